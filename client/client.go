@@ -0,0 +1,126 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package client is a client for the API of a tmemes server.
+//
+// The methods of a Client correspond to the endpoints described in
+// docs/api.md, and in the OpenAPI document the server publishes at
+// /static/openapi.json. Methods of the API without a typed method here, such
+// as the admin methods, can be called with Client.Call.
+//
+// A server identifies the caller by the tailnet node the request comes from,
+// so a client on a user's node needs no credentials. Clients without a user
+// identity, such as bots on tagged nodes, can set an API token.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A Client calls the API of a tmemes server.
+type Client struct {
+	// BaseURL is the base URL of the server, such as "http://tmemes".
+	BaseURL string
+
+	// Token, if set, is the secret of an API token to authenticate with.
+	Token string
+
+	// HTTPClient, if set, is used to send requests. It must not follow
+	// redirects, since uploading a template redirects to a page of the UI.
+	// If nil, a client with a timeout of one minute is used.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// defaultHTTPClient does not follow redirects, since uploading a template
+// redirects to the page for creating a macro from it.
+var defaultHTTPClient = &http.Client{
+	Timeout: time.Minute,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// An Error is an error reported by the server.
+type Error struct {
+	Method     string
+	Path       string
+	Status     string // e.g., "404 Not Found"
+	StatusCode int
+	Message    string // the body of the response, which is usually text
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %s: %s", e.Method, e.Path, e.Status, e.Message)
+}
+
+// Do sends a request to the API method at path, which must begin with "/",
+// with the given body and content type, and returns the response. If the
+// server reports an error, Do closes the response and returns an *Error.
+func (c *Client) Do(ctx context.Context, method, path, ctype string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = defaultHTTPClient
+	}
+	rsp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode >= 400 {
+		defer rsp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 4<<10))
+		return nil, &Error{
+			Method:     method,
+			Path:       path,
+			Status:     rsp.Status,
+			StatusCode: rsp.StatusCode,
+			Message:    strings.TrimSpace(string(msg)),
+		}
+	}
+	return rsp, nil
+}
+
+// Call sends a request to the API method at path, with in encoded as JSON if
+// it is non-nil, and decodes the JSON result into out if it is non-nil.
+func (c *Client) Call(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	var ctype string
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, ctype = bytes.NewReader(data), "application/json"
+	}
+	rsp, err := c.Do(ctx, method, path, ctype, body)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if out == nil {
+		_, err := io.Copy(io.Discard, rsp.Body)
+		return err
+	}
+	return json.NewDecoder(rsp.Body).Decode(out)
+}
@@ -0,0 +1,186 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/tailscale/tmemes"
+)
+
+// A MacroList is a page of macros.
+type MacroList struct {
+	Macros []*tmemes.Macro `json:"macros"`
+	Total  int             `json:"total"` // of all pages
+	IsLast bool            `json:"isLast,omitempty"`
+}
+
+// A BatchResult reports the outcome of creating a batch of macros.
+type BatchResult struct {
+	Created bool        `json:"created"` // all or none are created
+	Results []BatchItem `json:"results"` // one per macro, in order
+}
+
+// BatchItem is the result for one macro of a batch: the filled-in macro if
+// it was created, or else the error if it was invalid.
+type BatchItem struct {
+	Macro *tmemes.Macro `json:"macro,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// A Variant reports the votes on one caption variant of a macro.
+type Variant struct {
+	TextOverlay []tmemes.TextLine `json:"textOverlay"`
+	Upvotes     int               `json:"upvotes"`
+	Downvotes   int               `json:"downvotes"`
+	Winner      bool              `json:"winner,omitempty"`
+}
+
+// ExistingMacros reports the macros whose text matches a caption hash.
+type ExistingMacros struct {
+	Exists bool            `json:"exists"`
+	Macros []*tmemes.Macro `json:"macros"` // newest first
+}
+
+// NSFW reports whether a macro or template is marked NSFW.
+type NSFW struct {
+	NSFW bool `json:"nsfw"`
+
+	// Template reports whether the template of a macro is marked, which also
+	// blurs the macro. It is only set for macros.
+	Template bool `json:"template,omitempty"`
+}
+
+// PublicLink reports whether a macro is shared publicly.
+type PublicLink struct {
+	Public bool   `json:"public"`
+	URL    string `json:"url,omitempty"` // set for a public macro
+}
+
+// Macros lists the macros on the server.
+func (c *Client) Macros(ctx context.Context, opts *ListOptions) (*MacroList, error) {
+	var out MacroList
+	if err := c.Call(ctx, "GET", "/api/macro"+opts.query(), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Macro returns the macro with the given ID.
+func (c *Client) Macro(ctx context.Context, id int) (*tmemes.Macro, error) {
+	return c.macro(ctx, "GET", fmt.Sprintf("/api/macro/%d", id), nil)
+}
+
+// CreateMacro creates m, and returns the new macro. To create it without
+// attribution, set its Creator to -1.
+func (c *Client) CreateMacro(ctx context.Context, m *tmemes.Macro) (*tmemes.Macro, error) {
+	return c.macro(ctx, "POST", "/api/macro", m)
+}
+
+// CreateMacros creates the macros in ms, all or none of them. If none was
+// created, it returns the result along with the error, so that the caller can
+// tell which of the macros were invalid.
+func (c *Client) CreateMacros(ctx context.Context, ms []*tmemes.Macro) (*BatchResult, error) {
+	var out BatchResult
+	err := c.Call(ctx, "POST", "/api/macro/batch", ms, &out)
+	var e *Error
+	if errors.As(err, &e) && json.Unmarshal([]byte(e.Message), &out) == nil {
+		return &out, err
+	} else if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// EditMacro replaces the text of the macro with the given ID, and returns the
+// macro.
+func (c *Client) EditMacro(ctx context.Context, id int, text []tmemes.TextLine) (*tmemes.Macro, error) {
+	return c.macro(ctx, "PUT", fmt.Sprintf("/api/macro/%d", id), struct {
+		T []tmemes.TextLine `json:"textOverlay"`
+	}{T: text})
+}
+
+// DeleteMacro deletes the macro with the given ID, and returns it.
+func (c *Client) DeleteMacro(ctx context.Context, id int) (*tmemes.Macro, error) {
+	return c.macro(ctx, "DELETE", fmt.Sprintf("/api/macro/%d", id), nil)
+}
+
+// MacroVariants reports the votes on each caption variant of the macro with
+// the given ID, in order.
+func (c *Client) MacroVariants(ctx context.Context, id int) ([]*Variant, error) {
+	var out []*Variant
+	if err := c.Call(ctx, "GET", fmt.Sprintf("/api/macro/%d/variants", id), nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ExistingMacros reports the macros on the given template whose text has the
+// given hash, as computed by tmemes.CaptionHash.
+func (c *Client) ExistingMacros(ctx context.Context, templateID int, hash string) (*ExistingMacros, error) {
+	q := url.Values{"templateID": {strconv.Itoa(templateID)}, "hash": {hash}}
+	var out ExistingMacros
+	if err := c.Call(ctx, "GET", "/api/macro/exists"+encodeQuery(q), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateContext changes the context links of the macro with the given ID, and
+// returns the macro.
+func (c *Client) UpdateContext(ctx context.Context, id int, req *tmemes.ContextRequest) (*tmemes.Macro, error) {
+	return c.macro(ctx, "POST", fmt.Sprintf("/api/context/%d", id), req)
+}
+
+// MacroNSFW reports whether the macro with the given ID, or its template, is
+// marked NSFW.
+func (c *Client) MacroNSFW(ctx context.Context, id int) (*NSFW, error) {
+	return c.macroNSFW(ctx, "GET", id, nil)
+}
+
+// SetMacroNSFW marks the macro with the given ID NSFW, or clears the mark.
+func (c *Client) SetMacroNSFW(ctx context.Context, id int, nsfw bool) (*NSFW, error) {
+	return c.macroNSFW(ctx, "PUT", id, NSFW{NSFW: nsfw})
+}
+
+func (c *Client) macroNSFW(ctx context.Context, method string, id int, in any) (*NSFW, error) {
+	var out NSFW
+	if err := c.Call(ctx, method, fmt.Sprintf("/api/macro/%d/nsfw", id), in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// MacroPublic reports whether the macro with the given ID is shared publicly.
+func (c *Client) MacroPublic(ctx context.Context, id int) (*PublicLink, error) {
+	return c.macroPublic(ctx, "GET", id, nil)
+}
+
+// SetMacroPublic shares the macro with the given ID publicly, or stops
+// sharing it, and reports its public link.
+func (c *Client) SetMacroPublic(ctx context.Context, id int, public bool) (*PublicLink, error) {
+	return c.macroPublic(ctx, "PUT", id, PublicLink{Public: public})
+}
+
+func (c *Client) macroPublic(ctx context.Context, method string, id int, in any) (*PublicLink, error) {
+	var out PublicLink
+	if err := c.Call(ctx, method, fmt.Sprintf("/api/macro/%d/public", id), in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// macro calls a method that reports a macro.
+func (c *Client) macro(ctx context.Context, method, path string, in any) (*tmemes.Macro, error) {
+	var out tmemes.Macro
+	if err := c.Call(ctx, method, path, in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/tailscale/tmemes"
+)
+
+// Fonts reports the fonts available for text lines.
+type Fonts struct {
+	Default string `json:"default"` // the name of the default font
+	Fonts   []Font `json:"fonts"`
+}
+
+// A Font is a font available for text lines.
+type Font struct {
+	Name        string `json:"name"` // as used in tmemes.TextLine
+	Description string `json:"description"`
+}
+
+// Limits reports the limits of the server on template uploads.
+type Limits struct {
+	Formats      []string         `json:"formats"`                // file extensions
+	AudioFormats []string         `json:"audioFormats,omitempty"` // if audio templates are enabled
+	VideoFormats []string         `json:"videoFormats,omitempty"` // if video templates are enabled
+	MaxBytes     map[string]int64 `json:"maxBytes"`               // "static", "gif", "audio", and "video"
+	GIF          GIFLimits        `json:"gif"`
+
+	// The maximum length of a video clip for a template, in seconds, or 0
+	// for none.
+	MaxVideoSeconds int `json:"maxVideoSeconds,omitempty"`
+}
+
+// GIFLimits are the limits on animated templates. A limit of 0 means none.
+type GIFLimits struct {
+	MaxFrames     int   `json:"maxFrames"`
+	MaxDurationMS int64 `json:"maxDurationMS"`
+	Downsample    bool  `json:"downsample"` // drop frames rather than reject
+}
+
+// A PalettePreset is a named set of colors offered by the UI.
+type PalettePreset struct {
+	Name   string         `json:"name"`
+	Colors []tmemes.Color `json:"colors"`
+}
+
+// Categories lists the template categories, by name.
+func (c *Client) Categories(ctx context.Context) ([]*tmemes.Category, error) {
+	var out struct {
+		C []*tmemes.Category `json:"categories"`
+	}
+	if err := c.Call(ctx, "GET", "/api/category", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.C, nil
+}
+
+// SetCategory creates or updates the named category, and returns it. Only
+// admins can use it.
+func (c *Client) SetCategory(ctx context.Context, name, description string) (*tmemes.Category, error) {
+	var out tmemes.Category
+	if err := c.Call(ctx, "PUT", "/api/category/"+url.PathEscape(name), struct {
+		D string `json:"description"`
+	}{D: description}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteCategory deletes the named category, leaving its templates
+// uncategorized. Only admins can use it.
+func (c *Client) DeleteCategory(ctx context.Context, name string) error {
+	return c.Call(ctx, "DELETE", "/api/category/"+url.PathEscape(name), nil, nil)
+}
+
+// Fonts reports the fonts available for text lines.
+func (c *Client) Fonts(ctx context.Context) (*Fonts, error) {
+	var out Fonts
+	if err := c.Call(ctx, "GET", "/api/fonts", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Limits reports the limits of the server on template uploads.
+func (c *Client) Limits(ctx context.Context) (*Limits, error) {
+	var out Limits
+	if err := c.Call(ctx, "GET", "/api/limits", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Palette reports the color presets offered by the UI.
+func (c *Client) Palette(ctx context.Context) ([]*PalettePreset, error) {
+	var out struct {
+		P []*PalettePreset `json:"presets"`
+	}
+	if err := c.Call(ctx, "GET", "/api/palette", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.P, nil
+}
+
+// Branding reports the name, logo, and colors of the server.
+func (c *Client) Branding(ctx context.Context) (*tmemes.Branding, error) {
+	var out tmemes.Branding
+	if err := c.Call(ctx, "GET", "/api/branding", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
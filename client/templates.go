@@ -0,0 +1,232 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+
+	"github.com/tailscale/tmemes"
+)
+
+// ListOptions are the options for listing macros or templates. The zero
+// value lists all of them, in the default order.
+type ListOptions struct {
+	Page          int    // from 1; 0 lists all the results, unpaged
+	Count         int    // per page; 0 means the server's default
+	Sort          string // see "Sorting" in docs/api.md
+	Creator       string // a user ID, or "anon" for unattributed items
+	Category      string // templates only
+	ExpandCreator bool   // report the name and avatar URL of creators
+}
+
+func (o *ListOptions) query() string {
+	if o == nil {
+		return ""
+	}
+	q := make(url.Values)
+	if o.Page > 0 {
+		q.Set("page", strconv.Itoa(o.Page))
+	}
+	if o.Count > 0 {
+		q.Set("count", strconv.Itoa(o.Count))
+	}
+	if o.Sort != "" {
+		q.Set("sort", o.Sort)
+	}
+	if o.Creator != "" {
+		q.Set("creator", o.Creator)
+	}
+	if o.Category != "" {
+		q.Set("category", o.Category)
+	}
+	if o.ExpandCreator {
+		q.Set("expand", "creator")
+	}
+	return encodeQuery(q)
+}
+
+// encodeQuery returns q as the query of a URL, with its "?", or "" if q is
+// empty.
+func encodeQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
+
+// A TemplateList is a page of templates.
+type TemplateList struct {
+	Templates []*tmemes.Template `json:"templates"`
+	Total     int                `json:"total"` // of all pages
+	IsLast    bool               `json:"isLast,omitempty"`
+}
+
+// A SimilarTemplate is a template that looks like a reference image.
+type SimilarTemplate struct {
+	*tmemes.Template
+	Distance int `json:"distance"` // 0 means perceptually identical
+}
+
+// A TemplateUpload is a request to create a template.
+type TemplateUpload struct {
+	Name     string `json:"name"`
+	Category string `json:"category,omitempty"`
+	Anon     bool   `json:"anon,omitempty"`
+
+	// URL, if set, is the address of an image for the server to fetch.
+	// Otherwise, Image is uploaded, with Filename naming its format.
+	URL      string    `json:"url,omitempty"`
+	Filename string    `json:"-"`
+	Image    io.Reader `json:"-"`
+}
+
+// A TemplateEdit is a change to a template. Fields left nil are unchanged.
+type TemplateEdit struct {
+	Name        *string        `json:"name,omitempty"`
+	Description *string        `json:"description,omitempty"`
+	Areas       *[]tmemes.Area `json:"areas,omitempty"`
+	Category    *string        `json:"category,omitempty"` // "" to remove
+}
+
+// Templates lists the templates on the server.
+func (c *Client) Templates(ctx context.Context, opts *ListOptions) (*TemplateList, error) {
+	var out TemplateList
+	if err := c.Call(ctx, "GET", "/api/template"+opts.query(), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Template returns the template with the given ID.
+func (c *Client) Template(ctx context.Context, id int) (*tmemes.Template, error) {
+	return c.template(ctx, "GET", fmt.Sprintf("/api/template/%d", id), nil)
+}
+
+// UploadTemplate creates a template, and returns it.
+func (c *Client) UploadTemplate(ctx context.Context, up *TemplateUpload) (*tmemes.Template, error) {
+	var body bytes.Buffer
+	var ctype string
+	if up.Image == nil {
+		if err := json.NewEncoder(&body).Encode(up); err != nil {
+			return nil, err
+		}
+		ctype = "application/json"
+	} else {
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("name", up.Name)
+		mw.WriteField("anon", strconv.FormatBool(up.Anon))
+		if up.Category != "" {
+			mw.WriteField("category", up.Category)
+		}
+		part, err := mw.CreateFormFile("image", path.Base(up.Filename))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(part, up.Image); err != nil {
+			return nil, err
+		}
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+		ctype = mw.FormDataContentType()
+	}
+	rsp, err := c.Do(ctx, "POST", "/api/template", ctype, &body)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body.Close()
+
+	// On success, the server redirects to /create/:id for the new template.
+	id, err := strconv.Atoi(path.Base(rsp.Header.Get("Location")))
+	if rsp.StatusCode != http.StatusFound || err != nil {
+		return nil, errors.New("unexpected response to template upload")
+	}
+	return c.Template(ctx, id)
+}
+
+// EditTemplate changes the template with the given ID, and returns it.
+func (c *Client) EditTemplate(ctx context.Context, id int, ed TemplateEdit) (*tmemes.Template, error) {
+	return c.template(ctx, "PATCH", fmt.Sprintf("/api/template/%d", id), ed)
+}
+
+// SetTemplateAreas replaces the areas of the template with the given ID, and
+// returns the template.
+func (c *Client) SetTemplateAreas(ctx context.Context, id int, areas []tmemes.Area) (*tmemes.Template, error) {
+	if areas == nil {
+		areas = []tmemes.Area{}
+	}
+	return c.template(ctx, "PATCH", fmt.Sprintf("/api/template/%d/areas", id), struct {
+		A []tmemes.Area `json:"areas"`
+	}{A: areas})
+}
+
+// SetTemplateCategory moves the template with the given ID to the named
+// category, or out of its category if name is "", and returns the template.
+func (c *Client) SetTemplateCategory(ctx context.Context, id int, name string) (*tmemes.Template, error) {
+	return c.template(ctx, "PATCH", fmt.Sprintf("/api/template/%d/category", id), struct {
+		C string `json:"category"`
+	}{C: name})
+}
+
+// TransferTemplate gives the template with the given ID to the user with the
+// given login name, and returns the template.
+func (c *Client) TransferTemplate(ctx context.Context, id int, login, reason string) (*tmemes.Template, error) {
+	return c.template(ctx, "POST", fmt.Sprintf("/api/template/%d/transfer", id), struct {
+		L string `json:"login"`
+		R string `json:"reason,omitempty"`
+	}{L: login, R: reason})
+}
+
+// DeleteTemplate deletes the template with the given ID, and returns it.
+func (c *Client) DeleteTemplate(ctx context.Context, id int) (*tmemes.Template, error) {
+	return c.template(ctx, "DELETE", fmt.Sprintf("/api/template/%d", id), nil)
+}
+
+// TemplateNSFW reports whether the template with the given ID is marked NSFW.
+func (c *Client) TemplateNSFW(ctx context.Context, id int) (bool, error) {
+	var out NSFW
+	err := c.Call(ctx, "GET", fmt.Sprintf("/api/template/%d/nsfw", id), nil, &out)
+	return out.NSFW, err
+}
+
+// SetTemplateNSFW marks the template with the given ID NSFW, or clears the
+// mark.
+func (c *Client) SetTemplateNSFW(ctx context.Context, id int, nsfw bool) error {
+	return c.Call(ctx, "PUT", fmt.Sprintf("/api/template/%d/nsfw", id), NSFW{NSFW: nsfw}, nil)
+}
+
+// SimilarTemplates returns up to count templates that look like the one with
+// the given ID, closest first. If count is 0, the server chooses.
+func (c *Client) SimilarTemplates(ctx context.Context, id, count int) ([]*SimilarTemplate, error) {
+	q := make(url.Values)
+	if count > 0 {
+		q.Set("count", strconv.Itoa(count))
+	}
+	var out struct {
+		T []*SimilarTemplate `json:"templates"`
+	}
+	if err := c.Call(ctx, "GET", fmt.Sprintf("/api/template/%d/similar", id)+encodeQuery(q), nil, &out); err != nil {
+		return nil, err
+	}
+	return out.T, nil
+}
+
+// template calls a method that reports a template.
+func (c *Client) template(ctx context.Context, method, path string, in any) (*tmemes.Template, error) {
+	var out tmemes.Template
+	if err := c.Call(ctx, method, path, in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,258 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/tailcfg"
+)
+
+// A MacroVote is the vote of a user on a macro: -1 (downvote), 0 (unvoted),
+// or 1 (upvote).
+type MacroVote struct {
+	MacroID int `json:"macroID"`
+	Vote    int `json:"vote"`
+}
+
+// VoteList reports the non-zero votes of a user.
+type VoteList struct {
+	UserID tailcfg.UserID `json:"userID"`
+	Votes  []MacroVote    `json:"votes"` // by macro ID
+}
+
+// SearchResult reports the macros and templates matching a search.
+type SearchResult struct {
+	Macros    []*tmemes.Macro    `json:"macros"`    // best match first
+	Templates []*tmemes.Template `json:"templates"` // best match first
+}
+
+// A Leaderboard reports the top macros and creators over a period.
+type Leaderboard struct {
+	Period   string                `json:"period"`
+	Macros   []*tmemes.Macro       `json:"macros"`
+	Creators []*LeaderboardCreator `json:"creators"`
+}
+
+// A LeaderboardCreator is an entry of a Leaderboard.
+type LeaderboardCreator struct {
+	UserID    tailcfg.UserID `json:"userID"`
+	Name      string         `json:"name"`
+	Macros    int            `json:"macros"`
+	Upvotes   int            `json:"upvotes"`
+	Downvotes int            `json:"downvotes"`
+	Score     int            `json:"score"` // upvotes - downvotes
+	Karma     int            `json:"karma"` // score of all their macros, of all time
+}
+
+// A UserProfile is the profile of a creator.
+type UserProfile struct {
+	UserID    tailcfg.UserID     `json:"userID"`
+	Name      string             `json:"name"`
+	AvatarURL string             `json:"avatarURL,omitempty"`
+	Karma     *int               `json:"karma,omitempty"` // nil if the user is off leaderboards
+	Macros    []*tmemes.Macro    `json:"macros"`          // newest first
+	Templates []*tmemes.Template `json:"templates"`       // newest first
+}
+
+// Stats reports how often a macro or template has been viewed and rendered.
+type Stats struct {
+	ID         int   `json:"id"`
+	Views      int64 `json:"views"`
+	Renders    int64 `json:"renders"`
+	MacroViews int64 `json:"macroViews,omitempty"` // templates only
+}
+
+// A TokenRequest is a request to issue an API token.
+type TokenRequest struct {
+	Name      string   `json:"name,omitempty"`
+	Scopes    []string `json:"scopes"`              // see tmemes.ValidScope
+	ExpiresIn string   `json:"expiresIn,omitempty"` // a duration such as "720h"
+}
+
+// A NewToken is an API token just issued, with its secret. The secret cannot
+// be retrieved later.
+type NewToken struct {
+	*tmemes.APIToken
+	Secret string `json:"secret"`
+}
+
+// A QueuedReport is a report awaiting review by the moderators.
+type QueuedReport struct {
+	*tmemes.Report
+	PreviewURL string `json:"previewURL"`
+}
+
+// Votes reports the non-zero votes of the caller.
+func (c *Client) Votes(ctx context.Context) (*VoteList, error) {
+	var out VoteList
+	if err := c.Call(ctx, "GET", "/api/vote", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Vote reports the vote of the caller on the macro with the given ID.
+func (c *Client) Vote(ctx context.Context, id int) (int, error) {
+	var out MacroVote
+	err := c.Call(ctx, "GET", fmt.Sprintf("/api/vote/%d", id), nil, &out)
+	return out.Vote, err
+}
+
+// SetVote sets the vote of the caller on the macro with the given ID to vote:
+// 1 to upvote, -1 to downvote, or 0 to clear the vote. It returns the macro.
+func (c *Client) SetVote(ctx context.Context, id, vote int) (*tmemes.Macro, error) {
+	switch vote {
+	case 1:
+		return c.macro(ctx, "PUT", fmt.Sprintf("/api/vote/%d/up", id), nil)
+	case -1:
+		return c.macro(ctx, "PUT", fmt.Sprintf("/api/vote/%d/down", id), nil)
+	case 0:
+		return c.macro(ctx, "DELETE", fmt.Sprintf("/api/vote/%d", id), nil)
+	default:
+		return nil, fmt.Errorf("invalid vote %d", vote)
+	}
+}
+
+// Search returns up to count macros and templates matching query. If count
+// is 0, the server chooses.
+func (c *Client) Search(ctx context.Context, query string, count int) (*SearchResult, error) {
+	q := url.Values{"q": {query}}
+	if count > 0 {
+		q.Set("count", strconv.Itoa(count))
+	}
+	var out SearchResult
+	if err := c.Call(ctx, "GET", "/api/search"+encodeQuery(q), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Leaderboard reports up to count top macros and creators over period, which
+// is "day", "week", "month", or "all". If period is "" or count is 0, the
+// server chooses.
+func (c *Client) Leaderboard(ctx context.Context, period string, count int) (*Leaderboard, error) {
+	q := make(url.Values)
+	if period != "" {
+		q.Set("period", period)
+	}
+	if count > 0 {
+		q.Set("count", strconv.Itoa(count))
+	}
+	var out Leaderboard
+	if err := c.Call(ctx, "GET", "/api/leaderboard"+encodeQuery(q), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// User returns the profile of the creator with the given ID.
+func (c *Client) User(ctx context.Context, id tailcfg.UserID) (*UserProfile, error) {
+	var out UserProfile
+	if err := c.Call(ctx, "GET", fmt.Sprintf("/api/user/%d", id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// MacroStats reports the views and renders of the macro with the given ID.
+func (c *Client) MacroStats(ctx context.Context, id int) (*Stats, error) {
+	return c.stats(ctx, fmt.Sprintf("/api/stats/macro/%d", id))
+}
+
+// TemplateStats reports the views of the template with the given ID, and the
+// views and renders of its macros.
+func (c *Client) TemplateStats(ctx context.Context, id int) (*Stats, error) {
+	return c.stats(ctx, fmt.Sprintf("/api/stats/template/%d", id))
+}
+
+func (c *Client) stats(ctx context.Context, path string) (*Stats, error) {
+	var out Stats
+	if err := c.Call(ctx, "GET", path, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Prefs returns the preferences of the caller.
+func (c *Client) Prefs(ctx context.Context) (*tmemes.UserPrefs, error) {
+	return c.prefs(ctx, "GET", nil)
+}
+
+// SetPrefs replaces the preferences of the caller, and returns them.
+func (c *Client) SetPrefs(ctx context.Context, p *tmemes.UserPrefs) (*tmemes.UserPrefs, error) {
+	return c.prefs(ctx, "PUT", p)
+}
+
+func (c *Client) prefs(ctx context.Context, method string, in any) (*tmemes.UserPrefs, error) {
+	var out tmemes.UserPrefs
+	if err := c.Call(ctx, method, "/api/prefs", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Tokens lists the API tokens of the caller.
+func (c *Client) Tokens(ctx context.Context) ([]*tmemes.APIToken, error) {
+	var out []*tmemes.APIToken
+	if err := c.Call(ctx, "GET", "/api/token", nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CreateToken issues an API token to the caller.
+func (c *Client) CreateToken(ctx context.Context, req *TokenRequest) (*NewToken, error) {
+	var out NewToken
+	if err := c.Call(ctx, "POST", "/api/token", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RevokeToken revokes the API token of the caller with the given ID.
+func (c *Client) RevokeToken(ctx context.Context, id int) error {
+	return c.Call(ctx, "DELETE", fmt.Sprintf("/api/token/%d", id), nil, nil)
+}
+
+// Report reports the macro or template (as kind) with the given ID to the
+// moderators.
+func (c *Client) Report(ctx context.Context, kind string, id int, reason string) (*tmemes.Report, error) {
+	var out tmemes.Report
+	if err := c.Call(ctx, "POST", fmt.Sprintf("/api/report/%s/%d", kind, id), struct {
+		R string `json:"reason"`
+	}{R: reason}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Reports lists the reports awaiting review. Only moderators can use it.
+func (c *Client) Reports(ctx context.Context) ([]*QueuedReport, error) {
+	var out struct {
+		R []*QueuedReport `json:"reports"`
+	}
+	if err := c.Call(ctx, "GET", "/api/moderation", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.R, nil
+}
+
+// ResolveReport resolves the report with the given ID by action: "dismiss",
+// "hide", or (for admins) "delete". It returns the audit log entry recording
+// the decision.
+func (c *Client) ResolveReport(ctx context.Context, id int, action, reason string) (*tmemes.AuditEntry, error) {
+	var out tmemes.AuditEntry
+	if err := c.Call(ctx, "POST", fmt.Sprintf("/api/moderation/%d", id), struct {
+		A string `json:"action"`
+		R string `json:"reason"`
+	}{A: action, R: reason}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,49 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/client"
+)
+
+// findTemplate returns the template whose ID is key, or else the one whose
+// name is key, ignoring case.
+func findTemplate(ctx context.Context, c *client.Client, key string) (*tmemes.Template, error) {
+	if id, err := strconv.Atoi(key); err == nil {
+		return c.Template(ctx, id)
+	}
+	ts, err := c.Templates(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var found []*tmemes.Template
+	for _, t := range ts.Templates {
+		if strings.EqualFold(t.Name, key) {
+			found = append(found, t)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no template named %q", key)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("%d templates are named %q; use an ID instead", len(found), key)
+	}
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
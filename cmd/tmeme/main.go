@@ -0,0 +1,227 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Program tmeme is a command-line client for a tmemes server on the tailnet.
+//
+// Usage:
+//
+//	tmeme [flags] templates
+//	tmeme [flags] create <template> [--top "..."] [--bottom "..."] [--anon]
+//	tmeme [flags] upload <image-file> --name "..." [--anon]
+//	tmeme [flags] vote (up|down|clear) <macro-id>
+//
+// A template is given by its ID, or by its name if that is unique. The
+// caller is identified by the node it runs on, as for the web UI, or by an
+// API token given with --token.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/client"
+)
+
+var (
+	// The base URL of the server. MagicDNS resolves the bare hostname of the
+	// server on the tailnet.
+	serverURL = flag.String("server", envOr("TMEMES_SERVER", "http://tmemes"),
+		"Base URL of the tmemes server ($TMEMES_SERVER)")
+
+	// An API token, for callers without a user identity such as tagged nodes.
+	apiToken = flag.String("token", os.Getenv("TMEMES_TOKEN"),
+		"API token secret to authenticate with ($TMEMES_TOKEN)")
+)
+
+// commands maps subcommand names to their implementations. Each is passed the
+// client and the arguments following the subcommand name.
+var commands = map[string]func(context.Context, *client.Client, []string) error{
+	"templates": runTemplates,
+	"create":    runCreate,
+	"upload":    runUpload,
+	"vote":      runVote,
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %[1]s [flags] <command> [args]
+
+Commands:
+  templates                                   list templates
+  create <template> [--top ".."] [--bottom ".."] [--anon]
+                                              make a macro from a template
+  upload <image-file> --name ".." [--anon]    upload a new template
+  vote (up|down|clear) <macro-id>             vote on a macro
+
+Flags:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("tmeme: ")
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	run, ok := commands[flag.Arg(0)]
+	if !ok {
+		log.Printf("unknown command %q", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	c := client.New(*serverURL)
+	c.Token = *apiToken
+	if err := run(context.Background(), c, flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runTemplates(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("templates", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the templates as JSON")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	rsp, err := c.Templates(ctx, nil)
+	if err != nil {
+		return err
+	}
+	ts := rsp.Templates
+	if *asJSON {
+		return printJSON(ts)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSIZE\tAREAS")
+	for _, t := range ts {
+		var areas []string
+		for _, a := range t.Areas {
+			areas = append(areas, a.Name)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d×%d\t%s\n", t.ID, t.Name, t.Width, t.Height, strings.Join(areas, ", "))
+	}
+	return tw.Flush()
+}
+
+func runCreate(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	top := fs.String("top", "", "Text for the top of the image")
+	bottom := fs.String("bottom", "", "Text for the bottom of the image")
+	anon := fs.Bool("anon", false, "Create the macro without attribution")
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	overlay := tmemes.TopBottom(strings.TrimSpace(*top), strings.TrimSpace(*bottom))
+	if len(overlay) == 0 {
+		return fmt.Errorf("create: at least one of --top and --bottom is required")
+	}
+	t, err := findTemplate(ctx, c, pos[0])
+	if err != nil {
+		return err
+	}
+	m := &tmemes.Macro{TemplateID: t.ID, TextOverlay: overlay}
+	if *anon {
+		m.Creator = -1
+	}
+	m, err = c.CreateMacro(ctx, m)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created macro %d: %s/m/%d\n", m.ID, c.BaseURL, m.ID)
+	return nil
+}
+
+func runUpload(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	name := fs.String("name", "", "Descriptive name for the template (required)")
+	anon := fs.Bool("anon", false, "Upload the template without attribution")
+	pos, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(*name) == "" {
+		return fmt.Errorf("upload: --name is required")
+	}
+	f, err := os.Open(pos[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	t, err := c.UploadTemplate(ctx, &client.TemplateUpload{
+		Name:     strings.TrimSpace(*name),
+		Anon:     *anon,
+		Filename: filepath.Base(pos[0]),
+		Image:    f,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Uploaded template %d: %s/t/%d\n", t.ID, c.BaseURL, t.ID)
+	return nil
+}
+
+// voteValues maps the vote directions of the vote command to vote values.
+var voteValues = map[string]int{"up": 1, "down": -1, "clear": 0}
+
+func runVote(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("vote", flag.ExitOnError)
+	pos, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	dir := pos[0]
+	if _, ok := voteValues[dir]; !ok {
+		return fmt.Errorf("vote: direction must be up, down, or clear, not %q", dir)
+	}
+	id, err := strconv.Atoi(pos[1])
+	if err != nil || id <= 0 {
+		return fmt.Errorf("vote: invalid macro ID %q", pos[1])
+	}
+	if _, err := c.SetVote(ctx, id, voteValues[dir]); err != nil {
+		return err
+	}
+	if dir == "clear" {
+		fmt.Printf("Cleared your vote on macro %d\n", id)
+	} else {
+		fmt.Printf("Voted %s on macro %d\n", dir, id)
+	}
+	return nil
+}
+
+// parseArgs parses the flags in args with fs, allowing them to be mixed with
+// positional arguments, and returns the positional arguments. It reports an
+// error unless there are exactly want of them.
+func parseArgs(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(pos) != want {
+		return nil, fmt.Errorf("%s: expected %d arguments, got %d", fs.Name(), want, len(pos))
+	}
+	return pos, nil
+}
+
+func envOr(key, dflt string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return dflt
+}
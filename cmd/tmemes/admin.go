@@ -0,0 +1,305 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creachadair/mds/compare"
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+	"golang.org/x/exp/slices"
+	"tailscale.com/tailcfg"
+)
+
+// serveAPIAdminExport streams a bundle of the server's index and template
+// images, for backup or for moving the server to another host (see the
+// --import flag). Only server admins can export.
+//
+// API: GET /api/admin/export
+//
+// The result is a gzip-compressed tar archive with a manifest of checksums.
+func (s *tmemeServer) serveAPIAdminExport(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-export", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkAdmin(w, r, "export the store")
+	if whois == nil {
+		return // error already sent
+	}
+	name := fmt.Sprintf("tmemes-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if err := s.db.Export(w); err != nil {
+		// The response has likely begun, so all we can do is log the error
+		// and cut it short; the bundle will fail to verify on import.
+		log.Printf("export for %q failed: %v", whois.UserProfile.LoginName, err)
+		panic(http.ErrAbortHandler)
+	}
+	log.Printf("exported store for %q", whois.UserProfile.LoginName)
+}
+
+// logEvent records a routine action by a user in the audit log. The action
+// has already taken effect, so a failure to record it is logged but not
+// reported to the caller.
+func (s *tmemeServer) logEvent(actor tailcfg.UserID, action, kind string, targetID int) {
+	if err := s.db.LogEvent(actor, action, kind, targetID); err != nil {
+		log.Printf("WARNING: recording %s %s %d by user %d: %v", action, kind, targetID, actor, err)
+	}
+}
+
+// runImport unpacks the bundle at bundlePath into the store directory dir,
+// before the store is opened.
+func runImport(dir, bundlePath string) error {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := store.Import(dir, f); err != nil {
+		return err
+	}
+	log.Printf("Imported bundle %q into %q", bundlePath, dir)
+	return nil
+}
+
+// serveAPIAdminVotes implements bulk export and import of votes, for use when
+// migrating or merging servers. Only server admins can use these methods.
+//
+// API: GET /api/admin/votes  -- export all votes
+// API: POST /api/admin/votes -- import votes
+//
+// The export is {"votes":[...]}, where each element is a JSON tmemes.Vote.
+// The import payload has the same form, with an optional "macroMap" object
+// mapping macro IDs on the source server to macro IDs on this one. If a map is
+// given, votes for macros not in the map are skipped; otherwise macro IDs are
+// used as-is. Votes for unknown macros, and votes by users who have already
+// voted on the same macro here, are skipped.
+func (s *tmemeServer) serveAPIAdminVotes(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-votes", 1)
+	whois := s.checkAdmin(w, r, "migrate votes")
+	if whois == nil {
+		return // error already sent
+	}
+	var rsp any
+	switch r.Method {
+	case "GET":
+		votes, err := s.db.AllVotes()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rsp = struct {
+			V []tmemes.Vote `json:"votes"`
+		}{V: votes}
+
+	case "POST":
+		var req struct {
+			Votes    []tmemes.Vote `json:"votes"`
+			MacroMap map[int]int   `json:"macroMap"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		votes := req.Votes
+		if req.MacroMap != nil {
+			votes = remapVotes(votes, req.MacroMap)
+		}
+		n, err := s.db.ImportVotes(votes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+			Actor:  whois.UserProfile.ID,
+			Action: "import-votes",
+			Reason: fmt.Sprintf("imported %d of %d votes", n, len(req.Votes)),
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rsp = struct {
+			R int `json:"received"`
+			I int `json:"imported"`
+			S int `json:"skipped"`
+		}{R: len(req.Votes), I: n, S: len(req.Votes) - n}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAPIAdminOrphans implements finding the creators of content who are
+// no longer users of the tailnet, and reassigning or anonymizing their
+// content. Otherwise their templates and macros cannot be managed by anyone
+// but an admin, and are shown with placeholder names. Only server admins can
+// use these methods.
+//
+// API: GET /api/admin/orphans          -- list departed creators
+// API: POST /api/admin/orphans/:userID -- reassign a departed creator's content
+//
+// The list is {"orphans":[...]}, where each element gives the "userID" of a
+// creator, the "name" last recorded for them, and the number of "templates" and
+// "macros" they created. The POST payload must be a JSON object with an
+// "action", either "reassign" with the "login" of the new owner, or
+// "anonymize"; and optionally a "reason" to record in the audit log.
+func (s *tmemeServer) serveAPIAdminOrphans(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-orphans", 1)
+	whois := s.checkAdmin(w, r, "manage departed users")
+	if whois == nil {
+		return // error already sent
+	}
+	present, err := s.refreshUserProfiles(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var rsp any
+	switch r.Method {
+	case "GET":
+		if r.URL.Path != "/api/admin/orphans" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		rsp = struct {
+			O []orphanedCreator `json:"orphans"`
+		}{O: s.orphanedCreators(present)}
+
+	case "POST":
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/admin/orphans/"), 10, 64)
+		if err != nil || id <= 0 {
+			http.Error(w, "invalid user ID", http.StatusBadRequest)
+			return
+		}
+		uid := tailcfg.UserID(id)
+		if _, ok := present[uid]; ok {
+			http.Error(w, "user is still in the tailnet", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Action string `json:"action"`
+			Login  string `json:"login"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, toName := tailcfg.UserID(-1), "anonymous"
+		switch req.Action {
+		case "anonymize":
+		case "reassign":
+			up, err := s.userFromLogin(r.Context(), req.Login)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("unknown user %q", req.Login), http.StatusBadRequest)
+				return
+			}
+			to, toName = up.ID, up.LoginName
+		default:
+			http.Error(w, fmt.Sprintf("invalid action %q", req.Action), http.StatusBadRequest)
+			return
+		}
+
+		nt, nm, err := s.db.ReassignCreator(uid, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+			Actor:    whois.UserProfile.ID,
+			Action:   req.Action + "-content",
+			Kind:     "user",
+			TargetID: int(uid),
+			Reason:   strings.TrimSpace(fmt.Sprintf("%s (%d templates, %d macros to %s)", req.Reason, nt, nm, toName)),
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rsp = struct {
+			T int `json:"templates"`
+			M int `json:"macros"`
+		}{T: nt, M: nm}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// orphanedCreator describes a creator of content who is no longer a user of
+// the tailnet.
+type orphanedCreator struct {
+	UserID    tailcfg.UserID `json:"userID"`
+	Name      string         `json:"name,omitempty"` // as last recorded
+	Templates int            `json:"templates"`
+	Macros    int            `json:"macros"`
+}
+
+// orphanedCreators returns the creators of templates and macros who are not
+// among the present users, ordered by user ID.
+func (s *tmemeServer) orphanedCreators(present map[tailcfg.UserID]tailcfg.UserProfile) []orphanedCreator {
+	byUser := make(map[tailcfg.UserID]*orphanedCreator)
+	get := func(id tailcfg.UserID) *orphanedCreator {
+		if _, ok := present[id]; ok || id <= 0 {
+			return nil
+		}
+		c, ok := byUser[id]
+		if !ok {
+			c = &orphanedCreator{UserID: id, Name: s.db.CreatorName(id)}
+			byUser[id] = c
+		}
+		return c
+	}
+	for _, t := range s.db.AllTemplates() {
+		if c := get(t.Creator); c != nil {
+			c.Templates++
+		}
+	}
+	for _, m := range s.db.AllMacros() {
+		if c := get(m.Creator); c != nil {
+			c.Macros++
+		}
+	}
+	out := []orphanedCreator{}
+	for _, c := range byUser {
+		out = append(out, *c)
+	}
+	slices.SortFunc(out, compare.FromLessFunc(func(a, b orphanedCreator) bool {
+		return a.UserID < b.UserID
+	}))
+	return out
+}
+
+// remapVotes returns a copy of votes with macro IDs translated by idMap.
+// Votes for macros not in idMap are dropped.
+func remapVotes(votes []tmemes.Vote, idMap map[int]int) []tmemes.Vote {
+	var out []tmemes.Vote
+	for _, v := range votes {
+		if id, ok := idMap[v.MacroID]; ok {
+			v.MacroID = id
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -4,7 +4,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
@@ -15,13 +18,18 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creachadair/mds/compare"
@@ -29,6 +37,7 @@ import (
 	"github.com/tailscale/tmemes/memedraw"
 	"github.com/tailscale/tmemes/store"
 	"golang.org/x/exp/slices"
+	_ "golang.org/x/image/webp"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/metrics"
@@ -43,15 +52,35 @@ type tmemeServer struct {
 	srv            *tsnet.Server
 	lc             *tailscale.LocalClient
 	superUser      map[string]bool // logins of admin users
+	readOnlyTags   map[string]bool // tags of read-only service nodes
 	allowAnonymous bool
+	triggerToken   string             // if set, required for /api/trigger/
+	vapidKey       *ecdsa.PrivateKey  // if set, push notifications are enabled
+	packKey        ed25519.PrivateKey // for signing template packs
+	publicLinkKey  []byte             // if set, for signing public macro URLs
+	discordKey     ed25519.PublicKey  // if set, the key of the Discord app
+	limiter        *userLimiter       // if set, limits creation and voting
+	usage          *usageTracker      // requests and render time by user
+	trustedProxies []netip.Prefix     // proxies whose X-Forwarded-For is honored
+	palette        []palettePreset    // if nil, defaultPalette is used
 
 	macroGenerationSingleFlight singleflight.Group[string, string]
-	imageFileEtags              sync.Map // :: string(path) → string(quoted etag)
+	imageFileEtags              sync.Map   // :: string(path) → string(quoted etag)
+	packSyncMu                  sync.Mutex // serializes syncing of template packs
 
-	mu sync.Mutex // guards userProfiles
+	encoding atomic.Pointer[encodeSettings] // as set by admins; see encoding.go
 
-	userProfiles            map[tailcfg.UserID]tailcfg.UserProfile
+	mu sync.Mutex // guards the fields below
+
+	userProfiles            map[tailcfg.UserID]tailcfg.UserProfile // current users of the tailnet
+	knownProfiles           map[tailcfg.UserID]tailcfg.UserProfile // all users seen, persisted in the store
+	missingUsers            map[tailcfg.UserID]time.Time           // when lookups of unknown users failed
 	lastUpdatedUserProfiles time.Time
+	rerender                *rerenderJob                          // the latest bulk re-rendering job, or nil
+	trending                map[int]float64                       // scores for the "trending" sort, by macro ID
+	grantedCaps             map[tailcfg.UserID]tailcfg.PeerCapMap // tailnet grants last seen for each user
+	avatars                 map[tailcfg.UserID]*avatar            // cached profile pictures
+	uploads                 map[string]*upload                    // unfinished chunked uploads, by token
 }
 
 // initialize sets up the state of the server and checks the integrity of its
@@ -65,32 +94,63 @@ func (s *tmemeServer) initialize(ts *tsnet.Server) error {
 			s.superUser[u] = true
 		}
 	}
+	s.grantedCaps = make(map[tailcfg.UserID]tailcfg.PeerCapMap)
+	if *readOnlyTags != "" {
+		s.readOnlyTags = make(map[string]bool)
+		for _, tag := range strings.Split(*readOnlyTags, ",") {
+			s.readOnlyTags[strings.TrimSpace(tag)] = true
+		}
+	}
 
-	// Preload Etag values.
-	var numTags int
+	// Preload Etag values. Etags recorded by earlier runs are reused for files
+	// whose size and modification time have not changed, so only new or
+	// modified images are hashed. The Etag of a template image is its SHA-256
+	// digest, so record that for templates that predate content hashes.
+	var numTags, numHashed int
+	var lost []int // templates whose images are missing
 	for _, t := range s.db.Templates() {
 		tpath, _ := s.db.TemplatePath(t.ID)
-		tag, err := makeFileEtag(tpath)
-		if err != nil {
-			return err
-		}
-		s.imageFileEtags.Store(tpath, tag)
-		numTags++
-	}
-	for _, m := range s.db.Macros() {
-		cachePath, _ := s.db.CachePath(m)
-		tag, err := makeFileEtag(cachePath)
-		if os.IsNotExist(err) {
+		tag, err := s.fileEtag(tpath)
+		if errors.Is(err, fs.ErrNotExist) {
+			lost = append(lost, t.ID) // keep serving the rest
 			continue
 		} else if err != nil {
 			return err
 		}
-		s.imageFileEtags.Store(cachePath, tag)
+		s.imageFileEtags.Store(tpath, tag)
 		numTags++
+		if t.ContentHash == "" {
+			if err := s.db.SetTemplateContentHash(t.ID, strings.Trim(tag, `"`)); err != nil {
+				return err
+			}
+			numHashed++
+		}
 	}
 	log.Printf("Preloaded %d image Etags", numTags)
+	if numHashed > 0 {
+		log.Printf("Recorded content hashes for %d templates", numHashed)
+	}
+
+	// Load the user profiles saved by earlier runs, and keep them up to date.
+	known, err := s.db.UserProfiles()
+	if err != nil {
+		return err
+	}
+	s.knownProfiles = known
+	log.Printf("Loaded %d saved user profiles", len(known))
+	go s.refreshUserProfilesPeriodically()
+	go s.updateTrendingPeriodically()
+	s.startPrerendering(*prerenderWorkers)
+
+	// Compute image hashes for templates that predate them, and make sure the
+	// search index knows the names of creators.
+	go func() {
+		s.fillTemplateHashes()
+		s.indexCreatorNames()
+	}()
 
-	// Set up a metrics server.
+	// Set up a metrics server, including usage of the macro cache.
+	expvar.Publish("tmemes_macro_cache", expvar.Func(func() any { return s.db.CacheStats() }))
 	ln, err := ts.Listen("tcp", ":8383")
 	if err != nil {
 		return err
@@ -103,49 +163,190 @@ func (s *tmemeServer) initialize(ts *tsnet.Server) error {
 		http.Serve(ln, mux)
 	}()
 
+	// Load or create the signing key for push notifications, if enabled.
+	if *webPushContact != "" {
+		if err := s.loadVAPIDKey(); err != nil {
+			return err
+		}
+	}
+
+	removeStaleUploadFiles()
+	if err := s.loadEncodeSettings(); err != nil {
+		return err
+	}
+	if err := s.loadBranding(); err != nil {
+		return err
+	}
+
+	// Load or create the signing key for template packs, and keep
+	// subscriptions to packs from other servers up to date.
+	if err := s.loadPackKey(); err != nil {
+		return err
+	}
+	if *packSyncInterval > 0 {
+		go s.syncPacksPeriodically(*packSyncInterval)
+	}
+
+	// Deliver changes to macros to the webhooks registered by admins.
+	s.startWebhooks()
+
+	// Load or create the signing key for public macro URLs, if enabled.
+	if *serveFunnel {
+		if err := s.loadPublicLinkKey(); err != nil {
+			return err
+		}
+	}
+
+	// Alert the admins to any templates whose images are missing. This waits
+	// until push notifications are set up, so they can be used.
+	for _, id := range lost {
+		s.templateLost(id)
+	}
+
+	// Set up the email ingest listener, if enabled.
+	if *emailListen != "" {
+		eln, err := ts.Listen("tcp", *emailListen)
+		if err != nil {
+			return err
+		}
+		go s.serveEmail(eln)
+	}
+
 	return nil
 }
 
 var (
-	serveMetrics = &metrics.LabelMap{Label: "type"}
-	macroMetrics = &metrics.LabelMap{Label: "type"}
+	serveMetrics   = &metrics.LabelMap{Label: "type"}
+	macroMetrics   = &metrics.LabelMap{Label: "type"}
+	pushMetrics    = &metrics.LabelMap{Label: "type"}
+	webhookMetrics = &metrics.LabelMap{Label: "type"}
 )
 
 func init() {
 	expvar.Publish("tmemes_serve_metrics", serveMetrics)
 	expvar.Publish("tmemes_macro_metrics", macroMetrics)
+	expvar.Publish("tmemes_push_metrics", pushMetrics)
+	expvar.Publish("tmemes_webhook_metrics", webhookMetrics)
 }
 
 var errNotFound = errors.New("not found")
 
-// userFromID returns the user profile for the given user ID.  If the user
-// profile is not found, it will attempt to fetch the latest user profiles from
-// the tsnet server.
+const (
+	userRefreshInterval = 10 * time.Minute // how often to refresh user profiles
+	missingUserTTL      = time.Hour        // how long to remember unknown users
+)
+
+// userFromID returns the user profile for the given user ID. Users who have
+// left the tailnet are still found, if the server has seen them before. If the
+// user profile is not found, it will attempt to fetch the latest user profiles
+// from the tsnet server, unless it has done so recently or the same user was
+// not found within the last missingUserTTL.
 func (s *tmemeServer) userFromID(ctx context.Context, id tailcfg.UserID) (*tailcfg.UserProfile, error) {
 	s.mu.Lock()
-	up, ok := s.userProfiles[id]
+	up, ok := s.knownProfiles[id]
+	missed := s.missingUsers[id]
 	lastUpdated := s.lastUpdatedUserProfiles
 	s.mu.Unlock()
 	if ok {
 		return &up, nil
 	}
-	if time.Since(lastUpdated) < time.Minute {
+	if time.Since(missed) < missingUserTTL || time.Since(lastUpdated) < time.Minute {
 		return nil, errNotFound
 	}
+	if _, err := s.refreshUserProfiles(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if up, ok := s.knownProfiles[id]; ok {
+		return &up, nil
+	}
+	if s.missingUsers == nil {
+		s.missingUsers = make(map[tailcfg.UserID]time.Time)
+	}
+	s.missingUsers[id] = time.Now()
+	return nil, errNotFound
+}
+
+// refreshUserProfiles fetches the latest user profiles from the tsnet server,
+// and returns them. New and changed profiles are saved in the store.
+func (s *tmemeServer) refreshUserProfiles(ctx context.Context) (map[tailcfg.UserID]tailcfg.UserProfile, error) {
 	st, err := s.lc.Status(ctx)
 	if err != nil {
 		return nil, err
 	}
+	changed := make(map[tailcfg.UserID]tailcfg.UserProfile)
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.userProfiles = st.User
-	up, ok = s.userProfiles[id]
-	if !ok {
-		return nil, errNotFound
+	s.lastUpdatedUserProfiles = time.Now()
+	if s.knownProfiles == nil {
+		s.knownProfiles = make(map[tailcfg.UserID]tailcfg.UserProfile)
+	}
+	for id, up := range st.User {
+		if old, ok := s.knownProfiles[id]; !ok || !old.Equal(&up) {
+			s.knownProfiles[id] = up
+			changed[id] = up
+		}
+		delete(s.missingUsers, id)
+	}
+	s.mu.Unlock()
+	if len(changed) != 0 {
+		if err := s.db.SaveUserProfiles(changed); err != nil {
+			log.Printf("WARNING: saving user profiles: %v", err)
+		}
+	}
+	return st.User, nil
+}
+
+// refreshUserProfilesPeriodically keeps the user profiles of the server up to
+// date, so that lookups seldom need to wait for the tsnet server.
+func (s *tmemeServer) refreshUserProfilesPeriodically() {
+	t := time.NewTicker(userRefreshInterval)
+	defer t.Stop()
+	for {
+		if _, err := s.refreshUserProfiles(context.Background()); err != nil {
+			log.Printf("WARNING: refreshing user profiles: %v", err)
+		}
+		<-t.C
+	}
+}
+
+// userFromLogin returns the user profile for the given login name, compared
+// without regard to case, of a current user of the tailnet. If the login is
+// not found it will attempt to fetch the latest user profiles from the tsnet
+// server.
+func (s *tmemeServer) userFromLogin(ctx context.Context, login string) (*tailcfg.UserProfile, error) {
+	find := func() (*tailcfg.UserProfile, bool) {
+		for _, up := range s.userProfiles {
+			if strings.EqualFold(up.LoginName, login) {
+				return &up, true
+			}
+		}
+		return nil, false
+	}
+	s.mu.Lock()
+	up, ok := find()
+	s.mu.Unlock()
+	if ok {
+		return up, nil
+	}
+	if _, err := s.refreshUserProfiles(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if up, ok := find(); ok {
+		return up, nil
 	}
-	return &up, nil
+	return nil, errNotFound
 }
 
+// The OpenAPI document of the API, served as /static/openapi.json, is
+// generated from the API lines in the doc comments of the handlers. Update it
+// after changing an endpoint.
+//
+//go:generate go run ./internal/apigen -o static/openapi.json
+
 // newMux constructs a router for the tmemes API.
 //
 // There are three groups of endpoints:
@@ -155,17 +356,64 @@ func (s *tmemeServer) userFromID(ctx context.Context, id tailcfg.UserID) (*tailc
 //   - The rest of the endpoints serve UI components.
 func (s *tmemeServer) newMux() *http.ServeMux {
 	apiMux := http.NewServeMux()
-	apiMux.HandleFunc("/api/macro/", s.serveAPIMacro)       // one macro by ID
-	apiMux.HandleFunc("/api/macro", s.serveAPIMacro)        // all macros
-	apiMux.HandleFunc("/api/context/", s.serveAPIContext)   // add/remove context
-	apiMux.HandleFunc("/api/template/", s.serveAPITemplate) // one template by ID
-	apiMux.HandleFunc("/api/template", s.serveAPITemplate)  // all templates
-	apiMux.HandleFunc("/api/vote/", s.serveAPIVote)         // caller's vote by ID
-	apiMux.HandleFunc("/api/vote", s.serveAPIVote)          // all caller's votes
+	apiMux.HandleFunc("/api/macro/", s.serveAPIMacro)                               // one macro by ID
+	apiMux.HandleFunc("/api/macro", s.serveAPIMacro)                                // all macros
+	apiMux.HandleFunc("/api/context/", s.serveAPIContext)                           // add/remove context
+	apiMux.HandleFunc("/api/template/", s.serveAPITemplate)                         // one template by ID
+	apiMux.HandleFunc("/api/template", s.serveAPITemplate)                          // all templates
+	apiMux.HandleFunc("/api/vote/", s.serveAPIVote)                                 // caller's vote by ID
+	apiMux.HandleFunc("/api/vote", s.serveAPIVote)                                  // all caller's votes
+	apiMux.HandleFunc("/api/trigger/", s.serveAPITrigger)                           // polling triggers
+	apiMux.HandleFunc("/api/push/", s.serveAPIPush)                                 // push subscriptions
+	apiMux.HandleFunc("/api/report/", s.serveAPIReport)                             // report content
+	apiMux.HandleFunc("/api/moderation/", s.serveAPIModeration)                     // resolve a report
+	apiMux.HandleFunc("/api/moderation", s.serveAPIModeration)                      // moderation queue
+	apiMux.HandleFunc("/api/audit", s.serveAPIAudit)                                // audit log
+	apiMux.HandleFunc("/api/prefs", s.serveAPIPrefs)                                // caller's preferences
+	apiMux.HandleFunc("/api/chat/link", s.serveAPIChatLink)                         // link a chat account
+	apiMux.HandleFunc("/api/handle/", s.serveAPIHandleReset)                        // reset a user's handle
+	apiMux.HandleFunc("/api/leaderboard", s.serveAPILeaderboard)                    // top macros and creators
+	apiMux.HandleFunc("/api/stats/", s.serveAPIStats)                               // view and render counts
+	apiMux.HandleFunc("/api/search", s.serveAPISearch)                              // full-text search
+	apiMux.HandleFunc("/api/events", s.serveAPIEvents)                              // live macro changes
+	apiMux.HandleFunc("/api/admin/votes", s.serveAPIAdminVotes)                     // vote export/import
+	apiMux.HandleFunc("/api/admin/export", s.serveAPIAdminExport)                   // backup bundle
+	apiMux.HandleFunc("/api/admin/orphans/", s.serveAPIAdminOrphans)                // reassign content
+	apiMux.HandleFunc("/api/admin/orphans", s.serveAPIAdminOrphans)                 // departed creators
+	apiMux.HandleFunc("/api/admin/subscriptions", s.serveAPIAdminSubscriptions)     // pack subscriptions
+	apiMux.HandleFunc("/api/admin/webhooks/", s.serveAPIAdminWebhooks)              // remove a webhook
+	apiMux.HandleFunc("/api/admin/webhooks", s.serveAPIAdminWebhooks)               // list, add webhooks
+	apiMux.HandleFunc("/api/admin/macro/", s.serveAPIAdminMacro)                    // hide, lock, freeze votes
+	apiMux.HandleFunc("/api/admin/moderators/", s.serveAPIAdminModerators)          // remove a moderator
+	apiMux.HandleFunc("/api/admin/moderators", s.serveAPIAdminModerators)           // list, add moderators
+	apiMux.HandleFunc("/api/admin/rerender", s.serveAPIAdminRerender)               // bulk re-rendering
+	apiMux.HandleFunc("/api/admin/usage", s.serveAPIAdminUsage)                     // top consumers
+	apiMux.HandleFunc("/api/admin/templates/report", s.serveAPIAdminTemplateReport) // template health
+	apiMux.HandleFunc("/api/admin/branding", s.serveAPIAdminBranding)               // name, logo, colors
+	apiMux.HandleFunc("/api/admin/settings", s.serveAPIAdminSettings)               // encoder settings
+	apiMux.HandleFunc("/api/upload/", s.serveAPIUpload)                             // chunked template uploads
+	apiMux.HandleFunc("/api/pack/", s.serveAPIPack)                                 // one template pack
+	apiMux.HandleFunc("/api/pack", s.serveAPIPack)                                  // published packs
+	apiMux.HandleFunc("/api/category/", s.serveAPICategory)                         // one template category
+	apiMux.HandleFunc("/api/category", s.serveAPICategory)                          // template categories
+	apiMux.HandleFunc("/api/branding", s.serveAPIBranding)                          // name, logo, colors
+	apiMux.HandleFunc("/api/user/", s.serveAPIUser)                                 // creator profile
+	apiMux.HandleFunc("/api/limits", s.serveAPILimits)                              // upload limits
+	apiMux.HandleFunc("/api/fonts", s.serveAPIFonts)                                // available typefaces
+	apiMux.HandleFunc("/api/palette", s.serveAPIPalette)                            // color presets
+	apiMux.HandleFunc("/api/sticker/", s.serveAPISticker)                           // one sticker by ID
+	apiMux.HandleFunc("/api/sticker", s.serveAPISticker)                            // all stickers
+	apiMux.HandleFunc("/api/preview", s.serveAPIPreview)                            // render without saving
+	apiMux.HandleFunc("/api/preview/check", s.serveAPIPreviewCheck)                 // check without rendering
+	apiMux.HandleFunc("/api/token/", s.serveAPIToken)                               // revoke an API token
+	apiMux.HandleFunc("/api/token", s.serveAPIToken)                                // caller's API tokens
 
 	contentMux := http.NewServeMux()
 	contentMux.HandleFunc("/content/template/", s.serveContentTemplate)
 	contentMux.HandleFunc("/content/macro/", s.serveContentMacro)
+	contentMux.HandleFunc("/content/sticker/", s.serveContentSticker)
+	contentMux.HandleFunc("/content/preview/", s.serveContentPreview)
+	contentMux.HandleFunc("/content/avatar/", s.serveContentAvatar)
 
 	uiMux := http.NewServeMux()
 	uiMux.HandleFunc("/macros/", func(w http.ResponseWriter, r *http.Request) {
@@ -174,29 +422,44 @@ func (s *tmemeServer) newMux() *http.ServeMux {
 	uiMux.HandleFunc("/templates/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/t/"+r.URL.Path[len("/templates/"):], http.StatusFound)
 	})
-	uiMux.HandleFunc("/t/", s.serveUITemplates)   // view one template by ID
-	uiMux.HandleFunc("/t", s.serveUITemplates)    // view all templates
-	uiMux.HandleFunc("/create/", s.serveUICreate) // view create page for given template ID
-	uiMux.HandleFunc("/m/", s.serveUIMacros)      // view one macro by ID
-	uiMux.HandleFunc("/m", s.serveUIMacros)       // view all macros
-	uiMux.HandleFunc("/", s.serveUIMacros)        // alias for /macros/
-	uiMux.HandleFunc("/upload", s.serveUIUpload)  // template upload view
+	uiMux.HandleFunc("/t/", s.serveUITemplates)            // view one template by ID
+	uiMux.HandleFunc("/t", s.serveUITemplates)             // view all templates
+	uiMux.HandleFunc("/create/", s.serveUICreate)          // view create page for given template ID
+	uiMux.HandleFunc("/m/", s.serveUIMacros)               // view one macro by ID
+	uiMux.HandleFunc("/m", s.serveUIMacros)                // view all macros
+	uiMux.HandleFunc("/", s.serveUIMacros)                 // alias for /macros/
+	uiMux.HandleFunc("/upload", s.serveUIUpload)           // template upload view
+	uiMux.HandleFunc("/share", s.serveUIShare)             // web share target
+	uiMux.HandleFunc("/sw.js", s.serveServiceWorker)       // web app service worker
+	uiMux.HandleFunc("/moderation", s.serveUIModeration)   // moderation queue
+	uiMux.HandleFunc("/prefs", s.serveUIPrefs)             // user preferences
+	uiMux.HandleFunc(chatLinkPath, s.serveUIChatLink)      // link a chat account
+	uiMux.HandleFunc("/u/", s.serveUIUser)                 // creator profile by user ID
+	uiMux.HandleFunc("/leaderboard", s.serveUILeaderboard) // top macros and creators
 
 	mux := http.NewServeMux()
-	mux.Handle("/api/", apiMux)
-	mux.Handle("/content/", contentMux)
+	mux.Handle("/api/", s.trackUsage(apiMux, s.limitTaggedNodes(s.limitTokenReads(privateByDefault(apiMux)))))
+	mux.Handle("/content/", s.trackUsage(contentMux, s.limitTaggedNodes(s.limitTokenReads(contentMux))))
 	mux.Handle("/static/", http.FileServer(http.FS(staticFS)))
-	mux.Handle("/", uiMux)
+	mux.HandleFunc("/static/manifest.webmanifest", s.serveWebManifest)
+	mux.Handle("/", privateByDefault(uiMux))
 
 	return mux
 }
 
 // serveContentTemplate serves template image content.
 //
-// API: /content/template/:id[.ext]
+// API: /content/template/:id[.ext][?w=W][&h=H]
 //
 // A file extension is optional, but if .ext is included, it must match the
-// stored value.
+// stored value. For an audio template, the extension of its sound clip, or an
+// Accept header preferring audio, selects the clip instead of the image.
+//
+// If w and/or h is given, the image is scaled down (never up) to fit within
+// that many pixels, keeping its aspect ratio and format. See thumbs.go.
+//
+// If the template is marked NSFW, a blurred preview is served instead, unless
+// reveal=1 is given. See nsfw.go.
 func (s *tmemeServer) serveContentTemplate(w http.ResponseWriter, r *http.Request) {
 	serveMetrics.Add("content-template", 1)
 	const apiPath = "/content/template/"
@@ -218,6 +481,23 @@ func (s *tmemeServer) serveContentTemplate(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	t, err := s.db.AnyTemplate(idInt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if t.Audio != "" && ext == "" {
+		w.Header().Add("Vary", "Accept")
+	}
+	if wantsAudio(r, t, ext) {
+		s.serveTemplateAudio(w, r, t)
+		return
+	}
+	width, height, sized, err := thumbSize(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	tp, err := s.db.TemplatePath(idInt)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -229,17 +509,48 @@ func (s *tmemeServer) serveContentTemplate(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "wrong file extension", http.StatusBadRequest)
 		return
 	}
+	if _, err := os.Stat(tp); errors.Is(err, fs.ErrNotExist) {
+		s.templateLost(idInt)
+		writeRenderError(w, fmt.Errorf("template %d: %w", idInt, errTemplateLost))
+		return
+	}
+	if t.NSFW && !wantsReveal(r) {
+		s.serveBlurred(w, r, t)
+		return
+	}
+	s.db.CountTemplateView(idInt)
+	if sized {
+		s.serveTemplateThumb(w, r, t, width, height)
+		return
+	}
 
-	s.serveFileCached(w, r, tp, 365*24*time.Hour)
+	s.serveFileCached(w, r, tp, cacheControl(365*24*time.Hour, false))
 }
 
 // serveContentMacro serves macro image content. If the requested macro is not
 // already in the cache, it is rendered and cached before returning.
 //
-// API: /content/macro/:id[.ext]
+// API: /content/macro/:id[.ext][?variant=N][&w=W][&h=H]
+// API: /content/macro/:id/frame/:n[?variant=N]
 //
 // A file extension is optional, but if .ext is included, it must match the
-// file extension stored with the macro's template.
+// file extension of the generated image (see -webp-macros). If -ffmpeg is
+// set, macros on GIF templates may also be fetched as .mp4 or .webm video.
+// For a macro on an audio template, the sound clip of the template is
+// selected as for /content/template.
+//
+// If w and/or h is given, the image is scaled down to fit within that many
+// pixels, as for /content/template.
+//
+// The frame form renders only frame n (from 0) of an animated macro, as a PNG
+// still. For macros on still templates, only frame 0 exists.
+//
+// While a macro has a caption test running, each viewer is shown a consistent
+// variant of the caption. The variant parameter selects one explicitly.
+//
+// If the macro or its template is marked NSFW, a blurred preview of the
+// template is served instead of the image or frame, unless reveal=1 is
+// given; video is not served at all without it. See nsfw.go.
 func (s *tmemeServer) serveContentMacro(w http.ResponseWriter, r *http.Request) {
 	serveMetrics.Add("content-macro", 1)
 	const apiPath = "/content/macro/"
@@ -250,6 +561,10 @@ func (s *tmemeServer) serveContentMacro(w http.ResponseWriter, r *http.Request)
 
 	// Require /id or /id.ext
 	id := strings.TrimPrefix(r.URL.Path, apiPath)
+	if id, frame, ok := strings.Cut(id, "/frame/"); ok {
+		s.serveContentMacroFrame(w, r, id, frame)
+		return
+	}
 	if id == "" {
 		http.Error(w, "missing id", http.StatusBadRequest)
 		return
@@ -265,8 +580,47 @@ func (s *tmemeServer) serveContentMacro(w http.ResponseWriter, r *http.Request)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
+	} else if !s.canViewMacro(r, m) {
+		http.Error(w, fmt.Sprintf("macro %d not found", m.ID), http.StatusNotFound)
+		return
+	}
+	m, variant, cache, err := s.viewerVariant(r, m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t, err := s.db.AnyTemplate(m.TemplateID); err == nil && t.Audio != "" {
+		if ext == "" {
+			w.Header().Add("Vary", "Accept")
+		}
+		if wantsAudio(r, t, ext) {
+			s.serveTemplateAudio(w, r, t)
+			return
+		}
+	}
+	width, height, sized, err := thumbSize(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := store.CacheKey{Variant: variant}
+	vf, isVideo := videoFormats[ext]
+	if isVideo && sized {
+		http.Error(w, "thumbnails are not available as video", http.StatusBadRequest)
+		return
+	}
+	if isVideo && *ffmpegPath != "" {
+		t, err := s.db.AnyTemplate(m.TemplateID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if filepath.Ext(t.Path) != ".gif" {
+			http.Error(w, "video is only available for animated GIF macros", http.StatusBadRequest)
+			return
+		}
+		key.Ext = ext
 	}
-	cachePath, err := s.db.CachePath(m)
+	cachePath, err := s.db.MacroCachePath(m, key)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -278,45 +632,328 @@ func (s *tmemeServer) serveContentMacro(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "wrong file extension", http.StatusBadRequest)
 		return
 	}
+	if t, err := s.db.AnyTemplate(m.TemplateID); err == nil && isNSFW(m, t) && !wantsReveal(r) {
+		if isVideo {
+			http.Error(w, "macro is marked NSFW; use reveal=1 to see it", http.StatusForbidden)
+			return
+		}
+		s.serveBlurred(w, r, t)
+		return
+	}
+	es, encoding, err := s.encodeOverride(r.URL.Query(), filepath.Ext(cachePath))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if encoding != "" {
+		key.Encoding = encoding
+		if cachePath, err = s.db.MacroCachePath(m, key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if isVideo {
+		// The standard library does not know these types.
+		w.Header().Set("Content-Type", vf.mimeType)
+	}
+	s.db.CountMacroView(m.ID)
+	if sized {
+		s.serveMacroThumb(w, r, m, key, es, cache, width, height)
+		return
+	}
+
+	// The Etag for a rendering does not depend on the cached file, so if the
+	// caller already has the current image we do not need to render it again,
+	// even if the file has been cleaned up since.
+	tag, err := s.macroEtag(m, cachePath)
+	if err != nil {
+		writeRenderError(w, err)
+		return
+	} else if key.Encoding != "" {
+		h := sha256.New()
+		fmt.Fprintf(h, "%s encoding %s", tag, key.Encoding)
+		tag = formatEtag(h)
+	}
+	s.imageFileEtags.Store(cachePath, tag)
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		macroMetrics.Add("not-modified", 1)
+		w.Header().Set("Cache-Control", cache)
+		w.Header().Set("Etag", tag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
 	if _, err := os.Stat(cachePath); err == nil {
 		macroMetrics.Add("cache-hit", 1)
-		s.serveFileCached(w, r, cachePath, 24*time.Hour)
+		s.serveFileCached(w, r, cachePath, cache)
 		return
 	} else {
 		log.Printf("cache file %q not found, generating: %v", cachePath, err)
 	}
-	if _, err, reused := s.macroGenerationSingleFlight.Do(cachePath, func() (string, error) {
-		macroMetrics.Add("cache-miss", 1)
-		return cachePath, s.generateMacro(m, cachePath)
+	if err := s.chargeRender(r, func() error {
+		return s.renderMacro(m, cachePath, es)
 	}); err != nil {
-		log.Printf("error generating macro %d: %v", m.ID, err)
+		writeRenderError(w, err)
+		return
+	}
+
+	s.serveFileCached(w, r, cachePath, cache)
+}
+
+// viewerVariant returns the variant of m to show for request r, with its
+// index and the Cache-Control header for it. Unless a caption test is running,
+// this is m itself.
+func (s *tmemeServer) viewerVariant(r *http.Request, m *tmemes.Macro) (_ *tmemes.Macro, variant int, cache string, _ error) {
+	if ct := m.CaptionTest; ct != nil && ct.Active(time.Now()) {
+		variant = m.ViewerVariant(s.getCallerID(r))
+		private := true // the variant depends on who is asking
+		if v := r.FormValue("variant"); v != "" {
+			var err error
+			variant, err = strconv.Atoi(v)
+			if err != nil || variant < 0 || variant >= len(ct.Variants) {
+				return nil, 0, "", errors.New("invalid variant")
+			}
+			private = false
+		}
+		// Keep the cache lifetime short, since the caption will change when
+		// the test ends.
+		return m.Variant(variant), variant, cacheControl(time.Until(ct.Ends)+time.Minute, private), nil
+	}
+	return m, 0, cacheControl(24*time.Hour, false), nil
+}
+
+// serveContentMacroFrame serves a single frame of the macro with the given
+// ID, as a PNG. Frames are rendered on each request rather than cached, but
+// have stable Etags.
+func (s *tmemeServer) serveContentMacroFrame(w http.ResponseWriter, r *http.Request, id, frame string) {
+	serveMetrics.Add("content-macro-frame", 1)
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	n, err := strconv.Atoi(frame)
+	if err != nil || n < 0 {
+		http.Error(w, "invalid frame number", http.StatusBadRequest)
+		return
+	}
+	m, err := s.db.Macro(idInt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if !s.canViewMacro(r, m) {
+		http.Error(w, fmt.Sprintf("macro %d not found", m.ID), http.StatusNotFound)
+		return
+	}
+	m, _, cache, err := s.viewerVariant(r, m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t, err := s.db.AnyTemplate(m.TemplateID); err == nil && isNSFW(m, t) && !wantsReveal(r) {
+		s.serveBlurred(w, r, t)
+		return
+	}
+
+	base, err := s.macroEtag(m, ".png")
+	if err != nil {
+		writeRenderError(w, err)
+		return
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s frame %d", base, n)
+	tag := formatEtag(h)
+	w.Header().Set("Cache-Control", cache)
+	w.Header().Set("Etag", tag)
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		macroMetrics.Add("not-modified", 1)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var img image.Image
+	err = s.chargeRender(r, func() (err error) {
+		img, err = s.drawMacroFrame(m, n)
+		return err
+	})
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "frame not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeRenderError(w, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	buf.WriteTo(w)
+}
+
+// drawMacroFrame renders frame n of m. It reports errNotFound if the template
+// has no such frame.
+func (s *tmemeServer) drawMacroFrame(m *tmemes.Macro, n int) (image.Image, error) {
+	srcFile, err := s.openTemplateImage(m.TemplateID)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+	tp := srcFile.Name()
+	ss, err := s.loadStickers(m)
+	if err != nil {
+		return nil, err
+	}
+
+	macroMetrics.Add("generate-frame", 1)
+	if filepath.Ext(tp) == ".apng" {
+		a, err := memedraw.DecodeAPNG(srcFile)
+		if err != nil {
+			return nil, err
+		} else if n >= memedraw.APNGFrameCount(a, m) {
+			return nil, errNotFound
+		}
+		return memedraw.DrawAPNGFrame(a, m, ss, n), nil
+	} else if filepath.Ext(tp) != ".gif" {
+		if n != 0 {
+			return nil, errNotFound
+		}
+		srcImage, _, err := image.Decode(srcFile)
+		if err != nil {
+			return nil, err
+		}
+		return memedraw.Draw(srcImage, m, ss), nil
+	}
+	srcGIF, err := gif.DecodeAll(srcFile)
+	if err != nil {
+		return nil, err
+	} else if n >= memedraw.FrameCount(srcGIF, m) {
+		return nil, errNotFound
+	}
+	return memedraw.DrawGIFFrame(srcGIF, m, ss, n), nil
+}
+
+// renderMacro generates the image for m into cachePath with encoder settings
+// es, sharing the work with any concurrent requests for the same path. If the
+// store has a backend, the image is restored from there if possible, and saved
+// there otherwise.
+func (s *tmemeServer) renderMacro(m *tmemes.Macro, cachePath string, es encodeSettings) error {
+	_, err, reused := s.macroGenerationSingleFlight.Do(cachePath, func() (string, error) {
+		if ok, err := s.db.RestoreCached(cachePath); err != nil {
+			log.Printf("restoring cached macro %d: %v", m.ID, err)
+		} else if ok {
+			macroMetrics.Add("cache-restored", 1)
+			s.db.AddCached(cachePath)
+			return cachePath, nil
+		}
+		macroMetrics.Add("cache-miss", 1)
+		if err := s.generateMacro(m, cachePath, es); err != nil {
+			return cachePath, err
+		}
+		s.db.CountMacroRender(m.ID)
+		s.db.AddCached(cachePath)
+		if err := s.db.SaveCached(cachePath); err != nil {
+			log.Printf("saving cached macro %d: %v", m.ID, err)
+		}
+		return cachePath, nil
+	})
+	if err != nil {
+		log.Printf("error generating macro %d: %v", m.ID, err)
 	} else if reused {
 		macroMetrics.Add("cache-reused", 1)
 	}
+	return err
+}
+
+// macroEtag returns the Etag for the rendering of m stored at cachePath.
+// Since rendering is deterministic, the tag is computed from the inputs to the
+// renderer rather than from its output, and remains the same when the cached
+// file is discarded and generated again.
+func (s *tmemeServer) macroEtag(m *tmemes.Macro, cachePath string) (string, error) {
+	tpath, err := s.db.TemplatePath(m.TemplateID)
+	if err != nil {
+		return "", err
+	}
+	ttag, ok := s.imageFileEtags.Load(tpath)
+	if !ok {
+		tag, err := s.fileEtag(tpath)
+		if errors.Is(err, fs.ErrNotExist) {
+			s.templateLost(m.TemplateID)
+			return "", fmt.Errorf("template %d: %w", m.TemplateID, errTemplateLost)
+		} else if err != nil {
+			return "", err
+		}
+		s.imageFileEtags.Store(tpath, tag)
+		ttag = tag
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "memedraw/%d %s %s\n", memedraw.Version, ttag, filepath.Ext(cachePath))
+	if err := json.NewEncoder(h).Encode(m.TextOverlay); err != nil {
+		return "", err
+	}
+	if m.Playback != nil {
+		if err := json.NewEncoder(h).Encode(m.Playback); err != nil {
+			return "", err
+		}
+	}
+	if len(m.ImageOverlay) != 0 {
+		stags, err := s.stickerEtags(m)
+		if err != nil {
+			return "", err
+		}
+		if err := json.NewEncoder(h).Encode(m.ImageOverlay); err != nil {
+			return "", err
+		}
+		fmt.Fprintln(h, strings.Join(stags, " "))
+	}
+	return formatEtag(h), nil
+}
 
-	s.serveFileCached(w, r, cachePath, 24*time.Hour)
+// cacheControl returns a Cache-Control header value that allows a response
+// to be cached for maxAge. If private is true, only the caller's own cache may
+// store it, and not a shared cache such as a proxy.
+func cacheControl(maxAge time.Duration, private bool) string {
+	scope := "public"
+	if private {
+		scope = "private"
+	}
+	return fmt.Sprintf("%s, max-age=%d, no-transform", scope, maxAge/time.Second)
 }
 
-// serveFileCached is a wrapper for http.ServeFile that populates cache-control
-// and etag headers.
-func (s *tmemeServer) serveFileCached(w http.ResponseWriter, r *http.Request, path string, maxAge time.Duration) {
-	w.Header().Set("Cache-Control", fmt.Sprintf(
-		"public, max-age=%d, no-transform", maxAge/time.Second))
+// serveFileCached serves the file of the store at path, as http.ServeFile
+// does, decrypting it if necessary, and populates cache-control and etag
+// headers.
+func (s *tmemeServer) serveFileCached(w http.ResponseWriter, r *http.Request, path, cache string) {
+	f, err := s.db.OpenFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.db.TouchCached(path)
+	w.Header().Set("Cache-Control", cache)
 	if tag, ok := s.imageFileEtags.Load(path); ok {
 		w.Header().Set("Etag", tag.(string))
 	}
-	http.ServeFile(w, r, path)
+	http.ServeContent(w, r, filepath.Base(path), fi.ModTime(), f)
 }
 
-// generateMacroGIF renders the text specified by m onto the template GIF
-// stored in srcFile. On success it writes the generated macro to cachePath.
+// drawMacroGIF renders the text specified by m onto the template GIF stored
+// in srcFile, and writes it to dst as a GIF or an animated WebP according to
+// ext.
 //
 // If srcFile contains multiple frames, it renders the text onto each frame
 // according to the timing and position settings defined in its overlay.
-func (s *tmemeServer) generateMacroGIF(m *tmemes.Macro, cachePath string, srcFile *os.File) (retErr error) {
+func (s *tmemeServer) drawMacroGIF(dst io.Writer, m *tmemes.Macro, ext string, srcFile store.File) (retErr error) {
 	macroMetrics.Add("generate-gif", 1)
 	start := time.Now()
 	log.Printf("generating GIF for macro %d", m.ID)
@@ -328,111 +965,285 @@ func (s *tmemeServer) generateMacroGIF(m *tmemes.Macro, cachePath string, srcFil
 		}
 	}()
 
-	// Decode the source GIF
-	srcGIF, err := gif.DecodeAll(srcFile)
+	ss, err := s.loadStickers(m)
 	if err != nil {
 		return err
 	}
 
-	if len(srcGIF.Image) == 0 {
-		return errors.New("no frames in GIF")
+	// Render the frames as they are decoded, rather than decoding them all
+	// up front, since large templates take a lot of memory.
+	switch ext {
+	case ".gif":
+		return memedraw.StreamGIF(dst, srcFile, m, ss)
+	case ".webp":
+		macroMetrics.Add("generate-webp", 1)
+		return memedraw.StreamAnimatedWebP(dst, srcFile, m, ss)
+	default:
+		return fmt.Errorf("unknown extension: %v", ext)
 	}
+}
 
-	memedraw.DrawGIF(srcGIF, m)
-
-	// Save the modified GIF
-	dstFile, err := os.Create(cachePath)
+// drawMacro renders the text specified by m onto its template image, and
+// writes it to dst in the image format given by ext, with encoder settings es.
+//
+// Note this method will automatically dispatch to drawMacroGIF for templates
+// in GIF format, and to drawMacroAPNG for animated PNGs.
+func (s *tmemeServer) drawMacro(dst io.Writer, m *tmemes.Macro, ext string, es encodeSettings) error {
+	srcFile, err := s.openTemplateImage(m.TemplateID)
 	if err != nil {
 		return err
 	}
-	etagHash := sha256.New()
-	dst := io.MultiWriter(etagHash, dstFile)
-	defer func() {
-		if retErr != nil {
-			dstFile.Close()
-			os.Remove(cachePath)
-		} else {
-			s.imageFileEtags.Store(cachePath, formatEtag(etagHash))
-		}
-	}()
+	defer srcFile.Close()
 
-	err = gif.EncodeAll(dst, srcGIF)
-	if err != nil {
-		return err
+	switch filepath.Ext(srcFile.Name()) {
+	case ".gif":
+		return s.drawMacroGIF(dst, m, ext, srcFile)
+	case ".apng":
+		return s.drawMacroAPNG(dst, m, ext, srcFile, es)
 	}
-	return dstFile.Close()
-}
+	macroMetrics.Add("generate", 1)
 
-// generateMacro renders the text specified by m onto its template image.  On
-// success, it writes the generated macro to cachePath.
-//
-// Note this method will automatically dispatch to generateMacroGIF for
-// templates in GIF format.
-func (s *tmemeServer) generateMacro(m *tmemes.Macro, cachePath string) (retErr error) {
-	tp, err := s.db.TemplatePath(m.TemplateID)
+	srcImage, _, err := image.Decode(srcFile)
 	if err != nil {
 		return err
 	}
 
-	srcFile, err := os.Open(tp)
+	ss, err := s.loadStickers(m)
 	if err != nil {
 		return err
 	}
-	defer srcFile.Close()
+	alpha := memedraw.Draw(srcImage, m, ss)
 
-	ext := filepath.Ext(tp)
-	if ext == ".gif" {
-		return s.generateMacroGIF(m, cachePath, srcFile)
+	switch ext {
+	case ".jpg", ".jpeg":
+		macroMetrics.Add("generate-jpg", 1)
+		return jpeg.Encode(dst, alpha, es.jpegOptions())
+	case ".png":
+		macroMetrics.Add("generate-png", 1)
+		return es.pngEncoder().Encode(dst, alpha)
+	case ".webp":
+		macroMetrics.Add("generate-webp", 1)
+		return memedraw.EncodeWebP(dst, alpha)
+	default:
+		return fmt.Errorf("unknown extension: %v", ext)
 	}
-	macroMetrics.Add("generate", 1)
+}
 
-	srcImage, _, err := image.Decode(srcFile)
-	if err != nil {
-		return err
+// generateMacro renders the text specified by m onto its template image.  On
+// success, it writes the generated macro to cachePath, in the format given by
+// its extension, with encoder settings es.
+func (s *tmemeServer) generateMacro(m *tmemes.Macro, cachePath string, es encodeSettings) (retErr error) {
+	if vf, ok := videoFormats[filepath.Ext(cachePath)]; ok {
+		return s.transcodeMacro(m, cachePath, vf)
 	}
-
-	alpha := memedraw.Draw(srcImage, m)
-
-	f, err := os.Create(cachePath)
+	f, err := s.db.CreateFile(cachePath)
 	if err != nil {
 		return err
 	}
-	etagHash := sha256.New()
-	dst := io.MultiWriter(etagHash, f)
 	defer func() {
 		if retErr != nil {
 			f.Close()
 			os.Remove(cachePath)
-		} else {
-			s.imageFileEtags.Store(cachePath, formatEtag(etagHash))
 		}
 	}()
 
-	switch ext {
-	case ".jpg", ".jpeg":
-		macroMetrics.Add("generate-jpg", 1)
-		if err := jpeg.Encode(dst, alpha, &jpeg.Options{Quality: 90}); err != nil {
-			return err
+	if d := *chaosRenderDelay; d > 0 {
+		time.Sleep(d)
+	}
+	if err := s.drawMacro(f, m, filepath.Ext(cachePath), es); err != nil {
+		return err
+	}
+	if injectFault(*chaosCacheFail) {
+		log.Printf("[chaos] injecting cache write failure for macro %d", m.ID)
+		return errors.New("injected cache write failure")
+	}
+	return f.Close()
+}
+
+// serveAPIPreview renders a macro without storing it, so that users can see
+// what a macro will look like before they create it.
+//
+// API: POST /api/preview
+//
+// The payload must be of type application/json encoding a tmemes.Macro, as
+// for POST /api/macro. The rendered image is written back to the caller, in
+// the format the macro would have if it were created.
+//
+// If -legibility-warnings is set, text lines that may be hard to read are
+// reported in a Tmemes-Legibility header, as a JSON array of
+// memedraw.LegibilityWarning values. Text lines that do not fit where they
+// are placed are reported in a Tmemes-Layout header, as a JSON array of
+// memedraw.LayoutWarning values.
+func (s *tmemeServer) serveAPIPreview(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-preview", 1)
+	m, t := s.readPreviewMacro(w, r)
+	if m == nil {
+		return // error already sent
+	}
+
+	ext := s.db.MacroExt(t)
+	var buf bytes.Buffer
+	if err := s.chargeRender(r, func() error {
+		return s.drawMacro(&buf, m, ext, s.encodeSettings())
+	}); err != nil {
+		writeRenderError(w, err)
+		return
+	}
+	macroMetrics.Add("preview", 1)
+	if *legibilityWarnings {
+		warnings, err := s.checkLegibility(m)
+		if err != nil {
+			writeRenderError(w, err)
+			return
 		}
-	case ".png":
-		macroMetrics.Add("generate-png", 1)
-		if err := png.Encode(dst, alpha); err != nil {
-			return err
+		if len(warnings) > 0 {
+			macroMetrics.Add("preview-illegible", 1)
+			hdr, err := json.Marshal(warnings)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Tmemes-Legibility", string(hdr))
 		}
-	default:
-		return fmt.Errorf("unknown extension: %v", ext)
 	}
+	if warnings := checkLayout(t, m); len(warnings) > 0 {
+		macroMetrics.Add("preview-overflow", 1)
+		hdr, err := json.Marshal(warnings)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Tmemes-Layout", string(hdr))
+	}
+	w.Header().Set("Content-Type", mime.TypeByExtension(ext))
+	w.Header().Set("Cache-Control", "no-store")
+	buf.WriteTo(w)
+}
 
-	return f.Close()
+// serveAPIPreviewCheck checks a macro without rendering or storing it, so
+// that the UI can point out problems before the user creates it.
+//
+// API: POST /api/preview/check
+//
+// The payload is as for POST /api/preview. If the macro could not be
+// created, it reports an error as that method does. Otherwise, the result is
+// {"layout":[...], "legibility":[...]}, listing memedraw.LayoutWarning and
+// memedraw.LegibilityWarning values for the text lines. Legibility is only
+// checked if -legibility-warnings is set. The result also has "captionHash",
+// the tmemes.CaptionHash of the text, for use with /api/macro/exists.
+func (s *tmemeServer) serveAPIPreviewCheck(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-preview-check", 1)
+	m, t := s.readPreviewMacro(w, r)
+	if m == nil {
+		return // error already sent
+	}
+	rsp := struct {
+		Layout      []memedraw.LayoutWarning     `json:"layout"`
+		Legibility  []memedraw.LegibilityWarning `json:"legibility"`
+		CaptionHash string                       `json:"captionHash"`
+	}{Layout: checkLayout(t, m), CaptionHash: tmemes.CaptionHash(m.TextOverlay)}
+	if *legibilityWarnings {
+		var err error
+		rsp.Legibility, err = s.checkLegibility(m)
+		if err != nil {
+			writeRenderError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// readPreviewMacro reads a macro to preview from the body of r, and checks
+// that it could be created. It returns the macro and its template, or writes
+// an error response to w and returns nil if the macro is not valid.
+func (s *tmemeServer) readPreviewMacro(w http.ResponseWriter, r *http.Request) (*tmemes.Macro, *tmemes.Template) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil
+	}
+	if s.checkAccess(w, r, "preview macros") == nil {
+		return nil, nil // error already sent
+	}
+
+	var m tmemes.Macro
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil
+	}
+	t, err := s.db.Template(m.TemplateID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, nil
+	}
+	if err := fillTextAreas(t, m.TextOverlay); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil
+	}
+	if err := checkFonts(m.TextOverlay); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil
+	}
+	if err := s.checkStickers(m.ImageOverlay); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil
+	}
+	m.CaptionTest = nil // only the main caption is shown
+	if err := m.ValidForCreate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil
+	}
+	return &m, t
+}
+
+// checkLayout reports the text lines of m that do not fit where they are
+// placed on template t.
+func checkLayout(t *tmemes.Template, m *tmemes.Macro) []memedraw.LayoutWarning {
+	if t.Width <= 0 || t.Height <= 0 {
+		return nil // size unknown
+	}
+	bounds := image.Rect(0, 0, t.Width, t.Height)
+	return memedraw.CheckLayout(bounds, m, isAnimatedTemplate(t))
+}
+
+// checkLegibility reports the text lines of m that may be hard to read on its
+// template. For an animated template, text is checked against the first frame.
+func (s *tmemeServer) checkLegibility(m *tmemes.Macro) ([]memedraw.LegibilityWarning, error) {
+	srcFile, err := s.openTemplateImage(m.TemplateID)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+	img, _, err := image.Decode(srcFile)
+	if err != nil {
+		return nil, err
+	}
+	return memedraw.CheckLegibility(img, m), nil
 }
 
 func (s *tmemeServer) serveAPIMacro(w http.ResponseWriter, r *http.Request) {
 	serveMetrics.Add("api-macro", 1)
+	if path, ok := strings.CutSuffix(r.URL.Path, "/public"); ok {
+		s.serveAPIMacroPublic(w, r, path)
+		return
+	} else if path, ok := strings.CutSuffix(r.URL.Path, "/nsfw"); ok {
+		s.serveAPIMacroNSFW(w, r, path)
+		return
+	}
 	switch r.Method {
 	case "GET":
 		s.serveAPIMacroGet(w, r)
 	case "POST":
+		if r.URL.Path == "/api/macro/batch" {
+			s.serveAPIMacroBatch(w, r)
+			return
+		}
 		s.serveAPIMacroPost(w, r)
+	case "PUT":
+		s.serveAPIMacroPut(w, r)
 	case "DELETE":
 		s.serveAPIMacroDelete(w, r)
 	default:
@@ -440,11 +1251,19 @@ func (s *tmemeServer) serveAPIMacro(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// checkAccess checks that the caller is logged in and not a tagged node.  If
-// so, it returns the whois data for the user. Otherwise, it writes an error
-// response to w and returns nil.
+// checkAccess checks that the caller is logged in and not a tagged node, or
+// presents an API token that permits op, and that the tailnet policy grants
+// what op requires (see checkGrant).  If so, it returns the whois data for
+// the user. Otherwise, it writes an error response to w and returns nil.
 func (s *tmemeServer) checkAccess(w http.ResponseWriter, r *http.Request, op string) *apitype.WhoIsResponse {
-	whois, err := s.lc.WhoIs(r.Context(), r.RemoteAddr)
+	if secret, ok := requestAPIToken(r); ok {
+		whois := s.checkTokenAccess(w, secret, op)
+		if whois == nil || !s.checkGrant(w, r, whois, op) {
+			return nil
+		}
+		return whois
+	}
+	whois, err := s.whoIs(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return nil
@@ -453,10 +1272,41 @@ func (s *tmemeServer) checkAccess(w http.ResponseWriter, r *http.Request, op str
 		http.Error(w, "not logged in", http.StatusUnauthorized)
 		return nil
 	}
-	if whois.Node.IsTagged() {
+	if whois.Node.IsTagged() && !(readOnlyOps[op] && s.isReadOnlyNode(whois.Node)) {
 		http.Error(w, "tagged nodes cannot "+op, http.StatusForbidden)
 		return nil
 	}
+	if !s.checkGrant(w, r, whois, op) {
+		return nil
+	}
+	return whois
+}
+
+// checkAdmin is like checkAccess, but also requires that the caller be a
+// server admin.
+func (s *tmemeServer) checkAdmin(w http.ResponseWriter, r *http.Request, op string) *apitype.WhoIsResponse {
+	whois := s.checkAccess(w, r, op)
+	if whois == nil {
+		return nil
+	}
+	if !s.isAdmin(whois) {
+		http.Error(w, "permission denied", http.StatusUnauthorized)
+		return nil
+	}
+	return whois
+}
+
+// checkModerator is like checkAccess, but also requires that the caller be
+// allowed to moderate content (see isModerator).
+func (s *tmemeServer) checkModerator(w http.ResponseWriter, r *http.Request, op string) *apitype.WhoIsResponse {
+	whois := s.checkAccess(w, r, op)
+	if whois == nil {
+		return nil
+	}
+	if !s.isModerator(whois) {
+		http.Error(w, "permission denied", http.StatusUnauthorized)
+		return nil
+	}
 	return whois
 }
 
@@ -471,32 +1321,224 @@ func (s *tmemeServer) serveAPIMacroPost(w http.ResponseWriter, r *http.Request)
 	if whois == nil {
 		return // error already sent
 	}
+	if !s.checkRateLimit(w, whois.UserProfile.ID) {
+		return // error already sent
+	}
 
 	// Create a new macro.
 	var m tmemes.Macro
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
-	} else if err := m.ValidForCreate(); err != nil {
+	}
+	if code, err := s.prepareMacro(&m, whois); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	if err := s.db.AddMacro(&m); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	s.logEvent(whois.UserProfile.ID, "create", "macro", m.ID)
+	s.notifyTemplateUsed(&m)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// prepareMacro checks that m, sent by the caller described by whois, can be
+// created, and fills in its text areas and creator. If m cannot be created,
+// it reports why, along with the HTTP status for the error.
+func (s *tmemeServer) prepareMacro(m *tmemes.Macro, whois *apitype.WhoIsResponse) (int, error) {
+	if err := s.checkMacroOverlays(m); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := m.ValidForCreate(); err != nil {
+		return http.StatusBadRequest, err
+	}
 
 	// If the creator is negative, treat the macro as anonymous.
 	if m.Creator < 0 {
 		if !s.allowAnonymous {
-			http.Error(w, "anonymous macros not allowed", http.StatusForbidden)
-			return
+			return http.StatusForbidden, errors.New("anonymous macros not allowed")
 		}
 		m.Creator = -1 // normalize anonymous to -1
 	} else {
 		m.Creator = whois.UserProfile.ID
 	}
+	return 0, nil
+}
 
-	if err := s.db.AddMacro(&m); err != nil {
+// checkMacroOverlays fills in the text areas of the overlays and caption
+// variants of m from its template, and checks their fonts and stickers, as
+// for creating or editing m.
+func (s *tmemeServer) checkMacroOverlays(m *tmemes.Macro) error {
+	lines := [][]tmemes.TextLine{m.TextOverlay}
+	if m.CaptionTest != nil {
+		lines = append(lines, m.CaptionTest.Variants...)
+	}
+	if t, err := s.db.Template(m.TemplateID); err == nil {
+		for _, tl := range lines {
+			if err := fillTextAreas(t, tl); err != nil {
+				return err
+			}
+		}
+	}
+	for _, tl := range lines {
+		if err := checkFonts(tl); err != nil {
+			return err
+		}
+	}
+	return s.checkStickers(m.ImageOverlay)
+}
+
+// maxBatchMacros is the most macros that can be created by one request to
+// /api/macro/batch.
+const maxBatchMacros = 100
+
+// serveAPIMacroBatch implements the API for creating several image macros at
+// once, for example to import an archive.
+//
+// API: POST /api/macro/batch
+//
+// The payload must be a JSON array of up to maxBatchMacros tmemes.Macro
+// values, as for POST /api/macro. The macros are created in a single
+// transaction: if any of them is invalid, none is created. The result is
+// {"created":bool, "results":[...]}, with one result per macro, in order,
+// each {"macro":{...}} with the filled-in macro if it was created, or
+// {"error":"..."} if it is invalid. If no macro was created, the status is
+// that of the first invalid macro: 400, or 403 if it is anonymous and
+// anonymous macros are not allowed. The batch counts as one request toward
+// the caller's rate limit.
+func (s *tmemeServer) serveAPIMacroBatch(w http.ResponseWriter, r *http.Request) {
+	whois := s.checkAccess(w, r, "create macros")
+	if whois == nil {
+		return // error already sent
+	}
+	if !s.checkRateLimit(w, whois.UserProfile.ID) {
+		return // error already sent
+	}
+
+	var ms []*tmemes.Macro
+	if err := json.NewDecoder(r.Body).Decode(&ms); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(ms) == 0 {
+		http.Error(w, "no macros to create", http.StatusBadRequest)
+		return
+	} else if len(ms) > maxBatchMacros {
+		http.Error(w, fmt.Sprintf("at most %d macros may be created at once", maxBatchMacros), http.StatusBadRequest)
+		return
+	}
+
+	type result struct {
+		Macro *tmemes.Macro `json:"macro,omitempty"`
+		Error string        `json:"error,omitempty"`
+	}
+	rsp := struct {
+		C bool     `json:"created"`
+		R []result `json:"results"`
+	}{R: make([]result, len(ms))}
+	status := http.StatusOK
+	for i, m := range ms {
+		if m == nil {
+			m = new(tmemes.Macro)
+			ms[i] = m
+		}
+		if code, err := s.prepareMacro(m, whois); err != nil {
+			rsp.R[i].Error = err.Error()
+			if status == http.StatusOK {
+				status = code
+			}
+		}
+	}
+	if status == http.StatusOK {
+		if err := s.db.AddMacros(ms); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rsp.C = true
+		for i, m := range ms {
+			rsp.R[i].Macro = m
+			s.logEvent(whois.UserProfile.ID, "create", "macro", m.ID)
+			s.notifyTemplateUsed(m)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		log.Printf("writing batch result: %v", err)
+	}
+}
+
+// serveAPIMacroPut implements the API for editing the text of a macro. Only
+// the creator of a macro or a server admin can edit it; as with deletion, only
+// admins can edit anonymous macros. Edits are recorded in the audit log.
+//
+// API: PUT /api/macro/:id
+//
+// The payload must be of type application/json encoding an object with a
+// "textOverlay" field, which replaces the text overlay of the macro. Votes and
+// other fields are preserved. On success, the updated macro object is written
+// back to the caller.
+func (s *tmemeServer) serveAPIMacroPut(w http.ResponseWriter, r *http.Request) {
+	whois := s.checkAccess(w, r, "edit macros")
+	if whois == nil {
+		return // error already sent
+	}
+
+	m, ok, err := getSingleFromIDInPath(r.URL.Path, "api/macro", s.db.Macro)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing macro ID", http.StatusBadRequest)
+		return
+	}
+	isAdmin := s.isAdmin(whois)
+	if whois.UserProfile.ID != m.Creator && !isAdmin {
+		http.Error(w, "permission denied", http.StatusUnauthorized)
+		return
+	} else if m.Locked && !isAdmin {
+		http.Error(w, "macro is locked by an admin", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		TextOverlay []tmemes.TextLine `json:"textOverlay"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(req.TextOverlay) == 0 {
+		http.Error(w, "macro must have an overlay", http.StatusBadRequest)
+		return
+	}
+	edit := *m // check the edited macro without changing the stored one
+	edit.TextOverlay = req.TextOverlay
+	edit.CaptionTest = nil
+	if err := s.checkMacroOverlays(&edit); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	for _, tl := range edit.TextOverlay {
+		if err := tl.ValidForCreate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	m, err = s.db.EditMacro(m.ID, edit.TextOverlay)
+	if errors.Is(err, store.ErrCaptionTestRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logEvent(whois.UserProfile.ID, "edit", "macro", m.ID)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(m); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -531,10 +1573,18 @@ func (s *tmemeServer) serveAPIContextPost(w http.ResponseWriter, r *http.Request
 		http.Error(w, "missing macro ID", http.StatusBadRequest)
 		return
 	}
+	if !s.canViewMacro(r, m) {
+		http.Error(w, fmt.Sprintf("macro %d not found", m.ID), http.StatusNotFound)
+		return
+	}
 
-	if whois.UserProfile.ID != m.Creator && !s.superUser[whois.UserProfile.LoginName] {
+	isAdmin := s.isAdmin(whois)
+	if whois.UserProfile.ID != m.Creator && !isAdmin {
 		http.Error(w, "permission denied", http.StatusUnauthorized)
 		return
+	} else if m.Locked && !isAdmin {
+		http.Error(w, "macro is locked by an admin", http.StatusForbidden)
+		return
 	}
 
 	var req tmemes.ContextRequest
@@ -615,16 +1665,32 @@ func creatorUserID(r *http.Request) (tailcfg.UserID, error) {
 // API: /api/macro       -- all macros defined
 //
 // This API supports pagination (see parsePageOptions).
-// The result objects are JSON tmemes.Macro values.
+// The result objects are JSON tmemes.Macro values, each with its
+// "createdAtRelative" time (such as "3h ago"). With ?expand=creator, each
+// also has the name and avatar URL of its creator (see creatorInfo).
 func (s *tmemeServer) serveAPIMacroGet(w http.ResponseWriter, r *http.Request) {
+	if path, ok := strings.CutSuffix(r.URL.Path, "/variants"); ok {
+		s.serveAPIMacroVariants(w, r, path)
+		return
+	}
+	if r.URL.Path == "/api/macro/exists" {
+		s.serveAPIMacroExists(w, r)
+		return
+	}
 	m, ok, err := getSingleFromIDInPath(r.URL.Path, "api/macro", s.db.Macro)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if ok && !s.canViewMacro(r, m) {
+		http.Error(w, fmt.Sprintf("macro %d not found", m.ID), http.StatusNotFound)
+		return
+	}
+	expand := expandCreator(r)
 	w.Header().Set("Content-Type", "application/json")
 	if ok {
-		if err := json.NewEncoder(w).Encode(m); err != nil {
+		v := s.expandMacros(r.Context(), []*tmemes.Macro{m}, expand)[0]
+		if err := json.NewEncoder(w).Encode(v); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 		return
@@ -646,7 +1712,7 @@ func (s *tmemeServer) serveAPIMacroGet(w http.ResponseWriter, r *http.Request) {
 	total := len(all)
 
 	// Check for sorting order.
-	if err := sortMacros(r.FormValue("sort"), all); err != nil {
+	if err := s.sortMacros(r.FormValue("sort"), all); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -660,28 +1726,118 @@ func (s *tmemeServer) serveAPIMacroGet(w http.ResponseWriter, r *http.Request) {
 	pageItems, isLast := slicePage(all, page, count)
 
 	rsp := struct {
-		M []*tmemes.Macro `json:"macros"`
-		N int             `json:"total"`
-		L bool            `json:"isLast,omitempty"`
+		M any  `json:"macros"`
+		N int  `json:"total"`
+		L bool `json:"isLast,omitempty"`
 	}{M: pageItems, N: total, L: isLast}
+	if pageItems != nil {
+		rsp.M = s.expandMacros(r.Context(), pageItems, expand)
+	}
 	if err := json.NewEncoder(w).Encode(rsp); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-// serveAPIMacroDelete implements deletion of image macros. Only the user who
-// created a macro or an admin can delete a macro. Note that because
-// unattributed macros do not store a user ID, this means only admins can
-// remove anonymous macros.
+// serveAPIMacroVariants reports the vote tallies for each caption variant of
+// a macro.
 //
-// API: DELETE /api/macro/:id
+// API: /api/macro/:id/variants
 //
-// On success, the deleted macro object is written back to the caller.
-func (s *tmemeServer) serveAPIMacroDelete(w http.ResponseWriter, r *http.Request) {
-	whois := s.checkAccess(w, r, "delete macros")
-	if whois == nil {
-		return // error already sent
-	}
+// The result is a JSON array with one object per variant, in order.
+func (s *tmemeServer) serveAPIMacroVariants(w http.ResponseWriter, r *http.Request, path string) {
+	m, ok, err := getSingleFromIDInPath(path, "api/macro", s.db.Macro)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing macro ID", http.StatusBadRequest)
+		return
+	}
+	if !s.canViewMacro(r, m) {
+		http.Error(w, fmt.Sprintf("macro %d not found", m.ID), http.StatusNotFound)
+		return
+	}
+	up, down, err := s.db.VariantVotes(m.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type variant struct {
+		TextOverlay []tmemes.TextLine `json:"textOverlay"`
+		Upvotes     int               `json:"upvotes"`
+		Downvotes   int               `json:"downvotes"`
+		Winner      bool              `json:"winner,omitempty"`
+	}
+	rsp := make([]variant, len(up))
+	for i := range rsp {
+		rsp[i] = variant{
+			TextOverlay: m.TextOverlay,
+			Upvotes:     up[i],
+			Downvotes:   down[i],
+		}
+		if ct := m.CaptionTest; ct != nil {
+			rsp[i].TextOverlay = ct.Variants[i]
+			rsp[i].Winner = ct.Done && ct.Winner == i
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAPIMacroExists reports the macros on a template with the same text as
+// one the caller is about to create, so that the UI can point them out.
+//
+// API: /api/macro/exists?templateID=N&hash=H
+//
+// The hash is that of the text overlay, as computed by tmemes.CaptionHash and
+// reported by /api/preview/check. The result is {"exists":bool,
+// "macros":[...]}, listing the macros the caller can see whose text has that
+// hash, newest first, each with its "createdAtRelative" time.
+func (s *tmemeServer) serveAPIMacroExists(w http.ResponseWriter, r *http.Request) {
+	tid, err := strconv.Atoi(r.FormValue("templateID"))
+	if err != nil {
+		http.Error(w, "invalid template ID", http.StatusBadRequest)
+		return
+	}
+	hash := strings.ToLower(r.FormValue("hash"))
+	if hash == "" {
+		http.Error(w, "missing hash", http.StatusBadRequest)
+		return
+	}
+	matches := []*tmemes.Macro{}
+	for _, m := range s.db.AllMacros() {
+		if m.TemplateID == tid && s.canViewMacro(r, m) && tmemes.CaptionHash(m.TextOverlay) == hash {
+			matches = append(matches, m)
+		}
+	}
+	slices.SortFunc(matches, compare.FromLessFunc(func(a, b *tmemes.Macro) bool {
+		return a.CreatedAt.After(b.CreatedAt)
+	}))
+	rsp := struct {
+		E bool            `json:"exists"`
+		M []expandedMacro `json:"macros"`
+	}{E: len(matches) > 0, M: s.expandMacros(r.Context(), matches, false)}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAPIMacroDelete implements deletion of image macros. Only the user who
+// created a macro or an admin can delete a macro. Note that because
+// unattributed macros do not store a user ID, this means only admins can
+// remove anonymous macros.
+//
+// API: DELETE /api/macro/:id
+//
+// On success, the deleted macro object is written back to the caller.
+func (s *tmemeServer) serveAPIMacroDelete(w http.ResponseWriter, r *http.Request) {
+	whois := s.checkAccess(w, r, "delete macros")
+	if whois == nil {
+		return // error already sent
+	}
 
 	m, ok, err := getSingleFromIDInPath(r.URL.Path, "api/macro", s.db.Macro)
 	if err != nil {
@@ -692,16 +1848,21 @@ func (s *tmemeServer) serveAPIMacroDelete(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// The creator of a macro can delete it, otherwise the caller must be a
-	// superuser.
-	if whois.UserProfile.ID != m.Creator && !s.superUser[whois.UserProfile.LoginName] {
+	// The creator of a macro can delete it unless it is locked, otherwise the
+	// caller must be a superuser.
+	isAdmin := s.isAdmin(whois)
+	if whois.UserProfile.ID != m.Creator && !isAdmin {
 		http.Error(w, "permission denied", http.StatusUnauthorized)
 		return
+	} else if m.Locked && !isAdmin {
+		http.Error(w, "macro is locked by an admin", http.StatusForbidden)
+		return
 	}
 	if err := s.db.DeleteMacro(m.ID); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.logEvent(whois.UserProfile.ID, "delete", "macro", m.ID)
 	if err := json.NewEncoder(w).Encode(m); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -717,6 +1878,9 @@ func (s *tmemeServer) serveAPIVotePut(w http.ResponseWriter, r *http.Request) {
 	if whois == nil {
 		return // error already sent
 	}
+	if !s.checkRateLimit(w, whois.UserProfile.ID) {
+		return // error already sent
+	}
 
 	// Accept /api/vote/:id/{up,down}
 	path, op := r.URL.Path, 0
@@ -737,11 +1901,19 @@ func (s *tmemeServer) serveAPIVotePut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing macro ID", http.StatusBadRequest)
 		return
 	}
+	if !s.canViewMacro(r, m) {
+		http.Error(w, fmt.Sprintf("macro %d not found", m.ID), http.StatusNotFound)
+		return
+	}
 	m, err = s.db.SetVote(whois.UserProfile.ID, m.ID, op)
-	if err != nil {
+	if errors.Is(err, store.ErrSelfVote) || errors.Is(err, store.ErrVotesFrozen) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.logEvent(whois.UserProfile.ID, voteAction(op), "macro", m.ID)
 	if err := json.NewEncoder(w).Encode(m); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -749,11 +1921,37 @@ func (s *tmemeServer) serveAPIVotePut(w http.ResponseWriter, r *http.Request) {
 
 func (s *tmemeServer) serveAPITemplate(w http.ResponseWriter, r *http.Request) {
 	serveMetrics.Add("api-template", 1)
+	if r.URL.Path == "/api/template/search-by-image" {
+		s.serveAPITemplateSearch(w, r)
+		return
+	} else if path, ok := strings.CutSuffix(r.URL.Path, "/nsfw"); ok {
+		s.serveAPITemplateNSFW(w, r, path)
+		return
+	}
 	switch r.Method {
 	case "GET":
 		s.serveAPITemplateGet(w, r)
 	case "POST":
+		if strings.HasSuffix(r.URL.Path, "/transfer") {
+			s.serveAPITemplateTransfer(w, r)
+			return
+		}
 		s.serveAPITemplatePost(w, r)
+	case "PUT":
+		if path, ok := strings.CutSuffix(r.URL.Path, "/image"); ok {
+			s.serveAPITemplateImage(w, r, path)
+			return
+		}
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case "PATCH":
+		if path, ok := strings.CutSuffix(r.URL.Path, "/category"); ok {
+			s.serveAPITemplateCategory(w, r, path)
+			return
+		} else if strings.HasSuffix(r.URL.Path, "/areas") {
+			s.serveAPITemplateAreas(w, r)
+			return
+		}
+		s.serveAPITemplatePatch(w, r)
 	case "DELETE":
 		s.serveAPITemplateDelete(w, r)
 	default:
@@ -766,17 +1964,27 @@ func (s *tmemeServer) serveAPITemplate(w http.ResponseWriter, r *http.Request) {
 // API: /api/template/:id   -- one template by ID
 // API: /api/template       -- all templates defined
 //
-// This API supports pagination (see parsePageOptions).
-// The result objects are JSON tmemes.Template values.
+// This API supports pagination (see parsePageOptions), filtering by
+// ?creator= and ?category=, and sorting by ?sort=recent or ?sort=popular
+// (most macros first).
+// The result objects are JSON tmemes.Template values, each with its
+// "createdAtRelative" time (such as "3h ago"). With ?expand=creator, each
+// also has the name and avatar URL of its creator (see creatorInfo).
 func (s *tmemeServer) serveAPITemplateGet(w http.ResponseWriter, r *http.Request) {
+	if path, ok := strings.CutSuffix(r.URL.Path, "/similar"); ok {
+		s.serveAPITemplateSimilar(w, r, path)
+		return
+	}
 	t, ok, err := getSingleFromIDInPath(r.URL.Path, "api/template", s.db.Template)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	expand := expandCreator(r)
 	w.Header().Set("Content-Type", "application/json")
 	if ok {
-		if err := json.NewEncoder(w).Encode(t); err != nil {
+		v := s.expandTemplates(r.Context(), []*tmemes.Template{t}, expand)[0]
+		if err := json.NewEncoder(w).Encode(v); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 		return
@@ -795,8 +2003,15 @@ func (s *tmemeServer) serveAPITemplateGet(w http.ResponseWriter, r *http.Request
 	} else {
 		all = s.db.TemplatesByCreator(uid)
 	}
+	all = filterCategory(r, all)
 	total := len(all)
 
+	// Check for sorting order.
+	if err := sortTemplates(r.FormValue("sort"), all); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Handle pagination.
 	page, count, err := parsePageOptions(r, 24)
 	if err != nil {
@@ -806,81 +2021,428 @@ func (s *tmemeServer) serveAPITemplateGet(w http.ResponseWriter, r *http.Request
 	pageItems, isLast := slicePage(all, page, count)
 
 	rsp := struct {
-		T []*tmemes.Template `json:"templates"`
-		N int                `json:"total"`
-		L bool               `json:"isLast,omitempty"`
+		T any  `json:"templates"`
+		N int  `json:"total"`
+		L bool `json:"isLast,omitempty"`
 	}{T: pageItems, N: total, L: isLast}
+	if pageItems != nil {
+		rsp.T = s.expandTemplates(r.Context(), pageItems, expand)
+	}
 	if err := json.NewEncoder(w).Encode(rsp); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// creatorInfo is the information about the creator of a macro or template
+// added to API results when the caller requests ?expand=creator, so that
+// clients need not resolve user IDs themselves. Both fields are empty for
+// anonymous items.
+type creatorInfo struct {
+	CreatorName      string `json:"creatorName,omitempty"`
+	CreatorAvatarURL string `json:"creatorAvatarURL,omitempty"`
+}
+
+type expandedMacro struct {
+	*tmemes.Macro
+	creatorInfo
+	CreatedAtRelative string `json:"createdAtRelative"` // e.g., "3h ago"
+}
+
+type expandedTemplate struct {
+	*tmemes.Template
+	creatorInfo
+	CreatedAtRelative string `json:"createdAtRelative"` // e.g., "3h ago"
+}
+
+// expandCreator reports whether r requests creator information in results.
+func expandCreator(r *http.Request) bool {
+	return slices.Contains(strings.Split(r.FormValue("expand"), ","), "creator")
+}
+
+// creatorInfoFor returns the information about the given creator of an item
+// created at ts, as it is shown in the UI.
+func (s *tmemeServer) creatorInfoFor(ctx context.Context, id tailcfg.UserID, ts time.Time) creatorInfo {
+	if id <= 0 {
+		return creatorInfo{}
+	}
+	ci := creatorInfo{CreatorName: s.userDisplayName(ctx, id, ts)}
+	if up, err := s.userFromID(ctx, id); err == nil {
+		ci.CreatorAvatarURL = up.ProfilePicURL
+	}
+	return ci
+}
+
+// expandMacros returns ms with their relative creation times, and if creator
+// is true, with information about their creators.
+func (s *tmemeServer) expandMacros(ctx context.Context, ms []*tmemes.Macro, creator bool) []expandedMacro {
+	now := time.Now()
+	out := make([]expandedMacro, len(ms))
+	for i, m := range ms {
+		out[i] = expandedMacro{Macro: m, CreatedAtRelative: relativeTime(m.CreatedAt, now)}
+		if creator {
+			out[i].creatorInfo = s.creatorInfoFor(ctx, m.Creator, m.CreatedAt)
+		}
+	}
+	return out
+}
+
+// expandTemplates returns ts with their relative creation times, and if
+// creator is true, with information about their creators.
+func (s *tmemeServer) expandTemplates(ctx context.Context, ts []*tmemes.Template, creator bool) []expandedTemplate {
+	now := time.Now()
+	out := make([]expandedTemplate, len(ts))
+	for i, t := range ts {
+		out[i] = expandedTemplate{Template: t, CreatedAtRelative: relativeTime(t.CreatedAt, now)}
+		if creator {
+			out[i].creatorInfo = s.creatorInfoFor(ctx, t.Creator, t.CreatedAt)
+		}
+	}
+	return out
+}
+
 // serveAPITemplatePost implements creating (uploading) new template images.
 //
 // API: POST /api/template
 //
 // The payload must be of type multipart/form-data, and supports the fields:
 //
-//   - image: the image file to upload (required)
+//   - image: the image file to upload (required, unless url is set)
+//   - url: the http or https URL of an image for the server to fetch instead
 //   - name: a text description of the template (required)
 //   - anon: if present and true, create an unattributed template
+//   - category: the name of an existing category for the template (optional)
+//
+// Alternatively, the payload may be of type application/json, encoding a
+// templateUpload with the same fields except image.
 func (s *tmemeServer) serveAPITemplatePost(w http.ResponseWriter, r *http.Request) {
 	whois := s.checkAccess(w, r, "create templates")
 	if whois == nil {
 		return // error already sent
 	}
+	if !s.checkRateLimit(w, whois.UserProfile.ID) {
+		return // error already sent
+	}
+
+	var req templateUpload
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Name, req.URL = r.FormValue("name"), r.FormValue("url")
+		req.Category = r.FormValue("category")
+		if anon := r.FormValue("anon"); anon != "" {
+			anonBool, err := strconv.ParseBool(anon)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Anon = anonBool
+		}
+	}
 
 	// Create a new image.
 	t := &tmemes.Template{
-		Name:    r.FormValue("name"),
+		Name:    req.Name,
 		Creator: whois.UserProfile.ID,
 	}
-	if anon := r.FormValue("anon"); anon != "" {
-		anonBool, err := strconv.ParseBool(anon)
+	if req.Anon {
+		if !s.allowAnonymous {
+			http.Error(w, "anonymous templates not allowed", http.StatusUnauthorized)
+			return
+		}
+		t.Creator = -1
+	}
+	if name := strings.TrimSpace(req.Category); name != "" {
+		c, err := s.db.Category(name)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if anonBool {
-			if !s.allowAnonymous {
-				http.Error(w, "anonymous templates not allowed", http.StatusUnauthorized)
-				return
-			}
-			t.Creator = -1
-		}
+		t.Category = c.Name
 	}
 
-	img, header, err := r.FormFile("image")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	var ext string
+	var data io.Reader
+	if req.URL != "" {
+		u, err := url.Parse(req.URL)
+		if err == nil {
+			err = checkFetchURL(u)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name, bits, err := fetchTemplateImage(r.Context(), u)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		data, ext, err = s.checkTemplateImage(t, name, int64(len(bits)), bytes.NewReader(bits))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		img, header, err := r.FormFile("image")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if isAudioUpload(header.Filename) {
+			s.addAudioTemplate(w, r, whois.UserProfile.ID, t, header.Filename, header.Size, img)
+			return
+		} else if isVideoUpload(header.Filename) {
+			s.addVideoTemplate(w, r, whois.UserProfile.ID, t, header.Filename, header.Size, img)
+			return
+		}
+		data, ext, err = s.checkTemplateImage(t, header.Filename, header.Size, img)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.addTemplate(t, ext, data); err != nil {
+		writeAddTemplateError(w, err)
 		return
 	}
-	if header.Size > *maxImageSize<<20 {
-		http.Error(w, "image too large", http.StatusBadRequest)
+	s.logEvent(whois.UserProfile.ID, "create", "template", t.ID)
+	redirect := fmt.Sprintf("/create/%v", t.ID)
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// templateUpload is the JSON form of a request to POST /api/template.
+type templateUpload struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Anon     bool   `json:"anon,omitempty"`
+	Category string `json:"category,omitempty"`
+}
+
+// writeAddTemplateError writes an error response for a failure to add a
+// template. If the image duplicates an existing template, the response is
+// 409 Conflict with {"error":"...", "duplicateOf":id}.
+func writeAddTemplateError(w http.ResponseWriter, err error) {
+	var dup *store.DuplicateTemplateError
+	if !errors.As(err, &dup) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	ext := filepath.Ext(header.Filename)
-	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" && ext != ".gif" {
-		http.Error(w, "invalid image format", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(struct {
+		E string `json:"error"`
+		D int    `json:"duplicateOf"`
+	}{E: err.Error(), D: dup.ID})
+}
+
+// templateFormats are the file extensions accepted for template images.
+var templateFormats = []string{".apng", ".gif", ".jpeg", ".jpg", ".png", ".webp"}
+
+// maxImageBytes returns the size limit in bytes for a template image with the
+// file extension ext. Animated PNGs, and video clips for templates, have the
+// limit of GIFs.
+func maxImageBytes(ext string) int64 {
+	if ext == ".gif" || ext == ".apng" || isVideoUpload(ext) {
+		return *maxGIFSize << 20
+	}
+	return *maxImageSize << 20
+}
+
+// maxUploadBytes returns the largest template image size allowed for any
+// format.
+func maxUploadBytes() int64 { return max(*maxImageSize, *maxGIFSize) << 20 }
+
+// serveAPIFonts reports the fonts available for text lines.
+//
+// API: GET /api/fonts
+//
+// The result is {"default":"name", "fonts":[{"name":"...", "description":"..."}, ...]}.
+func (s *tmemeServer) serveAPIFonts(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-fonts", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	imageConfig, _, err := image.DecodeConfig(img)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	rsp := struct {
+		D string          `json:"default"`
+		F []memedraw.Font `json:"fonts"`
+	}{D: memedraw.DefaultFont, F: memedraw.Fonts()}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAPILimits reports the server's limits on uploads.
+//
+// API: GET /api/limits
+//
+// The result is {"formats":[...], "maxBytes":{"static":N, "gif":M}, "gif":{...}},
+// giving the accepted template file extensions, the maximum size in bytes of
+// still images and of GIFs, and the limits on GIF animations (a limit of 0
+// means none). If audio templates are enabled, it also includes the accepted
+// "audioFormats", and their limit as maxBytes "audio"; likewise for video
+// templates, the "videoFormats", their limit as maxBytes "video", and the
+// "maxVideoSeconds" of a clip (if there is a limit).
+func (s *tmemeServer) serveAPILimits(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-limits", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	t.Width = imageConfig.Width
-	t.Height = imageConfig.Height
-	img.Seek(0, io.SeekStart)
+	type gifLimits struct {
+		MaxFrames     int   `json:"maxFrames"`
+		MaxDurationMS int64 `json:"maxDurationMS"`
+		Downsample    bool  `json:"downsample"` // drop frames rather than reject
+	}
+	rsp := struct {
+		F []string         `json:"formats"`
+		A []string         `json:"audioFormats,omitempty"`
+		V []string         `json:"videoFormats,omitempty"`
+		S int              `json:"maxVideoSeconds,omitempty"`
+		M map[string]int64 `json:"maxBytes"`
+		G gifLimits        `json:"gif"`
+	}{
+		F: templateFormats,
+		M: map[string]int64{
+			"static": maxImageBytes(".png"),
+			"gif":    maxImageBytes(".gif"),
+		},
+		G: gifLimits{
+			MaxFrames:     *maxGIFFrames,
+			MaxDurationMS: maxGIFDuration.Milliseconds(),
+			Downsample:    *downsampleGIFs,
+		},
+	}
+	if *ffmpegPath != "" {
+		for ext := range audioFormats {
+			rsp.A = append(rsp.A, ext)
+		}
+		slices.Sort(rsp.A)
+		rsp.M["audio"] = *maxAudioSize << 20
+		rsp.V = videoTemplateFormats
+		rsp.M["video"] = maxImageBytes(".mp4")
+		rsp.S = *maxVideoSeconds
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// checkTemplateImage checks that the image data in img, whose size is given
+// and whose name is filename, is acceptable for use as a template image.  On
+// success, it populates the dimensions and image hash of t, and returns the
+// image data to store for the template and the file extension to store it
+// with. The data is normally img, positioned at the beginning of the data,
+// but may be a modified copy (see checkGIF). The extension is that of
+// filename, except that animated PNGs are stored as ".apng" (see apng.go).
+func (s *tmemeServer) checkTemplateImage(t *tmemes.Template, filename string, size int64, img io.ReadSeeker) (io.Reader, string, error) {
+	ext := filepath.Ext(filename)
+	if !slices.Contains(templateFormats, ext) {
+		return nil, "", errors.New("invalid image format")
+	}
+	if ext == ".png" || ext == ".apng" {
+		var err error
+		if ext, err = pngTemplateExt(img); err != nil {
+			return nil, "", err
+		}
+	}
+	if limit := maxImageBytes(ext); size > limit {
+		return nil, "", fmt.Errorf("image too large (limit %d MiB)", limit>>20)
+	}
+	var src image.Image
+	var data io.Reader = img
+	switch ext {
+	case ".gif":
+		g, err := gif.DecodeAll(img)
+		if err != nil {
+			return nil, "", err
+		} else if len(g.Image) == 0 {
+			return nil, "", errors.New("no frames in GIF")
+		}
+		changed, err := checkGIF(g)
+		if err != nil {
+			return nil, "", err
+		} else if changed {
+			var buf bytes.Buffer
+			if err := gif.EncodeAll(&buf, g); err != nil {
+				return nil, "", err
+			}
+			data = &buf
+		}
+		src = g.Image[0]
+	case ".apng":
+		a, err := memedraw.DecodeAPNG(img)
+		if err != nil {
+			return nil, "", err
+		}
+		changed, err := checkAPNG(a)
+		if err != nil {
+			return nil, "", err
+		} else if changed {
+			var buf bytes.Buffer
+			if err := memedraw.EncodeAPNG(&buf, a, s.encodeSettings().pngEncoder().CompressionLevel); err != nil {
+				return nil, "", err
+			}
+			data = &buf
+		}
+		src = a.Image[0]
+	default:
+		var err error
+		src, _, err = image.Decode(img)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	t.Width = src.Bounds().Dx()
+	t.Height = src.Bounds().Dy()
+	t.ImageHash = memedraw.ImageHash(src)
+	if data == img {
+		if _, err := img.Seek(0, io.SeekStart); err != nil {
+			return nil, "", err
+		}
+	}
+	return data, ext, nil
+}
+
+// checkGIF checks that g is within the configured limits on frame count and
+// duration. If it is not, and downsampling is enabled, it drops frames from g
+// until it is, and reports true. Frame count is reduced while keeping the
+// playback speed; duration is reduced by speeding up playback.
+func checkGIF(g *gif.GIF) (changed bool, _ error) {
+	for {
+		n, d := len(g.Image), memedraw.GIFDuration(g)
+		tooMany := *maxGIFFrames > 0 && n > *maxGIFFrames
+		tooLong := *maxGIFDuration > 0 && d > *maxGIFDuration
+		if !tooMany && !tooLong {
+			return changed, nil
+		} else if !*downsampleGIFs || n == 1 {
+			if tooMany {
+				return false, fmt.Errorf("GIF has too many frames (%d, limit %d)", n, *maxGIFFrames)
+			}
+			return false, fmt.Errorf("GIF is too long (%v, limit %v)", d, *maxGIFDuration)
+		}
+		memedraw.DownsampleGIF(g, tooMany)
+		changed = true
+	}
+}
 
+// addTemplate adds t to the store with the image data from img, which should
+// already have been checked by checkTemplateImage, and records its Etag.
+func (s *tmemeServer) addTemplate(t *tmemes.Template, ext string, img io.Reader) error {
 	etagHash := sha256.New()
 	if err := s.db.AddTemplate(t, ext, newHashPipe(img, etagHash)); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
-	s.imageFileEtags.Store(t.Path, formatEtag(etagHash))
-	redirect := fmt.Sprintf("/create/%v", t.ID)
-	http.Redirect(w, r, redirect, http.StatusFound)
+	tpath, err := s.db.TemplatePath(t.ID)
+	if err != nil {
+		return err
+	}
+	s.imageFileEtags.Store(tpath, formatEtag(etagHash))
+	return nil
 }
 
 // serveAPITemplateDelete implements deletion of templates. Only the user who
@@ -908,7 +2470,7 @@ func (s *tmemeServer) serveAPITemplateDelete(w http.ResponseWriter, r *http.Requ
 
 	// The creator of a template can delete it, otherwise the caller must be a
 	// superuser.
-	if whois.UserProfile.ID != t.Creator && !s.superUser[whois.UserProfile.LoginName] {
+	if whois.UserProfile.ID != t.Creator && !s.isAdmin(whois) {
 		http.Error(w, "permission denied", http.StatusUnauthorized)
 		return
 	}
@@ -916,11 +2478,306 @@ func (s *tmemeServer) serveAPITemplateDelete(w http.ResponseWriter, r *http.Requ
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.logEvent(whois.UserProfile.ID, "delete", "template", t.ID)
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAPITemplateTransfer implements handing the ownership of a template to
+// another user. Only the creator of a template or a server admin can transfer
+// it, and every transfer is recorded in the audit log.
+//
+// API: POST /api/template/:id/transfer
+//
+// The payload must be a JSON object with the "login" name of the new owner,
+// who must be a user of the tailnet, and optionally a "reason" to record. On
+// success, the updated template is written back to the caller.
+func (s *tmemeServer) serveAPITemplateTransfer(w http.ResponseWriter, r *http.Request) {
+	whois := s.checkAccess(w, r, "transfer templates")
+	if whois == nil {
+		return // error already sent
+	}
+	path := strings.TrimSuffix(r.URL.Path, "/transfer")
+	t, ok, err := getSingleFromIDInPath(path, "api/template", s.db.Template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing template ID", http.StatusBadRequest)
+		return
+	}
+	if whois.UserProfile.ID != t.Creator && !s.isAdmin(whois) {
+		http.Error(w, "permission denied", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Login  string `json:"login"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if req.Login == "" {
+		http.Error(w, "missing login of new owner", http.StatusBadRequest)
+		return
+	}
+	up, err := s.userFromLogin(r.Context(), req.Login)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, fmt.Sprintf("unknown user %q", req.Login), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if up.ID == t.Creator {
+		http.Error(w, "template already belongs to that user", http.StatusBadRequest)
+		return
+	}
+
+	from := fmt.Sprintf("user %d", t.Creator)
+	if t.Creator == -1 {
+		from = "anonymous"
+	}
+	t, err = s.db.SetTemplateCreator(t.ID, up.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+		Actor:    whois.UserProfile.ID,
+		Action:   "transfer",
+		Kind:     "template",
+		TargetID: t.ID,
+		Reason:   strings.TrimSpace(fmt.Sprintf("%s (from %s to %s)", req.Reason, from, up.LoginName)),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAPITemplateAreas implements defining the named text areas of a
+// template, which the UI and the macro API use to place text. Only the creator
+// of a template or a server admin can change its areas.
+//
+// API: PATCH /api/template/:id/areas
+//
+// The payload must be a JSON object {"areas":[...]} of tmemes.Area values,
+// each with a distinct name, which replace the existing areas. An empty list
+// removes them. On success, the updated template is written back to the
+// caller.
+func (s *tmemeServer) serveAPITemplateAreas(w http.ResponseWriter, r *http.Request) {
+	whois := s.checkAccess(w, r, "edit templates")
+	if whois == nil {
+		return // error already sent
+	}
+	path, ok := strings.CutSuffix(r.URL.Path, "/areas")
+	if !ok {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t, ok, err := getSingleFromIDInPath(path, "api/template", s.db.Template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing template ID", http.StatusBadRequest)
+		return
+	}
+	if whois.UserProfile.ID != t.Creator && !s.isAdmin(whois) {
+		http.Error(w, "permission denied", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Areas []tmemes.Area `json:"areas"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err := checkTemplateAreas(req.Areas); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err = s.db.SetTemplateAreas(t.ID, req.Areas)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(t); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// checkTemplateAreas reports an error if areas are not valid as the
+// predefined areas of a template. It trims the spaces around their names.
+func checkTemplateAreas(areas []tmemes.Area) error {
+	if len(areas) > tmemes.MaxTemplateAreas {
+		return fmt.Errorf("too many areas (max %d)", tmemes.MaxTemplateAreas)
+	}
+	seen := make(map[string]bool)
+	for i, a := range areas {
+		if err := a.ValidForTemplate(); err != nil {
+			return err
+		}
+		areas[i].Name = strings.TrimSpace(a.Name)
+		key := strings.ToLower(areas[i].Name)
+		if seen[key] {
+			return fmt.Errorf("duplicate area name %q", a.Name)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// serveAPITemplatePatch implements editing the name, description, areas, and
+// category of a template, keeping its image and its macros. Only the creator
+// of a template or a server admin can edit it. Edits by admins of other
+// users' templates are recorded in the audit log.
+//
+// API: PATCH /api/template/:id
+//
+// The payload must be a JSON object with any of the fields "name",
+// "description", "areas", and "category", which replace those of the
+// template; fields left out are unchanged. The name must not be that of
+// another template. The areas and category are as for PATCH
+// /api/template/:id/areas and /api/template/:id/category. On success, the
+// updated template is written back to the caller.
+func (s *tmemeServer) serveAPITemplatePatch(w http.ResponseWriter, r *http.Request) {
+	whois := s.checkAccess(w, r, "edit templates")
+	if whois == nil {
+		return // error already sent
+	}
+	t, ok, err := getSingleFromIDInPath(r.URL.Path, "api/template", s.db.Template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing template ID", http.StatusBadRequest)
+		return
+	}
+	isCreator := whois.UserProfile.ID == t.Creator
+	if !isCreator && !s.isAdmin(whois) {
+		http.Error(w, "permission denied", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name        *string        `json:"name"`
+		Description *string        `json:"description"`
+		Areas       *[]tmemes.Area `json:"areas"`
+		Category    *string        `json:"category"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			http.Error(w, "empty template name", http.StatusBadRequest)
+			return
+		} else if o, err := s.db.TemplateByName(*req.Name); err == nil && o.ID != t.ID {
+			http.Error(w, fmt.Sprintf("duplicate template name %q", o.Name), http.StatusConflict)
+			return
+		}
+	}
+	if req.Description != nil {
+		*req.Description = strings.TrimSpace(*req.Description)
+		if len(*req.Description) > tmemes.MaxTemplateDescription {
+			http.Error(w, fmt.Sprintf("description is too long (max %d bytes)", tmemes.MaxTemplateDescription), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Areas != nil {
+		if err := checkTemplateAreas(*req.Areas); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Category != nil {
+		*req.Category = strings.TrimSpace(*req.Category)
+		if *req.Category != "" {
+			if _, err := s.db.Category(*req.Category); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	oldName := t.Name
+	t, err = s.db.EditTemplate(t.ID, store.TemplateEdit{
+		Name:        req.Name,
+		Description: req.Description,
+		Areas:       req.Areas,
+		Category:    req.Category,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !isCreator {
+		var reason string
+		if t.Name != oldName {
+			reason = fmt.Sprintf("renamed from %q", oldName)
+		}
+		if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+			Actor:    whois.UserProfile.ID,
+			Action:   "edit",
+			Kind:     "template",
+			TargetID: t.ID,
+			Reason:   reason,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// fillTextAreas fills in the Field of each line that does not have one, from
+// the predefined areas of t: the area named by the line, or else the area at
+// the same position as the line, if t has one.
+func fillTextAreas(t *tmemes.Template, lines []tmemes.TextLine) error {
+	for i := range lines {
+		tl := &lines[i]
+		if len(tl.Field) != 0 {
+			continue
+		}
+		if tl.Area != "" {
+			j := slices.IndexFunc(t.Areas, func(a tmemes.Area) bool {
+				return strings.EqualFold(a.Name, tl.Area)
+			})
+			if j < 0 {
+				return fmt.Errorf("template has no area %q", tl.Area)
+			}
+			tl.Field = tmemes.Areas{t.Areas[j]}
+		} else if i < len(t.Areas) {
+			tl.Field = tmemes.Areas{t.Areas[i]}
+		}
+	}
+	return nil
+}
+
+// checkFonts reports an error if any of lines names a font that is not
+// available for drawing.
+func checkFonts(lines []tmemes.TextLine) error {
+	for _, tl := range lines {
+		if !memedraw.HasFont(tl.Font) {
+			return fmt.Errorf("unknown font %q", tl.Font)
+		}
+	}
+	return nil
+}
+
 func (s *tmemeServer) serveAPIVote(w http.ResponseWriter, r *http.Request) {
 	serveMetrics.Add("api-vote", 1)
 	switch r.Method {
@@ -951,6 +2808,9 @@ func (s *tmemeServer) serveAPIVoteGet(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
+	} else if ok && !s.canViewMacro(r, m) {
+		http.Error(w, fmt.Sprintf("macro %d not found", m.ID), http.StatusNotFound)
+		return
 	}
 
 	type macroVote struct {
@@ -1012,6 +2872,9 @@ func (s *tmemeServer) serveAPIVoteDelete(w http.ResponseWriter, r *http.Request)
 	if whois == nil {
 		return // error already sent
 	}
+	if !s.checkRateLimit(w, whois.UserProfile.ID) {
+		return // error already sent
+	}
 
 	m, ok, err := getSingleFromIDInPath(r.URL.Path, "api/vote", s.db.Macro)
 	if err != nil {
@@ -1021,10 +2884,32 @@ func (s *tmemeServer) serveAPIVoteDelete(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "missing macro ID", http.StatusBadRequest)
 		return
 	}
+	if !s.canViewMacro(r, m) {
+		http.Error(w, fmt.Sprintf("macro %d not found", m.ID), http.StatusNotFound)
+		return
+	}
 
-	if _, err := s.db.SetVote(whois.UserProfile.ID, m.ID, 0); err != nil {
+	if _, err := s.db.SetVote(whois.UserProfile.ID, m.ID, 0); errors.Is(err, store.ErrVotesFrozen) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-	} else if err := json.NewEncoder(w).Encode(m); err != nil {
+		return
+	}
+	s.logEvent(whois.UserProfile.ID, voteAction(0), "macro", m.ID)
+	if err := json.NewEncoder(w).Encode(m); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// voteAction returns the audit log action for setting a vote of v.
+func voteAction(v int) string {
+	switch {
+	case v > 0:
+		return "upvote"
+	case v < 0:
+		return "downvote"
+	default:
+		return "unvote"
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// newTestServer returns a server with an empty store, which knows the
+// profile of the tailnet user up and does not ask the tailnet for others.
+func newTestServer(t *testing.T, up *tailcfg.UserProfile) *tmemeServer {
+	t.Helper()
+	db, err := store.New(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &tmemeServer{
+		db:                      db,
+		knownProfiles:           map[tailcfg.UserID]tailcfg.UserProfile{up.ID: *up},
+		lastUpdatedUserProfiles: time.Now(),
+	}
+}
+
+// requestAs returns a request from the tailnet user up, as if its identity
+// had been looked up already.
+func requestAs(up *tailcfg.UserProfile, method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	whois := &apitype.WhoIsResponse{Node: &tailcfg.Node{Name: "laptop"}, UserProfile: up}
+	return r.WithContext(context.WithValue(r.Context(), whoIsKey{}, whois))
+}
+
+func TestHiddenMacroNotFound(t *testing.T) {
+	alice := &tailcfg.UserProfile{ID: 42, LoginName: "alice@example.com"}
+	s := newTestServer(t, alice)
+	tmpl := &tmemes.Template{Name: "drake", Creator: alice.ID}
+	if err := s.db.AddTemplate(tmpl, "png", strings.NewReader("template image")); err != nil {
+		t.Fatalf("AddTemplate: %v", err)
+	}
+	m := &tmemes.Macro{TemplateID: tmpl.ID, Creator: alice.ID, TextOverlay: tmemes.TopBottom("no", "yes")}
+	if err := s.db.AddMacro(m); err != nil {
+		t.Fatalf("AddMacro: %v", err)
+	}
+
+	routes := []struct {
+		method, path, body string
+		handler            http.HandlerFunc
+	}{
+		{"GET", "/api/macro/%d/variants", "", s.serveAPIMacroGet},
+		{"GET", "/api/vote/%d", "", s.serveAPIVote},
+		{"PUT", "/api/vote/%d/up", "", s.serveAPIVote},
+		{"DELETE", "/api/vote/%d", "", s.serveAPIVote},
+		{"POST", "/api/context/%d", `{"action":"add","link":{"url":"https://example.com"}}`, s.serveAPIContext},
+	}
+	call := func(method, path, body string, h http.HandlerFunc) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, requestAs(alice, method, fmt.Sprintf(path, m.ID), body))
+		return w
+	}
+	for _, rt := range routes {
+		if w := call(rt.method, rt.path, rt.body, rt.handler); w.Code == http.StatusNotFound {
+			t.Errorf("%s %s of visible macro: got 404: %s", rt.method, rt.path, w.Body)
+		}
+	}
+
+	if _, err := s.db.SetMacroHidden(m.ID, true); err != nil {
+		t.Fatalf("SetMacroHidden: %v", err)
+	}
+	for _, rt := range routes {
+		if w := call(rt.method, rt.path, rt.body, rt.handler); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s of hidden macro: got %d %s, want 404", rt.method, rt.path, w.Code, w.Body)
+		}
+	}
+	if got, _ := s.db.Macro(m.ID); len(got.ContextLink) != 1 {
+		t.Errorf("Hidden macro context: got %v, want the link added while visible", got.ContextLink)
+	}
+}
+
+func TestEditMacro(t *testing.T) {
+	alice := &tailcfg.UserProfile{ID: 42, LoginName: "alice@example.com"}
+	s := newTestServer(t, alice)
+	tmpl := &tmemes.Template{Name: "drake", Creator: alice.ID, Areas: []tmemes.Area{{X: 0.5, Y: 0.25}, {X: 0.5, Y: 0.75}}}
+	if err := s.db.AddTemplate(tmpl, "png", strings.NewReader("template image")); err != nil {
+		t.Fatalf("AddTemplate: %v", err)
+	}
+	m := &tmemes.Macro{TemplateID: tmpl.ID, Creator: alice.ID, TextOverlay: tmemes.TopBottom("no", "yes")}
+	if err := s.db.AddMacro(m); err != nil {
+		t.Fatalf("AddMacro: %v", err)
+	}
+	edit := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.serveAPIMacroPut(w, requestAs(alice, "PUT", fmt.Sprintf("/api/macro/%d", m.ID), body))
+		return w
+	}
+
+	if w := edit(`{"textOverlay":[{"text":"top"},{"text":"bottom"}]}`); w.Code != http.StatusOK {
+		t.Fatalf("Edit: got %d %s", w.Code, w.Body)
+	}
+	got, err := s.db.Macro(m.ID)
+	if err != nil {
+		t.Fatalf("Macro: %v", err)
+	}
+	for i, tl := range got.TextOverlay {
+		if len(tl.Field) == 0 || tl.Field[0].Y != tmpl.Areas[i].Y {
+			t.Errorf("Edited line %d: got area %v, want that of template area %d", i, tl.Field, i)
+		}
+	}
+	log, err := s.db.AuditLog(0)
+	if err != nil {
+		t.Fatalf("AuditLog: %v", err)
+	} else if len(log) == 0 || log[0].Action != "edit" || log[0].Actor != alice.ID || log[0].TargetID != m.ID {
+		t.Errorf("Audit log: got %+v, want an edit by the creator", log)
+	}
+
+	if w := edit(`{"textOverlay":[{"text":"x","font":"Comic Sans"}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Edit with unknown font: got %d %s, want 400", w.Code, w.Body)
+	}
+	if w := edit(`{"textOverlay":`); w.Code != http.StatusBadRequest {
+		t.Errorf("Edit with invalid body: got %d %s, want 400", w.Code, w.Body)
+	}
+}
+
+func TestPublicNSFWMacro(t *testing.T) {
+	defer func(old bool) { *serveFunnel = old }(*serveFunnel)
+	*serveFunnel = true
+
+	alice := &tailcfg.UserProfile{ID: 42, LoginName: "alice@example.com"}
+	s := newTestServer(t, alice)
+	s.publicLinkKey = make([]byte, publicLinkKeySize)
+	tmpl := &tmemes.Template{Name: "drake", Creator: alice.ID}
+	if err := s.db.AddTemplate(tmpl, "png", strings.NewReader("template image")); err != nil {
+		t.Fatalf("AddTemplate: %v", err)
+	}
+	m := &tmemes.Macro{TemplateID: tmpl.ID, Creator: alice.ID, TextOverlay: tmemes.TopBottom("no", "yes")}
+	if err := s.db.AddMacro(m); err != nil {
+		t.Fatalf("AddMacro: %v", err)
+	}
+	share := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.serveAPIMacroPublic(w, requestAs(alice, "PUT", "/", `{"public":true}`), fmt.Sprintf("/api/macro/%d", m.ID))
+		return w
+	}
+	fetch := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.servePublicMacro(w, httptest.NewRequest("GET", fmt.Sprintf("%s%d/%s", publicPrefix, m.ID, s.publicToken(m.ID)), nil))
+		return w
+	}
+
+	if _, err := s.db.SetMacroNSFW(m.ID, true); err != nil {
+		t.Fatalf("SetMacroNSFW: %v", err)
+	}
+	if w := share(); w.Code != http.StatusForbidden {
+		t.Errorf("Share NSFW macro: got %d %s, want 403", w.Code, w.Body)
+	}
+
+	// A macro shared before it was marked is no longer served.
+	if _, err := s.db.SetMacroPublic(m.ID, true); err != nil {
+		t.Fatalf("SetMacroPublic: %v", err)
+	}
+	if w := fetch(); w.Code != http.StatusNotFound {
+		t.Errorf("Fetch NSFW macro: got %d, want 404", w.Code)
+	}
+	if _, err := s.db.SetMacroNSFW(m.ID, false); err != nil {
+		t.Fatalf("SetMacroNSFW: %v", err)
+	}
+	if _, err := s.db.SetTemplateNSFW(tmpl.ID, true); err != nil {
+		t.Fatalf("SetTemplateNSFW: %v", err)
+	}
+	if w := fetch(); w.Code != http.StatusNotFound {
+		t.Errorf("Fetch macro of NSFW template: got %d, want 404", w.Code)
+	}
+}
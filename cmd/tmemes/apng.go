@@ -0,0 +1,108 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"path/filepath"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/memedraw"
+	"github.com/tailscale/tmemes/store"
+)
+
+// Animated PNG templates.
+//
+// A PNG template image that is animated (an APNG) is stored with the file
+// extension ".apng", and its macros are rendered as animated PNGs, or as
+// animated WebP images if -webp-macros is set. Unlike GIFs, the frames keep
+// their full 24-bit colour and alpha, so gradients and photographic sources
+// do not band. APNG templates are subject to the same limits as GIFs on size
+// (-max-gif-size), frames, and duration, and are downsampled like GIFs if
+// -gif-downsample is set. Video renderings are only available for GIFs.
+
+func init() {
+	// Browsers accept animated PNGs as image/png, but the standard library
+	// does not know the extension at all.
+	mime.AddExtensionType(".apng", "image/apng")
+}
+
+// isAnimatedTemplate reports whether t has an animated image.
+func isAnimatedTemplate(t *tmemes.Template) bool {
+	ext := filepath.Ext(t.Path)
+	return ext == ".gif" || ext == ".apng"
+}
+
+// pngTemplateExt reports the file extension to store the PNG image in img
+// with: ".apng" if it is animated, and ".png" otherwise. It leaves img
+// positioned at the beginning of the data.
+func pngTemplateExt(img io.ReadSeeker) (string, error) {
+	// Data that is not a PNG at all is left for image.Decode to sort out.
+	animated, _ := memedraw.IsAPNG(img)
+	if _, err := img.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	} else if animated {
+		return ".apng", nil
+	}
+	return ".png", nil
+}
+
+// checkAPNG checks that a is within the configured limits on frame count
+// and duration, and downsamples it if it is not, as checkGIF does for GIFs.
+func checkAPNG(a *memedraw.APNG) (changed bool, _ error) {
+	for {
+		n, d := len(a.Image), memedraw.APNGDuration(a)
+		tooMany := *maxGIFFrames > 0 && n > *maxGIFFrames
+		tooLong := *maxGIFDuration > 0 && d > *maxGIFDuration
+		if !tooMany && !tooLong {
+			return changed, nil
+		} else if !*downsampleGIFs || n == 1 {
+			if tooMany {
+				return false, fmt.Errorf("animated PNG has too many frames (%d, limit %d)", n, *maxGIFFrames)
+			}
+			return false, fmt.Errorf("animated PNG is too long (%v, limit %v)", d, *maxGIFDuration)
+		}
+		memedraw.DownsampleAPNG(a, tooMany)
+		changed = true
+	}
+}
+
+// drawMacroAPNG renders the text specified by m onto each frame of the
+// template APNG stored in srcFile, and writes it to dst as an animated PNG or
+// an animated WebP according to ext, with encoder settings es.
+func (s *tmemeServer) drawMacroAPNG(dst io.Writer, m *tmemes.Macro, ext string, srcFile store.File, es encodeSettings) (retErr error) {
+	macroMetrics.Add("generate-apng", 1)
+	start := time.Now()
+	log.Printf("generating APNG for macro %d", m.ID)
+	defer func() {
+		if retErr != nil {
+			log.Printf("error generating APNG for macro %d: %v", m.ID, retErr)
+		} else {
+			log.Printf("generated APNG for macro %d in %v", m.ID, time.Since(start).Round(time.Millisecond))
+		}
+	}()
+
+	ss, err := s.loadStickers(m)
+	if err != nil {
+		return err
+	}
+	a, err := memedraw.DecodeAPNG(srcFile)
+	if err != nil {
+		return err
+	}
+	memedraw.DrawAPNG(a, m, ss)
+	switch ext {
+	case ".apng":
+		return memedraw.EncodeAPNG(dst, a, es.pngEncoder().CompressionLevel)
+	case ".webp":
+		macroMetrics.Add("generate-webp", 1)
+		return memedraw.EncodeAPNGWebP(dst, a)
+	default:
+		return fmt.Errorf("unknown extension: %v", ext)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/tailcfg"
+)
+
+// Audio templates.
+//
+// If the -ffmpeg flag is set, a short MP3 or Ogg sound clip may be uploaded
+// as a template. The server draws a waveform of the clip with ffmpeg, and
+// stores that as the template image, so captions are drawn on it like any
+// other template. The clip is stored alongside the image, and served in its
+// place by the content endpoints when the caller asks for audio.
+
+// audioFormats maps the file extensions accepted for sound clips to their
+// MIME types.
+var audioFormats = map[string]string{
+	".mp3": "audio/mpeg",
+	".ogg": "audio/ogg",
+}
+
+const (
+	waveformSize    = "640x360" // dimensions of a waveform image
+	waveformTimeout = 30 * time.Second
+)
+
+// isAudioUpload reports whether filename names a sound clip to be uploaded
+// as an audio template.
+func isAudioUpload(filename string) bool {
+	_, ok := audioFormats[strings.ToLower(filepath.Ext(filename))]
+	return ok
+}
+
+// readAudioTemplate reads the sound clip in r, whose size is given, and checks
+// that it is acceptable for an audio template. It returns the contents of the
+// clip and a PNG waveform image for it.
+func readAudioTemplate(size int64, r io.Reader) (clip, waveform []byte, _ error) {
+	if *ffmpegPath == "" {
+		return nil, nil, errors.New("audio templates are not enabled")
+	} else if limit := *maxAudioSize << 20; size > limit {
+		return nil, nil, fmt.Errorf("audio clip too large (limit %d MiB)", limit>>20)
+	}
+	clip, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	waveform, err = drawWaveform(clip)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid audio clip: %w", err)
+	}
+	return clip, waveform, nil
+}
+
+// drawWaveform runs ffmpeg to draw a waveform picture of the sound clip, and
+// returns it as a PNG image.
+func drawWaveform(clip []byte) ([]byte, error) {
+	macroMetrics.Add("generate-waveform", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), waveformTimeout)
+	defer cancel()
+
+	// Draw the waveform on an opaque background, so that captions are legible.
+	filter := fmt.Sprintf("color=c=0x202020:s=%[1]s[bg];[0:a]showwavespic=s=%[1]s:colors=0x6fa8dc[wave];[bg][wave]overlay=format=auto", waveformSize)
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, *ffmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-i", "pipe:0",
+		"-filter_complex", filter,
+		"-frames:v", "1", "-f", "image2", "-c:v", "png", "pipe:1",
+	)
+	cmd.Stdin = bytes.NewReader(clip)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	} else if out.Len() == 0 {
+		return nil, errors.New("ffmpeg produced no image")
+	}
+	return out.Bytes(), nil
+}
+
+// wantsAudio reports whether the content request r for an image of template
+// t, requested with file extension ext, should be served the template's
+// sound clip instead. This is so if ext is the extension of the clip, or if
+// there is no extension and r prefers audio to images.
+func wantsAudio(r *http.Request, t *tmemes.Template, ext string) bool {
+	if t.Audio == "" {
+		return false
+	} else if ext != "" {
+		return strings.EqualFold(ext, filepath.Ext(t.Audio))
+	}
+	var audioQ, imageQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch {
+		case strings.HasPrefix(mt, "audio/"):
+			audioQ = max(audioQ, q)
+		case strings.HasPrefix(mt, "image/"), mt == "*/*":
+			imageQ = max(imageQ, q)
+		}
+	}
+	return audioQ > imageQ
+}
+
+// addAudioTemplate adds t to the store as an audio template, with the sound
+// clip in r, uploaded by actor with the given filename and size. On success,
+// it redirects the caller to the create page for the template.
+func (s *tmemeServer) addAudioTemplate(w http.ResponseWriter, r *http.Request, actor tailcfg.UserID, t *tmemes.Template, filename string, size int64, clip io.Reader) {
+	data, waveform, err := readAudioTemplate(size, clip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	img, imgExt, err := s.checkTemplateImage(t, "waveform.png", int64(len(waveform)), bytes.NewReader(waveform))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.addTemplate(t, imgExt, img); err != nil {
+		writeAddTemplateError(w, err)
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if err := s.db.SetTemplateAudio(t.ID, ext, bytes.NewReader(data)); err != nil {
+		// Don't leave the waveform as a template by itself.
+		if herr := s.db.SetTemplateHidden(t.ID, true); herr != nil {
+			log.Printf("hiding template %d: %v", t.ID, herr)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logEvent(actor, "create", "template", t.ID)
+	http.Redirect(w, r, fmt.Sprintf("/create/%v", t.ID), http.StatusFound)
+}
+
+// serveTemplateAudio serves the sound clip of audio template t.
+func (s *tmemeServer) serveTemplateAudio(w http.ResponseWriter, r *http.Request, t *tmemes.Template) {
+	ap, err := s.db.TemplateAudioPath(t.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	serveMetrics.Add("content-audio", 1)
+	if mt, ok := audioFormats[strings.ToLower(filepath.Ext(ap))]; ok {
+		w.Header().Set("Content-Type", mt)
+	}
+	s.serveFileCached(w, r, ap, cacheControl(365*24*time.Hour, false))
+}
@@ -0,0 +1,188 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/tailscale/tmemes"
+)
+
+// Branding.
+//
+// Server admins can give the server its own name, logo, accent color, and
+// footer links, which are shown in the UI and the web app manifest and used
+// in posts to the digest webhook. The branding is stored in the Meta table of
+// the store. Because the UI templates are shared by the whole process, the
+// current branding is kept in a global for the "branding" template function.
+
+const brandingMeta = "branding"
+
+// Defaults for the fields of a tmemes.Branding.
+const (
+	defaultBrandingName  = "tmemes"
+	defaultBrandingTitle = "tmemes: putting the meme in TS"
+	defaultBrandingLogo  = "/static/icon.svg"
+)
+
+// currentBranding is the branding of the server, as last loaded or set.
+var currentBranding atomic.Pointer[tmemes.Branding]
+
+// uiBranding is the branding of the server as used by the UI templates, with
+// defaults filled in.
+type uiBranding struct {
+	Name        string // the name of the server
+	Title       string // the title of UI pages
+	LogoURL     string // empty for the default logo
+	AccentColor string // a CSS color, or empty for the default
+	FooterLinks []tmemes.BrandingLink
+}
+
+// brandingForUI returns the current branding for the UI templates.
+func brandingForUI() uiBranding {
+	b := currentBranding.Load()
+	if b == nil {
+		b = new(tmemes.Branding)
+	}
+	ub := uiBranding{
+		Name:        b.Name,
+		Title:       b.Name,
+		LogoURL:     b.LogoURL,
+		FooterLinks: b.FooterLinks,
+	}
+	if ub.Name == "" {
+		ub.Name, ub.Title = defaultBrandingName, defaultBrandingTitle
+	}
+	if b.AccentColor != nil {
+		text, _ := b.AccentColor.MarshalText()
+		ub.AccentColor = string(text)
+	}
+	return ub
+}
+
+// loadBranding loads the branding of the server from the store.
+func (s *tmemeServer) loadBranding() error {
+	bits, err := s.db.GetMeta(brandingMeta)
+	if err != nil {
+		return err
+	}
+	b := new(tmemes.Branding)
+	if bits != nil {
+		if err := json.Unmarshal(bits, b); err != nil {
+			return fmt.Errorf("decode branding: %w", err)
+		}
+	}
+	currentBranding.Store(b)
+	return nil
+}
+
+// serveAPIBranding reports the branding of the server.
+//
+// API: GET /api/branding
+//
+// The result is a JSON tmemes.Branding. Fields left at their default values
+// are omitted.
+func (s *tmemeServer) serveAPIBranding(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-branding", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentBranding.Load()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAPIAdminBranding implements customizing the branding of the server.
+// Only server admins can use this method.
+//
+// API: PUT /api/admin/branding
+//
+// The payload must be a JSON tmemes.Branding, which replaces the current
+// branding; leave a field empty to use its default. On success, the new
+// branding is written back to the caller.
+func (s *tmemeServer) serveAPIAdminBranding(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-branding", 1)
+	if r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkAdmin(w, r, "change the branding")
+	if whois == nil {
+		return // error already sent
+	}
+	b := new(tmemes.Branding)
+	if err := json.NewDecoder(r.Body).Decode(b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err := b.Valid(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bits, err := json.Marshal(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.db.SetMeta(brandingMeta, bits); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	currentBranding.Store(b)
+	if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+		Actor:  whois.UserProfile.ID,
+		Action: "update-branding",
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveWebManifest serves the web app manifest, with the name, icon, and
+// theme color of the current branding.
+//
+// API: /static/manifest.webmanifest
+func (s *tmemeServer) serveWebManifest(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("static-manifest", 1)
+	bits, err := fs.ReadFile(staticFS, "static/manifest.webmanifest")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var man map[string]any
+	if err := json.Unmarshal(bits, &man); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ub := brandingForUI()
+	man["name"], man["short_name"] = ub.Title, ub.Name
+	if ub.AccentColor != "" {
+		man["theme_color"] = ub.AccentColor
+	}
+	if ub.LogoURL != "" {
+		man["icons"] = []map[string]string{{"src": ub.LogoURL, "sizes": "any", "purpose": "any"}}
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	if err := json.NewEncoder(w).Encode(man); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// digestPrefix returns the prefix for messages posted to the digest webhook,
+// naming the server if it has a custom name.
+func digestPrefix() string {
+	if b := currentBranding.Load(); b != nil && b.Name != "" {
+		return b.Name + ": "
+	}
+	return ""
+}
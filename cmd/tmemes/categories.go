@@ -0,0 +1,167 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tailscale/tmemes"
+)
+
+// serveAPICategory implements managing the categories of templates. Anyone
+// can list the categories; only server admins can change them.
+//
+// API: GET /api/category            -- list categories
+// API: PUT /api/category/:name      -- create or update a category
+// API: DELETE /api/category/:name   -- delete a category
+//
+// The list is {"categories":[...]} of tmemes.Category values, ordered by
+// name. The PUT payload is {"description":"..."}; on success, the category is
+// written back to the caller. Names are matched ignoring case, and a PUT with
+// the name of an existing category in a different case renames it. Deleting a
+// category does not delete its templates, but leaves them uncategorized.
+func (s *tmemeServer) serveAPICategory(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-category", 1)
+	name, _ := url.PathUnescape(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/category"), "/"))
+	if name == "" {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cats, err := s.db.Categories()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rsp := struct {
+			C []*tmemes.Category `json:"categories"`
+		}{C: cats}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rsp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		c, err := s.db.Category(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case "PUT":
+		if s.checkAdmin(w, r, "edit categories") == nil {
+			return // error already sent
+		}
+		var req struct {
+			Description string `json:"description"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c := &tmemes.Category{Name: name, Description: req.Description}
+		if err := c.Valid(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.db.SetCategory(c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case "DELETE":
+		if s.checkAdmin(w, r, "delete categories") == nil {
+			return // error already sent
+		}
+		if err := s.db.DeleteCategory(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveAPITemplateCategory implements setting the category of a template.
+// Only the creator of a template or a server admin can change its category.
+//
+// API: PATCH /api/template/:id/category
+//
+// The payload must be a JSON object {"category":"..."} naming an existing
+// category, or "" to remove the template from its category. On success, the
+// updated template is written back to the caller.
+func (s *tmemeServer) serveAPITemplateCategory(w http.ResponseWriter, r *http.Request, path string) {
+	whois := s.checkAccess(w, r, "edit templates")
+	if whois == nil {
+		return // error already sent
+	}
+	t, ok, err := getSingleFromIDInPath(path, "api/template", s.db.Template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing template ID", http.StatusBadRequest)
+		return
+	}
+	if whois.UserProfile.ID != t.Creator && !s.isAdmin(whois) {
+		http.Error(w, "permission denied", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Category string `json:"category"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c := strings.TrimSpace(req.Category); c != "" {
+		if _, err := s.db.Category(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	t, err = s.db.SetTemplateCategory(t.ID, strings.TrimSpace(req.Category))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// filterCategory returns the templates in ts that belong to the category
+// named by the "category" parameter of r, ignoring case. If the parameter is
+// not set, ts is returned unchanged.
+func filterCategory(r *http.Request, ts []*tmemes.Template) []*tmemes.Template {
+	name := r.FormValue("category")
+	if name == "" {
+		return ts
+	}
+	var out []*tmemes.Template
+	for _, t := range ts {
+		if strings.EqualFold(t.Category, name) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,603 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Chat bots.
+//
+// Users of several chat services can make macros without leaving them, with
+// a command such as
+//
+//	/meme drake "no" "yes"
+//
+// as a slash command in Slack (slackcmd.go), Discord (discord.go), and
+// Mattermost (mattermost.go), or as a message starting with "!meme" in
+// Matrix (matrix.go). Each service is a chatBot, which finds the tailnet
+// user on whose behalf a chat user acts and posts the replies to commands;
+// the commands themselves are parsed and carried out in the same way for
+// all of them.
+//
+// Slack reveals the email addresses of its users, which are matched to the
+// login names of tailnet users. The other services do not, so their users
+// link their accounts instead: the "link" command replies with a link to
+//
+//	/chat/link?service=<service>&id=<user>&name=<name>&expires=<time>&token=<token>
+//
+// on the tailnet, signed by the server and valid for a short time, where the
+// tailnet user who opens it confirms that the chat account is theirs. Until
+// then, the chat user can do nothing else. Linking again replaces the
+// earlier link of the chat account.
+//
+// Chat services cannot reach the tailnet, so a macro made from chat is
+// public, as if its creator had shared it (see funnel.go), and its image is
+// served to the service at a signed URL on the Funnel listener, or uploaded
+// to it.
+
+// A chatBot connects the server to a chat service.
+type chatBot interface {
+	// service returns the name of the chat service, as used in logs,
+	// metrics, and account links.
+	service() string
+
+	// tailnetUser returns the tailnet user on whose behalf the chat user
+	// with the given ID makes macros. Its errors are shown to the user.
+	tailnetUser(ctx context.Context, user string) (*tailcfg.UserProfile, error)
+
+	// post posts reply in conv, the conversation where a command was given.
+	post(ctx context.Context, conv chatConv, reply chatReply) error
+}
+
+// A chatConv is the conversation in which a chat command was given. Which
+// fields are set depends on the service.
+type chatConv struct {
+	User        string // the ID of the sender on the chat service
+	UserName    string // the name of the sender, for account links
+	ResponseURL string // where replies to the command are posted
+	Channel     string // the channel or room of the command
+	Thread      string // if set, the thread within Channel
+	Message     string // the ID of the message with the command
+}
+
+// A chatReply is the reply to a chat command. Exactly one field is set.
+type chatReply struct {
+	Text  string     // a message for the sender alone, if the service allows
+	Macro *chatMacro // the macro made by the command
+	Top   *chatTop   // the top macros, for a top command
+}
+
+// A chatMacro is a macro as it is shown in chat.
+type chatMacro struct {
+	*tmemes.Macro
+	Template *tmemes.Template
+	URL      string // of the macro's page on the tailnet
+	ImageURL string // if set, where its image is served outside the tailnet
+	Creator  string // the display name of its creator
+}
+
+// A chatTop is the list of top macros of a leaderboard period.
+type chatTop struct {
+	Title  string       // such as "Top macros of the week"
+	URL    string       // of the leaderboard page on the tailnet
+	Macros []*chatMacro // best first
+}
+
+// runChatCommand carries out cmd, given in conv on bot, and posts the reply.
+// Macros it makes have the given context links.
+func (s *tmemeServer) runChatCommand(bot chatBot, conv chatConv, cmd memeCommand, links []tmemes.ContextLink) {
+	ctx, cancel := context.WithTimeout(context.Background(), chatTimeout)
+	defer cancel()
+	reply := s.chatCommandReply(ctx, bot, conv, cmd, links)
+	if err := bot.post(ctx, conv, reply); err != nil {
+		log.Printf("[%s] replying to command: %v", bot.service(), err)
+	}
+}
+
+// chatCommandReply carries out cmd, given in conv on bot, and returns the
+// reply.
+func (s *tmemeServer) chatCommandReply(ctx context.Context, bot chatBot, conv chatConv, cmd memeCommand, links []tmemes.ContextLink) chatReply {
+	if cmd.Link {
+		if chatLinkServices[bot.service()] == "" {
+			return chatReply{Text: "Your account is matched to the tailnet by its email address, and needs no link."}
+		}
+		u := s.chatLinkURL(chatLink{Service: bot.service(), ID: conv.User, Name: conv.UserName}, time.Now().Add(chatLinkTTL))
+		return chatReply{Text: fmt.Sprintf("To make macros as yourself, open %s on the tailnet within %v.", u, chatLinkTTL)}
+	}
+	up, err := bot.tailnetUser(ctx, conv.User)
+	if err != nil {
+		return chatReply{Text: fmt.Sprintf("Sorry, %s.", err)}
+	}
+	if cmd.Top != "" {
+		serveMetrics.Add(bot.service()+"-top", 1)
+		return chatReply{Top: s.chatTop(ctx, cmd.Top)}
+	}
+	m, t, err := s.createChatMacro(up, cmd, links)
+	if err != nil {
+		return chatReply{Text: fmt.Sprintf("Could not make that macro: %s", err)}
+	}
+	serveMetrics.Add(bot.service()+"-macro", 1)
+	return chatReply{Macro: s.newChatMacro(ctx, m, t)}
+}
+
+// newChatMacro returns m, on template t, as it is shown in chat. Like
+// unfurls, it has an image only if m is public and not NSFW.
+func (s *tmemeServer) newChatMacro(ctx context.Context, m *tmemes.Macro, t *tmemes.Template) *chatMacro {
+	cm := &chatMacro{
+		Macro:    m,
+		Template: t,
+		URL:      fmt.Sprintf("%s/m/%d", s.serverBaseURL(), m.ID),
+		Creator:  s.userDisplayName(ctx, m.Creator, m.CreatedAt),
+	}
+	if m.Public && !isNSFW(m, t) {
+		cm.ImageURL = s.unfurlImageURL(m)
+	}
+	return cm
+}
+
+// chatTop returns the top macros of the given leaderboard period, as for
+// /api/leaderboard.
+func (s *tmemeServer) chatTop(ctx context.Context, period string) *chatTop {
+	top := &chatTop{
+		Title: "Top macros of all time",
+		URL:   fmt.Sprintf("%s/leaderboard?period=%s", s.serverBaseURL(), period),
+	}
+	if period != "all" {
+		top.Title = "Top macros of the " + period
+	}
+	macros, _ := s.leaderboard(ctx, leaderboardPeriods[period])
+	for _, m := range macros[:min(len(macros), chatTopCount)] {
+		if t, err := s.db.AnyTemplate(m.TemplateID); err == nil {
+			top.Macros = append(top.Macros, s.newChatMacro(ctx, m, t))
+		}
+	}
+	return top
+}
+
+// chatUsage returns the reply to a command that cannot be parsed, or a
+// request for help, where the command is invoked as command.
+func chatUsage(command string) string {
+	return fmt.Sprintf("Usage: `%[1]s <template> \"top text\" \"bottom text\" [--anon] [--color <color>]`\n"+
+		"Quote template names and texts of more than one word, with any kind of quotes.\n"+
+		"`%[1]s top [day|week|month|all]` lists the top macros, and "+
+		"`%[1]s link` links your account to the tailnet where needed.", command)
+}
+
+const (
+	defaultTopPeriod = "day"            // the leaderboard period of a bare top command
+	chatTopCount     = 5                // the number of macros a top command lists
+	chatTimeout      = 30 * time.Second // for carrying out a command
+)
+
+// A memeCommand is a parsed chat command.
+type memeCommand struct {
+	Template string        // the ID or name of the template
+	Lines    []string      // the text for each area, in order
+	Anon     bool          // make the macro without attribution
+	Color    *tmemes.Color // if set, the color of the text
+
+	// If set, list the top macros of this leaderboard period instead.
+	Top string
+
+	// If set, link the account of the sender to the tailnet instead.
+	Link bool
+}
+
+// errMemeHelp is reported by parseChatCommand for a request for help.
+var errMemeHelp = errors.New("help requested")
+
+// parseChatCommand parses the text of a chat command: a template name
+// followed by the text for each area, and options, in any order; or one of
+// the words "help", "top", and "link", unquoted.
+func parseChatCommand(text string) (memeCommand, error) {
+	args, err := splitCommandArgs(text)
+	if err != nil {
+		return memeCommand{}, err
+	}
+	var cmd memeCommand
+	var pos []commandArg // the arguments that are not options
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, ok := arg.option()
+		if !ok {
+			pos = append(pos, arg)
+			continue
+		}
+		name, value, hasValue := strings.Cut(name, "=")
+		switch name {
+		case "anon":
+			if hasValue {
+				return memeCommand{}, errors.New("--anon takes no value")
+			}
+			cmd.Anon = true
+		case "color":
+			if !hasValue {
+				if i+1 == len(args) {
+					return memeCommand{}, errors.New("--color needs a color")
+				}
+				i++
+				value = args[i].text
+			}
+			var c tmemes.Color
+			if err := c.UnmarshalText([]byte(value)); err != nil {
+				return memeCommand{}, fmt.Errorf("invalid color %q", value)
+			}
+			cmd.Color = &c
+		case "help":
+			return memeCommand{}, errMemeHelp
+		default:
+			return memeCommand{}, fmt.Errorf("unknown option %q", "--"+name)
+		}
+	}
+	if len(pos) == 0 {
+		return memeCommand{}, errors.New("missing template")
+	} else if len(pos) == 1 && isCommandWord(pos[0], "help") {
+		return memeCommand{}, errMemeHelp
+	} else if len(pos) == 1 && isCommandWord(pos[0], "link") {
+		if cmd.Anon || cmd.Color != nil {
+			return memeCommand{}, errors.New("link takes no options")
+		}
+		return memeCommand{Link: true}, nil
+	} else if period, ok := topCommandPeriod(pos); ok {
+		if cmd.Anon || cmd.Color != nil {
+			return memeCommand{}, errors.New("top takes no options")
+		}
+		return memeCommand{Top: period}, nil
+	} else if len(pos) == 1 {
+		return memeCommand{}, errors.New("missing text")
+	}
+	cmd.Template = pos[0].text
+	for _, arg := range pos[1:] {
+		cmd.Lines = append(cmd.Lines, arg.text)
+	}
+	return cmd, nil
+}
+
+// topCommandPeriod reports the leaderboard period of a top command, if pos
+// is one: "top" followed by an optional period name, both unquoted. A quoted
+// "top" names a template.
+func topCommandPeriod(pos []commandArg) (string, bool) {
+	if len(pos) > 2 || !isCommandWord(pos[0], "top") {
+		return "", false
+	} else if len(pos) == 1 {
+		return defaultTopPeriod, true
+	}
+	period := strings.ToLower(pos[1].text)
+	if _, ok := leaderboardPeriods[period]; !ok || pos[1].quoted {
+		return "", false
+	}
+	return period, true
+}
+
+// isCommandWord reports whether arg is the unquoted word w.
+func isCommandWord(arg commandArg, w string) bool {
+	return !arg.quoted && strings.EqualFold(arg.text, w)
+}
+
+// A commandArg is one argument of a chat command.
+type commandArg struct {
+	text   string
+	quoted bool // whether the text was quoted
+}
+
+// option reports the name of the option arg sets, if it is one: an unquoted
+// argument starting with "--", or with a dash that a chat client may have
+// made of it.
+func (arg commandArg) option() (string, bool) {
+	if arg.quoted {
+		return "", false
+	}
+	for _, p := range []string{"--", "\u2014", "\u2013"} { // em and en dashes
+		if name, ok := strings.CutPrefix(arg.text, p); ok && name != "" {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// commandQuotes maps the opening quotation marks understood in chat
+// commands to their closing marks. Chat clients often replace straight
+// quotes with typographic ones.
+var commandQuotes = map[rune]rune{
+	'"':      '"',
+	'\'':     '\'',
+	'\u201c': '\u201d', // “ ”
+	'\u2018': '\u2019', // ‘ ’
+	'\u201e': '\u201c', // „ “
+	'\u00ab': '\u00bb', // « »
+}
+
+// splitCommandArgs splits the text of a chat command into arguments,
+// separated by spaces. An argument may be quoted to include spaces, and
+// within quotes a backslash escapes the next character.
+func splitCommandArgs(text string) ([]commandArg, error) {
+	text = strings.ToValidUTF8(text, "\uFFFD")
+	var args []commandArg
+	rs := []rune(text)
+	for i := 0; i < len(rs); {
+		if unicode.IsSpace(rs[i]) {
+			i++
+			continue
+		}
+		closing, quoted := commandQuotes[rs[i]]
+		if !quoted {
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) {
+				j++
+			}
+			args = append(args, commandArg{text: string(rs[i:j])})
+			i = j
+			continue
+		}
+		var sb strings.Builder
+		j := i + 1
+		for ; j < len(rs) && rs[j] != closing; j++ {
+			if rs[j] == '\\' && j+1 < len(rs) {
+				j++
+			}
+			sb.WriteRune(rs[j])
+		}
+		if j == len(rs) {
+			return nil, fmt.Errorf("missing closing quote after %s", string(rs[i:min(i+20, len(rs))]))
+		}
+		args = append(args, commandArg{text: sb.String(), quoted: true})
+		i = j + 1
+	}
+	return args, nil
+}
+
+// createChatMacro makes the macro described by cmd on behalf of up, with the
+// given context links, subject to the same checks and limits as
+// POST /api/macro.
+func (s *tmemeServer) createChatMacro(up *tailcfg.UserProfile, cmd memeCommand, links []tmemes.ContextLink) (*tmemes.Macro, *tmemes.Template, error) {
+	if _, ok := s.limiter.allow(up.ID); !ok {
+		serveMetrics.Add("rate-limited", 1)
+		return nil, nil, errors.New("rate limit exceeded, try again later")
+	}
+	t, err := s.findChatTemplate(cmd.Template)
+	if err != nil {
+		return nil, nil, err
+	}
+	overlay, err := chatOverlay(t, cmd.Lines)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cmd.Color != nil {
+		for i := range overlay {
+			overlay[i].Color = *cmd.Color
+		}
+	}
+	m := &tmemes.Macro{TemplateID: t.ID, TextOverlay: overlay, ContextLink: links, Public: true}
+	if cmd.Anon {
+		m.Creator = -1
+	}
+	whois := &apitype.WhoIsResponse{Node: &tailcfg.Node{Name: "chat"}, UserProfile: up}
+	if _, err := s.prepareMacro(m, whois); err != nil {
+		return nil, nil, err
+	}
+	if err := s.db.AddMacro(m); err != nil {
+		return nil, nil, err
+	}
+	s.logEvent(up.ID, "create", "macro", m.ID)
+	s.notifyTemplateUsed(m)
+	return m, t, nil
+}
+
+// findChatTemplate returns the visible template with the given ID or name.
+func (s *tmemeServer) findChatTemplate(key string) (*tmemes.Template, error) {
+	if id, err := strconv.Atoi(key); err == nil {
+		if t, err := s.db.Template(id); err == nil {
+			return t, nil
+		}
+	} else if t, err := s.db.TemplateByName(key); err == nil {
+		return t, nil
+	}
+	return nil, fmt.Errorf("no template %q", key)
+}
+
+// chatOverlay returns the text overlay placing lines on t: each in one of
+// the areas of t, in order, or at the top and bottom of the image if t has
+// no areas. Empty lines leave their area blank.
+func chatOverlay(t *tmemes.Template, lines []string) ([]tmemes.TextLine, error) {
+	if len(t.Areas) == 0 {
+		if len(lines) > 2 {
+			return nil, errors.New("the template takes only top and bottom text")
+		}
+		lines = append(lines, "")
+		return tmemes.TopBottom(strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1])), nil
+	} else if len(lines) > len(t.Areas) {
+		return nil, fmt.Errorf("the template has only %d text areas", len(t.Areas))
+	}
+	var out []tmemes.TextLine
+	for i, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, tmemes.TextLine{
+				Text:        line,
+				Color:       tmemes.MustColor("white"),
+				StrokeColor: tmemes.MustColor("black"),
+				Field:       tmemes.Areas{t.Areas[i]},
+			})
+		}
+	}
+	return out, nil
+}
+
+const (
+	chatLinkPath = "/chat/link"
+	chatLinkTTL  = 15 * time.Minute
+)
+
+// chatLinkServices maps the names of the chatBots whose users link their
+// accounts to the names of their services, as shown to users.
+var chatLinkServices = map[string]string{
+	"discord":    "Discord",
+	"mattermost": "Mattermost",
+	"matrix":     "Matrix",
+}
+
+// chatUserMeta returns the metadata key that records the tailnet user to
+// whom the given user of a chat service is linked.
+func chatUserMeta(service, user string) string {
+	return service + "User/" + user
+}
+
+// linkedTailnetUser returns the tailnet user to whom the given user of a
+// chat service is linked.
+func (s *tmemeServer) linkedTailnetUser(ctx context.Context, service, user string) (*tailcfg.UserProfile, error) {
+	errNotLinked := errors.New("your account is not linked to a user of this tailnet; use the link command to link it")
+	v, err := s.db.GetMeta(chatUserMeta(service, user))
+	if err != nil {
+		log.Printf("[%s] looking up user %q: %v", service, user, err)
+		return nil, errNotLinked
+	} else if len(v) == 0 {
+		return nil, errNotLinked
+	}
+	id, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return nil, errNotLinked
+	}
+	up, err := s.userFromID(ctx, tailcfg.UserID(id))
+	if err != nil {
+		log.Printf("[%s] looking up tailnet user %d: %v", service, id, err)
+		return nil, errNotLinked
+	}
+	return up, nil
+}
+
+// A chatLink is a signed request to link a chat account, from the link URL
+// of the account.
+type chatLink struct {
+	Service string `json:"service"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Expires int64  `json:"expires"`
+	Token   string `json:"token"`
+}
+
+// chatLinkToken returns the token that authorizes link until it expires.
+func (s *tmemeServer) chatLinkToken(link chatLink) string {
+	h := hmac.New(sha256.New, s.publicLinkKey)
+	fmt.Fprintf(h, "chat-link %s %q %q %d", link.Service, link.ID, link.Name, link.Expires)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+// chatLinkURL returns the URL on the tailnet at which a tailnet user can
+// link the chat account of link to their own, until expires.
+func (s *tmemeServer) chatLinkURL(link chatLink, expires time.Time) string {
+	link.Expires = expires.Unix()
+	q := url.Values{
+		"service": {link.Service},
+		"id":      {link.ID},
+		"name":    {link.Name},
+		"expires": {strconv.FormatInt(link.Expires, 10)},
+		"token":   {s.chatLinkToken(link)},
+	}
+	return s.serverBaseURL() + chatLinkPath + "?" + q.Encode()
+}
+
+// checkChatLink reports whether link is signed by s and unexpired.
+func (s *tmemeServer) checkChatLink(link chatLink) error {
+	if link.ID == "" || chatLinkServices[link.Service] == "" ||
+		!hmac.Equal([]byte(link.Token), []byte(s.chatLinkToken(link))) {
+		return errors.New("invalid link")
+	} else if time.Now().After(time.Unix(link.Expires, 0)) {
+		return errors.New("link has expired, use the link command again")
+	}
+	return nil
+}
+
+// serveUIChatLink serves a UI page for the caller to confirm linking a chat
+// account to their own.
+//
+// API: GET /chat/link?service=S&id=ID&name=N&expires=T&token=K
+//
+// The parameters are those of the link given by the link command.
+func (s *tmemeServer) serveUIChatLink(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("ui-chat-link", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.checkAccess(w, r, "link a chat account") == nil {
+		return // error already sent
+	}
+	expires, _ := strconv.ParseInt(r.FormValue("expires"), 10, 64)
+	link := chatLink{
+		Service: r.FormValue("service"),
+		ID:      r.FormValue("id"),
+		Name:    r.FormValue("name"),
+		Expires: expires,
+		Token:   r.FormValue("token"),
+	}
+	if err := s.checkChatLink(link); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var buf bytes.Buffer
+	data := struct {
+		chatLink
+		ServiceName string
+	}{link, chatLinkServices[link.Service]}
+	if err := ui.ExecuteTemplate(&buf, "chatlink.tmpl", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf.WriteTo(w)
+}
+
+// serveAPIChatLink links a chat account to the caller's, so that its user
+// can make macros from chat on the caller's behalf.
+//
+// API: POST /api/chat/link
+//
+// The body is {"service":S, "id":ID, "name":N, "expires":T, "token":K}, the
+// parameters of the link given by the link command. Any earlier link of the
+// chat account is replaced.
+func (s *tmemeServer) serveAPIChatLink(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-chat-link", 1)
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkAccess(w, r, "link a chat account")
+	if whois == nil {
+		return // error already sent
+	}
+	var link chatLink
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err := s.checkChatLink(link); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	uid := whois.UserProfile.ID
+	if err := s.db.SetMeta(chatUserMeta(link.Service, link.ID), []byte(strconv.FormatInt(int64(uid), 10))); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%s] linked user %s (%q) to %s", link.Service, link.ID, link.Name, whois.UserProfile.LoginName)
+	s.logEvent(uid, "link-"+link.Service, "user", int(uid))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,176 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+	"tailscale.com/tailcfg"
+)
+
+// Damaged templates.
+//
+// If the image file of a template goes missing from the store, for example
+// because the disk was restored from an incomplete backup, the template is
+// marked damaged the first time the server notices, and the admins are
+// alerted by a log message, an entry in the audit log, and (if enabled) a
+// push notification. Requests that need the image report 410 (Gone) rather
+// than failing obscurely. An admin can repair the template by uploading its
+// image again with PUT /api/template/:id/image, which keeps its ID and its
+// macros.
+
+// errTemplateLost is reported when the image file of a template is missing.
+var errTemplateLost = errors.New("the template image is missing from the store")
+
+// openTemplateImage opens the image file of the template with the given ID.
+// If the file is missing, it marks the template damaged, and reports an error
+// wrapping errTemplateLost.
+func (s *tmemeServer) openTemplateImage(id int) (store.File, error) {
+	tp, err := s.db.TemplatePath(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.db.OpenFile(tp)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.templateLost(id)
+		return nil, fmt.Errorf("template %d: %w", id, errTemplateLost)
+	}
+	return f, err
+}
+
+// templateLost marks the template with the given ID as damaged, and alerts
+// the admins. It does nothing if the template is already marked.
+func (s *tmemeServer) templateLost(id int) {
+	changed, err := s.db.SetTemplateDamaged(id, true)
+	if err != nil {
+		log.Printf("WARNING: marking template %d damaged: %v", id, err)
+		return
+	} else if !changed {
+		return
+	}
+	macroMetrics.Add("template-lost", 1)
+	log.Printf("ERROR: the image file of template %d is missing; an admin must upload it again", id)
+	if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+		Actor:    -1, // the server itself
+		Action:   "template-lost",
+		Kind:     "template",
+		TargetID: id,
+		Reason:   "image file missing from the store",
+	}); err != nil {
+		log.Printf("WARNING: recording damaged template %d: %v", id, err)
+	}
+	if s.vapidKey == nil {
+		return
+	}
+	msg := pushMessage{
+		Title: "A template image is missing",
+		Body:  fmt.Sprintf("The image of template %d is missing and must be uploaded again", id),
+		URL:   fmt.Sprintf("/t/%d", id),
+	}
+	admins := make(map[tailcfg.UserID]bool)
+	for login := range s.superUser {
+		up, err := s.userFromLogin(context.Background(), login)
+		if err != nil {
+			continue // not a known user
+		}
+		admins[up.ID] = true
+	}
+	s.mu.Lock()
+	for id, caps := range s.grantedCaps {
+		if caps.HasCapability(capAdmin) {
+			admins[id] = true
+		}
+	}
+	s.mu.Unlock()
+	for id := range admins {
+		go s.sendPush(id, msg)
+	}
+}
+
+// writeRenderError writes an error response for a failure to render a macro
+// or serve a template image. A missing template image reports 410 (Gone).
+func writeRenderError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTemplateLost) {
+		http.Error(w, err.Error()+"; ask an admin to upload it again", http.StatusGone)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// serveAPITemplateImage replaces the image of a damaged (or any) template,
+// keeping its ID. Admin only.
+//
+// API: PUT /api/template/:id/image
+//
+// The body must be multipart/form-data with the new image in the "image"
+// field, as for uploading a template. On success, the updated template is
+// written back to the caller.
+func (s *tmemeServer) serveAPITemplateImage(w http.ResponseWriter, r *http.Request, path string) {
+	whois := s.checkAdmin(w, r, "replace template images")
+	if whois == nil {
+		return // error already sent
+	}
+	t, ok, err := getSingleFromIDInPath(path, "api/template", s.db.AnyTemplate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing template ID", http.StatusBadRequest)
+		return
+	} else if t.Audio != "" {
+		http.Error(w, "cannot replace the waveform of an audio template", http.StatusBadRequest)
+		return
+	}
+	img, header, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer img.Close()
+	nt := *t
+	data, ext, err := s.checkTemplateImage(&nt, header.Filename, header.Size, img)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	oldPath, _ := s.db.TemplatePath(t.ID)
+	if err := s.db.ReplaceTemplateImage(&nt, ext, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.imageFileEtags.Delete(oldPath)
+	tpath, err := s.db.TemplatePath(t.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if tag, err := s.fileEtag(tpath); err == nil {
+		s.imageFileEtags.Store(tpath, tag)
+	}
+	if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+		Actor:    whois.UserProfile.ID,
+		Action:   "replace-template-image",
+		Kind:     "template",
+		TargetID: t.ID,
+	}); err != nil {
+		log.Printf("WARNING: recording replaced image of template %d: %v", t.ID, err)
+	}
+	t, err = s.db.AnyTemplate(t.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+)
+
+// Meme of the day.
+//
+// If the -digest-schedule flag is set, the server periodically picks the most
+// popular macro created in the preceding day, and posts a link to it to the
+// webhook given by -digest-webhook. The payload is a JSON object whose "text"
+// field is understood by Slack incoming webhooks and similar chat services.
+
+const (
+	digestWindow  = 24 * time.Hour   // how far back to look for macros
+	digestTimeout = 30 * time.Second // for posting to the webhook
+)
+
+// A cronSchedule is a set of times given by a cron-style specification with
+// five fields: minute, hour, day of month, month, and day of week.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit i is set if value i matches
+
+	// As in cron, if both the day of month and the day of week are
+	// restricted, a day matches if either does.
+	anyDOM, anyDOW bool
+}
+
+// parseCronSchedule parses a cron-style schedule such as "0 9 * * 1-5". Each
+// field is "*" or a comma-separated list of values or ranges "a-b", each
+// optionally with a step "/n". Days of the week are 0-7, where both 0 and 7
+// mean Sunday.
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("schedule must have 5 fields: minute hour day-of-month month day-of-week")
+	}
+	var cs cronSchedule
+	for i, f := range []struct {
+		bits     *uint64
+		lo, hi   int
+		name     string
+		wildcard *bool
+	}{
+		{&cs.minute, 0, 59, "minute", nil},
+		{&cs.hour, 0, 23, "hour", nil},
+		{&cs.dom, 1, 31, "day of month", &cs.anyDOM},
+		{&cs.month, 1, 12, "month", nil},
+		{&cs.dow, 0, 7, "day of week", &cs.anyDOW},
+	} {
+		bits, err := parseCronField(fields[i], f.lo, f.hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", f.name, err)
+		}
+		*f.bits = bits
+		if f.wildcard != nil {
+			*f.wildcard = strings.HasPrefix(fields[i], "*")
+		}
+	}
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1 // Sunday
+	}
+	return &cs, nil
+}
+
+// parseCronField parses one field of a cron schedule whose values range from
+// lo to hi inclusive.
+func parseCronField(s string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+		first, last := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if first, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value %q", a)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid value %q", b)
+				}
+			} else if hasStep {
+				last = hi // as in "5/15"
+			}
+		}
+		if first < lo || last > hi || first > last {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+		for v := first; v <= last; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// matches reports whether cs includes the minute containing t.
+func (cs *cronSchedule) matches(t time.Time) bool {
+	has := func(bits uint64, v int) bool { return bits&(1<<v) != 0 }
+	if !has(cs.minute, t.Minute()) || !has(cs.hour, t.Hour()) || !has(cs.month, int(t.Month())) {
+		return false
+	}
+	domOK, dowOK := has(cs.dom, t.Day()), has(cs.dow, int(t.Weekday()))
+	switch {
+	case cs.anyDOM && cs.anyDOW:
+		return true
+	case cs.anyDOM:
+		return dowOK
+	case cs.anyDOW:
+		return domOK
+	default:
+		return domOK || dowOK
+	}
+}
+
+// next returns the first time in cs after t, or the zero time if there is
+// none within five years (for example, "0 0 31 2 *").
+func (cs *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if cs.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// postDigestsPeriodically posts the meme of the day to the digest webhook at
+// the times given by sched, until ctx ends.
+func (s *tmemeServer) postDigestsPeriodically(ctx context.Context, sched *cronSchedule) {
+	for {
+		next := sched.next(time.Now())
+		if next.IsZero() {
+			log.Print("[digest] schedule has no future times, stopping")
+			return
+		}
+		log.Printf("[digest] next post at %v", next.Format(time.RFC3339))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		if err := s.postDigest(ctx); err != nil {
+			log.Printf("[digest] posting: %v", err)
+		}
+	}
+}
+
+// digestPayload is the message posted to the digest webhook.
+type digestPayload struct {
+	Text     string        `json:"text"`   // for Slack and similar services
+	Server   string        `json:"server"` // the name of the server
+	URL      string        `json:"url"`
+	ImageURL string        `json:"imageURL"`
+	Macro    *tmemes.Macro `json:"macro"`
+}
+
+// pickDigestMacro returns the most popular of the macros in ms created since
+// the given time, or nil if there are none.
+func pickDigestMacro(ms []*tmemes.Macro, since time.Time) *tmemes.Macro {
+	var recent []*tmemes.Macro
+	for _, m := range ms {
+		if m.CreatedAt.After(since) {
+			recent = append(recent, m)
+		}
+	}
+	if len(recent) == 0 {
+		return nil
+	}
+	sortMacrosByPopularity(recent)
+	return recent[0]
+}
+
+// postDigest posts the most popular macro of the last day to the digest
+// webhook. If no macros were created in that time, it does nothing.
+func (s *tmemeServer) postDigest(ctx context.Context) error {
+	m := pickDigestMacro(s.db.Macros(), time.Now().Add(-digestWindow))
+	if m == nil {
+		log.Print("[digest] no macros in the last day, skipping")
+		return nil
+	}
+	t, err := s.db.AnyTemplate(m.TemplateID)
+	if err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(*digestBaseURL, "/")
+	if base == "" {
+		base = s.serverBaseURL()
+	}
+	pageURL := fmt.Sprintf("%s/m/%d", base, m.ID)
+	msg := digestPayload{
+		Text: fmt.Sprintf("%sMeme of the day: %s (%d upvotes, by %s) %s", digestPrefix(),
+			t.Name, m.Upvotes, s.userDisplayName(ctx, m.Creator, m.CreatedAt), pageURL),
+		Server:   brandingForUI().Name,
+		URL:      pageURL,
+		ImageURL: fmt.Sprintf("%s/content/macro/%d%s", base, m.ID, s.db.MacroExt(t)),
+		Macro:    m,
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, digestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", *digestWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(rsp.Body, 512))
+		return fmt.Errorf("webhook: %s: %s", rsp.Status, bytes.TrimSpace(detail))
+	}
+	log.Printf("[digest] posted macro %d", m.ID)
+	return nil
+}
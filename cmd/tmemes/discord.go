@@ -0,0 +1,403 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/tailcfg"
+)
+
+// Discord slash commands.
+//
+// If the -discord-public-key flag is set, the server also acts as a Discord
+// app offering the /meme command. Discord delivers the interactions of the
+// app to its interactions endpoint URL on the Funnel listener,
+//
+//	https://<host>.<tailnet>.ts.net/discord/interactions
+//
+// and each request is signed with the key of the app. The command has these
+// subcommands, which Discord shows with their options:
+//
+//	/meme make template:<template> text:"top text" "bottom text" [anon:] [color:]
+//	/meme top [period:day|week|month|all]
+//	/meme link
+//
+// As for the other chat services (see chat.go), "make" makes a macro from
+// the template with the given ID or name, completing template names as they
+// are typed, with each quoted text in one of its areas in order, and posts
+// it to the channel; "top" lists the top macros of a leaderboard period; and
+// "link" links the account of the sender to the tailnet, since Discord does
+// not reveal the email addresses of its users. Replies other than macros and
+// lists of them are shown to the sender alone.
+
+const (
+	discordInteractionsPath = "/discord/interactions"
+	discordAPIURL           = "https://discord.com/api/v10"
+	discordEphemeral        = 1 << 6 // the message flag for replies only the sender sees
+	discordMaxChoices       = 25     // of template name completions
+)
+
+// The types of Discord interactions, and of the responses to them.
+const (
+	discordPing         = 1
+	discordCommand      = 2
+	discordAutocomplete = 4
+
+	discordReplyPong    = 1
+	discordReplyMessage = 4
+	discordReplyLater   = 5
+	discordReplyChoices = 8
+)
+
+// parseDiscordPublicKey parses the hex-encoded public key of a Discord app.
+func parseDiscordPublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	} else if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("key is %d bytes, want %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// checkDiscordSignature reports whether the request with the given headers
+// and body was signed by the Discord app with the given public key, within
+// slackMaxSkew of now.
+func checkDiscordSignature(key ed25519.PublicKey, h http.Header, body []byte, now time.Time) error {
+	ts := h.Get("X-Signature-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("missing request timestamp")
+	} else if d := now.Sub(time.Unix(sec, 0)); d > slackMaxSkew || d < -slackMaxSkew {
+		return errors.New("request timestamp is too old")
+	}
+	sig, err := hex.DecodeString(h.Get("X-Signature-Ed25519"))
+	if err != nil || !ed25519.Verify(key, append([]byte(ts), body...), sig) {
+		return errors.New("invalid request signature")
+	}
+	return nil
+}
+
+// A discordInteraction is an interaction of a user with the Discord app.
+type discordInteraction struct {
+	Type          int    `json:"type"`
+	ApplicationID string `json:"application_id"`
+	Token         string `json:"token"` // for replying
+	Data          struct {
+		Name    string          `json:"name"`
+		Options []discordOption `json:"options"`
+	} `json:"data"`
+	Member *struct {
+		User discordUser `json:"user"`
+	} `json:"member"` // in a server
+	User *discordUser `json:"user"` // in a direct message
+}
+
+// sender returns the user who sent the interaction.
+func (in *discordInteraction) sender() discordUser {
+	if in.Member != nil {
+		return in.Member.User
+	} else if in.User != nil {
+		return *in.User
+	}
+	return discordUser{}
+}
+
+// A discordUser is a Discord user.
+type discordUser struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+}
+
+// A discordOption is the value of an option of a command, or a subcommand
+// with its own options.
+type discordOption struct {
+	Name    string          `json:"name"`
+	Value   json.RawMessage `json:"value"`
+	Focused bool            `json:"focused"` // the option being completed
+	Options []discordOption `json:"options"` // of a subcommand
+}
+
+// discordOptions returns the values of opts by name, as strings.
+func discordOptions(opts []discordOption) map[string]string {
+	m := make(map[string]string)
+	for _, o := range opts {
+		var v any
+		if json.Unmarshal(o.Value, &v) == nil {
+			m[o.Name] = fmt.Sprint(v)
+		}
+	}
+	return m
+}
+
+// A discordResponse is the response to an interaction.
+type discordResponse struct {
+	Type int `json:"type"`
+	Data any `json:"data,omitempty"`
+}
+
+// A discordMessage is a message posted by the app.
+type discordMessage struct {
+	Content string         `json:"content"`
+	Embeds  []discordEmbed `json:"embeds,omitempty"`
+	Flags   int            `json:"flags,omitempty"`
+}
+
+// A discordEmbed is the rich content of a Discord message.
+type discordEmbed struct {
+	Title       string        `json:"title,omitempty"`
+	URL         string        `json:"url,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Image       *discordImage `json:"image,omitempty"`
+	Thumbnail   *discordImage `json:"thumbnail,omitempty"`
+}
+
+// A discordImage is an image of an embed.
+type discordImage struct {
+	URL string `json:"url"`
+}
+
+// discordReply returns a response that posts text in reply to an
+// interaction, visible only to its sender.
+func discordReply(text string) discordResponse {
+	return discordResponse{Type: discordReplyMessage, Data: discordMessage{Content: text, Flags: discordEphemeral}}
+}
+
+// serveDiscordInteractions receives interactions from Discord, on the Funnel
+// listener.
+//
+// API: POST /discord/interactions
+//
+// Requests must be signed with the key of the Discord app. Pings, template
+// name completions, usage errors, and link requests are answered at once;
+// other commands are acknowledged, and carried out in the background, since
+// Discord expects a response within seconds.
+func (s *tmemeServer) serveDiscordInteractions(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("discord-interaction", 1)
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSlackEventBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkDiscordSignature(s.discordKey, r.Header, body, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var in discordInteraction
+	if err := json.Unmarshal(body, &in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var rsp discordResponse
+	switch in.Type {
+	case discordPing:
+		rsp = discordResponse{Type: discordReplyPong}
+	case discordCommand, discordAutocomplete:
+		rsp = s.discordCommand(r.Context(), &in)
+	default:
+		http.Error(w, "unknown interaction type", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// discordCommand returns the response to the command, or the completion
+// request, in.
+func (s *tmemeServer) discordCommand(ctx context.Context, in *discordInteraction) discordResponse {
+	if in.Data.Name != "meme" || len(in.Data.Options) != 1 {
+		return discordReply("Sorry, I don't know that command.")
+	}
+	sub := in.Data.Options[0]
+	user := in.sender()
+	bot := discordBot{s}
+	conv := chatConv{
+		User:        user.ID,
+		UserName:    cmp.Or(user.GlobalName, user.Username),
+		ResponseURL: fmt.Sprintf("%s/webhooks/%s/%s", discordAPIURL, url.PathEscape(in.ApplicationID), url.PathEscape(in.Token)),
+	}
+	if sub.Name == "link" && in.Type == discordCommand {
+		return discordReply(s.chatCommandReply(ctx, bot, conv, memeCommand{Link: true}, nil).Text)
+	}
+	if _, err := bot.tailnetUser(ctx, user.ID); err != nil {
+		if in.Type == discordAutocomplete {
+			return discordResponse{Type: discordReplyChoices, Data: map[string]any{"choices": []any{}}}
+		}
+		return discordReply(fmt.Sprintf("Sorry, %s.", err))
+	}
+	if in.Type == discordAutocomplete {
+		return s.discordTemplateChoices(sub.Options)
+	}
+
+	opts := discordOptions(sub.Options)
+	var cmd memeCommand
+	var err error
+	switch sub.Name {
+	case "make":
+		cmd, err = discordMemeCommand(opts)
+		if err != nil {
+			return discordReply(fmt.Sprintf("Sorry, %s.", err))
+		}
+	case "top":
+		cmd.Top = cmp.Or(opts["period"], defaultTopPeriod)
+		if _, ok := leaderboardPeriods[cmd.Top]; !ok {
+			return discordReply(fmt.Sprintf("Sorry, there is no period %q.", cmd.Top))
+		}
+	default:
+		return discordReply("Sorry, I don't know that command.")
+	}
+	go s.runChatCommand(bot, conv, cmd, nil)
+	return discordResponse{Type: discordReplyLater}
+}
+
+// discordMemeCommand returns the command described by the options of the
+// make subcommand.
+func discordMemeCommand(opts map[string]string) (memeCommand, error) {
+	cmd := memeCommand{Template: strings.TrimSpace(opts["template"]), Anon: opts["anon"] == "true"}
+	if cmd.Template == "" {
+		return memeCommand{}, errors.New("missing template")
+	}
+	args, err := splitCommandArgs(opts["text"])
+	if err != nil {
+		return memeCommand{}, err
+	} else if len(args) == 0 {
+		return memeCommand{}, errors.New("missing text")
+	}
+	for _, arg := range args {
+		cmd.Lines = append(cmd.Lines, arg.text)
+	}
+	if v := opts["color"]; v != "" {
+		var c tmemes.Color
+		if err := c.UnmarshalText([]byte(v)); err != nil {
+			return memeCommand{}, fmt.Errorf("invalid color %q", v)
+		}
+		cmd.Color = &c
+	}
+	return cmd, nil
+}
+
+// discordTemplateChoices returns the completions of the template option
+// among opts: the visible templates whose names contain what has been typed.
+func (s *tmemeServer) discordTemplateChoices(opts []discordOption) discordResponse {
+	var typed string
+	for _, o := range opts {
+		if o.Focused && o.Name == "template" {
+			json.Unmarshal(o.Value, &typed)
+		}
+	}
+	typed = strings.ToLower(strings.TrimSpace(typed))
+	choices := []map[string]string{}
+	for _, t := range s.db.Templates() {
+		if len(choices) == discordMaxChoices {
+			break
+		} else if strings.Contains(strings.ToLower(t.Name), typed) {
+			choices = append(choices, map[string]string{"name": t.Name, "value": strconv.Itoa(t.ID)})
+		}
+	}
+	return discordResponse{Type: discordReplyChoices, Data: map[string]any{"choices": choices}}
+}
+
+// discordBot is the chatBot for Discord. Its replies replace the deferred
+// responses to interactions.
+type discordBot struct{ s *tmemeServer }
+
+func (discordBot) service() string { return "discord" }
+
+func (b discordBot) tailnetUser(ctx context.Context, user string) (*tailcfg.UserProfile, error) {
+	return b.s.linkedTailnetUser(ctx, "discord", user)
+}
+
+func (discordBot) post(ctx context.Context, conv chatConv, reply chatReply) error {
+	if reply.Text != "" {
+		// A deferred response cannot be made ephemeral after the fact, so
+		// remove it and post the text in a new message.
+		if err := callDiscord(ctx, "DELETE", conv.ResponseURL+"/messages/@original", nil); err != nil {
+			log.Printf("[discord] removing response: %v", err)
+		}
+		return callDiscord(ctx, "POST", conv.ResponseURL, discordMessage{Content: reply.Text, Flags: discordEphemeral})
+	}
+	return callDiscord(ctx, "PATCH", conv.ResponseURL+"/messages/@original", discordMessageFor(reply))
+}
+
+// discordMessageFor returns the Discord message for a reply with a macro,
+// or with the top macros.
+func discordMessageFor(reply chatReply) discordMessage {
+	if m := reply.Macro; m != nil {
+		e := discordEmbed{Title: m.Template.Name, URL: m.URL, Description: "by " + m.Creator}
+		if m.ImageURL != "" {
+			e.Image = &discordImage{URL: m.ImageURL}
+		}
+		return discordMessage{Embeds: []discordEmbed{e}}
+	}
+	top := reply.Top
+	msg := discordMessage{Content: fmt.Sprintf("**[%s](%s)**", top.Title, top.URL)}
+	if len(top.Macros) == 0 {
+		msg.Content = fmt.Sprintf("**%s**: none yet", top.Title)
+	}
+	for i, m := range top.Macros {
+		e := discordEmbed{
+			Title:       fmt.Sprintf("%d. %s", i+1, m.Template.Name),
+			URL:         m.URL,
+			Description: fmt.Sprintf("by %s\n:thumbsup: %d  :thumbsdown: %d", m.Creator, m.Upvotes, m.Downvotes),
+		}
+		if m.ImageURL != "" {
+			e.Thumbnail = &discordImage{URL: m.ImageURL}
+		}
+		msg.Embeds = append(msg.Embeds, e)
+	}
+	return msg
+}
+
+// callDiscord sends req, if not nil, as JSON to the Discord API endpoint at
+// apiURL with the given method. Interaction webhooks need no bot token.
+func callDiscord(ctx context.Context, method, apiURL string, req any) error {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, method, apiURL, body)
+	if err != nil {
+		return err
+	}
+	if req != nil {
+		hreq.Header.Set("Content-Type", "application/json")
+	}
+	rsp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 1<<10))
+		return fmt.Errorf("discord: %s: %s", rsp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
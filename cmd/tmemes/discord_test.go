@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/tailscale/tmemes"
+)
+
+func TestCheckDiscordSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"type":1}`)
+	sign := func(ts int64, body []byte) http.Header {
+		h := make(http.Header)
+		tss := strconv.FormatInt(ts, 10)
+		h.Set("X-Signature-Timestamp", tss)
+		h.Set("X-Signature-Ed25519", hex.EncodeToString(ed25519.Sign(priv, append([]byte(tss), body...))))
+		return h
+	}
+	tests := []struct {
+		name    string
+		key     ed25519.PublicKey
+		h       http.Header
+		wantErr string
+	}{
+		{"OK", pub, sign(now.Unix(), body), ""},
+		{"OtherKey", otherPub, sign(now.Unix(), body), "invalid request signature"},
+		{"OtherBody", pub, sign(now.Unix(), []byte(`{"type":2}`)), "invalid request signature"},
+		{"Old", pub, sign(now.Add(-time.Hour).Unix(), body), "too old"},
+		{"NoTimestamp", pub, http.Header{}, "missing request timestamp"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkDiscordSignature(tc.key, tc.h, body, now)
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("Check: unexpected error: %v", err)
+			} else if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("Check: got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDiscordMemeCommand(t *testing.T) {
+	red := tmemes.MustColor("red")
+	tests := []struct {
+		opts    map[string]string
+		want    memeCommand
+		wantErr string
+	}{
+		{map[string]string{"template": "drake", "text": `"no" "yes"`},
+			memeCommand{Template: "drake", Lines: []string{"no", "yes"}}, ""},
+		{map[string]string{"template": "7", "text": `“fish &amp; chips”`, "anon": "true", "color": "red"},
+			memeCommand{Template: "7", Lines: []string{"fish &amp; chips"}, Anon: true, Color: &red}, ""},
+		{map[string]string{"text": `"no"`}, memeCommand{}, "missing template"},
+		{map[string]string{"template": "drake"}, memeCommand{}, "missing text"},
+		{map[string]string{"template": "drake", "text": `"no`}, memeCommand{}, "missing closing quote"},
+		{map[string]string{"template": "drake", "text": "no", "color": "blurple"}, memeCommand{}, "invalid color"},
+	}
+	for _, tc := range tests {
+		got, err := discordMemeCommand(tc.opts)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Command %v: got error %v, want %q", tc.opts, err, tc.wantErr)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Command %v: unexpected error: %v", tc.opts, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Command %v: (-want, +got)\n%s", tc.opts, diff)
+		}
+	}
+}
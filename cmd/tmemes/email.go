@@ -0,0 +1,303 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Email ingest.
+//
+// The server can optionally accept mail over SMTP on a tailnet address, and
+// turn incoming messages into templates or macros:
+//
+//   - A message with an image attachment becomes a new template. The template
+//     is named by the subject, or by the attachment's filename if the subject
+//     is empty.
+//
+//   - A message without an attachment whose subject has the form
+//     "template-name: caption" becomes a new macro on the named template.
+//     The caption may be split into top and bottom lines with "|".
+//
+// The template or macro is attributed to the tailnet user of the node that
+// sends the message, as reported by WhoIs, and is subject to the same checks
+// as creating it with the API. The sender address (From) must match the
+// login name of that user, and tagged nodes cannot send mail, so a relay
+// cannot submit messages on behalf of others.
+
+// serveEmail accepts SMTP connections from ln until it is closed.
+func (s *tmemeServer) serveEmail(ln net.Listener) {
+	log.Printf("Starting email ingest on %v", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Email ingest exiting: %v", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.handleSMTP(conn); err != nil {
+				log.Printf("[email] session from %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// maxEmailBytes is the largest message the ingest server will accept.  It
+// allows room for the base64 expansion of a maximum-size image.
+func maxEmailBytes() int64 { return maxUploadBytes()*4/3 + 1<<20 }
+
+// handleSMTP runs a minimal SMTP session on conn. It supports only the
+// commands needed to receive a message; there is no relaying, TLS, or AUTH.
+func (s *tmemeServer) handleSMTP(conn net.Conn) error {
+	const sessionTimeout = 5 * time.Minute
+	conn.SetDeadline(time.Now().Add(sessionTimeout))
+
+	tc := textproto.NewConn(conn)
+	reply := func(code int, msg string) error {
+		return tc.PrintfLine("%d %s", code, msg)
+	}
+	whois, err := s.lc.WhoIs(context.Background(), conn.RemoteAddr().String())
+	if err != nil {
+		reply(554, "unknown tailnet node")
+		return err
+	} else if whois.Node.IsTagged() {
+		reply(554, "tagged nodes cannot send mail")
+		return fmt.Errorf("tagged node %s", whois.Node.Name)
+	}
+	if err := reply(220, *hostName+" tmemes ESMTP ready"); err != nil {
+		return err
+	}
+
+	var from string
+	var haveRcpt bool
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return err
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			err = tc.PrintfLine("250-%s\r\n250 SIZE %d", *hostName, maxEmailBytes())
+		case "MAIL":
+			addr, ok := smtpPath(arg, "FROM:")
+			if !ok {
+				err = reply(501, "syntax: MAIL FROM:<address>")
+				break
+			}
+			from, haveRcpt = addr, false
+			err = reply(250, "OK")
+		case "RCPT":
+			addr, ok := smtpPath(arg, "TO:")
+			if !ok {
+				err = reply(501, "syntax: RCPT TO:<address>")
+			} else if from == "" {
+				err = reply(503, "need MAIL first")
+			} else if *emailTo != "" && !strings.EqualFold(addr, *emailTo) {
+				err = reply(550, "no such mailbox")
+			} else {
+				haveRcpt = true
+				err = reply(250, "OK")
+			}
+		case "DATA":
+			if !haveRcpt {
+				err = reply(503, "need RCPT first")
+				break
+			}
+			if err := reply(354, "end data with <CR><LF>.<CR><LF>"); err != nil {
+				return err
+			}
+			dr := tc.DotReader()
+			msg, rerr := io.ReadAll(io.LimitReader(dr, maxEmailBytes()+1))
+			if rerr != nil {
+				return rerr
+			}
+			if int64(len(msg)) > maxEmailBytes() {
+				io.Copy(io.Discard, dr)
+				err = reply(552, "message too large")
+			} else if result, perr := s.ingestEmail(whois, from, msg); perr != nil {
+				log.Printf("[email] rejected message from %q: %v", from, perr)
+				err = reply(554, perr.Error())
+			} else {
+				log.Printf("[email] message from %q: %s", from, result)
+				err = reply(250, result)
+			}
+			from, haveRcpt = "", false
+		case "RSET":
+			from, haveRcpt = "", false
+			err = reply(250, "OK")
+		case "NOOP":
+			err = reply(250, "OK")
+		case "QUIT":
+			reply(221, "bye")
+			return nil
+		default:
+			err = reply(502, "command not implemented")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// smtpPath parses an SMTP path argument of the form "<prefix><addr>" with an
+// optional enclosing pair of angle brackets and trailing parameters.
+func smtpPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path, _, _ := strings.Cut(strings.TrimSpace(arg[len(prefix):]), " ")
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "<"), ">")
+	return path, true
+}
+
+// ingestEmail processes a single message from the given envelope sender,
+// sent by the caller described by whois. On success it returns a brief
+// description of what was created.
+func (s *tmemeServer) ingestEmail(whois *apitype.WhoIsResponse, envFrom string, data []byte) (string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("invalid message: %w", err)
+	}
+	sender := envFrom
+	if from := msg.Header.Get("From"); from != "" {
+		addr, err := mail.ParseAddress(from)
+		if err != nil {
+			return "", fmt.Errorf("invalid From address: %w", err)
+		}
+		sender = addr.Address
+	}
+	up := whois.UserProfile
+	if !strings.EqualFold(sender, up.LoginName) {
+		return "", fmt.Errorf("sender %q does not match the tailnet user %q", sender, up.LoginName)
+	}
+
+	var dec mime.WordDecoder
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	subject = strings.TrimSpace(subject)
+
+	filename, image, err := findImageAttachment(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return "", err
+	}
+	op := "create macros"
+	if image != nil {
+		op = "create templates"
+	}
+	if err := s.grantError(whois, whois.CapMap, op); err != nil {
+		return "", err
+	}
+	if _, ok := s.limiter.allow(up.ID); !ok {
+		serveMetrics.Add("rate-limited", 1)
+		return "", errors.New("rate limit exceeded, try again later")
+	}
+
+	// Case 1: An attached image creates a template.
+	if image != nil {
+		name := subject
+		if name == "" {
+			name = strings.TrimSuffix(filename, filepath.Ext(filename))
+		}
+		t := &tmemes.Template{Name: name, Creator: up.ID}
+		img := bytes.NewReader(image)
+		data, ext, err := s.checkTemplateImage(t, filename, img.Size(), img)
+		if err != nil {
+			return "", err
+		}
+		if err := s.addTemplate(t, ext, data); err != nil {
+			return "", err
+		}
+		s.logEvent(up.ID, "create", "template", t.ID)
+		return fmt.Sprintf("created template %d", t.ID), nil
+	}
+
+	// Case 2: A subject "template: caption" creates a macro.
+	name, caption, ok := strings.Cut(subject, ":")
+	if !ok || strings.TrimSpace(caption) == "" {
+		return "", errors.New(`subject must be "template-name: caption" or include an image`)
+	}
+	t, err := s.db.TemplateByName(name)
+	if err != nil {
+		return "", err
+	}
+	top, bottom, _ := strings.Cut(caption, "|")
+	m := &tmemes.Macro{
+		TemplateID:  t.ID,
+		TextOverlay: tmemes.TopBottom(strings.TrimSpace(top), strings.TrimSpace(bottom)),
+	}
+	if _, err := s.prepareMacro(m, whois); err != nil {
+		return "", err
+	}
+	if err := s.db.AddMacro(m); err != nil {
+		return "", err
+	}
+	s.logEvent(up.ID, "create", "macro", m.ID)
+	s.notifyTemplateUsed(m)
+	return fmt.Sprintf("created macro %d", m.ID), nil
+}
+
+// findImageAttachment searches a message body with the given header for the
+// first attachment whose filename has an image extension, and returns its
+// name and decoded contents. It returns a nil slice without error if there is
+// no such attachment.
+func findImageAttachment(h textproto.MIMEHeader, body io.Reader) (string, []byte, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return "", nil, nil // a simple message, no attachments
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return "", nil, nil
+		} else if err != nil {
+			return "", nil, fmt.Errorf("reading message: %w", err)
+		}
+
+		// Recur into nested multipart sections (e.g., multipart/related).
+		if ct, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); strings.HasPrefix(ct, "multipart/") {
+			if name, data, err := findImageAttachment(part.Header, part); err != nil || data != nil {
+				return name, data, err
+			}
+			continue
+		}
+
+		name := part.FileName()
+		switch filepath.Ext(name) {
+		case ".png", ".apng", ".jpg", ".jpeg", ".gif", ".webp":
+		default:
+			continue
+		}
+		var r io.Reader = part
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			r = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return "", nil, fmt.Errorf("decoding attachment %q: %w", name, err)
+		}
+		return name, data, nil
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestIngestEmail(t *testing.T) {
+	db, err := store.New(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+	tmpl := &tmemes.Template{Name: "drake", Creator: 1}
+	if err := db.AddTemplate(tmpl, "png", strings.NewReader("template image")); err != nil {
+		t.Fatalf("AddTemplate: %v", err)
+	}
+	s := &tmemeServer{db: db}
+	whois := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop"},
+		UserProfile: &tailcfg.UserProfile{ID: 42, LoginName: "alice@example.com"},
+	}
+	message := func(from, subject string) []byte {
+		return []byte("From: " + from + "\r\nSubject: " + subject + "\r\n\r\nhi\r\n")
+	}
+
+	tests := []struct {
+		name    string
+		envFrom string
+		msg     []byte
+		wantErr string // if set, a substring of the error
+	}{
+		{"other user", "alice@example.com", message("Bob <bob@example.com>", "drake: no | yes"), `"bob@example.com" does not match`},
+		{"other envelope", "bob@example.com", []byte("Subject: drake: no\r\n\r\nhi\r\n"), `"bob@example.com" does not match`},
+		{"bad From", "alice@example.com", message("not an address", "drake: no"), "invalid From"},
+		{"no caption", "alice@example.com", message("alice@example.com", "drake"), "subject must be"},
+		{"created", "alice@example.com", message("Alice <ALICE@example.com>", "drake: no | yes"), ""},
+	}
+	for _, tc := range tests {
+		got, err := s.ingestEmail(whois, tc.envFrom, tc.msg)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got %q, %v; want error %q", tc.name, got, err, tc.wantErr)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		ms := db.MacrosByCreator(42)
+		if len(ms) != 1 {
+			t.Fatalf("%s: got %d macros by the sender, want 1", tc.name, len(ms))
+		}
+		m := ms[0]
+		if m.TemplateID != tmpl.ID || len(m.TextOverlay) != 2 || m.TextOverlay[1].Text != "yes" {
+			t.Errorf("%s: got macro %+v", tc.name, m)
+		}
+		for i, tl := range m.TextOverlay {
+			if tl.Field == nil {
+				t.Errorf("%s: line %d has no text area", tc.name, i)
+			}
+		}
+	}
+}
+
+func TestIngestEmailGrant(t *testing.T) {
+	old := *requireGrants
+	*requireGrants = true
+	defer func() { *requireGrants = old }()
+
+	s := &tmemeServer{}
+	whois := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{Name: "laptop"},
+		UserProfile: &tailcfg.UserProfile{ID: 42, LoginName: "alice@example.com"},
+	}
+	msg := "From: alice@example.com\r\n" +
+		"Subject: cat\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: image/png\r\n" +
+		"Content-Disposition: attachment; filename=cat.png\r\n\r\n" +
+		"not really a PNG\r\n--b--\r\n"
+	_, err := s.ingestEmail(whois, "alice@example.com", []byte(msg))
+	if err == nil || !strings.Contains(err.Error(), `requires the "tmemes:upload" grant`) {
+		t.Errorf("Ingest template without grant: got %v, want grant error", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/tailscale/tmemes"
+)
+
+// Encoder settings.
+//
+// Still renderings are encoded as JPEG or PNG, following their templates, with
+// the quality and compression level set by the -jpeg-quality and
+// -png-compression flags. Server admins can change these settings with
+// /api/admin/settings, which stores them in the Meta table of the store,
+// where they take precedence over the flags. Changed settings apply to
+// renderings generated afterward; use /api/admin/rerender to encode the cached
+// ones again.
+//
+// A request for a rendering may also override the settings with the quality
+// and compression query parameters. Such renderings are cached separately,
+// under a CacheKey with an Encoding label.
+
+const encodeSettingsMeta = "encode-settings"
+
+// encodeSettings are the settings of the JPEG and PNG encoders. Settings left
+// at their zero values are taken from the flags.
+type encodeSettings struct {
+	JPEGQuality    int    `json:"jpegQuality,omitempty"`    // 1 to 100
+	PNGCompression string `json:"pngCompression,omitempty"` // a key of pngCompressionLevels
+}
+
+// pngCompressionLevels are the PNG compression levels, by name.
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// valid reports whether es is valid.
+func (es encodeSettings) valid() error {
+	if es.JPEGQuality < 0 || es.JPEGQuality > 100 {
+		return fmt.Errorf("invalid jpegQuality %d: must be from 1 to 100", es.JPEGQuality)
+	} else if _, ok := pngCompressionLevels[es.PNGCompression]; !ok && es.PNGCompression != "" {
+		return fmt.Errorf("unknown pngCompression %q", es.PNGCompression)
+	}
+	return nil
+}
+
+// withFlags returns es with the settings it leaves unset taken from the
+// flags.
+func (es encodeSettings) withFlags() encodeSettings {
+	if es.JPEGQuality == 0 {
+		es.JPEGQuality = *jpegQuality
+	}
+	if es.PNGCompression == "" {
+		es.PNGCompression = *pngCompression
+	}
+	return es
+}
+
+func (es encodeSettings) jpegOptions() *jpeg.Options {
+	return &jpeg.Options{Quality: es.JPEGQuality}
+}
+
+func (es encodeSettings) pngEncoder() *png.Encoder {
+	return &png.Encoder{CompressionLevel: pngCompressionLevels[es.PNGCompression]}
+}
+
+// loadEncodeSettings loads the encoder settings of the server from the store.
+func (s *tmemeServer) loadEncodeSettings() error {
+	bits, err := s.db.GetMeta(encodeSettingsMeta)
+	if err != nil {
+		return err
+	}
+	es := new(encodeSettings)
+	if bits != nil {
+		if err := json.Unmarshal(bits, es); err != nil {
+			return fmt.Errorf("decode encoder settings: %w", err)
+		}
+	}
+	s.encoding.Store(es)
+	return nil
+}
+
+// encodeSettings returns the current encoder settings of the server.
+func (s *tmemeServer) encodeSettings() encodeSettings {
+	var es encodeSettings
+	if p := s.encoding.Load(); p != nil {
+		es = *p
+	}
+	return es.withFlags()
+}
+
+// encodeOverride returns the encoder settings for a rendering in the format
+// given by ext, as overridden by the quality (for JPEG) and compression (for
+// PNG) parameters in q, along with the CacheKey.Encoding label for them. The
+// label is "" if the settings are the server's.
+func (s *tmemeServer) encodeOverride(q url.Values, ext string) (encodeSettings, string, error) {
+	es := s.encodeSettings()
+	label := ""
+	if v := q.Get("quality"); v != "" {
+		n, err := strconv.Atoi(v)
+		if ext != ".jpg" && ext != ".jpeg" {
+			return es, "", fmt.Errorf("quality is only available for JPEG images")
+		} else if err != nil || n < 1 || n > 100 {
+			return es, "", fmt.Errorf("invalid quality: must be from 1 to 100")
+		} else if n != es.JPEGQuality {
+			es.JPEGQuality, label = n, fmt.Sprintf("q%d", n)
+		}
+	}
+	if v := q.Get("compression"); v != "" {
+		if ext != ".png" && ext != ".apng" {
+			return es, "", fmt.Errorf("compression is only available for PNG images")
+		} else if _, ok := pngCompressionLevels[v]; !ok {
+			return es, "", fmt.Errorf("unknown compression %q", v)
+		} else if v != es.PNGCompression {
+			es.PNGCompression, label = v, v
+		}
+	}
+	return es, label, nil
+}
+
+// serveAPIAdminSettings reports and changes the encoder settings of the
+// server. Only server admins can use these methods.
+//
+// API: GET /api/admin/settings -- report the settings
+// API: PUT /api/admin/settings -- change the settings
+//
+// The payload for PUT must be JSON {"jpegQuality":N, "pngCompression":"..."},
+// which replaces the settings made by earlier PUTs; leave a field out to use
+// the value of its flag. Each method reports the settings in effect in the
+// same form, with all fields filled in.
+func (s *tmemeServer) serveAPIAdminSettings(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-settings", 1)
+	if r.Method != "GET" && r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkAdmin(w, r, "manage the settings")
+	if whois == nil {
+		return // error already sent
+	}
+	if r.Method == "PUT" {
+		es := new(encodeSettings)
+		if err := json.NewDecoder(r.Body).Decode(es); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err := es.valid(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bits, err := json.Marshal(es)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := s.db.SetMeta(encodeSettingsMeta, bits); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.encoding.Store(es)
+		if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+			Actor:  whois.UserProfile.ID,
+			Action: "update-settings",
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.encodeSettings()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
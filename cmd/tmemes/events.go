@@ -0,0 +1,71 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// eventKeepAlive is how often to send a comment on an idle event stream, so
+// that proxies and browsers do not give up on the connection.
+const eventKeepAlive = 30 * time.Second
+
+// serveAPIEvents streams changes to macros as Server-Sent Events, so that
+// pages can update as they happen without polling.
+//
+// API: GET /api/events
+//
+// Each event has the type of the change as its name ("create", "vote", or
+// "delete"), and a JSON tmemes.Event as its data. Hidden macros are reported
+// only to admins.
+func (s *tmemeServer) serveAPIEvents(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-events", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := s.db.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	tick := time.NewTicker(eventKeepAlive)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.Macro != nil && !s.canViewMacro(r, e.Macro) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// Fetching template images.
+//
+// Instead of uploading a file, a user creating a template may give the URL of
+// an image for the server to fetch. The server can reach hosts its users may
+// not, such as other nodes of the tailnet and services on its own host, so it
+// only connects to public addresses. Each address is checked as it is dialed,
+// so that a name cannot be pointed elsewhere after it is checked, and
+// redirects are checked the same way. The image must be within the upload
+// limits and in one of the template formats.
+
+const (
+	templateFetchTimeout      = 30 * time.Second
+	maxTemplateFetchRedirects = 5
+)
+
+// blockedFetchPrefixes are ranges of unicast addresses that are not private
+// by the tests of netip.Addr, but that the server must not fetch from.
+var blockedFetchPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"), // CGNAT, including tailnet addresses
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which may map to any of the above
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// fetchedImageTypes maps the detected content types of fetched images to the
+// file extensions of the template formats.
+var fetchedImageTypes = map[string]string{
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// templateFetchClient is the HTTP client for fetching template images. It
+// ignores proxy settings, since a proxy would dial on its behalf.
+var templateFetchClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkFetchAddr,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   true,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxTemplateFetchRedirects {
+			return errors.New("too many redirects")
+		}
+		return checkFetchURL(req.URL)
+	},
+}
+
+// checkFetchURL reports an error if u is not an http or https URL that the
+// server may fetch a template image from.
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url scheme %q", u.Scheme)
+	} else if u.Host == "" {
+		return errors.New("url has no host")
+	} else if u.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	return nil
+}
+
+// checkFetchAddr reports an error if the server must not connect to address
+// to fetch a template image. It is called by the dialer for each address it
+// tries.
+func checkFetchAddr(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := ap.Addr().Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || slices.ContainsFunc(blockedFetchPrefixes, func(p netip.Prefix) bool {
+		return p.Contains(ip)
+	}) {
+		return fmt.Errorf("fetching from %v is not allowed", ip)
+	}
+	return nil
+}
+
+// fetchTemplateImage fetches the template image at u, which must have been
+// checked with checkFetchURL. It returns the contents of the image, with a
+// file name whose extension gives its format.
+func fetchTemplateImage(ctx context.Context, u *url.URL) (string, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, templateFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", "image/*")
+	rsp, err := templateFetchClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("fetching image: %s", rsp.Status)
+	}
+	limit := maxUploadBytes()
+	if rsp.ContentLength > limit {
+		return "", nil, fmt.Errorf("image too large (limit %d MiB)", limit>>20)
+	}
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, limit+1))
+	if err != nil {
+		return "", nil, err
+	} else if int64(len(data)) > limit {
+		return "", nil, fmt.Errorf("image too large (limit %d MiB)", limit>>20)
+	}
+	ctype := http.DetectContentType(data)
+	ext, ok := fetchedImageTypes[ctype]
+	if !ok {
+		return "", nil, fmt.Errorf("fetched file has unsupported type %q", ctype)
+	}
+	return "image" + ext, data, nil
+}
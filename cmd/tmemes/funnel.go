@@ -0,0 +1,265 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+)
+
+// Public sharing.
+//
+// Everything the server serves is normally reachable only from the tailnet.
+// If the --funnel flag is set, the server also listens on the public internet
+// with Tailscale Funnel, but serves only macros whose creators have marked
+// them public, and only at a URL signed by the server:
+//
+//	https://<host>.<tailnet>.ts.net/p/<id>/<token>
+//
+// The token is an HMAC of the macro ID under a key kept in the store, so the
+// URLs of other macros cannot be guessed from one that has been shared.
+// Macros marked NSFW, or made from templates marked NSFW, cannot be shared,
+// since anyone with the link could see the image unblurred. The public
+// listener serves nothing else, not even the pages or API of the server,
+// except for the Slack, Discord and Mattermost apps if they are enabled (see
+// slack.go, discord.go and mattermost.go).
+
+const (
+	publicLinkKeyMeta = "publicLinkKey"
+	publicLinkKeySize = 32
+	publicPrefix      = "/p/"
+)
+
+// loadPublicLinkKey loads the key for signing public macro URLs from the
+// store, or generates and stores a new one if none exists.
+func (s *tmemeServer) loadPublicLinkKey() error {
+	key, err := s.db.GetMeta(publicLinkKeyMeta)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		key = make([]byte, publicLinkKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := s.db.SetMeta(publicLinkKeyMeta, key); err != nil {
+			return err
+		}
+		log.Print("Generated new signing key for public links")
+	} else if len(key) != publicLinkKeySize {
+		return errors.New("invalid public link signing key")
+	}
+	s.publicLinkKey = key
+	return nil
+}
+
+// publicToken returns the token that authorizes public access to the macro
+// with the given ID.
+func (s *tmemeServer) publicToken(id int) string {
+	return s.linkToken("macro", id)
+}
+
+// linkToken returns a token authorizing access to the macro with the given
+// ID for the given purpose. Tokens for different purposes are unrelated.
+func (s *tmemeServer) linkToken(purpose string, id int) string {
+	h := hmac.New(sha256.New, s.publicLinkKey)
+	fmt.Fprintf(h, "%s %d", purpose, id)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+// publicMacroURL returns the public URL of the macro with the given ID, or ""
+// if the name of the server on the internet is not known yet.
+func (s *tmemeServer) publicMacroURL(id int) string {
+	host := s.certDomain()
+	if host == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://%s%s%d/%s", host, publicPrefix, id, s.publicToken(id))
+}
+
+// newFunnelMux returns the handler for requests from the public internet.
+func (s *tmemeServer) newFunnelMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(publicPrefix, s.servePublicMacro)
+	if *slackSigningSecret != "" {
+		mux.HandleFunc(slackEventsPath, s.serveSlackEvents)
+		mux.HandleFunc(slackCommandsPath, s.serveSlackCommand)
+	}
+	if s.discordKey != nil {
+		mux.HandleFunc(discordInteractionsPath, s.serveDiscordInteractions)
+	}
+	if *mattermostToken != "" {
+		mux.HandleFunc(mattermostCommandsPath, s.serveMattermostCommand)
+	}
+	if *slackSigningSecret != "" || s.discordKey != nil || *mattermostToken != "" {
+		mux.HandleFunc(unfurlPrefix, s.serveUnfurlImage)
+	}
+	return mux
+}
+
+// servePublicMacro serves the image of a public macro to a caller outside
+// the tailnet.
+//
+// API: GET /p/:id/:token
+//
+// Apart from the signature, the request looks the same as for a macro that
+// does not exist, is not public, is hidden by the moderators, or is marked
+// NSFW (either itself or by its template).
+func (s *tmemeServer) servePublicMacro(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("public-macro", 1)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	idStr, token, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, publicPrefix), "/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil || !hmac.Equal([]byte(token), []byte(s.publicToken(id))) {
+		http.NotFound(w, r)
+		return
+	}
+	m, err := s.db.Macro(id)
+	if err != nil || !m.Public || m.Hidden {
+		http.NotFound(w, r)
+		return
+	}
+	if t, err := s.db.AnyTemplate(m.TemplateID); err != nil || isNSFW(m, t) {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveMacroToPublic(w, r, m)
+}
+
+// serveMacroToPublic serves the image of m to a caller outside the tailnet,
+// who has been authorized to see it.
+func (s *tmemeServer) serveMacroToPublic(w http.ResponseWriter, r *http.Request, m *tmemes.Macro) {
+	// While a caption test is running, the public sees the main caption.
+	cachePath, err := s.db.MacroCachePath(m, store.CacheKey{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tag, err := s.macroEtag(m, cachePath)
+	if err != nil {
+		writeRenderError(w, err)
+		return
+	}
+	s.imageFileEtags.Store(cachePath, tag)
+	cache := cacheControl(time.Hour, false)
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		w.Header().Set("Cache-Control", cache)
+		w.Header().Set("Etag", tag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if _, err := os.Stat(cachePath); err != nil {
+		if err := s.renderMacro(m, cachePath, s.encodeSettings()); err != nil {
+			writeRenderError(w, err)
+			return
+		}
+	}
+	s.serveFileCached(w, r, cachePath, cache)
+}
+
+// serveAPIMacroPublic reports or changes whether a macro is shared outside
+// the tailnet. Only the creator of a macro, or a server admin, can do so.
+//
+// API: GET /api/macro/:id/public
+// API: PUT /api/macro/:id/public
+//
+// The PUT body is {"public":true} or {"public":false}. Both methods report
+// {"public":bool, "url":"..."}, where the url is set for a public macro.
+func (s *tmemeServer) serveAPIMacroPublic(w http.ResponseWriter, r *http.Request, path string) {
+	serveMetrics.Add("api-macro-public", 1)
+	if r.Method != "GET" && r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	} else if !*serveFunnel {
+		http.Error(w, "public sharing is not enabled", http.StatusNotFound)
+		return
+	}
+	whois := s.checkAccess(w, r, "share macros")
+	if whois == nil {
+		return // error already sent
+	}
+	m, ok, err := getSingleFromIDInPath(path, "api/macro", s.db.Macro)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing macro ID", http.StatusBadRequest)
+		return
+	}
+	isAdmin := s.isAdmin(whois)
+	if whois.UserProfile.ID != m.Creator && !isAdmin {
+		http.Error(w, "permission denied", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == "PUT" {
+		var req struct {
+			Public bool `json:"public"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if m.Locked && !isAdmin {
+			http.Error(w, "macro is locked by an admin", http.StatusForbidden)
+			return
+		} else if req.Public && m.Hidden {
+			http.Error(w, "hidden macros cannot be shared", http.StatusForbidden)
+			return
+		}
+		if req.Public {
+			t, err := s.db.AnyTemplate(m.TemplateID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if isNSFW(m, t) {
+				http.Error(w, "macros marked NSFW cannot be shared", http.StatusForbidden)
+				return
+			}
+		}
+		if req.Public != m.Public {
+			m, err = s.db.SetMacroPublic(m.ID, req.Public)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			action := "unshare"
+			if req.Public {
+				action = "share"
+			}
+			s.logEvent(whois.UserProfile.ID, action, "macro", m.ID)
+		}
+	}
+
+	rsp := struct {
+		P bool   `json:"public"`
+		U string `json:"url,omitempty"`
+	}{P: m.Public}
+	if m.Public {
+		rsp.U = s.publicMacroURL(m.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Tailnet grants.
+//
+// Besides the --admin flag, roles can be assigned centrally in the tailnet
+// policy file, by granting the capabilities below to users, groups, or tags
+// with this server as the destination:
+//
+//	"grants": [{
+//	  "src": ["group:meme-lords"],
+//	  "dst": ["tag:tmemes"],
+//	  "app": {"tmemes:admin": [{}]}
+//	}]
+//
+// The capabilities of a caller are reported by WhoIs, so changes to the
+// policy take effect on the next request, without restarting the server. A
+// caller granted tmemes:admin is a server admin, and one granted
+// tmemes:moderate is a moderator (see isModerator). With --require-grants,
+// uploading and voting also require tmemes:upload and tmemes:vote; otherwise
+// any user of the tailnet may do them.
+const (
+	capAdmin    tailcfg.PeerCapability = "tmemes:admin"
+	capModerate tailcfg.PeerCapability = "tmemes:moderate"
+	capUpload   tailcfg.PeerCapability = "tmemes:upload"
+	capVote     tailcfg.PeerCapability = "tmemes:vote"
+)
+
+// opGrants maps the operations named in calls to checkAccess to the
+// capability that permits them when --require-grants is set. Operations not
+// listed here do not require a grant.
+var opGrants = map[string]tailcfg.PeerCapability{
+	"create templates": capUpload,
+	"upload stickers":  capUpload,
+	"vote":             capVote,
+}
+
+// isAdmin reports whether the caller described by whois is a server admin,
+// either because they are listed in --admin or because the tailnet policy
+// grants them tmemes:admin. Callers using an API token have no grants.
+func (s *tmemeServer) isAdmin(whois *apitype.WhoIsResponse) bool {
+	return s.superUser[whois.UserProfile.LoginName] || whois.CapMap.HasCapability(capAdmin)
+}
+
+// isModerator reports whether the caller described by whois may moderate
+// content: whether they are a server admin, were made a moderator with the
+// admin API, or are granted tmemes:moderate by the tailnet policy.
+func (s *tmemeServer) isModerator(whois *apitype.WhoIsResponse) bool {
+	if s.isAdmin(whois) || whois.CapMap.HasCapability(capModerate) {
+		return true
+	}
+	ok, err := s.db.IsModerator(whois.UserProfile.ID)
+	return err == nil && ok // fail closed
+}
+
+// noteGrants records the capabilities that the tailnet policy grants to the
+// caller described by whois, for userIsAdmin and userIsModerator, which have
+// only a user ID to go on.
+func (s *tmemeServer) noteGrants(whois *apitype.WhoIsResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(whois.CapMap) != 0 {
+		s.grantedCaps[whois.UserProfile.ID] = whois.CapMap
+	} else {
+		delete(s.grantedCaps, whois.UserProfile.ID)
+	}
+}
+
+// userHasGrant reports whether cap was among the capabilities last noted for
+// the specified user by noteGrants.
+func (s *tmemeServer) userHasGrant(id tailcfg.UserID, cap tailcfg.PeerCapability) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.grantedCaps[id].HasCapability(cap)
+}
+
+// checkGrant checks that the caller of r, described by whois, may do op under
+// the tailnet policy. If so, it returns true. Otherwise, it writes an error
+// response to w and returns false. For a request using an API token, the
+// grants of the node sending it are checked, so that scripts on tagged nodes
+// can be granted what they need.
+func (s *tmemeServer) checkGrant(w http.ResponseWriter, r *http.Request, whois *apitype.WhoIsResponse, op string) bool {
+	err := s.grantError(whois, whois.CapMap, op)
+	if _, isToken := requestAPIToken(r); isToken && err != nil {
+		if node, werr := s.lc.WhoIs(r.Context(), s.callerAddr(r)); werr == nil {
+			err = s.grantError(whois, node.CapMap, op)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// grantError reports an error if the tailnet policy does not let the caller
+// described by whois, whose node has the capabilities caps, do op.
+func (s *tmemeServer) grantError(whois *apitype.WhoIsResponse, caps tailcfg.PeerCapMap, op string) error {
+	need, ok := opGrants[op]
+	if !ok || !*requireGrants || s.isAdmin(whois) || caps.HasCapability(need) {
+		return nil
+	}
+	return fmt.Errorf("permission denied: %s requires the %q grant", op, need)
+}
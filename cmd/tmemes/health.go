@@ -0,0 +1,174 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/tailscale/tmemes"
+)
+
+// Template health.
+//
+// To help admins keep the template library in shape, the health report flags
+// visible templates that nobody has used for a while, whose images are oddly
+// sized or larger than uploads may now be, that have no predefined text
+// areas, or whose images are missing, each with a suggested action.
+
+const (
+	minTemplateSide   = 100  // smallest reasonable width or height, in pixels
+	maxTemplateSide   = 4000 // largest reasonable width or height, in pixels
+	maxTemplateAspect = 4    // largest reasonable ratio of the longer side to the shorter
+)
+
+// templateHealth is the entry for one template in the health report.
+type templateHealth struct {
+	ID        int             `json:"id"`
+	Name      string          `json:"name"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Macros    int             `json:"macros"`   // macros made from it
+	LastUsed  time.Time       `json:"lastUsed"` // when its newest macro was made, or zero
+	Width     int             `json:"width"`
+	Height    int             `json:"height"`
+	Bytes     int64           `json:"bytes,omitempty"` // size of the image file
+	Problems  []healthProblem `json:"problems"`
+}
+
+// healthProblem is one problem with a template, and what an admin might do
+// about it.
+type healthProblem struct {
+	Problem string `json:"problem"` // "unused", "dimensions", "no-areas", "size", or "damaged"
+	Detail  string `json:"detail"`
+	Action  string `json:"action"`
+}
+
+// serveAPIAdminTemplateReport reports the visible templates that may need an
+// admin's attention. Only server admins can use this method.
+//
+// API: GET /api/admin/templates/report[?months=N]
+//
+// The result is {"checked":N, "templates":[...]}, where checked is the number
+// of templates examined, and each entry gives the "id", "name", "createdAt",
+// number of "macros", "lastUsed" time, "width", "height", and file "bytes" of
+// a template with problems, and its "problems", each {"problem":"...",
+// "detail":"...", "action":"..."}. A template is flagged as unused if it is
+// more than N months old (default 6) and no macro has been made from it in
+// that time.
+func (s *tmemeServer) serveAPIAdminTemplateReport(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-template-report", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.checkAdmin(w, r, "read the template report") == nil {
+		return // error already sent
+	}
+	months := 6
+	if v := r.FormValue("months"); v != "" {
+		var err error
+		months, err = strconv.Atoi(v)
+		if err != nil || months <= 0 {
+			http.Error(w, "invalid months", http.StatusBadRequest)
+			return
+		}
+	}
+	cutoff := time.Now().AddDate(0, -months, 0)
+
+	// Count the macros made from each template, including hidden ones, since
+	// they still use it.
+	macros := make(map[int]int)
+	lastUsed := make(map[int]time.Time)
+	for _, m := range s.db.AllMacros() {
+		macros[m.TemplateID]++
+		if m.CreatedAt.After(lastUsed[m.TemplateID]) {
+			lastUsed[m.TemplateID] = m.CreatedAt
+		}
+	}
+
+	templates := s.db.Templates()
+	report := []templateHealth{}
+	for _, t := range templates {
+		h := templateHealth{
+			ID:        t.ID,
+			Name:      t.Name,
+			CreatedAt: t.CreatedAt,
+			Macros:    macros[t.ID],
+			LastUsed:  lastUsed[t.ID],
+			Width:     t.Width,
+			Height:    t.Height,
+		}
+		if path, err := s.db.TemplatePath(t.ID); err == nil {
+			if fi, err := os.Stat(path); err == nil {
+				h.Bytes = fi.Size()
+			}
+		}
+		h.Problems = s.templateProblems(t, &h, cutoff, months)
+		if len(h.Problems) > 0 {
+			report = append(report, h)
+		}
+	}
+
+	rsp := struct {
+		C int              `json:"checked"`
+		T []templateHealth `json:"templates"`
+	}{C: len(templates), T: report}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// templateProblems returns the problems with t, whose usage and file size are
+// recorded in h. Templates not used since cutoff, which is the given number
+// of months ago, are flagged as unused.
+func (s *tmemeServer) templateProblems(t *tmemes.Template, h *templateHealth, cutoff time.Time, months int) []healthProblem {
+	var out []healthProblem
+	add := func(problem, action, detail string, args ...any) {
+		out = append(out, healthProblem{Problem: problem, Detail: fmt.Sprintf(detail, args...), Action: action})
+	}
+
+	if t.Damaged {
+		add("damaged", fmt.Sprintf("upload the image again with PUT /api/template/%d/image", t.ID),
+			"the image file is missing from the store")
+	}
+	if t.CreatedAt.Before(cutoff) && h.LastUsed.Before(cutoff) {
+		if h.Macros == 0 {
+			add("unused", "hide the template, so that it is no longer offered",
+				"no macros have been made from it in the %d months since it was uploaded", months)
+		} else {
+			add("unused", "hide the template, so that it is no longer offered",
+				"no macros have been made from it since %s", h.LastUsed.Format(time.DateOnly))
+		}
+	}
+
+	short, long := min(t.Width, t.Height), max(t.Width, t.Height)
+	switch {
+	case short < minTemplateSide:
+		add("dimensions", "replace the image with a larger one",
+			"the image is only %dx%d pixels, too small for legible text", t.Width, t.Height)
+	case long > maxTemplateSide:
+		add("dimensions", "replace the image with a scaled-down copy",
+			"the image is %dx%d pixels, more than %d on a side", t.Width, t.Height, maxTemplateSide)
+	case long > maxTemplateAspect*short:
+		add("dimensions", "replace the image with a cropped copy",
+			"the image is %dx%d pixels, more than %d times as long as it is wide", t.Width, t.Height, maxTemplateAspect)
+	}
+
+	if len(t.Areas) == 0 {
+		add("no-areas", fmt.Sprintf("define text areas with PATCH /api/template/%d/areas", t.ID),
+			"the template has no predefined text areas, so each macro must place its own text")
+	}
+
+	if limit := maxImageBytes(filepath.Ext(t.Path)); h.Bytes > limit {
+		add("size", "replace the image with a smaller or more compressed copy",
+			"the image file is %d KiB, more than the upload limit of %d KiB", h.Bytes>>10, limit>>10)
+	}
+	return out
+}
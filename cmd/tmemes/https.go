@@ -0,0 +1,31 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+)
+
+// certDomain returns the DNS name of the server on its tailnet HTTPS
+// certificate, or "" if it is not known yet.
+func (s *tmemeServer) certDomain() string {
+	if doms := s.srv.CertDomains(); len(doms) != 0 {
+		return doms[0]
+	}
+	return ""
+}
+
+// serveHTTPSRedirect redirects a plain HTTP request to the same path over
+// HTTPS, when the server is run with --serve-https. The certificate is only
+// valid for the full MagicDNS name of the server, so the redirect goes there
+// rather than to the name the request used, which may be the short one.
+func (s *tmemeServer) serveHTTPSRedirect(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("https-redirect", 1)
+	host := s.certDomain()
+	if host == "" {
+		http.Error(w, "HTTPS certificate not available yet", http.StatusServiceUnavailable)
+		return
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
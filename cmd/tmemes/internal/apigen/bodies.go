@@ -0,0 +1,274 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/client"
+	"tailscale.com/tailcfg"
+)
+
+// A body describes the request and response bodies of an endpoint. The
+// schemas of JSON bodies are those of the types of in and out.
+type body struct {
+	in, out   any
+	form      []string // fields of a multipart/form-data request; "image" is a file
+	inType    string   // content type of a request body that is not JSON
+	outType   string   // content type of a response body that is not JSON
+	query     []param  // not given in the API line
+	redirect  bool     // responds with a redirect
+	noContent bool     // responds with 204 No Content
+}
+
+// The types of bodies the client package has no type for.
+type (
+	reasonRequest struct {
+		Reason string `json:"reason,omitempty"`
+	}
+	loginRequest struct {
+		Login  string `json:"login"`
+		Reason string `json:"reason,omitempty"`
+	}
+	uploadStart struct {
+		client.TemplateUpload
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+	uploadStatus struct {
+		Token    string           `json:"token"`
+		Size     int64            `json:"size"`
+		Received int64            `json:"received"`
+		Template *tmemes.Template `json:"template,omitempty"`
+	}
+	chatLink struct {
+		Service string `json:"service"`
+		ID      string `json:"id"`
+		Name    string `json:"name"`
+		Expires int64  `json:"expires"`
+		Token   string `json:"token"`
+	}
+	auditPage struct {
+		Entries []*tmemes.AuditEntry `json:"entries"`
+		Total   int                  `json:"total"`
+		IsLast  bool                 `json:"isLast,omitempty"`
+	}
+	triggerMacro struct {
+		*tmemes.Macro
+		CreatorName string `json:"creatorName"`
+		ImageURL    string `json:"imageURL"`
+		PageURL     string `json:"pageURL"`
+	}
+	triggerTemplate struct {
+		*tmemes.Template
+		ImageURL  string `json:"imageURL"`
+		CreateURL string `json:"createURL"`
+	}
+	moderator struct {
+		*tmemes.Moderator
+		Name string `json:"name,omitempty"`
+	}
+	encodeSettings struct {
+		JPEGQuality    int    `json:"jpegQuality,omitempty"`
+		PNGCompression string `json:"pngCompression,omitempty"`
+	}
+	rerenderJob struct {
+		Filter   string     `json:"filter,omitempty"`
+		Started  time.Time  `json:"started"`
+		Finished *time.Time `json:"finished,omitempty"`
+		Canceled bool       `json:"canceled,omitempty"`
+		Total    int        `json:"total"`
+		Done     int        `json:"done"`
+		Failed   []int      `json:"failed"`
+	}
+	resolveRequest struct {
+		Action string `json:"action"`
+		Reason string `json:"reason"`
+	}
+	areasRequest struct {
+		Areas []tmemes.Area `json:"areas"`
+	}
+	categoryRequest struct {
+		Category string `json:"category"`
+	}
+	descriptionRequest struct {
+		Description string `json:"description"`
+	}
+	textRequest struct {
+		TextOverlay []tmemes.TextLine `json:"textOverlay"`
+	}
+	subscribeRequest struct {
+		URL       string `json:"url"`
+		PublicKey string `json:"publicKey"`
+	}
+	orphanRequest struct {
+		Action string `json:"action"` // "reassign" or "anonymize"
+		Login  string `json:"login,omitempty"`
+		Reason string `json:"reason,omitempty"`
+	}
+	orphan struct {
+		UserID    tailcfg.UserID `json:"userID"`
+		Name      string         `json:"name,omitempty"`
+		Templates int            `json:"templates"`
+		Macros    int            `json:"macros"`
+	}
+	webhookRequest struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events,omitempty"`
+	}
+	tokenID struct {
+		ID int `json:"id"`
+	}
+
+	similarList struct {
+		Templates []client.SimilarTemplate `json:"templates"`
+	}
+	stickerList struct {
+		Stickers []tmemes.Sticker `json:"stickers"`
+	}
+	categoryList struct {
+		Categories []tmemes.Category `json:"categories"`
+	}
+	paletteList struct {
+		Presets []client.PalettePreset `json:"presets"`
+	}
+	packList struct {
+		PublicKey string                `json:"publicKey"`
+		Packs     []tmemes.TemplatePack `json:"packs"`
+	}
+	reportList struct {
+		Reports []client.QueuedReport `json:"reports"`
+	}
+	moderatorList struct {
+		Moderators []moderator `json:"moderators"`
+	}
+	voteList struct {
+		Votes []tmemes.Vote `json:"votes"`
+	}
+	subscriptionList struct {
+		Subscriptions []tmemes.PackSubscription `json:"subscriptions"`
+	}
+	webhookList struct {
+		Webhooks []tmemes.Webhook `json:"webhooks"`
+	}
+	orphanList struct {
+		Orphans []orphan `json:"orphans"`
+	}
+)
+
+// listQuery are the query parameters of the lists of macros and templates.
+var listQuery = []param{
+	{name: "page"}, {name: "count"}, {name: "sort"}, {name: "creator"}, {name: "expand"},
+}
+
+// bodies are the bodies of the endpoints, by "METHOD path" as in the API
+// lines. Endpoints not listed here are described by defaultBody.
+var bodies = map[string]body{
+	// Templates.
+	"GET /api/template":                  {out: client.TemplateList{}, query: append(listQuery, param{name: "category"})},
+	"GET /api/template/:id":              {out: tmemes.Template{}, query: []param{{name: "expand"}}},
+	"POST /api/template":                 {in: client.TemplateUpload{}, form: []string{"image", "url", "name", "anon", "category"}, redirect: true},
+	"PATCH /api/template/:id":            {in: client.TemplateEdit{}, out: tmemes.Template{}},
+	"PATCH /api/template/:id/areas":      {in: areasRequest{}, out: tmemes.Template{}},
+	"PATCH /api/template/:id/category":   {in: categoryRequest{}, out: tmemes.Template{}},
+	"PUT /api/template/:id/image":        {form: []string{"image"}, out: tmemes.Template{}},
+	"POST /api/template/:id/transfer":    {in: loginRequest{}, out: tmemes.Template{}},
+	"DELETE /api/template/:id":           {out: tmemes.Template{}},
+	"GET /api/template/:id/nsfw":         {out: client.NSFW{}},
+	"PUT /api/template/:id/nsfw":         {in: client.NSFW{}, out: client.NSFW{}},
+	"GET /api/template/:id/similar":      {out: similarList{}},
+	"POST /api/template/search-by-image": {form: []string{"image"}, out: similarList{}},
+	"POST /api/upload/start":             {in: uploadStart{}, out: uploadStatus{}},
+	"GET /api/upload/:token":             {out: uploadStatus{}},
+	"PATCH /api/upload/:token":           {inType: "application/octet-stream", out: uploadStatus{}},
+	"DELETE /api/upload/:token":          {out: uploadStatus{}},
+
+	// Macros.
+	"GET /api/macro":              {out: client.MacroList{}, query: listQuery},
+	"GET /api/macro/:id":          {out: tmemes.Macro{}, query: []param{{name: "expand"}}},
+	"POST /api/macro":             {in: tmemes.Macro{}, out: tmemes.Macro{}},
+	"POST /api/macro/batch":       {in: []tmemes.Macro{}, out: client.BatchResult{}},
+	"PUT /api/macro/:id":          {in: textRequest{}, out: tmemes.Macro{}},
+	"DELETE /api/macro/:id":       {out: tmemes.Macro{}},
+	"GET /api/macro/:id/variants": {out: []client.Variant{}},
+	"GET /api/macro/exists":       {out: client.ExistingMacros{}},
+	"GET /api/macro/:id/nsfw":     {out: client.NSFW{}},
+	"PUT /api/macro/:id/nsfw":     {in: client.NSFW{}, out: client.NSFW{}},
+	"GET /api/macro/:id/public":   {out: client.PublicLink{}},
+	"PUT /api/macro/:id/public":   {in: client.PublicLink{}, out: client.PublicLink{}},
+	"POST /api/context/:id":       {in: tmemes.ContextRequest{}, out: tmemes.Macro{}},
+	"POST /api/preview":           {in: tmemes.Macro{}, outType: "image/*"},
+	"POST /api/preview/check":     {in: tmemes.Macro{}},
+	"GET /api/trigger/macro":      {out: []triggerMacro{}, query: []param{{name: "token"}}},
+	"GET /api/trigger/template":   {out: []triggerTemplate{}, query: []param{{name: "token"}}},
+	"GET /api/trigger/top-macro":  {out: []triggerMacro{}, query: []param{{name: "token"}}},
+	"GET /api/events":             {outType: "text/event-stream"},
+
+	// Votes.
+	"GET /api/vote":          {out: client.VoteList{}},
+	"GET /api/vote/:id":      {out: client.MacroVote{}},
+	"PUT /api/vote/:id/up":   {out: tmemes.Macro{}},
+	"PUT /api/vote/:id/down": {out: tmemes.Macro{}},
+	"DELETE /api/vote/:id":   {out: tmemes.Macro{}},
+
+	// Users and discovery.
+	"GET /api/search":             {out: client.SearchResult{}},
+	"GET /api/leaderboard":        {out: client.Leaderboard{}},
+	"GET /api/user/:id":           {out: client.UserProfile{}},
+	"GET /api/stats/macro/:id":    {out: client.Stats{}},
+	"GET /api/stats/template/:id": {out: client.Stats{}},
+	"GET /api/prefs":              {out: tmemes.UserPrefs{}},
+	"PUT /api/prefs":              {in: tmemes.UserPrefs{}, out: tmemes.UserPrefs{}},
+	"DELETE /api/handle/:userID":  {in: reasonRequest{}},
+	"POST /api/chat/link":         {in: chatLink{}},
+	"GET /api/token":              {out: []tmemes.APIToken{}},
+	"POST /api/token":             {in: client.TokenRequest{}, out: client.NewToken{}},
+	"DELETE /api/token/:id":       {out: tokenID{}},
+	"GET /api/sticker":            {out: stickerList{}},
+	"GET /api/sticker/:id":        {out: tmemes.Sticker{}},
+	"POST /api/sticker":           {form: []string{"image", "anon"}, out: tmemes.Sticker{}},
+	"POST /api/push/subscribe":    {in: tmemes.PushSubscription{}},
+	"DELETE /api/push/subscribe":  {in: tmemes.PushSubscription{}},
+
+	// Server information.
+	"GET /api/category":          {out: categoryList{}},
+	"PUT /api/category/:name":    {in: descriptionRequest{}, out: tmemes.Category{}},
+	"DELETE /api/category/:name": {noContent: true},
+	"GET /api/fonts":             {out: client.Fonts{}},
+	"GET /api/limits":            {out: client.Limits{}},
+	"GET /api/palette":           {out: paletteList{}},
+	"GET /api/branding":          {out: tmemes.Branding{}},
+	"GET /api/pack":              {out: packList{}},
+	"GET /api/pack/:name":        {outType: "application/octet-stream"},
+
+	// Moderation.
+	"POST /api/report/:kind/:id":             {in: reasonRequest{}, out: tmemes.Report{}},
+	"POST /api/report/:id":                   {in: reasonRequest{}, out: tmemes.Report{}},
+	"GET /api/moderation":                    {out: reportList{}},
+	"POST /api/moderation/:id":               {in: resolveRequest{}, out: tmemes.AuditEntry{}},
+	"GET /api/audit":                         {out: auditPage{}},
+	"GET /api/admin/moderators":              {out: moderatorList{}},
+	"POST /api/admin/moderators":             {in: loginRequest{}, out: tmemes.Moderator{}},
+	"POST /api/admin/macro/:id/hide":         {in: reasonRequest{}, out: tmemes.Macro{}},
+	"POST /api/admin/macro/:id/lock":         {in: reasonRequest{}, out: tmemes.Macro{}},
+	"POST /api/admin/macro/:id/freeze-votes": {in: reasonRequest{}, out: tmemes.Macro{}},
+
+	// Administration.
+	"GET /api/admin/export":           {outType: "application/gzip"},
+	"GET /api/admin/votes":            {out: voteList{}},
+	"GET /api/admin/settings":         {out: encodeSettings{}},
+	"PUT /api/admin/settings":         {in: encodeSettings{}, out: encodeSettings{}},
+	"PUT /api/admin/branding":         {in: tmemes.Branding{}, out: tmemes.Branding{}},
+	"GET /api/admin/rerender":         {out: rerenderJob{}},
+	"POST /api/admin/rerender":        {out: rerenderJob{}},
+	"DELETE /api/admin/rerender":      {out: rerenderJob{}},
+	"GET /api/admin/subscriptions":    {out: subscriptionList{}},
+	"POST /api/admin/subscriptions":   {in: subscribeRequest{}},
+	"GET /api/admin/webhooks":         {out: webhookList{}},
+	"POST /api/admin/webhooks":        {in: webhookRequest{}, out: tmemes.Webhook{}},
+	"DELETE /api/admin/webhooks/:id":  {noContent: true},
+	"GET /api/admin/orphans":          {out: orphanList{}},
+	"POST /api/admin/orphans/:userID": {in: orphanRequest{}},
+}
@@ -0,0 +1,225 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// A document is an OpenAPI 3 document.
+type document struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       info                            `json:"info"`
+	Tags       []tag                           `json:"tags"`
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components components                      `json:"components"`
+	Security   []map[string][]string           `json:"security"`
+}
+
+type info struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Version     string `json:"version"`
+}
+
+type tag struct {
+	Name string `json:"name"`
+}
+
+type components struct {
+	Schemas         map[string]schema `json:"schemas"`
+	SecuritySchemes map[string]any    `json:"securitySchemes"`
+}
+
+type operation struct {
+	OperationID string              `json:"operationId"`
+	Tags        []string            `json:"tags"`
+	Summary     string              `json:"summary,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Parameters  []parameter         `json:"parameters,omitempty"`
+	RequestBody *requestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]response `json:"responses"`
+}
+
+type parameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"` // "path" or "query"
+	Required bool   `json:"required"`
+	Schema   schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]mediaType `json:"content"`
+}
+
+type response struct {
+	Description string               `json:"description"`
+	Headers     map[string]any       `json:"headers,omitempty"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema schema `json:"schema"`
+}
+
+const description = `The API of a tmemes server, generated from the doc comments of its handlers
+by cmd/tmemes/internal/apigen. See docs/api.md for the conventions shared by
+the endpoints, such as pagination and sorting, and the client package for a
+Go client.
+
+The caller is identified by the tailnet node the request comes from. Clients
+without a user identity can authenticate with an API token instead. Errors
+are reported as text, with a 4xx or 5xx status.`
+
+// intParams are the path parameters that are integers.
+var intParams = []string{"id", "n", "userID"}
+
+var pathParams = regexp.MustCompile(`{(\w+)}`)
+
+// newDocument returns the document describing eps.
+func newDocument(eps []*endpoint) (*document, error) {
+	s := &schemaSet{defs: make(map[string]schema)}
+	doc := &document{
+		OpenAPI: "3.0.3",
+		Info: info{
+			Title:       "tmemes",
+			Description: description,
+			Version:     "1",
+		},
+		Paths: make(map[string]map[string]operation),
+		Components: components{
+			Schemas: s.defs,
+			SecuritySchemes: map[string]any{
+				"token": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+		// A token is optional.
+		Security: []map[string][]string{{}, {"token": {}}},
+	}
+	ids := make(map[string]bool)
+	keys := make(map[string]bool)
+	for _, ep := range eps {
+		method := strings.ToLower(ep.method)
+		if _, ok := doc.Paths[ep.path][method]; ok {
+			return nil, fmt.Errorf("%s is documented twice", ep.key)
+		}
+		keys[ep.key] = true
+		op := operation{
+			OperationID: operationID(ep),
+			Tags:        []string{ep.tag},
+			Summary:     ep.summary,
+			Description: ep.doc,
+		}
+		for id, n := op.OperationID, 2; ids[op.OperationID]; n++ {
+			op.OperationID = fmt.Sprintf("%s%d", id, n)
+		}
+		ids[op.OperationID] = true
+		if !slices.ContainsFunc(doc.Tags, func(t tag) bool { return t.Name == ep.tag }) {
+			doc.Tags = append(doc.Tags, tag{Name: ep.tag})
+		}
+
+		for _, m := range pathParams.FindAllStringSubmatch(ep.path, -1) {
+			p := parameter{Name: m[1], In: "path", Required: true, Schema: schema{"type": "string"}}
+			if slices.Contains(intParams, m[1]) {
+				p.Schema = schema{"type": "integer"}
+			}
+			op.Parameters = append(op.Parameters, p)
+		}
+		query := ep.query
+		if b, ok := bodies[ep.key]; ok {
+			query = append(query, b.query...)
+		}
+		for _, q := range query {
+			op.Parameters = append(op.Parameters, parameter{
+				Name: q.name, In: "query", Required: q.required, Schema: schema{"type": "string"},
+			})
+		}
+		if ep.ext {
+			op.Description = strings.TrimSpace(op.Description + "\n\nThe path may end with a file extension.")
+		}
+		op.RequestBody, op.Responses = s.bodies(ep)
+
+		if doc.Paths[ep.path] == nil {
+			doc.Paths[ep.path] = make(map[string]operation)
+		}
+		doc.Paths[ep.path][method] = op
+	}
+	for key := range bodies {
+		if !keys[key] {
+			return nil, fmt.Errorf("bodies has %q, which no API line documents", key)
+		}
+	}
+	slices.SortFunc(doc.Tags, func(a, b tag) int { return strings.Compare(a.Name, b.Name) })
+	return doc, nil
+}
+
+// bodies returns the request body and responses of ep.
+func (s *schemaSet) bodies(ep *endpoint) (*requestBody, map[string]response) {
+	b, ok := bodies[ep.key]
+	if !ok {
+		b = defaultBody(ep)
+	}
+	var req *requestBody
+	if b.in != nil || b.form != nil || b.inType != "" {
+		req = &requestBody{Required: true, Content: make(map[string]mediaType)}
+		if b.in != nil {
+			req.Content["application/json"] = mediaType{Schema: s.schemaOf(reflect.TypeOf(b.in))}
+		}
+		if b.form != nil {
+			props := make(map[string]schema)
+			for _, f := range b.form {
+				props[f] = schema{"type": "string"}
+				if f == "image" {
+					props[f] = schema{"type": "string", "format": "binary"}
+				}
+			}
+			req.Content["multipart/form-data"] = mediaType{Schema: schema{"type": "object", "properties": props}}
+		}
+		if b.inType != "" {
+			req.Content[b.inType] = mediaType{Schema: schema{"type": "string", "format": "binary"}}
+		}
+	}
+
+	ok200 := response{Description: "OK"}
+	switch {
+	case b.redirect:
+		return req, map[string]response{
+			"302": {
+				Description: "Created; redirects to the page for creating a macro from the new template, /create/:id.",
+				Headers:     map[string]any{"Location": map[string]any{"schema": schema{"type": "string"}}},
+			},
+			"default": errorResponse,
+		}
+	case b.outType != "":
+		ok200.Content = map[string]mediaType{b.outType: {Schema: schema{"type": "string", "format": "binary"}}}
+	case b.out != nil:
+		ok200.Content = map[string]mediaType{"application/json": {Schema: s.schemaOf(reflect.TypeOf(b.out))}}
+	case !b.noContent:
+		ok200.Content = map[string]mediaType{"application/json": {Schema: schema{}}}
+	}
+	code := "200"
+	if b.noContent {
+		code, ok200.Description = "204", "No Content"
+	}
+	return req, map[string]response{code: ok200, "default": errorResponse}
+}
+
+var errorResponse = response{
+	Description: "An error, reported as text.",
+	Content:     map[string]mediaType{"text/plain": {Schema: schema{"type": "string"}}},
+}
+
+// defaultBody returns the body of an endpoint not listed in bodies: image
+// data for content, and otherwise JSON of unspecified form.
+func defaultBody(ep *endpoint) body {
+	if ep.tag == "content" {
+		return body{outType: "image/*"}
+	}
+	return body{}
+}
@@ -0,0 +1,261 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Program apigen generates the OpenAPI document of the tmemes server.
+//
+// Usage:
+//
+//	go run ./internal/apigen [-src dir] [-o file]
+//
+// It reads the "API:" lines in the doc comments of the handlers in the source
+// directory of the server, which give the method, path, query parameters, and
+// a summary of each endpoint, and the rest of the doc comment as its
+// description. The schemas of request and response bodies come from the Go
+// types listed in bodies.go, which are those of the client package where it
+// has them. It reports the routes of newMux that no API line documents.
+//
+// Run it with go generate in cmd/tmemes after changing an endpoint.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	srcDir  = flag.String("src", ".", "Source directory of the server")
+	outPath = flag.String("o", "", "Output file (default stdout)")
+)
+
+// An endpoint is an endpoint documented by an API line.
+type endpoint struct {
+	method  string
+	path    string  // OpenAPI form, with {params}
+	key     string  // "METHOD path", with :params, as in bodies
+	query   []param // from the API line
+	ext     bool    // the path may have a file extension
+	summary string  // from the API line
+	doc     string  // the rest of the doc comment
+	tag     string  // the group of the endpoint
+}
+
+type param struct {
+	name     string
+	required bool
+}
+
+// apiLine matches an API line, with or without its "// ".
+var apiLine = regexp.MustCompile(`^API:\s+(?:(GET|POST|PUT|PATCH|DELETE)\s+)?(\S+)\s*(?:--\s*(.*))?$`)
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("apigen: ")
+
+	fset := token.NewFileSet()
+	paths, err := filepath.Glob(filepath.Join(*srcDir, "*.go"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var eps []*endpoint
+	var routes []string
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, decl := range f.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok {
+				continue
+			}
+			if fd.Name.Name == "newMux" {
+				routes = append(routes, muxRoutes(fd)...)
+			}
+			if fd.Doc != nil {
+				eps = append(eps, parseDoc(fd.Name.Name, fd.Doc.Text())...)
+			}
+		}
+	}
+	if len(routes) == 0 {
+		log.Fatal("no routes found in newMux")
+	}
+
+	// Keep the endpoints served under /api/ and /content/, and report the
+	// routes that none of them is served by.
+	used := make(map[string]bool)
+	eps = slices.DeleteFunc(eps, func(ep *endpoint) bool {
+		served := false
+		for _, r := range routes {
+			if r == ep.path || strings.HasSuffix(r, "/") && strings.HasPrefix(ep.path, r) {
+				served, used[r] = true, true
+			}
+		}
+		return !served
+	})
+	for _, r := range routes {
+		if !used[r] {
+			log.Printf("warning: no API line documents route %q", r)
+		}
+	}
+
+	doc, err := newDocument(eps)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	data = append(data, '\n')
+	if *outPath == "" {
+		os.Stdout.Write(data)
+	} else if err := os.WriteFile(*outPath, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// muxRoutes returns the patterns registered on apiMux and contentMux in the
+// body of newMux.
+func muxRoutes(fd *ast.FuncDecl) []string {
+	var routes []string
+	ast.Inspect(fd.Body, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || (sel.Sel.Name != "HandleFunc" && sel.Sel.Name != "Handle") {
+			return true
+		}
+		if mux, ok := sel.X.(*ast.Ident); !ok || (mux.Name != "apiMux" && mux.Name != "contentMux") {
+			return true
+		}
+		if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			if s, err := strconv.Unquote(lit.Value); err == nil {
+				routes = append(routes, s)
+			}
+		}
+		return true
+	})
+	return routes
+}
+
+// parseDoc returns the endpoints documented by the API lines of the doc
+// comment text of the function with the given name.
+func parseDoc(name, text string) []*endpoint {
+	var eps []*endpoint
+	var rest []string
+	for _, line := range strings.Split(text, "\n") {
+		m := apiLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			rest = append(rest, line)
+			continue
+		}
+		ep := &endpoint{method: m[1], summary: m[3]}
+		if ep.method == "" {
+			ep.method = "GET"
+		}
+		ep.path, ep.query, ep.ext = parsePath(m[2])
+		ep.key = ep.method + " " + ep.path
+		ep.path = colonParams.ReplaceAllString(ep.path, "{$1}")
+		ep.tag = pathTag(ep.path)
+		eps = append(eps, ep)
+	}
+	desc := cleanDoc(name, rest)
+	for _, ep := range eps {
+		ep.doc = desc
+	}
+	return eps
+}
+
+var colonParams = regexp.MustCompile(`:(\w+)`)
+
+// parsePath parses the path of an API line, such as
+// "/content/macro/:id[.ext][?variant=N][&w=W]", into its path and query
+// parameters, and reports whether it allows a file extension.
+func parsePath(s string) (path string, query []param, ext bool) {
+	path, q, _ := strings.Cut(s, "?")
+	if p, ok := strings.CutSuffix(path, "["); ok {
+		path, q = p, "["+q // the "?" was inside an optional part
+	}
+	if p, ok := strings.CutSuffix(path, "[.ext]"); ok {
+		path, ext = p, true
+	} else if p, ok := strings.CutSuffix(path, "[.png]"); ok {
+		path, ext = p, true
+	}
+	path = strings.TrimSuffix(path, "[")
+	for _, part := range strings.FieldsFunc(q, func(r rune) bool { return r == '&' }) {
+		opt := strings.HasPrefix(part, "[") || strings.HasSuffix(part, "]")
+		part = strings.Trim(part, "[]?")
+		name, _, _ := strings.Cut(part, "=")
+		if name != "" {
+			query = append(query, param{name: name, required: !opt})
+		}
+	}
+	return path, query, ext
+}
+
+// pathTag returns the group of an endpoint at path: the first element after
+// /api/, or "content".
+func pathTag(path string) string {
+	elts := strings.Split(strings.Trim(path, "/"), "/")
+	if elts[0] != "api" || len(elts) < 2 {
+		return elts[0]
+	}
+	return elts[1]
+}
+
+// cleanDoc returns the lines of a doc comment of the function with the given
+// name, without its API lines, as a description. A leading reference to the
+// function is dropped, since it means nothing to API clients.
+func cleanDoc(name string, lines []string) string {
+	text := strings.TrimSpace(strings.Join(lines, "\n"))
+	for strings.Contains(text, "\n\n\n") {
+		text = strings.ReplaceAll(text, "\n\n\n", "\n\n")
+	}
+	if rest, ok := strings.CutPrefix(text, name+" "); ok {
+		r := []rune(rest)
+		r[0] = unicode.ToUpper(r[0])
+		text = string(r)
+	}
+	return text
+}
+
+// operationID returns an identifier for the operation of ep, such as
+// "getMacroByID" for GET /api/macro/{id}.
+func operationID(ep *endpoint) string {
+	var buf bytes.Buffer
+	buf.WriteString(strings.ToLower(ep.method))
+	for _, elt := range strings.Split(strings.Trim(ep.path, "/"), "/") {
+		if elt == "api" {
+			continue
+		}
+		if p, ok := strings.CutPrefix(elt, "{"); ok {
+			buf.WriteString("By")
+			elt = strings.TrimSuffix(p, "}")
+			if elt == "id" {
+				elt = "ID"
+			}
+		}
+		for _, word := range strings.FieldsFunc(elt, func(r rune) bool { return r == '-' || r == '.' }) {
+			buf.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return buf.String()
+}
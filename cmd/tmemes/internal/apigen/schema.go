@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+)
+
+// A schema is a JSON schema, as used by OpenAPI.
+type schema = map[string]any
+
+// A schemaSet builds schemas from Go types, following their JSON encoding.
+// Named struct types of the tmemes and client packages are defined once, as
+// components of the document, and referred to by name.
+type schemaSet struct {
+	defs map[string]schema
+}
+
+// named are the packages whose struct types are named components.
+var named = []string{
+	"github.com/tailscale/tmemes",
+	"github.com/tailscale/tmemes/client",
+}
+
+var (
+	timeType          = reflect.TypeFor[time.Time]()
+	areasType         = reflect.TypeFor[tmemes.Areas]()
+	rawMessageType    = reflect.TypeFor[json.RawMessage]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// schemaOf returns the schema of the JSON encoding of values of type t.
+func (s *schemaSet) schemaOf(t reflect.Type) schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case areasType:
+		// See tmemes.Areas: a single area may be given as a plain object.
+		area := s.schemaOf(reflect.TypeFor[tmemes.Area]())
+		return schema{"oneOf": []schema{area, {"type": "array", "items": area}}}
+	case rawMessageType:
+		return schema{}
+	}
+	if reflect.PointerTo(t).Implements(textMarshalerType) {
+		return schema{"type": "string"} // e.g., tmemes.Color
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return schema{"type": "integer"}
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return schema{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return schema{"type": "string", "format": "byte"}
+		}
+		return schema{"type": "array", "items": s.schemaOf(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": s.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" || !slices.Contains(named, t.PkgPath()) {
+			return s.structSchema(t)
+		}
+		if _, ok := s.defs[t.Name()]; !ok {
+			s.defs[t.Name()] = nil // for recursive types
+			s.defs[t.Name()] = s.structSchema(t)
+		}
+		return schema{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return schema{} // any value
+}
+
+// structSchema returns the schema of the JSON encoding of struct type t.
+func (s *schemaSet) structSchema(t reflect.Type) schema {
+	props := make(map[string]schema)
+	var required []string
+	s.addFields(t, props, &required)
+	sch := schema{"type": "object", "properties": props}
+	if len(required) != 0 {
+		sch["required"] = required
+	}
+	return sch
+}
+
+// addFields adds the properties of the fields of struct type t to props, and
+// the names of those not marked omitempty to required. The fields of
+// embedded structs without a JSON name are promoted, as encoding/json does.
+func (s *schemaSet) addFields(t reflect.Type, props map[string]schema, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				s.addFields(ft, props, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = s.schemaOf(f.Type)
+		if !slices.Contains(strings.Split(opts, ","), "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/creachadair/mds/compare"
+	"github.com/tailscale/tmemes"
+	"golang.org/x/exp/slices"
+	"tailscale.com/tailcfg"
+)
+
+// leaderboardPeriods maps the names of leaderboard periods to their length.
+// A zero length means all time.
+var leaderboardPeriods = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"all":   0,
+}
+
+// leaderboardPeriodNames lists the keys of leaderboardPeriods, shortest first.
+var leaderboardPeriodNames = []string{"day", "week", "month", "all"}
+
+// leaderboardCreator is a creator's entry on the leaderboard.
+type leaderboardCreator struct {
+	UserID    tailcfg.UserID `json:"userID"`
+	Name      string         `json:"name"`
+	Macros    int            `json:"macros"`
+	Upvotes   int            `json:"upvotes"`
+	Downvotes int            `json:"downvotes"`
+	Score     int            `json:"score"` // upvotes - downvotes
+	Karma     int            `json:"karma"` // score of all their macros, of all time
+}
+
+// onLeaderboard reports whether the specified user may appear on leaderboards
+// and other displays of top creators.
+func (s *tmemeServer) onLeaderboard(id tailcfg.UserID) bool {
+	return !s.db.UserPrefs(id).HideFromLeaderboards
+}
+
+// serveAPILeaderboard reports the top macros and creators over a period.
+//
+// API: GET /api/leaderboard[?period=P][&count=N]
+//
+// The period is one of "day", "week" (the default), "month", or "all".  The
+// result is {"period":P, "macros":[...], "creators":[...]}, each best first
+// by net votes, with up to count (default 10) entries. Only macros created
+// during the period are counted, but each creator also reports their karma,
+// the net votes on all their visible macros. Users who have opted out of
+// leaderboards (see /api/prefs) and their macros are not included.
+func (s *tmemeServer) serveAPILeaderboard(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-leaderboard", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	period, window, count, err := parseLeaderboardOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	macros, creators := s.leaderboard(r.Context(), window)
+	rsp := struct {
+		P string               `json:"period"`
+		M []*tmemes.Macro      `json:"macros"`
+		C []leaderboardCreator `json:"creators"`
+	}{
+		P: period,
+		M: macros[:min(len(macros), count)],
+		C: creators[:min(len(creators), count)],
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseLeaderboardOptions parses the period and count parameters of r, and
+// returns the name and length of the period and the count.
+func parseLeaderboardOptions(r *http.Request) (period string, window time.Duration, count int, _ error) {
+	period = r.FormValue("period")
+	if period == "" {
+		period = "week"
+	}
+	window, ok := leaderboardPeriods[period]
+	if !ok {
+		return "", 0, 0, fmt.Errorf("invalid period %q", period)
+	}
+	count = 10
+	if v := r.FormValue("count"); v != "" {
+		var err error
+		count, err = strconv.Atoi(v)
+		if err != nil || count <= 0 {
+			return "", 0, 0, errors.New("invalid count")
+		}
+		count = min(count, 100)
+	}
+	return period, window, count, nil
+}
+
+// leaderboard computes the leaderboard for macros created within window of
+// the current time (or all time, if window == 0). The results are ordered best
+// first, and are never nil.
+func (s *tmemeServer) leaderboard(ctx context.Context, window time.Duration) ([]*tmemes.Macro, []leaderboardCreator) {
+	macros := []*tmemes.Macro{}
+	byUser := make(map[tailcfg.UserID]*leaderboardCreator)
+	for _, m := range s.db.Macros() {
+		if window > 0 && time.Since(m.CreatedAt) >= window {
+			continue
+		}
+		anon := m.Creator <= 0
+		if !anon && !s.onLeaderboard(m.Creator) {
+			continue
+		}
+		macros = append(macros, m)
+		if anon {
+			continue // anonymous macros have no creator to rank
+		}
+		c, ok := byUser[m.Creator]
+		if !ok {
+			c = &leaderboardCreator{UserID: m.Creator}
+			byUser[m.Creator] = c
+		}
+		c.Macros++
+		c.Upvotes += m.Upvotes
+		c.Downvotes += m.Downvotes
+		c.Score += m.Upvotes - m.Downvotes
+	}
+	sortMacrosByPopularity(macros)
+
+	creators := []leaderboardCreator{}
+	karma := s.db.Karma()
+	for _, c := range byUser {
+		c.Name = s.userDisplayName(ctx, c.UserID, time.Time{})
+		c.Karma = karma[c.UserID]
+		creators = append(creators, *c)
+	}
+	slices.SortFunc(creators, compare.FromLessFunc(func(a, b leaderboardCreator) bool {
+		if a.Score == b.Score {
+			return a.UserID < b.UserID
+		}
+		return a.Score > b.Score
+	}))
+	return macros, creators
+}
+
+// serveUILeaderboard serves a UI page for the leaderboard.
+//
+// API: /leaderboard[?period=P][&count=N]
+//
+// The parameters are as for /api/leaderboard.
+func (s *tmemeServer) serveUILeaderboard(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("ui-leaderboard", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	period, window, count, err := parseLeaderboardOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	macros, creators := s.leaderboard(r.Context(), window)
+	data := s.newUIData(r.Context(), nil, macros[:min(len(macros), count)], s.getCallerID(r))
+	data.Period = period
+	data.Periods = leaderboardPeriodNames
+	data.Creators = creators[:min(len(creators), count)]
+
+	var buf bytes.Buffer
+	if err := ui.ExecuteTemplate(&buf, "leaderboard.tmpl", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf.WriteTo(w)
+}
@@ -8,13 +8,19 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -31,46 +37,286 @@ var (
 
 	// Users with administrative ("super-user") powers. By default, only the
 	// user who created an image can edit or delete it. Marking a user as an
-	// admin gives them permission to edit or delete any image.
+	// admin gives them permission to edit or delete any image. Admins can also
+	// be named in the tailnet policy, with the tmemes:admin grant.
 	adminUsers = flag.String("admin", "",
 		"Users with admin rights (comma-separated logins: user@example.com)")
 
+	// Tagged nodes cannot create or vote. This flag lets nodes with the given
+	// tags, such as CI runners, read through the API as a service identity,
+	// and refuses API and content requests from all other tagged nodes.
+	readOnlyTags = flag.String("read-only-tags", "",
+		"Comma-separated tags of nodes allowed read-only API access, e.g., tag:ci (optional)")
+
+	// By default, any user of the tailnet can upload and vote. With this flag,
+	// those require the tmemes:upload and tmemes:vote grants in the tailnet
+	// policy, so that tailnet admins can manage roles centrally.
+	requireGrants = flag.Bool("require-grants", false,
+		"Require tailnet grants of tmemes:upload and tmemes:vote to upload and vote")
+
 	// If this flag is set true, users are allowed to post unattributed
 	// ("anonymous") templates and macros. Unattributed images still require
 	// that the user be authorized by the tailnet, but the server will not
 	// record their user ID in its database.
 	allowAnonymous = flag.Bool("allow-anonymous", true, "allow anonymous uploads")
 
+	// On small tailnets, a creator's vote for their own macro can make up a
+	// large share of its score. This flag lets the operator reject such votes
+	// ("deny"), or keep them without counting them in scores ("ignore").
+	selfVotes = flag.String("self-votes", "allow",
+		"How to treat votes by creators on their own macros: allow, deny, or ignore")
+
+	// To keep one user from flooding the board or churning the macro cache,
+	// this flag limits how often each user may create macros, upload
+	// templates, and vote. The limit is a token bucket holding N tokens,
+	// refilled steadily over the duration.
+	rateLimit = flag.String("rate-limit", "",
+		"Per-user limit on creating and voting, as N/duration, e.g., 30/1m (optional)")
+
+	// By default, sort=popular ranks macros by net votes. On large tailnets,
+	// ranking by the fraction of upvotes, discounted for macros with few votes,
+	// keeps older macros from crowding out good new ones.
+	popularRanking = flag.String("popular-ranking", rankNet,
+		"How to rank macros for sort=popular: net, wilson, or bayes")
+
 	// The hostname to advertise on the tailnet.
 	hostName = flag.String("hostname", "tmemes",
 		"The tailscale hostname to use for the server")
 
-	// This flag controls the maximum image file size the server will allow to
-	// be uploaded as a template.
+	// Some browsers and link unfurlers misbehave with plain HTTP on MagicDNS
+	// names. If this flag is set, the server uses the tailnet's HTTPS
+	// certificate to serve on :443, and answers HTTP on :80 with a redirect
+	// there. HTTPS must be enabled for the tailnet.
+	serveHTTPS = flag.Bool("serve-https", false,
+		"Serve HTTPS on :443 with the tailnet certificate, and redirect HTTP to it")
+
+	// If set, the server also listens on the public internet with Tailscale
+	// Funnel, and serves macros that their creators have marked public at
+	// signed URLs. Nothing else is served there, apart from the Slack,
+	// Discord and Mattermost apps below. See funnel.go for details.
+	serveFunnel = flag.Bool("funnel", false,
+		"Share macros marked public outside the tailnet with Tailscale Funnel")
+
+	// If set, the server also answers Slack on the Funnel listener, as a
+	// Slack app that unfurls links to macros and makes macros with /meme.
+	// See slack.go and slackcmd.go for details.
+	slackSigningSecret = flag.String("slack-signing-secret", "",
+		"Signing secret of the Slack app for unfurling links and making macros (requires -funnel)")
+	slackBotToken = flag.String("slack-bot-token", "",
+		"Bot token of the Slack app for unfurling links and making macros (requires -funnel)")
+
+	// If set, the server also answers Discord on the Funnel listener, as a
+	// Discord app that makes macros with /meme. See discord.go for details.
+	discordPublicKey = flag.String("discord-public-key", "",
+		"Public key (hex) of the Discord app for making macros (requires -funnel)")
+
+	// If set, the server also answers a Mattermost slash command on the
+	// Funnel listener. See mattermost.go for details.
+	mattermostToken = flag.String("mattermost-token", "",
+		"Token of the Mattermost slash command for making macros (requires -funnel)")
+
+	// If set, the server also answers "!meme" in the Matrix rooms that the
+	// bot account is invited to. See matrix.go for details.
+	matrixHomeserver = flag.String("matrix-homeserver", "",
+		"Base URL of the Matrix homeserver of the bot account for making macros")
+	matrixToken = flag.String("matrix-token", "",
+		"Access token of the Matrix bot account for making macros")
+
+	// These flags control the maximum image file sizes the server will allow to
+	// be uploaded as templates. Animated GIFs get a separate limit, since they
+	// are usually much larger than still images.
 	maxImageSize = flag.Int64("max-image-size", 4,
-		"Maximum image size in MiB")
+		"Maximum still image size in MiB")
+	maxGIFSize = flag.Int64("max-gif-size", 16,
+		"Maximum GIF or animated PNG image size in MiB")
+	maxAudioSize = flag.Int64("max-audio-size", 2,
+		"Maximum audio clip size in MiB, for audio templates (requires -ffmpeg)")
+
+	// Long animations are slow to render and make large macros. These flags
+	// limit the GIFs (and animated PNGs) accepted as templates. If downsampling is enabled, GIFs
+	// over the limits have frames dropped until they fit, instead of being
+	// rejected.
+	maxGIFFrames = flag.Int("max-gif-frames", 300,
+		"Maximum number of frames in a GIF template (0 for no limit)")
+	maxGIFDuration = flag.Duration("max-gif-duration", time.Minute,
+		"Maximum play time of a GIF template (0 for no limit)")
+	downsampleGIFs = flag.Bool("gif-downsample", false,
+		"Drop frames from GIFs over the limits instead of rejecting them")
+	maxVideoSeconds = flag.Int("max-video-seconds", 15,
+		"Maximum length in seconds of a video clip uploaded as a template (requires -ffmpeg; 0 for no limit)")
 
 	// The data directory where the server will store its images, caches, and
 	// the database of macro definitions.
 	storeDir = flag.String("store", "/tmp/tmemes", "Storage directory (required)")
 
+	// If set, the server first unpacks this bundle, as written by the
+	// /api/admin/export method, into the store directory. The store must not
+	// already have an index.
+	importBundle = flag.String("import", "",
+		"Restore a bundle from /api/admin/export into an empty --store directory")
+
+	// If set, template images, cached macros, and snapshots of the index are
+	// also kept in this object store, and restored from it into an empty
+	// -store directory on startup.
+	storeBackend = flag.String("store-backend", "",
+		"Durable storage URL, e.g., s3://bucket/prefix or file:///dir (optional)")
+
+	// If set, the image files of the store are encrypted at rest with the key
+	// in this file, or else with the key in $TMEMES_STORE_KEY. The key is 32
+	// bytes encoded in base64, e.g., from "openssl rand -base64 32".
+	storeKeyFile = flag.String("store-key-file", "",
+		"File holding a base64 key to encrypt stored images with (default $TMEMES_STORE_KEY)")
+
 	// Image macros are generated on the fly and cached. The server periodically
 	// cleans up cached macros that have not been accessed for some period of
-	// time, once the cache exceeds a size threshold.
+	// time, once the cache exceeds a size threshold. Macros that are viewed or
+	// voted for more than others are kept up to four times as long, and those
+	// no one has viewed or voted for lately half as long.
 	maxAccessAge = flag.Duration("cache-max-access-age", 24*time.Hour,
 		"How long after last access a cached macro is eligible for cleanup")
 	minPruneMiB = flag.Int64("cache-min-prune-mib", 512,
 		"Minimum size of macro cache in MiB to trigger a cleanup")
+	cacheMaxMiB = flag.Int64("cache-max-mib", 0,
+		"Maximum size of macro cache in MiB, evicting least recently used (0 for no limit)")
 	cacheSeed = flag.String("cache-seed", "",
 		"Hash seed used to generate cache keys")
+
+	// By default, macros are generated in the same image format as their
+	// templates. If this flag is set, all macros are generated as WebP images
+	// instead (animated, for GIF templates).
+	webpMacros = flag.Bool("webp-macros", false,
+		"Generate all macros as WebP images")
+
+	// Still macros are encoded as JPEG or PNG, following their templates,
+	// with these settings. Admins can change them at run time; see
+	// encoding.go.
+	jpegQuality = flag.Int("jpeg-quality", 90,
+		"Quality of generated JPEG images, from 1 to 100")
+	pngCompression = flag.String("png-compression", "default",
+		"Compression level of generated PNG images: default, none, speed, or best")
+
+	// New macros are rendered into the cache in the background as they are
+	// created, by this many workers, so that their first viewers do not wait
+	// for large GIFs to be rendered.
+	prerenderWorkers = flag.Int("prerender-workers", 2,
+		"Number of workers rendering new macros in the background (0 to render on first view)")
+
+	// If set, macros on GIF templates can also be fetched as MP4 or WebM
+	// video, transcoded by running this ffmpeg binary, sound clips can be
+	// uploaded as audio templates, and video clips can be uploaded as GIF
+	// templates.
+	ffmpegPath = flag.String("ffmpeg", "",
+		"Path to ffmpeg, to serve animated macros as .mp4 and .webm and enable audio and video templates (optional)")
+
+	// If set, the create UI offers the color presets defined in this JSON
+	// file instead of the defaults. See palette.go for the format.
+	paletteFile = flag.String("palette", "",
+		"JSON file of color presets for the create UI (optional)")
+
+	// If set, previews of macros report text lines that may be hard to read,
+	// because of poor contrast or small size.
+	legibilityWarnings = flag.Bool("legibility-warnings", false,
+		"Warn in macro previews about text that may be hard to read")
+
+	// If set, the most popular macro of the last day is posted to a webhook
+	// on this cron-style schedule, e.g., "0 9 * * 1-5" for 9am on weekdays
+	// (in the server's local time).
+	digestSchedule = flag.String("digest-schedule", "",
+		"Cron-style schedule for posting the meme of the day (optional)")
+	digestWebhook = flag.String("digest-webhook", "",
+		"Webhook URL to post the meme of the day to, e.g., a Slack incoming webhook")
+	digestBaseURL = flag.String("digest-base-url", "",
+		"Base URL of the server for links in the meme of the day (default -base-url, or http(s)://<hostname>)")
+
+	// When the server is reached through a reverse proxy, these flags say
+	// where the public sees it, and which proxies may be trusted to report
+	// the address of the original caller. See proxy.go for details.
+	baseURL = flag.String("base-url", "",
+		"Public base URL of the server for absolute links, e.g., https://memes.example.com (optional)")
+	trustedProxies = flag.String("trusted-proxies", "",
+		"Comma-separated addresses or CIDR prefixes of proxies whose X-Forwarded-For is honored (optional)")
+
+	// Automation services like Zapier and IFTTT poll the /api/trigger/
+	// endpoints for new items. If this flag is set, those endpoints require
+	// the caller to present this value as a bearer token.
+	triggerToken = flag.String("trigger-token", "",
+		"Bearer token required for the /api/trigger/ endpoints (optional)")
+
+	// If set, the server accepts mail over SMTP at this address on the
+	// tailnet, and converts messages from tailnet users into templates and
+	// macros. See email.go for details.
+	emailListen = flag.String("email-listen", "",
+		"Tailnet address to accept meme emails on, e.g., :25 (optional)")
+	emailTo = flag.String("email-to", "",
+		"If set, only accept email for this recipient address")
+
+	// Push services require senders to identify themselves with a contact URL
+	// (mailto: or https:). Setting this flag enables Web Push notifications.
+	webPushContact = flag.String("web-push-contact", "",
+		"Contact URL for Web Push, e.g., mailto:admin@example.com (enables push)")
+
+	// Subscriptions to template packs published by other servers are synced
+	// at this interval. See packs.go for details.
+	packSyncInterval = flag.Duration("pack-sync-interval", 6*time.Hour,
+		"How often to sync subscribed template packs (0 disables periodic sync)")
+
+	// A template pack that admins of a server with no templates are offered
+	// to import, as a subscription. See onboarding.go for details.
+	starterPackURL = flag.String("starter-pack", "",
+		"URL of a template pack to offer admins of an empty server")
+	starterPackKey = flag.String("starter-pack-key", "",
+		"Hex-encoded public key of the --starter-pack publisher")
+
+	// Fault injection, for checking how the server and its clients behave when
+	// things go wrong. These flags are omitted from the usage message, and
+	// should not be set in production.
+	chaosRenderDelay = flag.Duration("chaos-render-delay", 0,
+		"Add this much latency to each macro rendering")
+	chaosCacheFail = flag.Float64("chaos-cache-fail", 0,
+		"Fraction of macro cache writes that fail (0..1)")
+	chaosStoreFail = flag.Float64("chaos-store-fail", 0,
+		"Fraction of store updates that fail (0..1)")
 )
 
+// loadStoreKey returns the key for encrypting the store at rest, from the
+// -store-key-file flag or the TMEMES_STORE_KEY environment variable, or nil if
+// neither is set.
+func loadStoreKey() ([]byte, error) {
+	text := os.Getenv("TMEMES_STORE_KEY")
+	if *storeKeyFile != "" {
+		data, err := os.ReadFile(*storeKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	} else if len(key) != store.EncryptionKeySize {
+		return nil, fmt.Errorf("key must be %d bytes, not %d", store.EncryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+// isHiddenFlag reports whether the named flag is omitted from usage.
+func isHiddenFlag(name string) bool { return strings.HasPrefix(name, "chaos-") }
+
+// injectFault reports whether to inject a fault, given the fraction of
+// operations that should fail.
+func injectFault(rate float64) bool { return rate > 0 && rand.Float64() < rate }
+
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `Usage: [TS_AUTHKEY=k] %[1]s <options>
 
 Run an image macro service as a node on a tailnet.  The service listens for
-HTTP requests (not HTTPS) on port 80.
+HTTP requests on port 80.  With --serve-https, which requires HTTPS to be
+enabled for the tailnet, it instead serves HTTPS on port 443 with the
+tailnet's certificate, and redirects HTTP requests on port 80 there.
 
 The first time you start %[1]s, you must authenticate its node on the tailnet
 you wnat it to join. To do this, generate an auth key [1] and pass it in via
@@ -84,9 +330,21 @@ until terminated by SIGINT or SIGTERM.
 
 [1]: https://tailscale.com/kb/1085/auth-keys/
 
+To merge the contents of another (stopped) server's storage directory into
+this one, run:
+
+  %[1]s --store=dir merge --from=other-dir
+
 Options:
 `, filepath.Base(os.Args[0]))
-		flag.PrintDefaults()
+		visible := flag.NewFlagSet("", flag.ContinueOnError)
+		visible.SetOutput(flag.CommandLine.Output())
+		flag.VisitAll(func(f *flag.Flag) {
+			if !isHiddenFlag(f.Name) {
+				visible.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		visible.PrintDefaults()
 	}
 }
 
@@ -96,11 +354,123 @@ func main() {
 		log.Fatal("You must provide a non-empty --store directory")
 	} else if *maxImageSize <= 0 {
 		log.Fatal("The -max-image-size must be positive")
+	} else if *maxGIFSize <= 0 {
+		log.Fatal("The -max-gif-size must be positive")
+	} else if *maxVideoSeconds < 0 {
+		log.Fatal("The -max-video-seconds must not be negative")
+	} else if *maxAudioSize <= 0 {
+		log.Fatal("The -max-audio-size must be positive")
+	} else if !validRanking(*popularRanking) {
+		log.Fatalf("Unknown -popular-ranking %q", *popularRanking)
+	} else if *jpegQuality < 1 || *jpegQuality > 100 {
+		log.Fatal("The -jpeg-quality must be from 1 to 100")
+	} else if _, ok := pngCompressionLevels[*pngCompression]; !ok {
+		log.Fatalf("Unknown -png-compression %q", *pngCompression)
+	} else if *chaosCacheFail < 0 || *chaosCacheFail > 1 {
+		log.Fatal("The -chaos-cache-fail rate must be between 0 and 1")
+	} else if *chaosStoreFail < 0 || *chaosStoreFail > 1 {
+		log.Fatal("The -chaos-store-fail rate must be between 0 and 1")
+	}
+	if *chaosRenderDelay > 0 || *chaosCacheFail > 0 || *chaosStoreFail > 0 {
+		log.Printf("WARNING: fault injection enabled (render-delay=%v, cache-fail=%v, store-fail=%v)",
+			*chaosRenderDelay, *chaosCacheFail, *chaosStoreFail)
+	}
+	if *ffmpegPath != "" {
+		if _, err := exec.LookPath(*ffmpegPath); err != nil {
+			log.Fatalf("Invalid -ffmpeg: %v", err)
+		}
+	}
+	var digestSched *cronSchedule
+	if *digestSchedule != "" {
+		cs, err := parseCronSchedule(*digestSchedule)
+		if err != nil {
+			log.Fatalf("Invalid -digest-schedule: %v", err)
+		} else if *digestWebhook == "" {
+			log.Fatal("The -digest-schedule requires a -digest-webhook")
+		}
+		digestSched = cs
+	}
+	if (*slackSigningSecret == "") != (*slackBotToken == "") {
+		log.Fatal("The -slack-signing-secret and -slack-bot-token must be set together")
+	} else if *slackSigningSecret != "" && !*serveFunnel {
+		log.Fatal("The -slack-signing-secret requires -funnel")
+	}
+	var discordKey ed25519.PublicKey
+	if *discordPublicKey != "" {
+		key, err := parseDiscordPublicKey(*discordPublicKey)
+		if err != nil {
+			log.Fatalf("Invalid -discord-public-key: %v", err)
+		} else if !*serveFunnel {
+			log.Fatal("The -discord-public-key requires -funnel")
+		}
+		discordKey = key
+	}
+	if *mattermostToken != "" && !*serveFunnel {
+		log.Fatal("The -mattermost-token requires -funnel")
+	}
+	if (*matrixHomeserver == "") != (*matrixToken == "") {
+		log.Fatal("The -matrix-homeserver and -matrix-token must be set together")
+	}
+	if *baseURL != "" {
+		u, err := checkBaseURL(*baseURL)
+		if err != nil {
+			log.Fatalf("Invalid -base-url: %v", err)
+		}
+		*baseURL = u
+	}
+	proxies, err := parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	var limiter *userLimiter
+	if *rateLimit != "" {
+		n, per, err := parseRateLimit(*rateLimit)
+		if err != nil {
+			log.Fatalf("Invalid -rate-limit: %v", err)
+		}
+		limiter = newUserLimiter(n, per)
+	}
+	var palette []palettePreset
+	if *paletteFile != "" {
+		ps, err := loadPalette(*paletteFile)
+		if err != nil {
+			log.Fatalf("Invalid -palette: %v", err)
+		}
+		palette = ps
+	}
+	var macroExt string
+	if *webpMacros {
+		macroExt = ".webp"
+	}
+
+	if *importBundle != "" {
+		if err := runImport(*storeDir, *importBundle); err != nil {
+			log.Fatalf("Import: %v", err)
+		}
 	}
 
+	var backend store.Backend
+	if *storeBackend != "" {
+		b, err := store.OpenBackend(context.Background(), *storeBackend)
+		if err != nil {
+			log.Fatalf("Opening store backend: %v", err)
+		}
+		backend = b
+	}
+
+	storeKey, err := loadStoreKey()
+	if err != nil {
+		log.Fatalf("Loading store key: %v", err)
+	}
 	db, err := store.New(*storeDir, &store.Options{
 		MaxAccessAge:  *maxAccessAge,
 		MinPruneBytes: *minPruneMiB << 20,
+		MaxCacheBytes: *cacheMaxMiB << 20,
+		MacroExt:      macroExt,
+		FaultRate:     *chaosStoreFail,
+		Backend:       backend,
+		SelfVotes:     store.SelfVotePolicy(*selfVotes),
+		EncryptionKey: storeKey,
 	})
 	if err != nil {
 		log.Fatalf("Opening store: %v", err)
@@ -112,6 +482,13 @@ func main() {
 	}
 	defer db.Close()
 
+	if flag.Arg(0) == "merge" {
+		if err := runMerge(db, flag.Args()[1:]); err != nil {
+			log.Fatalf("Merge: %v", err)
+		}
+		return
+	}
+
 	logf := logger.Discard
 	if *doVerbose {
 		logf = log.Printf
@@ -130,7 +507,12 @@ func main() {
 		s.Close()
 	}()
 
-	ln, err := s.Listen("tcp", ":80")
+	var ln net.Listener
+	if *serveHTTPS {
+		ln, err = s.ListenTLS("tcp", ":443")
+	} else {
+		ln, err = s.Listen("tcp", ":80")
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -146,10 +528,44 @@ func main() {
 		srv:            s,
 		lc:             lc,
 		allowAnonymous: *allowAnonymous,
+		triggerToken:   *triggerToken,
+		limiter:        limiter,
+		usage:          newUsageTracker(),
+		trustedProxies: proxies,
+		palette:        palette,
+		discordKey:     discordKey,
 	}
 	if err := ms.initialize(s); err != nil {
 		panic(err)
 	}
+	if digestSched != nil {
+		go ms.postDigestsPeriodically(ctx, digestSched)
+	}
+	if *matrixHomeserver != "" {
+		mb, err := newMatrixBot(ctx, ms, *matrixHomeserver, *matrixToken)
+		if err != nil {
+			log.Fatalf("Logging in to Matrix: %v", err)
+		}
+		go mb.run(ctx)
+	}
+
+	if *serveHTTPS {
+		hln, err := s.Listen("tcp", ":80")
+		if err != nil {
+			panic(err)
+		}
+		defer hln.Close()
+		go http.Serve(hln, http.HandlerFunc(ms.serveHTTPSRedirect))
+	}
+
+	if *serveFunnel {
+		fln, err := s.ListenFunnel("tcp", ":443", tsnet.FunnelOnly())
+		if err != nil {
+			log.Fatalf("Starting Funnel listener: %v", err)
+		}
+		defer fln.Close()
+		go http.Serve(fln, ms.newFunnelMux())
+	}
 
 	log.Print("it's alive!")
 	http.Serve(ln, ms.newMux())
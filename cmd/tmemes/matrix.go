@@ -0,0 +1,364 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+	"tailscale.com/tailcfg"
+)
+
+// Matrix bot.
+//
+// If the -matrix-homeserver and -matrix-token flags are set, the server
+// logs in to the Matrix homeserver with the access token of a bot account,
+// joins the rooms it is invited to, and answers messages in them that start
+// with "!meme", as in
+//
+//	!meme drake "no" "yes"
+//
+// The command takes the same text as the Slack command (see slackcmd.go and
+// chat.go). Replies are posted in the room, in the thread of the command if
+// it has one. Matrix has no messages that only their sender sees, so users
+// should link their accounts to the tailnet with "!meme link" in a direct
+// chat with the bot. Since the homeserver may not reach the Funnel listener,
+// the images of macros are uploaded to it.
+//
+// Unlike the other chat services, Matrix is reached by the server, with
+// long-polling /sync requests, so the Funnel listener is not needed.
+
+const (
+	matrixCommand     = "!meme"
+	matrixSyncTimeout = 30 * time.Second
+	matrixRetryDelay  = 10 * time.Second       // after a failed sync
+	matrixCallTimeout = time.Minute            // for calls other than /sync
+	maxMatrixBytes    = 16 << 20               // of the response to a sync
+	matrixToURL       = "https://matrix.to/#/" // for permalinks
+)
+
+// matrixBot is the chatBot for Matrix, and the client of the homeserver.
+type matrixBot struct {
+	s      *tmemeServer
+	hs     string // the base URL of the homeserver
+	token  string // the access token of the bot account
+	userID string // the Matrix ID of the bot account
+}
+
+// newMatrixBot returns the bot for the account with the given access token
+// on the homeserver hs.
+func newMatrixBot(ctx context.Context, s *tmemeServer, hs, token string) (*matrixBot, error) {
+	b := &matrixBot{s: s, hs: strings.TrimSuffix(hs, "/"), token: token}
+	var res struct {
+		UserID string `json:"user_id"`
+	}
+	if err := b.call(ctx, "GET", "/_matrix/client/v3/account/whoami", nil, &res); err != nil {
+		return nil, err
+	} else if res.UserID == "" {
+		return nil, errors.New("no user ID for the access token")
+	}
+	b.userID = res.UserID
+	return b, nil
+}
+
+func (*matrixBot) service() string { return "matrix" }
+
+func (b *matrixBot) tailnetUser(ctx context.Context, user string) (*tailcfg.UserProfile, error) {
+	return b.s.linkedTailnetUser(ctx, "matrix", user)
+}
+
+// A matrixEvent is an event in the timeline of a Matrix room.
+type matrixEvent struct {
+	Type    string `json:"type"`
+	EventID string `json:"event_id"`
+	Sender  string `json:"sender"`
+	Content struct {
+		MsgType   string `json:"msgtype"`
+		Body      string `json:"body"`
+		RelatesTo *struct {
+			RelType string `json:"rel_type"`
+			EventID string `json:"event_id"`
+		} `json:"m.relates_to"`
+	} `json:"content"`
+}
+
+// A matrixSync is the response to a /sync request.
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+// run answers commands in the rooms of the bot until ctx ends. Messages sent
+// before it starts are not answered.
+func (b *matrixBot) run(ctx context.Context) {
+	log.Printf("[matrix] logged in as %s", b.userID)
+	var since string
+	for ctx.Err() == nil {
+		q := url.Values{"timeout": {fmt.Sprint(matrixSyncTimeout.Milliseconds())}}
+		if since == "" {
+			// Skip the history: only the position after it is wanted.
+			q = url.Values{"filter": {`{"room":{"timeline":{"limit":0}}}`}}
+		} else {
+			q.Set("since", since)
+		}
+		var res matrixSync
+		if err := b.call(ctx, "GET", "/_matrix/client/v3/sync?"+q.Encode(), nil, &res); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("[matrix] sync: %v", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(matrixRetryDelay):
+				}
+			}
+			continue
+		}
+		if since != "" {
+			b.handleSync(ctx, &res)
+		}
+		since = res.NextBatch
+	}
+}
+
+// handleSync joins the rooms to which res reports invitations, and answers
+// the commands in the events it reports.
+func (b *matrixBot) handleSync(ctx context.Context, res *matrixSync) {
+	for room := range res.Rooms.Invite {
+		if err := b.call(ctx, "POST", "/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/join", struct{}{}, nil); err != nil {
+			log.Printf("[matrix] joining %s: %v", room, err)
+		}
+	}
+	for room, jr := range res.Rooms.Join {
+		for _, ev := range jr.Timeline.Events {
+			if ev.Type != "m.room.message" || ev.Sender == b.userID || ev.Content.MsgType != "m.text" {
+				continue
+			}
+			text, ok := strings.CutPrefix(strings.TrimSpace(ev.Content.Body), matrixCommand)
+			if !ok || (text != "" && !strings.HasPrefix(text, " ")) {
+				continue
+			}
+			serveMetrics.Add("matrix-command", 1)
+			go b.runCommand(room, ev, text)
+		}
+	}
+}
+
+// runCommand carries out the command text of ev, in room.
+func (b *matrixBot) runCommand(room string, ev matrixEvent, text string) {
+	conv := chatConv{User: ev.Sender, UserName: ev.Sender, Channel: room, Message: ev.EventID}
+	if rel := ev.Content.RelatesTo; rel != nil && rel.RelType == "m.thread" {
+		conv.Thread = rel.EventID
+	}
+	cmd, err := parseChatCommand(text)
+	if err != nil {
+		usage := chatUsage(matrixCommand)
+		if !errors.Is(err, errMemeHelp) {
+			usage = fmt.Sprintf("Sorry, %s.\n%s", err, usage)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), matrixCallTimeout)
+		defer cancel()
+		if err := b.post(ctx, conv, chatReply{Text: usage}); err != nil {
+			log.Printf("[matrix] replying to command: %v", err)
+		}
+		return
+	}
+	links := []tmemes.ContextLink{{
+		URL:  matrixToURL + url.PathEscape(room) + "/" + url.PathEscape(ev.EventID),
+		Text: "Matrix conversation",
+	}}
+	b.s.runChatCommand(b, conv, cmd, links)
+}
+
+func (b *matrixBot) post(ctx context.Context, conv chatConv, reply chatReply) error {
+	if m := reply.Macro; m != nil && m.ImageURL != "" {
+		// Send the image first, so that the caption follows it.
+		img, err := b.uploadMacro(ctx, m.Macro)
+		if err != nil {
+			log.Printf("[matrix] uploading macro %d: %v", m.ID, err)
+		} else if err := b.send(ctx, conv, img); err != nil {
+			return err
+		}
+	}
+	text, fmtText := matrixReplyText(reply)
+	msgType := "m.text"
+	if reply.Text != "" {
+		msgType = "m.notice"
+	}
+	return b.send(ctx, conv, map[string]any{
+		"msgtype":        msgType,
+		"body":           text,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": fmtText,
+	})
+}
+
+// matrixReplyText returns the text of reply, in plain text and HTML.
+func matrixReplyText(reply chatReply) (string, string) {
+	link := func(text, u string) string {
+		return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(u), html.EscapeString(text))
+	}
+	switch {
+	case reply.Macro != nil:
+		m := reply.Macro
+		return fmt.Sprintf("%s by %s: %s", m.Template.Name, m.Creator, m.URL),
+			fmt.Sprintf("%s by %s", link(m.Template.Name, m.URL), html.EscapeString(m.Creator))
+
+	case reply.Top != nil:
+		top := reply.Top
+		if len(top.Macros) == 0 {
+			return top.Title + ": none yet", html.EscapeString(top.Title) + ": none yet"
+		}
+		var text, fmtText strings.Builder
+		fmt.Fprintf(&text, "%s (%s)\n", top.Title, top.URL)
+		fmt.Fprintf(&fmtText, "<strong>%s</strong><ol>", link(top.Title, top.URL))
+		for i, m := range top.Macros {
+			fmt.Fprintf(&text, "%d. %s by %s: +%d -%d %s\n", i+1, m.Template.Name, m.Creator, m.Upvotes, m.Downvotes, m.URL)
+			fmt.Fprintf(&fmtText, "<li>%s by %s: 👍 %d 👎 %d</li>", link(m.Template.Name, m.URL),
+				html.EscapeString(m.Creator), m.Upvotes, m.Downvotes)
+		}
+		fmtText.WriteString("</ol>")
+		return strings.TrimSuffix(text.String(), "\n"), fmtText.String()
+	}
+	return reply.Text, strings.ReplaceAll(html.EscapeString(reply.Text), "\n", "<br>")
+}
+
+// uploadMacro uploads the image of m to the media repository of the
+// homeserver, and returns the content of a message showing it.
+func (b *matrixBot) uploadMacro(ctx context.Context, m *tmemes.Macro) (map[string]any, error) {
+	cachePath, err := b.s.db.MacroCachePath(m, store.CacheKey{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(cachePath); err != nil {
+		if err := b.s.renderMacro(m, cachePath, b.s.encodeSettings()); err != nil {
+			return nil, err
+		}
+	}
+	data, err := b.s.db.ReadFile(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(cachePath)
+	ctype := mime.TypeByExtension(ext)
+	hreq, err := b.newRequest(ctx, "POST", "/_matrix/media/v3/upload?filename="+url.QueryEscape(fmt.Sprintf("%d%s", m.ID, ext)), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", ctype)
+	var res struct {
+		ContentURI string `json:"content_uri"`
+	}
+	if err := b.do(hreq, &res); err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"msgtype": "m.image",
+		"body":    fmt.Sprintf("%d%s", m.ID, ext),
+		"url":     res.ContentURI,
+		"info":    map[string]any{"mimetype": ctype, "size": len(data)},
+	}, nil
+}
+
+// send sends a message with the given content to the room of conv, in
+// reply to the command.
+func (b *matrixBot) send(ctx context.Context, conv chatConv, content map[string]any) error {
+	reply := map[string]any{"event_id": conv.Message}
+	if conv.Thread != "" {
+		content["m.relates_to"] = map[string]any{
+			"rel_type":        "m.thread",
+			"event_id":        conv.Thread,
+			"is_falling_back": true,
+			"m.in_reply_to":   reply,
+		}
+	} else {
+		content["m.relates_to"] = map[string]any{"m.in_reply_to": reply}
+	}
+	var txn [8]byte
+	rand.Read(txn[:])
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%s", url.PathEscape(conv.Channel), hex.EncodeToString(txn[:]))
+	return b.call(ctx, "PUT", path, content, nil)
+}
+
+// call makes a request of the homeserver at path, with req, if not nil, as
+// its JSON body, and decodes its JSON response into res, if not nil.
+func (b *matrixBot) call(ctx context.Context, method, path string, req, res any) error {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	if !strings.HasPrefix(path, "/_matrix/client/v3/sync") {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, matrixCallTimeout)
+		defer cancel()
+	}
+	hreq, err := b.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	if req != nil {
+		hreq.Header.Set("Content-Type", "application/json")
+	}
+	return b.do(hreq, res)
+}
+
+// newRequest returns a request of the homeserver at path, authorized by the
+// access token of the bot.
+func (b *matrixBot) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	hreq, err := http.NewRequestWithContext(ctx, method, b.hs+path, body)
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Authorization", "Bearer "+b.token)
+	return hreq, nil
+}
+
+// do sends hreq, and decodes its JSON response into res, if not nil.
+func (b *matrixBot) do(hreq *http.Request, res any) error {
+	rsp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, maxMatrixBytes))
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		var merr struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(data, &merr)
+		return fmt.Errorf("matrix: %s: %s", rsp.Status, merr.Error)
+	} else if res != nil {
+		return json.Unmarshal(data, res)
+	}
+	return nil
+}
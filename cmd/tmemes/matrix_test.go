@@ -0,0 +1,44 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"testing"
+
+	"github.com/tailscale/tmemes"
+)
+
+func TestMatrixReplyText(t *testing.T) {
+	m := &chatMacro{
+		Macro:    &tmemes.Macro{ID: 7, Upvotes: 3, Downvotes: 1},
+		Template: &tmemes.Template{Name: "fish & chips"},
+		URL:      "https://tmemes.example.ts.net/m/7?a=1&b=2",
+		Creator:  "<alice>",
+	}
+	tests := []struct {
+		name          string
+		reply         chatReply
+		text, fmtText string
+	}{
+		{"text", chatReply{Text: "Sorry, <no>.\nUsage"},
+			"Sorry, <no>.\nUsage", "Sorry, &lt;no&gt;.<br>Usage"},
+		{"macro", chatReply{Macro: m},
+			"fish & chips by <alice>: https://tmemes.example.ts.net/m/7?a=1&b=2",
+			`<a href="https://tmemes.example.ts.net/m/7?a=1&amp;b=2">fish &amp; chips</a> by &lt;alice&gt;`},
+		{"empty top", chatReply{Top: &chatTop{Title: "Top macros of the day", URL: "https://x/"}},
+			"Top macros of the day: none yet", "Top macros of the day: none yet"},
+		{"top", chatReply{Top: &chatTop{Title: "Top", URL: "https://x/", Macros: []*chatMacro{m}}},
+			"Top (https://x/)\n1. fish & chips by <alice>: +3 -1 https://tmemes.example.ts.net/m/7?a=1&b=2",
+			`<strong><a href="https://x/">Top</a></strong><ol><li><a href="https://tmemes.example.ts.net/m/7?a=1&amp;b=2">fish &amp; chips</a> by &lt;alice&gt;: 👍 3 👎 1</li></ol>`},
+	}
+	for _, tc := range tests {
+		text, fmtText := matrixReplyText(tc.reply)
+		if text != tc.text {
+			t.Errorf("%s: got text %q, want %q", tc.name, text, tc.text)
+		}
+		if fmtText != tc.fmtText {
+			t.Errorf("%s: got HTML %q, want %q", tc.name, fmtText, tc.fmtText)
+		}
+	}
+}
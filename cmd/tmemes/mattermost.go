@@ -0,0 +1,177 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+// Mattermost slash commands.
+//
+// If the -mattermost-token flag is set, the server answers a Mattermost
+// custom slash command, usually /meme, whose request URL is on the Funnel
+// listener,
+//
+//	https://<host>.<tailnet>.ts.net/mattermost/commands
+//
+// and whose token is the value of the flag. The command takes the same text
+// as the Slack command (see slackcmd.go and chat.go), and its replies are
+// posted to the response URL of the command. Mattermost users link their
+// accounts to the tailnet with "/meme link", and macros are shown with their
+// images at signed URLs on the Funnel listener.
+
+const mattermostCommandsPath = "/mattermost/commands"
+
+// A mattermostMessage is a message posted in reply to a slash command.
+type mattermostMessage struct {
+	ResponseType string                 `json:"response_type"` // "in_channel" or "ephemeral"
+	Text         string                 `json:"text"`
+	Attachments  []mattermostAttachment `json:"attachments,omitempty"`
+}
+
+// A mattermostAttachment is the rich content of a Mattermost message.
+type mattermostAttachment struct {
+	Fallback  string `json:"fallback"`
+	Title     string `json:"title,omitempty"`
+	TitleLink string `json:"title_link,omitempty"`
+	Text      string `json:"text,omitempty"`
+	ImageURL  string `json:"image_url,omitempty"`
+	ThumbURL  string `json:"thumb_url,omitempty"`
+}
+
+// serveMattermostCommand receives slash commands from Mattermost, on the
+// Funnel listener.
+//
+// API: POST /mattermost/commands
+//
+// Requests must carry the token of the slash command. Usage errors are
+// answered at once, visible only to the sender. Otherwise the command is
+// carried out in the background, and the result is posted to the response
+// URL of the command.
+func (s *tmemeServer) serveMattermostCommand(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("mattermost-command", 1)
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Token ")
+	}
+	if !hmac.Equal([]byte(token), []byte(*mattermostToken)) {
+		http.Error(w, "invalid command token", http.StatusUnauthorized)
+		return
+	}
+	usage := chatUsage(cmp.Or(r.PostForm.Get("command"), "/meme"))
+	cmd, err := parseChatCommand(r.PostForm.Get("text"))
+	if errors.Is(err, errMemeHelp) {
+		writeMattermostMessage(w, mattermostMessage{ResponseType: "ephemeral", Text: usage})
+		return
+	} else if err != nil {
+		writeMattermostMessage(w, mattermostMessage{ResponseType: "ephemeral", Text: fmt.Sprintf("Sorry, %s.\n%s", err, usage)})
+		return
+	}
+	conv := chatConv{
+		User:        r.PostForm.Get("user_id"),
+		UserName:    r.PostForm.Get("user_name"),
+		ResponseURL: r.PostForm.Get("response_url"),
+	}
+	if u, err := url.Parse(conv.ResponseURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		http.Error(w, "invalid response URL", http.StatusBadRequest)
+		return
+	}
+	go s.runChatCommand(mattermostBot{s}, conv, cmd, nil)
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "{}") // the reply follows at the response URL
+}
+
+// writeMattermostMessage writes msg as the response to a slash command.
+func writeMattermostMessage(w http.ResponseWriter, msg mattermostMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// mattermostBot is the chatBot for Mattermost.
+type mattermostBot struct{ s *tmemeServer }
+
+func (mattermostBot) service() string { return "mattermost" }
+
+func (b mattermostBot) tailnetUser(ctx context.Context, user string) (*tailcfg.UserProfile, error) {
+	return b.s.linkedTailnetUser(ctx, "mattermost", user)
+}
+
+func (mattermostBot) post(ctx context.Context, conv chatConv, reply chatReply) error {
+	body, err := json.Marshal(mattermostMessageFor(reply))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", conv.ResponseURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("mattermost: %s", rsp.Status)
+	}
+	return nil
+}
+
+// mattermostMessageFor returns the Mattermost message for reply.
+func mattermostMessageFor(reply chatReply) mattermostMessage {
+	switch {
+	case reply.Macro != nil:
+		m := reply.Macro
+		return mattermostMessage{
+			ResponseType: "in_channel",
+			Attachments: []mattermostAttachment{{
+				Fallback:  fmt.Sprintf("%s by %s: %s", m.Template.Name, m.Creator, m.URL),
+				Title:     m.Template.Name,
+				TitleLink: m.URL,
+				Text:      "by " + m.Creator,
+				ImageURL:  m.ImageURL,
+			}},
+		}
+
+	case reply.Top != nil:
+		top := reply.Top
+		msg := mattermostMessage{ResponseType: "in_channel", Text: fmt.Sprintf("**[%s](%s)**", top.Title, top.URL)}
+		if len(top.Macros) == 0 {
+			msg.Text = fmt.Sprintf("**%s**: none yet", top.Title)
+		}
+		for i, m := range top.Macros {
+			msg.Attachments = append(msg.Attachments, mattermostAttachment{
+				Fallback:  fmt.Sprintf("%d. %s by %s: %s", i+1, m.Template.Name, m.Creator, m.URL),
+				Title:     fmt.Sprintf("%d. %s", i+1, m.Template.Name),
+				TitleLink: m.URL,
+				Text:      fmt.Sprintf("by %s\n:thumbsup: %d  :thumbsdown: %d", m.Creator, m.Upvotes, m.Downvotes),
+				ThumbURL:  m.ImageURL,
+			})
+		}
+		return msg
+	}
+	return mattermostMessage{ResponseType: "ephemeral", Text: reply.Text}
+}
@@ -0,0 +1,226 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+)
+
+// runMerge implements the "merge" subcommand, which imports the templates,
+// macros, and votes of another store into db:
+//
+//	tmemes --store=dir merge --from=other-dir
+//
+// Templates whose image files are byte-for-byte identical to one already in
+// db are not copied; macros based on them use the existing template instead.
+// All imported items get new IDs in db, and votes follow their macros. The
+// server should not be running on either store during a merge.
+func runMerge(db *store.DB, args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	from := fs.String("from", "", "Storage directory to merge from (required)")
+	fs.Parse(args)
+	if *from == "" {
+		return errors.New("you must provide a --from directory")
+	} else if filepath.Clean(*from) == filepath.Clean(*storeDir) {
+		return errors.New("cannot merge a store into itself")
+	} else if _, err := os.Stat(filepath.Join(*from, "index.db")); err != nil {
+		return fmt.Errorf("source store: %w", err)
+	}
+
+	src, err := store.New(*from, &store.Options{
+		MinPruneBytes: math.MaxInt64, // don't prune the source cache
+	})
+	if err != nil {
+		return fmt.Errorf("opening source store: %w", err)
+	}
+	defer src.Close()
+
+	// Index the existing templates by the content of their image files.
+	have := make(map[[sha256.Size]byte]*tmemes.Template)
+	for _, t := range db.AllTemplates() {
+		h, err := templateHash(db, t.ID)
+		if err != nil {
+			return err
+		}
+		if _, ok := have[h]; !ok {
+			have[h] = t
+		}
+	}
+
+	// Copy templates.
+	templateMap := make(map[int]int)
+	var numAdded, numDup int
+	for _, st := range src.AllTemplates() {
+		h, err := templateHash(src, st.ID)
+		if err != nil {
+			return err
+		}
+		if dt, ok := have[h]; ok {
+			templateMap[st.ID] = dt.ID
+			numDup++
+			fmt.Printf("template %d %q: same image as template %d %q\n", st.ID, st.Name, dt.ID, dt.Name)
+			continue
+		}
+		dt, err := copyTemplate(db, src, st)
+		if err != nil {
+			return fmt.Errorf("copying template %d: %w", st.ID, err)
+		}
+		have[h] = dt
+		templateMap[st.ID] = dt.ID
+		numAdded++
+		fmt.Printf("template %d %q: added as template %d %q\n", st.ID, st.Name, dt.ID, dt.Name)
+	}
+
+	// Copy stickers.
+	stickerMap := make(map[int]int)
+	srcStickers, err := src.Stickers()
+	if err != nil {
+		return fmt.Errorf("reading stickers: %w", err)
+	}
+	for _, ss := range srcStickers {
+		ds, err := copySticker(db, src, ss)
+		if err != nil {
+			return fmt.Errorf("copying sticker %d: %w", ss.ID, err)
+		}
+		stickerMap[ss.ID] = ds.ID
+		fmt.Printf("sticker %d: added as sticker %d\n", ss.ID, ds.ID)
+	}
+
+	// Copy macros.
+	macroMap := make(map[int]int)
+	for _, sm := range src.AllMacros() {
+		dm := *sm
+		dm.ID = 0
+		dm.TemplateID = templateMap[sm.TemplateID]
+		if len(sm.ImageOverlay) != 0 {
+			dm.ImageOverlay = slices.Clone(sm.ImageOverlay)
+			for i, o := range dm.ImageOverlay {
+				dm.ImageOverlay[i].Sticker = stickerMap[o.Sticker]
+			}
+		}
+		dm.Upvotes, dm.Downvotes = 0, 0
+		if err := db.AddMacro(&dm); err != nil {
+			return fmt.Errorf("copying macro %d: %w", sm.ID, err)
+		}
+		// AddMacro stamps the current time; keep the original.
+		dm.CreatedAt = sm.CreatedAt
+		if err := db.UpdateMacro(&dm); err != nil {
+			return fmt.Errorf("copying macro %d: %w", sm.ID, err)
+		}
+		macroMap[sm.ID] = dm.ID
+		fmt.Printf("macro %d: added as macro %d\n", sm.ID, dm.ID)
+	}
+
+	// Copy votes.
+	votes, err := src.AllVotes()
+	if err != nil {
+		return fmt.Errorf("reading votes: %w", err)
+	}
+	numVotes, err := db.ImportVotes(remapVotes(votes, macroMap))
+	if err != nil {
+		return fmt.Errorf("copying votes: %w", err)
+	}
+
+	fmt.Printf(`
+Merged %s into %s:
+  templates: %d added, %d already present
+  macros:    %d added
+  votes:     %d added, %d skipped (duplicate voter)
+`, *from, *storeDir, numAdded, numDup, len(macroMap), numVotes, len(votes)-numVotes)
+	return nil
+}
+
+// templateHash returns a digest of the image file for template id in db.
+func templateHash(db *store.DB, id int) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	path, err := db.TemplatePath(id)
+	if err != nil {
+		return sum, err
+	}
+	f, err := db.OpenFile(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, fmt.Errorf("hashing template %d: %w", id, err)
+	}
+	h.Sum(sum[:0])
+	return sum, nil
+}
+
+// copySticker adds a copy of sticker st from src to db, and returns the new
+// sticker.
+func copySticker(db, src *store.DB, st *tmemes.Sticker) (*tmemes.Sticker, error) {
+	path, err := src.StickerPath(st.ID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := src.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ds := *st
+	ds.ID, ds.Path = 0, ""
+	if err := db.AddSticker(&ds, filepath.Ext(path), f); err != nil {
+		return nil, err
+	}
+	return &ds, nil
+}
+
+// copyTemplate adds a copy of template st from src to db, and returns the new
+// template. If the name of st is already in use in db, a numeric suffix is
+// added to make it unique.
+func copyTemplate(db, src *store.DB, st *tmemes.Template) (*tmemes.Template, error) {
+	path, err := src.TemplatePath(st.ID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := src.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dt := *st
+	dt.ID, dt.Path, dt.Audio = 0, "", ""
+	for i := 2; ; i++ {
+		if _, err := db.TemplateByName(dt.Name); err != nil {
+			break // name is available
+		}
+		dt.Name = fmt.Sprintf("%s-%d", st.Name, i)
+	}
+	if err := db.AddTemplate(&dt, filepath.Ext(path), f); err != nil {
+		return nil, err
+	}
+	if st.Audio != "" {
+		ap, err := src.TemplateAudioPath(st.ID)
+		if err != nil {
+			return nil, err
+		}
+		af, err := src.OpenFile(ap)
+		if err != nil {
+			return nil, err
+		}
+		defer af.Close()
+		if err := db.SetTemplateAudio(dt.ID, filepath.Ext(ap), af); err != nil {
+			return nil, err
+		}
+	}
+	return &dt, nil
+}
@@ -0,0 +1,615 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+	"tailscale.com/tailcfg"
+)
+
+// Moderation.
+//
+// Any user can report a macro or template they think is inappropriate.
+// Reports go into a queue that moderators can review, with a blurred,
+// low-resolution preview of each item so they can triage without viewing the
+// content in full. Each decision is recorded, with its reason, in the audit
+// log.
+//
+// Server admins are moderators, and can make other users moderators, either
+// with the admin API or with the tmemes:moderate grant in the tailnet policy.
+// Moderators who are not admins can resolve reports and hide macros, but not
+// delete content, lock macros, or freeze their votes.
+
+// previewSize is the maximum width or height in pixels of a moderation
+// preview image. It is small enough that details (and text) are not legible.
+const previewSize = 24
+
+// serveAPIReport implements reporting content for moderation.
+//
+// API: POST /api/report/:kind/:id
+// API: POST /api/report/:id        -- report a macro
+//
+// The kind must be "macro" or "template". The payload must be a JSON object
+// with a "reason" field. On success, the new tmemes.Report is written back.
+func (s *tmemeServer) serveAPIReport(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-report", 1)
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkAccess(w, r, "report content")
+	if whois == nil {
+		return // error already sent
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/report/")
+	if !strings.Contains(path, "/") {
+		path = "macro/" + path
+	}
+	kind, id, err := parseKindID(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkTarget(kind, id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, "missing reason", http.StatusBadRequest)
+		return
+	}
+	rpt := &tmemes.Report{
+		Kind:     kind,
+		TargetID: id,
+		Reporter: whois.UserProfile.ID,
+		Reason:   strings.TrimSpace(req.Reason),
+	}
+	if err := s.db.AddReport(rpt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rpt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// queuedReport is the representation of a report in the moderation queue.
+type queuedReport struct {
+	*tmemes.Report
+	PreviewURL string `json:"previewURL"`
+}
+
+func newQueuedReport(r *tmemes.Report) queuedReport {
+	return queuedReport{
+		Report:     r,
+		PreviewURL: fmt.Sprintf("/content/preview/%s/%d", r.Kind, r.TargetID),
+	}
+}
+
+// serveAPIModeration implements the moderation queue. Only moderators can use
+// these methods.
+//
+// API: GET /api/moderation      -- list reports awaiting review
+// API: POST /api/moderation/:id -- resolve a report by ID
+//
+// The POST payload must be a JSON object with "action" and "reason" fields.
+// The action "dismiss" leaves the reported item alone; "hide" hides it; and
+// "delete", which only admins can use, deletes a macro, or hides a template,
+// as the template delete API does. For compatibility, "remove" is "delete"
+// for admins and "hide" for other moderators. Either way, the decision is recorded in the audit log and written back to
+// the caller as a tmemes.AuditEntry.
+func (s *tmemeServer) serveAPIModeration(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-moderation", 1)
+	whois := s.checkModerator(w, r, "moderate content")
+	if whois == nil {
+		return // error already sent
+	}
+	var rsp any
+	switch r.Method {
+	case "GET":
+		reports, err := s.db.Reports()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		queue := []queuedReport{}
+		for _, rpt := range reports {
+			queue = append(queue, newQueuedReport(rpt))
+		}
+		rsp = struct {
+			R []queuedReport `json:"reports"`
+		}{R: queue}
+
+	case "POST":
+		rpt, ok, err := getSingleFromIDInPath(r.URL.Path, "api/moderation", s.db.Report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if !ok {
+			http.Error(w, "missing report ID", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Action string `json:"action"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if strings.TrimSpace(req.Reason) == "" {
+			http.Error(w, "missing reason", http.StatusBadRequest)
+			return
+		}
+		e := &tmemes.AuditEntry{
+			Actor:    whois.UserProfile.ID,
+			Kind:     rpt.Kind,
+			TargetID: rpt.TargetID,
+			Reason:   strings.TrimSpace(req.Reason),
+		}
+		switch req.Action {
+		case "dismiss":
+			e.Action = "dismiss-report"
+		case "hide":
+			e.Action = "hide-" + rpt.Kind
+			if err := s.removeTarget(rpt.Kind, rpt.TargetID, false); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "delete":
+			if !s.isAdmin(whois) {
+				http.Error(w, "only admins can delete content", http.StatusForbidden)
+				return
+			}
+			e.Action = "remove-" + rpt.Kind
+			if err := s.removeTarget(rpt.Kind, rpt.TargetID, true); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "remove":
+			canDelete := s.isAdmin(whois)
+			e.Action = "remove-" + rpt.Kind
+			if rpt.Kind == "macro" && !canDelete {
+				e.Action = "hide-macro"
+			}
+			if err := s.removeTarget(rpt.Kind, rpt.TargetID, canDelete); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, fmt.Sprintf("unknown action %q", req.Action), http.StatusBadRequest)
+			return
+		}
+		if err := s.db.ResolveReport(rpt.ID, e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rsp = e
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// macroFlagActions maps the actions of serveAPIAdminMacro to the store method
+// that sets the corresponding flag, and the audit log actions for setting and
+// clearing it.
+var macroFlagActions = map[string]struct {
+	set     func(*store.DB, int, bool) (*tmemes.Macro, error)
+	on, off string
+}{
+	"hide":         {(*store.DB).SetMacroHidden, "hide-macro", "unhide-macro"},
+	"lock":         {(*store.DB).SetMacroLocked, "lock-macro", "unlock-macro"},
+	"freeze-votes": {(*store.DB).SetMacroVotesFrozen, "freeze-votes", "unfreeze-votes"},
+}
+
+// serveAPIAdminMacro implements moderating a macro without deleting it.
+// Moderators can hide macros; only server admins can lock them or freeze
+// their votes.
+//
+// API: POST /api/admin/macro/:id/hide         -- hide the macro from users
+// API: POST /api/admin/macro/:id/lock         -- forbid changes by its creator
+// API: POST /api/admin/macro/:id/freeze-votes -- forbid changes to its votes
+//
+// DELETE on the same paths clears the flag again. The payload may be a JSON
+// object with a "reason" field to record in the audit log. On success, the
+// updated macro is written back to the caller.
+func (s *tmemeServer) serveAPIAdminMacro(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-macro", 1)
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkModerator(w, r, "moderate content")
+	if whois == nil {
+		return // error already sent
+	}
+	idStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/admin/macro/"), "/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "invalid macro ID", http.StatusBadRequest)
+		return
+	}
+	fa, ok := macroFlagActions[action]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown action %q", action), http.StatusBadRequest)
+		return
+	} else if action != "hide" && !s.isAdmin(whois) {
+		http.Error(w, "permission denied", http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	on := r.Method == "POST"
+	m, err := fa.set(s.db, id, on)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	e := &tmemes.AuditEntry{
+		Actor:    whois.UserProfile.ID,
+		Action:   fa.off,
+		Kind:     "macro",
+		TargetID: m.ID,
+		Reason:   strings.TrimSpace(req.Reason),
+	}
+	if on {
+		e.Action = fa.on
+	}
+	if err := s.db.AddAuditEntry(e); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// moderatorEntry is the representation of a moderator by
+// serveAPIAdminModerators.
+type moderatorEntry struct {
+	*tmemes.Moderator
+	Name string `json:"name,omitempty"`
+}
+
+// serveAPIAdminModerators implements managing the users who can moderate
+// content besides server admins. Only server admins can use these methods.
+//
+// API: GET /api/admin/moderators             -- list moderators
+// API: POST /api/admin/moderators            -- add a moderator
+// API: DELETE /api/admin/moderators/:userID  -- remove a moderator
+//
+// The list is {"moderators":[...]}, each a tmemes.Moderator with the "name" of
+// the user. The POST payload must be a JSON object with the "login" name of a
+// user of the tailnet, and optionally a "reason" to record in the audit log;
+// on success, the new tmemes.Moderator is written back to the caller. Users
+// granted tmemes:moderate by the tailnet policy are not listed.
+func (s *tmemeServer) serveAPIAdminModerators(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-moderators", 1)
+	whois := s.checkAdmin(w, r, "manage moderators")
+	if whois == nil {
+		return // error already sent
+	}
+	var rsp any
+	switch r.Method {
+	case "GET":
+		mods, err := s.db.Moderators()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list := []moderatorEntry{}
+		for _, m := range mods {
+			list = append(list, moderatorEntry{
+				Moderator: m,
+				Name:      s.userDisplayName(r.Context(), m.UserID, time.Time{}),
+			})
+		}
+		rsp = struct {
+			M []moderatorEntry `json:"moderators"`
+		}{M: list}
+
+	case "POST":
+		var req struct {
+			Login  string `json:"login"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if req.Login == "" {
+			http.Error(w, "missing login of moderator", http.StatusBadRequest)
+			return
+		}
+		up, err := s.userFromLogin(r.Context(), req.Login)
+		if errors.Is(err, errNotFound) {
+			http.Error(w, fmt.Sprintf("unknown user %q", req.Login), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m := &tmemes.Moderator{
+			UserID:  up.ID,
+			AddedBy: whois.UserProfile.ID,
+			AddedAt: time.Now().UTC(),
+		}
+		if err := s.db.AddModerator(m); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+			Actor:    whois.UserProfile.ID,
+			Action:   "add-moderator",
+			Kind:     "user",
+			TargetID: int(up.ID),
+			Reason:   strings.TrimSpace(req.Reason),
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rsp = m
+
+	case "DELETE":
+		idStr := strings.TrimPrefix(r.URL.Path, "/api/admin/moderators/")
+		uid, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil || uid <= 0 {
+			http.Error(w, "invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if err := s.db.RemoveModerator(tailcfg.UserID(uid)); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+			Actor:    whois.UserProfile.ID,
+			Action:   "remove-moderator",
+			Kind:     "user",
+			TargetID: int(uid),
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// canViewMacro reports whether the caller of r may see m. Hidden macros are
+// visible only to moderators.
+func (s *tmemeServer) canViewMacro(r *http.Request, m *tmemes.Macro) bool {
+	return !m.Hidden || s.userIsModerator(r.Context(), s.getCallerID(r))
+}
+
+// serveAPIAudit reports entries from the audit log, newest first. Only server
+// admins can read the audit log.
+//
+// API: GET /api/audit[?page=N&count=M]
+//
+// The result is {"entries":[...], "total":N, "isLast":bool}, where each
+// element is a JSON tmemes.AuditEntry. By default, the first page of 100
+// entries is returned.
+func (s *tmemeServer) serveAPIAudit(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-audit", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.checkAdmin(w, r, "read the audit log") == nil {
+		return // error already sent
+	}
+	count := 100
+	if v := r.FormValue("count"); v != "" {
+		var err error
+		count, err = strconv.Atoi(v)
+		if err != nil || count <= 0 {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+	}
+	page := 1
+	if v := r.FormValue("page"); v != "" {
+		var err error
+		page, err = strconv.Atoi(v)
+		if err != nil || page <= 0 {
+			http.Error(w, "invalid page", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, total, err := s.db.AuditLogPage((page-1)*count, count)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rsp := struct {
+		E []*tmemes.AuditEntry `json:"entries"`
+		N int                  `json:"total"`
+		L bool                 `json:"isLast,omitempty"`
+	}{E: entries, N: total, L: page*count >= total}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveContentPreview serves a blurred, low-resolution preview of a reported
+// item for moderators. Only moderators can fetch previews.
+//
+// API: /content/preview/:kind/:id
+func (s *tmemeServer) serveContentPreview(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("content-preview", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.checkModerator(w, r, "view previews") == nil {
+		return // error already sent
+	}
+	kind, id, err := parseKindID(strings.TrimPrefix(r.URL.Path, "/content/preview/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path, err := s.targetImagePath(kind, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	f, err := s.db.OpenFile(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, pixelate(img, previewSize)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	buf.WriteTo(w)
+}
+
+// parseKindID parses a path of the form "kind/id", where kind is "macro" or
+// "template".
+func parseKindID(path string) (string, int, error) {
+	kind, idStr, ok := strings.Cut(path, "/")
+	if !ok || (kind != "macro" && kind != "template") {
+		return "", 0, errors.New("path must be macro/:id or template/:id")
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid %s ID: %w", kind, err)
+	}
+	return kind, id, nil
+}
+
+// checkTarget reports whether the item of the given kind and ID exists.
+func (s *tmemeServer) checkTarget(kind string, id int) error {
+	if kind == "macro" {
+		_, err := s.db.Macro(id)
+		return err
+	}
+	_, err := s.db.Template(id)
+	return err
+}
+
+// removeTarget removes the item of the given kind and ID from view.  Macros
+// are deleted if canDelete is true, and otherwise hidden; templates are
+// hidden, as for the template delete API.
+func (s *tmemeServer) removeTarget(kind string, id int, canDelete bool) error {
+	if kind == "macro" {
+		if !canDelete {
+			_, err := s.db.SetMacroHidden(id, true)
+			return err
+		}
+		return s.db.DeleteMacro(id)
+	}
+	return s.db.SetTemplateHidden(id, true)
+}
+
+// targetImagePath returns the path of an image file for the item of the given
+// kind and ID, rendering a macro if it is not already cached.
+func (s *tmemeServer) targetImagePath(kind string, id int) (string, error) {
+	if kind == "template" {
+		return s.db.TemplatePath(id)
+	}
+	m, err := s.db.Macro(id)
+	if err != nil {
+		return "", err
+	}
+	path, err := s.db.CachePath(m)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if err := s.renderMacro(m, path, s.encodeSettings()); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// pixelate returns a copy of img reduced so that neither dimension exceeds
+// size pixels, with each output pixel the average color of the region of img
+// it covers.
+func pixelate(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	if b.Empty() {
+		return image.NewRGBA(image.Rect(0, 0, 1, 1))
+	}
+	w, h := size, size
+	if b.Dx() > b.Dy() {
+		h = max(1, size*b.Dy()/b.Dx())
+	} else {
+		w = max(1, size*b.Dx()/b.Dy())
+	}
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var sr, sg, sb, n uint64
+			for py := y0; py < max(y1, y0+1); py++ {
+				for px := x0; px < max(x1, x0+1); px++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sr, sg, sb = sr+uint64(r), sg+uint64(g), sb+uint64(b)
+					n++
+				}
+			}
+			out.Set(x, y, color.RGBA64{
+				R: uint16(sr / n), G: uint16(sg / n), B: uint16(sb / n), A: 0xffff,
+			})
+		}
+	}
+	return out
+}
@@ -0,0 +1,217 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+)
+
+// NSFW content.
+//
+// Templates and macros may be marked NSFW (not safe for work) by their
+// creators or by server admins. The content endpoints serve the images of
+// such templates, and of macros that are marked or made from marked
+// templates, as blurred previews unless the request has ?reveal=1. Like the
+// previews shown to moderators, these are reduced to a few pixels, which
+// browsers blur when they scale them up to the size of the image. The preview
+// of a macro is that of its template, since its caption would not be legible
+// anyway.
+//
+// Marking an image does not recall copies that browsers have already cached.
+
+// blurCacheTime is how long clients may cache a blurred preview. It is short,
+// since the flag may be cleared and the same URL then serves the image.
+const blurCacheTime = 10 * time.Minute
+
+// wantsReveal reports whether r asks to see an image marked NSFW.
+func wantsReveal(r *http.Request) bool {
+	ok, _ := strconv.ParseBool(r.FormValue("reveal"))
+	return ok
+}
+
+// isNSFW reports whether macro m, on template t, is to be served blurred.
+func isNSFW(m *tmemes.Macro, t *tmemes.Template) bool {
+	return m.NSFW || t.NSFW
+}
+
+// revealURL returns imageURL with the parameter that asks to see an image
+// marked NSFW.
+func revealURL(imageURL string) string {
+	if strings.Contains(imageURL, "?") {
+		return imageURL + "&reveal=1"
+	}
+	return imageURL + "?reveal=1"
+}
+
+// serveBlurred serves a blurred preview of the image of t, in place of an
+// image marked NSFW. For an animated template, it is a preview of the first
+// frame.
+func (s *tmemeServer) serveBlurred(w http.ResponseWriter, r *http.Request, t *tmemes.Template) {
+	serveMetrics.Add("content-blurred", 1)
+	f, err := s.openTemplateImage(t.ID)
+	if err != nil {
+		writeRenderError(w, err)
+		return
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, pixelate(img, previewSize)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", cacheControl(blurCacheTime, false))
+	buf.WriteTo(w)
+}
+
+// serveAPIMacroNSFW reports or changes whether a macro is marked NSFW. Only
+// the creator of a macro or a server admin can change it; as with editing,
+// only admins can change a locked macro.
+//
+// API: GET /api/macro/:id/nsfw
+// API: PUT /api/macro/:id/nsfw
+//
+// The PUT body is {"nsfw":true} or {"nsfw":false}. Both methods report
+// {"nsfw":bool, "template":bool}, where template is whether the template of
+// the macro is marked, which also makes the macro blurred.
+func (s *tmemeServer) serveAPIMacroNSFW(w http.ResponseWriter, r *http.Request, path string) {
+	serveMetrics.Add("api-macro-nsfw", 1)
+	if r.Method != "GET" && r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkAccess(w, r, "edit macros")
+	if whois == nil {
+		return // error already sent
+	}
+	m, ok, err := getSingleFromIDInPath(path, "api/macro", s.db.Macro)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing macro ID", http.StatusBadRequest)
+		return
+	}
+	t, err := s.db.AnyTemplate(m.TemplateID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "PUT" {
+		isAdmin := s.isAdmin(whois)
+		if whois.UserProfile.ID != m.Creator && !isAdmin {
+			http.Error(w, "permission denied", http.StatusUnauthorized)
+			return
+		} else if m.Locked && !isAdmin {
+			http.Error(w, "macro is locked by an admin", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			NSFW bool `json:"nsfw"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.NSFW != m.NSFW {
+			m, err = s.db.SetMacroNSFW(m.ID, req.NSFW)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s.logEvent(whois.UserProfile.ID, nsfwAction(req.NSFW), "macro", m.ID)
+		}
+	}
+	writeNSFW(w, m.NSFW, t.NSFW)
+}
+
+// serveAPITemplateNSFW reports or changes whether a template is marked NSFW,
+// which also blurs the macros made from it. Only the creator of a template or
+// a server admin can change it.
+//
+// API: GET /api/template/:id/nsfw
+// API: PUT /api/template/:id/nsfw
+//
+// The PUT body is {"nsfw":true} or {"nsfw":false}. Both methods report
+// {"nsfw":bool}.
+func (s *tmemeServer) serveAPITemplateNSFW(w http.ResponseWriter, r *http.Request, path string) {
+	serveMetrics.Add("api-template-nsfw", 1)
+	if r.Method != "GET" && r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkAccess(w, r, "edit templates")
+	if whois == nil {
+		return // error already sent
+	}
+	t, ok, err := getSingleFromIDInPath(path, "api/template", s.db.Template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing template ID", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "PUT" {
+		if whois.UserProfile.ID != t.Creator && !s.isAdmin(whois) {
+			http.Error(w, "permission denied", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			NSFW bool `json:"nsfw"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.NSFW != t.NSFW {
+			t, err = s.db.SetTemplateNSFW(t.ID, req.NSFW)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s.logEvent(whois.UserProfile.ID, nsfwAction(req.NSFW), "template", t.ID)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		N bool `json:"nsfw"`
+	}{N: t.NSFW}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// nsfwAction returns the audit log action for setting the NSFW flag to nsfw.
+func nsfwAction(nsfw bool) string {
+	if nsfw {
+		return "mark-nsfw"
+	}
+	return "unmark-nsfw"
+}
+
+func writeNSFW(w http.ResponseWriter, macro, template bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		N bool `json:"nsfw"`
+		T bool `json:"template"`
+	}{N: macro, T: template}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+// Onboarding.
+//
+// The macro and template galleries guide users of a new server. A gallery
+// with nothing in it explains how to fill it: by uploading a template, or for
+// admins, by importing the --starter-pack as a subscription (see packs.go).
+// Until a user creates their first macro, the macro gallery also shows them a
+// short tour, which they can dismiss; the dismissal is kept in their
+// preferences.
+
+// starterPack is a template pack offered to admins of an empty server.
+type starterPack struct {
+	URL       string
+	PublicKey string
+}
+
+// addOnboarding fills in the onboarding fields of data, for a gallery page
+// shown to data.CallerID.
+func (s *tmemeServer) addOnboarding(data *uiData) {
+	caller := data.CallerID
+	data.ShowTour = caller > 0 && !s.db.UserPrefs(caller).DismissedTour &&
+		len(s.db.MacrosByCreator(caller)) == 0
+	data.NoTemplates = len(s.db.Templates()) == 0
+	if data.NoTemplates && data.CallerIsAdmin {
+		data.StarterPack = &starterPack{URL: *starterPackURL, PublicKey: *starterPackKey}
+	}
+}
@@ -0,0 +1,543 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+	"golang.org/x/exp/slices"
+)
+
+// Template packs.
+//
+// An admin can publish a named set of templates as a pack. Anyone who can
+// reach the server can download the pack from /api/pack/:name, as a gzipped
+// tar file containing a manifest, a signature of the manifest, and the
+// template images. Packs are signed with an Ed25519 key generated on first use
+// and persisted in the store; GET /api/pack reports its public key.
+//
+// An admin of another server can subscribe to the URL of a pack, giving the
+// public key of its publisher. The subscribing server periodically fetches the
+// pack, checks the signature, and copies any templates it does not already
+// have (as anonymous templates). Templates it has copied before have their
+// text areas updated to match the pack. Templates removed from the pack are
+// kept.
+
+const (
+	packKeyMeta      = "packKey"
+	packManifestName = "pack.json"
+	packSigName      = "pack.sig"
+	maxPackBytes     = 256 << 20
+	packFetchTimeout = 5 * time.Minute
+)
+
+// A packManifest describes the contents of a pack file.
+type packManifest struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	PublicKey   string         `json:"publicKey"` // hex-encoded Ed25519
+	CreatedAt   time.Time      `json:"createdAt"`
+	Templates   []packTemplate `json:"templates"`
+}
+
+// A packTemplate describes one template in a pack.
+type packTemplate struct {
+	Name   string        `json:"name"`
+	File   string        `json:"file"`   // name of the image in the pack
+	SHA256 string        `json:"sha256"` // hex digest of the image
+	Areas  []tmemes.Area `json:"areas,omitempty"`
+}
+
+// loadPackKey loads the signing key for template packs from the store, or
+// generates and stores a new one if none exists.
+func (s *tmemeServer) loadPackKey() error {
+	seed, err := s.db.GetMeta(packKeyMeta)
+	if err != nil {
+		return err
+	}
+	if seed == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		seed = key.Seed()
+		if err := s.db.SetMeta(packKeyMeta, seed); err != nil {
+			return err
+		}
+		log.Print("Generated new signing key for template packs")
+	} else if len(seed) != ed25519.SeedSize {
+		return errors.New("invalid template pack signing key")
+	}
+	s.packKey = ed25519.NewKeyFromSeed(seed)
+	return nil
+}
+
+// packPublicKey returns the hex-encoded public key that packs from this server
+// are signed with.
+func (s *tmemeServer) packPublicKey() string {
+	return hex.EncodeToString(s.packKey.Public().(ed25519.PublicKey))
+}
+
+// writePack writes pack p to w as a signed pack file.
+func (s *tmemeServer) writePack(w io.Writer, p *tmemes.TemplatePack) error {
+	man := packManifest{
+		Name:        p.Name,
+		Description: p.Description,
+		PublicKey:   s.packPublicKey(),
+		CreatedAt:   time.Now().UTC(),
+	}
+	var files []string // local paths, parallel to man.Templates
+	for _, id := range p.Templates {
+		t, err := s.db.Template(id)
+		if err != nil {
+			continue // deleted or hidden since the pack was published
+		}
+		tp, err := s.db.TemplatePath(id)
+		if err != nil {
+			return err
+		}
+		f, err := s.db.OpenFile(tp)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("hashing template %d: %w", id, err)
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+		man.Templates = append(man.Templates, packTemplate{
+			Name:   t.Name,
+			File:   sum + filepath.Ext(tp),
+			SHA256: sum,
+			Areas:  t.Areas,
+		})
+		files = append(files, tp)
+	}
+	bits, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	addBytes := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: man.CreatedAt,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := addBytes(packManifestName, bits); err != nil {
+		return err
+	}
+	if err := addBytes(packSigName, ed25519.Sign(s.packKey, bits)); err != nil {
+		return err
+	}
+	for i, pt := range man.Templates {
+		data, err := s.db.ReadFile(files[i])
+		if err != nil {
+			return err
+		}
+		if err := addBytes(pt.File, data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readPack reads a pack file from r and checks that it is signed with pub and
+// that its images match the manifest. It returns the manifest and the image
+// data, keyed by file name.
+func readPack(r io.Reader, pub ed25519.PublicKey) (*packManifest, map[string][]byte, error) {
+	gz, err := gzip.NewReader(io.LimitReader(r, maxPackBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		} else if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		total += hdr.Size
+		if total > maxPackBytes {
+			return nil, nil, errors.New("pack is too large")
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		files[hdr.Name] = data
+	}
+
+	bits, sig := files[packManifestName], files[packSigName]
+	if bits == nil || sig == nil {
+		return nil, nil, errors.New("pack has no signed manifest")
+	} else if !ed25519.Verify(pub, bits, sig) {
+		return nil, nil, errors.New("pack signature is not valid for the publisher key")
+	}
+	var man packManifest
+	if err := json.Unmarshal(bits, &man); err != nil {
+		return nil, nil, fmt.Errorf("invalid pack manifest: %w", err)
+	}
+	for _, pt := range man.Templates {
+		data, ok := files[pt.File]
+		if !ok {
+			return nil, nil, fmt.Errorf("pack is missing %q", pt.File)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != pt.SHA256 {
+			return nil, nil, fmt.Errorf("pack file %q does not match its digest", pt.File)
+		}
+	}
+	return &man, files, nil
+}
+
+// syncPack fetches the pack for sub, and copies its new templates into the
+// store. It updates sub with the result (including any error), and saves it.
+func (s *tmemeServer) syncPack(ctx context.Context, sub *tmemes.PackSubscription) (added int, err error) {
+	s.packSyncMu.Lock()
+	defer s.packSyncMu.Unlock()
+	defer func() {
+		if err != nil {
+			sub.LastError = err.Error()
+		} else {
+			sub.LastError = ""
+			sub.LastSync = time.Now().UTC()
+		}
+		if serr := s.db.SetPackSubscription(sub); serr != nil && err == nil {
+			err = serr
+		}
+	}()
+
+	pub, err := hex.DecodeString(sub.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return 0, errors.New("invalid publisher key")
+	}
+	ctx, cancel := context.WithTimeout(ctx, packFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", sub.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	rsp, err := s.srv.HTTPClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetching pack: %s", rsp.Status)
+	}
+	man, files, err := readPack(rsp.Body, pub)
+	if err != nil {
+		return 0, err
+	}
+
+	sub.Name = man.Name
+	if sub.Templates == nil {
+		sub.Templates = make(map[string]int)
+	}
+	var errs []error
+	for _, pt := range man.Templates {
+		if id, ok := sub.Templates[pt.SHA256]; ok {
+			if t, err := s.db.AnyTemplate(id); err == nil {
+				if !slices.Equal(t.Areas, pt.Areas) {
+					if err := checkPackAreas(pt.Areas); err != nil {
+						errs = append(errs, fmt.Errorf("template %q: %w", pt.Name, err))
+					} else if _, err := s.db.SetTemplateAreas(id, pt.Areas); err != nil {
+						errs = append(errs, fmt.Errorf("template %q: %w", pt.Name, err))
+					}
+				}
+				continue
+			}
+		}
+		if _, err := s.db.TemplateByContentHash(pt.SHA256); err == nil {
+			continue // this server already has the image as its own template
+		}
+		id, err := s.addPackTemplate(pt, files[pt.File])
+		var dup *store.DuplicateTemplateError
+		if errors.As(err, &dup) {
+			continue // likewise, after conversion
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("template %q: %w", pt.Name, err))
+			continue
+		}
+		sub.Templates[pt.SHA256] = id
+		added++
+	}
+	return added, errors.Join(errs...)
+}
+
+// addPackTemplate adds an anonymous template to the store from pt, whose
+// image is data. If the name of pt is already in use, a numeric suffix is
+// added to make it unique.
+func (s *tmemeServer) addPackTemplate(pt packTemplate, data []byte) (int, error) {
+	t := &tmemes.Template{Name: pt.Name, Creator: -1}
+	for i := 2; ; i++ {
+		if _, err := s.db.TemplateByName(t.Name); err != nil {
+			break // name is available
+		}
+		t.Name = fmt.Sprintf("%s-%d", pt.Name, i)
+	}
+	if err := checkPackAreas(pt.Areas); err != nil {
+		return 0, err
+	}
+	t.Areas = pt.Areas
+	img, ext, err := s.checkTemplateImage(t, pt.File, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	if err := s.addTemplate(t, ext, img); err != nil {
+		return 0, err
+	}
+	return t.ID, nil
+}
+
+// checkPackAreas reports whether areas are valid as the predefined text areas
+// of a template copied from a pack.
+func checkPackAreas(areas []tmemes.Area) error {
+	if len(areas) > tmemes.MaxTemplateAreas {
+		return fmt.Errorf("too many areas (max %d)", tmemes.MaxTemplateAreas)
+	}
+	for _, a := range areas {
+		if err := a.ValidForTemplate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncPacksPeriodically syncs all pack subscriptions at the given interval.
+func (s *tmemeServer) syncPacksPeriodically(interval time.Duration) {
+	log.Printf("Starting template pack sync (poll=%v)", interval)
+	for {
+		subs, err := s.db.PackSubscriptions()
+		if err != nil {
+			log.Printf("[packs] listing subscriptions: %v", err)
+		}
+		for _, sub := range subs {
+			added, err := s.syncPack(context.Background(), sub)
+			if err != nil {
+				log.Printf("[packs] syncing %q: %v", sub.URL, err)
+			} else if added > 0 {
+				log.Printf("[packs] added %d templates from %q", added, sub.URL)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// serveAPIPack implements publishing and downloading template packs.
+//
+// API: GET /api/pack              -- list published packs
+// API: GET /api/pack/:name        -- download a pack file
+// API: PUT /api/pack/:name        -- publish or update a pack (admin)
+// API: DELETE /api/pack/:name     -- stop publishing a pack (admin)
+//
+// The list is {"publicKey":"...", "packs":[...]}. The PUT payload is
+// {"description":"...", "templates":[id, ...]}.
+func (s *tmemeServer) serveAPIPack(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-pack", 1)
+	name, _ := url.PathUnescape(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/pack"), "/"))
+	if name == "" {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		packs, err := s.db.TemplatePacks()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rsp := struct {
+			K string                 `json:"publicKey"`
+			P []*tmemes.TemplatePack `json:"packs"`
+		}{K: s.packPublicKey(), P: packs}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rsp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		p, err := s.db.TemplatePack(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		var buf bytes.Buffer
+		if err := s.writePack(&buf, p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(name)+".tmemes-pack"))
+		buf.WriteTo(w)
+
+	case "PUT":
+		if s.checkAdmin(w, r, "publish template packs") == nil {
+			return // error already sent
+		}
+		var req struct {
+			Description string `json:"description"`
+			Templates   []int  `json:"templates"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if len(req.Templates) == 0 {
+			http.Error(w, "pack must have templates", http.StatusBadRequest)
+			return
+		}
+		for _, id := range req.Templates {
+			if _, err := s.db.Template(id); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		p := &tmemes.TemplatePack{
+			Name:        name,
+			Description: req.Description,
+			Templates:   req.Templates,
+			UpdatedAt:   time.Now().UTC(),
+		}
+		if err := s.db.SetTemplatePack(p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case "DELETE":
+		if s.checkAdmin(w, r, "delete template packs") == nil {
+			return // error already sent
+		}
+		if err := s.db.DeleteTemplatePack(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveAPIAdminSubscriptions implements managing subscriptions to template
+// packs published by other servers. Admin only.
+//
+// API: GET /api/admin/subscriptions          -- list subscriptions
+// API: POST /api/admin/subscriptions         -- subscribe and sync now
+// API: DELETE /api/admin/subscriptions?url=  -- unsubscribe
+//
+// The POST payload is {"url":"...", "publicKey":"..."}, where the key is the
+// hex-encoded public key reported by GET /api/pack on the publishing server.
+// Subscribing to a URL again re-syncs it.
+func (s *tmemeServer) serveAPIAdminSubscriptions(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-subscriptions", 1)
+	if s.checkAdmin(w, r, "manage pack subscriptions") == nil {
+		return // error already sent
+	}
+	var rsp any
+	switch r.Method {
+	case "GET":
+		subs, err := s.db.PackSubscriptions()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rsp = struct {
+			S []*tmemes.PackSubscription `json:"subscriptions"`
+		}{S: subs}
+
+	case "POST":
+		var req struct {
+			URL       string `json:"url"`
+			PublicKey string `json:"publicKey"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			http.Error(w, "invalid pack URL", http.StatusBadRequest)
+			return
+		}
+		sub := &tmemes.PackSubscription{URL: req.URL, PublicKey: strings.ToLower(req.PublicKey)}
+		if subs, err := s.db.PackSubscriptions(); err == nil {
+			for _, old := range subs {
+				if old.URL == sub.URL && old.PublicKey == sub.PublicKey {
+					sub = old // keep track of templates already copied
+				}
+			}
+		}
+		added, err := s.syncPack(r.Context(), sub)
+		rsp = struct {
+			S *tmemes.PackSubscription `json:"subscription"`
+			N int                      `json:"added"`
+		}{S: sub, N: added}
+		if err != nil && sub.LastSync.IsZero() {
+			// Keep the subscription, so its error can be seen and the next
+			// periodic sync can retry, but report the failure.
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+	case "DELETE":
+		if err := s.db.DeletePackSubscription(r.FormValue("url")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
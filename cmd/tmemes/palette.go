@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/tailscale/tmemes"
+)
+
+// Palette presets.
+//
+// The create UI offers a choice of colors for text and its outline, grouped
+// into named presets. The server has a default set of presets, which the
+// operator can replace with the --palette flag, e.g., to add brand colors. The
+// file must contain a JSON array of presets of the form
+//
+//	{"name":"Brand", "colors":["#1f1f1f", "rgb(240 240 240)", "tomato"]}
+//
+// where each color is in any syntax accepted for text lines (see tmemes.Color).
+
+// A palettePreset is a named group of colors offered in the create UI.
+type palettePreset struct {
+	Name   string         `json:"name"`
+	Colors []tmemes.Color `json:"colors"`
+}
+
+// defaultPalette is the palette offered if the --palette flag is not set.
+var defaultPalette = []palettePreset{
+	{Name: "Classic", Colors: mustColors("white", "black")},
+	{Name: "Bright", Colors: mustColors("yellow", "orange", "red", "deeppink", "lime", "aqua", "dodgerblue")},
+	{Name: "Pastel", Colors: mustColors("lightpink", "peachpuff", "lemonchiffon", "palegreen", "lightblue", "thistle")},
+	{Name: "Dark", Colors: mustColors("maroon", "darkgreen", "navy", "indigo", "darkslategray")},
+}
+
+func mustColors(names ...string) []tmemes.Color {
+	out := make([]tmemes.Color, len(names))
+	for i, n := range names {
+		out[i] = tmemes.MustColor(n)
+	}
+	return out
+}
+
+// loadPalette reads a list of palette presets from the JSON file at path.
+func loadPalette(path string) ([]palettePreset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ps []palettePreset
+	if err := json.Unmarshal(data, &ps); err != nil {
+		return nil, err
+	} else if len(ps) == 0 {
+		return nil, errors.New("no presets defined")
+	}
+	for i, p := range ps {
+		if p.Name == "" {
+			return nil, fmt.Errorf("preset %d has no name", i+1)
+		} else if len(p.Colors) == 0 {
+			return nil, fmt.Errorf("preset %q has no colors", p.Name)
+		}
+	}
+	return ps, nil
+}
+
+// serveAPIPalette reports the palette presets offered for text lines.
+//
+// API: GET /api/palette
+//
+// The result is {"presets":[{"name":"...", "colors":["white", ...]}, ...]}.
+func (s *tmemeServer) serveAPIPalette(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-palette", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ps := s.palette
+	if ps == nil {
+		ps = defaultPalette
+	}
+	rsp := struct {
+		P []palettePreset `json:"presets"`
+	}{P: ps}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/tailcfg"
+)
+
+// serveAPIPrefs implements reading and updating the caller's preferences.
+//
+// API: GET /api/prefs -- get the caller's preferences
+// API: PUT /api/prefs -- replace the caller's preferences
+//
+// The PUT payload must be a JSON tmemes.UserPrefs. Either way, the caller's
+// current preferences are written back as a JSON tmemes.UserPrefs.
+func (s *tmemeServer) serveAPIPrefs(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-prefs", 1)
+	whois := s.checkAccess(w, r, "have preferences")
+	if whois == nil {
+		return // error already sent
+	}
+	uid := whois.UserProfile.ID
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var p tmemes.UserPrefs
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.Valid(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.db.SetUserPrefs(uid, &p); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.db.UserPrefs(uid)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAPIHandleReset clears the display handle of a user, for example if it
+// is abusive. Only server admins can reset handles, and each reset is
+// recorded in the audit log.
+//
+// API: DELETE /api/handle/:userID
+//
+// The payload may be a JSON object with a "reason" field to record.
+func (s *tmemeServer) serveAPIHandleReset(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-handle", 1)
+	if r.Method != "DELETE" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkAdmin(w, r, "reset handles")
+	if whois == nil {
+		return // error already sent
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/handle/"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+	uid := tailcfg.UserID(id)
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	p := s.db.UserPrefs(uid)
+	if p.Handle == "" {
+		http.Error(w, "user has no handle", http.StatusNotFound)
+		return
+	}
+	old := p.Handle
+	p.Handle = ""
+	if err := s.db.SetUserPrefs(uid, p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := &tmemes.AuditEntry{
+		Actor:    whois.UserProfile.ID,
+		Action:   "reset-handle",
+		Kind:     "user",
+		TargetID: int(uid),
+		Reason:   strings.TrimSpace(req.Reason + " (was " + strconv.Quote(old) + ")"),
+	}
+	if err := s.db.AddAuditEntry(e); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
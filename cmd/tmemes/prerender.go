@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+)
+
+// Background pre-rendering.
+//
+// Rendering a macro on a large GIF template can take seconds, which would
+// otherwise be spent by whoever views it first, usually right after it is
+// created. Instead, a small pool of workers watches for new macros and
+// renders them into the cache. Rendering goes through renderMacro, so a
+// viewer who arrives while a macro is being rendered waits for the same
+// work rather than repeating it. New macros are queued in the workers'
+// event subscription; if they fall behind and it fills up, the macros that
+// do not fit are rendered on demand as before.
+
+// startPrerendering starts n workers to pre-render new macros. If n <= 0,
+// macros are only rendered when they are first viewed.
+func (s *tmemeServer) startPrerendering(n int) {
+	if n <= 0 {
+		return
+	}
+	events, _ := s.db.Subscribe() // for the lifetime of the server
+	for range n {
+		go s.prerenderMacros(events)
+	}
+	log.Printf("Starting %d macro pre-rendering workers", n)
+}
+
+// prerenderMacros renders the macros reported as created by events until the
+// channel is closed.
+func (s *tmemeServer) prerenderMacros(events <-chan tmemes.Event) {
+	for e := range events {
+		if e.Type != "create" {
+			continue
+		}
+		start := time.Now()
+		if err := s.prerenderMacro(e.MacroID); err != nil {
+			log.Printf("pre-rendering macro %d: %v", e.MacroID, err)
+			macroMetrics.Add("prerender-failed", 1)
+			continue
+		}
+		macroMetrics.Add("prerender", 1)
+		if d := time.Since(start); d > time.Second {
+			log.Printf("Pre-rendered macro %d in %v", e.MacroID, d.Round(time.Millisecond))
+		}
+	}
+}
+
+// prerenderMacro renders the default rendering of the macro with the given
+// ID into the cache, along with each of its caption variants while a caption
+// test is running, unless they are already cached. It does nothing if the
+// macro has been deleted since it was created.
+func (s *tmemeServer) prerenderMacro(id int) error {
+	m, err := s.db.Macro(id)
+	if err != nil {
+		return nil // deleted before we got to it
+	}
+	variants := 1
+	if ct := m.CaptionTest; ct != nil && ct.Active(time.Now()) {
+		variants = len(ct.Variants)
+	}
+	for v := range variants {
+		mv := m.Variant(v)
+		cachePath, err := s.db.MacroCachePath(mv, store.CacheKey{Variant: v})
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(cachePath); err == nil {
+			continue // a viewer beat us to it
+		}
+		if err := s.renderMacro(mv, cachePath, s.encodeSettings()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
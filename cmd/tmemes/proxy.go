@@ -0,0 +1,164 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Serving behind a reverse proxy.
+//
+// Callers are normally identified by the tailnet address they connect from.
+// When the server is reached through a caching or load-balancing proxy on the
+// tailnet, every request comes from the proxy, so if the proxy's address is
+// listed in -trusted-proxies, the caller is identified by the X-Forwarded-For
+// header the proxy adds instead. The X-Forwarded-Proto and X-Forwarded-Host
+// headers of a trusted proxy are used for absolute URLs, unless -base-url
+// gives the public address of the server explicitly.
+//
+// Responses that depend on who the caller is are marked private, so that a
+// shared cache does not serve one user's view to another.
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// prefixes, such as "100.64.0.7,fd7a:115c:a1e0::/48".
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if strings.Contains(f, "/") {
+			p, err := netip.ParsePrefix(f)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(f)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return out, nil
+}
+
+// checkBaseURL reports whether s is usable as the -base-url setting, and
+// returns it without a trailing slash.
+func checkBaseURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("scheme must be http or https")
+	} else if u.Host == "" {
+		return "", errors.New("missing host")
+	} else if u.Path != "" && u.Path != "/" {
+		// Pages and redirects refer to paths from the root.
+		return "", errors.New("the server must be at the root of the URL")
+	}
+	return strings.TrimSuffix(s, "/"), nil
+}
+
+// fromTrustedProxy reports whether r was sent by a trusted proxy.
+func (s *tmemeServer) fromTrustedProxy(r *http.Request) bool {
+	if len(s.trustedProxies) == 0 {
+		return false
+	}
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	return err == nil && s.isTrustedProxy(ap.Addr())
+}
+
+func (s *tmemeServer) isTrustedProxy(a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range s.trustedProxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// callerAddr returns the address of the client that made r, to look up with
+// WhoIs. If r came from a trusted proxy, this is the last address in
+// X-Forwarded-For that is not itself a trusted proxy.
+func (s *tmemeServer) callerAddr(r *http.Request) string {
+	if !s.fromTrustedProxy(r) {
+		return r.RemoteAddr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		a, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break // don't skip past garbage to an address the client chose
+		}
+		if i == 0 || !s.isTrustedProxy(a) {
+			return a.Unmap().String()
+		}
+	}
+	return r.RemoteAddr
+}
+
+// whoIs looks up the tailnet user and node that made r.
+func (s *tmemeServer) whoIs(r *http.Request) (*apitype.WhoIsResponse, error) {
+	if whois, ok := cachedWhoIs(r); ok {
+		return whois, nil
+	}
+	return s.lc.WhoIs(r.Context(), s.callerAddr(r))
+}
+
+// absURL returns an absolute URL for path on this server. This uses
+// -base-url if it is set, or else the host that r was sent to.
+func (s *tmemeServer) absURL(r *http.Request, path string) string {
+	if *baseURL != "" {
+		return *baseURL + path
+	}
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if s.fromTrustedProxy(r) {
+		if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+			scheme = p
+		}
+		if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+			host, _, _ = strings.Cut(h, ",")
+			host = strings.TrimSpace(host)
+		}
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, path)
+}
+
+// serverBaseURL returns the base URL for links to this server in messages
+// sent outside of any request, such as digests and webhooks. This is
+// -base-url if it is set, or else a URL for the hostname of the server.
+func (s *tmemeServer) serverBaseURL() string {
+	if *baseURL != "" {
+		return *baseURL
+	}
+	if *serveHTTPS {
+		if host := s.certDomain(); host != "" {
+			return "https://" + host
+		}
+	}
+	return "http://" + *hostName
+}
+
+// privateByDefault wraps h so that its responses are marked as private to the
+// caller, unless h sets its own Cache-Control header.
+func privateByDefault(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private")
+		h.ServeHTTP(w, r)
+	})
+}
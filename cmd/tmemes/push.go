@@ -0,0 +1,354 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/tailcfg"
+)
+
+// Web Push notifications.
+//
+// Browsers subscribe via the /api/push/ endpoints, and the server sends
+// notifications to subscribed users when something happens that concerns
+// them (currently: when someone else makes a macro from their template).
+//
+// Messages are sent per RFC 8030, with payloads encrypted per RFC 8291 and
+// the server identified to push services per RFC 8292 (VAPID). The VAPID
+// signing key is generated on first use and persisted in the store.
+
+const vapidKeyMeta = "vapidKey"
+
+// pushMessage is the payload delivered to the service worker.
+type pushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url,omitempty"`
+}
+
+// loadVAPIDKey loads the VAPID signing key from the store, or generates and
+// stores a new one if none exists.
+func (s *tmemeServer) loadVAPIDKey() error {
+	der, err := s.db.GetMeta(vapidKeyMeta)
+	if err != nil {
+		return err
+	}
+	if der == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := s.db.SetMeta(vapidKeyMeta, der); err != nil {
+			return err
+		}
+		log.Print("Generated new VAPID key for push notifications")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return fmt.Errorf("parse VAPID key: %w", err)
+	}
+	ek, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("VAPID key is not ECDSA")
+	}
+	s.vapidKey = ek
+	return nil
+}
+
+// vapidPublicKey returns the uncompressed VAPID public key point, which is
+// the "applicationServerKey" browsers need to subscribe.
+func (s *tmemeServer) vapidPublicKey() []byte {
+	pub, err := s.vapidKey.PublicKey.ECDH()
+	if err != nil {
+		panic(err) // should not be possible for a P-256 key
+	}
+	return pub.Bytes()
+}
+
+func (s *tmemeServer) serveAPIPush(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-push", 1)
+	if s.vapidKey == nil {
+		http.Error(w, "push notifications are not enabled", http.StatusNotFound)
+		return
+	}
+	switch path := strings.TrimPrefix(r.URL.Path, "/api/push/"); {
+	case path == "key" && r.Method == "GET":
+		s.serveAPIPushKey(w, r)
+	case path == "subscribe" && (r.Method == "POST" || r.Method == "DELETE"):
+		s.serveAPIPushSubscribe(w, r)
+	case path == "key" || path == "subscribe":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveAPIPushKey reports the public key browsers must use to subscribe.
+//
+// API: GET /api/push/key
+func (s *tmemeServer) serveAPIPushKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rsp := struct {
+		K string `json:"publicKey"`
+	}{K: base64.RawURLEncoding.EncodeToString(s.vapidPublicKey())}
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAPIPushSubscribe adds or removes a push subscription for the caller.
+//
+// API: POST /api/push/subscribe   -- add a subscription
+// API: DELETE /api/push/subscribe -- remove a subscription
+//
+// The payload is a JSON tmemes.PushSubscription. For DELETE, only the
+// endpoint is required.
+func (s *tmemeServer) serveAPIPushSubscribe(w http.ResponseWriter, r *http.Request) {
+	whois := s.checkAccess(w, r, "subscribe to notifications")
+	if whois == nil {
+		return // error already sent
+	}
+	var sub tmemes.PushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" {
+		http.Error(w, "invalid push endpoint", http.StatusBadRequest)
+		return
+	}
+	if r.Method == "DELETE" {
+		if err := s.db.RemovePushSubscription(whois.UserProfile.ID, sub.Endpoint); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if _, _, err := decodePushKeys(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.db.AddPushSubscription(whois.UserProfile.ID, &sub); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// notifyTemplateUsed notifies the creator of the template for m that someone
+// made a new macro from it. It does nothing if push is disabled, or if the
+// template is anonymous or was used by its own creator.
+func (s *tmemeServer) notifyTemplateUsed(m *tmemes.Macro) {
+	if s.vapidKey == nil {
+		return
+	}
+	t, err := s.db.AnyTemplate(m.TemplateID)
+	if err != nil || t.Creator <= 0 || t.Creator == m.Creator {
+		return
+	}
+	byWhom := "Someone"
+	if m.Creator > 0 {
+		byWhom = s.userDisplayName(context.Background(), m.Creator, m.CreatedAt)
+	}
+	go s.sendPush(t.Creator, pushMessage{
+		Title: "Your template was used",
+		Body:  fmt.Sprintf("%s made a new macro from %q", byWhom, t.Name),
+		URL:   fmt.Sprintf("/m/%d", m.ID),
+	})
+}
+
+// sendPush delivers msg to all the push subscriptions of the given user.
+// Subscriptions the push service reports as expired are removed.
+func (s *tmemeServer) sendPush(userID tailcfg.UserID, msg pushMessage) {
+	subs, err := s.db.PushSubscriptions(userID)
+	if err != nil {
+		log.Printf("[push] listing subscriptions for user %d: %v", userID, err)
+		return
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		panic(err) // should not be possible
+	}
+	for _, sub := range subs {
+		status, err := s.sendPushMessage(sub, payload)
+		if err != nil {
+			log.Printf("[push] sending to user %d: %v", userID, err)
+			continue
+		}
+		pushMetrics.Add(fmt.Sprintf("status-%d", status), 1)
+		if status == http.StatusNotFound || status == http.StatusGone {
+			if err := s.db.RemovePushSubscription(0, sub.Endpoint); err != nil {
+				log.Printf("[push] removing expired subscription: %v", err)
+			}
+		}
+	}
+}
+
+// sendPushMessage encrypts payload for sub and posts it to the push service.
+// It returns the HTTP status reported by the push service.
+func (s *tmemeServer) sendPushMessage(sub *tmemes.PushSubscription, payload []byte) (int, error) {
+	body, err := encryptPushPayload(sub, payload)
+	if err != nil {
+		return 0, err
+	}
+	jwt, err := s.vapidJWT(sub.Endpoint)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", "86400")
+	req.Header.Set("Urgency", "normal")
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s",
+		jwt, base64.RawURLEncoding.EncodeToString(s.vapidPublicKey())))
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	rsp.Body.Close()
+	return rsp.StatusCode, nil
+}
+
+// vapidJWT constructs a signed VAPID token (RFC 8292) for a push endpoint.
+func (s *tmemeServer) vapidJWT(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": *webPushContact,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, sig, err := ecdsa.Sign(rand.Reader, s.vapidKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	var rs [64]byte
+	r.FillBytes(rs[:32])
+	sig.FillBytes(rs[32:])
+	return signed + "." + enc.EncodeToString(rs[:]), nil
+}
+
+// decodePushKeys decodes and checks the client keys of sub.
+func decodePushKeys(sub *tmemes.PushSubscription) (*ecdh.PublicKey, []byte, error) {
+	dec := func(s string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	pubBytes, err := dec(sub.Keys.P256DH)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	pub, err := ecdh.P256().NewPublicKey(pubBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	auth, err := dec(sub.Keys.Auth)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid auth secret: %w", err)
+	} else if len(auth) != 16 {
+		return nil, nil, errors.New("invalid auth secret length")
+	}
+	return pub, auth, nil
+}
+
+// encryptPushPayload encrypts payload for delivery to sub using the
+// "aes128gcm" content coding of RFC 8188, keyed as described by RFC 8291.
+// The result is a single record including the coding header.
+func encryptPushPayload(sub *tmemes.PushSubscription, payload []byte) ([]byte, error) {
+	uaPub, authSecret, err := decodePushKeys(sub)
+	if err != nil {
+		return nil, err
+	}
+	asPriv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := asPriv.ECDH(uaPub)
+	if err != nil {
+		return nil, err
+	}
+	asPub := asPriv.PublicKey().Bytes()
+
+	// Combine the ECDH secret with the authentication secret (RFC 8291 §3.3).
+	keyInfo := append([]byte("WebPush: info\x00"), uaPub.Bytes()...)
+	keyInfo = append(keyInfo, asPub...)
+	ikm := hkdf(authSecret, secret, keyInfo, 32)
+
+	// Derive the content encryption key and nonce (RFC 8188 §2.2, §2.3).
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The header is salt, record size, key ID length, and key ID (our public
+	// key). The payload is followed by a delimiter marking the last record.
+	const recordSize = 4096
+	out := append([]byte(nil), salt...)
+	out = binary.BigEndian.AppendUint32(out, recordSize)
+	out = append(out, byte(len(asPub)))
+	out = append(out, asPub...)
+	plain := append(append([]byte(nil), payload...), 2)
+	return gcm.Seal(out, nonce, plain, nil), nil
+}
+
+// hkdf computes HKDF-SHA256 (RFC 5869) with the given salt, input keying
+// material, and info, returning n ≤ 32 bytes of output.
+func hkdf(salt, ikm, info []byte, n int) []byte {
+	ext := hmac.New(sha256.New, salt)
+	ext.Write(ikm)
+	prk := ext.Sum(nil)
+
+	exp := hmac.New(sha256.New, prk)
+	exp.Write(info)
+	exp.Write([]byte{1})
+	return exp.Sum(nil)[:n]
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"tailscale.com/tailcfg"
+)
+
+// maxIdleLimiters is the number of per-user limiters a userLimiter keeps
+// before it discards those whose buckets have refilled.
+const maxIdleLimiters = 1000
+
+// parseRateLimit parses a rate limit of the form "N/duration", for example
+// "30/1m", meaning N actions per duration.
+func parseRateLimit(s string) (n int, per time.Duration, err error) {
+	ns, ds, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, errors.New(`rate limit must have the form "N/duration"`)
+	}
+	n, err = strconv.Atoi(ns)
+	if err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit count %q", ns)
+	}
+	per, err = time.ParseDuration(ds)
+	if err != nil || per <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit duration %q", ds)
+	}
+	return n, per, nil
+}
+
+// userLimiter is a token-bucket rate limiter keyed by user. Each user gets a
+// bucket of burst tokens, refilled at a steady rate. A nil *userLimiter
+// allows everything.
+type userLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu    sync.Mutex
+	users map[tailcfg.UserID]*rate.Limiter
+}
+
+// newUserLimiter constructs a userLimiter that allows each user n actions per
+// interval, in bursts of up to n.
+func newUserLimiter(n int, per time.Duration) *userLimiter {
+	return &userLimiter{
+		limit: rate.Limit(float64(n) / per.Seconds()),
+		burst: n,
+		users: make(map[tailcfg.UserID]*rate.Limiter),
+	}
+}
+
+// allow reports whether the specified user may perform an action now, and
+// consumes a token if so. Otherwise, it returns how long the user must wait
+// before trying again.
+func (l *userLimiter) allow(uid tailcfg.UserID) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lim, ok := l.users[uid]
+	if !ok {
+		if len(l.users) >= maxIdleLimiters {
+			l.pruneLocked()
+		}
+		lim = rate.NewLimiter(l.limit, l.burst)
+		l.users[uid] = lim
+	}
+	r := lim.Reserve()
+	if d := r.Delay(); d > 0 {
+		r.Cancel()
+		return d, false
+	}
+	return 0, true
+}
+
+// pruneLocked discards the limiters of users whose buckets are full, since
+// they are equivalent to new ones.
+func (l *userLimiter) pruneLocked() {
+	for uid, lim := range l.users {
+		if lim.Tokens() >= float64(l.burst) {
+			delete(l.users, uid)
+		}
+	}
+}
+
+// checkRateLimit reports whether the specified user may create or vote on
+// something now. If not, it writes a 429 response to w and returns false.
+func (s *tmemeServer) checkRateLimit(w http.ResponseWriter, uid tailcfg.UserID) bool {
+	wait, ok := s.limiter.allow(uid)
+	if ok {
+		return true
+	}
+	serveMetrics.Add("rate-limited", 1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "rate limit exceeded, try again later", http.StatusTooManyRequests)
+	return false
+}
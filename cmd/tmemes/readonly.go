@@ -0,0 +1,56 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+
+	"tailscale.com/tailcfg"
+)
+
+// Read-only service nodes.
+//
+// Tagged nodes, such as CI runners and bots, do not belong to a user, so they
+// cannot create, edit, or vote. With --read-only-tags, nodes with one of the
+// given tags act as a read-only service identity: they may use the GET and
+// HEAD methods of the API and content handlers, including those that ask who
+// the caller is, such as GET /api/vote. Requests from other tagged nodes are
+// then refused, so that only the tags that have been set up can read.
+
+// readOnlyOps lists the operations named in calls to checkAccess that
+// read-only service nodes may do.
+var readOnlyOps = map[string]bool{
+	"get votes": true,
+}
+
+// isReadOnlyNode reports whether node has one of the tags in --read-only-tags.
+func (s *tmemeServer) isReadOnlyNode(node *tailcfg.Node) bool {
+	for _, tag := range node.Tags {
+		if s.readOnlyTags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// limitTaggedNodes wraps h so that, if --read-only-tags is set, tagged nodes
+// are refused unless they are read-only service nodes, and those may only
+// read. Callers using an API token are not affected.
+func (s *tmemeServer) limitTaggedNodes(h http.Handler) http.Handler {
+	if len(s.readOnlyTags) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if whois, ok := cachedWhoIs(r); ok && whois.Node.IsTagged() {
+			if !s.isReadOnlyNode(whois.Node) {
+				http.Error(w, "tagged nodes cannot use this server", http.StatusForbidden)
+				return
+			} else if r.Method != "GET" && r.Method != "HEAD" {
+				http.Error(w, "read-only nodes cannot "+r.Method, http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,239 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+	"tailscale.com/tailcfg"
+)
+
+// Bulk re-rendering.
+//
+// Cached renderings of macros are kept for as long as they are used, so after
+// a change to the renderer the gallery would otherwise show a mix of old and
+// new styles indefinitely. An admin can start a background job that discards
+// the cached renderings of all macros, or of those matching a filter, and
+// generates their default renderings again. Other sizes, formats, and caption
+// variants are generated again on demand. Only one job runs at a time.
+
+// A rerenderJob records the progress of a bulk re-rendering job.
+type rerenderJob struct {
+	Filter   string     `json:"filter,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Canceled bool       `json:"canceled,omitempty"`
+	Total    int        `json:"total"`  // macros selected
+	Done     int        `json:"done"`   // macros processed so far
+	Failed   []int      `json:"failed"` // IDs of macros that failed to render
+
+	cancel context.CancelFunc
+}
+
+// serveAPIAdminRerender starts, reports, and cancels bulk re-rendering of
+// cached macros. Only server admins can use these methods.
+//
+// API: POST /api/admin/rerender[?filter=...] -- start a job
+// API: GET /api/admin/rerender               -- report the latest job
+// API: DELETE /api/admin/rerender            -- cancel the running job
+//
+// The filter is a space-separated list of terms, all of which a macro must
+// match to be re-rendered: "template:<id>", "creator:<id>" (or
+// "creator:anon"), "font:<name>", or "animated". Without a filter, all
+// macros are re-rendered. A job cannot be started while another is running.
+//
+// Each method reports the job as {"filter":"...", "started":time,
+// "finished":time, "canceled":bool, "total":N, "done":N, "failed":[ids]},
+// or null if no job has been run since the server started.
+func (s *tmemeServer) serveAPIAdminRerender(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-rerender", 1)
+	whois := s.checkAdmin(w, r, "re-render macros")
+	if whois == nil {
+		return // error already sent
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		filter := strings.TrimSpace(r.FormValue("filter"))
+		match, err := s.parseRerenderFilter(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.startRerender(filter, match); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err := s.db.AddAuditEntry(&tmemes.AuditEntry{
+			Actor:  whois.UserProfile.ID,
+			Action: "rerender",
+			Reason: filter,
+		}); err != nil {
+			log.Printf("WARNING: recording re-render by %q: %v", whois.UserProfile.LoginName, err)
+		}
+	case "DELETE":
+		s.mu.Lock()
+		if job := s.rerender; job != nil && job.Finished == nil {
+			job.cancel()
+		}
+		s.mu.Unlock()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	var rsp *rerenderJob
+	if s.rerender != nil {
+		job := *s.rerender
+		job.Failed = append([]int{}, job.Failed...)
+		rsp = &job
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseRerenderFilter parses a filter for bulk re-rendering (see
+// serveAPIAdminRerender), and returns a function that reports whether a
+// macro matches it.
+func (s *tmemeServer) parseRerenderFilter(filter string) (func(*tmemes.Macro) bool, error) {
+	var terms []func(*tmemes.Macro) bool
+	for _, term := range strings.Fields(filter) {
+		key, arg, _ := strings.Cut(term, ":")
+		switch key {
+		case "template":
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template ID %q", arg)
+			}
+			terms = append(terms, func(m *tmemes.Macro) bool { return m.TemplateID == id })
+		case "creator":
+			uid := tailcfg.UserID(-1)
+			if arg != "anon" && arg != "anonymous" {
+				id, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil || id <= 0 {
+					return nil, fmt.Errorf("invalid creator %q", arg)
+				}
+				uid = tailcfg.UserID(id)
+			}
+			terms = append(terms, func(m *tmemes.Macro) bool { return m.Creator == uid })
+		case "font":
+			if arg == "" {
+				return nil, errors.New("missing font name")
+			}
+			terms = append(terms, func(m *tmemes.Macro) bool {
+				for _, tl := range m.TextOverlay {
+					if strings.EqualFold(tl.Font, arg) {
+						return true
+					}
+				}
+				return false
+			})
+		case "animated":
+			terms = append(terms, func(m *tmemes.Macro) bool {
+				t, err := s.db.AnyTemplate(m.TemplateID)
+				return err == nil && isAnimatedTemplate(t)
+			})
+		default:
+			return nil, fmt.Errorf("invalid filter term %q", term)
+		}
+	}
+	return func(m *tmemes.Macro) bool {
+		for _, match := range terms {
+			if !match(m) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// startRerender starts a job to re-render the macros selected by match in the
+// background. It reports an error if a job is already running.
+func (s *tmemeServer) startRerender(filter string, match func(*tmemes.Macro) bool) error {
+	var ms []*tmemes.Macro
+	for _, m := range s.db.AllMacros() {
+		if match(m) {
+			ms = append(ms, m)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job := s.rerender; job != nil && job.Finished == nil {
+		return errors.New("a re-render job is already running")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &rerenderJob{
+		Filter:  filter,
+		Started: time.Now().UTC(),
+		Total:   len(ms),
+		Failed:  []int{},
+		cancel:  cancel,
+	}
+	s.rerender = job
+	go s.runRerender(ctx, job, ms)
+	return nil
+}
+
+// runRerender discards and regenerates the cached renderings of ms one at a
+// time, recording its progress in job, until it is done or ctx ends.
+func (s *tmemeServer) runRerender(ctx context.Context, job *rerenderJob, ms []*tmemes.Macro) {
+	log.Printf("Re-rendering %d macros (filter %q)", len(ms), job.Filter)
+	start := time.Now()
+	for _, m := range ms {
+		if ctx.Err() != nil {
+			break
+		}
+		err := s.rerenderMacro(m)
+		if err != nil {
+			log.Printf("re-rendering macro %d: %v", m.ID, err)
+			macroMetrics.Add("rerender-failed", 1)
+		} else {
+			macroMetrics.Add("rerender", 1)
+		}
+
+		s.mu.Lock()
+		job.Done++
+		if err != nil {
+			job.Failed = append(job.Failed, m.ID)
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	job.Finished = &now
+	job.Canceled = ctx.Err() != nil
+	job.cancel()
+	log.Printf("Re-rendered %d of %d macros in %v (%d failed, canceled=%v)",
+		job.Done, job.Total, time.Since(start).Round(time.Second), len(job.Failed), job.Canceled)
+}
+
+// rerenderMacro discards the cached renderings of m and generates its
+// default rendering again.
+func (s *tmemeServer) rerenderMacro(m *tmemes.Macro) error {
+	if err := s.db.DiscardCached(m.ID); err != nil {
+		return err // most likely, the macro was deleted
+	}
+	cachePath, err := s.db.MacroCachePath(m, store.CacheKey{})
+	if err != nil {
+		return err
+	}
+	return s.renderMacro(m, cachePath, s.encodeSettings())
+}
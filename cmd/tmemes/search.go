@@ -0,0 +1,70 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/tailcfg"
+)
+
+// serveAPISearch implements full-text search of macros and templates.
+//
+// API: GET /api/search?q=text[&count=N]
+//
+// The query matches macro overlay text, template names, and the names of
+// creators. The result is {"macros":[...], "templates":[...]}, best match
+// first, with up to count (default 24) of each.
+func (s *tmemeServer) serveAPISearch(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-search", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	count := 24
+	if v := r.FormValue("count"); v != "" {
+		var err error
+		count, err = strconv.Atoi(v)
+		if err != nil || count <= 0 {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+	}
+	macros, templates, err := s.db.Search(r.FormValue("q"), count)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rsp := struct {
+		M []*tmemes.Macro    `json:"macros"`
+		T []*tmemes.Template `json:"templates"`
+	}{M: macros, T: templates}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// indexCreatorNames records the display names of all known creators in the
+// search index.
+func (s *tmemeServer) indexCreatorNames() {
+	seen := make(map[tailcfg.UserID]bool)
+	check := func(id tailcfg.UserID) {
+		if id > 0 && !seen[id] {
+			seen[id] = true
+			s.userDisplayName(context.Background(), id, time.Time{})
+		}
+	}
+	for _, t := range s.db.Templates() {
+		check(t.Creator)
+	}
+	for _, m := range s.db.Macros() {
+		check(m.Creator)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/creachadair/mds/compare"
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/memedraw"
+	"golang.org/x/exp/slices"
+)
+
+// maxSimilarDistance is the largest hash distance (out of 64 bits) at which
+// two templates are considered similar.
+const maxSimilarDistance = 20
+
+// similarTemplate is a template along with its distance from a reference
+// image. Distance 0 means the images are (perceptually) identical.
+type similarTemplate struct {
+	*tmemes.Template
+	Distance int `json:"distance"`
+}
+
+// similarTemplates returns up to limit visible templates whose image hash is
+// within maxSimilarDistance of hash, closest first. The template with ID
+// exclude (if any) is skipped.
+func (s *tmemeServer) similarTemplates(hash uint64, exclude, limit int) []similarTemplate {
+	var out []similarTemplate
+	for _, t := range s.db.Templates() {
+		if t.ID == exclude || t.ImageHash == 0 {
+			continue
+		}
+		if d := memedraw.HashDistance(hash, t.ImageHash); d <= maxSimilarDistance {
+			out = append(out, similarTemplate{Template: t, Distance: d})
+		}
+	}
+	slices.SortStableFunc(out, compare.FromLessFunc(func(a, b similarTemplate) bool {
+		return a.Distance < b.Distance
+	}))
+	return out[:min(len(out), limit)]
+}
+
+// serveAPITemplateSimilar reports templates whose images resemble the
+// specified template.
+//
+// API: /api/template/:id/similar[?count=N]
+//
+// The result is {"templates":[...]}, where each element is a JSON
+// tmemes.Template with an additional "distance" field, closest first.
+func (s *tmemeServer) serveAPITemplateSimilar(w http.ResponseWriter, r *http.Request, path string) {
+	t, ok, err := getSingleFromIDInPath(path, "api/template", s.db.Template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if !ok {
+		http.Error(w, "missing template ID", http.StatusBadRequest)
+		return
+	}
+	count := 8
+	if v := r.FormValue("count"); v != "" {
+		count, err = strconv.Atoi(v)
+		if err != nil || count <= 0 {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+	}
+	rsp := struct {
+		T []similarTemplate `json:"templates"`
+	}{T: s.similarTemplates(t.ImageHash, t.ID, count)}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveAPITemplateSearch reports stored templates that resemble an uploaded
+// image, so a user can check whether a template already exists.
+//
+// API: POST /api/template/search-by-image[?count=N]
+//
+// The payload must be of type multipart/form-data with the image in the
+// "image" field. The result has the same format as /api/template/:id/similar.
+func (s *tmemeServer) serveAPITemplateSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	count := 8
+	if v := r.URL.Query().Get("count"); v != "" {
+		var err error
+		count, err = strconv.Atoi(v)
+		if err != nil || count <= 0 {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes()+1<<16)
+	f, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		http.Error(w, "invalid image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rsp := struct {
+		T []similarTemplate `json:"templates"`
+	}{T: s.similarTemplates(memedraw.ImageHash(img), 0, count)}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// fillTemplateHashes computes and records image hashes for any templates that
+// do not already have one, such as those created before hashes were added.
+func (s *tmemeServer) fillTemplateHashes() {
+	var numHashed int
+	for _, t := range s.db.Templates() {
+		if t.ImageHash != 0 {
+			continue
+		}
+		path, err := s.db.TemplatePath(t.ID)
+		if err != nil {
+			log.Printf("WARNING: template %d: %v", t.ID, err)
+			continue
+		}
+		f, err := s.db.OpenFile(path)
+		if err != nil {
+			log.Printf("WARNING: template %d: %v", t.ID, err)
+			continue
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			log.Printf("WARNING: decoding template %d: %v", t.ID, err)
+			continue
+		}
+		if err := s.db.SetTemplateImageHash(t.ID, memedraw.ImageHash(img)); err != nil {
+			log.Printf("WARNING: template %d: %v", t.ID, err)
+			continue
+		}
+		numHashed++
+	}
+	if numHashed > 0 {
+		log.Printf("Computed image hashes for %d templates", numHashed)
+	}
+}
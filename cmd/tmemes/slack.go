@@ -0,0 +1,339 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+)
+
+// Slack link unfurling.
+//
+// Slack cannot reach the tailnet, so links to macros posted there show
+// nothing. If the -slack-signing-secret and -slack-bot-token flags are set,
+// the server acts as a Slack app that unfurls them. Slack delivers events to
+// the Events API request URL on the Funnel listener,
+//
+//	https://<host>.<tailnet>.ts.net/slack/events
+//
+// and the server answers each link_shared event for a link to /m/:id with
+// chat.unfurl, giving the template name, creator, and vote counts of the
+// macro, and, if the macro is public, its image at a signed URL on the Funnel
+// listener,
+//
+//	https://<host>.<tailnet>.ts.net/u/<id>/<token>
+//
+// The Slack app needs the links:read and links:write scopes, a subscription
+// to the link_shared event, and the names of the server as app unfurl
+// domains. The app can also make macros when it is given a slash command or
+// mentioned (see slackcmd.go).
+//
+// As on the rest of the Funnel listener, only the images of macros whose
+// creators have made them public leave the tailnet: other macros are
+// unfurled as text alone, as are public macros marked NSFW. Hidden macros are
+// not unfurled at all.
+
+const (
+	slackEventsPath    = "/slack/events"
+	unfurlPrefix       = "/u/"
+	slackMaxSkew       = 5 * time.Minute  // of the timestamps of requests from Slack
+	slackTimeout       = 30 * time.Second // for calls to the Slack API
+	maxSlackEventBytes = 1 << 20
+)
+
+// slackUnfurlURL is the endpoint of the Slack chat.unfurl method.
+const slackUnfurlURL = "https://slack.com/api/chat.unfurl"
+
+// slackLinkShared is a link_shared event from the Slack Events API.
+type slackLinkShared struct {
+	Type      string `json:"type"`
+	Channel   string `json:"channel"`
+	MessageTS string `json:"message_ts"`
+	UnfurlID  string `json:"unfurl_id"` // for links in the message composer
+	Source    string `json:"source"`
+	Links     []struct {
+		URL string `json:"url"`
+	} `json:"links"`
+}
+
+// A slackAttachment is the unfurl of a link, in the form of a Slack message
+// attachment.
+type slackAttachment struct {
+	Fallback  string `json:"fallback"`
+	Title     string `json:"title"`
+	TitleLink string `json:"title_link"`
+	Text      string `json:"text"`
+	ImageURL  string `json:"image_url,omitempty"`
+	Footer    string `json:"footer,omitempty"`
+}
+
+// serveSlackEvents receives events from the Slack Events API, on the Funnel
+// listener.
+//
+// API: POST /slack/events
+//
+// Requests must be signed with the signing secret of the Slack app. The URL
+// verification challenge is answered directly, and link_shared events are
+// acknowledged at once and unfurled in the background, since Slack expects
+// a response within seconds.
+func (s *tmemeServer) serveSlackEvents(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("slack-events", 1)
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSlackEventBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkSlackSignature(r.Header, body, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Type      string          `json:"type"`
+		Challenge string          `json:"challenge"`
+		Event     json.RawMessage `json:"event"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, req.Challenge)
+	case "event_callback":
+		var ev struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(req.Event, &ev)
+		switch ev.Type {
+		case "link_shared":
+			var ls slackLinkShared
+			if err := json.Unmarshal(req.Event, &ls); err == nil {
+				go s.unfurlSlackLinks(ls)
+			}
+		case "app_mention":
+			// Slack retries events it thinks were not delivered, but a
+			// command must not make its macro twice.
+			var am slackAppMention
+			if err := json.Unmarshal(req.Event, &am); err == nil && r.Header.Get("X-Slack-Retry-Num") == "" {
+				go s.runSlackMention(am)
+			}
+		}
+	}
+}
+
+// checkSlackSignature reports an error if the request with the given header
+// and body was not signed with the Slack signing secret, or was signed too
+// long before now.
+func checkSlackSignature(h http.Header, body []byte, now time.Time) error {
+	ts := h.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("missing request timestamp")
+	} else if d := now.Sub(time.Unix(sec, 0)); d > slackMaxSkew || d < -slackMaxSkew {
+		return errors.New("request timestamp is too old")
+	}
+	mac := hmac.New(sha256.New, []byte(*slackSigningSecret))
+	fmt.Fprintf(mac, "v0:%s:", ts)
+	mac.Write(body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(h.Get("X-Slack-Signature")), []byte(want)) {
+		return errors.New("invalid request signature")
+	}
+	return nil
+}
+
+// unfurlSlackLinks unfurls the links to macros reported by ev.
+func (s *tmemeServer) unfurlSlackLinks(ev slackLinkShared) {
+	unfurls := make(map[string]slackAttachment)
+	for _, link := range ev.Links {
+		id, ok := macroIDFromLink(link.URL)
+		if !ok {
+			continue
+		}
+		if a, ok := s.slackUnfurl(link.URL, id); ok {
+			unfurls[link.URL] = a
+		}
+	}
+	if len(unfurls) == 0 {
+		return
+	}
+	req := map[string]any{"unfurls": unfurls}
+	if ev.UnfurlID != "" {
+		req["unfurl_id"], req["source"] = ev.UnfurlID, ev.Source
+	} else {
+		req["channel"], req["ts"] = ev.Channel, ev.MessageTS
+	}
+	if err := callSlack(slackUnfurlURL, req); err != nil {
+		log.Printf("[slack] unfurling %d links: %v", len(unfurls), err)
+		return
+	}
+	serveMetrics.Add("slack-unfurl", int64(len(unfurls)))
+}
+
+// macroIDFromLink reports the ID of the macro whose page is at link, a URL
+// of the form http://tmemes/m/:id.
+func macroIDFromLink(link string) (int, bool) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return 0, false
+	}
+	rest, ok := strings.CutPrefix(u.Path, "/m/")
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(rest, "/"))
+	return id, err == nil && id > 0
+}
+
+// slackUnfurl returns the unfurl of link, which refers to the macro with the
+// given ID. It reports false if the macro is not to be unfurled.
+func (s *tmemeServer) slackUnfurl(link string, id int) (slackAttachment, bool) {
+	m, err := s.db.Macro(id)
+	if err != nil || m.Hidden {
+		return slackAttachment{}, false
+	}
+	t, err := s.db.AnyTemplate(m.TemplateID)
+	if err != nil {
+		return slackAttachment{}, false
+	}
+	creator := s.userDisplayName(context.Background(), m.Creator, m.CreatedAt)
+	a := slackAttachment{
+		Fallback:  fmt.Sprintf("%s, by %s", t.Name, creator),
+		Title:     t.Name,
+		TitleLink: link,
+		Text:      fmt.Sprintf("by %s · %d upvotes, %d downvotes", creator, m.Upvotes, m.Downvotes),
+		Footer:    brandingForUI().Name,
+	}
+	if m.Public && !isNSFW(m, t) {
+		a.ImageURL = s.unfurlImageURL(m)
+	}
+	return a, true
+}
+
+// unfurlImageURL returns the URL of the image of m on the Funnel listener,
+// for unfurls, or "" if the name of the server on the internet is not known
+// yet.
+func (s *tmemeServer) unfurlImageURL(m *tmemes.Macro) string {
+	host := s.certDomain()
+	if host == "" {
+		return ""
+	}
+	u := fmt.Sprintf("https://%s%s%d/%s", host, unfurlPrefix, m.ID, s.linkToken("unfurl", m.ID))
+	if m.Revision > 0 {
+		u += fmt.Sprintf("?rev=%d", m.Revision) // don't reuse stale images
+	}
+	return u
+}
+
+// callSlack posts req as JSON to the Slack API method at apiURL, with the
+// bot token, and reports any error from Slack.
+func callSlack(apiURL string, req any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), slackTimeout)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return doSlack(hreq, nil)
+}
+
+// callSlackGet calls the Slack API method at apiURL with the given query
+// parameters, with the bot token, and decodes its result into res.
+func callSlackGet(ctx context.Context, apiURL string, params url.Values, res any) error {
+	hreq, err := http.NewRequestWithContext(ctx, "GET", apiURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	return doSlack(hreq, res)
+}
+
+// doSlack sends hreq to the Slack API with the bot token, and reports any
+// error from Slack. If res is not nil, the result is decoded into it.
+func doSlack(hreq *http.Request, res any) error {
+	hreq.Header.Set("Authorization", "Bearer "+*slackBotToken)
+	rsp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack: %s", rsp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, maxSlackEventBytes))
+	if err != nil {
+		return err
+	}
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	} else if !status.OK {
+		return fmt.Errorf("slack: %s", status.Error)
+	} else if res != nil {
+		return json.Unmarshal(data, res)
+	}
+	return nil
+}
+
+// serveUnfurlImage serves the image of a macro unfurled in Slack, on the
+// Funnel listener.
+//
+// API: GET /u/:id/:token
+//
+// As for public macros, the request looks the same as for a macro that does
+// not exist, is not public, is hidden, or is marked NSFW, if the signature is
+// not valid.
+func (s *tmemeServer) serveUnfurlImage(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("unfurl-image", 1)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	idStr, token, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, unfurlPrefix), "/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil || !hmac.Equal([]byte(token), []byte(s.linkToken("unfurl", id))) {
+		http.NotFound(w, r)
+		return
+	}
+	m, err := s.db.Macro(id)
+	if err != nil || !m.Public || m.Hidden {
+		http.NotFound(w, r)
+		return
+	}
+	if t, err := s.db.AnyTemplate(m.TemplateID); err != nil || isNSFW(m, t) {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveMacroToPublic(w, r, m)
+}
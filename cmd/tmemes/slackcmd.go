@@ -0,0 +1,342 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/tailcfg"
+)
+
+// Slack slash commands.
+//
+// The Slack app that unfurls links (see slack.go) can also offer the /meme
+// slash command, which makes a macro without leaving Slack:
+//
+//	/meme <template> "top text" "bottom text" [--anon] [--color <color>]
+//
+// Slack delivers the command to the request URL on the Funnel listener,
+//
+//	https://<host>.<tailnet>.ts.net/slack/commands
+//
+// The template is named by ID or by name, as for the tmeme CLI, and each
+// text fills one of its areas in order, or the top and bottom of the image if
+// it has none. Names and texts of more than one word are quoted, with
+// straight or typographic quotes, and options may be given anywhere. Usage
+// errors are reported only to the sender. The macro is made on behalf of the
+// tailnet user whose login name is the email address of the Slack user, so
+// the app needs the users:read and users:read.email scopes as well as
+// commands; Slack users with no such tailnet user cannot make macros.
+//
+// The command
+//
+//	/meme top [day|week|month|all]
+//
+// instead lists the top macros of the leaderboard period (by default, the
+// day), with their votes, and the images of those that are public.
+//
+// Slash commands cannot be given in threads, so the app also takes the same
+// commands when it is mentioned, as in "@tmemes drake "no" "yes"", if it is
+// subscribed to the app_mention event with the app_mentions:read and
+// chat:write scopes. It replies in the thread of the mention, starting one if
+// need be, and the macro records the permalink of the mention as a context
+// link, so that the conversation it came from is not lost.
+//
+// Since it is posted to the channel, a macro made from Slack is public, as if
+// its creator had shared it (see funnel.go), and the reply shows its image.
+
+const slackCommandsPath = "/slack/commands"
+
+// The endpoints of the Slack methods used for commands.
+const (
+	slackUsersInfoURL     = "https://slack.com/api/users.info"
+	slackPostMessageURL   = "https://slack.com/api/chat.postMessage"
+	slackPostEphemeralURL = "https://slack.com/api/chat.postEphemeral"
+	slackGetPermalinkURL  = "https://slack.com/api/chat.getPermalink"
+)
+
+// memeUsage is the reply to a /meme command that cannot be parsed.
+var memeUsage = chatUsage("/meme")
+
+// parseMemeCommand parses the text of a /meme command from Slack, as for
+// parseChatCommand. The entities with which Slack escapes "&", "<", and ">"
+// are decoded.
+func parseMemeCommand(text string) (memeCommand, error) {
+	return parseChatCommand(slackUnescaper.Replace(text))
+}
+
+// A slackMessage is a message posted in reply to a slash command.
+type slackMessage struct {
+	ResponseType string       `json:"response_type,omitempty"` // "in_channel" or "ephemeral"
+	Text         string       `json:"text"`
+	Blocks       []slackBlock `json:"blocks,omitempty"`
+}
+
+// A slackBlock is a layout block of a Slack message. Only the fields for its
+// type are set.
+type slackBlock struct {
+	Type      string      `json:"type"`                // "image", "context", or "section"
+	ImageURL  string      `json:"image_url,omitempty"` // image
+	AltText   string      `json:"alt_text,omitempty"`  // image
+	Title     *slackText  `json:"title,omitempty"`     // image
+	Elements  []slackText `json:"elements,omitempty"`  // context
+	Text      *slackText  `json:"text,omitempty"`      // section
+	Accessory *slackBlock `json:"accessory,omitempty"` // section, an image
+}
+
+// A slackText is a text object of a Slack layout block.
+type slackText struct {
+	Type string `json:"type"` // "mrkdwn" or "plain_text"
+	Text string `json:"text"`
+}
+
+// slackEscaper escapes the characters that Slack treats as markup.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackUnescaper decodes the escapes of slackEscaper.
+var slackUnescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+
+// slackEphemeral returns a reply to a slash command that only its sender
+// sees.
+func slackEphemeral(text string) slackMessage {
+	return slackMessage{ResponseType: "ephemeral", Text: text}
+}
+
+// serveSlackCommand receives slash commands from Slack, on the Funnel
+// listener.
+//
+// API: POST /slack/commands
+//
+// Requests must be signed with the signing secret of the Slack app. Usage
+// errors are answered at once, visible only to the sender. Otherwise the
+// command is acknowledged, and carried out in the background, since Slack
+// expects a response within seconds; the result is posted to the response
+// URL of the command.
+func (s *tmemeServer) serveSlackCommand(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("slack-command", 1)
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSlackEventBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkSlackSignature(r.Header, body, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cmd, err := parseMemeCommand(form.Get("text"))
+	if errors.Is(err, errMemeHelp) {
+		writeSlackMessage(w, slackEphemeral(memeUsage))
+		return
+	} else if err != nil {
+		writeSlackMessage(w, slackEphemeral(fmt.Sprintf("Sorry, %s.\n%s", err, memeUsage)))
+		return
+	}
+	conv := chatConv{User: form.Get("user_id"), ResponseURL: form.Get("response_url")}
+	go s.runChatCommand(slackBot{s}, conv, cmd, nil)
+}
+
+// writeSlackMessage writes msg as the response to a slash command.
+func writeSlackMessage(w http.ResponseWriter, msg slackMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// slackAppMention is an app_mention event from the Slack Events API.
+type slackAppMention struct {
+	User     string `json:"user"`
+	Text     string `json:"text"`
+	Channel  string `json:"channel"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"` // if the mention is in a thread
+}
+
+// slackMentionRE matches the mentions of users at the start of a message.
+var slackMentionRE = regexp.MustCompile(`^(\s*<@[A-Z0-9]+(\|[^>]*)?>)+`)
+
+// runSlackMention carries out the command in the message ev, in which the app
+// was mentioned, and replies in its thread.
+func (s *tmemeServer) runSlackMention(ev slackAppMention) {
+	serveMetrics.Add("slack-mention", 1)
+	bot := slackBot{s}
+	conv := chatConv{User: ev.User, Channel: ev.Channel, Thread: cmp.Or(ev.ThreadTS, ev.TS), Message: ev.TS}
+	cmd, err := parseMemeCommand(slackMentionRE.ReplaceAllString(ev.Text, ""))
+	if err != nil {
+		text := memeUsage
+		if !errors.Is(err, errMemeHelp) {
+			text = fmt.Sprintf("Sorry, %s.\n%s", err, memeUsage)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), slackTimeout)
+		defer cancel()
+		if err := bot.post(ctx, conv, chatReply{Text: text}); err != nil {
+			log.Printf("[slack] replying to mention: %v", err)
+		}
+		return
+	}
+	var links []tmemes.ContextLink
+	if cmd.Template != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), slackTimeout)
+		defer cancel()
+		var res struct {
+			Permalink string `json:"permalink"`
+		}
+		if err := callSlackGet(ctx, slackGetPermalinkURL, url.Values{
+			"channel":    {ev.Channel},
+			"message_ts": {ev.TS},
+		}, &res); err != nil {
+			log.Printf("[slack] getting permalink: %v", err)
+		} else if res.Permalink != "" {
+			links = append(links, tmemes.ContextLink{URL: res.Permalink, Text: "Slack conversation"})
+		}
+	}
+	s.runChatCommand(bot, conv, cmd, links)
+}
+
+// slackBot is the chatBot for Slack. Replies to slash commands are posted
+// to their response URLs; replies to mentions, in the thread of the mention.
+type slackBot struct{ s *tmemeServer }
+
+func (slackBot) service() string { return "slack" }
+
+// tailnetUser returns the tailnet user whose login name is the email address
+// of the Slack user with the given ID.
+func (b slackBot) tailnetUser(ctx context.Context, slackUser string) (*tailcfg.UserProfile, error) {
+	errNoUser := errors.New("your Slack account does not match a user of this tailnet")
+	var res struct {
+		User struct {
+			Profile struct {
+				Email string `json:"email"`
+			} `json:"profile"`
+		} `json:"user"`
+	}
+	if err := callSlackGet(ctx, slackUsersInfoURL, url.Values{"user": {slackUser}}, &res); err != nil {
+		log.Printf("[slack] looking up user %q: %v", slackUser, err)
+		return nil, errNoUser
+	} else if res.User.Profile.Email == "" {
+		return nil, errNoUser
+	}
+	up, err := b.s.userFromLogin(ctx, res.User.Profile.Email)
+	if err != nil {
+		log.Printf("[slack] looking up user %q: %v", slackUser, err)
+		return nil, errNoUser
+	}
+	return up, nil
+}
+
+func (b slackBot) post(ctx context.Context, conv chatConv, reply chatReply) error {
+	msg := slackReplyMessage(reply)
+	if conv.ResponseURL != "" {
+		return postSlackResponse(ctx, conv.ResponseURL, msg)
+	}
+	req := struct {
+		Channel  string `json:"channel"`
+		User     string `json:"user,omitempty"` // for ephemeral messages
+		ThreadTS string `json:"thread_ts"`
+		slackMessage
+	}{Channel: conv.Channel, ThreadTS: conv.Thread, slackMessage: msg}
+	apiURL := slackPostMessageURL
+	if msg.ResponseType == "ephemeral" {
+		apiURL, req.User = slackPostEphemeralURL, conv.User
+	}
+	req.ResponseType = ""
+	return callSlack(apiURL, req)
+}
+
+// slackReplyMessage returns the Slack message for reply. A macro is shown
+// with its image, if it has one, and the top macros with their votes.
+func slackReplyMessage(reply chatReply) slackMessage {
+	switch {
+	case reply.Macro != nil:
+		m := reply.Macro
+		caption := fmt.Sprintf("<%s|%s> by %s", m.URL, slackEscaper.Replace(m.Template.Name), slackEscaper.Replace(m.Creator))
+		msg := slackMessage{ResponseType: "in_channel", Text: caption}
+		if m.ImageURL != "" {
+			var alt []string
+			for _, tl := range m.TextOverlay {
+				alt = append(alt, tl.Text)
+			}
+			msg.Blocks = append(msg.Blocks, slackBlock{
+				Type:     "image",
+				ImageURL: m.ImageURL,
+				AltText:  strings.Join(alt, " / "),
+				Title:    &slackText{Type: "plain_text", Text: m.Template.Name},
+			})
+		}
+		msg.Blocks = append(msg.Blocks, slackBlock{
+			Type:     "context",
+			Elements: []slackText{{Type: "mrkdwn", Text: caption}},
+		})
+		return msg
+
+	case reply.Top != nil:
+		top := reply.Top
+		msg := slackMessage{ResponseType: "in_channel", Text: top.Title}
+		if len(top.Macros) == 0 {
+			msg.Text += ": none yet"
+			return msg
+		}
+		msg.Blocks = append(msg.Blocks, slackBlock{
+			Type: "section",
+			Text: &slackText{Type: "mrkdwn", Text: fmt.Sprintf("*<%s|%s>*", top.URL, top.Title)},
+		})
+		for i, m := range top.Macros {
+			b := slackBlock{
+				Type: "section",
+				Text: &slackText{Type: "mrkdwn", Text: fmt.Sprintf("%d. <%s|%s> by %s\n:thumbsup: %d  :thumbsdown: %d",
+					i+1, m.URL, slackEscaper.Replace(m.Template.Name), slackEscaper.Replace(m.Creator), m.Upvotes, m.Downvotes)},
+			}
+			if m.ImageURL != "" {
+				b.Accessory = &slackBlock{Type: "image", ImageURL: m.ImageURL, AltText: m.Template.Name}
+			}
+			msg.Blocks = append(msg.Blocks, b)
+		}
+		return msg
+	}
+	return slackEphemeral(reply.Text)
+}
+
+// postSlackResponse posts msg to the response URL of a slash command.
+func postSlackResponse(ctx context.Context, responseURL string, msg slackMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", responseURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack: %s", rsp.Status)
+	}
+	return nil
+}
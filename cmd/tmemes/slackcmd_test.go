@@ -0,0 +1,102 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/tailscale/tmemes"
+)
+
+func TestParseMemeCommand(t *testing.T) {
+	red := tmemes.MustColor("red")
+	tests := []struct {
+		input   string
+		want    memeCommand
+		wantErr string // if set, a substring of the error
+	}{
+		{input: `drake "no" "yes"`,
+			want: memeCommand{Template: "drake", Lines: []string{"no", "yes"}}},
+		{input: `  42   yes  `,
+			want: memeCommand{Template: "42", Lines: []string{"yes"}}},
+		{input: `"distracted boyfriend" "me" "memes" "work"`,
+			want: memeCommand{Template: "distracted boyfriend", Lines: []string{"me", "memes", "work"}}},
+		{input: `“distracted boyfriend” ‘me’ «work»`,
+			want: memeCommand{Template: "distracted boyfriend", Lines: []string{"me", "work"}}},
+		{input: `drake "" "only the bottom"`,
+			want: memeCommand{Template: "drake", Lines: []string{"", "only the bottom"}}},
+		{input: `drake "日本語のテキスト" "🎉 ünïcödé"`,
+			want: memeCommand{Template: "drake", Lines: []string{"日本語のテキスト", "🎉 ünïcödé"}}},
+		{input: `drake "say \"hi\"" "a\\b"`,
+			want: memeCommand{Template: "drake", Lines: []string{`say "hi"`, `a\b`}}},
+		{input: `drake "fish &amp; chips" "&lt;3"`,
+			want: memeCommand{Template: "drake", Lines: []string{"fish & chips", "<3"}}},
+		{input: `--anon drake "top" --color red "bottom"`,
+			want: memeCommand{Template: "drake", Lines: []string{"top", "bottom"}, Anon: true, Color: &red}},
+		{input: `drake "top" —anon --color=#f00`,
+			want: memeCommand{Template: "drake", Lines: []string{"top"}, Anon: true, Color: &red}},
+		{input: `drake "--anon"`,
+			want: memeCommand{Template: "drake", Lines: []string{"--anon"}}},
+		{input: `top`, want: memeCommand{Top: "day"}},
+		{input: `TOP Week`, want: memeCommand{Top: "week"}},
+		{input: `"top" "day"`,
+			want: memeCommand{Template: "top", Lines: []string{"day"}}},
+		{input: `top "day"`,
+			want: memeCommand{Template: "top", Lines: []string{"day"}}},
+		{input: `top "of the" "world"`,
+			want: memeCommand{Template: "top", Lines: []string{"of the", "world"}}},
+		{input: `LINK`, want: memeCommand{Link: true}},
+		{input: `"link" "this"`,
+			want: memeCommand{Template: "link", Lines: []string{"this"}}},
+
+		{input: "help", wantErr: "help requested"},
+		{input: "drake --help", wantErr: "help requested"},
+		{input: "", wantErr: "missing template"},
+		{input: "--anon", wantErr: "missing template"},
+		{input: "drake", wantErr: "missing text"},
+		{input: `drake "top`, wantErr: "missing closing quote"},
+		{input: `drake "top" --color`, wantErr: "needs a color"},
+		{input: `drake "top" --color blurple`, wantErr: "invalid color"},
+		{input: `drake "top" --anon=yes`, wantErr: "takes no value"},
+		{input: `drake "top" --font impact`, wantErr: `unknown option "--font"`},
+		{input: `top week --anon`, wantErr: "top takes no options"},
+		{input: `link --anon`, wantErr: "link takes no options"},
+	}
+	for _, tc := range tests {
+		got, err := parseMemeCommand(tc.input)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Parse %q: got error %v, want %q", tc.input, err, tc.wantErr)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Parse %q: unexpected error: %v", tc.input, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Parse %q: (-want, +got)\n%s", tc.input, diff)
+		}
+	}
+	if _, err := parseMemeCommand("help"); !errors.Is(err, errMemeHelp) {
+		t.Errorf("Parse help: got %v, want errMemeHelp", err)
+	}
+}
+
+func TestSlackMentionRE(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{`<@U0123ABC> drake "no" "yes"`, ` drake "no" "yes"`},
+		{`  <@U0123ABC|tmemes> <@W99> help`, ` help`},
+		{`drake "<@U0123ABC>"`, `drake "<@U0123ABC>"`},
+	}
+	for _, tc := range tests {
+		if got := slackMentionRE.ReplaceAllString(tc.input, ""); got != tc.want {
+			t.Errorf("Strip %q: got %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
@@ -4,42 +4,84 @@
   /** @type {HTMLCanvasElement} */ let canvas;
   /** @type {HTMLImageElement} */ let fallback;
 
+  // Each text input on the create page carries the position of its text,
+  // either the default top and bottom lines or the template's own areas.
   function readTextValues() {
-    const top = document.getElementById("top").value;
-    const bottom = document.getElementById("bottom").value;
     let anon = false;
     const anonEl = document.getElementById("anon");
     if (anonEl) {
       anon = document.getElementById("anon").checked;
     }
+    const color = colorChoice("text-color");
+    const strokeColor = colorChoice("stroke-color");
     overlays = [];
-    if (top !== "") {
-      overlays.push({
-        text: top,
-        field: {
-          x: 0.5,
-          y: 0.15,
-          width: 1,
-        },
-        color: "white",
-        strokeColor: "black",
-      });
-    }
-    if (bottom !== "") {
+    for (const input of document.querySelectorAll("input.text-line")) {
+      if (input.value === "") {
+        continue;
+      }
       overlays.push({
-        text: bottom,
+        text: input.value,
         field: {
-          x: 0.5,
-          y: 0.85,
-          width: 1,
+          x: parseFloat(input.dataset.x),
+          y: parseFloat(input.dataset.y),
+          width: parseFloat(input.dataset.width) || 1,
         },
-        color: "white",
-        strokeColor: "black",
+        color,
+        strokeColor,
       });
     }
     return { overlays, anon };
   }
 
+  // colorChoice returns the color selected in the picker with the given ID,
+  // or its default if there is none.
+  function colorChoice(id) {
+    const el = document.getElementById(id);
+    return el.value || el.dataset.default;
+  }
+
+  // Fill the color pickers with the server's palette presets, one group of
+  // options per preset.
+  function setupColorChoices(onChange) {
+    const pickers = document.querySelectorAll("select.color-choice");
+    for (const el of pickers) {
+      el.addEventListener("change", onChange);
+    }
+    fetch("/api/palette")
+      .then(function (response) {
+        if (!response.ok) {
+          throw new Error(response.statusText);
+        }
+        return response.json();
+      })
+      .then(function ({ presets }) {
+        for (const el of pickers) {
+          el.replaceChildren(
+            ...presets.map(function (preset) {
+              const group = document.createElement("optgroup");
+              group.label = preset.name;
+              for (const color of preset.colors) {
+                const opt = document.createElement("option");
+                opt.value = color;
+                opt.textContent = color;
+                opt.style.background = color;
+                group.appendChild(opt);
+              }
+              return group;
+            }),
+          );
+          el.value = el.dataset.default;
+          if (el.value === "") {
+            el.selectedIndex = 0; // the default is not in the palette
+          }
+        }
+        onChange();
+      })
+      .catch(function (err) {
+        console.log(`error loading palette: ${err}`);
+      });
+  }
+
   function draw(e) {
     ctx.clearRect(0, 0, canvas.width, canvas.height);
     let x = readTextValues();
@@ -72,6 +114,123 @@
     }
   }
 
+  // The canvas only approximates the server's rendering, and does not animate
+  // GIFs, so once the user pauses typing, ask the server for a real preview
+  // and show that in place of the template image.
+  let templateSrc; // URL of the bare template image
+  let previewTimer;
+  let previewSeq = 0;
+  function schedulePreview(id) {
+    clearTimeout(previewTimer);
+    previewSeq++;
+    if (fallback.src !== templateSrc) {
+      URL.revokeObjectURL(fallback.src);
+      fallback.src = templateSrc;
+    }
+    previewTimer = setTimeout(function () {
+      fetchPreview(id, previewSeq);
+    }, 500);
+  }
+
+  function fetchPreview(id, seq) {
+    const { overlays } = readTextValues();
+    if (overlays.length === 0) {
+      return;
+    }
+    fetch("/api/preview", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ templateID: parseInt(id), textOverlay: overlays }),
+    })
+      .then(function (response) {
+        if (!response.ok) {
+          throw new Error(response.statusText);
+        }
+        const warnings = JSON.parse(
+          response.headers.get("Tmemes-Legibility") || "[]",
+        );
+        return response.blob().then((blob) => ({ blob, warnings }));
+      })
+      .then(function ({ blob, warnings }) {
+        if (seq !== previewSeq) {
+          return; // the text has changed since
+        }
+        showLegibilityWarnings(warnings);
+        fallback.src = URL.createObjectURL(blob);
+        ctx.clearRect(0, 0, canvas.width, canvas.height);
+      })
+      .catch(function (err) {
+        console.log(`error rendering preview: ${err}`);
+      });
+  }
+
+  // Before a macro is created, check whether one on the same template already
+  // has the same text, and if so, link to it and ask whether to go ahead.
+  // Resolves to whether to create the macro; if the check fails, it does.
+  function checkDuplicate(id) {
+    const { overlays } = readTextValues();
+    return fetch("/api/preview/check", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ templateID: parseInt(id), textOverlay: overlays }),
+    })
+      .then(function (response) {
+        if (!response.ok) {
+          throw new Error(response.statusText);
+        }
+        return response.json();
+      })
+      .then(function (check) {
+        return fetch(
+          `/api/macro/exists?templateID=${id}&hash=${check.captionHash}`,
+          { headers: { Accept: "application/json" } },
+        );
+      })
+      .then(function (response) {
+        if (!response.ok) {
+          throw new Error(response.statusText);
+        }
+        return response.json();
+      })
+      .then(function (rsp) {
+        const el = document.getElementById("duplicate-warning");
+        if (!rsp.exists) {
+          el.hidden = true;
+          return true;
+        }
+        const m = rsp.macros[0];
+        const when = m.createdAtRelative;
+        const link = document.createElement("a");
+        link.href = `/m/${m.id}`;
+        link.textContent = `made this exact joke ${when}`;
+        el.replaceChildren("Someone already ", link, ".");
+        el.hidden = false;
+        return confirm(
+          `Someone already made this exact joke ${when}. Create it anyway?`,
+        );
+      })
+      .catch(function (err) {
+        console.log(`error checking for duplicate macros: ${err}`);
+        return true;
+      });
+  }
+
+  // If the server checks legibility, previews report text that may be hard
+  // to read.
+  function showLegibilityWarnings(warnings) {
+    const list = document.getElementById("legibility-warnings");
+    if (!list) {
+      return;
+    }
+    list.replaceChildren(
+      ...warnings.map(function (w) {
+        const item = document.createElement("li");
+        item.textContent = w.message;
+        return item;
+      }),
+    );
+  }
+
   function submitMacro(id) {
     values = readTextValues();
     fetch(`/create/${id}`, {
@@ -136,17 +295,138 @@
     }
   }
 
+  function reportItem(kind, id) {
+    const reason = prompt(
+      `Why should the moderators look at ${kind} #${id}?`
+    );
+    if (!reason) {
+      return;
+    }
+    fetch(`/api/report/${kind}/${id}`, {
+      method: "POST",
+      headers: {
+        Accept: "application/json",
+        "Content-Type": "application/json",
+      },
+      body: JSON.stringify({ reason }),
+    })
+      .then(function (response) {
+        if (!response.ok) {
+          return response.text().then((t) => Promise.reject(t));
+        }
+        alert("Thanks, the moderators will take a look.");
+      })
+      .catch(function (err) {
+        alert(`error encountered reporting ${kind}: ${err}`);
+      });
+  }
+
+  function setupModerationPage() {
+    const buttons = document.querySelectorAll("button.moderate");
+    for (let i = 0; i < buttons.length; i++) {
+      const el = buttons[i];
+      el.addEventListener("click", () => {
+        const id = el.getAttribute("report-id");
+        const action = el.getAttribute("action");
+        const reason = prompt(`Reason to ${action} (recorded in the audit log):`);
+        if (!reason) {
+          return;
+        }
+        fetch(`/api/moderation/${id}`, {
+          method: "POST",
+          headers: {
+            Accept: "application/json",
+            "Content-Type": "application/json",
+          },
+          body: JSON.stringify({ action, reason }),
+        })
+          .then(function (response) {
+            if (!response.ok) {
+              return response.text().then((t) => Promise.reject(t));
+            }
+            el.closest(".report").remove();
+          })
+          .catch(function (err) {
+            alert(`error encountered resolving report: ${err}`);
+          });
+      });
+    }
+  }
+
+  function setupPrefsPage() {
+    const form = document.getElementById("prefs-form");
+    form.addEventListener("submit", (e) => {
+      e.preventDefault();
+      const prefs = {
+        hideFromLeaderboards: form.elements.hideFromLeaderboards.checked,
+        handle: form.elements.handle.value.trim(),
+        dismissedTour: form.elements.dismissedTour.checked,
+      };
+      fetch("/api/prefs", {
+        method: "PUT",
+        headers: {
+          Accept: "application/json",
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify(prefs),
+      })
+        .then(function (response) {
+          if (!response.ok) {
+            return response.text().then((t) => Promise.reject(t));
+          }
+          alert("Preferences saved.");
+        })
+        .catch(function (err) {
+          alert(`error encountered saving preferences: ${err}`);
+        });
+    });
+  }
+
+  function setupChatLinkPage() {
+    const form = document.getElementById("chat-link-form");
+    form.addEventListener("submit", (e) => {
+      e.preventDefault();
+      const link = {
+        service: form.elements.service.value,
+        id: form.elements.id.value,
+        name: form.elements.name.value,
+        expires: Number(form.elements.expires.value),
+        token: form.elements.token.value,
+      };
+      fetch("/api/chat/link", {
+        method: "POST",
+        headers: {
+          Accept: "application/json",
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify(link),
+      })
+        .then(function (response) {
+          if (!response.ok) {
+            return response.text().then((t) => Promise.reject(t));
+          }
+          alert("Account linked.");
+          window.location.href = "/";
+        })
+        .catch(function (err) {
+          alert(`error encountered linking account: ${err}`);
+        });
+    });
+  }
+
   function setupCreatePage() {
     // setup submit button
     const submitBtn = document.getElementById("submit");
     const pathParts = window.location.pathname.split("/");
     const id = pathParts[pathParts.length - 1];
     submitBtn.addEventListener("click", () => {
-      const warn =
-        "Are you sure you want to submit this? Your coworkers will see it!";
-      if (confirm(warn)) {
-        submitMacro(id);
-      }
+      checkDuplicate(id).then(function (ok) {
+        const warn =
+          "Are you sure you want to submit this? Your coworkers will see it!";
+        if (ok && confirm(warn)) {
+          submitMacro(id);
+        }
+      });
     });
     // TODO more graceful fallback for gifs.
     canvas = document.getElementById("preview");
@@ -163,8 +443,15 @@
     ctx.textAlign = "center";
     ctx.font = `${fontSize}px Oswald SemiBold`;
 
-    document.getElementById("top").addEventListener("input", draw);
-    document.getElementById("bottom").addEventListener("input", draw);
+    templateSrc = fallback.src;
+    for (const input of document.querySelectorAll("input.text-line")) {
+      input.addEventListener("input", draw);
+      input.addEventListener("input", () => schedulePreview(id));
+    }
+    setupColorChoices(function () {
+      draw();
+      schedulePreview(id);
+    });
     draw();
   }
 
@@ -174,6 +461,7 @@
     const deleteTemplates = document.querySelectorAll("button.delete.template");
     const upvoteMacros = document.querySelectorAll("button.upvote.macro");
     const downvoteMacros = document.querySelectorAll("button.downvote.macro");
+    const reportMacros = document.querySelectorAll("button.report.macro");
 
     for (let i = 0; i < deleteMacros.length; i++) {
       const el = deleteMacros[i];
@@ -191,6 +479,13 @@
       });
     }
 
+    for (let i = 0; i < reportMacros.length; i++) {
+      const el = reportMacros[i];
+      el.addEventListener("click", () => {
+        reportItem("macro", el.getAttribute("report-id"));
+      });
+    }
+
     for (let i = 0; i < upvoteMacros.length; i++) {
       const upEl = upvoteMacros[i];
       const downEl = downvoteMacros[i];
@@ -216,6 +511,109 @@
         downvoteMacro(id, upEl, downEl);
       });
     }
+
+    // Images marked NSFW are shown blurred until the viewer asks to see them.
+    for (const el of document.querySelectorAll("button.reveal")) {
+      el.addEventListener("click", () => {
+        const img = el.closest(".meme").querySelector("img");
+        img.src = el.getAttribute("reveal-src");
+        el.remove();
+      });
+    }
+
+    if (upvoteMacros.length > 0) {
+      setupLiveUpdates();
+    }
+  }
+
+  function setupOnboarding() {
+    const dismiss = document.querySelector("button.dismiss-tour");
+    if (dismiss) {
+      dismiss.addEventListener("click", () => {
+        fetch("/api/prefs", { headers: { Accept: "application/json" } })
+          .then((response) => response.json())
+          .then((prefs) => {
+            prefs.dismissedTour = true;
+            return fetch("/api/prefs", {
+              method: "PUT",
+              headers: {
+                Accept: "application/json",
+                "Content-Type": "application/json",
+              },
+              body: JSON.stringify(prefs),
+            });
+          })
+          .then(function (response) {
+            if (!response.ok) {
+              return response.text().then((t) => Promise.reject(t));
+            }
+            document.getElementById("tour").remove();
+          })
+          .catch(function (err) {
+            alert(`error encountered dismissing the tour: ${err}`);
+          });
+      });
+    }
+
+    const form = document.getElementById("starter-pack-form");
+    if (form) {
+      form.addEventListener("submit", (e) => {
+        e.preventDefault();
+        const sub = {
+          url: form.elements.url.value.trim(),
+          publicKey: form.elements.publicKey.value.trim(),
+        };
+        fetch("/api/admin/subscriptions", {
+          method: "POST",
+          headers: {
+            Accept: "application/json",
+            "Content-Type": "application/json",
+          },
+          body: JSON.stringify(sub),
+        })
+          .then(function (response) {
+            if (!response.ok) {
+              return response.text().then((t) => Promise.reject(t));
+            }
+            return response.json();
+          })
+          .then(function (rsp) {
+            alert(`Imported ${rsp.added} templates.`);
+            window.location.reload();
+          })
+          .catch(function (err) {
+            alert(`error encountered importing the pack: ${err}`);
+          });
+      });
+    }
+  }
+
+  // Keep the vote counts on the page current, and remove macros when they are
+  // deleted, as the server reports the changes.
+  function setupLiveUpdates() {
+    if (!("EventSource" in window)) {
+      return;
+    }
+    const events = new EventSource("/api/events");
+    events.addEventListener("vote", function (ev) {
+      const data = JSON.parse(ev.data);
+      const upEl = document.querySelector(
+        `button.upvote.macro[upvote-id="${data.macroID}"]`,
+      );
+      const downEl = document.querySelector(
+        `button.downvote.macro[downvote-id="${data.macroID}"]`,
+      );
+      if (upEl && downEl) {
+        updateVotes(upEl, downEl, data);
+      }
+    });
+    events.addEventListener("delete", function (ev) {
+      const data = JSON.parse(ev.data);
+      const el = document.querySelector(`.meme[macro-id="${data.macroID}"]`);
+      if (el) {
+        el.remove();
+      }
+    });
   }
 
   function updateVotes(upvoteElement, downvoteElement, data) {
@@ -271,16 +669,92 @@
       });
   }
 
+  function registerServiceWorker() {
+    if ("serviceWorker" in navigator) {
+      navigator.serviceWorker.register("/sw.js").catch(function (err) {
+        console.log(`error registering service worker: ${err}`);
+      });
+    }
+  }
+
+  // Offer to subscribe to push notifications, if the browser supports them
+  // and the server has them enabled.
+  async function setupPushSubscribe() {
+    const btn = document.getElementById("push-subscribe");
+    if (!btn || !("serviceWorker" in navigator) || !("PushManager" in window)) {
+      return;
+    }
+    const rsp = await fetch("/api/push/key");
+    if (!rsp.ok) {
+      return; // push is not enabled on this server
+    }
+    const { publicKey } = await rsp.json();
+    const reg = await navigator.serviceWorker.ready;
+    if (await reg.pushManager.getSubscription()) {
+      return; // already subscribed
+    }
+    btn.hidden = false;
+    btn.addEventListener("click", async () => {
+      try {
+        const sub = await reg.pushManager.subscribe({
+          userVisibleOnly: true,
+          applicationServerKey: base64URLToBytes(publicKey),
+        });
+        const rsp = await fetch("/api/push/subscribe", {
+          method: "POST",
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify(sub.toJSON()),
+        });
+        if (!rsp.ok) {
+          throw new Error(await rsp.text());
+        }
+        btn.hidden = true;
+      } catch (err) {
+        alert(`error subscribing to notifications: ${err}`);
+      }
+    });
+  }
+
+  function base64URLToBytes(s) {
+    const b64 = s.replace(/-/g, "+").replace(/_/g, "/");
+    return Uint8Array.from(atob(b64), (c) => c.charCodeAt(0));
+  }
+
+  // The server shows times relative to now, with the time in UTC as a
+  // tooltip. Show the time in the viewer's own time zone instead.
+  function localizeTimes() {
+    for (const el of document.querySelectorAll("time[datetime]")) {
+      el.title = new Date(el.dateTime).toLocaleString();
+    }
+  }
+
   function setup() {
+    localizeTimes();
+    registerServiceWorker();
+    setupPushSubscribe();
     const page = document.body.getAttribute("id");
     switch (page) {
       case "templates":
       case "macros":
+        setupListPages();
+        setupOnboarding();
+        break;
+      case "user":
+      case "leaderboard":
         setupListPages();
         break;
       case "create":
         setupCreatePage();
         break;
+      case "moderation":
+        setupModerationPage();
+        break;
+      case "prefs":
+        setupPrefsPage();
+        break;
+      case "chat-link":
+        setupChatLinkPage();
+        break;
     }
   }
   setup();
@@ -0,0 +1,138 @@
+// Service worker for the installable tmemes web app.
+//
+// This caches the static "shell" of the UI so the app launches quickly, and
+// keeps a copy of recently-viewed pages to show when the network is not
+// available. It also implements the Web Share Target declared in the
+// manifest: a shared image is stashed in a cache and handed to the upload
+// page, so the user can review it before creating a template.
+
+const SHELL_CACHE = "tmemes-shell-v1";
+const PAGE_CACHE = "tmemes-pages-v1";
+const SHARE_CACHE = "tmemes-share";
+
+const SHELL = [
+  "/static/style.css",
+  "/static/script.js",
+  "/static/font/Oswald-SemiBold.ttf",
+  "/static/icon.svg",
+  "/static/manifest.webmanifest",
+];
+
+self.addEventListener("install", (event) => {
+  event.waitUntil(
+    caches
+      .open(SHELL_CACHE)
+      .then((cache) => cache.addAll(SHELL))
+      .then(() => self.skipWaiting())
+  );
+});
+
+self.addEventListener("activate", (event) => {
+  const keep = [SHELL_CACHE, PAGE_CACHE, SHARE_CACHE];
+  event.waitUntil(
+    caches
+      .keys()
+      .then((keys) =>
+        Promise.all(
+          keys.filter((k) => !keep.includes(k)).map((k) => caches.delete(k))
+        )
+      )
+      .then(() => self.clients.claim())
+  );
+});
+
+self.addEventListener("fetch", (event) => {
+  const req = event.request;
+  const url = new URL(req.url);
+  if (url.origin !== self.location.origin) {
+    return;
+  }
+  if (req.method === "POST" && url.pathname === "/share") {
+    event.respondWith(receiveShare(req));
+    return;
+  }
+  if (req.method !== "GET") {
+    return;
+  }
+  if (url.pathname.startsWith("/static/")) {
+    event.respondWith(staleWhileRevalidate(req));
+  } else if (req.mode === "navigate") {
+    event.respondWith(networkFirst(req));
+  }
+});
+
+// Serve static assets from the cache if possible, refreshing the cached copy
+// in the background.
+async function staleWhileRevalidate(req) {
+  const cache = await caches.open(SHELL_CACHE);
+  const cached = await cache.match(req);
+  const fresh = fetch(req).then((rsp) => {
+    if (rsp.ok) {
+      cache.put(req, rsp.clone());
+    }
+    return rsp;
+  });
+  return cached || fresh;
+}
+
+// Serve pages from the network, falling back to the last copy we saw.
+async function networkFirst(req) {
+  const cache = await caches.open(PAGE_CACHE);
+  try {
+    const rsp = await fetch(req);
+    if (rsp.ok) {
+      cache.put(req, rsp.clone());
+    }
+    return rsp;
+  } catch (err) {
+    const cached = await cache.match(req);
+    if (cached) {
+      return cached;
+    }
+    throw err;
+  }
+}
+
+// Stash a shared image and redirect to the upload page to finish the job.
+async function receiveShare(req) {
+  const form = await req.formData();
+  const file = form.get("image");
+  if (file) {
+    const cache = await caches.open(SHARE_CACHE);
+    await cache.put(
+      "/shared/image",
+      new Response(file, {
+        headers: {
+          "Content-Type": file.type,
+          "X-Filename": encodeURIComponent(file.name),
+          "X-Name": encodeURIComponent(form.get("name") || ""),
+        },
+      })
+    );
+  }
+  return Response.redirect("/upload?shared=1", 303);
+}
+
+// Show push notifications sent by the server (see push.go).
+self.addEventListener("push", (event) => {
+  let msg = { title: "tmemes", body: "" };
+  if (event.data) {
+    try {
+      msg = event.data.json();
+    } catch (err) {
+      msg.body = event.data.text();
+    }
+  }
+  event.waitUntil(
+    self.registration.showNotification(msg.title, {
+      body: msg.body,
+      icon: "/static/icon.svg",
+      data: { url: msg.url || "/" },
+    })
+  );
+});
+
+self.addEventListener("notificationclick", (event) => {
+  event.notification.close();
+  event.waitUntil(self.clients.openWindow(event.notification.data.url));
+});
@@ -0,0 +1,152 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/creachadair/mds/compare"
+	"github.com/tailscale/tmemes/store"
+	"golang.org/x/exp/slices"
+)
+
+// statsEntry is the view and render counts of one macro or template.
+type statsEntry struct {
+	ID int `json:"id"`
+	store.ContentStats
+}
+
+// serveAPIStats reports how often macros and templates have been viewed and
+// rendered.
+//
+// API: GET /api/stats/macro/:id
+// API: GET /api/stats/template/:id
+// API: GET /api/stats/top[?kind=K][&count=N]
+//
+// A view is a request for the content of a macro or template, including
+// thumbnails but not single frames; a render is a rendering generated for a
+// cache miss. The first two methods report {"id":N, "views":N, "renders":N}.
+// For a template, "renders" counts renderings of its macros, and the result
+// also has "macroViews", the total views of its macros.
+//
+// The top method reports the most viewed macros (kind=macro, the default) or
+// templates (kind=template), as {"kind":K, "top":[...]}, with up to count
+// (default 10) entries of the form above, most viewed first. Templates are
+// ranked by their views plus those of their macros. As for the leaderboard,
+// macros by users who have opted out of leaderboards are not included.
+func (s *tmemeServer) serveAPIStats(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-stats", 1)
+	const apiPath = "/api/stats/"
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var rsp any
+	kind, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, apiPath), "/")
+	switch kind {
+	case "macro", "template":
+		idInt, err := strconv.Atoi(id)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		cs, err := s.contentStats(r, kind, idInt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		rsp = statsEntry{ID: idInt, ContentStats: cs}
+	case "top":
+		if id != "" {
+			http.Error(w, "invalid path", http.StatusBadRequest)
+			return
+		}
+		kind := r.FormValue("kind")
+		if kind == "" {
+			kind = "macro"
+		} else if kind != "macro" && kind != "template" {
+			http.Error(w, fmt.Sprintf("invalid kind %q", kind), http.StatusBadRequest)
+			return
+		}
+		count := 10
+		if v := r.FormValue("count"); v != "" {
+			var err error
+			count, err = strconv.Atoi(v)
+			if err != nil || count <= 0 {
+				http.Error(w, "invalid count", http.StatusBadRequest)
+				return
+			}
+			count = min(count, 100)
+		}
+		top := s.mostViewed(kind)
+		rsp = struct {
+			K string       `json:"kind"`
+			T []statsEntry `json:"top"`
+		}{K: kind, T: top[:min(len(top), count)]}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// contentStats returns the counts for the macro or template (according to
+// kind) with the given ID, if the caller of r can see it.
+func (s *tmemeServer) contentStats(r *http.Request, kind string, id int) (store.ContentStats, error) {
+	if kind == "template" {
+		if _, err := s.db.Template(id); err != nil {
+			return store.ContentStats{}, err
+		}
+		return s.db.TemplateStats(id)
+	}
+	m, err := s.db.Macro(id)
+	if err != nil {
+		return store.ContentStats{}, err
+	} else if !s.canViewMacro(r, m) {
+		return store.ContentStats{}, fmt.Errorf("macro %d not found", id)
+	}
+	return s.db.MacroStats(id)
+}
+
+// mostViewed returns the counts for the visible macros or templates
+// (according to kind) that have been viewed, most viewed first. The result is
+// never nil.
+func (s *tmemeServer) mostViewed(kind string) []statsEntry {
+	out := []statsEntry{}
+	if kind == "template" {
+		stats := s.db.AllTemplateStats()
+		for _, t := range s.db.Templates() {
+			if cs := stats[t.ID]; cs.Views+cs.MacroViews > 0 {
+				out = append(out, statsEntry{ID: t.ID, ContentStats: cs})
+			}
+		}
+	} else {
+		stats := s.db.AllMacroStats()
+		for _, m := range s.db.Macros() {
+			if m.Creator > 0 && !s.onLeaderboard(m.Creator) {
+				continue
+			}
+			if cs := stats[m.ID]; cs.Views > 0 {
+				out = append(out, statsEntry{ID: m.ID, ContentStats: cs})
+			}
+		}
+	}
+	slices.SortFunc(out, compare.FromLessFunc(func(a, b statsEntry) bool {
+		va, vb := a.Views+a.MacroViews, b.Views+b.MacroViews
+		if va == vb {
+			return a.ID < b.ID
+		}
+		return va > vb
+	}))
+	return out
+}
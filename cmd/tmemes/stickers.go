@@ -0,0 +1,253 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/memedraw"
+)
+
+// Stickers.
+//
+// A sticker is a small PNG image that macros can paste onto their template as
+// an image overlay. Stickers are uploaded separately from macros, and any
+// number of macros may use the same sticker. Like templates, stickers are
+// never modified once uploaded, so their content is cached indefinitely.
+
+const (
+	// maxStickerBytes is the size limit for a sticker image file.
+	maxStickerBytes = 512 << 10
+
+	// maxStickerDim is the largest width or height allowed for a sticker.
+	maxStickerDim = 1024
+)
+
+// loadStickers decodes the images for the stickers used by the image overlays
+// of m.
+func (s *tmemeServer) loadStickers(m *tmemes.Macro) (memedraw.Stickers, error) {
+	if len(m.ImageOverlay) == 0 {
+		return nil, nil
+	}
+	ss := make(memedraw.Stickers)
+	for _, o := range m.ImageOverlay {
+		if _, ok := ss[o.Sticker]; ok {
+			continue
+		}
+		sp, err := s.db.StickerPath(o.Sticker)
+		if err != nil {
+			return nil, err
+		}
+		img, err := s.decodePNG(sp)
+		if err != nil {
+			return nil, fmt.Errorf("sticker %d: %w", o.Sticker, err)
+		}
+		ss[o.Sticker] = img
+	}
+	return ss, nil
+}
+
+func (s *tmemeServer) decodePNG(path string) (image.Image, error) {
+	f, err := s.db.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// checkStickers reports an error if any of overlays refers to a sticker that
+// does not exist.
+func (s *tmemeServer) checkStickers(overlays []tmemes.ImageOverlay) error {
+	for _, o := range overlays {
+		if _, err := s.db.Sticker(o.Sticker); err != nil {
+			return fmt.Errorf("unknown sticker %d", o.Sticker)
+		}
+	}
+	return nil
+}
+
+// stickerEtags returns the Etags of the sticker files used by m, in the order
+// of its image overlays.
+func (s *tmemeServer) stickerEtags(m *tmemes.Macro) ([]string, error) {
+	var tags []string
+	for _, o := range m.ImageOverlay {
+		sp, err := s.db.StickerPath(o.Sticker)
+		if err != nil {
+			return nil, err
+		}
+		tag, ok := s.imageFileEtags.Load(sp)
+		if !ok {
+			t, err := s.fileEtag(sp)
+			if err != nil {
+				return nil, fmt.Errorf("sticker %d: %w", o.Sticker, err)
+			}
+			s.imageFileEtags.Store(sp, t)
+			tag = t
+		}
+		tags = append(tags, tag.(string))
+	}
+	return tags, nil
+}
+
+// serveAPISticker lists, fetches, and uploads stickers.
+//
+// API: GET /api/sticker
+// API: GET /api/sticker/:id
+// API: POST /api/sticker
+//
+// A list is reported as {"stickers":[...]}, newest first. To upload, post a
+// multipart form with a PNG "image" file of at most 512 KiB and 1024×1024
+// pixels. Set "anon" to true to upload without attribution, if the server
+// allows it. The result is the new sticker.
+func (s *tmemeServer) serveAPISticker(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-sticker", 1)
+	switch r.Method {
+	case "GET":
+		s.serveAPIStickerGet(w, r)
+	case "POST":
+		s.serveAPIStickerPost(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *tmemeServer) serveAPIStickerGet(w http.ResponseWriter, r *http.Request) {
+	st, ok, err := getSingleFromIDInPath(r.URL.Path, "api/sticker", s.db.Sticker)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var v any = st
+	if !ok {
+		all, err := s.db.Stickers()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v = struct {
+			S []*tmemes.Sticker `json:"stickers"`
+		}{S: all}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *tmemeServer) serveAPIStickerPost(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/sticker" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkAccess(w, r, "upload stickers")
+	if whois == nil {
+		return // error already sent
+	}
+	if !s.checkRateLimit(w, whois.UserProfile.ID) {
+		return // error already sent
+	}
+
+	st := &tmemes.Sticker{Creator: whois.UserProfile.ID}
+	if anon := r.FormValue("anon"); anon != "" {
+		anonBool, err := strconv.ParseBool(anon)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if anonBool {
+			if !s.allowAnonymous {
+				http.Error(w, "anonymous stickers not allowed", http.StatusUnauthorized)
+				return
+			}
+			st.Creator = -1
+		}
+	}
+
+	img, header, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer img.Close()
+	if !strings.EqualFold(filepath.Ext(header.Filename), ".png") {
+		http.Error(w, "stickers must be PNG images", http.StatusBadRequest)
+		return
+	} else if header.Size > maxStickerBytes {
+		http.Error(w, fmt.Sprintf("sticker too large (limit %d KiB)", maxStickerBytes>>10), http.StatusBadRequest)
+		return
+	}
+	cfg, err := png.DecodeConfig(img)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if cfg.Width > maxStickerDim || cfg.Height > maxStickerDim {
+		http.Error(w, fmt.Sprintf("sticker too large (limit %d×%d pixels)", maxStickerDim, maxStickerDim),
+			http.StatusBadRequest)
+		return
+	} else if cfg.Width == 0 || cfg.Height == 0 {
+		http.Error(w, "sticker is empty", http.StatusBadRequest)
+		return
+	}
+	if _, err := img.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	st.Width, st.Height = cfg.Width, cfg.Height
+	if err := s.db.AddSticker(st, "png", img); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logEvent(whois.UserProfile.ID, "create", "sticker", st.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveContentSticker serves the image file for a sticker.
+//
+// API: /content/sticker/:id[.png]
+func (s *tmemeServer) serveContentSticker(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("content-sticker", 1)
+	const apiPath = "/content/sticker/"
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiPath), ".png")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	sp, err := s.db.StickerPath(idInt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(sp); errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("sticker %d image is missing", idInt), http.StatusNotFound)
+		return
+	}
+	s.serveFileCached(w, r, sp, cacheControl(365*24*time.Hour, false))
+}
@@ -0,0 +1,254 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/memedraw"
+	"github.com/tailscale/tmemes/store"
+)
+
+// Thumbnails.
+//
+// Template and macro images may be fetched scaled down to fit a given width
+// and/or height with the w and h query parameters, for example
+// /content/macro/5?w=300. Scaled images are cached in the thumbs directory of
+// the store, and are discarded by the cache cleaner like rendered macros.
+
+// maxThumbSize is the largest width or height that may be requested for a
+// thumbnail, in pixels.
+const maxThumbSize = 2048
+
+// thumbSize parses the w and h query parameters. It reports ok == false if
+// neither is set.
+func thumbSize(q url.Values) (width, height int, ok bool, err error) {
+	parse := func(name string) (int, error) {
+		s := q.Get(name)
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxThumbSize {
+			return 0, fmt.Errorf("invalid %s: must be from 1 to %d", name, maxThumbSize)
+		}
+		return n, nil
+	}
+	if width, err = parse("w"); err != nil {
+		return 0, 0, false, err
+	}
+	if height, err = parse("h"); err != nil {
+		return 0, 0, false, err
+	}
+	return width, height, width > 0 || height > 0, nil
+}
+
+// serveTemplateThumb serves the image of t scaled to fit within width ×
+// height pixels.
+func (s *tmemeServer) serveTemplateThumb(w http.ResponseWriter, r *http.Request, t *tmemes.Template, width, height int) {
+	serveMetrics.Add("content-thumb", 1)
+	cache := cacheControl(365*24*time.Hour, false)
+	path, err := s.db.TemplateThumbPath(t, width, height)
+	if err != nil {
+		// Without a content hash there is no stable name to cache the
+		// thumbnail under, so fall back to the full image.
+		log.Printf("serving template %d at full size: %v", t.ID, err)
+		tp, err := s.db.TemplatePath(t.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		s.serveFileCached(w, r, tp, cache)
+		return
+	}
+	if err := s.generateThumb(path, func(dst io.Writer) error {
+		return s.chargeRender(r, func() error {
+			return s.drawThumb(dst, t.ID, nil, filepath.Ext(path), width, height, s.encodeSettings())
+		})
+	}); err != nil {
+		writeRenderError(w, err)
+		return
+	}
+	if _, ok := s.imageFileEtags.Load(path); !ok {
+		if tag, err := s.fileEtag(path); err == nil {
+			s.imageFileEtags.Store(path, tag)
+		}
+	}
+	s.serveFileCached(w, r, path, cache)
+}
+
+// serveMacroThumb serves the rendering of m described by key, encoded with
+// es, scaled to fit within width × height pixels.
+func (s *tmemeServer) serveMacroThumb(w http.ResponseWriter, r *http.Request, m *tmemes.Macro, key store.CacheKey, es encodeSettings, cache string, width, height int) {
+	serveMetrics.Add("content-thumb", 1)
+	key.Width, key.Height = width, height
+	path, err := s.db.MacroCachePath(m, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	base, err := s.macroEtag(m, path)
+	if err != nil {
+		writeRenderError(w, err)
+		return
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s thumb %dx%d", base, width, height)
+	if key.Encoding != "" {
+		fmt.Fprintf(h, " encoding %s", key.Encoding)
+	}
+	tag := formatEtag(h)
+	s.imageFileEtags.Store(path, tag)
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		macroMetrics.Add("not-modified", 1)
+		w.Header().Set("Cache-Control", cache)
+		w.Header().Set("Etag", tag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if err := s.generateThumb(path, func(dst io.Writer) error {
+		return s.chargeRender(r, func() error {
+			return s.drawThumb(dst, m.TemplateID, m, filepath.Ext(path), width, height, es)
+		})
+	}); err != nil {
+		writeRenderError(w, err)
+		return
+	}
+	s.serveFileCached(w, r, path, cache)
+}
+
+// generateThumb writes a thumbnail to path using draw, unless it is already
+// cached, sharing the work with any concurrent requests for the same path.
+func (s *tmemeServer) generateThumb(path string, draw func(io.Writer) error) error {
+	if _, err := os.Stat(path); err == nil {
+		macroMetrics.Add("thumb-cache-hit", 1)
+		return nil
+	}
+	_, err, _ := s.macroGenerationSingleFlight.Do(path, func() (_ string, retErr error) {
+		macroMetrics.Add("generate-thumb", 1)
+		// Write to a temporary file so that a concurrent reader never sees
+		// a partial image under the final name.
+		f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*"+filepath.Ext(path))
+		if err != nil {
+			return path, err
+		}
+		defer func() {
+			if retErr != nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}()
+		w := s.db.NewFileWriter(f, path)
+		if err := draw(w); err != nil {
+			return path, err
+		}
+		if err := w.Close(); err != nil {
+			return path, err
+		}
+		if err := os.Rename(f.Name(), path); err != nil {
+			return path, err
+		}
+		s.db.AddCached(path)
+		return path, nil
+	})
+	if err != nil {
+		log.Printf("error generating thumbnail %q: %v", filepath.Base(path), err)
+	}
+	return err
+}
+
+// drawThumb decodes the image of the template with the given ID, renders m
+// onto it if m != nil, and writes it to dst scaled to fit within width ×
+// height pixels, in the image format given by ext, with encoder settings es.
+func (s *tmemeServer) drawThumb(dst io.Writer, templateID int, m *tmemes.Macro, ext string, width, height int, es encodeSettings) error {
+	srcFile, err := s.openTemplateImage(templateID)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	if filepath.Ext(srcFile.Name()) == ".gif" {
+		srcGIF, err := gif.DecodeAll(srcFile)
+		if err != nil {
+			return err
+		} else if len(srcGIF.Image) == 0 {
+			return errors.New("no frames in GIF")
+		}
+		if m != nil {
+			ss, err := s.loadStickers(m)
+			if err != nil {
+				return err
+			}
+			memedraw.DrawGIF(srcGIF, m, ss)
+		}
+		thumb := memedraw.ThumbnailGIF(srcGIF, width, height)
+		switch ext {
+		case ".gif":
+			return gif.EncodeAll(dst, thumb)
+		case ".webp":
+			return memedraw.EncodeAnimatedWebP(dst, thumb)
+		default:
+			return fmt.Errorf("unknown extension: %v", ext)
+		}
+	}
+	if filepath.Ext(srcFile.Name()) == ".apng" {
+		a, err := memedraw.DecodeAPNG(srcFile)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			ss, err := s.loadStickers(m)
+			if err != nil {
+				return err
+			}
+			memedraw.DrawAPNG(a, m, ss)
+		}
+		thumb := memedraw.ThumbnailAPNG(a, width, height)
+		switch ext {
+		case ".apng":
+			return memedraw.EncodeAPNG(dst, thumb, es.pngEncoder().CompressionLevel)
+		case ".webp":
+			return memedraw.EncodeAPNGWebP(dst, thumb)
+		default:
+			return fmt.Errorf("unknown extension: %v", ext)
+		}
+	}
+
+	var img image.Image
+	if img, _, err = image.Decode(srcFile); err != nil {
+		return err
+	}
+	if m != nil {
+		ss, err := s.loadStickers(m)
+		if err != nil {
+			return err
+		}
+		img = memedraw.Draw(img, m, ss)
+	}
+	thumb := memedraw.Thumbnail(img, width, height)
+	switch ext {
+	case ".jpg", ".jpeg":
+		return jpeg.Encode(dst, thumb, es.jpegOptions())
+	case ".png":
+		return es.pngEncoder().Encode(dst, thumb)
+	case ".webp":
+		return memedraw.EncodeWebP(dst, thumb)
+	default:
+		return fmt.Errorf("unknown extension: %v", ext)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// API tokens.
+//
+// Requests from tagged nodes have no user identity, so scripts and CI jobs
+// running on them cannot use the API. Instead, a user can issue a token that
+// such a client presents as "Authorization: Bearer <token>", and the request
+// is treated as coming from that user, limited to the scopes of the token.
+
+// apiTokenPrefix marks API token secrets, to distinguish them from other
+// bearer tokens such as the trigger token.
+const apiTokenPrefix = "tmemes_"
+
+// maxTokenLifetime bounds the requested lifetime of a new token.
+const maxTokenLifetime = 366 * 24 * time.Hour
+
+// tokenScopes maps the operations named in calls to checkAccess to the token
+// scope that permits them. Operations not listed here cannot be done with a
+// token. The "read" operation covers every GET request (see limitTokenReads).
+var tokenScopes = map[string]string{
+	"read":             tmemes.ScopeRead,
+	"create macros":    tmemes.ScopeCreate,
+	"preview macros":   tmemes.ScopeCreate,
+	"create templates": tmemes.ScopeCreate,
+	"vote":             tmemes.ScopeVote,
+	"get votes":        tmemes.ScopeVote,
+	"delete votes":     tmemes.ScopeVote,
+}
+
+// requestAPIToken returns the API token secret presented by r, if any.
+func requestAPIToken(r *http.Request) (string, bool) {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !strings.HasPrefix(tok, apiTokenPrefix) {
+		return "", false
+	}
+	return tok, true
+}
+
+// limitTokenReads wraps h so that GET and HEAD requests presenting an API
+// token are refused unless the token has the read scope. Other requests are
+// checked by the handlers, which name what they do to checkAccess. Checking
+// on a chunked upload is part of creating a template, and is checked as that.
+func (s *tmemeServer) limitTokenReads(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isRead := (r.Method == "GET" || r.Method == "HEAD") && !strings.HasPrefix(r.URL.Path, "/api/upload/")
+		if _, ok := requestAPIToken(r); ok && isRead {
+			if s.checkAccess(w, r, "read") == nil {
+				return // error already sent
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// hashAPIToken returns the hash under which the token secret is stored.
+func hashAPIToken(secret string) []byte {
+	h := sha256.Sum256([]byte(secret))
+	return h[:]
+}
+
+// lookupAPIToken returns the unexpired token with the given secret.
+func (s *tmemeServer) lookupAPIToken(secret string) (*tmemes.APIToken, error) {
+	tok, err := s.db.APITokenByHash(hashAPIToken(secret))
+	if err != nil {
+		return nil, errors.New("invalid API token")
+	} else if tok.Expired(time.Now()) {
+		return nil, errors.New("API token has expired")
+	}
+	return tok, nil
+}
+
+// checkTokenAccess is the part of checkAccess for requests that present an API
+// token. If the token is valid and grants access to op, it returns whois data
+// for the user who issued it. Otherwise, it writes an error response to w and
+// returns nil.
+func (s *tmemeServer) checkTokenAccess(w http.ResponseWriter, secret, op string) *apitype.WhoIsResponse {
+	tok, err := s.lookupAPIToken(secret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+	scope, ok := tokenScopes[op]
+	if !ok {
+		http.Error(w, "API tokens cannot "+op, http.StatusForbidden)
+		return nil
+	} else if !tok.HasScope(scope) {
+		http.Error(w, fmt.Sprintf("API token lacks %q scope", scope), http.StatusForbidden)
+		return nil
+	}
+	serveMetrics.Add("api-token-auth", 1)
+	return tokenWhoIs(tok)
+}
+
+// tokenWhoIs returns synthetic whois data for a request authorized by tok.
+// The node is not the caller's; it names the token for logging.
+func tokenWhoIs(tok *tmemes.APIToken) *apitype.WhoIsResponse {
+	return &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{Name: fmt.Sprintf("api-token-%d", tok.ID)},
+		UserProfile: &tailcfg.UserProfile{
+			ID:          tok.UserID,
+			LoginName:   tok.LoginName,
+			DisplayName: tok.LoginName,
+		},
+	}
+}
+
+// serveAPIToken implements issuing, listing, and revoking API tokens. Tokens
+// cannot be used to manage other tokens.
+//
+// API: GET /api/token -- list the caller's tokens
+// API: POST /api/token -- issue a new token
+// API: DELETE /api/token/:id -- revoke a token
+//
+// The POST payload must be a JSON object with "scopes" (a list of "read",
+// "create", and "vote"), and optionally "name" and "expiresIn" (a duration
+// such as "720h"). The response is the new tmemes.APIToken with an additional
+// "secret" field, which is not retrievable later.
+func (s *tmemeServer) serveAPIToken(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-token", 1)
+	whois := s.checkAccess(w, r, "manage API tokens")
+	if whois == nil {
+		return // error already sent
+	}
+	uid := whois.UserProfile.ID
+
+	var result any
+	switch r.Method {
+	case "GET":
+		if r.URL.Path != "/api/token" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		toks, err := s.db.APITokens(uid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = toks
+	case "POST":
+		if r.URL.Path != "/api/token" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		var req struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			ExpiresIn string   `json:"expiresIn"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tok, secret, err := s.issueAPIToken(whois.UserProfile, req.Name, req.Scopes, req.ExpiresIn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result = struct {
+			*tmemes.APIToken
+			Secret string `json:"secret"`
+		}{tok, secret}
+	case "DELETE":
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/token/"))
+		if err != nil {
+			http.Error(w, "invalid token ID", http.StatusBadRequest)
+			return
+		}
+		if err := s.db.DeleteAPIToken(uid, id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		result = struct {
+			ID int `json:"id"`
+		}{id}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// issueAPIToken creates and stores a new token for the given user, and
+// returns it along with its secret.
+func (s *tmemeServer) issueAPIToken(up *tailcfg.UserProfile, name string, scopes []string, expiresIn string) (*tmemes.APIToken, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", errors.New("no scopes requested")
+	}
+	for _, sc := range scopes {
+		if !tmemes.ValidScope(sc) {
+			return nil, "", fmt.Errorf("invalid scope %q", sc)
+		}
+	}
+	tok := &tmemes.APIToken{
+		UserID:    up.ID,
+		LoginName: up.LoginName,
+		Name:      strings.TrimSpace(name),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	if expiresIn != "" {
+		d, err := time.ParseDuration(expiresIn)
+		if err != nil || d <= 0 || d > maxTokenLifetime {
+			return nil, "", fmt.Errorf("invalid expiresIn %q", expiresIn)
+		}
+		exp := tok.CreatedAt.Add(d)
+		tok.ExpiresAt = &exp
+	}
+
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, "", err
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(buf[:])
+	if err := s.db.AddAPIToken(tok, hashAPIToken(secret)); err != nil {
+		return nil, "", err
+	}
+	return tok, secret, nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
+	"tailscale.com/tailcfg"
+)
+
+func TestAPITokenAccess(t *testing.T) {
+	db, err := store.New(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+	s := &tmemeServer{db: db}
+	up := &tailcfg.UserProfile{ID: 42, LoginName: "alice@example.com"}
+
+	_, secret, err := s.issueAPIToken(up, "ci", []string{tmemes.ScopeCreate}, "1h")
+	if err != nil {
+		t.Fatalf("issueAPIToken: %v", err)
+	}
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		t.Errorf("Secret %q lacks prefix %q", secret, apiTokenPrefix)
+	}
+	expired := &tmemes.APIToken{
+		UserID:    up.ID,
+		LoginName: up.LoginName,
+		Scopes:    []string{tmemes.ScopeCreate},
+		CreatedAt: time.Now().Add(-2 * time.Hour),
+	}
+	exp := time.Now().Add(-time.Hour)
+	expired.ExpiresAt = &exp
+	const expiredSecret = apiTokenPrefix + "expired"
+	if err := db.AddAPIToken(expired, hashAPIToken(expiredSecret)); err != nil {
+		t.Fatalf("AddAPIToken: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		op       string
+		wantCode int    // 0 if access is granted
+		wantErr  string // if set, a substring of the error response
+	}{
+		{"granted", secret, "create macros", 0, ""},
+		{"other op in scope", secret, "create templates", 0, ""},
+		{"missing scope", secret, "vote", http.StatusForbidden, `lacks "vote" scope`},
+		{"missing read scope", secret, "read", http.StatusForbidden, `lacks "read" scope`},
+		{"op without scope", secret, "link a chat account", http.StatusForbidden, "API tokens cannot link a chat account"},
+		{"unknown token", apiTokenPrefix + "bogus", "create macros", http.StatusUnauthorized, "invalid API token"},
+		{"expired token", expiredSecret, "create macros", http.StatusUnauthorized, "expired"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("POST", "/api/macro", nil)
+		r.Header.Set("Authorization", "Bearer "+tc.secret)
+		w := httptest.NewRecorder()
+		whois := s.checkAccess(w, r, tc.op)
+		if tc.wantCode == 0 {
+			if whois == nil {
+				t.Errorf("%s: denied: %d %s", tc.name, w.Code, w.Body)
+			} else if whois.UserProfile.ID != up.ID || whois.UserProfile.LoginName != up.LoginName {
+				t.Errorf("%s: got user %+v, want %+v", tc.name, whois.UserProfile, up)
+			}
+			continue
+		}
+		if whois != nil {
+			t.Errorf("%s: granted, want %d", tc.name, tc.wantCode)
+		} else if w.Code != tc.wantCode || !strings.Contains(w.Body.String(), tc.wantErr) {
+			t.Errorf("%s: got %d %q, want %d %q", tc.name, w.Code, w.Body, tc.wantCode, tc.wantErr)
+		}
+	}
+}
+
+func TestIssueAPITokenErrors(t *testing.T) {
+	s := &tmemeServer{}
+	up := &tailcfg.UserProfile{ID: 42, LoginName: "alice@example.com"}
+	tests := []struct {
+		scopes    []string
+		expiresIn string
+		wantErr   string
+	}{
+		{nil, "", "no scopes"},
+		{[]string{"create", "admin"}, "", `invalid scope "admin"`},
+		{[]string{"read"}, "soon", "invalid expiresIn"},
+		{[]string{"read"}, "-1h", "invalid expiresIn"},
+		{[]string{"read"}, "9000h", "invalid expiresIn"},
+	}
+	for _, tc := range tests {
+		_, _, err := s.issueAPIToken(up, "", tc.scopes, tc.expiresIn)
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("Issue %q %q: got error %v, want %q", tc.scopes, tc.expiresIn, err, tc.wantErr)
+		}
+	}
+}
+
+func TestRequestAPIToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		ok     bool
+	}{
+		{"Bearer tmemes_abc", "tmemes_abc", true},
+		{"Bearer trigger-token", "", false},
+		{"Basic tmemes_abc", "", false},
+		{"", "", false},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("GET", "/api/macro", nil)
+		r.Header.Set("Authorization", tc.header)
+		if got, ok := requestAPIToken(r); got != tc.want || ok != tc.ok {
+			t.Errorf("Token of %q: got %q, %v; want %q, %v", tc.header, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestLimitTokenReads(t *testing.T) {
+	db, err := store.New(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+	s := &tmemeServer{db: db}
+	up := &tailcfg.UserProfile{ID: 42, LoginName: "alice@example.com"}
+	_, createOnly, err := s.issueAPIToken(up, "", []string{tmemes.ScopeCreate}, "")
+	if err != nil {
+		t.Fatalf("issueAPIToken: %v", err)
+	}
+	_, reader, err := s.issueAPIToken(up, "", []string{tmemes.ScopeRead}, "")
+	if err != nil {
+		t.Fatalf("issueAPIToken: %v", err)
+	}
+
+	h := s.limitTokenReads(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot) // reached the handler
+	}))
+	tests := []struct {
+		method, path, secret string
+		want                 int
+	}{
+		{"GET", "/api/macro", reader, http.StatusTeapot},
+		{"HEAD", "/content/macro/1.png", reader, http.StatusTeapot},
+		{"GET", "/api/macro", createOnly, http.StatusForbidden},
+		{"GET", "/content/macro/1.png", createOnly, http.StatusForbidden},
+		{"GET", "/api/vote", createOnly, http.StatusForbidden},
+		{"GET", "/api/macro", apiTokenPrefix + "bogus", http.StatusUnauthorized},
+		{"GET", "/api/upload/abc", createOnly, http.StatusTeapot}, // checked as creating
+		{"POST", "/api/macro", createOnly, http.StatusTeapot},     // checked by the handler
+		{"POST", "/api/macro", reader, http.StatusTeapot},
+		{"GET", "/api/macro", "", http.StatusTeapot}, // no token
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.secret != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %s: got %d %q, want %d", tc.method, tc.path, w.Code, w.Body, tc.want)
+		}
+	}
+}
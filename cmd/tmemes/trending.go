@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/creachadair/mds/compare"
+	"github.com/tailscale/tmemes"
+	"golang.org/x/exp/slices"
+)
+
+// The "trending" sort order ranks macros by their recent views and votes,
+// each weighted so that it counts half as much after every
+// store.TrendHalfLife. Unlike "score", it notices macros that many people
+// look at without voting, and an old macro that becomes popular again rises
+// as quickly as a new one. Scores are recomputed in the background, since
+// doing so reads all the votes.
+const (
+	trendingInterval   = time.Minute // how often to recompute scores
+	trendingVoteWeight = 10          // how many views a net vote counts as
+)
+
+// updateTrendingPeriodically recomputes the scores for the "trending" sort
+// order every trendingInterval, starting right away.
+func (s *tmemeServer) updateTrendingPeriodically() {
+	t := time.NewTicker(trendingInterval)
+	defer t.Stop()
+	for {
+		if err := s.updateTrending(); err != nil {
+			log.Printf("WARNING: computing trending scores: %v", err)
+		}
+		<-t.C
+	}
+}
+
+// updateTrending recomputes the scores for the "trending" sort order.
+func (s *tmemeServer) updateTrending() error {
+	votes, err := s.db.TrendingVotes()
+	if err != nil {
+		return err
+	}
+	scores := s.db.TrendingViews()
+	for id, v := range votes {
+		scores[id] += trendingVoteWeight * v
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trending = scores
+	return nil
+}
+
+// sortMacrosByTrending sorts macros in decreasing order of their most
+// recently computed trending scores, breaking ties by recency.
+func (s *tmemeServer) sortMacrosByTrending(ms []*tmemes.Macro) {
+	s.mu.Lock()
+	scores := s.trending // replaced, not modified, by updateTrending
+	s.mu.Unlock()
+	slices.SortFunc(ms, compare.FromLessFunc(func(a, b *tmemes.Macro) bool {
+		sa, sb := scores[a.ID], scores[b.ID]
+		if sa == sb {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return sa > sb
+	}))
+}
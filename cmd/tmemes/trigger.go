@@ -0,0 +1,227 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creachadair/mds/compare"
+	"github.com/tailscale/tmemes"
+	"golang.org/x/exp/slices"
+)
+
+// Polling triggers for automation services like Zapier and IFTTT.
+//
+// These services periodically poll an endpoint and treat each object in the
+// response array with an unseen "id" as a new event. To make that work well,
+// trigger responses are always plain JSON arrays in a stable order (newest
+// or best first), and support a "since" parameter so a poller can fetch only
+// items it has not already seen.
+
+const (
+	defaultTriggerLimit = 50
+	maxTriggerLimit     = 100
+)
+
+// triggerMacro is the representation of a macro in a trigger response.
+type triggerMacro struct {
+	*tmemes.Macro
+	CreatorName string `json:"creatorName"`
+	ImageURL    string `json:"imageURL"`
+	PageURL     string `json:"pageURL"`
+}
+
+// triggerTemplate is the representation of a template in a trigger response.
+type triggerTemplate struct {
+	*tmemes.Template
+	ImageURL  string `json:"imageURL"`
+	CreateURL string `json:"createURL"`
+}
+
+// serveAPITrigger implements the polling triggers.
+//
+// API: GET /api/trigger/macro[?since=ID][&limit=N]                -- new macros
+// API: GET /api/trigger/template[?since=ID][&limit=N]             -- new templates
+// API: GET /api/trigger/top-macro[?since=ID][&limit=N][&window=D] -- top macros
+//
+// Each reports a JSON array of objects with an "id", newest or best first.
+// If the server has a trigger token, it must be given as a bearer token or
+// as the token parameter.
+func (s *tmemeServer) serveAPITrigger(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-trigger", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.checkTriggerToken(w, r) {
+		return // error already sent
+	}
+	since, limit, err := parseTriggerOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var rsp any
+	switch kind := strings.TrimPrefix(r.URL.Path, "/api/trigger/"); kind {
+	case "macro":
+		rsp = s.triggerNewMacros(r, since, limit)
+	case "template":
+		rsp = s.triggerNewTemplates(r, since, limit)
+	case "top-macro":
+		window := 24 * time.Hour
+		if v := r.FormValue("window"); v != "" {
+			window, err = time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid window: %v", err), http.StatusBadRequest)
+				return
+			} else if window <= 0 {
+				http.Error(w, "window must be positive", http.StatusBadRequest)
+				return
+			}
+		}
+		rsp = s.triggerTopMacros(r, window, since, limit)
+	default:
+		http.Error(w, "unknown trigger: "+kind, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// checkTriggerToken checks that the request carries the trigger token, if
+// one is configured. If not, it writes an error response to w and returns
+// false. The token may be sent as a bearer token in the Authorization header,
+// or in the "token" query parameter for services that cannot set headers.
+func (s *tmemeServer) checkTriggerToken(w http.ResponseWriter, r *http.Request) bool {
+	if s.triggerToken == "" {
+		return true
+	}
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		tok = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(tok), []byte(s.triggerToken)) != 1 {
+		http.Error(w, "invalid trigger token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// parseTriggerOptions parses the "since" and "limit" query parameters for a
+// trigger request. If since is absent it is 0, so all items are eligible. If
+// limit is absent, a default is chosen.
+func parseTriggerOptions(r *http.Request) (since, limit int, _ error) {
+	limit = defaultTriggerLimit
+	if v := r.FormValue("since"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid since: %w", err)
+		} else if n < 0 {
+			return 0, 0, errors.New("since must be non-negative")
+		}
+		since = n
+	}
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid limit: %w", err)
+		} else if n <= 0 {
+			return 0, 0, errors.New("limit must be positive")
+		}
+		limit = min(n, maxTriggerLimit)
+	}
+	return since, limit, nil
+}
+
+// triggerNewMacros returns up to limit macros with ID greater than since,
+// ordered from newest to oldest.
+func (s *tmemeServer) triggerNewMacros(r *http.Request, since, limit int) []triggerMacro {
+	out := []triggerMacro{} // N.B. not nil, pollers want an empty array
+	all := s.db.Macros()
+	for i := len(all) - 1; i >= 0 && len(out) < limit; i-- {
+		if all[i].ID <= since {
+			break // IDs are ascending, so nothing older qualifies
+		}
+		out = append(out, s.newTriggerMacro(r, all[i]))
+	}
+	return out
+}
+
+// triggerNewTemplates returns up to limit templates with ID greater than
+// since, ordered from newest to oldest.
+func (s *tmemeServer) triggerNewTemplates(r *http.Request, since, limit int) []triggerTemplate {
+	out := []triggerTemplate{}
+	all := s.db.Templates()
+	for i := len(all) - 1; i >= 0 && len(out) < limit; i-- {
+		if all[i].ID <= since {
+			break
+		}
+		t := all[i]
+		out = append(out, triggerTemplate{
+			Template:  t,
+			ImageURL:  s.absURL(r, fmt.Sprintf("/content/template/%d%s", t.ID, filepath.Ext(t.Path))),
+			CreateURL: s.absURL(r, fmt.Sprintf("/create/%d", t.ID)),
+		})
+	}
+	return out
+}
+
+// triggerTopMacros returns up to limit of the most popular macros created
+// within the given window of time, best first. Only macros with a positive
+// net vote count are included, and as with the other triggers, since
+// excludes macros whose ID is not greater than it.
+func (s *tmemeServer) triggerTopMacros(r *http.Request, window time.Duration, since, limit int) []triggerMacro {
+	var top []*tmemes.Macro
+	for _, m := range s.db.Macros() {
+		if m.Creator > 0 && !s.onLeaderboard(m.Creator) {
+			continue // creator opted out of leaderboards
+		}
+		if m.ID > since && time.Since(m.CreatedAt) < window && m.Upvotes > m.Downvotes {
+			top = append(top, m)
+		}
+	}
+	// Order by net votes, breaking ties by ID (newest first) so the order is
+	// stable between polls.
+	slices.SortFunc(top, compare.FromLessFunc(func(a, b *tmemes.Macro) bool {
+		da, db := a.Upvotes-a.Downvotes, b.Upvotes-b.Downvotes
+		if da == db {
+			return a.ID > b.ID
+		}
+		return da > db
+	}))
+
+	out := []triggerMacro{}
+	for _, m := range top[:min(len(top), limit)] {
+		out = append(out, s.newTriggerMacro(r, m))
+	}
+	return out
+}
+
+func (s *tmemeServer) newTriggerMacro(r *http.Request, m *tmemes.Macro) triggerMacro {
+	ext := ".png"
+	if t, err := s.db.AnyTemplate(m.TemplateID); err == nil {
+		ext = s.db.MacroExt(t)
+	}
+	path := fmt.Sprintf("/content/macro/%d%s", m.ID, ext)
+	if m.Revision > 0 {
+		path += fmt.Sprintf("?rev=%d", m.Revision) // don't reuse stale images
+	}
+	return triggerMacro{
+		Macro:       m,
+		CreatorName: s.userDisplayName(r.Context(), m.Creator, m.CreatedAt),
+		ImageURL:    s.absURL(r, path),
+		PageURL:     s.absURL(r, fmt.Sprintf("/m/%d", m.ID)),
+	}
+}
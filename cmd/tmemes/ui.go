@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"mime"
 	"net/http"
 	"path/filepath"
 	"strconv"
@@ -19,6 +20,7 @@ import (
 
 	"github.com/creachadair/mds/compare"
 	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
 	"golang.org/x/exp/slices"
 	"tailscale.com/tailcfg"
 	"tailscale.com/words"
@@ -31,10 +33,15 @@ var uiFS embed.FS
 var staticFS embed.FS
 
 var ui = template.Must(template.New("ui").Funcs(template.FuncMap{
-	"timestamp": func(ts time.Time) string {
-		return ts.Local().Format(time.Stamp)
+	// Times are shown relative to now, with the time in UTC as a tooltip,
+	// which the script replaces with the time in the viewer's time zone.
+	"timestamp": func(ts time.Time) template.HTML {
+		return template.HTML(fmt.Sprintf(`<time datetime="%s" title="%s">%s</time>`,
+			ts.UTC().Format(time.RFC3339), ts.UTC().Format("Jan 2, 2006 15:04 MST"),
+			relativeTime(ts, time.Now())))
 	},
-	"add1": func(z int) int { return z + 1 },
+	"add1":     func(z int) int { return z + 1 },
+	"branding": brandingForUI,
 	"sub1": func(z int) int {
 		if z > 1 {
 			return z - 1
@@ -43,6 +50,11 @@ var ui = template.Must(template.New("ui").Funcs(template.FuncMap{
 	},
 }).ParseFS(uiFS, "ui/*.tmpl"))
 
+func init() {
+	// The standard library does not know about web app manifests.
+	mime.AddExtensionType(".webmanifest", "application/manifest+json")
+}
+
 // uiData is the value passed to HTML templates.
 type uiData struct {
 	Macros    []*uiMacro
@@ -55,6 +67,21 @@ type uiData struct {
 	CallerID      tailcfg.UserID
 	AllowAnon     bool
 	CallerIsAdmin bool
+	Query         string // search query, if any
+
+	Categories []*tmemes.Category // on the templates page
+	Category   string             // selected category, if any
+
+	User *userProfile // on a creator's profile page
+
+	ShowTour    bool         // show the getting-started tour
+	NoTemplates bool         // the server has no templates at all
+	NoMacros    bool         // the server has no visible macros at all
+	StarterPack *starterPack // offered to admins if there are no templates
+
+	Period   string               // on the leaderboard page
+	Periods  []string             // on the leaderboard page
+	Creators []leaderboardCreator // on the leaderboard page
 }
 
 type uiMacro struct {
@@ -66,20 +93,26 @@ type uiMacro struct {
 	ContextLink []tmemes.ContextLink
 	Upvoted     bool
 	Downvoted   bool
+	NoVote      bool   // the caller may not vote on this macro
+	TestActive  bool   // a caption test is running
+	RevealURL   string // for macros served blurred (see nsfw.go)
 }
 
 type uiTemplate struct {
 	*tmemes.Template
 	ImageURL    string
+	AudioURL    string // for audio templates
+	RevealURL   string // for templates served blurred (see nsfw.go)
 	Extension   string
 	CreatorName string
 	CreatorID   tailcfg.UserID
 	AllowAnon   bool
+	Similar     []*uiTemplate // populated on the create page
 }
 
 func (s *tmemeServer) newUITemplate(ctx context.Context, t *tmemes.Template) *uiTemplate {
 	ext := filepath.Ext(t.Path)
-	return &uiTemplate{
+	ut := &uiTemplate{
 		Template:    t,
 		ImageURL:    fmt.Sprintf("/content/template/%d%s", t.ID, ext),
 		Extension:   ext,
@@ -87,6 +120,13 @@ func (s *tmemeServer) newUITemplate(ctx context.Context, t *tmemes.Template) *ui
 		CreatorID:   t.Creator,
 		AllowAnon:   s.allowAnonymous,
 	}
+	if t.Audio != "" {
+		ut.AudioURL = fmt.Sprintf("/content/template/%d%s", t.ID, filepath.Ext(t.Audio))
+	}
+	if t.NSFW {
+		ut.RevealURL = revealURL(ut.ImageURL)
+	}
+	return ut
 }
 
 func (s *tmemeServer) newUIData(ctx context.Context, templates []*tmemes.Template, macros []*tmemes.Macro, caller tailcfg.UserID) *uiData {
@@ -120,15 +160,28 @@ func (s *tmemeServer) newUIData(ctx context.Context, templates []*tmemes.Templat
 		um := &uiMacro{
 			Macro:       m,
 			Template:    mt,
-			ImageURL:    fmt.Sprintf("/content/macro/%d%s", m.ID, mt.Extension),
+			ImageURL:    fmt.Sprintf("/content/macro/%d%s", m.ID, s.db.MacroExt(mt.Template)),
 			ContextLink: m.ContextLink,
 			CreatorName: s.userDisplayName(ctx, m.Creator, m.CreatedAt),
 			CreatorID:   m.Creator,
 		}
+		if m.CaptionTest.Active(time.Now()) {
+			um.ImageURL += fmt.Sprintf("?variant=%d", m.ViewerVariant(caller))
+			um.TestActive = true
+		} else if m.Revision > 0 {
+			// Give each revision a distinct URL, so that browsers do not show
+			// an image cached before the macro was edited.
+			um.ImageURL += fmt.Sprintf("?rev=%d", m.Revision)
+		}
+		if isNSFW(m, mt.Template) {
+			um.RevealURL = revealURL(um.ImageURL)
+		}
 		if vote > 0 {
 			um.Upvoted = true
 		} else if vote < 0 {
 			um.Downvoted = true
+		} else if m.Creator == caller && s.db.SelfVotes() == store.SelfVotesDeny {
+			um.NoVote = true
 		}
 		data.Macros = append(data.Macros, um)
 	}
@@ -154,9 +207,28 @@ func tailyScalyName(ts time.Time) string {
 }
 
 func (s *tmemeServer) userDisplayName(ctx context.Context, id tailcfg.UserID, ts time.Time) string {
+	name := s.userProfileName(ctx, id)
+	if name == "" {
+		return tailyScalyName(ts)
+	}
+	// Keep the search index up to date with how we show this user.
+	if err := s.db.SetCreatorName(id, name); err != nil {
+		log.Printf("WARNING: indexing name for user %d: %v", id, err)
+	}
+	return name
+}
+
+// userProfileName returns the name to show for the given user, or "" if the
+// user is unknown.
+func (s *tmemeServer) userProfileName(ctx context.Context, id tailcfg.UserID) string {
+	if id > 0 {
+		if h := s.db.UserPrefs(id).Handle; h != "" {
+			return h
+		}
+	}
 	p, err := s.userFromID(ctx, id)
 	if err != nil {
-		return tailyScalyName(ts)
+		return ""
 	} else if p.DisplayName != "" {
 		return p.DisplayName
 	}
@@ -168,7 +240,15 @@ func (s *tmemeServer) userIsAdmin(ctx context.Context, id tailcfg.UserID) bool {
 	if err != nil {
 		return false // fail closed
 	}
-	return s.superUser[p.LoginName]
+	return s.superUser[p.LoginName] || s.userHasGrant(id, capAdmin)
+}
+
+func (s *tmemeServer) userIsModerator(ctx context.Context, id tailcfg.UserID) bool {
+	if s.userIsAdmin(ctx, id) || s.userHasGrant(id, capModerate) {
+		return true
+	}
+	ok, err := s.db.IsModerator(id)
+	return err == nil && ok // fail closed
 }
 
 func getSingleFromIDInPath[T any](path, key string, f func(int) (T, error)) (T, bool, error) {
@@ -218,6 +298,13 @@ func (s *tmemeServer) serveUICreate(w http.ResponseWriter, r *http.Request) {
 
 func (s *tmemeServer) serveUICreateGet(w http.ResponseWriter, r *http.Request, t *tmemes.Template) {
 	template := s.newUITemplate(r.Context(), t)
+	if template.RevealURL != "" {
+		// The caller chose this template, so show it as it is.
+		template.ImageURL = template.RevealURL
+	}
+	for _, st := range s.similarTemplates(t.ImageHash, t.ID, 6) {
+		template.Similar = append(template.Similar, s.newUITemplate(r.Context(), st.Template))
+	}
 
 	var buf bytes.Buffer
 	if err := ui.ExecuteTemplate(&buf, "create.tmpl", template); err != nil {
@@ -234,7 +321,7 @@ type webTemplateData struct {
 
 func (s *tmemeServer) serveUICreatePost(w http.ResponseWriter, r *http.Request, t *tmemes.Template) {
 	// TODO: need to refactor out whois protection
-	whois, err := s.lc.WhoIs(r.Context(), r.RemoteAddr)
+	whois, err := s.whoIs(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -265,6 +352,14 @@ func (s *tmemeServer) serveUICreatePost(w http.ResponseWriter, r *http.Request,
 			return
 		}
 	}
+	if err := fillTextAreas(t, webData.Overlays); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkFonts(webData.Overlays); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	m := tmemes.Macro{
 		TemplateID:  t.ID,
@@ -285,6 +380,8 @@ func (s *tmemeServer) serveUICreatePost(w http.ResponseWriter, r *http.Request,
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	s.logEvent(whois.UserProfile.ID, "create", "macro", m.ID)
+	s.notifyTemplateUsed(&m)
 
 	created := struct {
 		CreatedID int `json:"createdId"`
@@ -318,6 +415,7 @@ func (s *tmemeServer) serveUITemplates(w http.ResponseWriter, r *http.Request) {
 		} else {
 			templates = s.db.Templates()
 		}
+		templates = filterCategory(r, templates)
 	} else {
 		templates = append(templates, t)
 	}
@@ -340,6 +438,13 @@ func (s *tmemeServer) serveUITemplates(w http.ResponseWriter, r *http.Request) {
 	data.Page = page
 	data.HasNextPage = !isLast
 	data.HasPrevPage = page > 1
+	s.addOnboarding(data)
+	data.Category = r.FormValue("category")
+	data.Categories, err = s.db.Categories()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	var buf bytes.Buffer
 	if err := ui.ExecuteTemplate(&buf, "templates.tmpl", data); err != nil {
@@ -351,9 +456,16 @@ func (s *tmemeServer) serveUITemplates(w http.ResponseWriter, r *http.Request) {
 
 func (s *tmemeServer) getCallerID(r *http.Request) tailcfg.UserID {
 	caller := tailcfg.UserID(-1)
-	whois, err := s.lc.WhoIs(r.Context(), r.RemoteAddr)
+	if secret, ok := requestAPIToken(r); ok {
+		if tok, err := s.lookupAPIToken(secret); err == nil && tok.HasScope(tmemes.ScopeRead) {
+			caller = tok.UserID
+		}
+		return caller
+	}
+	whois, err := s.whoIs(r)
 	if err == nil {
 		caller = whois.UserProfile.ID
+		s.noteGrants(whois)
 	}
 	return caller
 }
@@ -366,9 +478,17 @@ func (s *tmemeServer) serveUIMacros(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var macros []*tmemes.Macro
+	var listAll bool // listing all macros, rather than one or a search
+	query := r.URL.Query().Get("q")
 	if m, ok, err := getSingleFromIDInPath(r.URL.Path, "m", s.db.Macro); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
+	} else if query != "" {
+		macros, _, err = s.db.Search(query, 240)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	} else if !ok {
 		creator, err := creatorUserID(r)
 		if err != nil {
@@ -379,15 +499,22 @@ func (s *tmemeServer) serveUIMacros(w http.ResponseWriter, r *http.Request) {
 			macros = s.db.MacrosByCreator(creator)
 		} else {
 			macros = s.db.Macros()
+			listAll = true
 		}
+	} else if !s.canViewMacro(r, m) {
+		http.Error(w, fmt.Sprintf("macro %d not found", m.ID), http.StatusNotFound)
+		return
 	} else {
 		macros = append(macros, m)
 	}
 	defaultSort := "score"
+	if query != "" {
+		defaultSort = "id" // keep search results in order of relevance
+	}
 	if v := r.URL.Query().Get("sort"); v != "" {
 		defaultSort = v
 	}
-	if err := sortMacros(defaultSort, macros); err != nil {
+	if err := s.sortMacros(defaultSort, macros); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -403,9 +530,14 @@ func (s *tmemeServer) serveUIMacros(w http.ResponseWriter, r *http.Request) {
 	pageItems, isLast := slicePage(macros, page, count)
 
 	data := s.newUIData(r.Context(), s.db.Templates(), pageItems, s.getCallerID(r))
+	data.Query = query
 	data.Page = page
 	data.HasNextPage = !isLast
 	data.HasPrevPage = page > 1
+	if listAll {
+		s.addOnboarding(data)
+		data.NoMacros = len(macros) == 0
+	}
 
 	var buf bytes.Buffer
 	if err := ui.ExecuteTemplate(&buf, "macros.tmpl", data); err != nil {
@@ -429,3 +561,76 @@ func (s *tmemeServer) serveUIUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	buf.WriteTo(w)
 }
+
+// serveServiceWorker serves the service worker script for the installable web
+// app. It is served from the root rather than under /static/ so that its scope
+// covers the whole site.
+func (s *tmemeServer) serveServiceWorker(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("ui-service-worker", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFileFS(w, r, staticFS, "static/sw.js")
+}
+
+// serveUIShare is the Web Share Target declared by the web app manifest.
+// Normally the service worker intercepts shares and hands them to the upload
+// page; if it did not (e.g., it has not been installed yet), send the user to
+// the upload page to try again.
+func (s *tmemeServer) serveUIShare(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("ui-share", 1)
+	http.Redirect(w, r, "/upload", http.StatusSeeOther)
+}
+
+func (s *tmemeServer) serveUIModeration(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("ui-moderation", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkModerator(w, r, "moderate content")
+	if whois == nil {
+		return // error already sent
+	}
+	reports, err := s.db.Reports()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Reports []queuedReport
+		IsAdmin bool // only admins can delete content
+	}
+	data.IsAdmin = s.isAdmin(whois)
+	for _, rpt := range reports {
+		data.Reports = append(data.Reports, newQueuedReport(rpt))
+	}
+
+	var buf bytes.Buffer
+	if err := ui.ExecuteTemplate(&buf, "moderation.tmpl", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf.WriteTo(w)
+}
+
+func (s *tmemeServer) serveUIPrefs(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("ui-prefs", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	whois := s.checkAccess(w, r, "have preferences")
+	if whois == nil {
+		return // error already sent
+	}
+
+	var buf bytes.Buffer
+	if err := ui.ExecuteTemplate(&buf, "prefs.tmpl", s.db.UserPrefs(whois.UserProfile.ID)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf.WriteTo(w)
+}
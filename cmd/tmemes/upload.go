@@ -0,0 +1,341 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/tailcfg"
+)
+
+// Chunked uploads.
+//
+// Reverse proxies often limit request bodies to less than the largest GIF
+// templates, so a template image may also be uploaded in pieces. The client
+// starts an upload with POST /api/upload/start, giving the name and size of
+// the file, then sends its contents in order with PATCH /api/upload/:token,
+// each request saying at which offset its body starts. If a request fails,
+// the client asks how much arrived with GET /api/upload/:token and resumes
+// from there. When the last byte arrives, the template is created as for POST
+// /api/template. Video clips for video templates may be uploaded this way
+// too (see videotemplate.go).
+//
+// Partial uploads are kept in temporary files, as the standard library does
+// for multipart forms, and are discarded once untouched for uploadTTL. The
+// server forgets them when it restarts.
+
+const (
+	uploadTTL         = time.Hour
+	maxUploadsPerUser = 4       // unfinished uploads at a time
+	maxUploadChunk    = 8 << 20 // bytes per PATCH request
+	uploadFilePattern = "tmemes-upload-*"
+)
+
+// An upload is the state of a chunked upload.
+type upload struct {
+	token    string
+	user     tailcfg.UserID   // who started the upload
+	t        *tmemes.Template // the template to create, without its image
+	filename string
+	size     int64
+
+	mu       sync.Mutex // serializes chunks
+	f        *os.File   // nil once finished or discarded
+	received int64
+	touched  time.Time
+}
+
+// uploadStatus is the JSON form of an upload reported to the client.
+type uploadStatus struct {
+	Token    string           `json:"token"`
+	Size     int64            `json:"size"`
+	Received int64            `json:"received"`
+	Template *tmemes.Template `json:"template,omitempty"` // once finished
+}
+
+func (u *upload) status() uploadStatus {
+	return uploadStatus{Token: u.token, Size: u.size, Received: u.received}
+}
+
+// discard removes the partial file of u. The caller must hold u.mu.
+func (u *upload) discard() {
+	if u.f != nil {
+		u.f.Close()
+		os.Remove(u.f.Name())
+		u.f = nil
+	}
+}
+
+// serveAPIUpload implements chunked uploads of template images.
+//
+// API: POST /api/upload/start      -- start an upload
+// API: PATCH /api/upload/:token    -- add to an upload
+// API: GET /api/upload/:token      -- report the progress of an upload
+// API: DELETE /api/upload/:token   -- cancel an upload
+//
+// The payload for start must be JSON {"name":"...", "filename":"...",
+// "size":N, "anon":bool, "category":"..."}; the name, anon, and category are
+// as for POST /api/template, and the extension of the filename gives the
+// image format. The payload for PATCH is the next part of the file, at the
+// offset given by the Upload-Offset header, which must be the number of bytes
+// received so far.
+//
+// Each method reports {"token":"...", "size":N, "received":N}. The PATCH that
+// completes the file also creates the template, and adds it to the report as
+// "template". An upload can only be used by the user who started it.
+func (s *tmemeServer) serveAPIUpload(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-upload", 1)
+	whois := s.checkAccess(w, r, "create templates")
+	if whois == nil {
+		return // error already sent
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/api/upload/")
+	if token == "start" {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveAPIUploadStart(w, r, whois.UserProfile.ID)
+		return
+	}
+
+	s.mu.Lock()
+	u, ok := s.uploads[token]
+	s.mu.Unlock()
+	if !ok || u.user != whois.UserProfile.ID {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.f == nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeUploadStatus(w, http.StatusOK, u.status())
+	case "PATCH":
+		s.serveAPIUploadChunk(w, r, u)
+	case "DELETE":
+		s.removeUpload(u)
+		writeUploadStatus(w, http.StatusOK, u.status())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *tmemeServer) serveAPIUploadStart(w http.ResponseWriter, r *http.Request, user tailcfg.UserID) {
+	if !s.checkRateLimit(w, user) {
+		return // error already sent
+	}
+	var req struct {
+		templateUpload
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if req.URL != "" {
+		http.Error(w, "use POST /api/template to upload from a URL", http.StatusBadRequest)
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(req.Filename))
+	limit := maxImageBytes(ext)
+	if ext == ".png" {
+		// The image may be animated, which is not known until it is all
+		// here, and checked again.
+		limit = max(limit, maxImageBytes(".apng"))
+	}
+	if !slices.Contains(templateFormats, ext) && (*ffmpegPath == "" || !isVideoUpload(ext)) {
+		http.Error(w, "invalid image format", http.StatusBadRequest)
+		return
+	} else if req.Size <= 0 {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	} else if req.Size > limit {
+		http.Error(w, fmt.Sprintf("image too large (limit %d MiB)", limit>>20), http.StatusBadRequest)
+		return
+	}
+
+	t := &tmemes.Template{Name: req.Name, Creator: user}
+	if req.Anon {
+		if !s.allowAnonymous {
+			http.Error(w, "anonymous templates not allowed", http.StatusUnauthorized)
+			return
+		}
+		t.Creator = -1
+	}
+	if name := strings.TrimSpace(req.Category); name != "" {
+		c, err := s.db.Category(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.Category = c.Name
+	}
+
+	var tok [16]byte
+	if _, err := rand.Read(tok[:]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u := &upload{
+		token:    hex.EncodeToString(tok[:]),
+		user:     user,
+		t:        t,
+		filename: "upload" + ext,
+		size:     req.Size,
+		touched:  time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireUploadsLocked()
+	var n int
+	for _, v := range s.uploads {
+		if v.user == user {
+			n++
+		}
+	}
+	if n >= maxUploadsPerUser {
+		http.Error(w, fmt.Sprintf("too many unfinished uploads (limit %d)", maxUploadsPerUser), http.StatusTooManyRequests)
+		return
+	}
+	f, err := os.CreateTemp("", uploadFilePattern)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.f = f
+	if s.uploads == nil {
+		s.uploads = make(map[string]*upload)
+	}
+	s.uploads[u.token] = u
+	writeUploadStatus(w, http.StatusCreated, u.status())
+}
+
+// serveAPIUploadChunk adds the body of r to u, and creates the template once
+// the file is complete. The caller must hold u.mu.
+func (s *tmemeServer) serveAPIUploadChunk(w http.ResponseWriter, r *http.Request, u *upload) {
+	off, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	} else if off != u.received {
+		writeUploadStatus(w, http.StatusConflict, u.status())
+		return
+	} else if r.ContentLength > u.size-u.received {
+		http.Error(w, "upload is larger than its declared size", http.StatusBadRequest)
+		return
+	}
+	u.touched = time.Now()
+
+	// Keep whatever arrives, even if the request fails part way, so that the
+	// client can resume from there.
+	body := http.MaxBytesReader(w, r.Body, maxUploadChunk)
+	n, err := io.Copy(u.f, io.LimitReader(body, u.size-u.received))
+	u.received += n
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if extra, _ := body.Read(make([]byte, 1)); extra > 0 {
+		s.removeUpload(u)
+		http.Error(w, "upload is larger than its declared size", http.StatusBadRequest)
+		return
+	}
+	if u.received < u.size {
+		writeUploadStatus(w, http.StatusOK, u.status())
+		return
+	}
+
+	// The file is complete, so create the template. Whether or not that
+	// succeeds, the upload is finished.
+	defer s.removeUpload(u)
+	if _, err := u.f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t := u.t
+	filename, size, img := u.filename, u.size, io.ReadSeeker(u.f)
+	if isVideoUpload(filename) {
+		clip, err := convertVideo(u.f.Name())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filename, size, img = "video.gif", int64(len(clip)), bytes.NewReader(clip)
+	}
+	data, ext, err := s.checkTemplateImage(t, filename, size, img)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.addTemplate(t, ext, data); err != nil {
+		writeAddTemplateError(w, err)
+		return
+	}
+	s.logEvent(u.user, "create", "template", t.ID)
+	st := u.status()
+	st.Template = t
+	writeUploadStatus(w, http.StatusCreated, st)
+}
+
+// removeUpload discards u and forgets it. The caller must hold u.mu.
+func (s *tmemeServer) removeUpload(u *upload) {
+	u.discard()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, u.token)
+}
+
+// expireUploadsLocked discards the uploads untouched for uploadTTL. It skips
+// uploads busy with a chunk, which are not idle. The caller must hold s.mu.
+func (s *tmemeServer) expireUploadsLocked() {
+	for tok, u := range s.uploads {
+		if !u.mu.TryLock() {
+			continue
+		}
+		if time.Since(u.touched) > uploadTTL {
+			log.Printf("discarding abandoned upload of %d bytes", u.received)
+			u.discard()
+			delete(s.uploads, tok)
+		}
+		u.mu.Unlock()
+	}
+}
+
+func writeUploadStatus(w http.ResponseWriter, code int, st uploadStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(st)
+}
+
+// removeStaleUploadFiles removes the partial files of uploads abandoned by
+// earlier runs of the server.
+func removeStaleUploadFiles() {
+	paths, _ := filepath.Glob(filepath.Join(os.TempDir(), uploadFilePattern))
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > uploadTTL {
+			os.Remove(path)
+		}
+	}
+}
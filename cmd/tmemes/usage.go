@@ -0,0 +1,257 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/creachadair/mds/compare"
+	"golang.org/x/exp/slices"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// Per-user usage.
+//
+// To find the scripts and clients that load the server, and to tune rate
+// limits, the server counts the API and content requests made by each user
+// since it started, by route, along with the time spent rendering images on
+// their behalf. Requests using an API token are counted for the user who
+// issued it. Counts are kept only in memory.
+
+// userUsage is the usage of the server by one user.
+type userUsage struct {
+	UserID        tailcfg.UserID   `json:"userID"` // 0 if the caller is unknown
+	Name          string           `json:"name,omitempty"`
+	Requests      int64            `json:"requests"`
+	Errors        int64            `json:"errors"`      // responses with status 400 or more
+	RateLimited   int64            `json:"rateLimited"` // responses with status 429
+	Renders       int64            `json:"renders"`     // images rendered for the user
+	RenderSeconds float64          `json:"renderSeconds"`
+	Routes        map[string]int64 `json:"routes"` // requests by route pattern
+	LastSeen      time.Time        `json:"lastSeen"`
+}
+
+// usageTracker counts the usage of the server by user.
+type usageTracker struct {
+	since time.Time
+
+	mu    sync.Mutex
+	users map[tailcfg.UserID]*userUsage
+}
+
+// newUsageTracker constructs a usageTracker that starts counting now.
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		since: time.Now().UTC(),
+		users: make(map[tailcfg.UserID]*userUsage),
+	}
+}
+
+// userLocked returns the usage record for uid, creating it if necessary.
+func (u *usageTracker) userLocked(uid tailcfg.UserID) *userUsage {
+	uu, ok := u.users[uid]
+	if !ok {
+		uu = &userUsage{UserID: uid, Routes: make(map[string]int64)}
+		u.users[uid] = uu
+	}
+	return uu
+}
+
+// addRequest counts a request by uid to the given route, which received a
+// response with the given status.
+func (u *usageTracker) addRequest(uid tailcfg.UserID, route string, status int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	uu := u.userLocked(uid)
+	uu.Requests++
+	uu.Routes[route]++
+	if status >= 400 {
+		uu.Errors++
+	}
+	if status == http.StatusTooManyRequests {
+		uu.RateLimited++
+	}
+	uu.LastSeen = time.Now().UTC()
+}
+
+// addRender counts a rendering for uid that took d.
+func (u *usageTracker) addRender(uid tailcfg.UserID, d time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	uu := u.userLocked(uid)
+	uu.Renders++
+	uu.RenderSeconds += d.Seconds()
+}
+
+// report returns copies of the usage records of all users.
+func (u *usageTracker) report() []userUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	out := make([]userUsage, 0, len(u.users))
+	for _, uu := range u.users {
+		c := *uu
+		c.Routes = make(map[string]int64, len(uu.Routes))
+		for k, v := range uu.Routes {
+			c.Routes[k] = v
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// Context keys for the caller of a request, as identified by trackUsage.
+type (
+	usageUserKey struct{}
+	whoIsKey     struct{}
+)
+
+// trackUsage wraps h, whose routes are registered on mux, so that each
+// request is counted for its caller. The tailnet identity of the caller is
+// kept in the request context, so that handlers do not look it up again.
+func (s *tmemeServer) trackUsage(mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var uid tailcfg.UserID
+		ctx := r.Context()
+		if secret, ok := requestAPIToken(r); ok {
+			if tok, err := s.lookupAPIToken(secret); err == nil {
+				uid = tok.UserID
+			}
+		} else if whois, err := s.lc.WhoIs(ctx, s.callerAddr(r)); err == nil {
+			uid = whois.UserProfile.ID
+			ctx = context.WithValue(ctx, whoIsKey{}, whois)
+		}
+		r = r.WithContext(context.WithValue(ctx, usageUserKey{}, uid))
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "other"
+		}
+		uw := &usageWriter{ResponseWriter: w}
+		h.ServeHTTP(uw, r)
+		if uw.status == 0 {
+			uw.status = http.StatusOK
+		}
+		s.usage.addRequest(uid, route, uw.status)
+	})
+}
+
+// cachedWhoIs returns the identity of the caller of r recorded by
+// trackUsage, if any.
+func cachedWhoIs(r *http.Request) (*apitype.WhoIsResponse, bool) {
+	whois, ok := r.Context().Value(whoIsKey{}).(*apitype.WhoIsResponse)
+	return whois, ok
+}
+
+// chargeRender calls render, which renders an image for the caller of r, and
+// counts the time it takes toward the caller's usage.
+func (s *tmemeServer) chargeRender(r *http.Request, render func() error) error {
+	start := time.Now()
+	err := render()
+	uid, _ := r.Context().Value(usageUserKey{}).(tailcfg.UserID)
+	s.usage.addRender(uid, time.Since(start))
+	return err
+}
+
+// usageWriter is a http.ResponseWriter that records the status of the
+// response.
+type usageWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *usageWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *usageWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush supports streaming responses, such as /api/events.
+func (w *usageWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *usageWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// serveAPIAdminUsage reports the heaviest users of the server since it
+// started. Only server admins can use this method.
+//
+// API: GET /api/admin/usage[?sort=requests|render][&count=N]
+//
+// The result is {"since":time, "users":[...]}, with up to count (default 20)
+// entries, in decreasing order of requests (the default) or of render time.
+// Each entry is {"userID":N, "name":"...", "requests":N, "errors":N,
+// "rateLimited":N, "renders":N, "renderSeconds":F, "routes":{...},
+// "lastSeen":time}, where routes counts requests by the route pattern they
+// matched. Requests whose caller could not be identified are reported for
+// user ID 0.
+func (s *tmemeServer) serveAPIAdminUsage(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-usage", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.checkAdmin(w, r, "read usage") == nil {
+		return // error already sent
+	}
+	count := 20
+	if v := r.FormValue("count"); v != "" {
+		var err error
+		count, err = strconv.Atoi(v)
+		if err != nil || count <= 0 {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+	}
+	var key func(userUsage) float64
+	switch v := r.FormValue("sort"); v {
+	case "", "requests":
+		key = func(u userUsage) float64 { return float64(u.Requests) }
+	case "render":
+		key = func(u userUsage) float64 { return u.RenderSeconds }
+	default:
+		http.Error(w, fmt.Sprintf("invalid sort order %q", v), http.StatusBadRequest)
+		return
+	}
+
+	users := s.usage.report()
+	slices.SortFunc(users, compare.FromLessFunc(func(a, b userUsage) bool {
+		ka, kb := key(a), key(b)
+		if ka == kb {
+			return a.UserID < b.UserID
+		}
+		return ka > kb
+	}))
+	users = users[:min(len(users), count)]
+	for i, u := range users {
+		if u.UserID > 0 {
+			users[i].Name = s.userDisplayName(r.Context(), u.UserID, time.Time{})
+		}
+	}
+
+	rsp := struct {
+		S time.Time   `json:"since"`
+		U []userUsage `json:"users"`
+	}{S: s.usage.since, U: users}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
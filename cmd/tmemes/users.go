@@ -0,0 +1,262 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creachadair/mds/compare"
+	"github.com/tailscale/tmemes"
+	"golang.org/x/exp/slices"
+	"tailscale.com/tailcfg"
+)
+
+// Creator profiles.
+//
+// Each user who has created content has a profile at /u/:id, listing their
+// templates and macros along with their vote karma, the net votes on their
+// macros. The profile picture of a user, as reported by the tailnet, is
+// proxied through /content/avatar/:id, so that browsers need not reach the
+// identity provider hosting it, and kept in memory for avatarTTL.
+
+const (
+	avatarTTL          = time.Hour
+	avatarFetchTimeout = 10 * time.Second
+	maxAvatarBytes     = 1 << 20
+)
+
+// userProfile is the profile of a creator, as reported by /api/user/:id.
+type userProfile struct {
+	UserID    tailcfg.UserID     `json:"userID"`
+	Name      string             `json:"name"`
+	AvatarURL string             `json:"avatarURL,omitempty"`
+	Karma     *int               `json:"karma,omitempty"` // nil if the user is off leaderboards
+	Macros    []*tmemes.Macro    `json:"macros"`
+	Templates []*tmemes.Template `json:"templates"`
+}
+
+// userProfileFor returns the profile of the specified user, with their
+// visible macros and templates, newest first.
+func (s *tmemeServer) userProfileFor(ctx context.Context, id tailcfg.UserID) (*userProfile, error) {
+	if id <= 0 {
+		return nil, errNotFound
+	}
+	p := &userProfile{
+		UserID:    id,
+		Name:      s.userProfileName(ctx, id),
+		Macros:    s.db.MacrosByCreator(id),
+		Templates: s.db.TemplatesByCreator(id),
+	}
+	if p.Name == "" {
+		if len(p.Macros) == 0 && len(p.Templates) == 0 {
+			return nil, errNotFound
+		}
+		p.Name = fmt.Sprintf("User %d", id)
+	}
+	if up, err := s.userFromID(ctx, id); err == nil && up.ProfilePicURL != "" {
+		p.AvatarURL = fmt.Sprintf("/content/avatar/%d", id)
+	}
+	if s.onLeaderboard(id) {
+		karma := s.db.Karma()[id]
+		p.Karma = &karma
+	}
+	slices.SortFunc(p.Macros, compare.FromLessFunc(func(a, b *tmemes.Macro) bool {
+		return a.CreatedAt.After(b.CreatedAt)
+	}))
+	slices.SortFunc(p.Templates, compare.FromLessFunc(func(a, b *tmemes.Template) bool {
+		return a.CreatedAt.After(b.CreatedAt)
+	}))
+	if p.Macros == nil {
+		p.Macros = []*tmemes.Macro{}
+	}
+	if p.Templates == nil {
+		p.Templates = []*tmemes.Template{}
+	}
+	return p, nil
+}
+
+// parseUserID parses the user ID at the end of path, after prefix.
+func parseUserID(path, prefix string) (tailcfg.UserID, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(path, prefix), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errors.New("invalid user ID")
+	}
+	return tailcfg.UserID(id), nil
+}
+
+// serveAPIUser reports the profile of a creator.
+//
+// API: GET /api/user/:id
+//
+// The result is {"userID":N, "name":"...", "avatarURL":"...", "karma":N,
+// "macros":[...], "templates":[...]}, where the macros and templates are the
+// user's visible ones, newest first, and karma is the net votes on those
+// macros. The karma of users who have opted out of leaderboards is omitted,
+// as is the avatar URL of users without a profile picture.
+func (s *tmemeServer) serveAPIUser(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-user", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := parseUserID(r.URL.Path, "/api/user/")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := s.userProfileFor(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, fmt.Sprintf("user %d not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// avatar is a cached profile picture.
+type avatar struct {
+	url     string // where it was fetched from
+	data    []byte
+	ctype   string
+	fetched time.Time
+}
+
+// serveContentAvatar serves the profile picture of a user, fetched from the
+// URL in their tailnet profile.
+//
+// API: /content/avatar/:id
+func (s *tmemeServer) serveContentAvatar(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("content-avatar", 1)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := parseUserID(r.URL.Path, "/content/avatar/")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	up, err := s.userFromID(r.Context(), id)
+	if err != nil || up.ProfilePicURL == "" {
+		http.Error(w, "no profile picture", http.StatusNotFound)
+		return
+	}
+	a, err := s.loadAvatar(r.Context(), id, up.ProfilePicURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", a.ctype)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(avatarTTL.Seconds())))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", a.fetched, bytes.NewReader(a.data))
+}
+
+// loadAvatar returns the profile picture of the specified user at url, from
+// the cache if it is fresh, and otherwise by fetching it.
+func (s *tmemeServer) loadAvatar(ctx context.Context, id tailcfg.UserID, url string) (*avatar, error) {
+	s.mu.Lock()
+	a, ok := s.avatars[id]
+	s.mu.Unlock()
+	if ok && a.url == url && time.Since(a.fetched) < avatarTTL {
+		return a, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, avatarFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	} else if req.URL.Scheme != "https" && req.URL.Scheme != "http" {
+		return nil, fmt.Errorf("invalid profile picture URL scheme %q", req.URL.Scheme)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching profile picture: %s", rsp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, maxAvatarBytes+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxAvatarBytes {
+		return nil, errors.New("profile picture is too large")
+	}
+	ctype := http.DetectContentType(data)
+	if !strings.HasPrefix(ctype, "image/") {
+		return nil, fmt.Errorf("profile picture has unsupported type %q", ctype)
+	}
+
+	a = &avatar{url: url, data: data, ctype: ctype, fetched: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.avatars == nil {
+		s.avatars = make(map[tailcfg.UserID]*avatar)
+	}
+	s.avatars[id] = a
+	return a, nil
+}
+
+// serveUIUser serves the profile page of a creator.
+//
+// API: /u/:id
+func (s *tmemeServer) serveUIUser(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("ui-user", 1)
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := parseUserID(r.URL.Path, "/u/")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := s.userProfileFor(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, fmt.Sprintf("user %d not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page, count, err := parsePageOptions(r, 24)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if page < 0 {
+		page = 1
+	}
+	pageItems, isLast := slicePage(p.Macros, page, count)
+
+	data := s.newUIData(r.Context(), p.Templates, pageItems, s.getCallerID(r))
+	data.Page = page
+	data.HasNextPage = !isLast
+	data.HasPrevPage = page > 1
+	data.User = p
+
+	var buf bytes.Buffer
+	if err := ui.ExecuteTemplate(&buf, "user.tmpl", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf.WriteTo(w)
+}
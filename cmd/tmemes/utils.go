@@ -9,20 +9,24 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"log"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/creachadair/mds/compare"
 	"github.com/creachadair/mds/slice"
 	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/store"
 	"golang.org/x/exp/slices"
 )
 
 // sortMacros sorts a slice of macros in-place by the specified sorting key.
 // The only possible error is if the sort key is not understood.
-func sortMacros(key string, ms []*tmemes.Macro) error {
+func (s *tmemeServer) sortMacros(key string, ms []*tmemes.Macro) error {
 	// Check for sorting order.
 	switch key {
 	case "", "default", "id":
@@ -40,6 +44,63 @@ func sortMacros(key string, ms []*tmemes.Macro) error {
 		sortMacrosByPopularity(rest)
 	case "score":
 		sortMacrosByScore(ms)
+	case "views":
+		sortMacrosByViews(ms, s.db.AllMacroStats())
+	case "trending":
+		s.sortMacrosByTrending(ms)
+	default:
+		return fmt.Errorf("invalid sort order %q", key)
+	}
+	return nil
+}
+
+// relativeTime describes t relative to now, at a resolution suited to how far
+// apart they are, e.g., "just now", "3h ago", or "in 2d".
+func relativeTime(t, now time.Time) string {
+	const day = 24 * time.Hour
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+	var rel string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		rel = fmt.Sprintf("%dm", d/time.Minute)
+	case d < day:
+		rel = fmt.Sprintf("%dh", d/time.Hour)
+	case d < 30*day:
+		rel = fmt.Sprintf("%dd", d/day)
+	case d < 365*day:
+		rel = fmt.Sprintf("%dmo", d/(30*day))
+	default:
+		rel = fmt.Sprintf("%dy", d/(365*day))
+	}
+	if future {
+		return "in " + rel
+	}
+	return rel + " ago"
+}
+
+// sortTemplates sorts a slice of templates in-place by the specified sorting
+// key. The only possible error is if the sort key is not understood.
+func sortTemplates(key string, ts []*tmemes.Template) error {
+	switch key {
+	case "", "default", "id":
+		// nothing to do, this is the order we get from the database
+	case "recent":
+		slices.SortFunc(ts, compare.FromLessFunc(func(a, b *tmemes.Template) bool {
+			return a.CreatedAt.After(b.CreatedAt)
+		}))
+	case "popular":
+		slices.SortFunc(ts, compare.FromLessFunc(func(a, b *tmemes.Template) bool {
+			if a.MacroCount == b.MacroCount {
+				return a.CreatedAt.After(b.CreatedAt)
+			}
+			return a.MacroCount > b.MacroCount
+		}))
 	default:
 		return fmt.Errorf("invalid sort order %q", key)
 	}
@@ -52,18 +113,91 @@ func sortMacrosByRecency(ms []*tmemes.Macro) {
 	}))
 }
 
+// sortMacrosByViews sorts macros in decreasing order of their view counts in
+// stats, breaking ties by recency.
+func sortMacrosByViews(ms []*tmemes.Macro, stats map[int]store.ContentStats) {
+	slices.SortFunc(ms, compare.FromLessFunc(func(a, b *tmemes.Macro) bool {
+		va, vb := stats[a.ID].Views, stats[b.ID].Views
+		if va == vb {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return va > vb
+	}))
+}
+
+// Ranking methods for the "popular" sort order, selected by the
+// -popular-ranking flag.
+const (
+	rankNet    = "net"    // upvotes minus downvotes
+	rankWilson = "wilson" // lower bound of the Wilson score interval
+	rankBayes  = "bayes"  // upvote ratio, averaged with the overall ratio
+)
+
+// validRanking reports whether name is a known ranking method.
+func validRanking(name string) bool {
+	return name == rankNet || name == rankWilson || name == rankBayes
+}
+
+// sortMacrosByPopularity sorts macros in decreasing order of popularity under
+// the ranking method of the server, breaking ties by recency.
 func sortMacrosByPopularity(ms []*tmemes.Macro) {
-	// TODO: what should the definition of this be?
+	score := popularityScore(*popularRanking, ms)
 	slices.SortFunc(ms, compare.FromLessFunc(func(a, b *tmemes.Macro) bool {
-		da := a.Upvotes - a.Downvotes
-		db := b.Upvotes - b.Downvotes
-		if da == db {
+		sa, sb := score(a), score(b)
+		if sa == sb {
 			return a.CreatedAt.After(b.CreatedAt)
 		}
-		return da > db
+		return sa > sb
 	}))
 }
 
+// popularityScore returns a function that scores the popularity of macros
+// among ms under the named ranking method.
+//
+// The net vote count favours macros that have simply been seen by more
+// people, which on a large tailnet buries a new macro with 3 of 3 upvotes
+// under an old one with 40 of 45. The other methods rank by the fraction of
+// upvotes instead, discounted when there are few votes to go on: "wilson"
+// uses the lower bound of the 95% confidence interval for the fraction, and
+// "bayes" averages it with the fraction over all of ms, weighted by the mean
+// number of votes per macro.
+func popularityScore(ranking string, ms []*tmemes.Macro) func(*tmemes.Macro) float64 {
+	switch ranking {
+	case rankWilson:
+		return func(m *tmemes.Macro) float64 {
+			return wilsonLowerBound(m.Upvotes, m.Upvotes+m.Downvotes)
+		}
+	case rankBayes:
+		var up, votes int
+		for _, m := range ms {
+			up += m.Upvotes
+			votes += m.Upvotes + m.Downvotes
+		}
+		if votes == 0 {
+			break
+		}
+		// The prior is the mean number of votes per macro, all at the
+		// overall upvote ratio.
+		priorVotes := float64(votes) / float64(len(ms))
+		priorUp := float64(up) / float64(len(ms))
+		return func(m *tmemes.Macro) float64 {
+			return (priorUp + float64(m.Upvotes)) / (priorVotes + float64(m.Upvotes+m.Downvotes))
+		}
+	}
+	return func(m *tmemes.Macro) float64 { return float64(m.Upvotes - m.Downvotes) }
+}
+
+// wilsonLowerBound returns the lower bound of the Wilson score interval at 95%
+// confidence for a proportion of up out of n. It is 0 if n == 0.
+func wilsonLowerBound(up, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	const z = 1.96 // for 95% confidence
+	p, fn := float64(up)/float64(n), float64(n)
+	return (p + z*z/(2*fn) - z*math.Sqrt((p*(1-p)+z*z/(4*fn))/fn)) / (1 + z*z/fn)
+}
+
 // sortMacrosByScore sorts macros by a heuristic blended "score" that takes
 // into account both recency and popularity. The score favours macros that were
 // created very recently, but this bias degrades so that after a while
@@ -145,6 +279,18 @@ func slicePage[T any, S ~[]T](vs S, page, count int) (S, bool) {
 
 func formatEtag(h hash.Hash) string { return fmt.Sprintf(`"%x"`, h.Sum(nil)) }
 
+// etagMatches reports whether the value of an If-None-Match header matches
+// the given quoted etag. Weak tags are compared by their opaque value.
+func etagMatches(header, tag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 // newHashPipe returns a reader that delegates to r, and as a side-effect
 // writes everything successfully read from r as writes to h.
 func newHashPipe(r io.Reader, h hash.Hash) io.Reader { return hashPipe{r: r, h: h} }
@@ -160,10 +306,10 @@ func (h hashPipe) Read(data []byte) (int, error) {
 	return nr, err
 }
 
-// makeFileEtag returns a quoted Etag hash ("<hex>") for the specified file
-// path.
-func makeFileEtag(path string) (string, error) {
-	f, err := os.Open(path)
+// makeFileEtag returns a quoted Etag hash ("<hex>") for the contents of the
+// file of the store at path.
+func (s *tmemeServer) makeFileEtag(path string) (string, error) {
+	f, err := s.db.OpenFile(path)
 	if err != nil {
 		return "", err
 	}
@@ -175,6 +321,28 @@ func makeFileEtag(path string) (string, error) {
 	return formatEtag(etagHash), nil
 }
 
+// fileEtag returns the Etag for the file at path, as makeFileEtag does, but
+// reuses the value recorded in the store by an earlier call (including one
+// before a restart) if the size and modification time of the file have not
+// changed since.
+func (s *tmemeServer) fileEtag(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if tag, ok := s.db.FileEtag(path, fi); ok {
+		return tag, nil
+	}
+	tag, err := s.makeFileEtag(path)
+	if err != nil {
+		return "", err
+	}
+	if err := s.db.SaveFileEtag(path, fi, tag); err != nil {
+		log.Printf("WARNING: saving Etag of %q: %v (continuing)", path, err)
+	}
+	return tag, nil
+}
+
 // removeItem returns a copy of slice with index i removed.  The original slice
 // is not modified.
 func removeItem[T any, S ~[]T](slice S, i int) S {
@@ -0,0 +1,93 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/tailscale/tmemes"
+)
+
+// Video renderings.
+//
+// Large animated GIFs are slow to load, and many chat tools play video more
+// smoothly than GIFs. If the -ffmpeg flag is set, macros on GIF templates can
+// also be fetched as MP4 (H.264) or WebM (VP9) video, transcoded from the GIF
+// rendering by ffmpeg. These are cached like other renderings.
+
+// transcodeTimeout bounds the time ffmpeg may spend on one macro.
+const transcodeTimeout = 2 * time.Minute
+
+// A videoFormat describes how to encode a video rendering.
+type videoFormat struct {
+	mimeType string
+	muxer    string   // ffmpeg output format
+	args     []string // ffmpeg encoder options
+}
+
+// videoFormats maps the file extensions of video renderings to their formats.
+var videoFormats = map[string]videoFormat{
+	".mp4": {
+		mimeType: "video/mp4",
+		muxer:    "mp4",
+		args:     []string{"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-movflags", "+faststart"},
+	},
+	".webm": {
+		mimeType: "video/webm",
+		muxer:    "webm",
+		args:     []string{"-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "36"},
+	},
+}
+
+// transcodeMacro renders m, which must be on a GIF template, as a GIF and
+// pipes it through ffmpeg to write a video in format vf to cachePath.
+func (s *tmemeServer) transcodeMacro(m *tmemes.Macro, cachePath string, vf videoFormat) (retErr error) {
+	macroMetrics.Add("generate-video", 1)
+	start := time.Now()
+	tmp := cachePath + ".tmp"
+	defer func() {
+		if retErr != nil {
+			os.Remove(tmp)
+			log.Printf("error transcoding macro %d: %v", m.ID, retErr)
+		} else {
+			log.Printf("transcoded macro %d to %s in %v", m.ID, vf.muxer, time.Since(start).Round(time.Millisecond))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-f", "gif", "-i", "pipe:0",
+		// Most encoders and players require even dimensions with 4:2:0 chroma.
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2,format=yuv420p",
+		"-an",
+	}
+	args = append(args, vf.args...)
+	args = append(args, "-f", vf.muxer, "-y", tmp)
+	cmd := exec.CommandContext(ctx, *ffmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting ffmpeg: %w", err)
+	}
+	derr := s.drawMacro(in, m, ".gif", s.encodeSettings())
+	in.Close()
+	if err := cmd.Wait(); derr != nil {
+		return derr
+	} else if err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return s.db.SealFile(tmp, cachePath)
+}
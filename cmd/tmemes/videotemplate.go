@@ -0,0 +1,149 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/gif"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+	"github.com/tailscale/tmemes/memedraw"
+	"tailscale.com/tailcfg"
+)
+
+// Video templates.
+//
+// If the -ffmpeg flag is set, a short MP4 or WebM clip may be uploaded as a
+// template. The server converts it with ffmpeg to an animated GIF without
+// sound, at most videoMaxWidth pixels wide and videoFrameRate frames per
+// second, and stores that as the template image. From then on it is a GIF
+// template like any other, subject to the same limits on size, frames, and
+// duration. Clips longer than -max-video-seconds are rejected, and clips may
+// be as large as GIFs (-max-gif-size).
+
+// videoTemplateFormats are the file extensions accepted for video clips.
+var videoTemplateFormats = []string{".mp4", ".webm"}
+
+const (
+	videoFrameRate      = 15  // of the converted GIF, in frames per second
+	videoMaxWidth       = 480 // of the converted GIF, in pixels
+	videoConvertTimeout = 2 * time.Minute
+
+	// How much of a clip over the limit is converted, to tell whether the
+	// clip is too long.
+	videoLengthSlack = time.Second
+)
+
+// isVideoUpload reports whether filename names a video clip to be uploaded
+// as a template.
+func isVideoUpload(filename string) bool {
+	return slices.Contains(videoTemplateFormats, strings.ToLower(filepath.Ext(filename)))
+}
+
+// maxVideoDuration returns the longest clip accepted as a template, or 0 if
+// there is no limit.
+func maxVideoDuration() time.Duration {
+	return time.Duration(*maxVideoSeconds) * time.Second
+}
+
+// readVideoTemplate reads the video clip in r, whose name and size are
+// given, and returns it converted to a GIF for a template.
+func readVideoTemplate(filename string, size int64, r io.Reader) ([]byte, error) {
+	if *ffmpegPath == "" {
+		return nil, errors.New("video templates are not enabled")
+	} else if limit := maxImageBytes(".gif"); size > limit {
+		return nil, fmt.Errorf("video too large (limit %d MiB)", limit>>20)
+	}
+
+	// MP4 files may keep their index at the end, which ffmpeg must seek to,
+	// so the clip is given to it as a file rather than on a pipe.
+	f, err := os.CreateTemp("", "tmemes-video-*"+strings.ToLower(filepath.Ext(filename)))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return convertVideo(f.Name())
+}
+
+// convertVideo runs ffmpeg to convert the video clip in the file at path to
+// an animated GIF, and checks that the clip is not too long.
+func convertVideo(path string) ([]byte, error) {
+	if *ffmpegPath == "" {
+		return nil, errors.New("video templates are not enabled")
+	}
+	macroMetrics.Add("convert-video", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), videoConvertTimeout)
+	defer cancel()
+
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	limit := maxVideoDuration()
+	if limit > 0 {
+		// Read no more than needed to tell that the clip is too long.
+		args = append(args, "-t", strconv.FormatFloat((limit+videoLengthSlack).Seconds(), 'f', -1, 64))
+	}
+	// Make one palette for the whole clip, so colors do not flicker.
+	filter := fmt.Sprintf("fps=%d,scale='min(%d,iw)':-1:flags=lanczos,split[a][b];[a]palettegen=stats_mode=diff[p];[b][p]paletteuse=dither=bayer",
+		videoFrameRate, videoMaxWidth)
+	args = append(args, "-i", path, "-an", "-vf", filter, "-loop", "0", "-f", "gif", "pipe:1")
+
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, *ffmpegPath, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("invalid video clip: ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	} else if out.Len() == 0 {
+		return nil, errors.New("invalid video clip: ffmpeg produced no image")
+	}
+	if limit > 0 {
+		g, err := gif.DecodeAll(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("converting video: %w", err)
+		} else if memedraw.GIFDuration(g) > limit+videoLengthSlack/2 {
+			return nil, fmt.Errorf("video is too long (limit %v)", limit)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// addVideoTemplate adds t to the store as a template made from the video
+// clip in r, uploaded by actor with the given filename and size. On success,
+// it redirects the caller to the create page for the template.
+func (s *tmemeServer) addVideoTemplate(w http.ResponseWriter, r *http.Request, actor tailcfg.UserID, t *tmemes.Template, filename string, size int64, clip io.Reader) {
+	data, err := readVideoTemplate(filename, size, clip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	img, ext, err := s.checkTemplateImage(t, "video.gif", int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.addTemplate(t, ext, img); err != nil {
+		writeAddTemplateError(w, err)
+		return
+	}
+	s.logEvent(actor, "create", "template", t.ID)
+	http.Redirect(w, r, fmt.Sprintf("/create/%v", t.ID), http.StatusFound)
+}
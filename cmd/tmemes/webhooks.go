@@ -0,0 +1,328 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+)
+
+// Outbound webhooks.
+//
+// Server admins register webhook URLs with the /api/admin/webhooks endpoints,
+// each with the events it wants: macro.created, macro.deleted, or
+// vote.changed. A dispatcher watches the store for changes to macros, and
+// posts a webhookPayload for each to the webhooks that want it. Like the
+// digest, the payload has a "text" field understood by Slack incoming
+// webhooks and similar chat services.
+//
+// Each delivery is signed with the secret of the webhook, which is reported
+// to the admin only when the webhook is registered: the X-Tmemes-Signature
+// header is "sha256=" followed by the hex-encoded HMAC-SHA256 of the body.
+// Deliveries that fail with a network error, a 429, or a 5xx status are
+// retried with exponential backoff, and the outcome of the last delivery is
+// recorded with the webhook. Changes to hidden macros are not delivered.
+
+const (
+	webhookTimeout       = 30 * time.Second // for each delivery attempt
+	webhookAttempts      = 5                // per delivery, including the first
+	webhookBackoff       = 10 * time.Second // before the first retry, then doubled
+	maxWebhookDeliveries = 64               // in progress at once, including retries
+)
+
+// webhookSlots limits the number of deliveries in progress, so that a
+// webhook that is down cannot pile up goroutines without bound. Events for
+// which there is no slot are dropped.
+var webhookSlots = make(chan struct{}, maxWebhookDeliveries)
+
+// webhookEvents maps the types of store events to webhook events.
+var webhookEvents = map[string]string{
+	"create": tmemes.WebhookMacroCreated,
+	"delete": tmemes.WebhookMacroDeleted,
+	"vote":   tmemes.WebhookVoteChanged,
+}
+
+// webhookPayload is the message posted to a webhook.
+type webhookPayload struct {
+	Event    string    `json:"event"`
+	Delivery string    `json:"delivery"` // unique, and the same for each attempt
+	Time     time.Time `json:"time"`     // of the event
+	Text     string    `json:"text"`     // for Slack and similar services
+	Server   string    `json:"server"`   // the name of the server
+	MacroID  int       `json:"macroID"`
+
+	URL      string        `json:"url,omitempty"`
+	ImageURL string        `json:"imageURL,omitempty"`
+	Macro    *tmemes.Macro `json:"macro,omitempty"` // for macro.created
+
+	// For vote.changed, the new vote totals of the macro.
+	Upvotes   int `json:"upvotes,omitempty"`
+	Downvotes int `json:"downvotes,omitempty"`
+}
+
+// startWebhooks starts the dispatcher for webhooks.
+func (s *tmemeServer) startWebhooks() {
+	events, _ := s.db.Subscribe() // for the lifetime of the server
+	go s.dispatchWebhooks(events)
+}
+
+// dispatchWebhooks delivers the changes reported by events to the webhooks
+// that want them, until the channel is closed.
+func (s *tmemeServer) dispatchWebhooks(events <-chan tmemes.Event) {
+	for e := range events {
+		event, ok := webhookEvents[e.Type]
+		if !ok {
+			continue
+		}
+		hooks, err := s.db.Webhooks()
+		if err != nil {
+			log.Printf("[webhook] listing webhooks: %v", err)
+			continue
+		}
+		hooks = slices.DeleteFunc(hooks, func(h *tmemes.Webhook) bool { return !h.Wants(event) })
+		if len(hooks) == 0 {
+			continue
+		}
+		msg, ok := s.newWebhookPayload(event, e)
+		if !ok {
+			continue
+		}
+		for _, h := range hooks {
+			select {
+			case webhookSlots <- struct{}{}:
+				go func() {
+					defer func() { <-webhookSlots }()
+					s.deliverWebhook(h, msg)
+				}()
+			default:
+				webhookMetrics.Add("dropped", 1)
+				log.Printf("[webhook] too many deliveries in progress, dropping %s for webhook %d", event, h.ID)
+			}
+		}
+	}
+}
+
+// newWebhookPayload returns the payload reporting e as the given event. It
+// reports false if e should not be delivered.
+func (s *tmemeServer) newWebhookPayload(event string, e tmemes.Event) (webhookPayload, bool) {
+	base := s.serverBaseURL()
+	msg := webhookPayload{
+		Event:   event,
+		Time:    time.Now().UTC(),
+		Server:  brandingForUI().Name,
+		MacroID: e.MacroID,
+	}
+	if event == tmemes.WebhookMacroDeleted {
+		msg.Text = fmt.Sprintf("%sMacro %d was deleted", digestPrefix(), e.MacroID)
+		return msg, true
+	}
+
+	m := e.Macro
+	if m == nil {
+		var err error
+		if m, err = s.db.Macro(e.MacroID); err != nil {
+			return msg, false // deleted since
+		}
+	}
+	if m.Hidden {
+		return msg, false
+	}
+	t, err := s.db.AnyTemplate(m.TemplateID)
+	if err != nil {
+		return msg, false
+	}
+	msg.URL = fmt.Sprintf("%s/m/%d", base, m.ID)
+	msg.ImageURL = fmt.Sprintf("%s/content/macro/%d%s", base, m.ID, s.db.MacroExt(t))
+	if event == tmemes.WebhookMacroCreated {
+		msg.Macro = m
+		msg.Text = fmt.Sprintf("%sNew macro: %s (by %s) %s", digestPrefix(),
+			t.Name, s.userDisplayName(context.Background(), m.Creator, m.CreatedAt), msg.URL)
+	} else {
+		msg.Upvotes, msg.Downvotes = e.Upvotes, e.Downvotes
+		msg.Text = fmt.Sprintf("%sVotes on %s: %d up, %d down %s", digestPrefix(),
+			t.Name, e.Upvotes, e.Downvotes, msg.URL)
+	}
+	return msg, true
+}
+
+// deliverWebhook posts msg to h, retrying failures that may be temporary,
+// and records the outcome with h.
+func (s *tmemeServer) deliverWebhook(h *tmemes.Webhook, msg webhookPayload) {
+	msg.Delivery = newWebhookDelivery()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		panic(err) // should not be possible
+	}
+	wait := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.postWebhook(h, msg.Event, msg.Delivery, body)
+		if err == nil {
+			webhookMetrics.Add("delivered", 1)
+		} else if retry && attempt < webhookAttempts {
+			webhookMetrics.Add("retried", 1)
+			time.Sleep(wait)
+			wait *= 2
+			continue
+		} else {
+			webhookMetrics.Add("failed", 1)
+			log.Printf("[webhook] delivering %s to webhook %d: %v", msg.Event, h.ID, err)
+		}
+		if serr := s.db.SetWebhookStatus(h.ID, time.Now(), err); serr != nil {
+			log.Printf("[webhook] recording status of webhook %d: %v", h.ID, serr)
+		}
+		return
+	}
+}
+
+// postWebhook makes one attempt to post body to h. If it fails, it reports
+// whether the failure may be temporary, so that the delivery can be retried.
+func (s *tmemeServer) postWebhook(h *tmemes.Webhook, event, delivery string, body []byte) (retry bool, _ error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tmemes-Event", event)
+	req.Header.Set("X-Tmemes-Delivery", delivery)
+	req.Header.Set("X-Tmemes-Signature", signWebhook(h.Secret, body))
+	rsp, err := s.srv.HTTPClient().Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(rsp.Body, 512))
+		retry := rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode >= 500
+		return retry, fmt.Errorf("webhook: %s: %s", rsp.Status, bytes.TrimSpace(detail))
+	}
+	return false, nil
+}
+
+// signWebhook returns the value of the X-Tmemes-Signature header for a
+// payload with the given body, signed with secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookDelivery returns a random identifier for a delivery.
+func newWebhookDelivery() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// serveAPIAdminWebhooks implements managing outbound webhooks. Admin only.
+//
+// API: GET /api/admin/webhooks         -- list webhooks
+// API: POST /api/admin/webhooks        -- register a webhook
+// API: DELETE /api/admin/webhooks/:id  -- remove a webhook
+//
+// The list is {"webhooks":[...]}, each a tmemes.Webhook without its secret.
+// The POST payload is {"url":"...", "events":[...]}, where the events are any
+// of "macro.created", "macro.deleted", and "vote.changed", or omitted for all
+// of them; on success, the new tmemes.Webhook is written back to the caller,
+// with the secret its deliveries are signed with.
+func (s *tmemeServer) serveAPIAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	serveMetrics.Add("api-admin-webhooks", 1)
+	whois := s.checkAdmin(w, r, "manage webhooks")
+	if whois == nil {
+		return // error already sent
+	}
+	var rsp any
+	switch r.Method {
+	case "GET":
+		hooks, err := s.db.Webhooks()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, h := range hooks {
+			h.Secret = ""
+		}
+		if hooks == nil {
+			hooks = []*tmemes.Webhook{}
+		}
+		rsp = struct {
+			W []*tmemes.Webhook `json:"webhooks"`
+		}{W: hooks}
+
+	case "POST":
+		var req struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "invalid webhook URL", http.StatusBadRequest)
+			return
+		}
+		for _, e := range req.Events {
+			if !tmemes.ValidWebhookEvent(e) {
+				http.Error(w, fmt.Sprintf("unknown event %q", e), http.StatusBadRequest)
+				return
+			}
+		}
+		slices.Sort(req.Events)
+		var secret [32]byte
+		rand.Read(secret[:])
+		h := &tmemes.Webhook{
+			URL:       req.URL,
+			Events:    slices.Compact(req.Events),
+			Secret:    hex.EncodeToString(secret[:]),
+			CreatedBy: whois.UserProfile.ID,
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := s.db.AddWebhook(h); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.logEvent(whois.UserProfile.ID, "add-webhook", "webhook", h.ID)
+		rsp = h
+
+	case "DELETE":
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/admin/webhooks/"))
+		if err != nil || id <= 0 {
+			http.Error(w, "invalid webhook ID", http.StatusBadRequest)
+			return
+		}
+		if err := s.db.DeleteWebhook(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		s.logEvent(whois.UserProfile.ID, "remove-webhook", "webhook", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
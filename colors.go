@@ -0,0 +1,309 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tmemes
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// cutColorFunc splits a CSS color function such as "rgb(1, 2, 3)" into its
+// name and the text of its arguments. It reports false if s is not a call of
+// one of the supported functions.
+func cutColorFunc(s string) (fn, args string, ok bool) {
+	fn, rest, ok := strings.Cut(s, "(")
+	if !ok || !strings.HasSuffix(rest, ")") {
+		return "", "", false
+	}
+	fn = strings.TrimSpace(fn)
+	switch fn {
+	case "rgb", "rgba", "hsl", "hsla":
+		return fn, strings.TrimSuffix(rest, ")"), true
+	}
+	return "", "", false
+}
+
+// parseColorFunc parses the arguments of the CSS color function fn, in either
+// the legacy comma-separated syntax, "rgba(255, 0, 0, 0.5)", or the modern
+// space-separated one, "rgb(255 0 0 / 50%)". The rgb and rgba functions, and
+// the hsl and hsla functions, are aliases.
+func parseColorFunc(fn, args string) (Color, error) {
+	var parts []string
+	if strings.Contains(args, ",") {
+		for _, p := range strings.Split(args, ",") {
+			parts = append(parts, strings.TrimSpace(p))
+		}
+	} else {
+		main, alpha, hasAlpha := strings.Cut(args, "/")
+		parts = strings.Fields(main)
+		if hasAlpha {
+			parts = append(parts, strings.TrimSpace(alpha))
+		}
+	}
+	if len(parts) != 3 && len(parts) != 4 {
+		return Color{}, fmt.Errorf("%s() needs 3 or 4 arguments, got %d", fn, len(parts))
+	}
+
+	var c Color
+	if len(parts) == 4 {
+		a, err := parseColorValue(parts[3], 1)
+		if err != nil {
+			return Color{}, fmt.Errorf("invalid alpha: %w", err)
+		}
+		c[3] = 1 - a
+	}
+	switch fn {
+	case "rgb", "rgba":
+		for i, p := range parts[:3] {
+			v, err := parseColorValue(p, 255)
+			if err != nil {
+				return Color{}, fmt.Errorf("invalid %s() argument %q: %w", fn, p, err)
+			}
+			c[i] = v
+		}
+	case "hsl", "hsla":
+		h, err := parseHue(parts[0])
+		if err != nil {
+			return Color{}, fmt.Errorf("invalid hue %q: %w", parts[0], err)
+		}
+		s, err := parseColorValue(strings.TrimSuffix(parts[1], "%")+"%", 1)
+		if err != nil {
+			return Color{}, fmt.Errorf("invalid saturation %q: %w", parts[1], err)
+		}
+		l, err := parseColorValue(strings.TrimSuffix(parts[2], "%")+"%", 1)
+		if err != nil {
+			return Color{}, fmt.Errorf("invalid lightness %q: %w", parts[2], err)
+		}
+		c[0], c[1], c[2] = hslToRGB(h, s, l)
+	}
+	return c, nil
+}
+
+// parseColorValue parses a number or percentage, and returns it as a fraction
+// of the range 0..scale, clamped to 0..1.
+func parseColorValue(s string, scale float64) (float64, error) {
+	var v float64
+	var err error
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		v, err = strconv.ParseFloat(p, 64)
+		v /= 100
+	} else {
+		v, err = strconv.ParseFloat(s, 64)
+		v /= scale
+	}
+	if err != nil {
+		return 0, errors.New("not a number")
+	}
+	return math.Max(0, math.Min(1, v)), nil
+}
+
+// parseHue parses a hue angle, in degrees unless it has a "deg", "grad",
+// "rad", or "turn" suffix, and returns it in degrees in the range 0..360.
+func parseHue(s string) (float64, error) {
+	scale := 1.0
+	for _, u := range []struct {
+		suffix string
+		scale  float64
+	}{{"deg", 1}, {"grad", 0.9}, {"rad", 180 / math.Pi}, {"turn", 360}} {
+		if v, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, scale = v, u.scale
+			break
+		}
+	}
+	h, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errors.New("not a number")
+	}
+	h = math.Mod(h*scale, 360)
+	if h < 0 {
+		h += 360
+	}
+	return h, nil
+}
+
+// hslToRGB converts a color given as hue (in degrees), saturation, and
+// lightness to red, green, and blue components.
+func hslToRGB(h, s, l float64) (r, g, b float64) {
+	f := func(n float64) float64 {
+		k := math.Mod(n+h/30, 12)
+		a := s * math.Min(l, 1-l)
+		return l - a*math.Max(-1, math.Min(k-3, math.Min(9-k, 1)))
+	}
+	return f(0), f(8), f(4)
+}
+
+// n2c maps CSS color names to their equivalent hex strings in standard web
+// RGB format (#xxxxxx). Names should be normalized to lower-case. Each hex
+// string must have only one name here, so that the reverse mapping is
+// deterministic; other spellings belong in colorAliases.
+var n2c = map[string]string{
+	"aliceblue":            "#f0f8ff",
+	"antiquewhite":         "#faebd7",
+	"aqua":                 "#00ffff",
+	"aquamarine":           "#7fffd4",
+	"azure":                "#f0ffff",
+	"beige":                "#f5f5dc",
+	"bisque":               "#ffe4c4",
+	"black":                "#000000",
+	"blanchedalmond":       "#ffebcd",
+	"blue":                 "#0000ff",
+	"blueviolet":           "#8a2be2",
+	"brown":                "#a52a2a",
+	"burlywood":            "#deb887",
+	"cadetblue":            "#5f9ea0",
+	"chartreuse":           "#7fff00",
+	"chocolate":            "#d2691e",
+	"coral":                "#ff7f50",
+	"cornflowerblue":       "#6495ed",
+	"cornsilk":             "#fff8dc",
+	"crimson":              "#dc143c",
+	"darkblue":             "#00008b",
+	"darkcyan":             "#008b8b",
+	"darkgoldenrod":        "#b8860b",
+	"darkgray":             "#a9a9a9",
+	"darkgreen":            "#006400",
+	"darkkhaki":            "#bdb76b",
+	"darkmagenta":          "#8b008b",
+	"darkolivegreen":       "#556b2f",
+	"darkorange":           "#ff8c00",
+	"darkorchid":           "#9932cc",
+	"darkred":              "#8b0000",
+	"darksalmon":           "#e9967a",
+	"darkseagreen":         "#8fbc8f",
+	"darkslateblue":        "#483d8b",
+	"darkslategray":        "#2f4f4f",
+	"darkturquoise":        "#00ced1",
+	"darkviolet":           "#9400d3",
+	"deeppink":             "#ff1493",
+	"deepskyblue":          "#00bfff",
+	"dimgray":              "#696969",
+	"dodgerblue":           "#1e90ff",
+	"firebrick":            "#b22222",
+	"floralwhite":          "#fffaf0",
+	"forestgreen":          "#228b22",
+	"fuchsia":              "#ff00ff",
+	"gainsboro":            "#dcdcdc",
+	"ghostwhite":           "#f8f8ff",
+	"gold":                 "#ffd700",
+	"goldenrod":            "#daa520",
+	"gray":                 "#808080",
+	"green":                "#008000",
+	"greenyellow":          "#adff2f",
+	"honeydew":             "#f0fff0",
+	"hotpink":              "#ff69b4",
+	"indianred":            "#cd5c5c",
+	"indigo":               "#4b0082",
+	"ivory":                "#fffff0",
+	"khaki":                "#f0e68c",
+	"lavender":             "#e6e6fa",
+	"lavenderblush":        "#fff0f5",
+	"lawngreen":            "#7cfc00",
+	"lemonchiffon":         "#fffacd",
+	"lightblue":            "#add8e6",
+	"lightcoral":           "#f08080",
+	"lightcyan":            "#e0ffff",
+	"lightgoldenrodyellow": "#fafad2",
+	"lightgray":            "#d3d3d3",
+	"lightgreen":           "#90ee90",
+	"lightpink":            "#ffb6c1",
+	"lightsalmon":          "#ffa07a",
+	"lightseagreen":        "#20b2aa",
+	"lightskyblue":         "#87cefa",
+	"lightslategray":       "#778899",
+	"lightsteelblue":       "#b0c4de",
+	"lightyellow":          "#ffffe0",
+	"lime":                 "#00ff00",
+	"limegreen":            "#32cd32",
+	"linen":                "#faf0e6",
+	"maroon":               "#800000",
+	"mediumaquamarine":     "#66cdaa",
+	"mediumblue":           "#0000cd",
+	"mediumorchid":         "#ba55d3",
+	"mediumpurple":         "#9370db",
+	"mediumseagreen":       "#3cb371",
+	"mediumslateblue":      "#7b68ee",
+	"mediumspringgreen":    "#00fa9a",
+	"mediumturquoise":      "#48d1cc",
+	"mediumvioletred":      "#c71585",
+	"midnightblue":         "#191970",
+	"mintcream":            "#f5fffa",
+	"mistyrose":            "#ffe4e1",
+	"moccasin":             "#ffe4b5",
+	"navajowhite":          "#ffdead",
+	"navy":                 "#000080",
+	"oldlace":              "#fdf5e6",
+	"olive":                "#808000",
+	"olivedrab":            "#6b8e23",
+	"orange":               "#ffa500",
+	"orangered":            "#ff4500",
+	"orchid":               "#da70d6",
+	"palegoldenrod":        "#eee8aa",
+	"palegreen":            "#98fb98",
+	"paleturquoise":        "#afeeee",
+	"palevioletred":        "#db7093",
+	"papayawhip":           "#ffefd5",
+	"peachpuff":            "#ffdab9",
+	"peru":                 "#cd853f",
+	"pink":                 "#ffc0cb",
+	"plum":                 "#dda0dd",
+	"powderblue":           "#b0e0e6",
+	"purple":               "#800080",
+	"rebeccapurple":        "#663399",
+	"red":                  "#ff0000",
+	"rosybrown":            "#bc8f8f",
+	"royalblue":            "#4169e1",
+	"saddlebrown":          "#8b4513",
+	"salmon":               "#fa8072",
+	"sandybrown":           "#f4a460",
+	"seagreen":             "#2e8b57",
+	"seashell":             "#fff5ee",
+	"sienna":               "#a0522d",
+	"silver":               "#c0c0c0",
+	"skyblue":              "#87ceeb",
+	"slateblue":            "#6a5acd",
+	"slategray":            "#708090",
+	"snow":                 "#fffafa",
+	"springgreen":          "#00ff7f",
+	"steelblue":            "#4682b4",
+	"tan":                  "#d2b48c",
+	"teal":                 "#008080",
+	"thistle":              "#d8bfd8",
+	"tomato":               "#ff6347",
+	"turquoise":            "#40e0d0",
+	"violet":               "#ee82ee",
+	"wheat":                "#f5deb3",
+	"white":                "#ffffff",
+	"whitesmoke":           "#f5f5f5",
+	"yellow":               "#ffff00",
+	"yellowgreen":          "#9acd32",
+}
+
+// colorAliases maps alternative spellings of CSS color names to the names
+// used for them in n2c.
+var colorAliases = map[string]string{
+	"cyan":           "aqua",
+	"magenta":        "fuchsia",
+	"grey":           "gray",
+	"darkgrey":       "darkgray",
+	"darkslategrey":  "darkslategray",
+	"dimgrey":        "dimgray",
+	"lightgrey":      "lightgray",
+	"lightslategrey": "lightslategray",
+	"slategrey":      "slategray",
+}
+
+var c2n = make(map[string]string)
+
+func init() {
+	// Set up the reverse mapping from color code to name.
+	for n, c := range n2c {
+		if _, ok := c2n[c]; ok {
+			panic("duplicate color name for " + c)
+		}
+		c2n[c] = n
+	}
+}
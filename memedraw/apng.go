@@ -0,0 +1,563 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/fogleman/gg"
+	"github.com/tailscale/tmemes"
+)
+
+// An APNG is an animated PNG image. Unlike the frames of a GIF, each frame
+// covers the whole canvas and has full 24-bit colour with alpha, so the
+// animation does not lose colours to a palette.
+type APNG struct {
+	Image []*image.RGBA // the frames, each covering the whole canvas
+	Delay []int         // per frame, in 100ths of a second, as for gif.GIF
+	Plays int           // times to play the animation, 0 for forever
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// APNG frame disposal and blending methods, from the fcTL chunk.
+const (
+	apngDisposeNone       = 0
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+
+	apngBlendSource = 0
+	apngBlendOver   = 1
+)
+
+// maxAPNGChunk is the largest chunk accepted by DecodeAPNG, as a sanity
+// check on the lengths read before allocating.
+const maxAPNGChunk = 64 << 20
+
+// A pngChunk is a chunk of a PNG stream.
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// readPNGChunk reads the next chunk from r. If skip is true, the data of the
+// chunk is discarded rather than returned.
+func readPNGChunk(r io.Reader, skip bool) (pngChunk, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return pngChunk{}, noEOF(err)
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	c := pngChunk{typ: string(hdr[4:])}
+	if n > maxAPNGChunk {
+		return c, fmt.Errorf("png: %s chunk too large (%d bytes)", c.typ, n)
+	}
+	if skip {
+		// The CRC follows the data.
+		_, err := io.CopyN(io.Discard, r, int64(n)+4)
+		return c, noEOF(err)
+	}
+	buf := make([]byte, n+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return c, noEOF(err)
+	}
+	c.data = buf[:n]
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(c.data)
+	if crc.Sum32() != binary.BigEndian.Uint32(buf[n:]) {
+		return c, fmt.Errorf("png: invalid checksum in %s chunk", c.typ)
+	}
+	return c, nil
+}
+
+// writePNGChunk writes a chunk of the given type and data to buf.
+func writePNGChunk(buf *bytes.Buffer, typ string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.WriteString(typ)
+	buf.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// readPNGSignature reads and checks the signature at the start of a PNG.
+func readPNGSignature(r io.Reader) error {
+	var sig [len(pngSignature)]byte
+	if _, err := io.ReadFull(r, sig[:]); err != nil {
+		return noEOF(err)
+	} else if string(sig[:]) != pngSignature {
+		return errors.New("png: not a PNG file")
+	}
+	return nil
+}
+
+// IsAPNG reports whether the PNG image read from r is animated. It reads r
+// only as far as the start of the image data.
+func IsAPNG(r io.Reader) (bool, error) {
+	if err := readPNGSignature(r); err != nil {
+		return false, err
+	}
+	for {
+		c, err := readPNGChunk(r, true)
+		if err != nil {
+			return false, err
+		}
+		switch c.typ {
+		case "acTL":
+			return true, nil
+		case "IDAT", "IEND":
+			// The animation control chunk must come before the image data.
+			return false, nil
+		}
+	}
+}
+
+// An apngFrame is the control information and data of one frame of an APNG.
+type apngFrame struct {
+	width, height int
+	x, y          int
+	delay         int // in 100ths of a second
+	dispose       byte
+	blend         byte
+	data          bytes.Buffer // the compressed image data
+}
+
+// parseFCTL parses the frame control chunk data b.
+func parseFCTL(b []byte) (*apngFrame, error) {
+	if len(b) != 26 {
+		return nil, errors.New("png: invalid fcTL chunk")
+	}
+	f := &apngFrame{
+		width:   int(binary.BigEndian.Uint32(b[4:])),
+		height:  int(binary.BigEndian.Uint32(b[8:])),
+		x:       int(binary.BigEndian.Uint32(b[12:])),
+		y:       int(binary.BigEndian.Uint32(b[16:])),
+		dispose: b[24],
+		blend:   b[25],
+	}
+	num, den := int(binary.BigEndian.Uint16(b[20:])), int(binary.BigEndian.Uint16(b[22:]))
+	if den == 0 {
+		den = 100 // as the APNG specification says
+	}
+	f.delay = (num*100 + den/2) / den
+	return f, nil
+}
+
+// DecodeAPNG reads an animated PNG from r. It reports an error if the image
+// is not animated (see IsAPNG).
+func DecodeAPNG(r io.Reader) (*APNG, error) {
+	if err := readPNGSignature(r); err != nil {
+		return nil, err
+	}
+	var (
+		ihdr     []byte
+		header   []pngChunk // other chunks needed to decode the frames
+		animated bool
+		plays    int
+		frames   []*apngFrame
+		cur      *apngFrame // the frame whose data comes next, or nil
+	)
+	for done := false; !done; {
+		c, err := readPNGChunk(r, false)
+		if err != nil {
+			return nil, err
+		}
+		switch c.typ {
+		case "IHDR":
+			if len(c.data) != 13 {
+				return nil, errors.New("png: invalid IHDR chunk")
+			}
+			ihdr = c.data
+		case "PLTE", "tRNS":
+			header = append(header, c)
+		case "acTL":
+			if len(c.data) != 8 {
+				return nil, errors.New("png: invalid acTL chunk")
+			}
+			animated = true
+			plays = int(binary.BigEndian.Uint32(c.data[4:]))
+		case "fcTL":
+			if cur, err = parseFCTL(c.data); err != nil {
+				return nil, err
+			}
+			frames = append(frames, cur)
+		case "IDAT":
+			// The default image is the first frame only if a frame control
+			// chunk comes before it.
+			if cur != nil {
+				cur.data.Write(c.data)
+			}
+		case "fdAT":
+			if cur == nil || len(c.data) < 4 {
+				return nil, errors.New("png: invalid fdAT chunk")
+			}
+			cur.data.Write(c.data[4:]) // after the sequence number
+		case "IEND":
+			done = true
+		}
+	}
+	if ihdr == nil {
+		return nil, errors.New("png: missing IHDR chunk")
+	} else if !animated {
+		return nil, errors.New("png: image is not animated")
+	} else if len(frames) == 0 {
+		return nil, errors.New("png: no frames in APNG")
+	}
+
+	width, height := int(binary.BigEndian.Uint32(ihdr[0:])), int(binary.BigEndian.Uint32(ihdr[4:]))
+	bounds := image.Rect(0, 0, width, height)
+	a := &APNG{Plays: plays}
+	canvas := image.NewRGBA(bounds)
+	for i, f := range frames {
+		fb := image.Rect(f.x, f.y, f.x+f.width, f.y+f.height)
+		if fb.Empty() || !fb.In(bounds) {
+			return nil, fmt.Errorf("png: frame %d is outside the image", i)
+		}
+		img, err := decodeAPNGFrame(ihdr, header, f)
+		if err != nil {
+			return nil, fmt.Errorf("png: frame %d: %w", i, err)
+		}
+
+		dispose := f.dispose
+		if i == 0 && dispose == apngDisposePrevious {
+			dispose = apngDisposeBackground // as the specification says
+		}
+		var saved *image.RGBA
+		if dispose == apngDisposePrevious {
+			saved = copyRGBA(canvas)
+		}
+		op := draw.Over
+		if f.blend == apngBlendSource {
+			op = draw.Src
+		}
+		draw.Draw(canvas, fb, img, img.Bounds().Min, op)
+		a.Image = append(a.Image, copyRGBA(canvas))
+		a.Delay = append(a.Delay, f.delay)
+
+		switch dispose {
+		case apngDisposeBackground:
+			draw.Draw(canvas, fb, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			canvas = saved
+		}
+	}
+	return a, nil
+}
+
+// decodeAPNGFrame decodes the image data of frame f, as a PNG with header
+// ihdr (adjusted to the size of the frame) and the other chunks in header.
+func decodeAPNGFrame(ihdr []byte, header []pngChunk, f *apngFrame) (image.Image, error) {
+	var buf bytes.Buffer
+	buf.WriteString(pngSignature)
+	h := slices.Clone(ihdr)
+	binary.BigEndian.PutUint32(h[0:], uint32(f.width))
+	binary.BigEndian.PutUint32(h[4:], uint32(f.height))
+	writePNGChunk(&buf, "IHDR", h)
+	for _, c := range header {
+		writePNGChunk(&buf, c.typ, c.data)
+	}
+	writePNGChunk(&buf, "IDAT", f.data.Bytes())
+	writePNGChunk(&buf, "IEND", nil)
+	return png.Decode(&buf)
+}
+
+// EncodeAPNG writes a as an animated PNG to w, compressed at the given level.
+func EncodeAPNG(w io.Writer, a *APNG, level png.CompressionLevel) error {
+	if len(a.Image) == 0 {
+		return errors.New("png: no frames in APNG")
+	}
+	bounds := a.Image[0].Bounds()
+	opaque := true
+	for _, img := range a.Image {
+		if img.Bounds() != bounds {
+			return errors.New("png: frames of APNG differ in size")
+		}
+		opaque = opaque && img.Opaque()
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(pngSignature)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(bounds.Dy()))
+	ihdr[8] = 8 // bits per channel
+	ihdr[9] = 6 // truecolour with alpha
+	if opaque {
+		ihdr[9] = 2 // truecolour
+	}
+	writePNGChunk(&buf, "IHDR", ihdr)
+
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(a.Image)))
+	binary.BigEndian.PutUint32(actl[4:], uint32(a.Plays))
+	writePNGChunk(&buf, "acTL", actl)
+
+	// The frames are compressed in parallel, since that is most of the work.
+	data := make([][]byte, len(a.Image))
+	g, run := taskgroup.New(nil).Limit(runtime.NumCPU())
+	for i, img := range a.Image {
+		run.Run(func() { data[i] = compressAPNGFrame(img, opaque, zlibLevel(level)) })
+	}
+	g.Wait()
+
+	var seq uint32 // shared by the fcTL and fdAT chunks
+	for i := range a.Image {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(bounds.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(bounds.Dy()))
+		var delay int
+		if i < len(a.Delay) {
+			delay = min(a.Delay[i], math.MaxUint16)
+		}
+		binary.BigEndian.PutUint16(fctl[20:], uint16(delay))
+		binary.BigEndian.PutUint16(fctl[22:], 100)
+		fctl[24] = apngDisposeNone
+		fctl[25] = apngBlendSource // every frame replaces the whole canvas
+		writePNGChunk(&buf, "fcTL", fctl)
+		seq++
+
+		if i == 0 {
+			writePNGChunk(&buf, "IDAT", data[i])
+			continue
+		}
+		fdat := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data[i])), seq)
+		writePNGChunk(&buf, "fdAT", append(fdat, data[i]...))
+		seq++
+	}
+	writePNGChunk(&buf, "IEND", nil)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// zlibLevel returns the zlib compression level for the PNG level.
+func zlibLevel(level png.CompressionLevel) int {
+	switch level {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	default:
+		return zlib.DefaultCompression
+	}
+}
+
+// compressAPNGFrame returns the compressed image data of img, as 8-bit
+// truecolour without alpha if opaque is true, or with alpha otherwise. Each
+// row is filtered by whichever method gives the smallest sum of absolute
+// differences, as image/png does.
+func compressAPNGFrame(img *image.RGBA, opaque bool, level int) []byte {
+	bpp := 4
+	if opaque {
+		bpp = 3
+	}
+	b := img.Bounds()
+	n := b.Dx() * bpp
+	prev, cur := make([]byte, n), make([]byte, n)
+	var filtered [5][]byte
+	for i := range filtered {
+		filtered[i] = make([]byte, 1+n)
+		filtered[i][0] = byte(i)
+	}
+
+	var buf bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&buf, level) // the level is always valid
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x, j := 0, 0; x < b.Dx(); x++ {
+			r, g, bl, al := row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]
+			if al != 0 && al != 0xff {
+				// PNG stores colours without premultiplied alpha.
+				r, g, bl = unpremultiply(r, al), unpremultiply(g, al), unpremultiply(bl, al)
+			}
+			cur[j], cur[j+1], cur[j+2] = r, g, bl
+			if !opaque {
+				cur[j+3] = al
+			}
+			j += bpp
+		}
+		zw.Write(filterRow(filtered[:], cur, prev, bpp))
+		prev, cur = cur, prev
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+// unpremultiply returns the colour component of c without the premultiplied
+// alpha a, 0 < a < 0xff. Of the values that image/color premultiplies back to
+// c, it chooses the smallest, so that decoding the frame recovers c.
+func unpremultiply(c, a uint8) uint8 {
+	return uint8((int(c)*0xff00 + int(a)*0x101 - 1) / (int(a) * 0x101))
+}
+
+// filterRow fills each of out (one per filter type, including the type
+// byte) with row cur filtered against the row prev above it, and returns the
+// one with the smallest sum of absolute values.
+func filterRow(out [][]byte, cur, prev []byte, bpp int) []byte {
+	for i := range cur {
+		var a, c byte
+		if i >= bpp {
+			a, c = cur[i-bpp], prev[i-bpp]
+		}
+		b := prev[i]
+		out[0][i+1] = cur[i]
+		out[1][i+1] = cur[i] - a
+		out[2][i+1] = cur[i] - b
+		out[3][i+1] = cur[i] - byte((int(a)+int(b))/2)
+		out[4][i+1] = cur[i] - paeth(a, b, c)
+	}
+	best, bestSum := 0, math.MaxInt
+	for i, f := range out {
+		var sum int
+		for _, v := range f[1:] {
+			sum += abs(int(int8(v)))
+		}
+		if sum < bestSum {
+			best, bestSum = i, sum
+		}
+	}
+	return out[best]
+}
+
+// paeth implements the Paeth predictor of the PNG specification.
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// APNGDuration reports the total time it takes to play one loop of a.
+func APNGDuration(a *APNG) time.Duration {
+	var total time.Duration
+	for _, d := range a.Delay {
+		total += time.Duration(d) * 10 * time.Millisecond
+	}
+	return total
+}
+
+// DownsampleAPNG halves the number of frames in a by dropping every other
+// frame, starting with the second, as DownsampleGIF does.
+func DownsampleAPNG(a *APNG, keepTiming bool) {
+	n := 0
+	for i := 0; i < len(a.Image); i += 2 {
+		a.Image[n] = a.Image[i]
+		a.Delay[n] = a.Delay[i]
+		if keepTiming && i+1 < len(a.Delay) {
+			a.Delay[n] += a.Delay[i+1]
+		}
+		n++
+	}
+	a.Image = a.Image[:n]
+	a.Delay = a.Delay[:n]
+}
+
+// DrawAPNG renders macro m onto each frame of the animated template a, with
+// the images of its stickers taken from ss, as DrawGIF does. It modifies and
+// returns a.
+func DrawAPNG(a *APNG, m *tmemes.Macro, ss Stickers) *APNG {
+	rStart := time.Now()
+	bounds := a.Image[0].Bounds()
+
+	// Arrange the frames for playback.
+	if seq := playOrder(len(a.Image), m.Playback); !isIdentity(seq) {
+		played := make([]*image.RGBA, len(seq))
+		delay := make([]int, len(seq))
+		seen := make([]bool, len(a.Image))
+		for j, i := range seq {
+			played[j] = a.Image[i]
+			if seen[i] {
+				// A boomerang shows frames twice, and the text may differ.
+				played[j] = copyRGBA(a.Image[i])
+			}
+			seen[i] = true
+			delay[j] = a.Delay[i]
+		}
+		a.Image, a.Delay = played, delay
+	}
+	if m.Playback != nil {
+		for j := range a.Delay {
+			a.Delay[j] = scaleDelay(a.Delay[j], m.Playback.Speed)
+		}
+	}
+
+	layer := stickerLayer(m, ss, bounds)
+	lineFrames := make([]frames, len(m.TextOverlay))
+	for i, tl := range m.TextOverlay {
+		lineFrames[i] = newFrames(len(a.Image), tl)
+	}
+	g, run := taskgroup.New(nil).Limit(runtime.NumCPU())
+	for j, dst := range a.Image {
+		run.Run(func() { drawRGBAOverlays(dst, j, layer, lineFrames) })
+	}
+	g.Wait()
+
+	log.Printf("Rendering complete: %v", time.Since(rStart).Round(time.Millisecond))
+	return a
+}
+
+// DrawAPNGFrame renders frame n of the animated macro m, whose template is a,
+// as DrawGIFFrame does. It panics if n is out of range.
+func DrawAPNGFrame(a *APNG, m *tmemes.Macro, ss Stickers, n int) image.Image {
+	seq := playOrder(len(a.Image), m.Playback)
+	dst := copyRGBA(a.Image[seq[n]])
+	lineFrames := make([]frames, len(m.TextOverlay))
+	for i, tl := range m.TextOverlay {
+		lineFrames[i] = newFrames(len(seq), tl)
+	}
+	drawRGBAOverlays(dst, n, stickerLayer(m, ss, dst.Bounds()), lineFrames)
+	return dst
+}
+
+// APNGFrameCount reports the number of frames in the animation of macro m,
+// whose template is a, as drawn by DrawAPNG.
+func APNGFrameCount(a *APNG, m *tmemes.Macro) int {
+	return len(playOrder(len(a.Image), m.Playback))
+}
+
+// drawRGBAOverlays draws the stickers in layer (if not nil) and the text of
+// lines visible in frame j onto dst.
+func drawRGBAOverlays(dst *image.RGBA, j int, layer image.Image, lines []frames) {
+	bounds := dst.Bounds()
+	if layer != nil {
+		draw.Draw(dst, bounds, layer, bounds.Min, draw.Over)
+	}
+	dc := gg.NewContext(bounds.Dx(), bounds.Dy())
+	for _, f := range lines {
+		if f.visibleAt(j) {
+			overlayTextOnImage(dc, f.frame(j), bounds)
+		}
+	}
+	draw.Draw(dst, bounds, dc.Image(), image.Point{}, draw.Over)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"slices"
+	"testing"
+)
+
+// testAPNG returns an APNG of n frames of w×h, each different.
+func testAPNG(w, h, n int, opaque bool) *APNG {
+	a := &APNG{Plays: 3}
+	for i := range n {
+		src := testImage(w, h, int64(i))
+		if opaque {
+			for j := 3; j < len(src.Pix); j += 4 {
+				src.Pix[j] = 0xff
+			}
+		}
+		img := image.NewRGBA(src.Rect)
+		draw.Draw(img, img.Rect, src, image.Point{}, draw.Src)
+		a.Image = append(a.Image, img)
+		a.Delay = append(a.Delay, 4*(i+1))
+	}
+	return a
+}
+
+func TestEncodeAPNG(t *testing.T) {
+	for _, opaque := range []bool{false, true} {
+		want := testAPNG(33, 21, 3, opaque)
+		var buf bytes.Buffer
+		if err := EncodeAPNG(&buf, want, png.DefaultCompression); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		data := buf.Bytes()
+
+		// A decoder that knows nothing of animation sees the first frame.
+		still, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Decode as PNG: %v", err)
+		}
+		checkSameImage(t, "default image", color.RGBAModel, still, want.Image[0])
+
+		if ok, err := IsAPNG(bytes.NewReader(data)); err != nil || !ok {
+			t.Errorf("IsAPNG: got %v, %v; want true", ok, err)
+		}
+		got, err := DecodeAPNG(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("DecodeAPNG: %v", err)
+		}
+		if len(got.Image) != len(want.Image) {
+			t.Fatalf("Got %d frames, want %d", len(got.Image), len(want.Image))
+		}
+		for i := range want.Image {
+			checkSameImage(t, "frame", color.RGBAModel, got.Image[i], want.Image[i])
+		}
+		if !slices.Equal(got.Delay, want.Delay) || got.Plays != want.Plays {
+			t.Errorf("Got delays %v, plays %d; want %v, %d", got.Delay, got.Plays, want.Delay, want.Plays)
+		}
+	}
+}
+
+func TestIsAPNGStill(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(8, 8, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := IsAPNG(bytes.NewReader(buf.Bytes())); err != nil || ok {
+		t.Errorf("IsAPNG of still PNG: got %v, %v; want false", ok, err)
+	}
+	if _, err := DecodeAPNG(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("DecodeAPNG of still PNG: got no error")
+	}
+	if _, err := IsAPNG(bytes.NewReader([]byte("GIF89a"))); err == nil {
+		t.Error("IsAPNG of GIF: got no error")
+	}
+}
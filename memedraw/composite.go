@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+)
+
+// Compositing onto paletted images.
+//
+// The frames of a GIF are paletted images, and the standard library draws
+// onto those one pixel at a time, searching the whole palette for the colour
+// of every pixel it touches, even where the image drawn over it is
+// transparent. For large GIFs that search is most of the time spent
+// rendering. The methods of a paletteCache produce exactly the same pixels
+// as draw.Draw, but look up each distinct colour only once per palette, and
+// only blend the pixels under the visible parts of an overlay (its dirty
+// rectangle).
+
+// maxChannel is the maximum value of a colour channel, as from RGBA.
+const maxChannel = 1<<16 - 1
+
+// A paletteIndex finds colours in a palette, as color.Palette.Index does,
+// remembering the results. It is safe for concurrent use.
+type paletteIndex struct {
+	pal      color.Palette
+	rgba     [][4]uint32 // the entries of pal, as from RGBA
+	canon    []uint8     // canon[i] is pal.Index(pal[i]), the first entry of the same colour
+	distinct bool        // whether canon[i] == i for all i
+
+	mu    sync.Mutex
+	index map[color.RGBA64]uint8
+}
+
+func newPaletteIndex(pal color.Palette) *paletteIndex {
+	p := &paletteIndex{
+		pal:      pal,
+		rgba:     make([][4]uint32, len(pal)),
+		canon:    make([]uint8, len(pal)),
+		distinct: true,
+		index:    make(map[color.RGBA64]uint8),
+	}
+	first := make(map[[4]uint32]int, len(pal))
+	for i, c := range pal {
+		r, g, b, a := c.RGBA()
+		p.rgba[i] = [4]uint32{r, g, b, a}
+		j, ok := first[p.rgba[i]]
+		if !ok {
+			first[p.rgba[i]], j = i, i
+		}
+		p.canon[i] = uint8(j)
+		p.distinct = p.distinct && j == i
+	}
+	return p
+}
+
+// lookup returns the index of the entry of the palette closest to c.
+func (p *paletteIndex) lookup(c color.RGBA64) uint8 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i, ok := p.index[c]
+	if !ok {
+		i = uint8(p.pal.Index(c))
+		p.index[c] = i
+	}
+	return i
+}
+
+// over returns the index of the colour s, premultiplied as from RGBA, drawn
+// over entry d of the palette.
+func (p *paletteIndex) over(d uint8, s [4]uint32) uint8 {
+	if s == [4]uint32{} {
+		return p.canon[d]
+	}
+	dc := p.rgba[d]
+	a := maxChannel - s[3]
+	return p.lookup(color.RGBA64{
+		R: uint16((dc[0]*a + s[0]*maxChannel) / maxChannel),
+		G: uint16((dc[1]*a + s[1]*maxChannel) / maxChannel),
+		B: uint16((dc[2]*a + s[2]*maxChannel) / maxChannel),
+		A: uint16((dc[3]*a + s[3]*maxChannel) / maxChannel),
+	})
+}
+
+// A paletteCache holds the paletteIndex of each palette used in drawing a
+// GIF. The frames of most GIFs share one palette. The zero value is ready
+// for use, and it is safe for concurrent use.
+type paletteCache struct {
+	mu sync.Mutex
+	m  map[paletteKey]*paletteIndex
+}
+
+// A paletteKey identifies a palette by the slice holding it.
+type paletteKey struct {
+	first *color.Color
+	n     int
+}
+
+// get returns the paletteIndex for pal.
+func (c *paletteCache) get(pal color.Palette) *paletteIndex {
+	if len(pal) == 0 {
+		return newPaletteIndex(pal)
+	}
+	key := paletteKey{first: &pal[0], n: len(pal)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.m[key]
+	if !ok {
+		if c.m == nil {
+			c.m = make(map[paletteKey]*paletteIndex)
+		}
+		p = newPaletteIndex(pal)
+		c.m[key] = p
+	}
+	return p
+}
+
+// drawSrc replaces the pixels of dst within r with those of src, as
+// draw.Draw(dst, r, src, r.Min, draw.Src) does.
+func (c *paletteCache) drawSrc(dst *image.Paletted, r image.Rectangle, src *image.Paletted) {
+	r = r.Intersect(dst.Bounds()).Intersect(src.Bounds())
+	dp, sp := c.get(dst.Palette), c.get(src.Palette)
+	remap := dp.canon
+	if sp != dp {
+		remap = make([]uint8, len(sp.rgba))
+		for i, s := range sp.rgba {
+			remap[i] = dp.lookup(color.RGBA64{R: uint16(s[0]), G: uint16(s[1]), B: uint16(s[2]), A: uint16(s[3])})
+		}
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		di, si := dst.PixOffset(r.Min.X, y), src.PixOffset(r.Min.X, y)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			dst.Pix[di] = remap[src.Pix[si]]
+			di++
+			si++
+		}
+	}
+}
+
+// drawOver paints src over dst within r, as draw.Draw(dst, r, src, r.Min,
+// draw.Over) does.
+func (c *paletteCache) drawOver(dst *image.Paletted, r image.Rectangle, src image.Image) {
+	r = r.Intersect(dst.Bounds()).Intersect(src.Bounds())
+	dp := c.get(dst.Palette)
+	switch src := src.(type) {
+	case *image.Paletted:
+		sp := c.get(src.Palette)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			di, si := dst.PixOffset(r.Min.X, y), src.PixOffset(r.Min.X, y)
+			for x := r.Min.X; x < r.Max.X; x++ {
+				s := sp.rgba[src.Pix[si]]
+				if sp == dp && s[3] == maxChannel {
+					dst.Pix[di] = dp.canon[src.Pix[si]]
+				} else {
+					dst.Pix[di] = dp.over(dst.Pix[di], s)
+				}
+				di++
+				si++
+			}
+		}
+	case *image.RGBA:
+		// Outside the dirty rectangle, src is transparent and leaves the
+		// colours of dst as they are, though not always their indices.
+		dirty := opaqueBounds(src, r)
+		if !dp.distinct {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				row := dst.Pix[dst.PixOffset(r.Min.X, y):dst.PixOffset(r.Max.X, y)]
+				for i, d := range row {
+					row[i] = dp.canon[d]
+				}
+			}
+		}
+		for y := dirty.Min.Y; y < dirty.Max.Y; y++ {
+			di, si := dst.PixOffset(dirty.Min.X, y), src.PixOffset(dirty.Min.X, y)
+			for x := dirty.Min.X; x < dirty.Max.X; x++ {
+				px := src.Pix[si : si+4 : si+4]
+				s := [4]uint32{uint32(px[0]) * 0x101, uint32(px[1]) * 0x101, uint32(px[2]) * 0x101, uint32(px[3]) * 0x101}
+				dst.Pix[di] = dp.over(dst.Pix[di], s)
+				di++
+				si += 4
+			}
+		}
+	default:
+		draw.Draw(dst, r, src, r.Min, draw.Over)
+	}
+}
+
+// opaqueBounds returns the smallest rectangle within r outside of which img
+// is entirely transparent.
+func opaqueBounds(img *image.RGBA, r image.Rectangle) image.Rectangle {
+	var out image.Rectangle
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(r.Min.X, y):img.PixOffset(r.Max.X, y)]
+		x0, x1 := -1, -1
+		for i := 0; i < len(row); i += 4 {
+			if row[i]|row[i+1]|row[i+2]|row[i+3] != 0 {
+				if x0 < 0 {
+					x0 = i / 4
+				}
+				x1 = i/4 + 1
+			}
+		}
+		if x0 >= 0 {
+			out = out.Union(image.Rect(r.Min.X+x0, y, r.Min.X+x1, y+1))
+		}
+	}
+	return out
+}
@@ -2,11 +2,17 @@
 // SPDX-License-Identifier: BSD-3-Clause
 
 // Package memedraw draws text on a tempate.
+//
+// Rendering is deterministic: drawing the same macro onto the same template
+// always produces the same pixels, and the encoders in this package always
+// produce the same bytes for the same image. Callers may rely on this to
+// derive cache validators from the inputs to a rendering, without having to
+// keep the output.
 package memedraw
 
 import (
-	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
 	"image/gif"
 	"log"
@@ -17,35 +23,13 @@ import (
 
 	"github.com/creachadair/taskgroup"
 	"github.com/fogleman/gg"
-	"github.com/golang/freetype/truetype"
 	"github.com/tailscale/tmemes"
-	"golang.org/x/image/font"
-
-	_ "embed"
 )
 
-// Preloaded font definition.
-var (
-	//go:embed Oswald-SemiBold.ttf
-	oswaldSemiBoldBytes []byte
-
-	oswaldSemiBold *truetype.Font
-)
-
-func init() {
-	var err error
-	oswaldSemiBold, err = truetype.Parse(oswaldSemiBoldBytes)
-	if err != nil {
-		panic(fmt.Sprintf("Parsing font: %v", err))
-	}
-}
-
-// fontForSize constructs a new font.Face for the specified point size.
-func fontForSize(points int) font.Face {
-	return truetype.NewFace(oswaldSemiBold, &truetype.Options{
-		Size: float64(points),
-	})
-}
+// Version identifies the output of this package. It must be incremented by any
+// change that alters the image produced for a given macro and template, so
+// that validators derived from the inputs are invalidated.
+const Version = 3
 
 // fontSizeForImage computes a recommend font size in points for the given image.
 func fontSizeForImage(img image.Image) int {
@@ -61,31 +45,60 @@ func oneForZero(v float64) float64 {
 	return v
 }
 
-// overlayTextOnImage paints the specified text line on a single image frame.
-func overlayTextOnImage(dc *gg.Context, tl frame, bounds image.Rectangle) {
+// lineSpacing is the distance between the baselines of wrapped lines of text,
+// as a multiple of the font height.
+const lineSpacing = 1.25
+
+// A textLayout describes where the wrapped lines of a text line are drawn.
+type textLayout struct {
+	lines      []string
+	fontSize   int     // in points
+	fontHeight float64 // in pixels, of a line at the initial font size
+	x, y       float64 // anchor point of the first line
+	ax, ay     float64 // anchor, as for DrawStringAnchored
+	cx, cy     float64 // center of the text area, for rotation
+	textHeight float64 // in pixels, of the font the text is drawn in
+	outline    float64 // width in pixels of the outline
+}
+
+// layoutText computes the layout of the specified text line on a single image
+// frame, and sets the font face of dc to the one it is drawn in. It reports
+// false if the line has no text to draw.
+func layoutText(dc *gg.Context, tl frame, bounds image.Rectangle) (textLayout, bool) {
 	text := strings.TrimSpace(tl.Text)
 	if text == "" {
-		return
+		return textLayout{}, false
 	}
 
 	fontSize := fontSizeForImage(bounds)
-	font := fontForSize(fontSize)
+	if tl.Size > 0 {
+		fontSize = max(1, int(math.Round(float64(bounds.Dy())*0.75*tl.Size)))
+	}
+	font := fontForSize(tl.Font, fontSize)
 	dc.SetFontFace(font)
 
 	width := oneForZero(tl.Field[0].Width) * float64(bounds.Dx())
-	lineSpacing := 1.25
-	x := tl.area().X * float64(bounds.Dx())
-	y := tl.area().Y * float64(bounds.Dy())
+	cx := tl.area().X * float64(bounds.Dx())
+	cy := tl.area().Y * float64(bounds.Dy())
+	x, y := cx, cy
 	ax := 0.5
 	ay := 1.0
+	switch tl.Align {
+	case "left":
+		x, ax = cx-width/2, 0
+	case "right":
+		x, ax = cx+width/2, 1
+	}
+	// N.B. The line height is that of the initial font size, even if the text
+	// is shrunk to fit below. Changing this would change existing renderings.
 	fontHeight := dc.FontHeight()
 	// Replicate part of the DrawStringWrapped logic so that we can draw the
-	// text multiple times to create an outline effect.
+	// outline and shadow of each line as well as its text.
 	lines := dc.WordWrap(text, width)
 
-	for len(lines) > 2 && fontSize > 6 {
+	for tl.Size == 0 && len(lines) > 2 && fontSize > 6 {
 		fontSize--
-		font = fontForSize(fontSize)
+		font = fontForSize(tl.Font, fontSize)
 		dc.SetFontFace(font)
 		lines = dc.WordWrap(text, width)
 	}
@@ -95,30 +108,172 @@ func overlayTextOnImage(dc *gg.Context, tl frame, bounds image.Rectangle) {
 	h -= (lineSpacing - 1) * fontHeight
 	y -= 0.5 * h
 
-	for _, line := range lines {
-		c := tl.StrokeColor
-		dc.SetRGB(c.R(), c.G(), c.B())
-
-		n := 6 // visible outline size
-		for dy := -n; dy <= n; dy++ {
-			for dx := -n; dx <= n; dx++ {
-				if dx*dx+dy*dy >= n*n {
-					// give it rounded corners
-					continue
-				}
-				dc.DrawStringAnchored(line, x+float64(dx), y+float64(dy), ax, ay)
-			}
+	// The outline follows the size the text is drawn at, so that it is in
+	// proportion on small images and small text.
+	textHeight := dc.FontHeight()
+	outline := tl.OutlineWidth
+	if outline == 0 {
+		outline = tmemes.DefaultOutlineWidth
+	}
+
+	return textLayout{
+		lines:      lines,
+		fontSize:   fontSize,
+		fontHeight: fontHeight,
+		x:          x,
+		y:          y,
+		ax:         ax,
+		ay:         ay,
+		cx:         cx,
+		cy:         cy,
+		textHeight: textHeight,
+		outline:    max(1, outline*textHeight),
+	}, true
+}
+
+// overlayTextOnImage paints the specified text line on a single image frame.
+func overlayTextOnImage(dc *gg.Context, tl frame, bounds image.Rectangle) {
+	lay, ok := layoutText(dc, tl, bounds)
+	if !ok {
+		return
+	}
+
+	if tl.RotateDegrees != 0 {
+		dc.Push()
+		defer dc.Pop()
+		dc.RotateAbout(gg.Radians(tl.RotateDegrees), lay.cx, lay.cy)
+	}
+
+	if tl.Box != nil {
+		drawBoxes(dc, tl, lay)
+	}
+	if tl.Shadow != nil && tl.Shadow.Color.A() > 0 {
+		drawShadow(dc, tl, lay)
+	}
+
+	// The outline covers the text as well as its edge, and where it overlaps
+	// the text drawn over it, a translucent outline would build up. So in
+	// that case, draw the outline opaque on a separate layer, and blend that
+	// in. A transparent outline is not drawn at all.
+	translucent := tl.StrokeColor.A() < 1
+	if translucent && tl.StrokeColor.A() > 0 {
+		layer := textLayer(dc, tl, lay)
+		y := lay.y
+		for _, line := range lay.lines {
+			drawOutline(layer, tl.StrokeColor, tl, lay, line, y)
+			y += lay.fontHeight * lineSpacing
 		}
+		dst := dc.Image().(draw.Image)
+		mask := image.NewUniform(color.Alpha{A: uint8(math.Round(tl.StrokeColor.A() * 255))})
+		draw.DrawMask(dst, dst.Bounds(), layer.Image(), image.Point{}, mask, image.Point{}, draw.Over)
+	}
 
-		c = tl.Color
-		dc.SetRGB(c.R(), c.G(), c.B())
+	// gg fills text with a single color, so for a gradient, draw the text on
+	// a separate layer to use as a mask for painting the gradient.
+	var mask *gg.Context
+	if tl.Gradient != nil {
+		mask = textLayer(dc, tl, lay)
+		mask.SetRGB(0, 0, 0)
+	}
 
-		dc.DrawStringAnchored(line, x, y, ax, ay)
-		y += fontHeight * lineSpacing
+	x, y := lay.x, lay.y
+	for _, line := range lay.lines {
+		if !translucent {
+			drawOutline(dc, tl.StrokeColor, tl, lay, line, y)
+		}
+
+		if mask != nil {
+			mask.DrawStringAnchored(line, x, y, lay.ax, lay.ay)
+		} else {
+			c := tl.Color
+			dc.SetRGBA(c.R(), c.G(), c.B(), c.A())
+			dc.DrawStringAnchored(line, x, y, lay.ax, lay.ay)
+		}
+		y += lay.fontHeight * lineSpacing
+	}
+	if mask != nil {
+		dst := dc.Image().(draw.Image)
+		draw.DrawMask(dst, dst.Bounds(), gradientFill(mask, tl, lay), image.Point{}, mask.Image(), image.Point{}, draw.Over)
 	}
 }
 
-func Draw(srcImage image.Image, m *tmemes.Macro) image.Image {
+// drawBoxes paints the box of tl behind each of the lines of lay. The boxes
+// are filled together, so where the boxes of adjacent lines overlap, a
+// translucent color is no darker than elsewhere.
+func drawBoxes(dc *gg.Context, tl frame, lay textLayout) {
+	b := tl.Box
+	pad := b.Padding
+	if pad == 0 {
+		pad = tmemes.DefaultBoxPadding
+	}
+	pad *= lay.fontHeight
+	radius := b.Radius
+	if radius == 0 {
+		radius = tmemes.DefaultBoxRadius
+	}
+	radius *= lay.fontHeight
+
+	// The box spans the ascent and descent of the font around the baseline,
+	// which DrawStringAnchored puts at y + ay*FontHeight.
+	met := fontForSize(tl.Font, lay.fontSize).Metrics()
+	ascent, descent := float64(met.Ascent)/64, float64(met.Descent)/64
+	h := ascent + descent + 2*pad
+	y := lay.y + lay.ay*dc.FontHeight()
+	for _, line := range lay.lines {
+		w, _ := dc.MeasureString(line)
+		x0 := lay.x - lay.ax*w
+		w += 2 * pad
+		dc.DrawRoundedRectangle(x0-pad, y-ascent-pad, w, h, min(radius, w/2, h/2))
+		y += lay.fontHeight * lineSpacing
+	}
+	c := b.Color
+	dc.SetRGBA(c.R(), c.G(), c.B(), c.A())
+	dc.Fill()
+}
+
+// textLayer returns a new transparent context the size of dc, set up to draw
+// the text of tl as laid out by lay.
+func textLayer(dc *gg.Context, tl frame, lay textLayout) *gg.Context {
+	layer := gg.NewContext(dc.Width(), dc.Height())
+	layer.SetFontFace(fontForSize(tl.Font, lay.fontSize))
+	if tl.RotateDegrees != 0 {
+		layer.RotateAbout(gg.Radians(tl.RotateDegrees), lay.cx, lay.cy)
+	}
+	return layer
+}
+
+// gradientFill returns an image the size of layer, painted with the gradient
+// of tl across the bounds of the text in lay. The gradient follows the
+// transformation of layer, which must be set up as by textLayer.
+func gradientFill(layer *gg.Context, tl frame, lay textLayout) image.Image {
+	r := lay.bounds(layer)
+	midX, midY := float64(r.Min.X+r.Max.X)/2, float64(r.Min.Y+r.Max.Y)/2
+	x0, y0, x1, y1 := midX, float64(r.Min.Y), midX, float64(r.Max.Y)
+	if tl.Gradient.Direction == "horizontal" {
+		x0, y0, x1, y1 = float64(r.Min.X), midY, float64(r.Max.X), midY
+	}
+	x0, y0 = layer.TransformPoint(x0, y0)
+	x1, y1 = layer.TransformPoint(x1, y1)
+
+	grad := gg.NewLinearGradient(x0, y0, x1, y1)
+	grad.AddColorStop(0, nrgba(tl.Color))
+	grad.AddColorStop(1, nrgba(tl.Gradient.To))
+	fill := gg.NewContext(layer.Width(), layer.Height())
+	fill.SetFillStyle(grad)
+	fill.DrawRectangle(0, 0, float64(layer.Width()), float64(layer.Height()))
+	fill.Fill()
+	return fill.Image()
+}
+
+// nrgba converts c to a standard library color.
+func nrgba(c tmemes.Color) color.NRGBA {
+	b := func(v float64) uint8 { return uint8(math.Round(v * 255)) }
+	return color.NRGBA{R: b(c.R()), G: b(c.G()), B: b(c.B()), A: b(c.A())}
+}
+
+// Draw renders macro m onto the still template srcImage, with the images of
+// its stickers taken from ss.
+func Draw(srcImage image.Image, m *tmemes.Macro, ss Stickers) image.Image {
 	dc := gg.NewContext(srcImage.Bounds().Dx(), srcImage.Bounds().Dy())
 	bounds := srcImage.Bounds()
 	for _, tl := range m.TextOverlay {
@@ -127,18 +282,19 @@ func Draw(srcImage image.Image, m *tmemes.Macro) image.Image {
 
 	alpha := image.NewNRGBA(bounds)
 	draw.Draw(alpha, bounds, srcImage, bounds.Min, draw.Src)
+	if layer := stickerLayer(m, ss, bounds); layer != nil {
+		draw.Draw(alpha, bounds, layer, bounds.Min, draw.Over)
+	}
 	draw.Draw(alpha, bounds, dc.Image(), bounds.Min, draw.Over)
 	return alpha
 }
 
-func DrawGIF(img *gif.GIF, m *tmemes.Macro) *gif.GIF {
-	lineFrames := make([]frames, len(m.TextOverlay))
-	for i, tl := range m.TextOverlay {
-		lineFrames[i] = newFrames(len(img.Image), tl)
-	}
-
+// DrawGIF renders macro m onto each frame of the animated template img, with
+// the images of its stickers taken from ss. It modifies and returns img.
+func DrawGIF(img *gif.GIF, m *tmemes.Macro, ss Stickers) *gif.GIF {
 	bounds := image.Rect(0, 0, img.Config.Width, img.Config.Height)
 	rStart := time.Now()
+	var pc paletteCache // shared by all frames
 
 	backdrops := make([]*image.Paletted, len(img.Image))
 	backdropReady := make([]chan struct{}, len(img.Image))
@@ -147,61 +303,176 @@ func DrawGIF(img *gif.GIF, m *tmemes.Macro) *gif.GIF {
 	}
 
 	// Draw first frame's backdrop.
-	backdrops[0] = image.NewPaletted(bounds, img.Image[0].Palette)
-	draw.Draw(backdrops[0], bounds, image.NewUniform(img.Image[0].Palette[img.BackgroundIndex]), image.Point{}, draw.Src)
+	backdrops[0] = newBackdrop(img.Image[0], img.BackgroundIndex, bounds)
 	close(backdropReady[0])
 
 	g, run := taskgroup.New(nil).Limit(runtime.NumCPU())
 	for i := 0; i < len(img.Image); i++ {
 		i, frame := i, img.Image[i]
 		run.Run(func() {
-			pal := frame.Palette
-			fb := frame.Bounds()
-
 			// Block until the required background for this frame is already painted.
 			<-backdropReady[i]
 
-			dst := image.NewPaletted(bounds, pal)
-
-			// Draw the backdrop.
-			copy(dst.Pix, backdrops[i].Pix)
-
-			// Draw the frame.
-			draw.Draw(dst, fb, frame, fb.Min, draw.Over)
+			dst := pc.composite(backdrops[i], frame, bounds)
 
 			// Sort out next frame's backdrop, unless we're on the final frame.
 			if i != len(img.Image)-1 {
-				switch img.Disposal[i] {
-				case gif.DisposalBackground:
-					// Restore background colour.
-					backdrops[i+1] = backdrops[0]
-				case gif.DisposalPrevious:
-					// Keep the backdrops the same, i.e. discard whatever this frame drew.
-					backdrops[i+1] = backdrops[i]
-				case gif.DisposalNone:
-					// Do not dispose of the frame, i.e. copy this frame to be next frame's backdrop.
-					backdrops[i+1] = image.NewPaletted(bounds, pal)
-					copy(backdrops[i+1].Pix, dst.Pix)
-				default:
-					backdrops[i+1] = backdrops[0]
-				}
+				backdrops[i+1] = pc.nextBackdrop(dst, frame, backdrops[i], backdrops[0], img.Disposal[i])
 				close(backdropReady[i+1])
 			}
 
-			// Draw the text overlay.
-			dc := gg.NewContext(bounds.Dx(), bounds.Dy())
-			for _, f := range lineFrames {
-				if f.visibleAt(i) {
-					overlayTextOnImage(dc, f.frame(i), bounds)
-				}
-			}
-			text := dc.Image()
-			draw.Draw(dst, dst.Bounds(), text, text.Bounds().Min, draw.Over)
 			img.Image[i] = dst
 		})
 	}
 	g.Wait()
 
+	// Arrange the composited frames for playback.
+	if seq := playOrder(len(img.Image), m.Playback); !isIdentity(seq) {
+		played := make([]*image.Paletted, len(seq))
+		delay := make([]int, len(seq))
+		disposal := make([]byte, len(seq))
+		seen := make([]bool, len(img.Image))
+		for j, i := range seq {
+			played[j] = img.Image[i]
+			if seen[i] {
+				// A boomerang shows frames twice, and the text may differ.
+				played[j] = copyPaletted(img.Image[i])
+			}
+			seen[i] = true
+			delay[j] = img.Delay[i]
+			// Every frame now covers the whole canvas, so each can replace
+			// the last regardless of the order.
+			disposal[j] = gif.DisposalBackground
+		}
+		img.Image, img.Delay, img.Disposal = played, delay, disposal
+	}
+	if m.Playback != nil {
+		for j := range img.Delay {
+			img.Delay[j] = scaleDelay(img.Delay[j], m.Playback.Speed)
+		}
+	}
+
+	// Draw the stickers, which are the same on every frame, and the text
+	// overlay.
+	layer := stickerLayer(m, ss, bounds)
+	g, run = taskgroup.New(nil).Limit(runtime.NumCPU())
+	lineFrames := make([]frames, len(m.TextOverlay))
+	for i, tl := range m.TextOverlay {
+		lineFrames[i] = newFrames(len(img.Image), tl)
+	}
+	for j, dst := range img.Image {
+		run.Run(func() { pc.drawOverlays(dst, j, layer, lineFrames) })
+	}
+	g.Wait()
+
 	log.Printf("Rendering complete: %v", time.Since(rStart).Round(time.Millisecond))
 	return img
 }
+
+// newBackdrop returns the canvas on which the first frame of a GIF is drawn,
+// filled with its background colour, in the palette of that frame.
+func newBackdrop(first *image.Paletted, background byte, bounds image.Rectangle) *image.Paletted {
+	bg := image.NewPaletted(bounds, first.Palette)
+	draw.Draw(bg, bounds, image.NewUniform(first.Palette[background]), image.Point{}, draw.Src)
+	return bg
+}
+
+// composite returns frame drawn over backdrop, as an image of the whole
+// canvas in the palette of frame.
+func (c *paletteCache) composite(backdrop, frame *image.Paletted, bounds image.Rectangle) *image.Paletted {
+	pal := frame.Palette
+	dst := image.NewPaletted(bounds, pal)
+
+	// Draw the backdrop. If it was painted with a different palette, its
+	// pixel indices do not mean the same colours in this frame, so map the
+	// colours over instead of copying the indices.
+	if samePalette(backdrop.Palette, pal) {
+		copy(dst.Pix, backdrop.Pix)
+	} else {
+		c.drawSrc(dst, bounds, backdrop)
+	}
+
+	// Draw the frame.
+	c.drawOver(dst, frame.Bounds(), frame)
+	return dst
+}
+
+// nextBackdrop returns the backdrop for the frame after the one composited
+// as dst, by drawing frame over backdrop, according to the disposal method
+// of that frame. The first frame of the GIF was drawn over bg.
+func (c *paletteCache) nextBackdrop(dst, frame, backdrop, bg *image.Paletted, disposal byte) *image.Paletted {
+	switch disposal {
+	case gif.DisposalBackground:
+		// Restore background colour in the area of this frame.
+		next := copyPaletted(dst)
+		c.drawSrc(next, frame.Bounds(), bg)
+		return next
+	case gif.DisposalPrevious:
+		// Keep the backdrops the same, i.e. discard whatever this frame drew.
+		return backdrop
+	case gif.DisposalNone:
+		// Do not dispose of the frame, i.e. copy this frame to be next frame's backdrop.
+		return copyPaletted(dst)
+	default:
+		return bg
+	}
+}
+
+// drawOverlays draws the stickers in layer (if not nil), which are the same
+// on every frame, and the text of lines visible in frame j, onto dst.
+func (c *paletteCache) drawOverlays(dst *image.Paletted, j int, layer image.Image, lines []frames) {
+	bounds := dst.Bounds()
+	if layer != nil {
+		c.drawOver(dst, bounds, layer)
+	}
+	dc := gg.NewContext(bounds.Dx(), bounds.Dy())
+	for _, f := range lines {
+		if f.visibleAt(j) {
+			overlayTextOnImage(dc, f.frame(j), bounds)
+		}
+	}
+	c.drawOver(dst, bounds, dc.Image())
+}
+
+// DrawGIFFrame renders frame n of the animated macro m, whose template is img,
+// as it appears while the animation plays, with the images of its stickers
+// taken from ss. Unlike DrawGIF, it draws text only for that frame. Frames are numbered in the order they are played (see
+// FrameCount). It panics if n is out of range.
+func DrawGIFFrame(img *gif.GIF, m *tmemes.Macro, ss Stickers, n int) image.Image {
+	seq := playOrder(len(img.Image), m.Playback)
+	canvas := frameAt(img, seq[n])
+	bounds := canvas.Bounds()
+	if layer := stickerLayer(m, ss, bounds); layer != nil {
+		draw.Draw(canvas, bounds, layer, image.Point{}, draw.Over)
+	}
+	dc := gg.NewContext(bounds.Dx(), bounds.Dy())
+	for _, tl := range m.TextOverlay {
+		if f := newFrames(len(seq), tl); f.visibleAt(n) {
+			overlayTextOnImage(dc, f.frame(n), bounds)
+		}
+	}
+	draw.Draw(canvas, bounds, dc.Image(), image.Point{}, draw.Over)
+	return canvas
+}
+
+// FrameCount reports the number of frames in the animation of macro m, whose
+// template is img, as drawn by DrawGIF.
+func FrameCount(img *gif.GIF, m *tmemes.Macro) int {
+	return len(playOrder(len(img.Image), m.Playback))
+}
+
+// samePalette reports whether a and b contain the same colours in the same
+// order.
+func samePalette(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		r1, g1, b1, a1 := a[i].RGBA()
+		r2, g2, b2, a2 := b[i].RGBA()
+		if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+			return false
+		}
+	}
+	return true
+}
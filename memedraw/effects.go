@@ -0,0 +1,191 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"github.com/tailscale/tmemes"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// drawOutline paints the outline of one line of lay at y, in the RGB
+// components of c, ignoring its opacity. The glyphs of the line are filled
+// and stroked with the outline width, so the outline also covers the text.
+func drawOutline(dc *gg.Context, c tmemes.Color, tl frame, lay textLayout, line string, y float64) {
+	dc.SetRGB(c.R(), c.G(), c.B())
+	appendTextPath(dc, tl.Font, lay, line, y)
+	strokeText(dc, lay)
+}
+
+// strokeText fills and strokes the current path of dc, the outlines of some
+// glyphs, with the outline width of lay.
+func strokeText(dc *gg.Context, lay textLayout) {
+	dc.SetLineWidth(2 * lay.outline) // half of it lies inside the glyphs
+	dc.SetLineJoin(gg.LineJoinRound)
+	dc.FillPreserve()
+	dc.Stroke()
+}
+
+// drawShadow paints the shadow of the text of tl, and of its outline if it
+// is drawn, as laid out by lay.
+func drawShadow(dc *gg.Context, tl frame, lay textLayout) {
+	s := tl.Shadow
+	layer := textLayer(dc, tl, lay)
+	layer.SetRGB(0, 0, 0)
+	y := lay.y
+	for _, line := range lay.lines {
+		appendTextPath(layer, tl.Font, lay, line, y)
+		y += lay.fontHeight * lineSpacing
+	}
+	if tl.StrokeColor.A() > 0 {
+		strokeText(layer, lay)
+	} else {
+		layer.Fill()
+	}
+
+	var mask image.Image = layer.Image()
+	if s.Blur > 0 {
+		mask = blurAlpha(layer.Image().(*image.RGBA), int(math.Round(s.Blur*lay.textHeight/2)))
+	}
+	ox, oy := s.OffsetX, s.OffsetY
+	if ox == 0 && oy == 0 {
+		ox, oy = tmemes.DefaultShadowOffset, tmemes.DefaultShadowOffset
+	}
+	off := image.Pt(int(math.Round(ox*lay.textHeight)), int(math.Round(oy*lay.textHeight)))
+	dst := dc.Image().(draw.Image)
+	draw.DrawMask(dst, dst.Bounds(), image.NewUniform(nrgba(s.Color)), image.Point{}, mask, off.Mul(-1), draw.Over)
+}
+
+// appendTextPath adds the outlines of the glyphs of one line of lay at y,
+// drawn in the named font, to the current path of dc. The glyphs are placed
+// as DrawStringAnchored places them.
+func appendTextPath(dc *gg.Context, name string, lay textLayout, line string, y float64) {
+	f := fontNamed(name)
+	scale := fixed.Int26_6(lay.fontSize * 64) // at 72 DPI, as for fontForSize
+	w, h := dc.MeasureString(line)
+	x := lay.x - lay.ax*w
+	y += lay.ay * h
+
+	var gb truetype.GlyphBuf
+	prev := truetype.Index(0)
+	for i, r := range []rune(line) {
+		idx := f.Index(r)
+		if i > 0 {
+			x += fix(f.Kern(scale, prev, idx))
+		}
+		if err := gb.Load(f, scale, idx, font.HintingNone); err != nil {
+			continue
+		}
+		start := 0
+		for _, end := range gb.Ends {
+			appendContour(dc, gb.Points[start:end], x, y)
+			start = end
+		}
+		x += fix(gb.AdvanceWidth)
+		prev = idx
+	}
+}
+
+// appendContour adds one contour of a TrueType glyph, with its origin at
+// (x, y), to the current path of dc. Between two off-curve points of the
+// contour is an implied on-curve point halfway between them.
+func appendContour(dc *gg.Context, ps []truetype.Point, x, y float64) {
+	if len(ps) == 0 {
+		return
+	}
+	pt := func(p truetype.Point) (float64, float64) {
+		return x + fix(p.X), y - fix(p.Y) // glyph coordinates are y-up
+	}
+	onCurve := func(p truetype.Point) bool { return p.Flags&1 != 0 }
+
+	// Start at an on-curve point: the first, or else the last, or else the
+	// implied one between them.
+	last := ps[len(ps)-1]
+	var sx, sy float64
+	switch {
+	case onCurve(ps[0]):
+		sx, sy = pt(ps[0])
+	case onCurve(last):
+		sx, sy = pt(last)
+	default:
+		x0, y0 := pt(ps[0])
+		x1, y1 := pt(last)
+		sx, sy = (x0+x1)/2, (y0+y1)/2
+	}
+	dc.MoveTo(sx, sy)
+	qx, qy, on := sx, sy, true
+	for _, p := range ps {
+		px, py := pt(p)
+		switch {
+		case onCurve(p) && on:
+			dc.LineTo(px, py)
+		case onCurve(p):
+			dc.QuadraticTo(qx, qy, px, py)
+		case !on:
+			dc.QuadraticTo(qx, qy, (qx+px)/2, (qy+py)/2)
+		}
+		qx, qy, on = px, py, onCurve(p)
+	}
+	if on {
+		dc.LineTo(sx, sy)
+	} else {
+		dc.QuadraticTo(qx, qy, sx, sy)
+	}
+	dc.ClosePath()
+}
+
+// fix converts v to a float64.
+func fix(v fixed.Int26_6) float64 { return float64(v) / 64 }
+
+// blurAlpha returns the alpha channel of img blurred with the given radius in
+// pixels, by three passes of a box blur in each direction, which approximate
+// a Gaussian blur.
+func blurAlpha(img *image.RGBA, radius int) *image.Alpha {
+	b := img.Bounds()
+	out := image.NewAlpha(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			out.Pix[out.PixOffset(x, y)] = img.Pix[img.PixOffset(x, y)+3]
+		}
+	}
+	if radius < 1 {
+		return out
+	}
+	w, h := b.Dx(), b.Dy()
+	tmp := make([]uint8, len(out.Pix))
+	for range 3 {
+		for y := range h {
+			boxBlur(tmp[y*out.Stride:], out.Pix[y*out.Stride:], w, 1, radius)
+		}
+		for x := range w {
+			boxBlur(out.Pix[x:], tmp[x:], h, out.Stride, radius)
+		}
+	}
+	return out
+}
+
+// boxBlur sets each of the n values of dst, stride apart, to the mean of the
+// values of src within radius of it, counting those beyond the ends as 0.
+func boxBlur(dst, src []uint8, n, stride, radius int) {
+	size := 2*radius + 1
+	var sum int
+	for i := range min(radius, n) {
+		sum += int(src[i*stride])
+	}
+	for i := range n {
+		if j := i + radius; j < n {
+			sum += int(src[j*stride])
+		}
+		dst[i*stride] = uint8((sum + size/2) / size)
+		if j := i - radius; j >= 0 {
+			sum -= int(src[j*stride])
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"fmt"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gosmallcaps"
+
+	_ "embed"
+)
+
+// Oswald is licensed under the SIL Open Font License; the Go fonts are
+// licensed under the same terms as the Go project.
+
+//go:embed Oswald-SemiBold.ttf
+var oswaldSemiBoldBytes []byte
+
+// DefaultFont is the name of the font used for text lines that do not
+// specify one.
+const DefaultFont = "oswald"
+
+// A Font describes a typeface available for drawing text.
+type Font struct {
+	Name        string `json:"name"`        // as used in tmemes.TextLine
+	Description string `json:"description"` // human-readable
+}
+
+// fontDefs lists the preloaded fonts, default first.
+var fontDefs = []struct {
+	Font
+	ttf []byte
+}{
+	{Font{DefaultFont, "Oswald SemiBold"}, oswaldSemiBoldBytes},
+	{Font{"go-bold", "Go Bold"}, gobold.TTF},
+	{Font{"go-bold-italic", "Go Bold Italic"}, gobolditalic.TTF},
+	{Font{"go-mono-bold", "Go Mono Bold"}, gomonobold.TTF},
+	{Font{"go-smallcaps", "Go Smallcaps"}, gosmallcaps.TTF},
+}
+
+// fonts maps font names to their parsed definitions.
+var fonts = make(map[string]*truetype.Font)
+
+func init() {
+	for _, def := range fontDefs {
+		f, err := truetype.Parse(def.ttf)
+		if err != nil {
+			panic(fmt.Sprintf("Parsing font %q: %v", def.Name, err))
+		}
+		fonts[def.Name] = f
+	}
+}
+
+// Fonts returns descriptions of the available fonts, default first.
+func Fonts() []Font {
+	out := make([]Font, len(fontDefs))
+	for i, def := range fontDefs {
+		out[i] = def.Font
+	}
+	return out
+}
+
+// HasFont reports whether name is the name of an available font. The empty
+// name denotes DefaultFont.
+func HasFont(name string) bool {
+	_, ok := fonts[name]
+	return ok || name == ""
+}
+
+// fontNamed returns the named font. An empty or unknown name selects
+// DefaultFont.
+func fontNamed(name string) *truetype.Font {
+	f, ok := fonts[name]
+	if !ok {
+		f = fonts[DefaultFont]
+	}
+	return f
+}
+
+// fontForSize constructs a new font.Face for the named font at the specified
+// point size. An empty or unknown name selects DefaultFont.
+func fontForSize(name string, points int) font.Face {
+	return truetype.NewFace(fontNamed(name), &truetype.Options{
+		Size: float64(points),
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+	"time"
+)
+
+// GIFDuration reports the total time it takes to play one loop of img.
+func GIFDuration(img *gif.GIF) time.Duration {
+	var total time.Duration
+	for _, d := range img.Delay {
+		total += time.Duration(d) * 10 * time.Millisecond
+	}
+	return total
+}
+
+// DownsampleGIF halves the number of frames in img by dropping every other
+// frame, starting with the second.
+//
+// If keepTiming is true, the delay of each dropped frame is added to the frame
+// before it, so the animation plays at the same speed but less smoothly.
+// Otherwise the delays are unchanged, and the animation plays twice as fast.
+//
+// Since GIF frames may only update part of the image, the remaining frames
+// are first coalesced onto the full canvas.
+func DownsampleGIF(img *gif.GIF, keepTiming bool) {
+	coalesceGIF(img)
+	n := 0
+	for i := 0; i < len(img.Image); i += 2 {
+		img.Image[n] = img.Image[i]
+		img.Disposal[n] = img.Disposal[i]
+		img.Delay[n] = img.Delay[i]
+		if keepTiming && i+1 < len(img.Delay) {
+			img.Delay[n] += img.Delay[i+1]
+		}
+		n++
+	}
+	img.Image = img.Image[:n]
+	img.Disposal = img.Disposal[:n]
+	img.Delay = img.Delay[:n]
+}
+
+// coalesceGIF replaces each frame of img with a full-canvas frame showing how
+// the image looks at that point of the animation.
+func coalesceGIF(img *gif.GIF) {
+	c := newGIFCanvas(img)
+	for i, frame := range img.Image {
+		c.draw(i)
+		full := image.NewPaletted(c.bounds, frame.Palette)
+		draw.Draw(full, c.bounds, c.canvas, image.Point{}, draw.Src)
+		c.dispose(i)
+		img.Image[i] = full
+
+		// Each frame now replaces the whole canvas.
+		img.Disposal[i] = gif.DisposalBackground
+	}
+}
+
+// frameAt returns a full-canvas image showing how img looks when frame n of
+// its animation is displayed.
+func frameAt(img *gif.GIF, n int) *image.RGBA {
+	c := newGIFCanvas(img)
+	for i := 0; i < n; i++ {
+		c.draw(i)
+		c.dispose(i)
+	}
+	c.draw(n)
+	return c.canvas
+}
+
+// A gifCanvas tracks the appearance of a GIF as its frames are played.
+type gifCanvas struct {
+	img    *gif.GIF
+	bounds image.Rectangle
+	bg     image.Image
+	canvas *image.RGBA
+	saved  *image.RGBA // for frames with DisposalPrevious
+}
+
+// newGIFCanvas returns a canvas for img, filled with its background. It also
+// fills in any missing disposal and delay values of img.
+func newGIFCanvas(img *gif.GIF) *gifCanvas {
+	bounds := image.Rect(0, 0, img.Config.Width, img.Config.Height)
+	if bounds.Empty() {
+		bounds = img.Image[0].Bounds()
+	}
+	for len(img.Disposal) < len(img.Image) {
+		img.Disposal = append(img.Disposal, gif.DisposalNone)
+	}
+	for len(img.Delay) < len(img.Image) {
+		img.Delay = append(img.Delay, 0)
+	}
+
+	var bg image.Image = image.Transparent
+	if pal := img.Image[0].Palette; int(img.BackgroundIndex) < len(pal) {
+		bg = image.NewUniform(pal[img.BackgroundIndex])
+	}
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, bg, image.Point{}, draw.Src)
+	return &gifCanvas{img: img, bounds: bounds, bg: bg, canvas: canvas}
+}
+
+// draw paints frame i onto the canvas.
+func (c *gifCanvas) draw(i int) {
+	if c.img.Disposal[i] == gif.DisposalPrevious {
+		c.saved = image.NewRGBA(c.bounds)
+		copy(c.saved.Pix, c.canvas.Pix)
+	}
+	frame := c.img.Image[i]
+	fb := frame.Bounds()
+	draw.Draw(c.canvas, fb, frame, fb.Min, draw.Over)
+}
+
+// dispose updates the canvas after frame i is done, according to its
+// disposal method.
+func (c *gifCanvas) dispose(i int) {
+	switch c.img.Disposal[i] {
+	case gif.DisposalBackground:
+		draw.Draw(c.canvas, c.img.Image[i].Bounds(), c.bg, image.Point{}, draw.Src)
+	case gif.DisposalPrevious:
+		c.canvas = c.saved
+	}
+}
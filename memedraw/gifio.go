@@ -0,0 +1,471 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"bufio"
+	"bytes"
+	"compress/lzw"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"math/bits"
+	"slices"
+)
+
+// Frame-at-a-time GIF decoding and encoding.
+//
+// The image/gif package decodes and encodes all the frames of a GIF at once,
+// which for a long animation takes a lot of memory. A gifReader and a
+// gifWriter handle one frame at a time instead. The frames a gifReader reads
+// are the same as those gif.DecodeAll returns, and a gifWriter writes the
+// same bytes as gif.EncodeAll, so that streamed renderings are the same as
+// those of DrawGIF.
+
+// Block labels and flags of the GIF format.
+const (
+	gifExtension       = 0x21
+	gifImageDescriptor = 0x2c
+	gifTrailer         = 0x3b
+
+	gifPlainText      = 0x01
+	gifGraphicControl = 0xf9
+	gifComment        = 0xfe
+	gifApplication    = 0xff
+
+	gifColorTable     = 0x80 // a colour table follows
+	gifInterlace      = 0x40 // the rows of the frame are interlaced
+	gifColorTableBits = 0x07 // the size of the colour table
+)
+
+// A gifHeader holds the settings of a GIF that apply to all of its frames.
+type gifHeader struct {
+	width, height int
+	global        color.Palette // the global colour table, or nil
+	background    byte          // index in global
+	loopCount     int           // as for gif.GIF
+}
+
+// headerOf returns the header of g.
+func headerOf(g *gif.GIF) gifHeader {
+	global, _ := g.Config.ColorModel.(color.Palette)
+	return gifHeader{
+		width:      g.Config.Width,
+		height:     g.Config.Height,
+		global:     global,
+		background: g.BackgroundIndex,
+		loopCount:  g.LoopCount,
+	}
+}
+
+// A gifReader reads the frames of a GIF one at a time.
+type gifReader struct {
+	gifHeader // loopCount is updated as frames are read
+	r         *bufio.Reader
+
+	// The graphic control settings for the next frame. As in image/gif, the
+	// disposal method carries over to later frames, but the others do not.
+	delay       int
+	disposal    byte
+	transparent int // -1 if none
+
+	tmp [3 * 256]byte
+}
+
+// newGIFReader reads the header of a GIF from r.
+func newGIFReader(r io.Reader) (*gifReader, error) {
+	gr := &gifReader{r: bufio.NewReader(r), transparent: -1}
+	gr.loopCount = -1
+	hdr := gr.tmp[:13]
+	if _, err := io.ReadFull(gr.r, hdr); err != nil {
+		return nil, fmt.Errorf("reading GIF header: %w", err)
+	}
+	if v := string(hdr[:6]); v != "GIF87a" && v != "GIF89a" {
+		return nil, fmt.Errorf("unknown GIF version %q", v)
+	}
+	gr.width = int(binary.LittleEndian.Uint16(hdr[6:]))
+	gr.height = int(binary.LittleEndian.Uint16(hdr[8:]))
+	if fields := hdr[10]; fields&gifColorTable != 0 {
+		gr.background = hdr[11]
+		var err error
+		if gr.global, err = gr.readColorTable(fields); err != nil {
+			return nil, err
+		}
+	}
+	return gr, nil
+}
+
+// next reads the next frame of the GIF, with its delay and disposal method.
+// If decode is false, it skips the pixels of the frame and returns a nil
+// image. After the last frame, it reports io.EOF.
+func (gr *gifReader) next(decode bool) (*image.Paletted, int, byte, error) {
+	for {
+		c, err := gr.r.ReadByte()
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("reading GIF frames: %w", noEOF(err))
+		}
+		switch c {
+		case gifExtension:
+			if err := gr.readExtension(); err != nil {
+				return nil, 0, 0, fmt.Errorf("reading GIF extension: %w", noEOF(err))
+			}
+		case gifImageDescriptor:
+			return gr.readFrame(decode)
+		case gifTrailer:
+			return nil, 0, 0, io.EOF
+		default:
+			return nil, 0, 0, fmt.Errorf("unknown GIF block type 0x%02x", c)
+		}
+	}
+}
+
+func (gr *gifReader) readColorTable(fields byte) (color.Palette, error) {
+	n := 1 << (1 + fields&gifColorTableBits)
+	buf := gr.tmp[:3*n]
+	if _, err := io.ReadFull(gr.r, buf); err != nil {
+		return nil, fmt.Errorf("reading GIF color table: %w", noEOF(err))
+	}
+	p := make(color.Palette, n)
+	for i := range p {
+		p[i] = color.RGBA{buf[3*i], buf[3*i+1], buf[3*i+2], 0xff}
+	}
+	return p, nil
+}
+
+func (gr *gifReader) readExtension() error {
+	label, err := gr.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	size := 0
+	switch label {
+	case gifPlainText:
+		size = 13
+	case gifGraphicControl:
+		return gr.readGraphicControl()
+	case gifComment:
+		// Only sub-blocks follow.
+	case gifApplication:
+		b, err := gr.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		size = int(b)
+	default:
+		return fmt.Errorf("unknown extension 0x%02x", label)
+	}
+	if _, err := io.ReadFull(gr.r, gr.tmp[:size]); err != nil {
+		return err
+	}
+
+	// The NETSCAPE2.0 application extension holds the loop count.
+	if label == gifApplication && string(gr.tmp[:size]) == "NETSCAPE2.0" {
+		n, err := gr.readBlock()
+		if err != nil || n == 0 {
+			return err
+		}
+		if n == 3 && gr.tmp[0] == 1 {
+			gr.loopCount = int(gr.tmp[1]) | int(gr.tmp[2])<<8
+		}
+	}
+	return gr.skipBlocks()
+}
+
+func (gr *gifReader) readGraphicControl() error {
+	b := gr.tmp[:6]
+	if _, err := io.ReadFull(gr.r, b); err != nil {
+		return err
+	}
+	if b[0] != 4 {
+		return fmt.Errorf("invalid graphic control block size %d", b[0])
+	} else if b[5] != 0 {
+		return errors.New("invalid graphic control block terminator")
+	}
+	gr.disposal = (b[1] & 0x1c) >> 2
+	gr.delay = int(b[2]) | int(b[3])<<8
+	if b[1]&0x01 != 0 {
+		gr.transparent = int(b[4])
+	}
+	return nil
+}
+
+func (gr *gifReader) readFrame(decode bool) (*image.Paletted, int, byte, error) {
+	d := gr.tmp[:9]
+	if _, err := io.ReadFull(gr.r, d); err != nil {
+		return nil, 0, 0, fmt.Errorf("reading GIF image descriptor: %w", noEOF(err))
+	}
+	left := int(binary.LittleEndian.Uint16(d[0:]))
+	top := int(binary.LittleEndian.Uint16(d[2:]))
+	width := int(binary.LittleEndian.Uint16(d[4:]))
+	height := int(binary.LittleEndian.Uint16(d[6:]))
+	fields := d[8]
+	if left+width > gr.width || top+height > gr.height {
+		return nil, 0, 0, errors.New("GIF frame bounds larger than image bounds")
+	}
+
+	pal := gr.global
+	if fields&gifColorTable != 0 {
+		var err error
+		if pal, err = gr.readColorTable(fields); err != nil {
+			return nil, 0, 0, err
+		}
+	} else if pal == nil {
+		return nil, 0, 0, errors.New("GIF frame has no color table")
+	}
+	if ti := gr.transparent; ti >= 0 {
+		if fields&gifColorTable == 0 {
+			pal = slices.Clone(pal) // leave the global table as it is
+		}
+		for len(pal) <= ti {
+			pal = append(pal, color.RGBA{})
+		}
+		pal[ti] = color.RGBA{}
+	}
+	litWidth, err := gr.r.ReadByte()
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("reading GIF image data: %w", noEOF(err))
+	} else if litWidth < 2 || litWidth > 8 {
+		return nil, 0, 0, fmt.Errorf("invalid GIF pixel size %d", litWidth)
+	}
+	delay, disposal := gr.delay, gr.disposal
+	gr.delay, gr.transparent = 0, -1
+
+	if !decode {
+		if err := gr.skipBlocks(); err != nil {
+			return nil, 0, 0, fmt.Errorf("reading GIF image data: %w", noEOF(err))
+		}
+		return nil, delay, disposal, nil
+	}
+	var data bytes.Buffer
+	for {
+		n, err := gr.readBlock()
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("reading GIF image data: %w", noEOF(err))
+		} else if n == 0 {
+			break
+		}
+		data.Write(gr.tmp[:n])
+	}
+	m := image.NewPaletted(image.Rect(left, top, left+width, top+height), pal)
+	lr := lzw.NewReader(&data, lzw.LSB, int(litWidth))
+	defer lr.Close()
+	if _, err := io.ReadFull(lr, m.Pix); err != nil {
+		return nil, 0, 0, fmt.Errorf("reading GIF image data: %w", err)
+	}
+	if len(pal) < 256 {
+		for _, px := range m.Pix {
+			if int(px) >= len(pal) {
+				return nil, 0, 0, errors.New("GIF pixel value out of range")
+			}
+		}
+	}
+	if fields&gifInterlace != 0 {
+		uninterlace(m)
+	}
+	return m, delay, disposal, nil
+}
+
+// readBlock reads a data sub-block into gr.tmp, and returns its length,
+// which is 0 at the end of the data.
+func (gr *gifReader) readBlock() (int, error) {
+	n, err := gr.r.ReadByte()
+	if n == 0 || err != nil {
+		return 0, err
+	}
+	_, err = io.ReadFull(gr.r, gr.tmp[:n])
+	return int(n), err
+}
+
+// skipBlocks skips data sub-blocks up to the end of the data.
+func (gr *gifReader) skipBlocks() error {
+	for {
+		n, err := gr.readBlock()
+		if err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+// uninterlace puts the rows of m, stored in interlaced order, in order.
+func uninterlace(m *image.Paletted) {
+	dx, dy := m.Rect.Dx(), m.Rect.Dy()
+	pix := make([]uint8, dx*dy)
+	off := 0
+	for _, pass := range [...]struct{ start, skip int }{{0, 8}, {4, 8}, {2, 4}, {1, 2}} {
+		for y := pass.start; y < dy; y += pass.skip {
+			copy(pix[y*dx:(y+1)*dx], m.Pix[off:off+dx])
+			off += dx
+		}
+	}
+	m.Pix = pix
+}
+
+// noEOF converts io.EOF, which callers of a gifReader take to mean there are
+// no more frames, to io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// A gifWriter writes the frames of a GIF one at a time.
+type gifWriter struct {
+	gifHeader
+	w        *bufio.Writer
+	globalCT []byte // the encoded global colour table
+}
+
+// newGIFWriter returns a gifWriter that writes to w.
+func newGIFWriter(w io.Writer) *gifWriter {
+	return &gifWriter{w: bufio.NewWriter(w)}
+}
+
+// start writes the header of a GIF with n frames.
+func (gw *gifWriter) start(h gifHeader, n int) error {
+	gw.gifHeader = h
+	gw.w.WriteString("GIF89a")
+	gw.w.Write(le16(h.width, h.height))
+	if len(h.global) > 0 {
+		size := log2(len(h.global))
+		ct, err := encodeColorTable(h.global, size)
+		if err != nil {
+			return err
+		}
+		gw.w.Write([]byte{gifColorTable | byte(size), h.background, 0})
+		gw.w.Write(ct)
+		gw.globalCT = ct
+	} else {
+		gw.w.Write([]byte{0, 0, 0})
+	}
+	if n > 1 && h.loopCount >= 0 {
+		gw.w.Write([]byte{gifExtension, gifApplication, 11})
+		gw.w.WriteString("NETSCAPE2.0")
+		gw.w.Write([]byte{3, 1, byte(h.loopCount), byte(h.loopCount >> 8), 0})
+	}
+	return nil
+}
+
+// frame writes pm, to be shown for delay 100ths of a second and then
+// disposed of by the given method.
+func (gw *gifWriter) frame(pm *image.Paletted, delay int, disposal byte) error {
+	if len(pm.Palette) == 0 {
+		return errors.New("cannot encode GIF frame with empty palette")
+	}
+	b := pm.Bounds()
+	if b.Min.X < 0 || b.Max.X >= 1<<16 || b.Min.Y < 0 || b.Max.Y >= 1<<16 {
+		return errors.New("GIF frame is too large to encode")
+	} else if !b.In(image.Rect(0, 0, gw.width, gw.height)) {
+		return errors.New("GIF frame is out of bounds")
+	}
+	ti := -1
+	for i, c := range pm.Palette {
+		if c == nil {
+			return errors.New("cannot encode GIF color table with nil entries")
+		}
+		if _, _, _, a := c.RGBA(); a == 0 {
+			ti = i
+			break
+		}
+	}
+
+	if delay > 0 || disposal != 0 || ti >= 0 {
+		flags, tb := disposal<<2, byte(0)
+		if ti >= 0 {
+			flags, tb = flags|0x01, byte(ti)
+		}
+		gw.w.Write([]byte{gifExtension, gifGraphicControl, 4, flags, byte(delay), byte(delay >> 8), tb, 0})
+	}
+	gw.w.WriteByte(gifImageDescriptor)
+	gw.w.Write(le16(b.Min.X, b.Min.Y, b.Dx(), b.Dy()))
+
+	// As in image/gif, use the global colour table if the palette is the
+	// global one, or a copy of it with a transparent entry.
+	size := log2(len(pm.Palette))
+	if gp := gw.global; len(pm.Palette) <= len(gp) && &gp[0] == &pm.Palette[0] {
+		gw.w.WriteByte(0)
+	} else if ct, err := encodeColorTable(pm.Palette, size); err != nil {
+		return err
+	} else if len(ct) <= len(gw.globalCT) && gw.matchesGlobal(ct[:3*len(pm.Palette)], ti) {
+		gw.w.WriteByte(0)
+	} else {
+		gw.w.WriteByte(gifColorTable | byte(size))
+		gw.w.Write(ct)
+	}
+
+	litWidth := max(size+1, 2)
+	gw.w.WriteByte(byte(litWidth))
+	var data bytes.Buffer
+	lw := lzw.NewWriter(&data, lzw.LSB, litWidth)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := pm.PixOffset(b.Min.X, y)
+		lw.Write(pm.Pix[i : i+b.Dx()])
+	}
+	lw.Close()
+	for d := data.Bytes(); len(d) > 0; {
+		n := min(len(d), 255)
+		gw.w.WriteByte(byte(n))
+		gw.w.Write(d[:n])
+		d = d[n:]
+	}
+	return gw.w.WriteByte(0)
+}
+
+// matchesGlobal reports whether the encoded colour table ct is the same as
+// the start of the global one, except perhaps for entry ti (if ti >= 0).
+func (gw *gifWriter) matchesGlobal(ct []byte, ti int) bool {
+	g := gw.globalCT[:len(ct)]
+	if ti < 0 {
+		return bytes.Equal(g, ct)
+	}
+	return bytes.Equal(g[:3*ti], ct[:3*ti]) && bytes.Equal(g[3*ti+3:], ct[3*ti+3:])
+}
+
+// finish writes the end of the GIF.
+func (gw *gifWriter) finish() error {
+	gw.w.WriteByte(gifTrailer)
+	return gw.w.Flush()
+}
+
+// encodeColorTable encodes p as a GIF colour table of 2^(size+1) entries.
+func encodeColorTable(p color.Palette, size int) ([]byte, error) {
+	if size >= 8 {
+		return nil, errors.New("cannot encode GIF color table with more than 256 entries")
+	}
+	ct := make([]byte, 3<<(size+1)) // padded with black
+	for i, c := range p {
+		if c == nil {
+			return nil, errors.New("cannot encode GIF color table with nil entries")
+		}
+		if rgba, ok := c.(color.RGBA); ok {
+			ct[3*i], ct[3*i+1], ct[3*i+2] = rgba.R, rgba.G, rgba.B
+		} else {
+			r, g, b, _ := c.RGBA()
+			ct[3*i], ct[3*i+1], ct[3*i+2] = uint8(r>>8), uint8(g>>8), uint8(b>>8)
+		}
+	}
+	return ct, nil
+}
+
+// log2 returns the size field of a GIF colour table with n entries, which
+// holds 2^(size+1) entries.
+func log2(n int) int {
+	if n < 2 {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - 1
+}
+
+// le16 encodes vs as little-endian 16-bit values.
+func le16(vs ...int) []byte {
+	out := make([]byte, 0, 2*len(vs))
+	for _, v := range vs {
+		out = binary.LittleEndian.AppendUint16(out, uint16(v))
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"image"
+	"math/bits"
+)
+
+// ImageHash computes a 64-bit perceptual hash of img. Images that look alike
+// have hashes that differ in few bits (see HashDistance), even if they differ
+// in size, format, or compression.
+//
+// This is a "difference hash": The image is reduced to a 9×8 grid of
+// grayscale cells, and each bit records whether a cell is brighter than its
+// neighbour to the right.
+func ImageHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	var grid [h][w]float64
+
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/h)
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/w)
+			grid[y][x] = meanLuma(img, image.Rect(x0, y0, x1, y1))
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if grid[y][x] > grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HashDistance reports the number of bits that differ between two hashes
+// computed by ImageHash. Smaller values mean the images are more alike.
+func HashDistance(a, b uint64) int { return bits.OnesCount64(a ^ b) }
+
+// meanLuma returns the average brightness of img within r.  To keep the cost
+// bounded for large images, it samples at most 16×16 points in r.
+func meanLuma(img image.Image, r image.Rectangle) float64 {
+	const samples = 16
+	dx, dy := max(1, r.Dx()/samples), max(1, r.Dy()/samples)
+
+	var sum float64
+	var n int
+	for y := r.Min.Y; y < r.Max.Y; y += dy {
+		for x := r.Min.X; x < r.Max.X; x += dx {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(cr) + 0.587*float64(cg) + 0.114*float64(cb)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
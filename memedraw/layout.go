@@ -0,0 +1,136 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/fogleman/gg"
+	"github.com/tailscale/tmemes"
+)
+
+// A LayoutWarning describes a text line of a macro that does not fit where it
+// is placed.
+type LayoutWarning struct {
+	Line    int    `json:"line"`    // index in the text overlay
+	Problem string `json:"problem"` // "overflow" or "overlap"
+	Message string `json:"message"` // human-readable
+
+	// The box covered by the text, including its outline, as fractions of
+	// the width and height of the image.
+	Box Rect `json:"box"`
+
+	Area int   `json:"area,omitempty"` // for "overflow", index in the line's field
+	With []int `json:"with,omitempty"` // for "overlap", the other lines
+}
+
+// A Rect is a rectangle whose position and size are given as fractions of the
+// width and height of an image. X and Y are its top left corner.
+type Rect struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// CheckLayout reports the text lines of m that would not fit when drawn onto
+// an image with the given bounds: those whose text extends past an edge of
+// the image in any of their areas, and those whose text overlaps that of
+// another line shown at the same time. If animated is false, all the lines
+// are shown together regardless of their timing. Overlaps are checked where
+// the lines first appear. The boxes take rotation into account.
+func CheckLayout(bounds image.Rectangle, m *tmemes.Macro, animated bool) []LayoutWarning {
+	dc := gg.NewContext(bounds.Dx(), bounds.Dy())
+	img := image.Rect(0, 0, bounds.Dx(), bounds.Dy())
+	var out []LayoutWarning
+
+	first := make([]image.Rectangle, len(m.TextOverlay))
+	for i, tl := range m.TextOverlay {
+		for j := range tl.Field {
+			f := frame{TextLine: tl, pos: j, fpa: 1}
+			lay, ok := layoutText(dc, f, bounds)
+			if !ok {
+				continue
+			}
+			box := lay.drawnBounds(dc, tl.RotateDegrees)
+			if j == 0 {
+				first[i] = box
+			}
+			if !box.In(img) {
+				out = append(out, LayoutWarning{
+					Line:    i,
+					Problem: "overflow",
+					Message: fmt.Sprintf("text %q extends past the edge of the image; use less text, a smaller size, or move it", tl.Text),
+					Box:     toRect(box, bounds),
+					Area:    j,
+				})
+			}
+		}
+	}
+
+	for i, tl := range m.TextOverlay {
+		var with []int
+		for j, other := range m.TextOverlay {
+			if j != i && first[i].Overlaps(first[j]) && (!animated || shownTogether(tl, other)) {
+				with = append(with, j)
+			}
+		}
+		if len(with) > 0 {
+			out = append(out, LayoutWarning{
+				Line:    i,
+				Problem: "overlap",
+				Message: fmt.Sprintf("text %q overlaps other text; move one of them apart", tl.Text),
+				Box:     toRect(first[i], bounds),
+				With:    with,
+			})
+		}
+	}
+	return out
+}
+
+// drawnBounds returns the rectangle covered by the lines of lay and their
+// outline, when rotated by the given angle about the center of their area, in
+// the font face currently set on dc.
+func (lay textLayout) drawnBounds(dc *gg.Context, rotateDegrees float64) image.Rectangle {
+	r := lay.bounds(dc).Inset(-int(math.Ceil(lay.outline)))
+	if rotateDegrees == 0 {
+		return r
+	}
+	m := gg.Identity().Translate(lay.cx, lay.cy).Rotate(gg.Radians(rotateDegrees)).Translate(-lay.cx, -lay.cy)
+	x0, y0 := math.Inf(1), math.Inf(1)
+	x1, y1 := math.Inf(-1), math.Inf(-1)
+	for _, p := range []image.Point{r.Min, {r.Max.X, r.Min.Y}, {r.Min.X, r.Max.Y}, r.Max} {
+		x, y := m.TransformPoint(float64(p.X), float64(p.Y))
+		x0, y0 = min(x0, x), min(y0, y)
+		x1, y1 = max(x1, x), max(y1, y)
+	}
+	return image.Rect(int(math.Floor(x0)), int(math.Floor(y0)), int(math.Ceil(x1)), int(math.Ceil(y1)))
+}
+
+// shownTogether reports whether the two text lines are visible during some
+// part of an animation.
+func shownTogether(a, b tmemes.TextLine) bool {
+	aEnd, bEnd := a.End, b.End
+	if aEnd <= a.Start {
+		aEnd = 1
+	}
+	if bEnd <= b.Start {
+		bEnd = 1
+	}
+	return a.Start <= bEnd && b.Start <= aEnd
+}
+
+// toRect converts r, in pixels within bounds, to fractions of the size of
+// bounds.
+func toRect(r image.Rectangle, bounds image.Rectangle) Rect {
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	return Rect{
+		X:      float64(r.Min.X) / w,
+		Y:      float64(r.Min.Y) / h,
+		Width:  float64(r.Dx()) / w,
+		Height: float64(r.Dy()) / h,
+	}
+}
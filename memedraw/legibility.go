@@ -0,0 +1,162 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/fogleman/gg"
+	"github.com/tailscale/tmemes"
+)
+
+const (
+	// MinContrast is the contrast ratio below which text is reported as hard
+	// to read. This is the WCAG minimum for large text.
+	MinContrast = 3.0
+
+	// MinTextHeight is the height in pixels of a line of text below which it
+	// is reported as hard to read.
+	MinTextHeight = 12
+)
+
+// A LegibilityWarning describes a text line of a macro that may be hard to
+// read.
+type LegibilityWarning struct {
+	Line    int    `json:"line"`    // index in the text overlay
+	Problem string `json:"problem"` // "contrast" or "size"
+	Message string `json:"message"` // human-readable
+
+	Contrast float64 `json:"contrast,omitempty"` // for "contrast"
+	Height   int     `json:"height,omitempty"`   // for "size", in pixels
+}
+
+// CheckLegibility reports the text lines of m that may be hard to read when
+// drawn onto img: those whose color contrasts poorly with both their outline
+// and the part of the image behind them, and those drawn smaller than
+// MinTextHeight. For an animated template, img should be its first frame, and
+// lines are checked where they first appear. Rotation is not accounted for.
+func CheckLegibility(img image.Image, m *tmemes.Macro) []LegibilityWarning {
+	bounds := img.Bounds()
+	dc := gg.NewContext(bounds.Dx(), bounds.Dy())
+	var out []LegibilityWarning
+	for i, tl := range m.TextOverlay {
+		lay, ok := layoutText(dc, newFrames(1, tl).frame(0), bounds)
+		if !ok {
+			continue
+		}
+
+		// The height of the glyphs, rather than the spacing of the lines.
+		if h := int(math.Round(float64(lay.fontSize) / 0.75)); h < MinTextHeight {
+			out = append(out, LegibilityWarning{
+				Line:    i,
+				Problem: "size",
+				Message: fmt.Sprintf("text %q is only %d pixels tall; use less text or a larger size", tl.Text, h),
+				Height:  h,
+			})
+		}
+
+		box := lay.bounds(dc).Inset(-int(math.Ceil(lay.outline))).Add(bounds.Min).Intersect(bounds)
+		if box.Empty() {
+			continue // off the image entirely
+		}
+		bg := meanColor(img, box)
+		if tl.Box != nil {
+			bg = over(tl.Box.Color, bg)
+		}
+		stroke := over(tl.StrokeColor, bg)
+		// For a gradient, the text is only as legible as its worst stop.
+		best := math.Inf(1)
+		for _, c := range fillColors(tl) {
+			best = min(best, max(contrastRatio(over(c, stroke), stroke), contrastRatio(over(c, bg), bg)))
+		}
+		if best < MinContrast {
+			out = append(out, LegibilityWarning{
+				Line:     i,
+				Problem:  "contrast",
+				Message:  fmt.Sprintf("text %q has low contrast (%.1f:1) with its outline and the image behind it", tl.Text, best),
+				Contrast: math.Round(best*10) / 10,
+			})
+		}
+	}
+	return out
+}
+
+// fillColors returns the colors that the text of tl is filled with.
+func fillColors(tl tmemes.TextLine) []tmemes.Color {
+	if tl.Gradient != nil {
+		return []tmemes.Color{tl.Color, tl.Gradient.To}
+	}
+	return []tmemes.Color{tl.Color}
+}
+
+// bounds returns the rectangle covered by the lines of lay, without their
+// outline, in the font face currently set on dc.
+func (lay textLayout) bounds(dc *gg.Context) image.Rectangle {
+	var r image.Rectangle
+	y := lay.y
+	for _, line := range lay.lines {
+		w, _ := dc.MeasureString(line)
+		// As for DrawStringAnchored, the text lies between y and the baseline
+		// of the line at y + ay*fontHeight.
+		x0 := lay.x - lay.ax*w
+		y0 := y + (lay.ay-1)*lay.fontHeight
+		r = r.Union(image.Rect(int(x0), int(y0), int(math.Ceil(x0+w)), int(math.Ceil(y0+lay.fontHeight))))
+		y += lay.fontHeight * lineSpacing
+	}
+	return r
+}
+
+// meanColor returns the average color of img within r, sampled as for
+// meanLuma.
+func meanColor(img image.Image, r image.Rectangle) tmemes.Color {
+	const samples = 16
+	dx, dy := max(1, r.Dx()/samples), max(1, r.Dy()/samples)
+
+	var sum tmemes.Color
+	var n float64
+	for y := r.Min.Y; y < r.Max.Y; y += dy {
+		for x := r.Min.X; x < r.Max.X; x += dx {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			sum[0] += float64(cr) / 0xffff
+			sum[1] += float64(cg) / 0xffff
+			sum[2] += float64(cb) / 0xffff
+			n++
+		}
+	}
+	return tmemes.Color{sum[0] / n, sum[1] / n, sum[2] / n}
+}
+
+// over returns the opaque color seen when fg is drawn over the opaque color
+// bg.
+func over(fg, bg tmemes.Color) tmemes.Color {
+	a := fg.A()
+	return tmemes.Color{
+		fg.R()*a + bg.R()*(1-a),
+		fg.G()*a + bg.G()*(1-a),
+		fg.B()*a + bg.B()*(1-a),
+	}
+}
+
+// contrastRatio returns the WCAG contrast ratio of two colors, from 1 (none)
+// to 21 (black and white).
+func contrastRatio(a, b tmemes.Color) float64 {
+	la, lb := relativeLuminance(a), relativeLuminance(b)
+	if la < lb {
+		la, lb = lb, la
+	}
+	return (la + 0.05) / (lb + 0.05)
+}
+
+// relativeLuminance returns the WCAG relative luminance of an sRGB color.
+func relativeLuminance(c tmemes.Color) float64 {
+	lin := func(v float64) float64 {
+		if v <= 0.03928 {
+			return v / 12.92
+		}
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+	return 0.2126*lin(c.R()) + 0.7152*lin(c.G()) + 0.0722*lin(c.B())
+}
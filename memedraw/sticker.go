@@ -0,0 +1,53 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"image"
+
+	"github.com/fogleman/gg"
+	"github.com/tailscale/tmemes"
+)
+
+// Stickers maps sticker IDs to their images, for drawing the image overlays
+// of a macro. A nil Stickers is empty.
+type Stickers map[int]image.Image
+
+// stickerLayer returns a transparent image of the given bounds with the image
+// overlays of m painted onto it, or nil if m has no overlays to draw.
+// Overlays whose stickers are not in ss are skipped.
+func stickerLayer(m *tmemes.Macro, ss Stickers, bounds image.Rectangle) image.Image {
+	if len(m.ImageOverlay) == 0 {
+		return nil
+	}
+	dc := gg.NewContext(bounds.Dx(), bounds.Dy())
+	for _, o := range m.ImageOverlay {
+		if img, ok := ss[o.Sticker]; ok {
+			drawSticker(dc, o, img, bounds)
+		}
+	}
+	return dc.Image()
+}
+
+// drawSticker paints img onto dc as specified by o.
+func drawSticker(dc *gg.Context, o tmemes.ImageOverlay, img image.Image, bounds image.Rectangle) {
+	sw := img.Bounds().Dx()
+	if sw == 0 || img.Bounds().Dy() == 0 {
+		return
+	}
+	scale := o.Scale
+	if scale == 0 {
+		scale = tmemes.DefaultStickerScale
+	}
+	k := scale * float64(bounds.Dx()) / float64(sw)
+
+	dc.Push()
+	defer dc.Pop()
+	dc.Translate(o.X*float64(bounds.Dx()), o.Y*float64(bounds.Dy()))
+	if o.RotateDegrees != 0 {
+		dc.Rotate(gg.Radians(o.RotateDegrees))
+	}
+	dc.Scale(k, k)
+	dc.DrawImageAnchored(img, 0, 0, 0.5, 0.5)
+}
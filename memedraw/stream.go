@@ -0,0 +1,179 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"log"
+	"runtime"
+	"time"
+
+	"github.com/creachadair/taskgroup"
+	"github.com/tailscale/tmemes"
+)
+
+// StreamGIF draws macro m onto the animated template read from r, as DrawGIF
+// does, and writes the result to w as a GIF. The output is the same as that
+// of gif.EncodeAll for the result of DrawGIF, but rather than holding every
+// frame of the template in memory twice over, StreamGIF decodes, draws, and
+// encodes a few frames at a time.
+//
+// The template is read twice, first to count its frames. If the playback
+// settings of m reorder the frames, they must all be drawn before any can be
+// written, and memory use is as for DrawGIF.
+func StreamGIF(w io.Writer, r io.ReadSeeker, m *tmemes.Macro, ss Stickers) error {
+	return streamGIF(newGIFWriter(w), r, m, ss)
+}
+
+// StreamAnimatedWebP is like StreamGIF, but writes the result as an animated
+// WebP image, as EncodeAnimatedWebP does. The encoded frames are held in
+// memory until the end, but those are much smaller than the decoded ones.
+func StreamAnimatedWebP(w io.Writer, r io.ReadSeeker, m *tmemes.Macro, ss Stickers) error {
+	return streamGIF(newWebPAnimWriter(w), r, m, ss)
+}
+
+// A frameSink encodes the frames of an animation in order.
+type frameSink interface {
+	// start begins an animation of n frames.
+	start(h gifHeader, n int) error
+
+	// frame adds pm, to be shown for delay 100ths of a second and then
+	// disposed of by the given method.
+	frame(pm *image.Paletted, delay int, disposal byte) error
+
+	// finish ends the animation.
+	finish() error
+}
+
+// writeFrames sends all the frames of g to out.
+func writeFrames(out frameSink, g *gif.GIF) error {
+	if err := out.start(headerOf(g), len(g.Image)); err != nil {
+		return err
+	}
+	for i, pm := range g.Image {
+		var delay int
+		var disposal byte
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if err := out.frame(pm, delay, disposal); err != nil {
+			return err
+		}
+	}
+	return out.finish()
+}
+
+func streamGIF(out frameSink, r io.ReadSeeker, m *tmemes.Macro, ss Stickers) error {
+	rStart := time.Now()
+
+	// Count the frames first, since the timing of the text depends on how
+	// many there are. The loop count may also follow the first frame.
+	gr, err := newGIFReader(r)
+	if err != nil {
+		return err
+	}
+	var n int
+	for {
+		if _, _, _, err := gr.next(false); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("no frames in GIF")
+	}
+	loopCount := gr.loopCount
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if !isIdentity(playOrder(n, m.Playback)) {
+		g, err := gif.DecodeAll(r)
+		if err != nil {
+			return err
+		}
+		return writeFrames(out, DrawGIF(g, m, ss))
+	}
+
+	gr, err = newGIFReader(r)
+	if err != nil {
+		return err
+	}
+	h := gr.gifHeader
+	h.loopCount = loopCount
+	if err := out.start(h, n); err != nil {
+		return err
+	}
+
+	bounds := image.Rect(0, 0, h.width, h.height)
+	var pc paletteCache // shared by all frames
+	layer := stickerLayer(m, ss, bounds)
+	lineFrames := make([]frames, len(m.TextOverlay))
+	for i, tl := range m.TextOverlay {
+		lineFrames[i] = newFrames(n, tl)
+	}
+
+	// Each frame is drawn over the backdrop left by the one before, so the
+	// frames are composited in order, but the overlays of a window of
+	// frames are drawn in parallel before those frames are encoded.
+	type pending struct {
+		dst      *image.Paletted
+		delay    int
+		disposal byte
+	}
+	window := make([]pending, 0, runtime.NumCPU())
+	flush := func(j0 int) error {
+		g, run := taskgroup.New(nil).Limit(runtime.NumCPU())
+		for k, p := range window {
+			run.Run(func() { pc.drawOverlays(p.dst, j0+k, layer, lineFrames) })
+		}
+		g.Wait()
+		for _, p := range window {
+			if err := out.frame(p.dst, p.delay, p.disposal); err != nil {
+				return err
+			}
+		}
+		window = window[:0]
+		return nil
+	}
+
+	var backdrop, bg *image.Paletted
+	for j := range n {
+		frame, delay, disposal, err := gr.next(true)
+		if err == io.EOF {
+			return fmt.Errorf("GIF has %d frames, want %d", j, n)
+		} else if err != nil {
+			return err
+		}
+		if bg == nil {
+			bg = newBackdrop(frame, h.background, bounds)
+			backdrop = bg
+		}
+		dst := pc.composite(backdrop, frame, bounds)
+		if j != n-1 {
+			backdrop = pc.nextBackdrop(dst, frame, backdrop, bg, disposal)
+		}
+		if m.Playback != nil {
+			delay = scaleDelay(delay, m.Playback.Speed)
+		}
+		window = append(window, pending{dst, delay, disposal})
+		if len(window) == cap(window) || j == n-1 {
+			if err := flush(j + 1 - len(window)); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("Rendering complete: %v", time.Since(rStart).Round(time.Millisecond))
+	return out.finish()
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"image"
+	"image/draw"
+	"image/gif"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// thumbBounds returns the bounds of a copy of an image with bounds b, scaled
+// down to fit within width × height pixels while keeping its aspect ratio. A
+// zero width or height is unconstrained. It reports false if the image
+// already fits.
+func thumbBounds(b image.Rectangle, width, height int) (image.Rectangle, bool) {
+	dx, dy := b.Dx(), b.Dy()
+	scale := 1.0
+	if width > 0 && dx > width {
+		scale = float64(width) / float64(dx)
+	}
+	if height > 0 && dy > height {
+		scale = min(scale, float64(height)/float64(dy))
+	}
+	if scale == 1 || dx == 0 || dy == 0 {
+		return b, false
+	}
+	return image.Rect(0, 0, max(1, int(float64(dx)*scale+0.5)), max(1, int(float64(dy)*scale+0.5))), true
+}
+
+// Thumbnail returns a copy of img scaled down to fit within width × height
+// pixels, keeping its aspect ratio. A zero width or height is unconstrained.
+// If img already fits, it is returned unchanged.
+func Thumbnail(img image.Image, width, height int) image.Image {
+	tb, ok := thumbBounds(img.Bounds(), width, height)
+	if !ok {
+		return img
+	}
+	dst := image.NewRGBA(tb)
+	xdraw.CatmullRom.Scale(dst, tb, img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// ThumbnailGIF returns a copy of the animation g scaled down to fit within
+// width × height pixels, as for Thumbnail, with the same timing. Each frame
+// of the copy covers the full canvas. If g already fits, it is returned
+// unchanged.
+func ThumbnailGIF(g *gif.GIF, width, height int) *gif.GIF {
+	c := newGIFCanvas(g)
+	tb, ok := thumbBounds(c.bounds, width, height)
+	if !ok {
+		return g
+	}
+	out := &gif.GIF{
+		Image:           make([]*image.Paletted, len(g.Image)),
+		Delay:           append([]int(nil), g.Delay...),
+		Disposal:        make([]byte, len(g.Image)),
+		LoopCount:       g.LoopCount,
+		BackgroundIndex: g.BackgroundIndex,
+		Config:          image.Config{ColorModel: g.Config.ColorModel, Width: tb.Dx(), Height: tb.Dy()},
+	}
+	scaled := image.NewRGBA(tb)
+	for i, frame := range g.Image {
+		c.draw(i)
+		// Bilinear scaling is much faster than CatmullRom, and the difference
+		// is hard to see once the frame is mapped back to its palette.
+		xdraw.ApproxBiLinear.Scale(scaled, tb, c.canvas, c.bounds, draw.Src, nil)
+		c.dispose(i)
+		pf := image.NewPaletted(tb, frame.Palette)
+		draw.Draw(pf, tb, scaled, image.Point{}, draw.Src)
+		out.Image[i] = pf
+		out.Disposal[i] = gif.DisposalBackground
+	}
+	return out
+}
+
+// ThumbnailAPNG returns a copy of the animation a scaled down to fit within
+// width × height pixels, as for Thumbnail, with the same timing. If a already
+// fits, it is returned unchanged.
+func ThumbnailAPNG(a *APNG, width, height int) *APNG {
+	tb, ok := thumbBounds(a.Image[0].Bounds(), width, height)
+	if !ok {
+		return a
+	}
+	out := &APNG{
+		Image: make([]*image.RGBA, len(a.Image)),
+		Delay: append([]int(nil), a.Delay...),
+		Plays: a.Plays,
+	}
+	for i, frame := range a.Image {
+		out.Image[i] = image.NewRGBA(tb)
+		xdraw.CatmullRom.Scale(out.Image[i], tb, frame, frame.Bounds(), draw.Src, nil)
+	}
+	return out
+}
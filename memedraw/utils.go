@@ -4,9 +4,11 @@
 package memedraw
 
 import (
+	"image"
 	"math"
 
 	"github.com/tailscale/tmemes"
+	"golang.org/x/exp/slices"
 )
 
 // newFrames constructs a frame tracker for a text line given an animation with
@@ -78,3 +80,62 @@ func (f frame) area() tmemes.Area {
 	}
 	return cur
 }
+
+// playOrder returns the indices of the n frames of an animation in the order
+// they are shown under playback options p, which may be nil.
+func playOrder(n int, p *tmemes.Playback) []int {
+	seq := make([]int, n)
+	for i := range seq {
+		seq[i] = i
+	}
+	if p == nil {
+		return seq
+	}
+	if p.Reverse {
+		slices.Reverse(seq)
+	}
+	if p.Boomerang && n > 2 {
+		// Play back to (but not including) the first frame, since the loop
+		// returns there.
+		for i := n - 2; i > 0; i-- {
+			seq = append(seq, seq[i])
+		}
+	}
+	return seq
+}
+
+// isIdentity reports whether seq is the sequence 0, 1, 2, ...
+func isIdentity(seq []int) bool {
+	for i, v := range seq {
+		if v != i {
+			return false
+		}
+	}
+	return true
+}
+
+// scaleDelay scales a GIF frame delay d in 100ths of a second by the playback
+// speed multiplier. A speed of 0 is treated as 1.
+func scaleDelay(d int, speed float64) int {
+	if speed == 0 || speed == 1 {
+		return d
+	}
+	if d < 2 {
+		d = 10 // as most browsers treat very short delays
+	}
+	return max(2, int(math.Round(float64(d)/speed)))
+}
+
+// copyPaletted returns a copy of img.
+func copyPaletted(img *image.Paletted) *image.Paletted {
+	cp := *img
+	cp.Pix = slices.Clone(img.Pix)
+	return &cp
+}
+
+// copyRGBA returns a copy of img.
+func copyRGBA(img *image.RGBA) *image.RGBA {
+	cp := *img
+	cp.Pix = slices.Clone(img.Pix)
+	return &cp
+}
@@ -0,0 +1,632 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math/bits"
+)
+
+// This file implements a simple encoder for lossless WebP (VP8L) images, as
+// described by https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+// and RFC 9649.
+//
+// The encoder uses only the "subtract green" transform and a single set of
+// prefix codes, with LZ77 backward references. That is much simpler than what
+// libwebp does, but still compresses the flat colors and repeated regions of
+// typical meme templates well.
+
+// EncodeWebP writes img to w as a lossless WebP image.
+func EncodeWebP(w io.Writer, img image.Image) error {
+	vp8l, err := encodeVP8L(toNRGBA(img))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	writeChunk(&buf, "VP8L", vp8l)
+	return writeRIFF(w, buf.Bytes())
+}
+
+// EncodeAnimatedWebP writes the frames of g to w as a lossless animated WebP
+// image. Each frame of g must cover the full canvas, as the frames produced by
+// DrawGIF do.
+func EncodeAnimatedWebP(w io.Writer, g *gif.GIF) error {
+	if len(g.Image) == 0 {
+		return errors.New("no frames in GIF")
+	}
+	return writeFrames(newWebPAnimWriter(w), g)
+}
+
+// EncodeAPNGWebP writes the frames of a to w as a lossless animated WebP
+// image, keeping their full colour.
+func EncodeAPNGWebP(w io.Writer, a *APNG) error {
+	if len(a.Image) == 0 {
+		return errors.New("no frames in APNG")
+	}
+	b := a.Image[0].Bounds()
+	aw := newWebPAnimWriter(w)
+	aw.width, aw.height = b.Dx(), b.Dy()
+	switch {
+	case a.Plays == 1:
+		aw.loopCount = -1
+	case a.Plays > 1:
+		aw.loopCount = a.Plays - 1
+	}
+	for i, img := range a.Image {
+		var delay int
+		if i < len(a.Delay) {
+			delay = a.Delay[i]
+		}
+		if err := aw.add(toNRGBA(img), delay); err != nil {
+			return err
+		}
+	}
+	return aw.finish()
+}
+
+// A webPAnimWriter writes an animated WebP one frame at a time. The header
+// depends on all the frames, so the encoded frames are held until the end.
+type webPAnimWriter struct {
+	w             io.Writer
+	width, height int
+	loopCount     int // as for gif.GIF
+	frames        bytes.Buffer
+	hasAlpha      bool
+}
+
+// newWebPAnimWriter returns a webPAnimWriter that writes to w.
+func newWebPAnimWriter(w io.Writer) *webPAnimWriter { return &webPAnimWriter{w: w} }
+
+func (aw *webPAnimWriter) start(h gifHeader, n int) error {
+	aw.width, aw.height, aw.loopCount = h.width, h.height, h.loopCount
+	return nil
+}
+
+func (aw *webPAnimWriter) frame(pm *image.Paletted, delay int, _ byte) error {
+	if aw.width == 0 || aw.height == 0 {
+		b := pm.Bounds()
+		aw.width, aw.height = b.Dx(), b.Dy()
+	}
+	return aw.add(toNRGBA(pm), delay)
+}
+
+// add adds img as the next frame, to be shown for delay 100ths of a second.
+func (aw *webPAnimWriter) add(img *image.NRGBA, delay int) error {
+	if !aw.hasAlpha && !isOpaque(img) {
+		aw.hasAlpha = true
+	}
+	vp8l, err := encodeVP8L(img)
+	if err != nil {
+		return err
+	}
+	var anmf bytes.Buffer
+	b := img.Bounds()
+	put24(&anmf, b.Min.X/2)
+	put24(&anmf, b.Min.Y/2)
+	put24(&anmf, b.Dx()-1)
+	put24(&anmf, b.Dy()-1)
+	put24(&anmf, delay*10) // GIF delays are in 100ths of a second
+	anmf.WriteByte(0x02)   // do not blend, do not dispose
+	writeChunk(&anmf, "VP8L", vp8l)
+	writeChunk(&aw.frames, "ANMF", anmf.Bytes())
+	return nil
+}
+
+func (aw *webPAnimWriter) finish() error {
+	var buf bytes.Buffer
+	var vp8x bytes.Buffer
+	flags := byte(0x02) // animation
+	if aw.hasAlpha {
+		flags |= 0x10
+	}
+	vp8x.Write([]byte{flags, 0, 0, 0})
+	put24(&vp8x, aw.width-1)
+	put24(&vp8x, aw.height-1)
+	writeChunk(&buf, "VP8X", vp8x.Bytes())
+
+	// Translate the GIF loop count (repeats after the first showing) to the
+	// WebP loop count (total showings, 0 for forever).
+	var loops int
+	switch {
+	case aw.loopCount < 0:
+		loops = 1
+	case aw.loopCount > 0:
+		loops = min(aw.loopCount+1, 0xffff)
+	}
+	anim := []byte{0, 0, 0, 0, byte(loops), byte(loops >> 8)}
+	writeChunk(&buf, "ANIM", anim)
+	buf.Write(aw.frames.Bytes())
+	return writeRIFF(aw.w, buf.Bytes())
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok && n.Rect.Min == (image.Point{}) {
+		return n
+	}
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Rect, img, b.Min, draw.Src)
+	return out
+}
+
+func isOpaque(img *image.NRGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func writeRIFF(w io.Writer, chunks []byte) error {
+	var hdr [12]byte
+	copy(hdr[0:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(4+len(chunks)))
+	copy(hdr[8:], "WEBP")
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(chunks)
+	return err
+}
+
+func writeChunk(buf *bytes.Buffer, fourCC string, data []byte) {
+	buf.WriteString(fourCC)
+	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0) // chunks are padded to even length
+	}
+}
+
+func put24(buf *bytes.Buffer, v int) {
+	buf.Write([]byte{byte(v), byte(v >> 8), byte(v >> 16)})
+}
+
+const (
+	maxVP8LSize   = 1 << 14 // max width or height
+	numLiterals   = 256
+	numLengthSyms = 24
+	numDistSyms   = 40
+	minMatch      = 3
+	maxMatch      = 4096
+	matchWindow   = 1 << 16
+	maxChainLen   = 16
+)
+
+// A vp8lToken is either a literal ARGB pixel (length == 0) or a backward
+// reference to length pixels at distance dist.
+type vp8lToken struct {
+	argb   uint32
+	length int
+	dist   int
+}
+
+// encodeVP8L returns the VP8L bitstream for img, including the header but not
+// the enclosing chunk.
+func encodeVP8L(img *image.NRGBA) ([]byte, error) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	if w <= 0 || h <= 0 || w > maxVP8LSize || h > maxVP8LSize {
+		return nil, errors.New("invalid image size for WebP")
+	}
+
+	// Collect pixels, applying the subtract-green transform.
+	pix := make([]uint32, 0, w*h)
+	for y := 0; y < h; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+4*w]
+		for x := 0; x < len(row); x += 4 {
+			r, g, b, a := row[x], row[x+1], row[x+2], row[x+3]
+			r, b = r-g, b-g
+			pix = append(pix, uint32(a)<<24|uint32(r)<<16|uint32(g)<<8|uint32(b))
+		}
+	}
+	tokens := lz77(pix)
+
+	// Gather symbol statistics for the five prefix codes.
+	var (
+		green = make([]uint32, numLiterals+numLengthSyms)
+		red   = make([]uint32, numLiterals)
+		blue  = make([]uint32, numLiterals)
+		alpha = make([]uint32, numLiterals)
+		dist  = make([]uint32, numDistSyms)
+	)
+	for _, t := range tokens {
+		if t.length == 0 {
+			green[(t.argb>>8)&0xff]++
+			red[(t.argb>>16)&0xff]++
+			blue[t.argb&0xff]++
+			alpha[t.argb>>24]++
+			continue
+		}
+		lp, _, _ := prefixEncode(t.length)
+		green[numLiterals+lp]++
+		dp, _, _ := prefixEncode(t.dist + 120)
+		dist[dp]++
+	}
+	codes := [5]*prefixCode{
+		newPrefixCode(green, 15),
+		newPrefixCode(red, 15),
+		newPrefixCode(blue, 15),
+		newPrefixCode(alpha, 15),
+		newPrefixCode(dist, 15),
+	}
+
+	var bw bitWriter
+	bw.write(0x2f, 8) // signature
+	bw.write(uint32(w-1), 14)
+	bw.write(uint32(h-1), 14)
+	if isOpaque(img) {
+		bw.write(0, 1)
+	} else {
+		bw.write(1, 1)
+	}
+	bw.write(0, 3) // version
+
+	bw.write(1, 1) // transform present
+	bw.write(2, 2) // subtract green
+	bw.write(0, 1) // no more transforms
+	bw.write(0, 1) // no color cache
+	bw.write(0, 1) // no meta prefix codes
+	for _, c := range codes {
+		c.writeTo(&bw)
+	}
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].writeSymbol(&bw, int(t.argb>>8)&0xff)
+			codes[1].writeSymbol(&bw, int(t.argb>>16)&0xff)
+			codes[2].writeSymbol(&bw, int(t.argb)&0xff)
+			codes[3].writeSymbol(&bw, int(t.argb>>24))
+			continue
+		}
+		lp, ln, lv := prefixEncode(t.length)
+		codes[0].writeSymbol(&bw, numLiterals+lp)
+		bw.write(lv, ln)
+		dp, dn, dv := prefixEncode(t.dist + 120)
+		codes[4].writeSymbol(&bw, dp)
+		bw.write(dv, dn)
+	}
+	return bw.bytes(), nil
+}
+
+// lz77 converts pix into a sequence of literals and backward references.
+func lz77(pix []uint32) []vp8lToken {
+	const hashBits = 16
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(pix))
+	hash := func(i int) uint32 {
+		v := pix[i]*0x1e35a7bd ^ pix[i+1]*0x9e3779b1 ^ pix[i+2]*0x85ebca6b
+		return v >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+minMatch <= len(pix) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	var out []vp8lToken
+	for i := 0; i < len(pix); {
+		bestLen, bestDist := 0, 0
+		if i+minMatch <= len(pix) {
+			limit := min(maxMatch, len(pix)-i)
+			for j, n := head[hash(i)], 0; j >= 0 && i-int(j) <= matchWindow && n < maxChainLen; j, n = prev[j], n+1 {
+				k := 0
+				for k < limit && pix[int(j)+k] == pix[i+k] {
+					k++
+				}
+				if k > bestLen {
+					bestLen, bestDist = k, i-int(j)
+					if k == limit {
+						break
+					}
+				}
+			}
+		}
+		if bestLen >= minMatch {
+			out = append(out, vp8lToken{length: bestLen, dist: bestDist})
+			for k := 0; k < bestLen; k++ {
+				insert(i + k)
+			}
+			i += bestLen
+			continue
+		}
+		out = append(out, vp8lToken{argb: pix[i]})
+		insert(i)
+		i++
+	}
+	return out
+}
+
+// prefixEncode splits v ≥ 1 into a prefix symbol and extra bits, as used for
+// LZ77 lengths and distances.
+func prefixEncode(v int) (sym int, nbits uint, extra uint32) {
+	n := v - 1
+	if n < 4 {
+		return n, 0, 0
+	}
+	hi := bits.Len(uint(n)) - 1
+	second := (n >> (hi - 1)) & 1
+	nbits = uint(hi - 1)
+	return 2*hi + second, nbits, uint32(n) & (1<<nbits - 1)
+}
+
+// A bitWriter accumulates a little-endian bitstream.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (b *bitWriter) write(v uint32, nbits uint) {
+	b.acc |= uint64(v) << b.nacc
+	b.nacc += nbits
+	for b.nacc >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nacc -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.nacc > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.nacc = 0, 0
+	}
+	return b.buf
+}
+
+// A prefixCode is a canonical Huffman code over a fixed alphabet.
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint16 // bit-reversed, ready to write
+}
+
+// newPrefixCode constructs a prefix code for an alphabet with the given
+// symbol counts, whose code lengths do not exceed maxLen.
+func newPrefixCode(hist []uint32, maxLen int) *prefixCode {
+	c := &prefixCode{lengths: huffmanLengths(hist, maxLen)}
+	c.codes = canonicalCodes(c.lengths)
+	return c
+}
+
+func (c *prefixCode) writeSymbol(b *bitWriter, sym int) {
+	b.write(uint32(c.codes[sym]), uint(c.lengths[sym]))
+}
+
+// used returns the symbols of c that have nonzero length.
+func (c *prefixCode) used() []int {
+	var syms []int
+	for s, n := range c.lengths {
+		if n > 0 {
+			syms = append(syms, s)
+		}
+	}
+	return syms
+}
+
+// codeLengthOrder is the order in which code length code lengths are written.
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// writeTo writes the description of c to b.
+func (c *prefixCode) writeTo(b *bitWriter) {
+	used := c.used()
+	if len(used) == 0 {
+		// No symbols are used: Write a simple code with one symbol, which is
+		// coded with zero bits.
+		b.write(1, 1) // simple
+		b.write(0, 1) // one symbol
+		b.write(0, 1) // 1-bit symbol
+		b.write(0, 1) // symbol 0
+		return
+	}
+	if len(used) == 2 && used[1] < 256 {
+		b.write(1, 1) // simple
+		b.write(1, 1) // two symbols
+		b.write(1, 1) // 8-bit first symbol
+		b.write(uint32(used[0]), 8)
+		b.write(uint32(used[1]), 8)
+		return
+	}
+
+	// Normal code: Run-length encode the code lengths, then describe those
+	// with a code length code.
+	type clToken struct {
+		sym   int
+		nbits uint
+		extra uint32
+	}
+	var toks []clToken
+	for i := 0; i < len(c.lengths); {
+		n := c.lengths[i]
+		run := 1
+		for i+run < len(c.lengths) && c.lengths[i+run] == n {
+			run++
+		}
+		i += run
+		if n == 0 {
+			for run > 0 {
+				switch {
+				case run >= 11:
+					k := min(run, 138)
+					toks = append(toks, clToken{18, 7, uint32(k - 11)})
+					run -= k
+				case run >= 3:
+					toks = append(toks, clToken{17, 3, uint32(run - 3)})
+					run = 0
+				default:
+					toks = append(toks, clToken{sym: 0})
+					run--
+				}
+			}
+			continue
+		}
+		toks = append(toks, clToken{sym: int(n)})
+		run--
+		for run > 0 {
+			if run >= 3 {
+				k := min(run, 6)
+				toks = append(toks, clToken{16, 2, uint32(k - 3)})
+				run -= k
+			} else {
+				toks = append(toks, clToken{sym: int(n)})
+				run--
+			}
+		}
+	}
+	hist := make([]uint32, 19)
+	for _, t := range toks {
+		hist[t.sym]++
+	}
+	clc := newPrefixCode(hist, 7)
+
+	numCL := 4
+	for i, s := range codeLengthOrder {
+		if clc.lengths[s] > 0 {
+			numCL = max(numCL, i+1)
+		}
+	}
+	b.write(0, 1) // normal
+	b.write(uint32(numCL-4), 4)
+	for _, s := range codeLengthOrder[:numCL] {
+		b.write(uint32(clc.lengths[s]), 3)
+	}
+	b.write(0, 1) // max_symbol = alphabet size
+	for _, t := range toks {
+		clc.writeSymbol(b, t.sym)
+		b.write(t.extra, t.nbits)
+	}
+}
+
+// huffmanLengths computes Huffman code lengths for the given symbol counts,
+// limited to maxLen bits. If fewer than two symbols have nonzero counts, it
+// still assigns lengths to two symbols, so that the code is complete.
+func huffmanLengths(hist []uint32, maxLen int) []uint8 {
+	counts := make([]uint32, len(hist))
+	copy(counts, hist)
+	var nz []int
+	for s, n := range counts {
+		if n > 0 {
+			nz = append(nz, s)
+		}
+	}
+	lengths := make([]uint8, len(counts))
+	switch len(nz) {
+	case 0:
+		return lengths
+	case 1:
+		other := 0
+		if nz[0] == 0 {
+			other = 1
+		}
+		lengths[nz[0]], lengths[other] = 1, 1
+		return lengths
+	}
+
+	for {
+		h := &nodeHeap{}
+		for _, s := range nz {
+			h.nodes = append(h.nodes, huffNode{weight: uint64(counts[s]), sym: s, left: -1, right: -1})
+			h.idx = append(h.idx, len(h.nodes)-1)
+		}
+		heap.Init(h)
+		for h.Len() > 1 {
+			a, b := heap.Pop(h).(int), heap.Pop(h).(int)
+			h.nodes = append(h.nodes, huffNode{
+				weight: h.nodes[a].weight + h.nodes[b].weight,
+				sym:    -1, left: a, right: b,
+			})
+			heap.Push(h, len(h.nodes)-1)
+		}
+
+		// Assign depths by walking down from the root.
+		depth := make([]int, len(h.nodes))
+		tooLong := false
+		for i := len(h.nodes) - 1; i >= 0; i-- {
+			n := h.nodes[i]
+			if n.sym >= 0 {
+				lengths[n.sym] = uint8(depth[i])
+				if depth[i] > maxLen {
+					tooLong = true
+				}
+				continue
+			}
+			depth[n.left] = depth[i] + 1
+			depth[n.right] = depth[i] + 1
+		}
+		if !tooLong {
+			return lengths
+		}
+
+		// Flatten the distribution and try again.
+		for _, s := range nz {
+			counts[s] = (counts[s] + 1) / 2
+		}
+	}
+}
+
+type huffNode struct {
+	weight      uint64
+	sym         int // -1 for internal nodes
+	left, right int
+}
+
+// nodeHeap is a min-heap of indexes into nodes, ordered by weight.
+type nodeHeap struct {
+	nodes []huffNode
+	idx   []int
+}
+
+func (h *nodeHeap) Len() int { return len(h.idx) }
+func (h *nodeHeap) Less(i, j int) bool {
+	a, b := h.nodes[h.idx[i]], h.nodes[h.idx[j]]
+	if a.weight == b.weight {
+		return h.idx[i] < h.idx[j]
+	}
+	return a.weight < b.weight
+}
+func (h *nodeHeap) Swap(i, j int) { h.idx[i], h.idx[j] = h.idx[j], h.idx[i] }
+func (h *nodeHeap) Push(x any)    { h.idx = append(h.idx, x.(int)) }
+func (h *nodeHeap) Pop() any {
+	n := len(h.idx)
+	x := h.idx[n-1]
+	h.idx = h.idx[:n-1]
+	return x
+}
+
+// canonicalCodes assigns canonical Huffman codes for the given lengths, as in
+// RFC 1951 section 3.2.2, and returns them bit-reversed for writing.
+func canonicalCodes(lengths []uint8) []uint16 {
+	var count [16]int
+	for _, n := range lengths {
+		if n > 0 {
+			count[n]++
+		}
+	}
+	var next [16]int
+	code := 0
+	for n := 1; n < 16; n++ {
+		code = (code + count[n-1]) << 1
+		next[n] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for s, n := range lengths {
+		if n > 0 {
+			codes[s] = bits.Reverse16(uint16(next[n])) >> (16 - n)
+			next[n]++
+		}
+	}
+	return codes
+}
@@ -0,0 +1,195 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package memedraw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// testImage returns a w×h image with flat, graded, noisy, and translucent
+// regions, to exercise the backward references and prefix codes of the
+// encoder.
+func testImage(w, h int, seed int64) *image.NRGBA {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			var c color.NRGBA
+			switch {
+			case y < h/4:
+				c = color.NRGBA{0x20, 0x40, 0x80, 0xff}
+			case y < h/2:
+				c = color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8(x + y), 0xff}
+			case y < 3*h/4:
+				c = color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 0xff}
+			default:
+				c = color.NRGBA{0xff, 0x10, 0x10, uint8(1 + x*254/w)}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// checkSameImage reports the first pixel at which got differs from want, as
+// colours of the model m.
+func checkSameImage(t *testing.T, name string, m color.Model, got, want image.Image) {
+	t.Helper()
+	if got.Bounds().Size() != want.Bounds().Size() {
+		t.Fatalf("%s: got size %v, want %v", name, got.Bounds().Size(), want.Bounds().Size())
+	}
+	gb, wb := got.Bounds(), want.Bounds()
+	for y := range wb.Dy() {
+		for x := range wb.Dx() {
+			g := m.Convert(got.At(gb.Min.X+x, gb.Min.Y+y))
+			w := m.Convert(want.At(wb.Min.X+x, wb.Min.Y+y))
+			if g != w {
+				t.Fatalf("%s: pixel (%d, %d): got %v, want %v", name, x, y, g, w)
+			}
+		}
+	}
+}
+
+// riffChunks returns the chunks of a RIFF WebP file, or of the payload of a
+// chunk, by their FourCCs in order.
+func riffChunks(t *testing.T, data []byte) []pngChunk {
+	t.Helper()
+	var out []pngChunk
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("Truncated chunk header: %q", data)
+		}
+		n := int(binary.LittleEndian.Uint32(data[4:]))
+		if 8+n > len(data) {
+			t.Fatalf("Chunk %q of %d bytes overruns its %d-byte container", data[:4], n, len(data)-8)
+		}
+		out = append(out, pngChunk{typ: string(data[:4]), data: data[8 : 8+n]})
+		data = data[8+n+n%2:]
+	}
+	return out
+}
+
+func TestEncodeWebP(t *testing.T) {
+	for _, size := range []image.Point{{1, 1}, {37, 23}, {256, 128}} {
+		want := testImage(size.X, size.Y, int64(size.X))
+		var buf bytes.Buffer
+		if err := EncodeWebP(&buf, want); err != nil {
+			t.Fatalf("Encode %v: %v", size, err)
+		}
+		got, err := webp.Decode(&buf)
+		if err != nil {
+			t.Fatalf("Decode %v: %v", size, err)
+		}
+		checkSameImage(t, size.String(), color.NRGBAModel, got, want)
+	}
+}
+
+func TestEncodeAnimatedWebP(t *testing.T) {
+	const w, h = 40, 30
+	a := &APNG{Delay: []int{5, 10, 20}, Plays: 2}
+	for i := range a.Delay {
+		f := testImage(w, h, int64(i))
+		rgba := image.NewRGBA(f.Rect)
+		for y := range h {
+			for x := range w {
+				rgba.Set(x, y, f.At(x, y))
+			}
+		}
+		a.Image = append(a.Image, rgba)
+	}
+	var buf bytes.Buffer
+	if err := EncodeAPNGWebP(&buf, a); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	data := buf.Bytes()
+	if string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		t.Fatalf("Bad header %q", data[:12])
+	} else if n := int(binary.LittleEndian.Uint32(data[4:])); n != len(data)-8 {
+		t.Fatalf("RIFF size %d, want %d", n, len(data)-8)
+	}
+	chunks := riffChunks(t, data[12:])
+	if len(chunks) != 2+len(a.Image) || chunks[0].typ != "VP8X" || chunks[1].typ != "ANIM" {
+		t.Fatalf("Got chunks %v, want VP8X, ANIM, and %d ANMF", chunks, len(a.Image))
+	}
+	vp8x := chunks[0].data
+	if vp8x[0]&0x12 != 0x12 {
+		t.Errorf("VP8X flags %#x lack animation and alpha", vp8x[0])
+	}
+	le24 := func(b []byte) int { return int(b[0]) | int(b[1])<<8 | int(b[2])<<16 }
+	if gw, gh := le24(vp8x[4:])+1, le24(vp8x[7:])+1; gw != w || gh != h {
+		t.Errorf("Canvas %d×%d, want %d×%d", gw, gh, w, h)
+	}
+	if loops := binary.LittleEndian.Uint16(chunks[1].data[4:]); loops != 2 {
+		t.Errorf("Loop count %d, want 2", loops)
+	}
+
+	// Each frame holds a complete VP8L bitstream, which decodes on its own.
+	for i, c := range chunks[2:] {
+		if c.typ != "ANMF" {
+			t.Fatalf("Chunk %d is %q, want ANMF", i+2, c.typ)
+		}
+		if d := le24(c.data[12:]); d != a.Delay[i]*10 {
+			t.Errorf("Frame %d: duration %d ms, want %d", i, d, a.Delay[i]*10)
+		}
+		sub := riffChunks(t, c.data[16:])
+		if len(sub) != 1 || sub[0].typ != "VP8L" {
+			t.Fatalf("Frame %d: got chunks %v, want VP8L", i, sub)
+		}
+		var still bytes.Buffer
+		var body bytes.Buffer
+		writeChunk(&body, "VP8L", sub[0].data)
+		if err := writeRIFF(&still, body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		got, err := webp.Decode(&still)
+		if err != nil {
+			t.Fatalf("Decode frame %d: %v", i, err)
+		}
+		checkSameImage(t, "frame", color.NRGBAModel, got, a.Image[i])
+	}
+}
+
+func TestEncodeAnimatedWebPGIF(t *testing.T) {
+	pal := color.Palette{color.Black, color.White, color.NRGBA{0xff, 0, 0, 0xff}}
+	g := &gif.GIF{LoopCount: 0}
+	for i := range 3 {
+		pm := image.NewPaletted(image.Rect(0, 0, 16, 8), pal)
+		for j := range pm.Pix {
+			pm.Pix[j] = uint8((i + j) % len(pal))
+		}
+		g.Image = append(g.Image, pm)
+		g.Delay = append(g.Delay, 7)
+	}
+	var buf bytes.Buffer
+	if err := EncodeAnimatedWebP(&buf, g); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	chunks := riffChunks(t, buf.Bytes()[12:])
+	if len(chunks) != 5 {
+		t.Fatalf("Got %d chunks, want 5", len(chunks))
+	}
+	if vp8x := chunks[0].data; vp8x[0]&0x10 != 0 {
+		t.Errorf("VP8X flags %#x claim alpha for opaque frames", vp8x[0])
+	}
+	if loops := binary.LittleEndian.Uint16(chunks[1].data[4:]); loops != 0 {
+		t.Errorf("Loop count %d, want 0 (forever)", loops)
+	}
+	sub := riffChunks(t, chunks[4].data[16:])
+	var still, body bytes.Buffer
+	writeChunk(&body, "VP8L", sub[0].data)
+	writeRIFF(&still, body.Bytes())
+	got, err := webp.Decode(&still)
+	if err != nil {
+		t.Fatalf("Decode last frame: %v", err)
+	}
+	checkSameImage(t, "last frame", color.NRGBAModel, got, g.Image[2])
+}
@@ -0,0 +1,312 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A Backend is durable storage for the files of a DB. Objects are named by
+// slash-separated keys relative to the root of the store, for example
+// "templates/3.png" or "macros/seed-5.jpg".
+//
+// When a DB has a backend, its local directory is a working copy: template
+// images and cached macros are written to the backend as they are created,
+// the index is copied there periodically, and missing files are fetched back
+// from it on demand. This allows the server to run on a host whose local disk
+// does not survive a restart.
+type Backend interface {
+	// Get returns the contents of the object with the given key. If there is
+	// no such object, the error satisfies errors.Is(err, fs.ErrNotExist).
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Put creates or replaces the object with the given key.
+	Put(ctx context.Context, key string, data []byte) error
+
+	// Delete removes the object with the given key. It is not an error if
+	// there is no such object.
+	Delete(ctx context.Context, key string) error
+
+	// List returns the keys of all objects whose keys begin with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// OpenBackend returns a Backend for the given URL. The supported forms are:
+//
+//	s3://bucket/prefix        an S3 bucket, using the standard AWS configuration
+//	file:///path/to/dir       a local directory, e.g., a mounted volume
+//
+// For S3, the query parameters "region" and "endpoint" may be used to select
+// an S3-compatible service such as MinIO or Google Cloud Storage, for example
+// "s3://memes?endpoint=https://storage.googleapis.com".
+func OpenBackend(ctx context.Context, backendURL string) (Backend, error) {
+	u, err := url.Parse(backendURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL: %w", err)
+	}
+	switch u.Scheme {
+	case "s3":
+		return newS3Backend(ctx, u)
+	case "file":
+		if u.Path == "" {
+			return nil, errors.New("missing backend directory path")
+		}
+		if err := os.MkdirAll(u.Path, 0700); err != nil {
+			return nil, err
+		}
+		return dirBackend(u.Path), nil
+	default:
+		return nil, fmt.Errorf("unsupported backend %q", u.Scheme)
+	}
+}
+
+// dirBackend is a Backend that stores objects as files under a directory.
+type dirBackend string
+
+func (d dirBackend) path(key string) string { return filepath.Join(string(d), filepath.FromSlash(key)) }
+
+func (d dirBackend) Get(_ context.Context, key string) ([]byte, error) {
+	return os.ReadFile(d.path(key))
+}
+
+func (d dirBackend) Put(_ context.Context, key string, data []byte) error {
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (d dirBackend) Delete(_ context.Context, key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d dirBackend) List(_ context.Context, prefix string) ([]string, error) {
+	es, err := os.ReadDir(d.path(path.Dir(prefix)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, e := range es {
+		key := path.Join(path.Dir(prefix), e.Name())
+		if !e.IsDir() && strings.HasPrefix(key, prefix) && !strings.HasSuffix(key, ".tmp") {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+const (
+	indexKey         = "index.db"
+	backendTimeout   = time.Minute     // for individual backend operations
+	snapshotInterval = 5 * time.Minute // how often to copy the index
+)
+
+// backendKey returns the backend key for the file at path, which must be
+// within the store directory.
+func (db *DB) backendKey(path string) (string, error) {
+	rel, err := filepath.Rel(db.dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is not in the store", path)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// putFile copies the file at path to the backend.
+func (db *DB) putFile(ctx context.Context, path string) error {
+	key, err := db.backendKey(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+	return db.backend.Put(ctx, key, data)
+}
+
+// fetchFile copies the file at path from the backend, if it exists there.
+// It reports false without error if the backend does not have the file.
+func (db *DB) fetchFile(ctx context.Context, path string) (bool, error) {
+	key, err := db.backendKey(path)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, backendTimeout)
+	defer cancel()
+	data, err := db.backend.Get(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// RestoreCached fetches the cached macro rendering at path from the backend,
+// and reports whether it was found there. If the DB has no backend, it
+// reports false without error.
+func (db *DB) RestoreCached(path string) (bool, error) {
+	if db.backend == nil {
+		return false, nil
+	}
+	return db.fetchFile(context.Background(), path)
+}
+
+// SaveCached copies the cached macro rendering at path to the backend.  If
+// the DB has no backend, it does nothing.
+func (db *DB) SaveCached(path string) error {
+	if db.backend == nil {
+		return nil
+	}
+	return db.putFile(context.Background(), path)
+}
+
+// removeBackendCachedLocked removes all cached renderings of the macro with
+// the given ID from the backend.
+func (db *DB) removeBackendCachedLocked(id int) {
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	seed := db.cachePrefix()
+	keys, err := db.backend.List(ctx, path.Join("macros", seed+"-"))
+	if err != nil {
+		log.Printf("WARNING: listing cached macros in backend: %v", err)
+		return
+	}
+	for _, key := range keys {
+		if s, mid, _, ok := parseCacheName(path.Base(key)); ok && s == seed && mid == id {
+			if err := db.backend.Delete(ctx, key); err != nil {
+				log.Printf("WARNING: removing %q from backend: %v", key, err)
+			}
+		}
+	}
+}
+
+// restoreIndex fetches the index database from backend into dbPath, unless
+// a local copy already exists.
+func restoreIndex(backend Backend, dbPath string) error {
+	if _, err := os.Stat(dbPath); err == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	data, err := backend.Get(ctx, indexKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil // a new store
+	} else if err != nil {
+		return err
+	}
+	log.Printf("Restoring index from backend (%d bytes)", len(data))
+	return os.WriteFile(dbPath, data, 0600)
+}
+
+// restoreTemplates fetches any template images and sound clips, and sticker
+// images, that are missing locally from the backend.
+func (db *DB) restoreTemplates() error {
+	var nr int
+	stickers, err := db.Stickers()
+	if err != nil {
+		return err
+	}
+	for _, st := range stickers {
+		path := filepath.Join(db.dir, st.Path)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		ok, err := db.fetchFile(context.Background(), path)
+		if err != nil {
+			return fmt.Errorf("restore sticker %d: %w", st.ID, err)
+		} else if !ok {
+			log.Printf("WARNING: sticker %d file %q not found in backend", st.ID, st.Path)
+			continue
+		}
+		nr++
+	}
+	for _, t := range db.AllTemplates() {
+		rels := []string{t.Path}
+		if t.Audio != "" {
+			rels = append(rels, t.Audio)
+		}
+		for _, rel := range rels {
+			path := filepath.Join(db.dir, rel)
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+			ok, err := db.fetchFile(context.Background(), path)
+			if err != nil {
+				return fmt.Errorf("restore template %d: %w", t.ID, err)
+			} else if !ok {
+				log.Printf("WARNING: template %d file %q not found in backend", t.ID, rel)
+				continue
+			}
+			nr++
+		}
+	}
+	if nr > 0 {
+		log.Printf("Restored %d template and sticker files from backend", nr)
+	}
+	return nil
+}
+
+// snapshotIndex copies a consistent snapshot of the index database to the
+// backend.
+func (db *DB) snapshotIndex() error {
+	tmp := filepath.Join(db.dir, "index.db.snapshot")
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	if err := db.vacuumInto(tmp); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	return db.backend.Put(ctx, indexKey, data)
+}
+
+// snapshotIndexes periodically copies the index to the backend until ctx
+// ends.
+func (db *DB) snapshotIndexes(ctx context.Context) {
+	log.Printf("Starting index snapshots (poll=%v)", snapshotInterval)
+	t := time.NewTicker(snapshotInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Index snapshots exiting (%v)", ctx.Err())
+			return
+		case <-t.C:
+		}
+		if err := db.snapshotIndex(); err != nil {
+			log.Printf("WARNING: snapshotting index: %v", err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tailscale/tmemes"
+)
+
+// Categories returns all the template categories, ordered by name.
+func (db *DB) Categories() ([]*tmemes.Category, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows, err := db.sqldb.Query(`SELECT raw FROM Categories ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("loading categories: %w", err)
+	}
+	defer rows.Close()
+	var out []*tmemes.Category
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, fmt.Errorf("scanning category: %w", err)
+		}
+		var c tmemes.Category
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return nil, fmt.Errorf("decode category: %w", err)
+		}
+		out = append(out, &c)
+	}
+	return out, rows.Err()
+}
+
+// Category returns the category with the given name, ignoring case.
+func (db *DB) Category(name string) (*tmemes.Category, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.categoryLocked(name)
+}
+
+func (db *DB) categoryLocked(name string) (*tmemes.Category, error) {
+	var raw []byte
+	err := db.sqldb.QueryRow(`SELECT raw FROM Categories WHERE name = ?`, name).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("category %q not found", name)
+	} else if err != nil {
+		return nil, err
+	}
+	var c tmemes.Category
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("decode category: %w", err)
+	}
+	return &c, nil
+}
+
+// SetCategory creates or replaces the category with the name of c, ignoring
+// case. If the name differs only in case from that of an existing category,
+// templates in that category are updated to use the new name.
+func (db *DB) SetCategory(c *tmemes.Category) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	bits, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.sqldb.Exec(`INSERT OR REPLACE INTO Categories (name, raw) VALUES (?, ?)`, c.Name, bits); err != nil {
+		return err
+	}
+	return db.renameCategoryLocked(c.Name, c.Name)
+}
+
+// DeleteCategory removes the category with the given name, ignoring case.
+// Templates in the category are kept, but no longer have a category.
+func (db *DB) DeleteCategory(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, err := db.sqldb.Exec(`DELETE FROM Categories WHERE name = ?`, name)
+	if err != nil {
+		return err
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("category %q not found", name)
+	}
+	return db.renameCategoryLocked(name, "")
+}
+
+// renameCategoryLocked sets the category of every template whose category is
+// old, ignoring case, to new.
+func (db *DB) renameCategoryLocked(old, new string) error {
+	for _, t := range db.templates {
+		if t.Category == new || !strings.EqualFold(t.Category, old) {
+			continue
+		}
+		saved := t.Category
+		t.Category = new
+		if err := db.updateTemplateLocked(t); err != nil {
+			t.Category = saved
+			return err
+		}
+	}
+	return nil
+}
+
+// SetTemplateCategory sets the category of a template, and returns the
+// updated template. The category must exist, and the template uses its name
+// as stored. If name == "", the template is removed from its category.
+func (db *DB) SetTemplateCategory(id int, name string) (*tmemes.Template, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.templates[id]
+	if !ok {
+		return nil, fmt.Errorf("template %d not found", id)
+	}
+	if name != "" {
+		c, err := db.categoryLocked(name)
+		if err != nil {
+			return nil, err
+		}
+		name = c.Name
+	}
+	saved := t.Category
+	t.Category = name
+	if err := db.updateTemplateLocked(t); err != nil {
+		t.Category = saved
+		return nil, err
+	}
+	return t, nil
+}
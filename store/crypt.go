@@ -0,0 +1,473 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encryption at rest.
+//
+// If Options.EncryptionKey is set, the files the DB keeps for templates,
+// stickers, and cached renderings are encrypted with AES-256-GCM, so that
+// their contents cannot be read from the disk (or the backend) without the
+// key. So that large files can be streamed, and read at random offsets, each
+// file is sealed in segments of sealSegmentSize bytes. A sealed file holds a
+// header with a random salt, from which the key for the file is derived, and
+// then its segments in order. The nonce of each segment is its index, and
+// whether it is the last, so segments cannot be reordered or the file
+// truncated undetected. The path of the file within the store is the
+// additional data of each segment, so that one sealed file cannot be swapped
+// for another: files must be sealed under their final names.
+//
+// Files without the header are read as plaintext, so that a store can start
+// encrypting after it already has content. When it is opened with a key, the
+// DB encrypts any plaintext files it finds in place. The index database is
+// not encrypted.
+
+// EncryptionKeySize is the size in bytes of a key for encryption at rest.
+const EncryptionKeySize = 32
+
+const (
+	sealedMagic     = "tmemes-sealed-1\n" // the header of an encrypted file
+	sealSaltSize    = 16                  // bytes of salt following the header
+	sealHeaderSize  = len(sealedMagic) + sealSaltSize
+	sealSegmentSize = 64 << 10 // bytes of plaintext per segment
+	sealTagSize     = 16       // GCM overhead per segment
+)
+
+// checkEncryptionKey reports an error if key cannot be used for encryption
+// at rest.
+func checkEncryptionKey(key []byte) error {
+	if len(key) != EncryptionKeySize {
+		return fmt.Errorf("encryption key must be %d bytes, not %d", EncryptionKeySize, len(key))
+	}
+	return nil
+}
+
+// fileCipher returns the AEAD for the segments of a file with the given
+// salt. Its key is an HMAC of the salt under the encryption key of the DB.
+func (db *DB) fileCipher(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, db.sealKey)
+	mac.Write(salt)
+	blk, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+// sealedAD returns the additional data for the segments of the file at path.
+func (db *DB) sealedAD(path string) []byte {
+	if key, err := db.backendKey(path); err == nil {
+		return []byte(key)
+	}
+	return []byte(filepath.ToSlash(path))
+}
+
+// segmentNonce returns the nonce of the segment of a file with index i, which
+// is the last segment of the file if last is true.
+func segmentNonce(nonce []byte, i int64, last bool) []byte {
+	binary.BigEndian.PutUint64(nonce, uint64(i))
+	clear(nonce[8:])
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// A File is a file of the store opened for reading. Its contents are
+// decrypted if necessary, and Stat reports their decrypted size.
+type File interface {
+	io.ReadSeekCloser
+	Name() string
+	Stat() (fs.FileInfo, error)
+}
+
+// OpenFile opens the file at path for reading, decrypting its contents if
+// they are encrypted. Use it instead of os.Open for the files of the store.
+// Encrypted contents are decrypted a segment at a time as they are read.
+func (db *DB) OpenFile(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	} else if db.sealKey == nil {
+		return f, nil
+	}
+	sf, err := db.openSealed(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("decrypt %q: %w", filepath.Base(path), err)
+	} else if sf == nil {
+		return f, nil // plaintext
+	}
+	return sf, nil
+}
+
+// openSealed returns a reader of the decrypted contents of f, or nil if f is
+// not encrypted. It checks the last segment, so that a truncated file is
+// reported at once.
+func (db *DB) openSealed(f *os.File) (*sealedFile, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, sealHeaderSize)
+	n, err := io.ReadFull(f, hdr)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	} else if !bytes.HasPrefix(hdr[:n], []byte(sealedMagic)) {
+		_, err := f.Seek(0, io.SeekStart)
+		return nil, err
+	} else if n < sealHeaderSize {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	aead, err := db.fileCipher(hdr[len(sealedMagic):])
+	if err != nil {
+		return nil, err
+	}
+
+	const encSize = sealSegmentSize + sealTagSize
+	body := fi.Size() - int64(sealHeaderSize)
+	nseg := max(1, (body+encSize-1)/encSize)
+	if body-(nseg-1)*encSize < sealTagSize {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	sf := &sealedFile{
+		f:     f,
+		aead:  aead,
+		ad:    db.sealedAD(f.Name()),
+		body:  body,
+		nseg:  nseg,
+		seg:   -1,
+		nonce: make([]byte, aead.NonceSize()),
+	}
+	sf.info = sizedInfo{FileInfo: fi, size: body - nseg*sealTagSize}
+	if err := sf.load(nseg - 1); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// ReadFile returns the contents of the file at path, decrypting them if they
+// are encrypted. Use it instead of os.ReadFile for the files of the store.
+func (db *DB) ReadFile(path string) ([]byte, error) {
+	if db.sealKey == nil {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		} else if bytes.HasPrefix(data, []byte(sealedMagic)) {
+			return nil, fmt.Errorf("decrypt %q: file is encrypted, but no encryption key is set", filepath.Base(path))
+		}
+		return data, nil
+	}
+	f, err := db.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %q: %w", filepath.Base(path), err)
+	}
+	return data, nil
+}
+
+// CreateFile creates or truncates the file at path for writing. If the DB
+// encrypts files at rest, the data written are encrypted a segment at a time.
+// Use it instead of os.Create for the files of the store.
+func (db *DB) CreateFile(path string) (io.WriteCloser, error) {
+	return db.createFileAs(path, path)
+}
+
+// createFileAs is as CreateFile, but for a temporary file at tmp that will be
+// renamed to path once it is complete.
+func (db *DB) createFileAs(tmp, path string) (io.WriteCloser, error) {
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	return db.NewFileWriter(f, path), nil
+}
+
+// NewFileWriter returns a writer for the contents of f, which is closed when
+// the writer is closed. If the DB encrypts files at rest, the data written
+// are encrypted for the file at path in the store, which may be the eventual
+// name of f rather than its current one.
+func (db *DB) NewFileWriter(f *os.File, path string) io.WriteCloser {
+	if db.sealKey == nil {
+		return f
+	}
+	return &sealWriter{
+		db:  db,
+		f:   f,
+		ad:  db.sealedAD(path),
+		buf: make([]byte, 0, sealSegmentSize),
+	}
+}
+
+// SealFile renames the plaintext file at tmp to path, encrypting it first if
+// the DB encrypts files at rest. This is for files written by other programs.
+func (db *DB) SealFile(tmp, path string) error {
+	if db.sealKey == nil {
+		return os.Rename(tmp, path)
+	}
+	defer os.Remove(tmp)
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return db.writeSealed(path, f)
+}
+
+// writeSealed writes the contents of r, encrypted, to the file at path,
+// replacing it atomically.
+func (db *DB) writeSealed(path string, r io.Reader) error {
+	tmp := path + ".seal"
+	w, err := db.createFileAs(tmp, path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		os.Remove(tmp)
+		return err
+	} else if err := w.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// sealPlainFiles encrypts, in place, the plaintext files in the image
+// subdirectories of the store. Copies held by the backend are replaced.
+func (db *DB) sealPlainFiles() error {
+	var n int
+	for _, sub := range subdirs {
+		dir := filepath.Join(db.dir, sub)
+		es, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			if !e.Type().IsRegular() || isTempName(e.Name()) {
+				continue // skip directories and files being written
+			}
+			path := filepath.Join(dir, e.Name())
+			if err := db.sealPlainFile(path); errors.Is(err, errSealed) {
+				continue // already encrypted
+			} else if err != nil {
+				return fmt.Errorf("encrypt %q: %w", e.Name(), err)
+			}
+			if db.backend != nil {
+				if err := db.putFile(context.Background(), path); err != nil {
+					return fmt.Errorf("store %q: %w", e.Name(), err)
+				}
+			}
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("Encrypted %d existing files in the store", n)
+	}
+	return nil
+}
+
+// errSealed is reported by sealPlainFile for a file that is already
+// encrypted.
+var errSealed = errors.New("file is already encrypted")
+
+// sealPlainFile encrypts the file at path in place, or reports errSealed if
+// it is already encrypted.
+func (db *DB) sealPlainFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hdr := make([]byte, len(sealedMagic))
+	if n, _ := io.ReadFull(f, hdr); string(hdr[:n]) == sealedMagic {
+		return errSealed
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return db.writeSealed(path, f)
+}
+
+// isTempName reports whether name is that of a temporary file, written
+// before being renamed into place.
+func isTempName(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".tmp") ||
+		strings.HasSuffix(name, ".new") || strings.HasSuffix(name, ".seal")
+}
+
+// A sealedFile is a File reading the decrypted contents of an encrypted
+// file, one segment at a time.
+type sealedFile struct {
+	f     *os.File
+	info  sizedInfo
+	aead  cipher.AEAD
+	ad    []byte // additional data of the segments
+	body  int64  // the size of the segments, in bytes
+	nseg  int64  // the number of segments
+	off   int64  // the offset of the next read, in the plaintext
+	seg   int64  // the index of the segment in plain, or -1
+	plain []byte // the plaintext of segment seg
+	enc   []byte // buffer for the ciphertext of a segment
+	nonce []byte
+}
+
+// load decrypts segment i of f into f.plain.
+func (f *sealedFile) load(i int64) error {
+	if i == f.seg {
+		return nil
+	}
+	const encSize = sealSegmentSize + sealTagSize
+	off := i * encSize
+	n := min(encSize, f.body-off)
+	if cap(f.enc) < int(n) {
+		f.enc = make([]byte, encSize)
+	}
+	enc := f.enc[:n]
+	if _, err := f.f.ReadAt(enc, int64(sealHeaderSize)+off); err != nil {
+		return err
+	}
+	plain, err := f.aead.Open(f.plain[:0], segmentNonce(f.nonce, i, i == f.nseg-1), enc, f.ad)
+	if err != nil {
+		f.seg = -1
+		return err
+	}
+	f.plain, f.seg = plain, i
+	return nil
+}
+
+func (f *sealedFile) Read(p []byte) (int, error) {
+	if f.off >= f.info.size {
+		return 0, io.EOF
+	}
+	i := f.off / sealSegmentSize
+	if err := f.load(i); err != nil {
+		return 0, fmt.Errorf("decrypt %q: %w", filepath.Base(f.f.Name()), err)
+	}
+	n := copy(p, f.plain[f.off-i*sealSegmentSize:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *sealedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *sealedFile) Name() string               { return f.f.Name() }
+func (f *sealedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *sealedFile) Close() error               { return f.f.Close() }
+
+// sizedInfo is a fs.FileInfo reporting the size of the decrypted contents.
+type sizedInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (fi sizedInfo) Size() int64 { return fi.size }
+
+// A sealWriter encrypts the contents of a file a segment at a time. Each
+// segment is held back until the next byte is written or the writer is
+// closed, since the last segment is sealed differently.
+type sealWriter struct {
+	db    *DB
+	f     *os.File
+	ad    []byte // additional data of the segments
+	aead  cipher.AEAD
+	nonce []byte
+	seg   int64  // the index of the segment in buf
+	buf   []byte // plaintext of the segment not yet written
+	enc   []byte
+	err   error
+}
+
+func (w *sealWriter) Write(data []byte) (int, error) {
+	var n int
+	for w.err == nil && len(data) > 0 {
+		if len(w.buf) == sealSegmentSize {
+			w.err = w.flush(false)
+			continue
+		}
+		k := copy(w.buf[len(w.buf):sealSegmentSize], data)
+		w.buf = w.buf[:len(w.buf)+k]
+		data = data[k:]
+		n += k
+	}
+	return n, w.err
+}
+
+// flush writes the segment in w.buf, sealed as the last segment of the file
+// if last is true, after the header if it has not been written yet.
+func (w *sealWriter) flush(last bool) error {
+	if w.aead == nil {
+		hdr := make([]byte, sealHeaderSize)
+		copy(hdr, sealedMagic)
+		salt := hdr[len(sealedMagic):]
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		aead, err := w.db.fileCipher(salt)
+		if err != nil {
+			return err
+		}
+		if _, err := w.f.Write(hdr); err != nil {
+			return err
+		}
+		w.aead, w.nonce = aead, make([]byte, aead.NonceSize())
+	}
+	w.enc = w.aead.Seal(w.enc[:0], segmentNonce(w.nonce, w.seg, last), w.buf, w.ad)
+	if _, err := w.f.Write(w.enc); err != nil {
+		return err
+	}
+	w.seg++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *sealWriter) Close() error {
+	if w.err == nil {
+		w.err = w.flush(true)
+	}
+	if err := w.f.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
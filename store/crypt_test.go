@@ -0,0 +1,195 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newSealedDB returns a DB in a temporary directory that encrypts files.
+func newSealedDB(t *testing.T) *DB {
+	t.Helper()
+	key := bytes.Repeat([]byte{7}, EncryptionKeySize)
+	db, err := New(t.TempDir(), &Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// writeStoreFile writes data to the file at path with db.CreateFile.
+func writeStoreFile(t *testing.T, db *DB, path string, data []byte) {
+	t.Helper()
+	w, err := db.CreateFile(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// Write in uneven pieces, to cross segment boundaries mid-write.
+	for len(data) > 0 {
+		n := min(len(data), 1000+len(data)%7777)
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	db := newSealedDB(t)
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"Empty", 0},
+		{"Small", 1},
+		{"UnderSegment", sealSegmentSize - 1},
+		{"Segment", sealSegmentSize},
+		{"OverSegment", sealSegmentSize + 1},
+		{"Several", 3*sealSegmentSize + 12345},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			want := make([]byte, tc.size)
+			rand.New(rand.NewSource(int64(tc.size))).Read(want)
+			path := filepath.Join(db.dir, "macros", tc.name+".png")
+			writeStoreFile(t, db, path, want)
+
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			} else if !strings.HasPrefix(string(raw), sealedMagic) {
+				t.Fatal("file is not encrypted")
+			} else if tc.size > 16 && bytes.Contains(raw, want[:16]) {
+				t.Fatal("file contains plaintext")
+			}
+
+			got, err := db.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			} else if !bytes.Equal(got, want) {
+				t.Fatalf("ReadFile: got %d bytes, want %d (or contents differ)", len(got), len(want))
+			}
+
+			f, err := db.OpenFile(path)
+			if err != nil {
+				t.Fatalf("OpenFile: %v", err)
+			}
+			defer f.Close()
+			if fi, err := f.Stat(); err != nil {
+				t.Fatalf("Stat: %v", err)
+			} else if fi.Size() != int64(tc.size) {
+				t.Errorf("Size: got %d, want %d", fi.Size(), tc.size)
+			}
+			// Read from a few offsets, as http.ServeContent does for ranges.
+			for _, off := range []int{tc.size / 2, tc.size - 1, 0, sealSegmentSize - 3} {
+				if off < 0 || off >= tc.size {
+					continue
+				}
+				if _, err := f.Seek(int64(off), io.SeekStart); err != nil {
+					t.Fatalf("Seek %d: %v", off, err)
+				}
+				buf := make([]byte, 10)
+				n, err := io.ReadFull(f, buf)
+				if err != nil && err != io.ErrUnexpectedEOF {
+					t.Fatalf("Read at %d: %v", off, err)
+				} else if want := want[off:min(off+10, tc.size)]; !bytes.Equal(buf[:n], want) {
+					t.Errorf("Read at %d: got %x, want %x", off, buf[:n], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSealTamper(t *testing.T) {
+	db := newSealedDB(t)
+	data := bytes.Repeat([]byte("meme"), sealSegmentSize/2) // two segments
+	orig := filepath.Join(db.dir, "templates", "1.png")
+	writeStoreFile(t, db, orig, data)
+	sealed, err := os.ReadFile(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const encSize = sealSegmentSize + sealTagSize
+
+	tests := []struct {
+		name   string
+		path   string // where the tampered file is put
+		tamper func([]byte) []byte
+	}{
+		{"Swapped", filepath.Join(db.dir, "templates", "2.png"), func(b []byte) []byte {
+			return b
+		}},
+		{"Truncated", orig, func(b []byte) []byte {
+			return b[:sealHeaderSize+encSize]
+		}},
+		{"ShortHeader", orig, func(b []byte) []byte {
+			return b[:sealHeaderSize-1]
+		}},
+		{"Reordered", orig, func(b []byte) []byte {
+			segs := b[sealHeaderSize:]
+			out := append([]byte(nil), b[:sealHeaderSize]...)
+			out = append(out, segs[encSize:]...)
+			return append(out, segs[:encSize]...)
+		}},
+		{"Flipped", orig, func(b []byte) []byte {
+			b[len(b)/2] ^= 1
+			return b
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bad := tc.tamper(bytes.Clone(sealed))
+			if err := os.WriteFile(tc.path, bad, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := db.ReadFile(tc.path); err == nil {
+				t.Errorf("ReadFile: got %d bytes, want error", len(got))
+			}
+		})
+	}
+}
+
+func TestSealPlainFiles(t *testing.T) {
+	dir := t.TempDir()
+	plain, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	path := filepath.Join(dir, "stickers", "1.png")
+	writeStoreFile(t, plain, path, []byte("plain sticker"))
+	plain.Close()
+
+	key := bytes.Repeat([]byte{9}, EncryptionKeySize)
+	db, err := New(dir, &Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("New with key: %v", err)
+	}
+	defer db.Close()
+	if raw, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(string(raw), sealedMagic) {
+		t.Error("plaintext file was not encrypted when the store was opened")
+	}
+	if got, err := db.ReadFile(path); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(got) != "plain sticker" {
+		t.Errorf("ReadFile: got %q, want %q", got, "plain sticker")
+	}
+
+	// Without the key, encrypted files cannot be read.
+	nokey := &DB{dir: dir}
+	if _, err := nokey.ReadFile(path); err == nil {
+		t.Error("ReadFile without key: got nil, want error")
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	_ "embed"
@@ -19,6 +21,7 @@ import (
 	"github.com/tailscale/squibble"
 	"github.com/tailscale/tmemes"
 	"golang.org/x/sys/unix"
+	"tailscale.com/tailcfg"
 )
 
 //go:embed schema.sql
@@ -26,6 +29,161 @@ var schemaText string
 
 var schema = &squibble.Schema{
 	Current: schemaText,
+
+	Updates: []squibble.UpdateRule{
+		{
+			Source: "90648e542f932a307527540e389f95c9884ebaa4c8a4508c0ddf3a2670b1f8d5",
+			Target: "ff162efb0eeb495f36d6d1b5037f9b69f2da5d29717210d0118686f08e9f9357",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS PushSubscriptions (
+  endpoint TEXT PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  raw BLOB, -- JSON tmemes.PushSubscription
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+)`),
+		},
+		{
+			Source: "ff162efb0eeb495f36d6d1b5037f9b69f2da5d29717210d0118686f08e9f9357",
+			Target: "474b0d0e3373fefd8bbbf045cc1393c0053d1764443500c3307410d5bf71aecf",
+			Apply:  squibble.Exec(`ALTER TABLE Votes ADD COLUMN variant INTEGER NOT NULL DEFAULT 0`),
+		},
+		{
+			Source: "474b0d0e3373fefd8bbbf045cc1393c0053d1764443500c3307410d5bf71aecf",
+			Target: "22003317ce0b5faa8ff4c51cc2afdd46c06931d95add1619dfc8e570200a2ac0",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS Reports (
+  id INTEGER PRIMARY KEY,
+  raw BLOB, -- JSON tmemes.Report
+
+  -- Generated columns.
+  kind TEXT AS (json_extract(raw, '$.kind')) STORED,
+  target_id INTEGER AS (json_extract(raw, '$.targetID')) STORED
+)`, `CREATE TABLE IF NOT EXISTS AuditLog (
+  id INTEGER PRIMARY KEY,
+  raw BLOB -- JSON tmemes.AuditEntry
+)`),
+		},
+		{
+			Source: "22003317ce0b5faa8ff4c51cc2afdd46c06931d95add1619dfc8e570200a2ac0",
+			Target: "ae030c0392ddc0b92380439379181c974fe60607089ef2bc156187db53a1a11e",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS UserPrefs (
+  user_id INTEGER PRIMARY KEY,
+  raw BLOB -- JSON tmemes.UserPrefs
+)`),
+		},
+		{
+			Source: "ae030c0392ddc0b92380439379181c974fe60607089ef2bc156187db53a1a11e",
+			Target: "5ca3e38c65124b3a2e23599b57c7a311d06dc6f688652d6cb16e4904017f8f0e",
+			Apply: squibble.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS SearchIndex USING fts5(
+  kind UNINDEXED,       -- "macro" or "template"
+  item_id UNINDEXED,    -- ID of the macro or template
+  creator_id UNINDEXED, -- user ID of the creator
+  body,                 -- macro overlay text or template name
+  creator,              -- display name of the creator
+  tokenize = 'porter unicode61'
+)`, `CREATE TABLE IF NOT EXISTS CreatorNames (
+  user_id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+)`),
+		},
+		{
+			Source: "5ca3e38c65124b3a2e23599b57c7a311d06dc6f688652d6cb16e4904017f8f0e",
+			Target: "5310986350524adb1ae79aabcfb2c689ddf6a52463db9221aeea52d6b0c44d95",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS APITokens (
+  id INTEGER PRIMARY KEY,
+  hash BLOB UNIQUE NOT NULL, -- SHA-256 of the token secret
+  user_id INTEGER NOT NULL,
+  raw BLOB -- JSON tmemes.APIToken
+)`),
+		},
+		{
+			Source: "5310986350524adb1ae79aabcfb2c689ddf6a52463db9221aeea52d6b0c44d95",
+			Target: "1f33ecf89dc1f3c25cd769a692369efc1758cbc130a70fb43da35b59646a20be",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS UserProfiles (
+  user_id INTEGER PRIMARY KEY,
+  raw BLOB, -- JSON tailcfg.UserProfile
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+)`),
+		},
+		{
+			Source: "1f33ecf89dc1f3c25cd769a692369efc1758cbc130a70fb43da35b59646a20be",
+			Target: "79afdc6a079f8f1b9b87d8f60e1789d378a752b3822addbb1ce0fd6096921ad1",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS TemplatePacks (
+  name TEXT PRIMARY KEY,
+  raw BLOB -- JSON tmemes.TemplatePack
+)`, `CREATE TABLE IF NOT EXISTS PackSubscriptions (
+  url TEXT PRIMARY KEY,
+  raw BLOB -- JSON tmemes.PackSubscription
+)`),
+		},
+		{
+			Source: "79afdc6a079f8f1b9b87d8f60e1789d378a752b3822addbb1ce0fd6096921ad1",
+			Target: "dad3a00c44b9057611a6a23d4b1bb08b86ccd9ddb33e5f7820715eb915a20777",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS FileEtags (
+  path TEXT PRIMARY KEY, -- relative to the store directory
+  size INTEGER NOT NULL,
+  mtime INTEGER NOT NULL, -- Unix nanoseconds
+  etag TEXT NOT NULL
+)`),
+		},
+		{
+			Source: "dad3a00c44b9057611a6a23d4b1bb08b86ccd9ddb33e5f7820715eb915a20777",
+			Target: "d99a49644c31858ce4361d639af804148384072b5b63c88bc62f3ee869667756",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS Stickers (
+  id INTEGER PRIMARY KEY,
+  raw BLOB -- JSON tmemes.Sticker
+)`),
+		},
+		{
+			Source: "d99a49644c31858ce4361d639af804148384072b5b63c88bc62f3ee869667756",
+			Target: "a1608c2145535b1e4995c7821698da86bbde08e397f7b3508e072ce333a5e772",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS CacheAccess (
+  path TEXT PRIMARY KEY, -- relative to the store directory
+  accessed INTEGER NOT NULL -- Unix nanoseconds
+)`),
+		},
+		{
+			Source: "a1608c2145535b1e4995c7821698da86bbde08e397f7b3508e072ce333a5e772",
+			Target: "a369fdec64a8427e11a525497bbf7bea4afe4b1879d1d3ff446a9fddd685a3b5",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS ContentStats (
+  kind TEXT NOT NULL, -- "macro" or "template"
+  id INTEGER NOT NULL,
+  views INTEGER NOT NULL DEFAULT 0,
+  renders INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (kind, id)
+)`),
+		},
+		{
+			Source: "a369fdec64a8427e11a525497bbf7bea4afe4b1879d1d3ff446a9fddd685a3b5",
+			Target: "e896697c35e5c79ec26f93c86dc6b359cc7e8c7276c849f887ce85103300a363",
+			Apply: squibble.Exec(
+				`ALTER TABLE ContentStats ADD COLUMN trend REAL NOT NULL DEFAULT 0`,
+				`ALTER TABLE ContentStats ADD COLUMN trend_at INTEGER NOT NULL DEFAULT 0`,
+			),
+		},
+		{
+			Source: "e896697c35e5c79ec26f93c86dc6b359cc7e8c7276c849f887ce85103300a363",
+			Target: "c135ad0b440472b81e65cda4a145cbcd06b9e794b88ba86984bc16e8e7ce28b8",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS Categories (
+  name TEXT PRIMARY KEY COLLATE NOCASE,
+  raw BLOB -- JSON tmemes.Category
+)`),
+		},
+		{
+			Source: "c135ad0b440472b81e65cda4a145cbcd06b9e794b88ba86984bc16e8e7ce28b8",
+			Target: "cad35a796a7875c20af258c3f83ba71ade04cdd960d5f5566deb4116577b8fbb",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS Moderators (
+  user_id INTEGER PRIMARY KEY,
+  raw BLOB -- JSON tmemes.Moderator
+)`),
+		},
+		{
+			Source: "cad35a796a7875c20af258c3f83ba71ade04cdd960d5f5566deb4116577b8fbb",
+			Target: "1222dfc552c8960c1854b101a530c7fe4caf5332fd722019128f9ed3ea3b0039",
+			Apply: squibble.Exec(`CREATE TABLE IF NOT EXISTS Webhooks (
+  id INTEGER PRIMARY KEY,
+  raw BLOB -- JSON tmemes.Webhook
+)`),
+		},
+	},
 }
 
 func openDatabase(url string) (*sql.DB, error) {
@@ -50,8 +208,18 @@ func (db *DB) loadSQLiteIndex() error {
 	merr := db.loadMacrosLocked()
 	terr := db.loadTemplatesLocked()
 	derr := db.loadMetadataLocked()
-
-	return errors.Join(merr, terr, derr)
+	perr := db.loadUserPrefsLocked()
+	nerr := db.loadCreatorNamesLocked()
+	serr := db.loadStatsLocked()
+	if err := errors.Join(merr, terr, derr, perr, nerr, serr); err != nil {
+		return err
+	}
+	for _, m := range db.macros {
+		if t, ok := db.templates[m.TemplateID]; ok {
+			t.MacroCount++
+		}
+	}
+	return db.checkSearchIndexLocked()
 }
 
 func (db *DB) loadMacrosLocked() error {
@@ -104,6 +272,7 @@ func (db *DB) loadTemplatesLocked() error {
 		if err := json.Unmarshal(tmplJSON, &tmpl); err != nil {
 			return fmt.Errorf("decode template id %d: %w", id, err)
 		}
+		tmpl.MacroCount = 0 // counted once the macros are loaded
 		db.templates[id] = &tmpl
 	}
 	db.nextTemplateID++
@@ -118,17 +287,92 @@ func (db *DB) loadMetadataLocked() error {
 	return nil
 }
 
+func (db *DB) loadUserPrefsLocked() error {
+	db.prefs = make(map[tailcfg.UserID]*tmemes.UserPrefs)
+	rows, err := db.sqldb.Query(`SELECT user_id, raw FROM UserPrefs`)
+	if err != nil {
+		return fmt.Errorf("loading user prefs: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id tailcfg.UserID
+		var raw []byte
+		if err := rows.Scan(&id, &raw); err != nil {
+			return fmt.Errorf("scanning user prefs: %w", err)
+		}
+		var p tmemes.UserPrefs
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return fmt.Errorf("decode prefs for user %d: %w", id, err)
+		}
+		db.prefs[id] = &p
+	}
+	return rows.Err()
+}
+
+func (db *DB) loadCreatorNamesLocked() error {
+	db.creatorNames = make(map[tailcfg.UserID]string)
+	rows, err := db.sqldb.Query(`SELECT user_id, name FROM CreatorNames`)
+	if err != nil {
+		return fmt.Errorf("loading creator names: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id tailcfg.UserID
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return fmt.Errorf("scanning creator names: %w", err)
+		}
+		db.creatorNames[id] = name
+	}
+	return rows.Err()
+}
+
+// checkSearchIndexLocked populates the search index, if it is empty but there
+// is content to index. This happens when upgrading a database that predates
+// the index.
+func (db *DB) checkSearchIndexLocked() error {
+	var n int
+	if err := db.sqldb.QueryRow(`SELECT count(*) FROM SearchIndex`).Scan(&n); err != nil {
+		return fmt.Errorf("checking search index: %w", err)
+	}
+	if n > 0 || len(db.macros)+len(db.templates) == 0 {
+		return nil
+	}
+	for _, t := range db.templates {
+		if err := db.indexTemplateLocked(t); err != nil {
+			return err
+		}
+	}
+	for _, m := range db.macros {
+		if err := db.indexMacroLocked(db.sqldb, m); err != nil {
+			return err
+		}
+	}
+	log.Printf("Built search index for %d templates and %d macros", len(db.templates), len(db.macros))
+	return nil
+}
+
 func (db *DB) updateTemplateLocked(t *tmemes.Template) error {
-	bits, err := json.Marshal(t)
+	cp := *t
+	cp.MacroCount = 0
+	bits, err := json.Marshal(cp)
 	if err != nil {
 		return err
 	}
 	_, err = db.sqldb.Exec(`INSERT OR REPLACE INTO Templates (id, raw) VALUES (?, ?)`,
 		t.ID, bits)
-	return err
+	if err != nil {
+		return err
+	}
+	return db.indexTemplateLocked(t)
 }
 
 func (db *DB) updateMacroLocked(m *tmemes.Macro) error {
+	return db.writeMacroLocked(db.sqldb, m)
+}
+
+// writeMacroLocked writes m and its search index entry using tx.
+func (db *DB) writeMacroLocked(tx execer, m *tmemes.Macro) error {
 	cp := *m
 	cp.Upvotes = 0
 	cp.Downvotes = 0
@@ -136,14 +380,86 @@ func (db *DB) updateMacroLocked(m *tmemes.Macro) error {
 	if err != nil {
 		return err
 	}
-	_, err = db.sqldb.Exec(`INSERT OR REPLACE INTO Macros (id, raw) VALUES (?, ?)`,
+	_, err = tx.Exec(`INSERT OR REPLACE INTO Macros (id, raw) VALUES (?, ?)`,
 		m.ID, bits)
+	if err != nil {
+		return err
+	}
+	return db.indexMacroLocked(tx, m)
+}
+
+// indexTemplateLocked updates the search index entry for t. Hidden templates
+// are removed from the index.
+func (db *DB) indexTemplateLocked(t *tmemes.Template) error {
+	if t.Hidden {
+		return db.unindexItemLocked(db.sqldb, "template", t.ID)
+	}
+	return db.indexItemLocked(db.sqldb, "template", t.ID, t.Creator, strings.ReplaceAll(t.Name, "-", " "))
+}
+
+// indexMacroLocked updates the search index entry for m using tx, including
+// the text of all its caption variants. Hidden macros are removed from the
+// index.
+func (db *DB) indexMacroLocked(tx execer, m *tmemes.Macro) error {
+	if m.Hidden {
+		return db.unindexItemLocked(tx, "macro", m.ID)
+	}
+	var text []string
+	for _, tl := range m.TextOverlay {
+		text = append(text, tl.Text)
+	}
+	if ct := m.CaptionTest; ct != nil {
+		for _, v := range ct.Variants {
+			for _, tl := range v {
+				text = append(text, tl.Text)
+			}
+		}
+	}
+	return db.indexItemLocked(tx, "macro", m.ID, m.Creator, strings.Join(text, "\n"))
+}
+
+func (db *DB) indexItemLocked(tx execer, kind string, id int, creator tailcfg.UserID, body string) error {
+	if err := db.unindexItemLocked(tx, kind, id); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO SearchIndex (kind, item_id, creator_id, body, creator) VALUES (?, ?, ?, ?, ?)`,
+		kind, id, creator, body, db.creatorNames[creator])
+	return err
+}
+
+func (db *DB) unindexItemLocked(tx execer, kind string, id int) error {
+	_, err := tx.Exec(`DELETE FROM SearchIndex WHERE kind = ? AND item_id = ?`, kind, id)
 	return err
 }
 
+// searchQuery converts free text entered by a user into an FTS5 query that
+// matches items containing all the words of text, or words beginning with
+// them. It reports false if text contains no words.
+func searchQuery(text string) (string, bool) {
+	var terms []string
+	for _, w := range strings.Fields(text) {
+		if w = strings.ReplaceAll(w, `"`, ""); w != "" {
+			terms = append(terms, `"`+w+`"*`)
+		}
+	}
+	return strings.Join(terms, " "), len(terms) != 0
+}
+
+// voteTotals returns the name of a table or subquery giving the up and down
+// vote totals for each macro, according to the self-vote policy of db.
+func (db *DB) voteTotals() string {
+	if db.selfVotes != SelfVotesIgnore {
+		return "VoteTotals"
+	}
+	return `(SELECT v.macro_id macro_id, sum(v.vote = 1) up, sum(v.vote = -1) down
+    FROM Votes v JOIN Macros m ON (v.macro_id = m.id)
+   WHERE m.creator IS NULL OR v.user_id != m.creator
+   GROUP BY v.macro_id)`
+}
+
 func (db *DB) fillMacroVotesLocked(m *tmemes.Macro) error {
 	var up, down int
-	row := db.sqldb.QueryRow(`SELECT up, down FROM VoteTotals WHERE macro_id = ?`, m.ID)
+	row := db.sqldb.QueryRow(`SELECT up, down FROM `+db.voteTotals()+` WHERE macro_id = ?`, m.ID)
 	if err := row.Scan(&up, &down); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return err
 	}
@@ -158,7 +474,7 @@ func (db *DB) fillAllMacroVotesLocked() error {
 		return err
 	}
 	defer tx.Rollback()
-	rows, err := tx.Query(`SELECT macro_id, up, down FROM VoteTotals`)
+	rows, err := tx.Query(`SELECT macro_id, up, down FROM ` + db.voteTotals())
 	if err != nil {
 		return err
 	}
@@ -175,78 +491,276 @@ func (db *DB) fillAllMacroVotesLocked() error {
 	return rows.Err()
 }
 
+// cleanMacroCache periodically removes cached macro renderings that have not
+// been used recently, and if the cache is over its size cap, removes the least
+// recently used files until it fits. Renderings of popular macros are kept
+// longer, and those of unpopular ones removed sooner (see cacheWeight).
+// Renderings are deterministic, so a file removed here is regenerated
+// byte-for-byte on demand, and copies held by clients stay valid.
 func (db *DB) cleanMacroCache(ctx context.Context) {
 	const pollInterval = time.Minute // how often to scan the cache
-	log.Printf("Starting macro cache cleaner (poll=%v, max-age=%v, min-prune=%d bytes)",
-		pollInterval, db.maxAccessAge, db.minPruneBytes)
+	log.Printf("Starting macro cache cleaner (poll=%v, max-age=%v, min-prune=%d bytes, max=%d bytes)",
+		pollInterval, db.maxAccessAge, db.minPruneBytes, db.maxCacheBytes)
 
 	t := time.NewTicker(pollInterval)
 	defer t.Stop()
 
-	cacheDir := filepath.Join(db.dir, "macros")
+	cacheDirs := []string{filepath.Join(db.dir, "macros"), filepath.Join(db.dir, "thumbs")}
 	for {
 		select {
 		case <-ctx.Done():
+			db.mu.Lock()
+			db.flushCacheAccessLocked()
+			db.mu.Unlock()
 			log.Printf("Macro cache cleaner exiting (%v)", ctx.Err())
 			return
 		case <-t.C:
+		case <-db.pruneNow:
+			log.Printf("[macro cache] over %d bytes, cleaning early", db.maxCacheBytes)
 		}
 
-		// Phase 1: List all the files in the macro cache.
-		es, err := os.ReadDir(cacheDir)
-		if err != nil {
-			log.Printf("WARNING: reading cache directory: %v (continuing)", err)
-			continue
+		// Phase 1: List all the files in the macro and thumbnail caches.
+		type dirEntry struct {
+			dir string
+			os.DirEntry
 		}
+		var es []dirEntry
+		for _, dir := range cacheDirs {
+			des, err := os.ReadDir(dir)
+			if err != nil {
+				log.Printf("WARNING: reading cache directory: %v (continuing)", err)
+				continue
+			}
+			for _, e := range des {
+				es = append(es, dirEntry{dir, e})
+			}
+		}
+
+		// Phase 2: Gather the size and last use of each file. Uses recorded
+		// by TouchCached take precedence over access times on disk, which
+		// many filesystems do not keep up to date.
+		db.mu.Lock()
+		db.flushCacheAccessLocked()
+		used := db.cacheAccessLocked()
+		db.mu.Unlock()
 
-		// Phase 2: Select candidate paths for removal based on access time.
-		var totalSize int64
-		var cand []string
+		type cacheFile struct {
+			path, kind string
+			size       int64
+			age        time.Duration
+			weight     float64 // see cacheWeight
+		}
+		var files []cacheFile
 		for _, e := range es {
 			if !e.Type().IsRegular() {
 				continue // ignore directories, other nonsense
 			}
 
-			path := filepath.Join(cacheDir, e.Name())
-			atime, err := getAccessTime(path)
+			path := filepath.Join(e.dir, e.Name())
+			atime, ok := used[db.relPath(path)]
+			if !ok {
+				var err error
+				atime, err = getAccessTime(path)
+				if err != nil {
+					continue // skip
+				}
+			}
+			fi, err := e.Info()
 			if err != nil {
 				continue // skip
 			}
+			files = append(files, cacheFile{path: path, size: fi.Size(), age: time.Since(atime)})
+		}
 
-			age := time.Since(atime)
-			if age > db.maxAccessAge {
-				cand = append(cand, path)
+		// Phase 3: Classify the files, and select candidates for removal based
+		// on access time, scaled by the popularity of their macros. Renderings
+		// other than the default for each macro are less often viewed, so
+		// they expire sooner. Stale files are always removed.
+		stats := CacheStats{Kinds: make(map[string]CacheUsage), Scanned: time.Now().UTC(), Limit: db.maxCacheBytes}
+		var stale, cand, keep []cacheFile
+		db.mu.Lock()
+		weight := cacheWeight(db.macroPopularityLocked())
+		for i, f := range files {
+			name := filepath.Base(f.path)
+			files[i].kind = db.cacheKindLocked(name)
+			files[i].weight = 1
+			if _, id, _, ok := parseCacheName(name); ok {
+				files[i].weight = weight(id)
+			}
+		}
+		db.mu.Unlock()
+		for _, f := range files {
+			stats.add(f.kind, 1, f.size)
+			if f.kind == "stale" {
+				stale = append(stale, f)
+				continue
+			}
+			maxAge := time.Duration(float64(db.maxAccessAge) * f.weight)
+			if f.kind != "default" {
+				maxAge /= 2
+			}
+			if f.age > maxAge {
+				cand = append(cand, f)
+			} else {
+				keep = append(keep, f)
 			}
+		}
 
-			fi, _ := e.Info()
-			totalSize += fi.Size()
+		// If we have not stored enough data to be worried about, only remove
+		// stale files.
+		if stats.Bytes <= db.minPruneBytes {
+			keep = append(keep, cand...)
+			cand = nil
 		}
+		cand = append(cand, stale...)
 
-		// If we don't have eny candidates, or have not stored enough data to be
-		// worried about, go back to sleep.
-		if totalSize <= db.minPruneBytes || len(cand) == 0 {
-			continue
+		// If what remains is over the size cap, also remove the least recently
+		// used files until it fits, counting the files of popular macros as
+		// used more recently than they were.
+		if db.maxCacheBytes > 0 {
+			total := stats.Bytes
+			for _, f := range cand {
+				total -= f.size
+			}
+			sort.Slice(keep, func(i, j int) bool {
+				return float64(keep[i].age)/keep[i].weight > float64(keep[j].age)/keep[j].weight
+			})
+			for _, f := range keep {
+				if total <= db.maxCacheBytes {
+					break
+				}
+				f.kind = "evicted " + f.kind
+				cand = append(cand, f)
+				total -= f.size
+			}
 		}
 
-		// Phase 3: Grab the lock and clean up candidates.  By holding the lock,
+		// Phase 4: Grab the lock and clean up candidates.  By holding the lock,
 		// we ensure we are not racing with a last-minute /content request; if we
 		// win the race, the unlucky call will regenerate the file. If we lose,
 		// the caller is done with it by the time we unlink.
 		func() {
 			db.mu.Lock()
 			defer db.mu.Unlock()
-			for _, path := range cand {
-				if os.Remove(path) == nil {
-					log.Printf("[macro cache] removed %q", path)
+			for _, f := range cand {
+				if os.Remove(f.path) == nil {
+					log.Printf("[macro cache] removed %q (%s)", f.path, f.kind)
+					stats.add(strings.TrimPrefix(f.kind, "evicted "), -1, -f.size)
+					db.forgetFileEtagLocked(f.path)
 				}
 
 				// N.B. We ignore errors herd, it's not the end of the world if we
 				// aren't able to remove everything.
 			}
+			present := make(map[string]bool)
+			for _, f := range files {
+				present[db.relPath(f.path)] = true
+			}
+			for _, f := range cand {
+				delete(present, db.relPath(f.path))
+			}
+			db.forgetCacheAccessLocked(used, present)
+			db.cacheStats = stats
+			db.cacheBytes = stats.Bytes
+		}()
+	}
+}
+
+// cacheKindLocked classifies the file with the given name in the macro cache
+// as a rendering of one of these kinds:
+//
+//   - "default": the default rendering of a macro (see CacheKey)
+//   - "caption": a caption variant, for a macro with a caption test running
+//   - "size": a rendering at other than full size, or a template thumbnail
+//   - "format": a rendering in other than the default format, or with other
+//     than the server's encoder settings
+//   - "stale": a file for a deleted macro, a finished caption test, an old
+//     cache seed, or a replaced template image, or one whose name is not
+//     recognized
+//
+// A rendering that differs from the default in several ways has the first
+// applicable kind in the order listed.
+func (db *DB) cacheKindLocked(name string) string {
+	if hash, ok := parseTemplateThumbName(name); ok {
+		for _, t := range db.templates {
+			if t.ContentHash == hash {
+				return "size"
+			}
+		}
+		return "stale"
+	}
+	seed, id, key, ok := parseCacheName(name)
+	if !ok || seed != db.cachePrefix() {
+		return "stale"
+	}
+	m, ok := db.macros[id]
+	if !ok {
+		return "stale"
+	}
+	if key.Variant > 0 {
+		if !m.CaptionTest.Active(time.Now()) {
+			return "stale"
+		}
+		return "caption"
+	} else if key.Width > 0 || key.Height > 0 {
+		return "size"
+	}
+	if key.Encoding != "" {
+		return "format"
+	} else if t, ok := db.templates[m.TemplateID]; ok && key.Ext != db.MacroExt(t) {
+		return "format"
+	}
+	return "default"
+}
+
+// finishCaptionTests periodically checks for macros whose caption tests have
+// ended, and locks in the winning variant for each.
+func (db *DB) finishCaptionTests(ctx context.Context) {
+	const pollInterval = time.Minute
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		func() {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			now := time.Now()
+			for _, m := range db.macros {
+				if ct := m.CaptionTest; ct != nil && !ct.Done && !ct.Active(now) {
+					if err := db.finishCaptionTestLocked(m); err != nil {
+						log.Printf("WARNING: finishing caption test for macro %d: %v", m.ID, err)
+					}
+				}
+			}
 		}()
 	}
 }
 
+// finishCaptionTestLocked ends the caption test for m, choosing as the winner
+// the variant with the largest net vote count (ties go to the earliest).
+func (db *DB) finishCaptionTestLocked(m *tmemes.Macro) error {
+	up, down, err := db.variantVotesLocked(m)
+	if err != nil {
+		return err
+	}
+	winner := 0
+	for v := range up {
+		if up[v]-down[v] > up[winner]-down[winner] {
+			winner = v
+		}
+	}
+	db.removeCachedLocked(m)
+	ct := m.CaptionTest
+	ct.Done, ct.Winner = true, winner
+	m.TextOverlay = ct.Variants[winner]
+	log.Printf("Caption test for macro %d finished; winner is variant %d", m.ID, winner)
+	return db.updateMacroLocked(m)
+}
+
 func getAccessTime(path string) (time.Time, error) {
 	var sbuf unix.Stat_t
 	if err := unix.Stat(path, &sbuf); err != nil {
@@ -254,3 +768,59 @@ func getAccessTime(path string) (time.Time, error) {
 	}
 	return time.Unix(sbuf.Atim.Sec, sbuf.Atim.Nsec).UTC(), nil
 }
+
+// execer is the common subset of *sql.DB and *sql.Tx used for writes.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func addAuditEntry(tx execer, e *tmemes.AuditEntry) error {
+	if e.ID != 0 {
+		return errors.New("audit entry ID must be zero")
+	} else if e.Action == "" {
+		return errors.New("audit entry must have an action")
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	bits, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`INSERT INTO AuditLog (raw) VALUES (?)`, bits)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	e.ID = int(id)
+	return nil
+}
+
+// queryRaw runs a query whose rows have the form (id, raw), and decodes each
+// raw JSON value into a T. The setID function is called to record the ID of
+// each decoded value, since it is not stored in the raw value.
+func queryRaw[T any](sqldb *sql.DB, setID func(*T, int), query string, args ...any) ([]*T, error) {
+	rows, err := sqldb.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*T
+	for rows.Next() {
+		var id int
+		var raw []byte
+		if err := rows.Scan(&id, &raw); err != nil {
+			return nil, err
+		}
+		v := new(T)
+		if err := json.Unmarshal(raw, v); err != nil {
+			return nil, fmt.Errorf("decode row %d: %w", id, err)
+		}
+		setID(v, id)
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,78 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tailscale/squibble"
+)
+
+// TestUpgradeBaseline checks that a database made with the first schema of
+// the store is brought up to date by the update rules, keeping its data.
+func TestUpgradeBaseline(t *testing.T) {
+	baseline, err := os.ReadFile("testdata/baseline-schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	sqldb, err := sql.Open("sqlite", filepath.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &squibble.Schema{Current: string(baseline)}
+	if err := old.Apply(context.Background(), sqldb); err != nil {
+		t.Fatalf("Apply baseline: %v", err)
+	}
+	for _, q := range []string{
+		`INSERT INTO Templates (id, raw) VALUES (1, '{"id":1,"path":"templates/1.png","name":"drake","creator":42,"createdAt":"2023-04-01T00:00:00Z"}')`,
+		`INSERT INTO Macros (id, raw) VALUES (1, '{"id":1,"templateID":1,"creator":42,"createdAt":"2023-04-01T00:00:00Z","textOverlay":[{"text":"no"}]}')`,
+		`INSERT INTO Votes (user_id, macro_id, vote) VALUES (7, 1, 1)`,
+		`INSERT INTO Meta (key, value) VALUES ('greeting', 'hello')`,
+	} {
+		if _, err := sqldb.Exec(q); err != nil {
+			t.Fatalf("Exec %q: %v", q, err)
+		}
+	}
+	sqldb.Close()
+
+	db, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New on baseline database: %v", err)
+	}
+	defer db.Close()
+
+	if tmpl, err := db.Template(1); err != nil {
+		t.Errorf("Template 1: %v", err)
+	} else if tmpl.Name != "drake" || tmpl.MacroCount != 1 {
+		t.Errorf("Template 1: got %+v, want drake with 1 macro", tmpl)
+	}
+	if ms := db.MacrosByCreator(42); len(ms) != 1 || ms[0].ID != 1 {
+		t.Errorf("Macros by 42: got %+v, want macro 1", ms)
+	} else if ms[0].Upvotes != 1 {
+		t.Errorf("Macro 1: got %d upvotes, want 1", ms[0].Upvotes)
+	}
+	if v, err := db.GetVote(7, 1); err != nil || v != 1 {
+		t.Errorf("Vote: got %d, %v; want 1", v, err)
+	}
+	if v, err := db.GetMeta("greeting"); err != nil || string(v) != "hello" {
+		t.Errorf("Meta: got %q, %v; want hello", v, err)
+	}
+
+	// The database now has the current schema, so opening it again applies
+	// nothing; and new data goes into the tables the updates added.
+	if err := schema.Apply(context.Background(), db.sqldb); err != nil {
+		t.Errorf("Apply current schema again: %v", err)
+	}
+	if _, err := db.SetVote(8, 1, -1); err != nil {
+		t.Errorf("SetVote after upgrade: %v", err)
+	}
+	if _, err := db.sqldb.Exec(`INSERT INTO Webhooks (id, raw) VALUES (1, '{}')`); err != nil {
+		t.Errorf("Insert into added table: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"sync"
+
+	"github.com/tailscale/tmemes"
+)
+
+// eventBuffer is the number of events that may be queued for a subscriber
+// before further events are dropped for it.
+const eventBuffer = 64
+
+// An eventBus delivers events to its subscribers. The zero value is ready
+// for use.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan tmemes.Event]struct{}
+}
+
+// Subscribe returns a channel that receives an event when a macro is created
+// or deleted, or its votes change, and a function that ends the subscription
+// and closes the channel. Events are not delivered to a subscriber that
+// falls too far behind in reading them, so the receiver should not block.
+func (db *DB) Subscribe() (<-chan tmemes.Event, func()) {
+	b := &db.events
+	ch := make(chan tmemes.Event, eventBuffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[chan tmemes.Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subs, ch)
+			close(ch)
+		})
+	}
+}
+
+// publish delivers e to each subscriber with room for it.
+func (b *eventBus) publish(e tmemes.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// The subscriber is not keeping up; drop the event.
+		}
+	}
+}
+
+// publishVotesLocked publishes the current vote totals of m.
+// The caller must hold db.mu.
+func (db *DB) publishVotesLocked(m *tmemes.Macro) {
+	db.events.publish(tmemes.Event{
+		Type:      "vote",
+		MacroID:   m.ID,
+		Upvotes:   m.Upvotes,
+		Downvotes: m.Downvotes,
+	})
+}
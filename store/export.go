@@ -0,0 +1,232 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A bundle is a gzip-compressed tar archive holding a copy of the index and
+// all the template and sticker images of a store, followed by a manifest
+// recording the SHA-256 digest of each of them. Cached macros are not
+// included, since they can be regenerated.
+
+// bundleManifestName is the name of the manifest entry in a bundle.
+const bundleManifestName = "manifest.json"
+
+// bundleManifest is the JSON encoding of the manifest of a bundle.
+type bundleManifest struct {
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Files     map[string]string `json:"files"` // name → hex SHA-256
+}
+
+// vacuumInto writes a consistent snapshot of the index database to path,
+// which must not exist.
+func (db *DB) vacuumInto(path string) error {
+	_, err := db.sqldb.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
+// Export writes a bundle of the contents of db to w.
+func (db *DB) Export(w io.Writer) error {
+	tmp := filepath.Join(db.dir, "index.db.export")
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+	if err := db.vacuumInto(tmp); err != nil {
+		return fmt.Errorf("snapshot index: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	m := bundleManifest{Version: 1, CreatedAt: time.Now().UTC(), Files: make(map[string]string)}
+	add := func(name, srcPath string) error {
+		f, err := db.OpenFile(srcPath) // bundles are not encrypted
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}); err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tw, h), f); err != nil {
+			return err
+		}
+		m.Files[name] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	}
+
+	if err := add("index.db", tmp); err != nil {
+		return err
+	}
+	// Templates are never removed, so every template in the snapshot is
+	// listed here; any added since are harmless extras.
+	for _, t := range db.AllTemplates() {
+		if err := add(filepath.ToSlash(t.Path), filepath.Join(db.dir, t.Path)); err != nil {
+			return fmt.Errorf("template %d: %w", t.ID, err)
+		}
+		if t.Audio != "" {
+			if err := add(filepath.ToSlash(t.Audio), filepath.Join(db.dir, t.Audio)); err != nil {
+				return fmt.Errorf("template %d audio: %w", t.ID, err)
+			}
+		}
+	}
+
+	stickers, err := db.Stickers()
+	if err != nil {
+		return err
+	}
+	for _, st := range stickers {
+		if err := add(filepath.ToSlash(st.Path), filepath.Join(db.dir, st.Path)); err != nil {
+			return fmt.Errorf("sticker %d: %w", st.ID, err)
+		}
+	}
+
+	bits, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    bundleManifestName,
+		Mode:    0600,
+		Size:    int64(len(bits)),
+		ModTime: m.CreatedAt,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(bits); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Import unpacks a bundle written by Export from r into the store directory
+// dirPath, which is created if necessary. The directory must not already
+// contain an index. Each file is checked against the manifest, and on any
+// error the files unpacked so far are removed.
+//
+// Import must be called before the store is opened with New.
+func Import(dirPath string, r io.Reader) (retErr error) {
+	if _, err := os.Stat(filepath.Join(dirPath, "index.db")); err == nil {
+		return errors.New("store already has an index")
+	}
+	for _, sub := range subdirs {
+		if err := os.MkdirAll(filepath.Join(dirPath, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	var written []string
+	defer func() {
+		if retErr != nil {
+			for _, p := range written {
+				os.Remove(p)
+			}
+		}
+	}()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("invalid bundle: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	digests := make(map[string]string)
+	var m *bundleManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("invalid bundle: %w", err)
+		}
+		if hdr.Name == bundleManifestName {
+			m = new(bundleManifest)
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return fmt.Errorf("invalid manifest: %w", err)
+			}
+			continue
+		}
+		if !validBundleName(hdr.Name) || hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected bundle entry %q", hdr.Name)
+		} else if _, ok := digests[hdr.Name]; ok {
+			return fmt.Errorf("duplicate bundle entry %q", hdr.Name)
+		}
+
+		dst := filepath.Join(dirPath, filepath.FromSlash(hdr.Name))
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		written = append(written, dst)
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(f, h), tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("unpack %q: %w", hdr.Name, err)
+		}
+		digests[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	// Check that the contents are exactly what the manifest describes.
+	if m == nil {
+		return errors.New("bundle has no manifest")
+	} else if m.Version != 1 {
+		return fmt.Errorf("unsupported bundle version %d", m.Version)
+	} else if _, ok := m.Files["index.db"]; !ok {
+		return errors.New("bundle has no index")
+	}
+	for name, want := range m.Files {
+		got, ok := digests[name]
+		if !ok {
+			return fmt.Errorf("bundle is missing %q", name)
+		} else if got != want {
+			return fmt.Errorf("checksum mismatch for %q", name)
+		}
+	}
+	for name := range digests {
+		if _, ok := m.Files[name]; !ok {
+			return fmt.Errorf("bundle entry %q is not in the manifest", name)
+		}
+	}
+	return nil
+}
+
+// validBundleName reports whether name is a valid file name in a bundle:
+// either the index, or a file directly in the templates or stickers
+// directory.
+func validBundleName(name string) bool {
+	if name == "index.db" {
+		return true
+	}
+	dir, base := path.Split(name)
+	return (dir == "templates/" || dir == "stickers/") &&
+		base != "" && base != "." && base != ".." && !strings.ContainsAny(base, `/\`)
+}
@@ -0,0 +1,149 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/tmemes"
+
+	_ "modernc.org/sqlite"
+)
+
+// readStoreFile returns the contents of the file at relPath in db.
+func readStoreFile(t *testing.T, db *DB, relPath string) string {
+	t.Helper()
+	f, err := db.OpenFile(filepath.Join(db.dir, relPath))
+	if err != nil {
+		t.Fatalf("Open %q: %v", relPath, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read %q: %v", relPath, err)
+	}
+	return string(data)
+}
+
+func TestExportImport(t *testing.T) {
+	src, err := New(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer src.Close()
+
+	tmpl := &tmemes.Template{Name: "drake", Width: 10, Height: 10, Creator: 1}
+	if err := src.AddTemplate(tmpl, "png", strings.NewReader("template image")); err != nil {
+		t.Fatalf("AddTemplate: %v", err)
+	}
+	st := &tmemes.Sticker{Width: 5, Height: 5, Creator: 1}
+	if err := src.AddSticker(st, "png", strings.NewReader("sticker image")); err != nil {
+		t.Fatalf("AddSticker: %v", err)
+	}
+
+	var bundle bytes.Buffer
+	if err := src.Export(&bundle); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := Import(dir, bytes.NewReader(bundle.Bytes())); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if err := Import(dir, bytes.NewReader(bundle.Bytes())); err == nil {
+		t.Error("Import into a populated store: got nil, want error")
+	}
+
+	dst, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New imported: %v", err)
+	}
+	defer dst.Close()
+
+	gotT, err := dst.Template(tmpl.ID)
+	if err != nil {
+		t.Fatalf("Template %d: %v", tmpl.ID, err)
+	} else if gotT.Name != tmpl.Name || gotT.Path != tmpl.Path {
+		t.Errorf("Template: got %q at %q, want %q at %q", gotT.Name, gotT.Path, tmpl.Name, tmpl.Path)
+	}
+	if got := readStoreFile(t, dst, gotT.Path); got != "template image" {
+		t.Errorf("Template image: got %q, want %q", got, "template image")
+	}
+
+	gotS, err := dst.Sticker(st.ID)
+	if err != nil {
+		t.Fatalf("Sticker %d: %v", st.ID, err)
+	} else if gotS.Path != st.Path {
+		t.Errorf("Sticker path: got %q, want %q", gotS.Path, st.Path)
+	}
+	if got := readStoreFile(t, dst, gotS.Path); got != "sticker image" {
+		t.Errorf("Sticker image: got %q, want %q", got, "sticker image")
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	// bundle returns a bundle with the given entries, in order.
+	bundle := func(entries ...string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for i := 0; i < len(entries); i += 2 {
+			name, data := entries[i], entries[i+1]
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))})
+			tw.Write([]byte(data))
+		}
+		tw.Close()
+		gz.Close()
+		return buf.Bytes()
+	}
+	h := sha256.Sum256([]byte("index"))
+	indexSum := hex.EncodeToString(h[:])
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"NotGzip", []byte("hello"), "invalid bundle"},
+		{"NoManifest", bundle("index.db", "index"), "no manifest"},
+		{"NoIndex", bundle("manifest.json", `{"version":1,"files":{}}`), "no index"},
+		{"BadVersion", bundle("manifest.json", `{"version":2}`), "unsupported bundle version"},
+		{"Traversal", bundle("templates/../../x", "x"), "unexpected bundle entry"},
+		{"OtherDir", bundle("macros/1.png", "x"), "unexpected bundle entry"},
+		{"Nested", bundle("stickers/a/b.png", "x"), "unexpected bundle entry"},
+		{"Duplicate", bundle("index.db", "index", "index.db", "index"), "duplicate bundle entry"},
+		{"Checksum", bundle("index.db", "index",
+			"manifest.json", `{"version":1,"files":{"index.db":"00"}}`), "checksum mismatch"},
+		{"Missing", bundle("index.db", "index",
+			"manifest.json", `{"version":1,"files":{"index.db":"`+indexSum+`","stickers/1.png":"00"}}`), "missing"},
+		{"Extra", bundle("index.db", "index", "stickers/1.png", "x",
+			"manifest.json", `{"version":1,"files":{"index.db":"`+indexSum+`"}}`), "not in the manifest"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := Import(dir, bytes.NewReader(tc.input))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("Import: got error %v, want %q", err, tc.want)
+			}
+			// Nothing unpacked may be left behind on failure.
+			for _, sub := range subdirs {
+				if des, _ := os.ReadDir(filepath.Join(dir, sub)); len(des) != 0 {
+					t.Errorf("Import left %d files in %s", len(des), sub)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, "index.db")); err == nil {
+				t.Error("Import left index.db behind")
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tailscale/tmemes"
+	"tailscale.com/tailcfg"
+)
+
+// Moderators returns all the moderators of the server, ordered by user ID.
+func (db *DB) Moderators() ([]*tmemes.Moderator, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows, err := db.sqldb.Query(`SELECT raw FROM Moderators ORDER BY user_id`)
+	if err != nil {
+		return nil, fmt.Errorf("loading moderators: %w", err)
+	}
+	defer rows.Close()
+	var out []*tmemes.Moderator
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, fmt.Errorf("scanning moderator: %w", err)
+		}
+		var m tmemes.Moderator
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("decode moderator: %w", err)
+		}
+		out = append(out, &m)
+	}
+	return out, rows.Err()
+}
+
+// IsModerator reports whether the specified user is a moderator.
+func (db *DB) IsModerator(uid tailcfg.UserID) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var n int
+	err := db.sqldb.QueryRow(`SELECT 1 FROM Moderators WHERE user_id = ?`, uid).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AddModerator makes the user of m a moderator, replacing any existing record
+// for that user.
+func (db *DB) AddModerator(m *tmemes.Moderator) error {
+	if m.UserID <= 0 {
+		return errors.New("invalid moderator user ID")
+	}
+	bits, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, err = db.sqldb.Exec(`INSERT OR REPLACE INTO Moderators (user_id, raw) VALUES (?, ?)`, m.UserID, bits)
+	return err
+}
+
+// RemoveModerator removes the specified user from the moderators.
+func (db *DB) RemoveModerator(uid tailcfg.UserID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, err := db.sqldb.Exec(`DELETE FROM Moderators WHERE user_id = ?`, uid)
+	if err != nil {
+		return err
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %d is not a moderator", uid)
+	}
+	return nil
+}
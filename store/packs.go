@@ -0,0 +1,141 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tailscale/tmemes"
+)
+
+// TemplatePacks returns all the template packs published by this server,
+// ordered by name.
+func (db *DB) TemplatePacks() ([]*tmemes.TemplatePack, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows, err := db.sqldb.Query(`SELECT raw FROM TemplatePacks ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("loading template packs: %w", err)
+	}
+	defer rows.Close()
+	var out []*tmemes.TemplatePack
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, fmt.Errorf("scanning template pack: %w", err)
+		}
+		var p tmemes.TemplatePack
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, fmt.Errorf("decode template pack: %w", err)
+		}
+		out = append(out, &p)
+	}
+	return out, rows.Err()
+}
+
+// TemplatePack returns the published template pack with the given name.
+func (db *DB) TemplatePack(name string) (*tmemes.TemplatePack, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var raw []byte
+	err := db.sqldb.QueryRow(`SELECT raw FROM TemplatePacks WHERE name = ?`, name).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("template pack %q not found", name)
+	} else if err != nil {
+		return nil, err
+	}
+	var p tmemes.TemplatePack
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, fmt.Errorf("decode template pack: %w", err)
+	}
+	return &p, nil
+}
+
+// SetTemplatePack creates or replaces the published template pack with the
+// name of p.
+func (db *DB) SetTemplatePack(p *tmemes.TemplatePack) error {
+	if p.Name == "" {
+		return errors.New("empty pack name")
+	}
+	bits, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, err = db.sqldb.Exec(`INSERT OR REPLACE INTO TemplatePacks (name, raw) VALUES (?, ?)`, p.Name, bits)
+	return err
+}
+
+// DeleteTemplatePack removes the published template pack with the given name.
+// The templates in it are not affected.
+func (db *DB) DeleteTemplatePack(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, err := db.sqldb.Exec(`DELETE FROM TemplatePacks WHERE name = ?`, name)
+	if err != nil {
+		return err
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("template pack %q not found", name)
+	}
+	return nil
+}
+
+// PackSubscriptions returns all the template pack subscriptions of this
+// server, ordered by URL.
+func (db *DB) PackSubscriptions() ([]*tmemes.PackSubscription, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows, err := db.sqldb.Query(`SELECT raw FROM PackSubscriptions ORDER BY url`)
+	if err != nil {
+		return nil, fmt.Errorf("loading pack subscriptions: %w", err)
+	}
+	defer rows.Close()
+	var out []*tmemes.PackSubscription
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, fmt.Errorf("scanning pack subscription: %w", err)
+		}
+		var sub tmemes.PackSubscription
+		if err := json.Unmarshal(raw, &sub); err != nil {
+			return nil, fmt.Errorf("decode pack subscription: %w", err)
+		}
+		out = append(out, &sub)
+	}
+	return out, rows.Err()
+}
+
+// SetPackSubscription creates or replaces the pack subscription with the URL
+// of sub.
+func (db *DB) SetPackSubscription(sub *tmemes.PackSubscription) error {
+	if sub.URL == "" {
+		return errors.New("empty subscription URL")
+	}
+	bits, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, err = db.sqldb.Exec(`INSERT OR REPLACE INTO PackSubscriptions (url, raw) VALUES (?, ?)`, sub.URL, bits)
+	return err
+}
+
+// DeletePackSubscription removes the pack subscription with the given URL.
+// Templates already copied from the pack are kept.
+func (db *DB) DeletePackSubscription(url string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, err := db.sqldb.Exec(`DELETE FROM PackSubscriptions WHERE url = ?`, url)
+	if err != nil {
+		return err
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("subscription %q not found", url)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// s3Backend is a Backend that stores objects in an S3 bucket, or in a
+// compatible service, using the REST API directly.
+type s3Backend struct {
+	endpoint *url.URL // base URL of the bucket
+	prefix   string   // prepended to all keys; empty or ends in "/"
+	region   string
+	creds    aws.CredentialsProvider
+	signer   *v4.Signer
+	client   *http.Client
+}
+
+// newS3Backend constructs an s3Backend for a URL of the form
+// s3://bucket/prefix?region=r&endpoint=https://host.
+func newS3Backend(ctx context.Context, u *url.URL) (*s3Backend, error) {
+	bucket := u.Host
+	if bucket == "" {
+		return nil, errors.New("missing S3 bucket name")
+	}
+	q := u.Query()
+	var opts []func(*config.LoadOptions) error
+	if r := q.Get("region"); r != "" {
+		opts = append(opts, config.WithRegion(r))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	// Use path-style addressing for custom endpoints, since S3-compatible
+	// services do not all support virtual hosts for buckets.
+	var base *url.URL
+	if ep := q.Get("endpoint"); ep != "" {
+		base, err = url.Parse(strings.TrimSuffix(ep, "/") + "/" + bucket + "/")
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+		}
+	} else {
+		base = &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, region), Path: "/"}
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Backend{
+		endpoint: base,
+		prefix:   prefix,
+		region:   region,
+		creds:    cfg.Credentials,
+		signer: v4.NewSigner(func(o *v4.SignerOptions) {
+			o.DisableURIPathEscaping = true // S3 expects paths encoded only once
+		}),
+		client: &http.Client{Timeout: backendTimeout},
+	}, nil
+}
+
+// do sends a signed request for the given object key (or for the bucket, if
+// key == "") with the specified query and body, and returns the response if
+// it has a 2xx status.
+func (s *s3Backend) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	if key != "" {
+		u.Path += s.prefix + key
+	}
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	if s.creds != nil {
+		creds, err := s.creds.Retrieve(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving AWS credentials: %w", err)
+		}
+		if err := s.signer.SignHTTP(ctx, creds, req, payloadHash, "s3", s.region, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode/100 == 2 {
+		return rsp, nil
+	}
+	defer rsp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 1<<10))
+	err = fmt.Errorf("s3 %s %q: %s: %s", method, key, rsp.Status, bytes.TrimSpace(msg))
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+	}
+	return nil, err
+}
+
+func (s *s3Backend) Get(ctx context.Context, key string) ([]byte, error) {
+	rsp, err := s.do(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	return io.ReadAll(rsp.Body)
+}
+
+func (s *s3Backend) Put(ctx context.Context, key string, data []byte) error {
+	rsp, err := s.do(ctx, "PUT", key, nil, data)
+	if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+func (s *s3Backend) Delete(ctx context.Context, key string) error {
+	rsp, err := s.do(ctx, "DELETE", key, nil, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return rsp.Body.Close()
+}
+
+func (s *s3Backend) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	q := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+	for {
+		rsp, err := s.do(ctx, "GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(rsp.Body).Decode(&result)
+		rsp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %q: %w", prefix, err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, path.Clean(strings.TrimPrefix(c.Key, s.prefix)))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		q.Set("continuation-token", result.NextContinuationToken)
+	}
+}
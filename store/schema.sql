@@ -36,6 +36,7 @@ CREATE TABLE IF NOT EXISTS Votes (
   macro_id INTEGER NOT NULL,
   vote INTEGER NOT NULL,
   last_update TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  variant INTEGER NOT NULL DEFAULT 0, -- caption test variant voted on
 
   CHECK (vote = -1 OR vote = 1),
   FOREIGN KEY (macro_id) REFERENCES Macros(id),
@@ -61,3 +62,126 @@ CREATE TABLE IF NOT EXISTS Meta (
   key TEXT UNIQUE NOT NULL,
   value BLOB
 );
+
+CREATE TABLE IF NOT EXISTS PushSubscriptions (
+  endpoint TEXT PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  raw BLOB, -- JSON tmemes.PushSubscription
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS Reports (
+  id INTEGER PRIMARY KEY,
+  raw BLOB, -- JSON tmemes.Report
+
+  -- Generated columns.
+  kind TEXT AS (json_extract(raw, '$.kind')) STORED,
+  target_id INTEGER AS (json_extract(raw, '$.targetID')) STORED
+);
+
+CREATE TABLE IF NOT EXISTS AuditLog (
+  id INTEGER PRIMARY KEY,
+  raw BLOB -- JSON tmemes.AuditEntry
+);
+
+CREATE TABLE IF NOT EXISTS UserPrefs (
+  user_id INTEGER PRIMARY KEY,
+  raw BLOB -- JSON tmemes.UserPrefs
+);
+
+-- Full-text search index over macros and templates, maintained by the store.
+CREATE VIRTUAL TABLE IF NOT EXISTS SearchIndex USING fts5(
+  kind UNINDEXED,       -- "macro" or "template"
+  item_id UNINDEXED,    -- ID of the macro or template
+  creator_id UNINDEXED, -- user ID of the creator
+  body,                 -- macro overlay text or template name
+  creator,              -- display name of the creator
+  tokenize = 'porter unicode61'
+);
+
+CREATE TABLE IF NOT EXISTS CreatorNames (
+  user_id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS APITokens (
+  id INTEGER PRIMARY KEY,
+  hash BLOB UNIQUE NOT NULL, -- SHA-256 of the token secret
+  user_id INTEGER NOT NULL,
+  raw BLOB -- JSON tmemes.APIToken
+);
+
+-- Tailnet user profiles last seen by the server, so that creators can be
+-- named without asking the tailnet, including after a restart.
+CREATE TABLE IF NOT EXISTS UserProfiles (
+  user_id INTEGER PRIMARY KEY,
+  raw BLOB, -- JSON tailcfg.UserProfile
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Template packs published by this server for other servers to subscribe to.
+CREATE TABLE IF NOT EXISTS TemplatePacks (
+  name TEXT PRIMARY KEY,
+  raw BLOB -- JSON tmemes.TemplatePack
+);
+
+-- Template packs published by other servers, whose templates are copied here.
+CREATE TABLE IF NOT EXISTS PackSubscriptions (
+  url TEXT PRIMARY KEY,
+  raw BLOB -- JSON tmemes.PackSubscription
+);
+
+-- Etags of files in the store, so they need not be computed again after a
+-- restart. An entry is valid only while the file keeps the recorded size and
+-- modification time.
+CREATE TABLE IF NOT EXISTS FileEtags (
+  path TEXT PRIMARY KEY, -- relative to the store directory
+  size INTEGER NOT NULL,
+  mtime INTEGER NOT NULL, -- Unix nanoseconds
+  etag TEXT NOT NULL
+);
+
+-- Stickers, small images that can be pasted onto macros as image overlays.
+CREATE TABLE IF NOT EXISTS Stickers (
+  id INTEGER PRIMARY KEY,
+  raw BLOB -- JSON tmemes.Sticker
+);
+
+-- When each file in the macro and thumbnail caches was last used, for evicting
+-- the least recently used files first. Files without an entry fall back to
+-- their access time on disk.
+CREATE TABLE IF NOT EXISTS CacheAccess (
+  path TEXT PRIMARY KEY, -- relative to the store directory
+  accessed INTEGER NOT NULL -- Unix nanoseconds
+);
+
+-- How many times each macro and template has been served and rendered, for
+-- ranking by views. Counts are kept in memory and written periodically.
+CREATE TABLE IF NOT EXISTS ContentStats (
+  kind TEXT NOT NULL, -- "macro" or "template"
+  id INTEGER NOT NULL,
+  views INTEGER NOT NULL DEFAULT 0,
+  renders INTEGER NOT NULL DEFAULT 0,
+  trend REAL NOT NULL DEFAULT 0, -- views, decayed as of trend_at
+  trend_at INTEGER NOT NULL DEFAULT 0, -- Unix nanoseconds
+  PRIMARY KEY (kind, id)
+);
+
+-- Categories of templates, curated by server admins.
+CREATE TABLE IF NOT EXISTS Categories (
+  name TEXT PRIMARY KEY COLLATE NOCASE,
+  raw BLOB -- JSON tmemes.Category
+);
+
+-- Users allowed to moderate content, besides server admins.
+CREATE TABLE IF NOT EXISTS Moderators (
+  user_id INTEGER PRIMARY KEY,
+  raw BLOB -- JSON tmemes.Moderator
+);
+
+-- Outbound webhooks registered by server admins, notified of changes to
+-- macros.
+CREATE TABLE IF NOT EXISTS Webhooks (
+  id INTEGER PRIMARY KEY,
+  raw BLOB -- JSON tmemes.Webhook
+);
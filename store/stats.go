@@ -0,0 +1,364 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// ContentStats report how many times a macro or template has been served and
+// rendered.
+type ContentStats struct {
+	Views   int64 `json:"views"`   // content requests served
+	Renders int64 `json:"renders"` // renderings generated
+
+	// For a template, the total views of the macros made from it.
+	MacroViews int64 `json:"macroViews,omitempty"`
+
+	trend   float64   // views, decayed as of trendAt (see TrendHalfLife)
+	trendAt time.Time // when trend was last updated
+}
+
+// TrendHalfLife is the time over which a view or vote loses half its weight
+// in the decayed totals reported by TrendingViews and TrendingVotes.
+const TrendHalfLife = 24 * time.Hour
+
+// decay returns the factor by which a decayed total loses weight over d.
+func decay(d time.Duration) float64 {
+	return math.Exp2(-float64(d) / float64(TrendHalfLife))
+}
+
+// A statsKey identifies the item counted by a ContentStats.
+type statsKey struct {
+	kind string // "macro" or "template"
+	id   int
+}
+
+// CountMacroView records that the content of the specified macro was served.
+func (db *DB) CountMacroView(id int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.macros[id]; ok {
+		db.bumpStatsLocked(statsKey{"macro", id}, 1, 0)
+		if db.recentViews == nil {
+			db.recentViews = make(map[int]float64)
+		}
+		db.recentViews[id]++
+	}
+}
+
+// CountMacroRender records that a rendering of the specified macro was
+// generated. It also counts as a rendering of the macro's template.
+func (db *DB) CountMacroRender(id int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if m, ok := db.macros[id]; ok {
+		db.bumpStatsLocked(statsKey{"macro", id}, 0, 1)
+		db.bumpStatsLocked(statsKey{"template", m.TemplateID}, 0, 1)
+	}
+}
+
+// CountTemplateView records that the image of the specified template was
+// served.
+func (db *DB) CountTemplateView(id int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.templates[id]; ok {
+		db.bumpStatsLocked(statsKey{"template", id}, 1, 0)
+	}
+}
+
+// bumpStatsLocked adds the given numbers of views and renders to the counts
+// for key, and marks them to be written to the index.
+func (db *DB) bumpStatsLocked(key statsKey, views, renders int64) {
+	if db.stats == nil {
+		db.stats = make(map[statsKey]ContentStats)
+	}
+	cs := db.stats[key]
+	cs.Views += views
+	cs.Renders += renders
+	if views > 0 {
+		now := time.Now()
+		cs.trend = cs.trend*decay(now.Sub(cs.trendAt)) + float64(views)
+		cs.trendAt = now
+	}
+	db.stats[key] = cs
+	if db.statsDirty == nil {
+		db.statsDirty = make(map[statsKey]bool)
+	}
+	db.statsDirty[key] = true
+}
+
+// MacroStats returns the view and render counts for the specified macro.
+func (db *DB) MacroStats(id int) (ContentStats, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.macros[id]; !ok {
+		return ContentStats{}, fmt.Errorf("macro %d not found", id)
+	}
+	return db.stats[statsKey{"macro", id}], nil
+}
+
+// TemplateStats returns the view and render counts for the specified
+// template, including the views of the macros made from it.
+func (db *DB) TemplateStats(id int) (ContentStats, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.templates[id]; !ok {
+		return ContentStats{}, fmt.Errorf("template %d not found", id)
+	}
+	cs := db.stats[statsKey{"template", id}]
+	for _, m := range db.macros {
+		if m.TemplateID == id {
+			cs.MacroViews += db.stats[statsKey{"macro", m.ID}].Views
+		}
+	}
+	return cs, nil
+}
+
+// AllMacroStats returns the view and render counts of all the macros in the
+// store, by macro ID. Macros that have not been viewed or rendered since
+// counting began are not included.
+func (db *DB) AllMacroStats() map[int]ContentStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	out := make(map[int]ContentStats)
+	for key, cs := range db.stats {
+		if key.kind == "macro" {
+			out[key.id] = cs
+		}
+	}
+	return out
+}
+
+// AllTemplateStats returns the view and render counts of all the templates
+// in the store, by template ID, as for TemplateStats. Templates with nothing
+// counted for them or their macros are not included.
+func (db *DB) AllTemplateStats() map[int]ContentStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	out := make(map[int]ContentStats)
+	for key, cs := range db.stats {
+		if key.kind != "template" {
+			continue
+		}
+		ts := out[key.id]
+		ts.Views, ts.Renders = cs.Views, cs.Renders
+		out[key.id] = ts
+	}
+	for key, cs := range db.stats {
+		if m, ok := db.macros[key.id]; ok && key.kind == "macro" {
+			ts := out[m.TemplateID]
+			ts.MacroViews += cs.Views
+			out[m.TemplateID] = ts
+		}
+	}
+	return out
+}
+
+// TrendingViews returns the views of each macro in the store that has been
+// viewed, by macro ID, with each view weighted by how recent it is: a view
+// counts as 1 when it happens, and half as much after each TrendHalfLife.
+func (db *DB) TrendingViews() map[int]float64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now()
+	out := make(map[int]float64)
+	for key, cs := range db.stats {
+		if key.kind == "macro" && cs.trend > 0 {
+			out[key.id] = cs.trend * decay(now.Sub(cs.trendAt))
+		}
+	}
+	return out
+}
+
+// TrendingVotes returns the net votes on each macro in the store that has
+// votes, by macro ID, with each vote weighted by how recently it was cast as
+// for TrendingViews. Votes by the creator of a macro are left out if the
+// self-vote policy ignores them.
+func (db *DB) TrendingVotes() (map[int]float64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows, err := db.sqldb.Query(`SELECT user_id, macro_id, vote, last_update FROM Votes`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	now := time.Now()
+	out := make(map[int]float64)
+	for rows.Next() {
+		var uid tailcfg.UserID
+		var id, vote int
+		var when time.Time
+		if err := rows.Scan(&uid, &id, &vote, &when); err != nil {
+			return nil, err
+		}
+		m, ok := db.macros[id]
+		if !ok || (db.selfVotes == SelfVotesIgnore && uid == m.Creator) {
+			continue
+		}
+		out[id] += float64(vote) * decay(now.Sub(when))
+	}
+	return out, rows.Err()
+}
+
+// forgetStatsLocked discards the counts for the specified item.
+func (db *DB) forgetStatsLocked(kind string, id int) error {
+	key := statsKey{kind, id}
+	delete(db.stats, key)
+	delete(db.statsDirty, key)
+	if kind == "macro" {
+		delete(db.recentViews, id)
+	}
+	_, err := db.sqldb.Exec(`DELETE FROM ContentStats WHERE kind = ? AND id = ?`, kind, id)
+	return err
+}
+
+// loadStatsLocked reads the counts recorded in the index.
+func (db *DB) loadStatsLocked() error {
+	db.stats = make(map[statsKey]ContentStats)
+	rows, err := db.sqldb.Query(`SELECT kind, id, views, renders, trend, trend_at FROM ContentStats`)
+	if err != nil {
+		return fmt.Errorf("loading content stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key statsKey
+		var cs ContentStats
+		var trendAt int64
+		if err := rows.Scan(&key.kind, &key.id, &cs.Views, &cs.Renders, &cs.trend, &trendAt); err != nil {
+			return fmt.Errorf("scanning content stats: %w", err)
+		}
+		cs.trendAt = time.Unix(0, trendAt)
+		db.stats[key] = cs
+	}
+	return rows.Err()
+}
+
+// flushStatsLocked writes the counts changed since the last flush to the
+// index.
+func (db *DB) flushStatsLocked() {
+	if len(db.statsDirty) == 0 {
+		return
+	}
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		log.Printf("WARNING: recording content stats: %v (continuing)", err)
+		return
+	}
+	defer tx.Rollback()
+	for key := range db.statsDirty {
+		cs := db.stats[key]
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO ContentStats (kind, id, views, renders, trend, trend_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			key.kind, key.id, cs.Views, cs.Renders, cs.trend, cs.trendAt.UnixNano()); err != nil {
+			log.Printf("WARNING: recording content stats: %v (continuing)", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("WARNING: recording content stats: %v (continuing)", err)
+		return
+	}
+	clear(db.statsDirty)
+}
+
+// saveStats periodically writes changed counts to the index, and writes any
+// remaining ones when ctx ends. Counts taken since the last write are lost if
+// the process exits without closing the DB.
+func (db *DB) saveStats(ctx context.Context) {
+	const flushInterval = time.Minute // how often to write counts
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			db.mu.Lock()
+			db.flushStatsLocked()
+			db.mu.Unlock()
+			return
+		case <-t.C:
+			db.mu.Lock()
+			db.flushStatsLocked()
+			db.mu.Unlock()
+		}
+	}
+}
+
+// Cache retention by popularity.
+//
+// The cache cleaner scales the maximum access age of the renderings of each
+// macro by a weight: the renderings of the most popular macros are kept
+// longer, even if they have not been fetched lately, and those of macros no
+// one has looked at or voted for lately are removed sooner. Popularity is
+// the number of recent views of a macro, each counting for less as it ages,
+// plus its net votes. Recent views are kept only in memory, so until the
+// server has counted them for a full maximum access age, no macro is treated
+// as unpopular.
+const (
+	popularWeight   = 4   // for the most viewed quarter of macros
+	unpopularWeight = 0.5 // for macros with no recent views or net votes
+	viewsPerVote    = 5   // how many views a net vote counts as
+)
+
+// macroPopularityLocked returns the popularity of each macro, by ID, for the
+// cache cleaner. It reports false if recent views have not been counted for
+// long enough to treat macros as unpopular. Recent views lose half their
+// weight over each maximum access age.
+func (db *DB) macroPopularityLocked() (map[int]float64, bool) {
+	now := time.Now()
+	if db.recentDecayed.IsZero() {
+		db.recentDecayed = now
+	}
+	decay := math.Exp2(-float64(now.Sub(db.recentDecayed)) / float64(db.maxAccessAge))
+	db.recentDecayed = now
+	for id, v := range db.recentViews {
+		if v *= decay; v < 0.01 {
+			delete(db.recentViews, id)
+		} else {
+			db.recentViews[id] = v
+		}
+	}
+
+	if err := db.fillAllMacroVotesLocked(); err != nil {
+		log.Printf("WARNING: filling macro votes: %v (continuing)", err)
+	}
+	pop := make(map[int]float64, len(db.macros))
+	for id, m := range db.macros {
+		pop[id] = db.recentViews[id] + viewsPerVote*float64(m.Upvotes-m.Downvotes)
+	}
+	return pop, now.Sub(db.recentSince) >= db.maxAccessAge
+}
+
+// cacheWeight returns a function that reports the weight for the retention
+// of the renderings of a macro, given the popularity of each macro in pop. If
+// penalize is false, no macro gets less than the normal weight.
+func cacheWeight(pop map[int]float64, penalize bool) func(id int) float64 {
+	var scores []float64
+	for _, p := range pop {
+		if p > 0 {
+			scores = append(scores, p)
+		}
+	}
+	sort.Float64s(scores)
+	threshold := math.Inf(1)
+	if len(scores) > 0 {
+		threshold = scores[len(scores)*3/4]
+	}
+	return func(id int) float64 {
+		p := pop[id]
+		if p >= threshold {
+			return popularWeight
+		} else if p <= 0 && penalize {
+			return unpopularWeight
+		}
+		return 1
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tailscale/tmemes"
+)
+
+// AddSticker adds st to the database, with the image file read from data.
+// It reports an error if st.ID != 0, or updates st.ID and st.Path on success.
+// If set, fileExt is used as the filename extension for the image file.
+func (db *DB) AddSticker(st *tmemes.Sticker, fileExt string, data io.Reader) error {
+	if st.ID != 0 {
+		return errors.New("sticker ID must be zero")
+	}
+	if fileExt == "" {
+		fileExt = "png"
+	} else {
+		fileExt = strings.TrimPrefix(fileExt, ".")
+	}
+	if st.CreatedAt.IsZero() {
+		st.CreatedAt = time.Now().UTC()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.injectFault("AddSticker"); err != nil {
+		return err
+	}
+	var id int
+	if err := db.sqldb.QueryRow(`SELECT coalesce(max(id), 0) + 1 FROM Stickers`).Scan(&id); err != nil {
+		return err
+	}
+	relPath := filepath.Join("stickers", fmt.Sprintf("%d.%s", id, fileExt))
+	path := filepath.Join(db.dir, relPath)
+	f, err := db.CreateFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	} else if err := f.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	if db.backend != nil {
+		if err := db.putFile(context.Background(), path); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("store sticker: %w", err)
+		}
+	}
+	st.ID = id
+	st.Path = relPath // N.B. not path, the data may move
+	bits, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if _, err := db.sqldb.Exec(`INSERT INTO Stickers (id, raw) VALUES (?, ?)`, id, bits); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// Sticker returns the sticker with the specified ID.
+func (db *DB) Sticker(id int) (*tmemes.Sticker, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ss, err := queryRaw[tmemes.Sticker](db.sqldb, func(s *tmemes.Sticker, id int) { s.ID = id },
+		`SELECT id, raw FROM Stickers WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	} else if len(ss) == 0 {
+		return nil, fmt.Errorf("sticker %d not found", id)
+	}
+	return ss[0], nil
+}
+
+// Stickers returns all the stickers in the database, newest first.
+func (db *DB) Stickers() ([]*tmemes.Sticker, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return queryRaw[tmemes.Sticker](db.sqldb, func(s *tmemes.Sticker, id int) { s.ID = id },
+		`SELECT id, raw FROM Stickers ORDER BY id DESC`)
+}
+
+// StickerPath returns the path of the file containing a sticker image.
+func (db *DB) StickerPath(id int) (string, error) {
+	st, err := db.Sticker(id)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(db.dir, st.Path), nil
+}
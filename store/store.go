@@ -8,25 +8,35 @@
 // A DB manages a directory in the filesystem. At the top level of the
 // directory is a SQLite database (index.db) that keeps track of metadata about
 // templates, macros, and votes. There are also subdirectories to store the
-// image data, "templates" and "macros".
+// image data, "templates", "macros", and "thumbs".
 //
 // The "macros" subdirectory is a cache, and the DB maintains a background
 // polling thread that cleans up files that have not been accessed for a while.
 // It is safe to manually delete files inside the macros directory; the server
-// will re-create them on demand. Templates images are persistent, and should
-// not be modified or deleted.
+// will re-create them on demand. Each macro may have several renderings in
+// the cache, for caption variants, sizes, and formats (see CacheKey); those
+// other than the default expire sooner. The "thumbs" subdirectory is cleaned
+// up the same way, and holds resized renderings of macros and resized copies
+// of template images. Templates images are persistent, and should not be
+// modified or deleted.
 package store
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -36,7 +46,7 @@ import (
 	"tailscale.com/tailcfg"
 )
 
-var subdirs = []string{"templates", "macros"}
+var subdirs = []string{"templates", "macros", "thumbs", "stickers"}
 
 // A DB is a meme database. It consists of a directory containing files and
 // subdirectories holding images and metadata. A DB is safe for concurrent use
@@ -46,7 +56,14 @@ type DB struct {
 	stop          context.CancelFunc
 	tasks         sync.WaitGroup
 	minPruneBytes int64
+	maxCacheBytes int64
 	maxAccessAge  time.Duration
+	macroExt      string
+	faultRate     float64
+	backend       Backend
+	selfVotes     SelfVotePolicy
+	sealKey       []byte        // if set, the key for encrypting files at rest
+	pruneNow      chan struct{} // signals the cache cleaner to run early
 
 	mu             sync.Mutex
 	sqldb          *sql.DB
@@ -55,6 +72,18 @@ type DB struct {
 	nextMacroID    int
 	templates      map[int]*tmemes.Template
 	nextTemplateID int
+	prefs          map[tailcfg.UserID]*tmemes.UserPrefs
+	creatorNames   map[tailcfg.UserID]string
+	cacheStats     CacheStats
+	cacheBytes     int64                // size of the caches, as last known
+	cacheAccess    map[string]time.Time // uses not yet recorded, by relative path
+	stats          map[statsKey]ContentStats
+	statsDirty     map[statsKey]bool // stats not yet recorded
+	recentViews    map[int]float64   // decayed views by macro ID, for cache retention
+	recentSince    time.Time         // when counting of recent views began
+	recentDecayed  time.Time         // when recentViews were last decayed
+
+	events eventBus
 }
 
 // Options are optional settings for a DB.  A nil *Options is ready for use
@@ -67,8 +96,73 @@ type Options struct {
 	// When pruning the cache, discard entries that have not been accessed in at
 	// least this long. Default: 30m.
 	MaxAccessAge time.Duration
+
+	// If positive, the most bytes the macro and thumbnail caches may hold.
+	// When they hold more, the least recently used files are removed until
+	// they fit, without waiting for them to expire. Default: no limit.
+	MaxCacheBytes int64
+
+	// If non-empty, the file extension (e.g., ".webp") that determines the
+	// image format of generated macros. Default: the template's extension.
+	MacroExt string
+
+	// If positive, the fraction of updates that fail with ErrInjectedFault
+	// before changing anything, for resilience testing. Default: 0.
+	FaultRate float64
+
+	// If non-nil, the durable storage for template images, cached macros,
+	// and snapshots of the index (see [Backend]). Default: local disk only.
+	Backend Backend
+
+	// How votes by the creator of a macro on that macro are treated.
+	// Default: SelfVotesAllow.
+	SelfVotes SelfVotePolicy
+
+	// If set, the key (of EncryptionKeySize bytes) with which to encrypt the
+	// image files of the store at rest. Default: files are not encrypted.
+	EncryptionKey []byte
+}
+
+// A SelfVotePolicy determines how a DB treats votes by the creator of a macro
+// on their own macro. Since anonymous macros do not record their creator,
+// votes on them are always counted.
+type SelfVotePolicy string
+
+const (
+	SelfVotesAllow  SelfVotePolicy = "allow"  // counted like any other vote
+	SelfVotesDeny   SelfVotePolicy = "deny"   // rejected by SetVote
+	SelfVotesIgnore SelfVotePolicy = "ignore" // recorded, but not counted
+)
+
+// SelfVotes reports the self-vote policy of db.
+func (db *DB) SelfVotes() SelfVotePolicy { return db.selfVotes }
+
+// ErrSelfVote is reported by SetVote for a vote by the creator of a macro,
+// when self-votes are denied.
+var ErrSelfVote = errors.New("you cannot vote on your own macro")
+
+// ErrVotesFrozen is reported by SetVote for a macro whose votes an admin has
+// frozen.
+var ErrVotesFrozen = errors.New("votes on this macro are frozen")
+
+// ErrCaptionTestRunning is reported by EditMacro for a macro whose caption
+// test has not finished.
+var ErrCaptionTestRunning = errors.New("macro has an unfinished caption test")
+
+// A DuplicateTemplateError is reported by AddTemplate when the image of the
+// new template is identical to that of an existing (visible) template.
+type DuplicateTemplateError struct {
+	ID int // of the existing template
 }
 
+func (e *DuplicateTemplateError) Error() string {
+	return fmt.Sprintf("this image is already template %d", e.ID)
+}
+
+// ErrInjectedFault is the error reported by updates that fail due to fault
+// injection (see [Options]).
+var ErrInjectedFault = errors.New("injected store fault")
+
 func (o *Options) minPruneBytes() int64 {
 	if o == nil || o.MinPruneBytes <= 0 {
 		return 50 << 20
@@ -76,6 +170,48 @@ func (o *Options) minPruneBytes() int64 {
 	return o.MinPruneBytes
 }
 
+func (o *Options) maxCacheBytes() int64 {
+	if o == nil || o.MaxCacheBytes <= 0 {
+		return 0
+	}
+	return o.MaxCacheBytes
+}
+
+func (o *Options) macroExt() string {
+	if o == nil {
+		return ""
+	}
+	return o.MacroExt
+}
+
+func (o *Options) faultRate() float64 {
+	if o == nil {
+		return 0
+	}
+	return o.FaultRate
+}
+
+func (o *Options) backend() Backend {
+	if o == nil {
+		return nil
+	}
+	return o.Backend
+}
+
+func (o *Options) selfVotes() SelfVotePolicy {
+	if o == nil || o.SelfVotes == "" {
+		return SelfVotesAllow
+	}
+	return o.SelfVotes
+}
+
+func (o *Options) encryptionKey() []byte {
+	if o == nil {
+		return nil
+	}
+	return o.EncryptionKey
+}
+
 func (o *Options) maxAccessAge() time.Duration {
 	if o == nil || o.MaxAccessAge <= 0 {
 		return 30 * time.Minute
@@ -90,6 +226,17 @@ func (o *Options) maxAccessAge() time.Duration {
 // The caller should Close the DB when it is no longer in use, to ensure the
 // cache maintenance routine is stopped and cleaned up.
 func New(dirPath string, opts *Options) (*DB, error) {
+	switch p := opts.selfVotes(); p {
+	case SelfVotesAllow, SelfVotesDeny, SelfVotesIgnore:
+	default:
+		return nil, fmt.Errorf("store.New: invalid self-vote policy %q", p)
+	}
+	sealKey := opts.encryptionKey()
+	if sealKey != nil {
+		if err := checkEncryptionKey(sealKey); err != nil {
+			return nil, fmt.Errorf("store.New: %w", err)
+		}
+	}
 	if err := os.MkdirAll(dirPath, 0700); err != nil {
 		return nil, fmt.Errorf("store.New: %w", err)
 	}
@@ -103,6 +250,11 @@ func New(dirPath string, opts *Options) (*DB, error) {
 	}
 
 	dbPath := filepath.Join(dirPath, "index.db")
+	if b := opts.backend(); b != nil {
+		if err := restoreIndex(b, dbPath); err != nil {
+			return nil, fmt.Errorf("restore index: %w", err)
+		}
+	}
 	sqldb, err := openDatabase(dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite: %w", err)
@@ -112,7 +264,15 @@ func New(dirPath string, opts *Options) (*DB, error) {
 	db := &DB{
 		dir:           dirPath,
 		minPruneBytes: opts.minPruneBytes(),
+		maxCacheBytes: opts.maxCacheBytes(),
 		maxAccessAge:  opts.maxAccessAge(),
+		macroExt:      opts.macroExt(),
+		faultRate:     opts.faultRate(),
+		backend:       opts.backend(),
+		selfVotes:     opts.selfVotes(),
+		sealKey:       sealKey,
+		pruneNow:      make(chan struct{}, 1),
+		recentSince:   time.Now(),
 		stop:          cancel,
 		sqldb:         sqldb,
 	}
@@ -120,21 +280,52 @@ func New(dirPath string, opts *Options) (*DB, error) {
 		db.Close()
 		return nil, err
 	}
-	db.tasks.Add(1)
+	if db.backend != nil {
+		if err := db.restoreTemplates(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.tasks.Add(1)
+		go func() {
+			defer db.tasks.Done()
+			db.snapshotIndexes(ctx)
+		}()
+	}
+	if db.sealKey != nil {
+		if err := db.sealPlainFiles(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	db.tasks.Add(3)
 	go func() {
 		defer db.tasks.Done()
 		db.cleanMacroCache(ctx)
 	}()
+	go func() {
+		defer db.tasks.Done()
+		db.saveStats(ctx)
+	}()
+	go func() {
+		defer db.tasks.Done()
+		db.finishCaptionTests(ctx)
+	}()
 	return db, err
 }
 
-// Close stops background tasks and closes the index database.
+// Close stops background tasks and closes the index database. If the DB has a
+// backend, a final snapshot of the index is copied to it first.
 func (db *DB) Close() error {
 	db.stop()
 	db.tasks.Wait()
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if db.sqldb != nil {
+		if db.backend != nil {
+			if err := db.snapshotIndex(); err != nil {
+				log.Printf("WARNING: snapshotting index: %v", err)
+			}
+		}
 		err := db.sqldb.Close()
 		db.sqldb = nil
 		return err
@@ -160,6 +351,29 @@ func (db *DB) SetCacheSeed(s string) error {
 	return err
 }
 
+// GetMeta returns the value stored under key in the metadata table, or nil
+// if no value is stored for that key.
+func (db *DB) GetMeta(key string) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var value []byte
+	err := db.sqldb.QueryRow(`SELECT value FROM Meta WHERE key = ?`, key).Scan(&value)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return value, nil
+}
+
+// SetMeta stores value under key in the metadata table, replacing any value
+// previously stored for that key.
+func (db *DB) SetMeta(key string, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, err := db.sqldb.Exec(`INSERT OR REPLACE INTO Meta (key, value) VALUES (?,?)`,
+		key, value)
+	return err
+}
+
 // Templates returns all the non-hidden templates in the store.
 // Templates are ordered non-decreasing by ID.
 func (db *DB) Templates() []*tmemes.Template {
@@ -177,6 +391,18 @@ func (db *DB) Templates() []*tmemes.Template {
 	return all
 }
 
+// AllTemplates returns all the templates in the store, including hidden ones.
+// Templates are ordered non-decreasing by ID.
+func (db *DB) AllTemplates() []*tmemes.Template {
+	db.mu.Lock()
+	all := maps.Values(db.templates)
+	db.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ID < all[j].ID
+	})
+	return all
+}
+
 // TemplatesByCreator returns all the non-hidden templates in the store created
 // by the specified user. The results are ordered non-decreasing by ID.
 func (db *DB) TemplatesByCreator(creator tailcfg.UserID) []*tmemes.Template {
@@ -234,6 +460,187 @@ func (db *DB) SetTemplateHidden(id int, hidden bool) error {
 	return nil
 }
 
+// SetTemplateAreas replaces the predefined text areas of a template.
+func (db *DB) SetTemplateAreas(id int, areas []tmemes.Area) (*tmemes.Template, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.templates[id]
+	if !ok {
+		return nil, fmt.Errorf("template %d not found", id)
+	}
+	saved := t.Areas
+	t.Areas = areas
+	if err := db.updateTemplateLocked(t); err != nil {
+		t.Areas = saved
+		return nil, err
+	}
+	return t, nil
+}
+
+// SetTemplateCreator changes the creator of a template to the specified
+// user, and returns the updated template.
+func (db *DB) SetTemplateCreator(id int, creator tailcfg.UserID) (*tmemes.Template, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.templates[id]
+	if !ok {
+		return nil, fmt.Errorf("template %d not found", id)
+	}
+	saved := t.Creator
+	t.Creator = creator
+	if err := db.updateTemplateLocked(t); err != nil {
+		t.Creator = saved
+		return nil, err
+	}
+	return t, nil
+}
+
+// A TemplateEdit describes changes to the descriptive fields of a template.
+// Fields that are nil are left unchanged.
+type TemplateEdit struct {
+	Name        *string
+	Description *string
+	Areas       *[]tmemes.Area
+	Category    *string // the name of a category, or "" for none
+}
+
+// EditTemplate applies ed to the visible template id, and returns the updated
+// template. A new name is normalized as by AddTemplate, and must not be the
+// name of another visible template. Either all the changes are made, or none.
+func (db *DB) EditTemplate(id int, ed TemplateEdit) (*tmemes.Template, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.templates[id]
+	if !ok || t.Hidden {
+		return nil, fmt.Errorf("template %d not found", id)
+	}
+	cp := *t
+	if ed.Name != nil {
+		cp.Name = canonicalTemplateName(*ed.Name)
+		if cp.Name == "" {
+			return nil, errors.New("empty template name")
+		}
+		for _, o := range db.templates {
+			if o.ID != id && !o.Hidden && o.Name == cp.Name {
+				return nil, fmt.Errorf("duplicate template name %q", cp.Name)
+			}
+		}
+	}
+	if ed.Description != nil {
+		cp.Description = *ed.Description
+	}
+	if ed.Areas != nil {
+		cp.Areas = *ed.Areas
+	}
+	if ed.Category != nil {
+		cp.Category = ""
+		if *ed.Category != "" {
+			c, err := db.categoryLocked(*ed.Category)
+			if err != nil {
+				return nil, err
+			}
+			cp.Category = c.Name
+		}
+	}
+	if err := db.updateTemplateLocked(&cp); err != nil {
+		return nil, err
+	}
+	*t = cp
+	return t, nil
+}
+
+// SetTemplateNSFW sets (or clears) the "NSFW" flag of a template. It returns
+// the updated template.
+func (db *DB) SetTemplateNSFW(id int, nsfw bool) (*tmemes.Template, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.templates[id]
+	if !ok {
+		return nil, fmt.Errorf("template %d not found", id)
+	}
+	if t.NSFW != nsfw {
+		t.NSFW = nsfw
+		if err := db.updateTemplateLocked(t); err != nil {
+			t.NSFW = !nsfw
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// SetTemplateImageHash records the perceptual hash of a template image.
+func (db *DB) SetTemplateImageHash(id int, hash uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.templates[id]
+	if !ok {
+		return fmt.Errorf("template %d not found", id)
+	}
+	if t.ImageHash != hash {
+		t.ImageHash = hash
+		return db.updateTemplateLocked(t)
+	}
+	return nil
+}
+
+// SetTemplateDamaged sets (or clears) the "damaged" flag of a template. It
+// reports whether the flag was changed.
+func (db *DB) SetTemplateDamaged(id int, damaged bool) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.templates[id]
+	if !ok {
+		return false, fmt.Errorf("template %d not found", id)
+	}
+	if t.Damaged == damaged {
+		return false, nil
+	}
+	t.Damaged = damaged
+	if err := db.updateTemplateLocked(t); err != nil {
+		t.Damaged = !damaged
+		return false, err
+	}
+	return true, nil
+}
+
+// SetTemplateContentHash records the SHA-256 digest of a template image.
+func (db *DB) SetTemplateContentHash(id int, hash string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.templates[id]
+	if !ok {
+		return fmt.Errorf("template %d not found", id)
+	}
+	if t.ContentHash != hash {
+		t.ContentHash = hash
+		return db.updateTemplateLocked(t)
+	}
+	return nil
+}
+
+// TemplateByContentHash returns the visible template whose image has the given
+// SHA-256 digest (hex), if there is one.
+func (db *DB) TemplateByContentHash(hash string) (*tmemes.Template, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if t := db.templateByContentHashLocked(hash); t != nil {
+		return t, nil
+	}
+	return nil, fmt.Errorf("no template with content hash %q", hash)
+}
+
+func (db *DB) templateByContentHashLocked(hash string) *tmemes.Template {
+	if hash == "" {
+		return nil
+	}
+	for _, t := range db.templates {
+		if !t.Hidden && t.ContentHash == hash {
+			return t
+		}
+	}
+	return nil
+}
+
 var sep = strings.NewReplacer(" ", "-", "_", "-")
 
 func canonicalTemplateName(name string) string {
@@ -274,6 +681,21 @@ func (db *DB) TemplatePath(id int) (string, error) {
 	return filepath.Join(db.dir, t.Path), nil
 }
 
+// TemplateAudioPath returns the path of the sound clip for the specified
+// audio template ID. It reports an error if the template is not an audio
+// template.
+func (db *DB) TemplateAudioPath(id int) (string, error) {
+	db.mu.Lock()
+	t, ok := db.templates[id]
+	db.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("template %d not found", id)
+	} else if t.Audio == "" {
+		return "", fmt.Errorf("template %d has no audio", id)
+	}
+	return filepath.Join(db.dir, t.Audio), nil
+}
+
 // Macro returns the macro data for the specified ID.
 func (db *DB) Macro(id int) (*tmemes.Macro, error) {
 	db.mu.Lock()
@@ -285,7 +707,8 @@ func (db *DB) Macro(id int) (*tmemes.Macro, error) {
 	return m, nil
 }
 
-// MacrosByCreator returns all the macros created by the specified user.
+// MacrosByCreator returns all the visible macros created by the specified
+// user.
 func (db *DB) MacrosByCreator(creator tailcfg.UserID) []*tmemes.Macro {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -294,7 +717,7 @@ func (db *DB) MacrosByCreator(creator tailcfg.UserID) []*tmemes.Macro {
 	}
 	var all []*tmemes.Macro
 	for _, m := range db.macros {
-		if m.Creator == creator {
+		if m.Creator == creator && !m.Hidden {
 			all = append(all, m)
 		}
 	}
@@ -304,8 +727,37 @@ func (db *DB) MacrosByCreator(creator tailcfg.UserID) []*tmemes.Macro {
 	return all
 }
 
-// Macros returns all the macros in the store.
+// Karma returns the karma of each user who has created visible macros: the
+// sum of the upvotes minus the downvotes of those macros.
+func (db *DB) Karma() map[tailcfg.UserID]int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.fillAllMacroVotesLocked(); err != nil {
+		log.Printf("WARNING: filling macro votes: %v (continuing)", err)
+	}
+	karma := make(map[tailcfg.UserID]int)
+	for _, m := range db.macros {
+		if m.Creator > 0 && !m.Hidden {
+			karma[m.Creator] += m.Upvotes - m.Downvotes
+		}
+	}
+	return karma
+}
+
+// Macros returns all the visible macros in the store.
 func (db *DB) Macros() []*tmemes.Macro {
+	all := db.AllMacros()
+	vis := all[:0]
+	for _, m := range all {
+		if !m.Hidden {
+			vis = append(vis, m)
+		}
+	}
+	return vis
+}
+
+// AllMacros returns all the macros in the store, including hidden ones.
+func (db *DB) AllMacros() []*tmemes.Macro {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	if err := db.fillAllMacroVotesLocked(); err != nil {
@@ -328,54 +780,557 @@ func (db *DB) CachePath(m *tmemes.Macro) (string, error) {
 	return db.cachePath(m, t), nil
 }
 
+// VariantCachePath returns a cache file path for the specified caption
+// variant of a macro (see tmemes.CaptionTest). Variant 0 is the same as the
+// path reported by CachePath. The path is returned even if the file is not
+// cached.
+func (db *DB) VariantCachePath(m *tmemes.Macro, variant int) (string, error) {
+	return db.MacroCachePath(m, CacheKey{Variant: variant})
+}
+
+// A CacheKey identifies one of the renderings of a macro that may be cached.
+// The zero key is the default rendering: the macro's own caption at full size,
+// in the format reported by MacroExt.
+//
+// Renderings with a maximum width or height are kept in the "thumbs"
+// subdirectory rather than with the full-size renderings.
+type CacheKey struct {
+	Variant int    // caption variant (see tmemes.CaptionTest), 0 for the default
+	Width   int    // maximum width in pixels, 0 for full size
+	Height  int    // maximum height in pixels, 0 for full size
+	Ext     string // file extension including ".", "" for the default
+
+	// Encoder settings other than the server's, as a label of lowercase
+	// letters and digits chosen by the caller, or "" for the server's.
+	Encoding string
+}
+
+// MacroCachePath returns the cache file path for the rendering of m selected
+// by key. The path is returned even if the file is not cached.
+func (db *DB) MacroCachePath(m *tmemes.Macro, key CacheKey) (string, error) {
+	t, err := db.AnyTemplate(m.TemplateID)
+	if err != nil {
+		return "", err
+	}
+	return db.keyCachePath(m.ID, t, key), nil
+}
+
+// MacroExt returns the file extension, including the leading ".", of
+// generated macros based on template t. This governs their image format.
+func (db *DB) MacroExt(t *tmemes.Template) string {
+	if db.macroExt != "" {
+		return db.macroExt
+	}
+	return filepath.Ext(t.Path)
+}
+
 func (db *DB) cachePath(m *tmemes.Macro, t *tmemes.Template) string {
-	key := string(db.cacheSeed)
-	if key == "" {
-		key = "0000"
+	return db.keyCachePath(m.ID, t, CacheKey{})
+}
+
+func (db *DB) cachePrefix() string {
+	if len(db.cacheSeed) == 0 {
+		return "0000"
 	}
-	name := fmt.Sprintf("%s-%d%s", key, m.ID, filepath.Ext(t.Path))
-	return filepath.Join(db.dir, "macros", name)
+	return string(db.cacheSeed)
 }
 
-// AddMacro adds m to the database. It reports an error if m.ID != 0, or
-// updates m.ID on success.
-func (db *DB) AddMacro(m *tmemes.Macro) error {
-	if m.ID != 0 {
-		return errors.New("macro ID must be zero")
-	} else if m.TemplateID == 0 {
-		return errors.New("macro must have a template ID")
-	} else if m.TextOverlay == nil {
-		return errors.New("macro must have an overlay")
+func (db *DB) keyCachePath(id int, t *tmemes.Template, key CacheKey) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s-%d", db.cachePrefix(), id)
+	if key.Variant > 0 {
+		fmt.Fprintf(&sb, "-v%d", key.Variant)
 	}
-	if m.CreatedAt.IsZero() {
-		m.CreatedAt = time.Now().UTC()
+	if key.Width > 0 {
+		fmt.Fprintf(&sb, "-w%d", key.Width)
 	}
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	if _, ok := db.templates[m.TemplateID]; !ok {
-		return fmt.Errorf("template %d not found", m.TemplateID)
+	if key.Height > 0 {
+		fmt.Fprintf(&sb, "-h%d", key.Height)
 	}
-	m.ID = db.nextMacroID
-	m.CreatedAt = time.Now().UTC()
-	db.nextMacroID++
-	db.macros[m.ID] = m
-	return db.updateMacroLocked(m)
+	if key.Encoding != "" {
+		fmt.Fprintf(&sb, "-e%s", key.Encoding)
+	}
+	if key.Ext != "" {
+		sb.WriteString(key.Ext)
+	} else {
+		sb.WriteString(db.MacroExt(t))
+	}
+	dir := "macros"
+	if key.Width > 0 || key.Height > 0 {
+		dir = "thumbs"
+	}
+	return filepath.Join(db.dir, dir, sb.String())
 }
 
-// DeleteMacro deletes the specified macro ID from the database.
-func (db *DB) DeleteMacro(id int) error {
+// CacheStats summarizes the contents of the macro cache.
+type CacheStats struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+
+	// Usage by kind of rendering: "default", "caption", "size", "format", and
+	// "stale". Template thumbnails count as "size". A rendering that differs from the default in several ways is
+	// counted once, under the first of those kinds in that order.
+	Kinds map[string]CacheUsage `json:"kinds"`
+
+	// When the cache was last scanned.
+	Scanned time.Time `json:"scanned"`
+
+	// The size cap of the cache in bytes (see Options), or 0 if none.
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// CacheUsage is the number and total size of some files in the macro cache.
+type CacheUsage struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (c *CacheStats) add(kind string, files, bytes int64) {
+	u := c.Kinds[kind]
+	u.Files += files
+	u.Bytes += bytes
+	c.Kinds[kind] = u
+	c.Files += files
+	c.Bytes += bytes
+}
+
+// TouchCached records that the cached rendering at path was just used, so
+// that the cache cleaner keeps the most recently used files. It does nothing
+// for paths outside the macro and thumbnail caches.
+func (db *DB) TouchCached(path string) {
+	rel := db.relPath(path)
+	if !isCachePath(rel) {
+		return
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	m, ok := db.macros[id]
-	if !ok {
-		return fmt.Errorf("macro %d not found", id)
+	if db.cacheAccess == nil {
+		db.cacheAccess = make(map[string]time.Time)
 	}
-	if t, ok := db.templates[m.TemplateID]; ok {
-		os.Remove(db.cachePath(m, t))
+	db.cacheAccess[rel] = time.Now()
+}
+
+// AddCached records that a cached rendering was just written at path, as for
+// TouchCached. If this puts the caches over their size cap (see Options), the
+// cache cleaner runs right away, rather than at its next scheduled scan.
+func (db *DB) AddCached(path string) {
+	fi, err := os.Stat(path)
+	if err != nil || !isCachePath(db.relPath(path)) {
+		return
 	}
+	db.TouchCached(path)
+	db.mu.Lock()
+	db.cacheBytes += fi.Size()
+	over := db.maxCacheBytes > 0 && db.cacheBytes > db.maxCacheBytes
+	db.mu.Unlock()
+	if over {
+		select {
+		case db.pruneNow <- struct{}{}:
+		default: // already signaled
+		}
+	}
+}
+
+// isCachePath reports whether rel, relative to the store directory, is in the
+// macro or thumbnail cache.
+func isCachePath(rel string) bool {
+	dir, _, ok := strings.Cut(filepath.ToSlash(rel), "/")
+	return ok && (dir == "macros" || dir == "thumbs")
+}
+
+// flushCacheAccessLocked records the uses noted by TouchCached in the index.
+func (db *DB) flushCacheAccessLocked() {
+	if len(db.cacheAccess) == 0 {
+		return
+	}
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		log.Printf("WARNING: recording cache use: %v (continuing)", err)
+		return
+	}
+	defer tx.Rollback()
+	for rel, t := range db.cacheAccess {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO CacheAccess (path, accessed) VALUES (?, ?)`,
+			rel, t.UnixNano()); err != nil {
+			log.Printf("WARNING: recording cache use: %v (continuing)", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("WARNING: recording cache use: %v (continuing)", err)
+		return
+	}
+	clear(db.cacheAccess)
+}
+
+// cacheAccessLocked returns the recorded last uses of cached files, by path
+// relative to the store directory.
+func (db *DB) cacheAccessLocked() map[string]time.Time {
+	out := make(map[string]time.Time)
+	rows, err := db.sqldb.Query(`SELECT path, accessed FROM CacheAccess`)
+	if err != nil {
+		log.Printf("WARNING: reading cache use: %v (continuing)", err)
+		return out
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rel string
+		var ns int64
+		if err := rows.Scan(&rel, &ns); err != nil {
+			log.Printf("WARNING: reading cache use: %v (continuing)", err)
+			return out
+		}
+		out[rel] = time.Unix(0, ns)
+	}
+	return out
+}
+
+// forgetCacheAccessLocked discards the recorded uses in used of files that
+// are not present, by path relative to the store directory.
+func (db *DB) forgetCacheAccessLocked(used map[string]time.Time, present map[string]bool) {
+	for rel := range used {
+		if present[rel] || db.cacheAccess[rel] != (time.Time{}) {
+			continue
+		}
+		if _, err := db.sqldb.Exec(`DELETE FROM CacheAccess WHERE path = ?`, rel); err != nil {
+			log.Printf("WARNING: forgetting cache use of %q: %v (continuing)", rel, err)
+			return
+		}
+	}
+}
+
+// CacheStats reports the contents of the macro cache as of the most recent
+// scan by the cache cleaner, less any files it then removed. Until the first
+// scan, it reports an empty cache.
+func (db *DB) CacheStats() CacheStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	out := db.cacheStats
+	out.Kinds = maps.Clone(out.Kinds)
+	return out
+}
+
+// parseCacheName parses the name of a file in the macro cache, as generated
+// by keyCachePath, into the seed, macro ID, and key. The Ext of the key is
+// always populated. It reports false if name is not in that form.
+func parseCacheName(name string) (seed string, id int, key CacheKey, ok bool) {
+	key.Ext = filepath.Ext(name)
+	parts := strings.Split(strings.TrimSuffix(name, key.Ext), "-")
+	if last := parts[len(parts)-1]; len(parts) > 2 && len(last) > 1 && last[0] == 'e' && isEncodingLabel(last[1:]) {
+		key.Encoding = last[1:]
+		parts = parts[:len(parts)-1]
+	}
+	for len(parts) > 2 {
+		last := parts[len(parts)-1]
+		if len(last) < 2 {
+			break
+		}
+		n, err := strconv.Atoi(last[1:])
+		if err != nil || n <= 0 {
+			break
+		} else if last[0] == 'h' && key.Height == 0 && key.Width == 0 && key.Variant == 0 {
+			key.Height = n
+		} else if last[0] == 'w' && key.Width == 0 && key.Variant == 0 {
+			key.Width = n
+		} else if last[0] == 'v' && key.Variant == 0 {
+			key.Variant = n
+		} else {
+			break
+		}
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) < 2 {
+		return "", 0, key, false
+	}
+	id, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil || id <= 0 {
+		return "", 0, key, false
+	}
+	return strings.Join(parts[:len(parts)-1], "-"), id, key, true
+}
+
+// isEncodingLabel reports whether s is a valid CacheKey.Encoding.
+func isEncodingLabel(s string) bool {
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// TemplateThumbPath returns the path of the cached thumbnail of template t
+// that fits within the given width and height in pixels; either may be 0 to
+// leave it unconstrained. The path is returned even if the file is not cached.
+// Since thumbnails are keyed by the content of the template image, it reports
+// an error if t has no recorded content hash.
+func (db *DB) TemplateThumbPath(t *tmemes.Template, width, height int) (string, error) {
+	if t.ContentHash == "" {
+		return "", fmt.Errorf("template %d has no content hash", t.ID)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "t-%s", t.ContentHash)
+	if width > 0 {
+		fmt.Fprintf(&sb, "-w%d", width)
+	}
+	if height > 0 {
+		fmt.Fprintf(&sb, "-h%d", height)
+	}
+	sb.WriteString(filepath.Ext(t.Path))
+	return filepath.Join(db.dir, "thumbs", sb.String()), nil
+}
+
+// parseTemplateThumbName parses the name of a template thumbnail file as
+// generated by TemplateThumbPath, and returns the content hash of its
+// template.
+func parseTemplateThumbName(name string) (hash string, ok bool) {
+	rest, ok := strings.CutPrefix(name, "t-")
+	if !ok {
+		return "", false
+	}
+	hash, _, _ = strings.Cut(strings.TrimSuffix(rest, filepath.Ext(rest)), "-")
+	return hash, len(hash) == 2*sha256.Size
+}
+
+// DiscardCached removes all cached renderings of the macro with the given ID,
+// so that they are generated again when next requested.
+func (db *DB) DiscardCached(id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	m, ok := db.macros[id]
+	if !ok {
+		return fmt.Errorf("macro %d not found", id)
+	}
+	db.removeCachedLocked(m)
+	return nil
+}
+
+// removeCachedLocked removes all cached renderings of m, including its caption
+// variants and other sizes and formats.
+func (db *DB) removeCachedLocked(m *tmemes.Macro) {
+	seed := db.cachePrefix()
+	for _, sub := range []string{"macros", "thumbs"} {
+		cacheDir := filepath.Join(db.dir, sub)
+		es, err := os.ReadDir(cacheDir)
+		if err != nil {
+			continue
+		}
+		for _, e := range es {
+			if s, id, _, ok := parseCacheName(e.Name()); ok && s == seed && id == m.ID {
+				os.Remove(filepath.Join(cacheDir, e.Name()))
+			}
+		}
+	}
+	if db.backend != nil {
+		db.removeBackendCachedLocked(m.ID)
+	}
+}
+
+// injectFault reports ErrInjectedFault at the configured fault rate, and
+// otherwise nil.
+func (db *DB) injectFault(op string) error {
+	if db.faultRate > 0 && rand.Float64() < db.faultRate {
+		log.Printf("[chaos] injecting store fault in %s", op)
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+// AddMacro adds m to the database. It reports an error if m.ID != 0, or
+// updates m.ID on success.
+func (db *DB) AddMacro(m *tmemes.Macro) error {
+	if err := checkNewMacro(m); err != nil {
+		return err
+	}
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now().UTC()
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.injectFault("AddMacro"); err != nil {
+		return err
+	}
+	t, ok := db.templates[m.TemplateID]
+	if !ok {
+		return fmt.Errorf("template %d not found", m.TemplateID)
+	}
+	m.ID = db.nextMacroID
+	m.CreatedAt = time.Now().UTC()
+	db.nextMacroID++
+	db.macros[m.ID] = m
+	t.MacroCount++
+	if err := db.updateMacroLocked(m); err != nil {
+		return err
+	}
+	mc := *m // the caller may modify m after we return
+	db.events.publish(tmemes.Event{Type: "create", MacroID: m.ID, Macro: &mc})
+	return nil
+}
+
+// checkNewMacro reports whether m has the fields required to add it to the
+// database.
+func checkNewMacro(m *tmemes.Macro) error {
+	if m.ID != 0 {
+		return errors.New("macro ID must be zero")
+	} else if m.TemplateID == 0 {
+		return errors.New("macro must have a template ID")
+	} else if m.TextOverlay == nil {
+		return errors.New("macro must have an overlay")
+	}
+	return nil
+}
+
+// AddMacros adds all of ms to the database in a single transaction, so that
+// either all of them are added or none are. On success, it updates the ID of
+// each macro, as AddMacro does.
+func (db *DB) AddMacros(ms []*tmemes.Macro) error {
+	for i, m := range ms {
+		if err := checkNewMacro(m); err != nil {
+			return fmt.Errorf("macro %d: %w", i, err)
+		}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.injectFault("AddMacros"); err != nil {
+		return err
+	}
+	for i, m := range ms {
+		if _, ok := db.templates[m.TemplateID]; !ok {
+			return fmt.Errorf("macro %d: template %d not found", i, m.TemplateID)
+		}
+	}
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	for i, m := range ms {
+		m.ID = db.nextMacroID + i
+		m.CreatedAt = now
+		if err := db.writeMacroLocked(tx, m); err != nil {
+			for _, m := range ms {
+				m.ID = 0
+			}
+			return fmt.Errorf("macro %d: %w", i, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		for _, m := range ms {
+			m.ID = 0
+		}
+		return err
+	}
+	db.nextMacroID += len(ms)
+	for _, m := range ms {
+		db.macros[m.ID] = m
+		db.templates[m.TemplateID].MacroCount++
+		mc := *m // the caller may modify m after we return
+		db.events.publish(tmemes.Event{Type: "create", MacroID: m.ID, Macro: &mc})
+	}
+	return nil
+}
+
+// DeleteMacro deletes the specified macro ID from the database.
+func (db *DB) DeleteMacro(id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.injectFault("DeleteMacro"); err != nil {
+		return err
+	}
+	m, ok := db.macros[id]
+	if !ok {
+		return fmt.Errorf("macro %d not found", id)
+	}
+	db.removeCachedLocked(m)
 	delete(db.macros, id)
-	_, err := db.sqldb.Exec(`DELETE FROM Macros WHERE id = ?`, id)
-	return err
+	if t, ok := db.templates[m.TemplateID]; ok {
+		t.MacroCount--
+	}
+	if _, err := db.sqldb.Exec(`DELETE FROM Macros WHERE id = ?`, id); err != nil {
+		return err
+	}
+	if err := db.forgetStatsLocked("macro", id); err != nil {
+		return err
+	}
+	db.events.publish(tmemes.Event{Type: "delete", MacroID: id})
+	return db.unindexItemLocked(db.sqldb, "macro", id)
+}
+
+// EditMacro replaces the text overlay of macro id, increments its revision,
+// and discards any cached renderings of it. Macros whose caption test has not
+// yet finished cannot be edited. It returns the updated macro.
+func (db *DB) EditMacro(id int, overlay []tmemes.TextLine) (*tmemes.Macro, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.injectFault("EditMacro"); err != nil {
+		return nil, err
+	}
+	m, ok := db.macros[id]
+	if !ok {
+		return nil, fmt.Errorf("macro %d not found", id)
+	} else if ct := m.CaptionTest; ct != nil && !ct.Done {
+		return nil, ErrCaptionTestRunning
+	}
+	saved, rev := m.TextOverlay, m.Revision
+	m.TextOverlay = overlay
+	m.Revision++
+	if err := db.updateMacroLocked(m); err != nil {
+		m.TextOverlay, m.Revision = saved, rev
+		return nil, err
+	}
+	db.removeCachedLocked(m)
+	return m, nil
+}
+
+// SetMacroHidden sets (or clears) the "hidden" flag of a macro. Hidden macros
+// are omitted from Macros, MacrosByCreator, and search results, but can still
+// be fetched by ID. It returns the updated macro.
+func (db *DB) SetMacroHidden(id int, hidden bool) (*tmemes.Macro, error) {
+	return db.setMacroFlag(id, hidden, func(m *tmemes.Macro) *bool { return &m.Hidden })
+}
+
+// SetMacroLocked sets (or clears) the "locked" flag of a macro. It returns
+// the updated macro.
+func (db *DB) SetMacroLocked(id int, locked bool) (*tmemes.Macro, error) {
+	return db.setMacroFlag(id, locked, func(m *tmemes.Macro) *bool { return &m.Locked })
+}
+
+// SetMacroVotesFrozen sets (or clears) the "votes frozen" flag of a macro.
+// While it is set, SetVote reports ErrVotesFrozen for the macro. It returns
+// the updated macro.
+func (db *DB) SetMacroVotesFrozen(id int, frozen bool) (*tmemes.Macro, error) {
+	return db.setMacroFlag(id, frozen, func(m *tmemes.Macro) *bool { return &m.VotesFrozen })
+}
+
+// SetMacroPublic sets (or clears) the "public" flag of a macro. It returns
+// the updated macro.
+func (db *DB) SetMacroPublic(id int, public bool) (*tmemes.Macro, error) {
+	return db.setMacroFlag(id, public, func(m *tmemes.Macro) *bool { return &m.Public })
+}
+
+// SetMacroNSFW sets (or clears) the "NSFW" flag of a macro. It returns the
+// updated macro.
+func (db *DB) SetMacroNSFW(id int, nsfw bool) (*tmemes.Macro, error) {
+	return db.setMacroFlag(id, nsfw, func(m *tmemes.Macro) *bool { return &m.NSFW })
+}
+
+// setMacroFlag sets the flag of macro id selected by field to on.
+func (db *DB) setMacroFlag(id int, on bool, field func(*tmemes.Macro) *bool) (*tmemes.Macro, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	m, ok := db.macros[id]
+	if !ok {
+		return nil, fmt.Errorf("macro %d not found", id)
+	}
+	if f := field(m); *f != on {
+		*f = on
+		if err := db.updateMacroLocked(m); err != nil {
+			*f = !on
+			return nil, err
+		}
+	}
+	return m, nil
 }
 
 // UpdateMacro updates macro m. It reports an error if m is not already in the
@@ -383,6 +1338,9 @@ func (db *DB) DeleteMacro(id int) error {
 func (db *DB) UpdateMacro(m *tmemes.Macro) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if err := db.injectFault("UpdateMacro"); err != nil {
+		return err
+	}
 	if _, ok := db.macros[m.ID]; !ok {
 		return fmt.Errorf("macro %d not found", m.ID)
 	}
@@ -394,7 +1352,9 @@ func (db *DB) UpdateMacro(m *tmemes.Macro) error {
 // should be initialized by the caller.
 //
 // If set, fileExt is used as the filename extension for the image file. The
-// contents of the template image are fully read from r.
+// contents of the template image are fully read from r. If they are identical
+// to the image of an existing visible template, AddTemplate reports a
+// *DuplicateTemplateError and does not add t.
 func (db *DB) AddTemplate(t *tmemes.Template, fileExt string, data io.Reader) error {
 	if t.ID != 0 {
 		return errors.New("template ID must be zero")
@@ -416,27 +1376,158 @@ func (db *DB) AddTemplate(t *tmemes.Template, fileExt string, data io.Reader) er
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if err := db.injectFault("AddTemplate"); err != nil {
+		return err
+	}
 	id := db.nextTemplateID
 	relPath := filepath.Join("templates", fmt.Sprintf("%d.%s", id, fileExt))
 	path := filepath.Join(db.dir, relPath)
-	f, err := os.Create(path)
+	f, err := db.CreateFile(path)
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(f, data); err != nil {
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), data); err != nil {
 		f.Close()
+		os.Remove(path)
 		return err
 	}
 	if err := f.Close(); err != nil {
 		return err
 	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if dup := db.templateByContentHashLocked(sum); dup != nil {
+		os.Remove(path)
+		return &DuplicateTemplateError{ID: dup.ID}
+	}
+	if db.backend != nil {
+		if err := db.putFile(context.Background(), path); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("store template: %w", err)
+		}
+	}
 	t.ID = id
 	t.Path = relPath // N.B. not path, the data may move
+	t.ContentHash = sum
 	db.nextTemplateID++
 	db.templates[t.ID] = t
 	return db.updateTemplateLocked(t)
 }
 
+// ReplaceTemplateImage replaces the image file of the template with the ID of
+// t with the contents of data, keeping its ID, and clears its "damaged" flag.
+// The dimensions and image hash of the stored template are copied from t. If
+// set, fileExt is the filename extension for the new image file. Cached
+// renderings of macros made from the template are discarded.
+func (db *DB) ReplaceTemplateImage(t *tmemes.Template, fileExt string, data io.Reader) error {
+	if fileExt == "" {
+		fileExt = "png"
+	} else {
+		fileExt = strings.TrimPrefix(fileExt, ".")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	old, ok := db.templates[t.ID]
+	if !ok {
+		return fmt.Errorf("template %d not found", t.ID)
+	}
+	relPath := filepath.Join("templates", fmt.Sprintf("%d.%s", t.ID, fileExt))
+	if relPath == old.Audio {
+		return errors.New("image file extension conflicts with the audio")
+	}
+	path := filepath.Join(db.dir, relPath)
+	tmp := path + ".new"
+	f, err := db.createFileAs(tmp, path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // in case of error
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if db.backend != nil {
+		if err := db.putFile(context.Background(), path); err != nil {
+			return fmt.Errorf("store template: %w", err)
+		}
+	}
+	if relPath != old.Path {
+		os.Remove(filepath.Join(db.dir, old.Path))
+	}
+
+	nt := *old
+	nt.Path = relPath
+	nt.Width, nt.Height, nt.ImageHash = t.Width, t.Height, t.ImageHash
+	nt.ContentHash = hex.EncodeToString(h.Sum(nil))
+	nt.Damaged = false
+	if err := db.updateTemplateLocked(&nt); err != nil {
+		return err
+	}
+	*old = nt
+	for _, m := range db.macros {
+		if m.TemplateID == t.ID {
+			db.removeCachedLocked(m)
+		}
+	}
+	return nil
+}
+
+// SetTemplateAudio stores the sound clip for the template with the given ID
+// from data, making it an audio template. The clip is stored alongside the
+// template image, with the given file extension.
+func (db *DB) SetTemplateAudio(id int, fileExt string, data io.Reader) error {
+	fileExt = strings.TrimPrefix(fileExt, ".")
+	if fileExt == "" {
+		return errors.New("missing audio file extension")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t, ok := db.templates[id]
+	if !ok {
+		return fmt.Errorf("template %d not found", id)
+	} else if t.Audio != "" {
+		return fmt.Errorf("template %d already has audio", id)
+	}
+	relPath := filepath.Join("templates", fmt.Sprintf("%d.%s", id, fileExt))
+	if relPath == t.Path {
+		return errors.New("audio file extension conflicts with the image")
+	}
+	path := filepath.Join(db.dir, relPath)
+	f, err := db.CreateFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if db.backend != nil {
+		if err := db.putFile(context.Background(), path); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("store template audio: %w", err)
+		}
+	}
+	t.Audio = relPath
+	if err := db.updateTemplateLocked(t); err != nil {
+		t.Audio = ""
+		return err
+	}
+	return nil
+}
+
 // GetVote returns the given user's vote on a single macro.
 // If vote < 0, the user downvoted this macro.
 // If vote == 0, the user did not vote on this macro.
@@ -464,9 +1555,16 @@ func (db *DB) GetVote(userID tailcfg.UserID, macroID int) (vote int, err error)
 func (db *DB) SetVote(userID tailcfg.UserID, macroID, vote int) (*tmemes.Macro, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	m, ok := db.macros[macroID]
+	if err := db.injectFault("SetVote"); err != nil {
+		return nil, err
+	}
+	m, ok := db.macros[macroID]
 	if !ok {
 		return nil, fmt.Errorf("macro %d not found", macroID)
+	} else if m.VotesFrozen {
+		return nil, ErrVotesFrozen
+	} else if vote != 0 && m.Creator == userID && db.selfVotes == SelfVotesDeny {
+		return nil, ErrSelfVote
 	}
 	tx, err := db.sqldb.Begin()
 	if err != nil {
@@ -482,7 +1580,11 @@ func (db *DB) SetVote(userID tailcfg.UserID, macroID, vote int) (*tmemes.Macro,
 		if err := tx.Commit(); err != nil {
 			return nil, err
 		}
-		return m, db.fillMacroVotesLocked(m)
+		if err := db.fillMacroVotesLocked(m); err != nil {
+			return m, err
+		}
+		db.publishVotesLocked(m)
+		return m, nil
 	}
 
 	// Pin votes to the allowed values, +1 for up, -1 for down.
@@ -490,8 +1592,8 @@ func (db *DB) SetVote(userID tailcfg.UserID, macroID, vote int) (*tmemes.Macro,
 	if vote < 0 {
 		flag = -1
 	}
-	_, err = tx.Exec(`INSERT OR REPLACE INTO Votes (user_id, macro_id, vote) VALUES (?, ?, ?)`,
-		userID, macroID, flag)
+	_, err = tx.Exec(`INSERT OR REPLACE INTO Votes (user_id, macro_id, vote, variant) VALUES (?, ?, ?, ?)`,
+		userID, macroID, flag, m.ViewerVariant(userID))
 	if err != nil {
 		return nil, err
 	} else if err := tx.Commit(); err != nil {
@@ -500,9 +1602,58 @@ func (db *DB) SetVote(userID tailcfg.UserID, macroID, vote int) (*tmemes.Macro,
 	if err := db.fillMacroVotesLocked(m); err != nil {
 		return nil, err
 	}
+	db.publishVotesLocked(m)
 	return m, nil
 }
 
+// VariantVotes reports the upvote and downvote totals for each caption
+// variant of the specified macro, indexed by variant. If the macro has no
+// caption test, it has a single variant.
+func (db *DB) VariantVotes(macroID int) (up, down []int, _ error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	m, ok := db.macros[macroID]
+	if !ok {
+		return nil, nil, fmt.Errorf("macro %d not found", macroID)
+	}
+	return db.variantVotesLocked(m)
+}
+
+func (db *DB) variantVotesLocked(m *tmemes.Macro) (up, down []int, _ error) {
+	n := 1
+	if m.CaptionTest != nil {
+		n = max(n, len(m.CaptionTest.Variants))
+	}
+	up, down = make([]int, n), make([]int, n)
+	// When self-votes are ignored, exclude the creator's vote. Other user IDs
+	// are never negative, so -1 excludes nothing.
+	exclude := tailcfg.UserID(-1)
+	if db.selfVotes == SelfVotesIgnore {
+		exclude = m.Creator
+	}
+	rows, err := db.sqldb.Query(`SELECT variant, vote, count(*) FROM Votes WHERE macro_id = ? AND user_id != ? GROUP BY variant, vote`,
+		m.ID, exclude)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var variant, vote, count int
+		if err := rows.Scan(&variant, &vote, &count); err != nil {
+			return nil, nil, err
+		}
+		if variant < 0 || variant >= n {
+			continue // ignore stray variants
+		}
+		if vote > 0 {
+			up[variant] += count
+		} else {
+			down[variant] += count
+		}
+	}
+	return up, down, rows.Err()
+}
+
 // UserMacroVote reports the vote status of the given user for a single macro.
 // The result is -1 for a downvote, 1 for an upvote, 0 for no vote.
 func (db *DB) UserMacroVote(userID tailcfg.UserID, macroID int) (int, error) {
@@ -544,3 +1695,547 @@ func (db *DB) UserVotes(userID tailcfg.UserID) (map[int]int, error) {
 	}
 	return out, rows.Err()
 }
+
+// AddPushSubscription records a Web Push subscription for the given user.
+// If a subscription with the same endpoint exists, it is replaced.
+func (db *DB) AddPushSubscription(userID tailcfg.UserID, sub *tmemes.PushSubscription) error {
+	if sub.Endpoint == "" {
+		return errors.New("missing push endpoint")
+	}
+	bits, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, err = db.sqldb.Exec(`INSERT OR REPLACE INTO PushSubscriptions (endpoint, user_id, raw) VALUES (?, ?, ?)`,
+		sub.Endpoint, userID, bits)
+	return err
+}
+
+// RemovePushSubscription removes the Web Push subscription with the given
+// endpoint, if it exists. If userID > 0, the subscription is removed only if
+// it belongs to that user.
+func (db *DB) RemovePushSubscription(userID tailcfg.UserID, endpoint string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var err error
+	if userID > 0 {
+		_, err = db.sqldb.Exec(`DELETE FROM PushSubscriptions WHERE endpoint = ? AND user_id = ?`,
+			endpoint, userID)
+	} else {
+		_, err = db.sqldb.Exec(`DELETE FROM PushSubscriptions WHERE endpoint = ?`, endpoint)
+	}
+	return err
+}
+
+// PushSubscriptions returns all the Web Push subscriptions for the given user.
+func (db *DB) PushSubscriptions(userID tailcfg.UserID) ([]*tmemes.PushSubscription, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows, err := db.sqldb.Query(`SELECT raw FROM PushSubscriptions WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*tmemes.PushSubscription
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var sub tmemes.PushSubscription
+		if err := json.Unmarshal(raw, &sub); err != nil {
+			return nil, fmt.Errorf("decode push subscription: %w", err)
+		}
+		out = append(out, &sub)
+	}
+	return out, rows.Err()
+}
+
+// AddReport records a new report for review by a moderator. It reports an
+// error if r.ID != 0, or updates r.ID on success.
+func (db *DB) AddReport(r *tmemes.Report) error {
+	if r.ID != 0 {
+		return errors.New("report ID must be zero")
+	} else if r.Kind != "macro" && r.Kind != "template" {
+		return fmt.Errorf("invalid report kind %q", r.Kind)
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now().UTC()
+	}
+	bits, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, err := db.sqldb.Exec(`INSERT INTO Reports (raw) VALUES (?)`, bits)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	r.ID = int(id)
+	return nil
+}
+
+// Reports returns all the reports awaiting review, oldest first.
+func (db *DB) Reports() ([]*tmemes.Report, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return queryRaw[tmemes.Report](db.sqldb, func(r *tmemes.Report, id int) { r.ID = id },
+		`SELECT id, raw FROM Reports ORDER BY id`)
+}
+
+// Report returns the report with the specified ID.
+func (db *DB) Report(id int) (*tmemes.Report, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rs, err := queryRaw[tmemes.Report](db.sqldb, func(r *tmemes.Report, id int) { r.ID = id },
+		`SELECT id, raw FROM Reports WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	} else if len(rs) == 0 {
+		return nil, fmt.Errorf("report %d not found", id)
+	}
+	return rs[0], nil
+}
+
+// ResolveReport removes the specified report from the review queue, and
+// records e in the audit log as the decision made about it.
+func (db *DB) ResolveReport(id int, e *tmemes.AuditEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM Reports WHERE id = ?`, id)
+	if err != nil {
+		return err
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("report %d not found", id)
+	}
+	if err := addAuditEntry(tx, e); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddAuditEntry records e in the audit log, and updates e.ID on success.
+func (db *DB) AddAuditEntry(e *tmemes.AuditEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return addAuditEntry(db.sqldb, e)
+}
+
+// LogEvent records in the audit log that the specified user performed action
+// on the item of the given kind and ID, such as creating a macro or voting.
+func (db *DB) LogEvent(actor tailcfg.UserID, action, kind string, targetID int) error {
+	return db.AddAuditEntry(&tmemes.AuditEntry{
+		Actor:    actor,
+		Action:   action,
+		Kind:     kind,
+		TargetID: targetID,
+	})
+}
+
+// AuditLog returns up to limit of the most recent audit log entries, newest
+// first. If limit ≤ 0, all entries are returned.
+func (db *DB) AuditLog(limit int) ([]*tmemes.AuditEntry, error) {
+	entries, _, err := db.AuditLogPage(0, limit)
+	return entries, err
+}
+
+// AuditLogPage returns up to limit audit log entries, newest first, after
+// skipping the offset most recent ones. If limit ≤ 0, all remaining entries
+// are returned. It also reports the total number of entries in the log.
+func (db *DB) AuditLogPage(offset, limit int) ([]*tmemes.AuditEntry, int, error) {
+	if limit <= 0 {
+		limit = -1 // SQLite: no limit
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var total int
+	if err := db.sqldb.QueryRow(`SELECT count(*) FROM AuditLog`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	entries, err := queryRaw[tmemes.AuditEntry](db.sqldb, func(e *tmemes.AuditEntry, id int) { e.ID = id },
+		`SELECT id, raw FROM AuditLog ORDER BY id DESC LIMIT ? OFFSET ?`, limit, offset)
+	return entries, total, err
+}
+
+// AddAPIToken records tok, whose secret has the given hash. It reports an
+// error if tok.ID != 0, or updates tok.ID on success.
+func (db *DB) AddAPIToken(tok *tmemes.APIToken, hash []byte) error {
+	if tok.ID != 0 {
+		return errors.New("token ID must be zero")
+	} else if len(hash) == 0 {
+		return errors.New("missing token hash")
+	}
+	if tok.CreatedAt.IsZero() {
+		tok.CreatedAt = time.Now().UTC()
+	}
+	bits, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, err := db.sqldb.Exec(`INSERT INTO APITokens (hash, user_id, raw) VALUES (?, ?, ?)`,
+		hash, tok.UserID, bits)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	tok.ID = int(id)
+	return nil
+}
+
+// APITokenByHash returns the token whose secret has the given hash.
+func (db *DB) APITokenByHash(hash []byte) (*tmemes.APIToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ts, err := queryRaw[tmemes.APIToken](db.sqldb, func(t *tmemes.APIToken, id int) { t.ID = id },
+		`SELECT id, raw FROM APITokens WHERE hash = ?`, hash)
+	if err != nil {
+		return nil, err
+	} else if len(ts) == 0 {
+		return nil, errors.New("token not found")
+	}
+	return ts[0], nil
+}
+
+// APITokens returns all the tokens issued by the given user, oldest first.
+func (db *DB) APITokens(userID tailcfg.UserID) ([]*tmemes.APIToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return queryRaw[tmemes.APIToken](db.sqldb, func(t *tmemes.APIToken, id int) { t.ID = id },
+		`SELECT id, raw FROM APITokens WHERE user_id = ? ORDER BY id`, userID)
+}
+
+// DeleteAPIToken revokes the token with the specified ID, which must have been
+// issued by the given user.
+func (db *DB) DeleteAPIToken(userID tailcfg.UserID, id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, err := db.sqldb.Exec(`DELETE FROM APITokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("token %d not found", id)
+	}
+	return nil
+}
+
+// UserPrefs returns the preferences for the specified user. If the user has
+// not set any preferences, it returns the defaults.
+func (db *DB) UserPrefs(userID tailcfg.UserID) *tmemes.UserPrefs {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if p, ok := db.prefs[userID]; ok {
+		cp := *p
+		return &cp
+	}
+	return new(tmemes.UserPrefs)
+}
+
+// SetUserPrefs replaces the preferences for the specified user with p.  It
+// reports an error if p is not valid, or if p sets a handle that another user
+// already has (ignoring case).
+func (db *DB) SetUserPrefs(userID tailcfg.UserID, p *tmemes.UserPrefs) error {
+	if err := p.Valid(); err != nil {
+		return err
+	}
+	bits, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if p.Handle != "" {
+		for id, op := range db.prefs {
+			if id != userID && strings.EqualFold(op.Handle, p.Handle) {
+				return fmt.Errorf("handle %q is already taken", p.Handle)
+			}
+		}
+	}
+	if _, err := db.sqldb.Exec(`INSERT OR REPLACE INTO UserPrefs (user_id, raw) VALUES (?, ?)`,
+		userID, bits); err != nil {
+		return err
+	}
+	cp := *p
+	db.prefs[userID] = &cp
+	return nil
+}
+
+// UserProfiles returns the tailnet user profiles saved by SaveUserProfiles.
+func (db *DB) UserProfiles() (map[tailcfg.UserID]tailcfg.UserProfile, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows, err := db.sqldb.Query(`SELECT user_id, raw FROM UserProfiles`)
+	if err != nil {
+		return nil, fmt.Errorf("loading user profiles: %w", err)
+	}
+	defer rows.Close()
+	out := make(map[tailcfg.UserID]tailcfg.UserProfile)
+	for rows.Next() {
+		var id tailcfg.UserID
+		var raw []byte
+		if err := rows.Scan(&id, &raw); err != nil {
+			return nil, fmt.Errorf("scanning user profile: %w", err)
+		}
+		var up tailcfg.UserProfile
+		if err := json.Unmarshal(raw, &up); err != nil {
+			return nil, fmt.Errorf("decode profile for user %d: %w", id, err)
+		}
+		out[id] = up
+	}
+	return out, rows.Err()
+}
+
+// SaveUserProfiles records the given tailnet user profiles, replacing any
+// previously saved for the same users. Profiles of other users are kept.
+func (db *DB) SaveUserProfiles(ups map[tailcfg.UserID]tailcfg.UserProfile) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, up := range ups {
+		bits, err := json.Marshal(up)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO UserProfiles (user_id, raw, updated_at) VALUES (?, ?, ?)`,
+			id, bits, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// FileEtag returns the Etag recorded by SaveFileEtag for the file at path, if
+// the file still has the size and modification time given by fi.
+func (db *DB) FileEtag(path string, fi fs.FileInfo) (string, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var size, mtime int64
+	var tag string
+	if err := db.sqldb.QueryRow(`SELECT size, mtime, etag FROM FileEtags WHERE path = ?`,
+		db.relPath(path)).Scan(&size, &mtime, &tag); err != nil {
+		return "", false
+	}
+	if size != fi.Size() || mtime != fi.ModTime().UnixNano() {
+		return "", false // the file has changed
+	}
+	return tag, true
+}
+
+// SaveFileEtag records tag as the Etag of the file at path, whose size and
+// modification time are given by fi.
+func (db *DB) SaveFileEtag(path string, fi fs.FileInfo, tag string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, err := db.sqldb.Exec(`INSERT OR REPLACE INTO FileEtags (path, size, mtime, etag) VALUES (?, ?, ?, ?)`,
+		db.relPath(path), fi.Size(), fi.ModTime().UnixNano(), tag)
+	return err
+}
+
+// forgetFileEtagLocked discards the Etag recorded for the file at path.
+func (db *DB) forgetFileEtagLocked(path string) {
+	if _, err := db.sqldb.Exec(`DELETE FROM FileEtags WHERE path = ?`, db.relPath(path)); err != nil {
+		log.Printf("WARNING: forgetting Etag of %q: %v (continuing)", path, err)
+	}
+}
+
+// relPath returns path relative to the store directory, if it is inside it,
+// so that recorded paths remain valid if the directory is moved.
+func (db *DB) relPath(path string) string {
+	if rel, err := filepath.Rel(db.dir, path); err == nil && filepath.IsLocal(rel) {
+		return rel
+	}
+	return path
+}
+
+// CreatorName returns the display name last recorded for the specified user
+// by SetCreatorName, or "" if none is recorded.
+func (db *DB) CreatorName(userID tailcfg.UserID) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.creatorNames[userID]
+}
+
+// ReassignCreator changes the creator of all the templates and macros created
+// by from to the user to, which may be -1 to make them anonymous. It reports
+// the number of templates and macros changed.
+func (db *DB) ReassignCreator(from, to tailcfg.UserID) (templates, macros int, _ error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, t := range db.templates {
+		if t.Creator != from {
+			continue
+		}
+		t.Creator = to
+		if err := db.updateTemplateLocked(t); err != nil {
+			t.Creator = from
+			return templates, macros, fmt.Errorf("template %d: %w", t.ID, err)
+		}
+		templates++
+	}
+	for _, m := range db.macros {
+		if m.Creator != from {
+			continue
+		}
+		m.Creator = to
+		if err := db.updateMacroLocked(m); err != nil {
+			m.Creator = from
+			return templates, macros, fmt.Errorf("macro %d: %w", m.ID, err)
+		}
+		macros++
+	}
+	return templates, macros, nil
+}
+
+// SetCreatorName records name as the display name of the specified user, so
+// that searches can match macros and templates by who created them.
+func (db *DB) SetCreatorName(userID tailcfg.UserID, name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if old, ok := db.creatorNames[userID]; ok && old == name {
+		return nil // no change
+	}
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO CreatorNames (user_id, name) VALUES (?, ?)`,
+		userID, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE SearchIndex SET creator = ? WHERE creator_id = ?`,
+		name, userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.creatorNames[userID] = name
+	return nil
+}
+
+// Search returns up to limit each of the macros and templates whose text,
+// name, or creator's name match the given query, best match first. The query
+// is free text, and matches items that contain all its words (or words that
+// begin with them). Hidden templates and macros are not included.
+func (db *DB) Search(query string, limit int) ([]*tmemes.Macro, []*tmemes.Template, error) {
+	q, ok := searchQuery(query)
+	if !ok {
+		return nil, nil, errors.New("empty search query")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows, err := db.sqldb.Query(`SELECT kind, item_id FROM SearchIndex WHERE SearchIndex MATCH ? ORDER BY rank`, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var macros []*tmemes.Macro
+	var templates []*tmemes.Template
+	for rows.Next() {
+		var kind string
+		var id int
+		if err := rows.Scan(&kind, &id); err != nil {
+			return nil, nil, err
+		}
+		switch kind {
+		case "macro":
+			if m, ok := db.macros[id]; ok && len(macros) < limit {
+				macros = append(macros, m)
+			}
+		case "template":
+			if t, ok := db.templates[id]; ok && !t.Hidden && len(templates) < limit {
+				templates = append(templates, t)
+			}
+		}
+		if len(macros) >= limit && len(templates) >= limit {
+			break
+		}
+	}
+	return macros, templates, rows.Err()
+}
+
+// AllVotes returns all the votes recorded in the store, ordered by macro ID
+// and then by user ID.
+func (db *DB) AllVotes() ([]tmemes.Vote, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows, err := db.sqldb.Query(`SELECT user_id, macro_id, vote, variant, last_update FROM Votes ORDER BY macro_id, user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []tmemes.Vote
+	for rows.Next() {
+		var v tmemes.Vote
+		if err := rows.Scan(&v.UserID, &v.MacroID, &v.Vote, &v.Variant, &v.LastUpdate); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// ImportVotes adds the given votes to the store. Votes for macros not in the
+// store, or with a vote value other than 1 or -1, are skipped. If a user has
+// already voted on a macro, their existing vote is kept. It reports the number
+// of votes added.
+func (db *DB) ImportVotes(votes []tmemes.Vote) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	tx, err := db.sqldb.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var added int
+	touched := make(map[int]*tmemes.Macro)
+	for _, v := range votes {
+		m, ok := db.macros[v.MacroID]
+		if !ok || (v.Vote != 1 && v.Vote != -1) {
+			continue
+		}
+		if v.LastUpdate.IsZero() {
+			v.LastUpdate = time.Now().UTC()
+		}
+		res, err := tx.Exec(`INSERT OR IGNORE INTO Votes (user_id, macro_id, vote, variant, last_update) VALUES (?, ?, ?, ?, ?)`,
+			v.UserID, v.MacroID, v.Vote, v.Variant, v.LastUpdate.UTC().Format(time.DateTime))
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			added++
+			touched[m.ID] = m
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for _, m := range touched {
+		if err := db.fillMacroVotesLocked(m); err != nil {
+			return added, err
+		}
+		db.publishVotesLocked(m)
+	}
+	return added, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tailscale/tmemes"
+)
+
+// AddWebhook adds w to the database. It reports an error if w.ID != 0, or
+// updates w.ID on success.
+func (db *DB) AddWebhook(w *tmemes.Webhook) error {
+	if w.ID != 0 {
+		return errors.New("webhook ID must be zero")
+	} else if w.URL == "" {
+		return errors.New("empty webhook URL")
+	}
+	if w.CreatedAt.IsZero() {
+		w.CreatedAt = time.Now().UTC()
+	}
+	bits, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, err := db.sqldb.Exec(`INSERT INTO Webhooks (raw) VALUES (?)`, bits)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	w.ID = int(id)
+	return nil
+}
+
+// Webhooks returns all the webhooks in the database, ordered by ID.
+func (db *DB) Webhooks() ([]*tmemes.Webhook, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return queryRaw[tmemes.Webhook](db.sqldb, func(w *tmemes.Webhook, id int) { w.ID = id },
+		`SELECT id, raw FROM Webhooks ORDER BY id`)
+}
+
+// SetWebhookStatus records the result of a delivery to the webhook with the
+// given ID, at the given time: if derr is nil, the delivery succeeded. It
+// does nothing if the webhook no longer exists.
+func (db *DB) SetWebhookStatus(id int, at time.Time, derr error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var raw []byte
+	err := db.sqldb.QueryRow(`SELECT raw FROM Webhooks WHERE id = ?`, id).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // deleted while delivering
+	} else if err != nil {
+		return err
+	}
+	var w tmemes.Webhook
+	if err := json.Unmarshal(raw, &w); err != nil {
+		return fmt.Errorf("decode webhook: %w", err)
+	}
+	if derr != nil {
+		w.LastError = derr.Error()
+	} else {
+		w.LastDelivery = at.UTC()
+		w.LastError = ""
+	}
+	bits, err := json.Marshal(&w)
+	if err != nil {
+		return err
+	}
+	_, err = db.sqldb.Exec(`UPDATE Webhooks SET raw = ? WHERE id = ?`, bits, id)
+	return err
+}
+
+// DeleteWebhook removes the webhook with the given ID.
+func (db *DB) DeleteWebhook(id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, err := db.sqldb.Exec(`DELETE FROM Webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("webhook %d not found", id)
+	}
+	return nil
+}
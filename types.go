@@ -7,12 +7,19 @@
 package tmemes
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"tailscale.com/tailcfg"
 )
@@ -29,6 +36,41 @@ type Template struct {
 	Areas     []Area         `json:"areas,omitempty"` // optional predefined areas
 	Hidden    bool           `json:"hidden,omitempty"`
 
+	// The name of the Category the template belongs to, if any.
+	Category string `json:"category,omitempty"`
+
+	// An optional description of the template, such as where its image comes
+	// from or how it is usually captioned.
+	Description string `json:"description,omitempty"`
+
+	// If set, the template is not safe for work. Its image, and those of the
+	// macros made from it, are served blurred unless the viewer asks to see
+	// them.
+	NSFW bool `json:"nsfw,omitempty"`
+
+	// The number of macros made from the template, including hidden ones. It
+	// is computed by the server.
+	MacroCount int `json:"macroCount"`
+
+	// A perceptual hash of the template image, used to find similar
+	// templates. It is computed by the server.
+	ImageHash uint64 `json:"imageHash,omitempty,string"`
+
+	// The SHA-256 digest (hex) of the template image file, used to detect
+	// uploads of an image that is already a template. It is computed by the
+	// server.
+	ContentHash string `json:"contentHash,omitempty"`
+
+	// A template is damaged if its image file has gone missing from the
+	// store, so macros made from it cannot be rendered. An admin can repair
+	// it by uploading the image again.
+	Damaged bool `json:"damaged,omitempty"`
+
+	// For an audio template, the path of its sound clip. The image of an
+	// audio template is a waveform of the clip, generated by the server, and
+	// macros made from it play the clip alongside their image.
+	Audio string `json:"audio,omitempty"`
+
 	// If a template is hidden, macros based on it are still usable, but the
 	// service won't list it as available and won't let you create new macros
 	// from it. This way we can "delete" a template without screwing up the
@@ -47,13 +89,132 @@ type Macro struct {
 	TextOverlay []TextLine     `json:"textOverlay"`
 	ContextLink []ContextLink  `json:"contextLink,omitempty"`
 
+	// Stickers pasted onto the template, drawn in order beneath the text.
+	ImageOverlay []ImageOverlay `json:"imageOverlay,omitempty"`
+
 	Upvotes   int `json:"upvotes,omitempty"`
 	Downvotes int `json:"downvotes,omitempty"`
+
+	// The number of times the text overlay has been edited since creation.
+	Revision int `json:"revision,omitempty"`
+
+	// If set, the macro is running (or has run) an A/B test of alternative
+	// text overlays. See CaptionTest.
+	CaptionTest *CaptionTest `json:"captionTest,omitempty"`
+
+	// If set, options for playing back a macro on an animated template. It is
+	// ignored for still templates.
+	Playback *Playback `json:"playback,omitempty"`
+
+	// If set, the macro is not safe for work, and its image is served blurred
+	// unless the viewer asks to see it. A macro on a template marked NSFW is
+	// treated the same way.
+	NSFW bool `json:"nsfw,omitempty"`
+
+	// If set, the creator has chosen to share the macro outside the tailnet.
+	// It is served at a signed public URL if the server has Funnel enabled.
+	Public bool `json:"public,omitempty"`
+
+	// Moderation flags, which only admins can set. A hidden macro is shown
+	// only to admins; a locked macro cannot be edited or deleted by its
+	// creator; and the votes on a macro with frozen votes cannot change.
+	Hidden      bool `json:"hidden,omitempty"`
+	Locked      bool `json:"locked,omitempty"`
+	VotesFrozen bool `json:"votesFrozen,omitempty"`
+}
+
+// CaptionHash returns a hash of the text of lines, for finding macros that
+// make the same joke. Case, spacing, and empty lines are ignored, and so are
+// the placement and colors of the text. The hash is the hex-encoded SHA-256
+// of the remaining lines, each lower-cased with its words separated by single
+// spaces, joined by newlines.
+func CaptionHash(lines []TextLine) string {
+	var norm []string
+	for _, tl := range lines {
+		if words := strings.Fields(strings.ToLower(tl.Text)); len(words) > 0 {
+			norm = append(norm, strings.Join(words, " "))
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(norm, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Playback describes how the frames of an animated macro are played.
+//
+// The reordering is applied before text is drawn, so the Start and End of
+// each text line refer to the frames as played.
+type Playback struct {
+	Reverse   bool `json:"reverse,omitempty"`   // play the frames in reverse
+	Boomerang bool `json:"boomerang,omitempty"` // play forward, then backward
+
+	// A multiplier for the speed of the animation: 0.5, 1, or 2.
+	// A value of 0 is treated as 1.
+	Speed float64 `json:"speed,omitempty"`
+}
+
+// ValidForCreate reports whether p is valid for creation of a macro.
+func (p *Playback) ValidForCreate() error {
+	switch p.Speed {
+	case 0, 0.5, 1, 2:
+		return nil
+	}
+	return fmt.Errorf("unsupported playback speed %g", p.Speed)
 }
 
 // MaxContextLinks is the maximum number of context links permitted on a macro.
 const MaxContextLinks = 3
 
+// MaxCaptionVariants is the maximum number of variants, including the
+// original, permitted in a caption test.
+const MaxCaptionVariants = 4
+
+// A CaptionTest is an A/B test of alternative text overlays for a macro.
+//
+// While the test is running, each viewer is consistently shown one of the
+// variants, and votes are tallied separately for each variant. When the test
+// ends, the variant with the best net vote count (ties going to the earliest)
+// becomes the TextOverlay of the macro.
+type CaptionTest struct {
+	// The text overlays under test. Variant 0 is the original TextOverlay of
+	// the macro. When creating a macro, list only the alternatives; the
+	// original is added by ValidForCreate.
+	Variants [][]TextLine `json:"variants"`
+
+	// When the test ends.
+	Ends time.Time `json:"ends"`
+
+	Done   bool `json:"done,omitempty"`   // whether the test has ended
+	Winner int  `json:"winner,omitempty"` // the winning variant (if done)
+}
+
+// Active reports whether t is a caption test still running at the given time.
+func (t *CaptionTest) Active(now time.Time) bool {
+	return t != nil && !t.Done && now.Before(t.Ends)
+}
+
+// ViewerVariant reports which caption variant of m should be shown to the
+// specified viewer. It returns 0 unless m has an active caption test.
+// Variants are assigned to viewers in rotation, so that each viewer always
+// sees (and votes on) the same one.
+func (m *Macro) ViewerVariant(viewer tailcfg.UserID) int {
+	if !m.CaptionTest.Active(time.Now()) {
+		return 0
+	}
+	n := uint64(len(m.CaptionTest.Variants))
+	return int((uint64(viewer) + uint64(m.ID)) % n)
+}
+
+// Variant returns a copy of m whose text overlay is caption variant i.  If m
+// has no caption test, or i is out of range, it returns m itself.
+func (m *Macro) Variant(i int) *Macro {
+	if m.CaptionTest == nil || i <= 0 || i >= len(m.CaptionTest.Variants) {
+		return m
+	}
+	cp := *m
+	cp.TextOverlay = m.CaptionTest.Variants[i]
+	return &cp
+}
+
 // ValidForCreate reports whether m is valid for the creation of a new macro.
 func (m *Macro) ValidForCreate() error {
 	switch {
@@ -61,10 +222,14 @@ func (m *Macro) ValidForCreate() error {
 		return errors.New("macro ID must be zero")
 	case m.TemplateID <= 0:
 		return errors.New("macro must have a template ID")
-	case len(m.TextOverlay) == 0:
+	case len(m.TextOverlay) == 0 && len(m.ImageOverlay) == 0:
 		return errors.New("macro must have an overlay")
+	case len(m.ImageOverlay) > MaxImageOverlays:
+		return errors.New("too many image overlays")
 	case m.Upvotes != 0 || m.Downvotes != 0:
 		return errors.New("macro must not contain votes")
+	case m.Revision != 0:
+		return errors.New("macro must not have a revision")
 	case m.Creator > 0:
 		return errors.New("invalid macro creator")
 	case len(m.ContextLink) > MaxContextLinks:
@@ -88,6 +253,93 @@ func (m *Macro) ValidForCreate() error {
 			return err
 		}
 	}
+	for _, ov := range m.ImageOverlay {
+		if err := ov.ValidForCreate(); err != nil {
+			return err
+		}
+	}
+	if ct := m.CaptionTest; ct != nil {
+		switch {
+		case ct.Done || ct.Winner != 0:
+			return errors.New("caption test must not be finished")
+		case !time.Now().Before(ct.Ends):
+			return errors.New("caption test must end in the future")
+		case len(ct.Variants) == 0:
+			return errors.New("caption test must have variants")
+		case len(ct.Variants)+1 > MaxCaptionVariants:
+			return errors.New("too many caption variants")
+		}
+		for i, v := range ct.Variants {
+			if len(v) == 0 {
+				return fmt.Errorf("caption variant %d is empty", i+1)
+			}
+			for _, tl := range v {
+				if err := tl.ValidForCreate(); err != nil {
+					return fmt.Errorf("caption variant %d: %w", i+1, err)
+				}
+			}
+		}
+		ct.Variants = append([][]TextLine{m.TextOverlay}, ct.Variants...)
+	}
+	if m.Playback != nil {
+		if err := m.Playback.ValidForCreate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaxImageOverlays is the maximum number of image overlays permitted on a
+// macro.
+const MaxImageOverlays = 8
+
+// A Sticker is a small image, uploaded separately from templates, that can be
+// pasted onto macros as an ImageOverlay.
+type Sticker struct {
+	ID        int            `json:"id"`                // assigned by the server
+	Path      string         `json:"path"`              // path of image file
+	Width     int            `json:"width"`             // image width
+	Height    int            `json:"height"`            // image height
+	Creator   tailcfg.UserID `json:"creator,omitempty"` // -1 for anon
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// An ImageOverlay places a sticker on a macro.
+type ImageOverlay struct {
+	Sticker int `json:"sticker"` // the ID of the sticker
+
+	// The center of the sticker, as fractions 0..1 of the width and height of
+	// the image.
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+
+	// The width of the sticker as a fraction (0..1) of the width of the image;
+	// its height is scaled to match. If 0, DefaultStickerScale is used.
+	Scale float64 `json:"scale,omitempty"`
+
+	// The angle in degrees (-360..360) by which to rotate the sticker
+	// clockwise about its center.
+	RotateDegrees float64 `json:"rotateDegrees,omitempty"`
+}
+
+// DefaultStickerScale is the width of a sticker, as a fraction of the width
+// of the image, when an ImageOverlay does not specify a scale.
+const DefaultStickerScale = 0.25
+
+// ValidForCreate reports whether o is valid for creation of a macro.
+func (o ImageOverlay) ValidForCreate() error {
+	switch {
+	case o.Sticker <= 0:
+		return errors.New("image overlay must have a sticker ID")
+	case o.X < 0 || o.X > 1:
+		return fmt.Errorf("x out of range %g", o.X)
+	case o.Y < 0 || o.Y > 1:
+		return fmt.Errorf("y out of range %g", o.Y)
+	case o.Scale < 0 || o.Scale > 1:
+		return fmt.Errorf("scale out of range %g", o.Scale)
+	case o.RotateDegrees < -360 || o.RotateDegrees > 360:
+		return fmt.Errorf("rotation out of range %g", o.RotateDegrees)
+	}
 	return nil
 }
 
@@ -139,6 +391,10 @@ type Area struct {
 	Y     float64 `json:"y"`               // y offset of anchor as a fraciton 0..1 of height
 	Width float64 `json:"width,omitempty"` // width of text box as a fraction of image width
 
+	// A label for the area. This is required for the predefined areas of a
+	// template (see Template.Areas), and is otherwise optional.
+	Name string `json:"name,omitempty"`
+
 	// If true, adjust the effective coordinates for each frame by interpolating
 	// the distance between the given X, Y and the X, Y of the next area in
 	// sequence, when rendering multiple frames.
@@ -163,6 +419,29 @@ func (a Area) ValidForCreate() error {
 	return nil
 }
 
+// MaxTemplateAreas is the maximum number of predefined areas permitted on a
+// template.
+const MaxTemplateAreas = 8
+
+// MaxAreaNameLength is the maximum length in bytes of an area name.
+const MaxAreaNameLength = 32
+
+// MaxTemplateDescription is the maximum length in bytes of the description of
+// a template.
+const MaxTemplateDescription = 1024
+
+// ValidForTemplate reports whether a is valid as one of the predefined areas of
+// a template.
+func (a Area) ValidForTemplate() error {
+	switch {
+	case strings.TrimSpace(a.Name) == "":
+		return errors.New("area must have a name")
+	case len(a.Name) > MaxAreaNameLength:
+		return fmt.Errorf("area name is too long (max %d bytes)", MaxAreaNameLength)
+	}
+	return a.ValidForCreate()
+}
+
 // A TextLine is a single line of text with an optional alignment.
 type TextLine struct {
 	Text        string `json:"text"`
@@ -178,6 +457,12 @@ type TextLine struct {
 	// frames (Field[0] to frames 0, 1, 2, 3; Field[1] to frames 4, 5, 6, 7).
 	Field Areas `json:"field"`
 
+	// When creating a macro, the name of a predefined area of the template
+	// (see Template.Areas) to use when Field is empty. If neither is set, the
+	// server uses the template's area at the same position as this line, if
+	// there is one.
+	Area string `json:"area,omitempty"`
+
 	// The first point in a multi-frame image where this text should be visible,
 	// as a fraction (0..1) of the total frames of the image. For example, in an
 	// image with 16 frames, 0.25 represents 4 frames.
@@ -194,7 +479,130 @@ type TextLine struct {
 	// Otherwise, do not hide the text after the start index.
 	End float64 `json:"end,omitempty"` // 0..1
 
-	// TODO: size, typeface, linebreaks in long runs
+	// The name of the typeface to draw the text in (see GET /api/fonts). If
+	// empty, the server's default font is used.
+	Font string `json:"font,omitempty"`
+
+	// The height of the text as a fraction (0..1) of the height of the image.
+	// If 0, the size is chosen automatically, and reduced to fit the text into
+	// at most two lines; otherwise the text is drawn at this size regardless.
+	Size float64 `json:"size,omitempty"`
+
+	// The horizontal alignment of the text within the width of its area, one
+	// of "left", "center", or "right". If empty, the text is centered.
+	Align string `json:"align,omitempty"`
+
+	// The angle in degrees (-360..360) by which to rotate the text clockwise
+	// about the anchor of its area.
+	RotateDegrees float64 `json:"rotateDegrees,omitempty"`
+
+	// If set, the text is filled with a gradient from Color to another color,
+	// instead of with Color alone.
+	Gradient *Gradient `json:"gradient,omitempty"`
+
+	// If set, a box is drawn behind each line of the text, beneath its
+	// outline. To draw the box instead of the outline, make StrokeColor
+	// transparent.
+	Box *TextBox `json:"box,omitempty"`
+
+	// The width of the outline drawn around the text in StrokeColor, as a
+	// multiple of the height of the font the text is drawn in. If 0,
+	// DefaultOutlineWidth is used. To draw no outline, make StrokeColor
+	// transparent.
+	OutlineWidth float64 `json:"outlineWidth,omitempty"`
+
+	// If set, a shadow of the text and its outline is drawn beneath them.
+	Shadow *TextShadow `json:"shadow,omitempty"`
+
+	// TODO: linebreaks in long runs
+}
+
+// DefaultOutlineWidth is the width of the outline of a TextLine that does
+// not set OutlineWidth.
+const DefaultOutlineWidth = 0.06
+
+// A TextShadow is a drop shadow drawn beneath the text of a line and its
+// outline. The shadow does not turn with rotated text.
+type TextShadow struct {
+	Color Color `json:"color"`
+
+	// How far the shadow is moved right and down from the text, as multiples
+	// of the height of the font the text is drawn in. If both are 0, each is
+	// DefaultShadowOffset.
+	OffsetX float64 `json:"offsetX,omitempty"`
+	OffsetY float64 `json:"offsetY,omitempty"`
+
+	// The radius of the blur of the shadow, as a multiple of the height of
+	// the font. If 0, the shadow has sharp edges.
+	Blur float64 `json:"blur,omitempty"`
+}
+
+// DefaultShadowOffset is the offset of a TextShadow that does not set one.
+const DefaultShadowOffset = 0.05
+
+// ValidForCreate reports whether s is valid for creation of a macro.
+func (s TextShadow) ValidForCreate() error {
+	switch {
+	case s.OffsetX < -1 || s.OffsetX > 1:
+		return fmt.Errorf("shadow offsetX out of range %g", s.OffsetX)
+	case s.OffsetY < -1 || s.OffsetY > 1:
+		return fmt.Errorf("shadow offsetY out of range %g", s.OffsetY)
+	case s.Blur < 0 || s.Blur > 0.5:
+		return fmt.Errorf("shadow blur out of range %g", s.Blur)
+	}
+	return nil
+}
+
+// A TextBox is a rounded box drawn behind the text of a line, usually in a
+// translucent color, as is common for captions on screenshots.
+type TextBox struct {
+	Color Color `json:"color"`
+
+	// The space between the text and the edge of the box, as a multiple of
+	// the height of a line of text. If 0, DefaultBoxPadding is used.
+	Padding float64 `json:"padding,omitempty"`
+
+	// The radius of the corners of the box, as a multiple of the height of a
+	// line of text. If 0, DefaultBoxRadius is used.
+	Radius float64 `json:"radius,omitempty"`
+}
+
+// Default proportions of a TextBox.
+const (
+	DefaultBoxPadding = 0.2
+	DefaultBoxRadius  = 0.25
+)
+
+// ValidForCreate reports whether b is valid for creation of a macro.
+func (b TextBox) ValidForCreate() error {
+	switch {
+	case b.Padding < 0 || b.Padding > 2:
+		return fmt.Errorf("box padding out of range %g", b.Padding)
+	case b.Radius < 0 || b.Radius > 2:
+		return fmt.Errorf("box radius out of range %g", b.Radius)
+	}
+	return nil
+}
+
+// A Gradient is a two-stop linear gradient for filling the text of a line.
+// The gradient spans the bounds of the text, beginning with the Color of the
+// line and ending with To.
+type Gradient struct {
+	To Color `json:"to"`
+
+	// The direction of the gradient: "vertical" (top to bottom) or
+	// "horizontal" (left to right). If empty, the gradient is vertical. The
+	// gradient turns with the text if it is rotated.
+	Direction string `json:"direction,omitempty"`
+}
+
+// ValidForCreate reports whether g is valid for creation of a macro.
+func (g Gradient) ValidForCreate() error {
+	switch g.Direction {
+	case "", "vertical", "horizontal":
+		return nil
+	}
+	return fmt.Errorf("invalid gradient direction %q", g.Direction)
 }
 
 // ValidForCreate reports whether t is valid for creation of a macro.
@@ -208,6 +616,32 @@ func (t TextLine) ValidForCreate() error {
 		return fmt.Errorf("start out of range %g", t.Start)
 	case t.End < 0 || t.End > 1:
 		return fmt.Errorf("end out of range %g", t.End)
+	case t.Size < 0 || t.Size > 1:
+		return fmt.Errorf("size out of range %g", t.Size)
+	case t.RotateDegrees < -360 || t.RotateDegrees > 360:
+		return fmt.Errorf("rotation out of range %g", t.RotateDegrees)
+	case t.OutlineWidth < 0 || t.OutlineWidth > 0.5:
+		return fmt.Errorf("outline width out of range %g", t.OutlineWidth)
+	}
+	switch t.Align {
+	case "", "left", "center", "right":
+	default:
+		return fmt.Errorf("invalid alignment %q", t.Align)
+	}
+	if t.Gradient != nil {
+		if err := t.Gradient.ValidForCreate(); err != nil {
+			return err
+		}
+	}
+	if t.Box != nil {
+		if err := t.Box.ValidForCreate(); err != nil {
+			return err
+		}
+	}
+	if t.Shadow != nil {
+		if err := t.Shadow.ValidForCreate(); err != nil {
+			return err
+		}
 	}
 	for _, f := range t.Field {
 		if err := f.ValidForCreate(); err != nil {
@@ -217,14 +651,39 @@ func (t TextLine) ValidForCreate() error {
 	return nil
 }
 
+// TopBottom returns a text overlay with the given top and bottom captions,
+// positioned and colored the way the web UI does by default. Empty captions
+// are omitted, so the result may be empty.
+func TopBottom(top, bottom string) []TextLine {
+	var out []TextLine
+	if top != "" {
+		out = append(out, TextLine{
+			Text:        top,
+			Color:       MustColor("white"),
+			StrokeColor: MustColor("black"),
+			Field:       Areas{{X: 0.5, Y: 0.15, Width: 1}},
+		})
+	}
+	if bottom != "" {
+		out = append(out, TextLine{
+			Text:        bottom,
+			Color:       MustColor("white"),
+			StrokeColor: MustColor("black"),
+			Field:       Areas{{X: 0.5, Y: 0.85, Width: 1}},
+		})
+	}
+	return out
+}
+
 // ContextLink is a link to explain the context of a macro.
 type ContextLink struct {
 	URL  string `json:"url"`            // required
 	Text string `json:"text,omitempty"` // optional
 }
 
-// MustColor constructs a color from a known color name or hex specification
-// #xxx or #xxxxxx. It panics if s does not correspond to a valid color.
+// MustColor constructs a color from a CSS color specification, as accepted by
+// the UnmarshalText method of Color. It panics if s does not correspond to a
+// valid color.
 func MustColor(s string) Color {
 	var c Color
 	if err := c.UnmarshalText([]byte(s)); err != nil {
@@ -233,17 +692,31 @@ func MustColor(s string) Color {
 	return c
 }
 
-// A Color represents an RGB color encoded as hex. It supports encoding in JSON
-// as a string, allowing "#xxxxxx" or "#xxx" format (the "#" is optional).
-type Color [3]float64
+// A Color represents an sRGB color with opacity, as red, green, and blue
+// components in the range 0..1 and a transparency (one minus the opacity),
+// so that the zero Color is opaque black.
+//
+// It supports encoding in JSON as a string. Opaque colors are encoded as a
+// CSS color name if they have one, and otherwise as "#xxxxxx"; translucent
+// colors are encoded as "rgba(r, g, b, a)". Decoding accepts any of these,
+// and also "#xxx", "#xxxx", and "#xxxxxxxx" format (the "#" is optional), the
+// rgb(), rgba(), hsl(), and hsla() functions, and "transparent".
+type Color [4]float64
 
 func (c Color) R() float64 { return c[0] }
 func (c Color) G() float64 { return c[1] }
 func (c Color) B() float64 { return c[2] }
 
+// A returns the opacity of c, from 0 (transparent) to 1 (opaque).
+func (c Color) A() float64 { return 1 - c[3] }
+
 func (c Color) MarshalText() ([]byte, error) {
-	s := fmt.Sprintf("#%02x%02x%02x",
-		byte(c[0]*255), byte(c[1]*255), byte(c[2]*255))
+	if c.A() < 1 {
+		a := strconv.FormatFloat(math.Round(c.A()*1000)/1000, 'f', -1, 64)
+		return []byte(fmt.Sprintf("rgba(%d, %d, %d, %s)",
+			colorByte(c[0]), colorByte(c[1]), colorByte(c[2]), a)), nil
+	}
+	s := fmt.Sprintf("#%02x%02x%02x", colorByte(c[0]), colorByte(c[1]), colorByte(c[2]))
 
 	// Check for a name mapping.
 	if n, ok := c2n[s]; ok {
@@ -254,19 +727,34 @@ func (c Color) MarshalText() ([]byte, error) {
 
 func (c *Color) UnmarshalText(data []byte) error {
 	// As a special case, treat an empty string as "white".
-	if len(data) == 0 {
-		c[0], c[1], c[2] = 1, 1, 1
+	p := strings.ToLower(strings.TrimSpace(string(data)))
+	if p == "" {
+		*c = Color{1, 1, 1}
+		return nil
+	} else if p == "transparent" {
+		*c = Color{0, 0, 0, 1}
 		return nil
 	}
-	p := string(data)
 
 	// Check for a name mapping.
-	if c, ok := n2c[p]; ok {
-		p = c
+	if n, ok := colorAliases[p]; ok {
+		p = n
+	}
+	if h, ok := n2c[p]; ok {
+		p = h
+	}
+	if fn, args, ok := cutColorFunc(p); ok {
+		v, err := parseColorFunc(fn, args)
+		if err != nil {
+			return err
+		}
+		*c = v
+		return nil
 	}
 
 	p = strings.TrimPrefix(p, "#")
 	var r, g, b byte
+	a := byte(255)
 	var err error
 	switch len(p) {
 	case 3:
@@ -274,50 +762,29 @@ func (c *Color) UnmarshalText(data []byte) error {
 		r |= r << 4
 		g |= g << 4
 		b |= b << 4
+	case 4:
+		_, err = fmt.Sscanf(p, "%1x%1x%1x%1x", &r, &g, &b, &a)
+		r |= r << 4
+		g |= g << 4
+		b |= b << 4
+		a |= a << 4
 	case 6:
 		_, err = fmt.Sscanf(p, "%2x%2x%2x", &r, &g, &b)
+	case 8:
+		_, err = fmt.Sscanf(p, "%2x%2x%2x%2x", &r, &g, &b, &a)
 	default:
-		return errors.New("invalid hex color")
+		return errors.New("invalid color")
 	}
 	if err != nil {
 		return err
 	}
-	c[0], c[1], c[2] = float64(r)/255, float64(g)/255, float64(b)/255
+	*c = Color{float64(r) / 255, float64(g) / 255, float64(b) / 255, 1 - float64(a)/255}
 	return nil
 }
 
-// n2c maps color names to their equivalent hex strings in standard web RGB
-// format (#xxxxxx). Names should be normalized to lower-case. If multiple
-// names map to the same hex, the reverse mapping will not be deterministic.
-var n2c = map[string]string{
-	"white":   "#ffffff",
-	"silver":  "#c0c0c0",
-	"gray":    "#808080",
-	"black":   "#000000",
-	"red":     "#ff0000",
-	"maroon":  "#800000",
-	"yellow":  "#ffff00",
-	"olive":   "#808000",
-	"lime":    "#00ff00",
-	"green":   "#008000",
-	"aqua":    "#00ffff",
-	"teal":    "#008080",
-	"blue":    "#0000ff",
-	"navy":    "#000080",
-	"fuchsia": "#ff00ff",
-	"purple":  "#800080",
-}
-
-var c2n = make(map[string]string)
-
-func init() {
-	// Set up the reverse mapping from color code to name.
-	for n, c := range n2c {
-		_, ok := c2n[c]
-		if !ok {
-			c2n[c] = n
-		}
-	}
+// colorByte converts a color component in the range 0..1 to a byte.
+func colorByte(v float64) byte {
+	return byte(math.Round(math.Max(0, math.Min(1, v)) * 255))
 }
 
 // ContextRequest is the payload for the /api/context handler.
@@ -330,3 +797,304 @@ type ContextRequest struct {
 	// must be specified unless Action is "clear".
 	Link ContextLink `json:"link"`
 }
+
+// A PushSubscription is a Web Push subscription registered by a browser.  Its
+// JSON encoding matches the result of PushSubscription.toJSON() in the
+// browser.
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"` // push service URL
+	Keys     struct {
+		P256DH string `json:"p256dh"` // base64url client public key
+		Auth   string `json:"auth"`   // base64url authentication secret
+	} `json:"keys"`
+}
+
+// A Report is a user's complaint about a macro or template, awaiting review
+// by a moderator.
+type Report struct {
+	ID        int            `json:"id"`       // assigned by the server
+	Kind      string         `json:"kind"`     // "macro" or "template"
+	TargetID  int            `json:"targetID"` // ID of the reported item
+	Reporter  tailcfg.UserID `json:"reporter"`
+	Reason    string         `json:"reason"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// An AuditEntry records an action taken by an administrator or moderator, or
+// a routine action by a user such as creating content or voting. The Actor is
+// the user who made the request, even if the content they created is
+// anonymous.
+type AuditEntry struct {
+	ID        int            `json:"id"` // assigned by the server
+	Actor     tailcfg.UserID `json:"actor"`
+	Action    string         `json:"action"`             // e.g., "dismiss-report", "create"
+	Kind      string         `json:"kind,omitempty"`     // kind of target, if any
+	TargetID  int            `json:"targetID,omitempty"` // ID of target, if any
+	Reason    string         `json:"reason,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// An Event reports a change to the macros in the store, as streamed by
+// GET /api/events.
+type Event struct {
+	Type    string `json:"type"` // "create", "vote", or "delete"
+	MacroID int    `json:"macroID"`
+
+	// For "create", the new macro.
+	Macro *Macro `json:"macro,omitempty"`
+
+	// For "vote", the new vote totals of the macro.
+	Upvotes   int `json:"upvotes,omitempty"`
+	Downvotes int `json:"downvotes,omitempty"`
+}
+
+// Events that a Webhook may be notified of.
+const (
+	WebhookMacroCreated = "macro.created"
+	WebhookMacroDeleted = "macro.deleted"
+	WebhookVoteChanged  = "vote.changed"
+)
+
+// ValidWebhookEvent reports whether s is an event a webhook may be notified
+// of.
+func ValidWebhookEvent(s string) bool {
+	return s == WebhookMacroCreated || s == WebhookMacroDeleted || s == WebhookVoteChanged
+}
+
+// A Webhook is a URL registered by a server admin, to which the server posts
+// a signed JSON payload when one of the given events happens.
+type Webhook struct {
+	ID     int      `json:"id"` // assigned by the server
+	URL    string   `json:"url"`
+	Events []string `json:"events"` // the events to deliver; empty means all
+
+	// The key for signing payloads, with HMAC-SHA256. The server reports it
+	// only when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+
+	CreatedBy    tailcfg.UserID `json:"createdBy"`
+	CreatedAt    time.Time      `json:"createdAt"`
+	LastDelivery time.Time      `json:"lastDelivery,omitempty"` // last successful delivery
+	LastError    string         `json:"lastError,omitempty"`    // of the last delivery, if it failed
+}
+
+// Wants reports whether w should be notified of the given event.
+func (w *Webhook) Wants(event string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, event)
+}
+
+// Scopes that may be granted to an APIToken.
+const (
+	ScopeRead   = "read"   // read the API and content as the caller
+	ScopeCreate = "create" // create macros and templates
+	ScopeVote   = "vote"   // cast, inspect, and remove votes
+)
+
+// ValidScope reports whether s is a scope that may be granted to a token.
+func ValidScope(s string) bool {
+	return s == ScopeRead || s == ScopeCreate || s == ScopeVote
+}
+
+// An APIToken authorizes a non-interactive client, such as a CI job running on
+// a tagged node, to call the API on behalf of the user who issued it. Only a
+// hash of the token secret is stored.
+type APIToken struct {
+	ID        int            `json:"id"` // assigned by the server
+	UserID    tailcfg.UserID `json:"userID"`
+	LoginName string         `json:"loginName"`
+	Name      string         `json:"name,omitempty"` // chosen by the user
+	Scopes    []string       `json:"scopes"`
+	CreatedAt time.Time      `json:"createdAt"`
+	ExpiresAt *time.Time     `json:"expiresAt,omitempty"` // nil: no expiry
+}
+
+// HasScope reports whether t grants the specified scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether t has expired as of now.
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// UserPrefs are per-user preferences. The zero value is the default for a
+// user who has not set any preferences.
+type UserPrefs struct {
+	// If true, the user is excluded from leaderboards and other displays of
+	// top creators. Their macros still receive votes as usual.
+	HideFromLeaderboards bool `json:"hideFromLeaderboards,omitempty"`
+
+	// If set, this handle is shown instead of the user's tailnet profile name
+	// wherever tmemes attributes content to them.
+	Handle string `json:"handle,omitempty"`
+
+	// If true, the user has dismissed the getting-started tour, which is
+	// otherwise shown until they create their first macro.
+	DismissedTour bool `json:"dismissedTour,omitempty"`
+}
+
+// MaxHandleLength is the maximum length in runes of a user handle.
+const MaxHandleLength = 32
+
+// Valid reports whether p is a valid set of preferences.
+func (p *UserPrefs) Valid() error {
+	switch {
+	case p.Handle != strings.TrimSpace(p.Handle):
+		return errors.New("handle must not begin or end with spaces")
+	case utf8.RuneCountInString(p.Handle) > MaxHandleLength:
+		return fmt.Errorf("handle is longer than %d characters", MaxHandleLength)
+	case strings.IndexFunc(p.Handle, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0:
+		return errors.New("handle must not contain control characters")
+	}
+	return nil
+}
+
+// A Vote is a single user's vote on a macro, as exported for migration
+// between servers.
+type Vote struct {
+	UserID     tailcfg.UserID `json:"userID"`
+	MacroID    int            `json:"macroID"`
+	Vote       int            `json:"vote"`              // 1 for up, -1 for down
+	Variant    int            `json:"variant,omitempty"` // caption test variant
+	LastUpdate time.Time      `json:"lastUpdate"`
+}
+
+// Branding is the identity of a server as shown to its users, which server
+// admins can customize. Empty fields take their default values.
+type Branding struct {
+	Name        string         `json:"name,omitempty"`        // default "tmemes"
+	LogoURL     string         `json:"logoURL,omitempty"`     // default the tmemes icon
+	AccentColor *Color         `json:"accentColor,omitempty"` // e.g., of the navigation bar
+	FooterLinks []BrandingLink `json:"footerLinks,omitempty"` // shown at the bottom of each page
+}
+
+// A BrandingLink is a link shown in the footer of the UI.
+type BrandingLink struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+// Limits on the size of a Branding.
+const (
+	MaxBrandingName = 64 // runes
+	MaxFooterLinks  = 8
+)
+
+// Valid reports an error if b is not a valid branding. It also normalizes the
+// URLs in b.
+func (b *Branding) Valid() error {
+	switch {
+	case b.Name != strings.TrimSpace(b.Name):
+		return errors.New("name must not begin or end with spaces")
+	case utf8.RuneCountInString(b.Name) > MaxBrandingName:
+		return fmt.Errorf("name is longer than %d characters", MaxBrandingName)
+	case strings.IndexFunc(b.Name, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0:
+		return errors.New("name must not contain control characters")
+	case len(b.FooterLinks) > MaxFooterLinks:
+		return fmt.Errorf("too many footer links (max %d)", MaxFooterLinks)
+	}
+	if b.AccentColor != nil && b.AccentColor.A() < 1 {
+		return errors.New("accent color must be opaque")
+	}
+	if b.LogoURL != "" {
+		u, err := checkBrandingURL(b.LogoURL)
+		if err != nil {
+			return fmt.Errorf("invalid logo URL: %w", err)
+		}
+		b.LogoURL = u
+	}
+	for i, fl := range b.FooterLinks {
+		if strings.TrimSpace(fl.Text) == "" {
+			return fmt.Errorf("footer link %d has no text", i+1)
+		}
+		u, err := checkBrandingURL(fl.URL)
+		if err != nil {
+			return fmt.Errorf("invalid URL for footer link %d: %w", i+1, err)
+		}
+		b.FooterLinks[i].Text = strings.TrimSpace(fl.Text)
+		b.FooterLinks[i].URL = u
+	}
+	return nil
+}
+
+// checkBrandingURL checks that s is an "http" or "https" URL, or a path on
+// this server, and returns it properly escaped.
+func checkBrandingURL(s string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return "", err
+	} else if u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/") {
+		return u.String(), nil
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid scheme %q", u.Scheme)
+	}
+	return u.String(), nil
+}
+
+// A Moderator is a user whom a server admin has allowed to moderate content:
+// to resolve reports and hide macros and templates, but not to delete
+// templates or change the settings of the server.
+type Moderator struct {
+	UserID  tailcfg.UserID `json:"userID"`
+	AddedBy tailcfg.UserID `json:"addedBy"`
+	AddedAt time.Time      `json:"addedAt"`
+}
+
+// A Category is a group of related templates, such as "reaction" or
+// "animals". Server admins curate the list of categories, so that templates
+// can be browsed by category rather than in one long list.
+type Category struct {
+	Name        string `json:"name"` // unique, ignoring case
+	Description string `json:"description,omitempty"`
+}
+
+// MaxCategoryName is the maximum length in bytes of the name of a Category.
+const MaxCategoryName = 64
+
+// Valid reports an error if c is not a valid category.
+func (c *Category) Valid() error {
+	switch {
+	case c.Name == "":
+		return errors.New("category must have a name")
+	case c.Name != strings.TrimSpace(c.Name):
+		return errors.New("category name must not begin or end with spaces")
+	case len(c.Name) > MaxCategoryName:
+		return fmt.Errorf("category name is too long (max %d bytes)", MaxCategoryName)
+	case strings.ContainsAny(c.Name, "/?#&"):
+		return errors.New(`category name must not contain "/", "?", "#", or "&"`)
+	}
+	return nil
+}
+
+// A TemplatePack is a named set of templates that a server publishes, so that
+// other servers can subscribe to it and copy its templates.
+type TemplatePack struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Templates   []int     `json:"templates"` // template IDs, in order
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// A PackSubscription is a template pack published by another server, whose
+// templates this server copies and keeps up to date.
+type PackSubscription struct {
+	URL string `json:"url"` // where to fetch the pack
+
+	// The hex-encoded Ed25519 public key of the publisher. The pack must be
+	// signed with the corresponding private key.
+	PublicKey string `json:"publicKey"`
+
+	Name      string    `json:"name,omitempty"`      // as reported by the pack
+	LastSync  time.Time `json:"lastSync,omitempty"`  // last successful sync
+	LastError string    `json:"lastError,omitempty"` // of the last sync, if it failed
+
+	// Maps the SHA-256 digest (hex) of each template image copied from the
+	// pack to the ID of the local template made from it.
+	Templates map[string]int `json:"templates,omitempty"`
+}
@@ -38,6 +38,50 @@ func TestColorNames(t *testing.T) {
 	}
 }
 
+func TestColorSyntax(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"", "white"},
+		{"Red", "red"},
+		{"  grey ", "gray"},
+		{"cyan", "aqua"},
+		{"#123", "#112233"},
+		{"abcdef", "#abcdef"},
+		{"#ff000080", "rgba(255, 0, 0, 0.502)"},
+		{"#f008", "rgba(255, 0, 0, 0.533)"},
+		{"transparent", "rgba(0, 0, 0, 0)"},
+		{"rgb(255, 165, 0)", "orange"},
+		{"rgb(100% 0% 0%)", "red"},
+		{"rgba(0, 0, 255, 0.5)", "rgba(0, 0, 255, 0.5)"},
+		{"rgb(0 0 255 / 25%)", "rgba(0, 0, 255, 0.25)"},
+		{"rgb(300, -5, 0)", "red"},
+		{"hsl(120, 100%, 25%)", "green"},
+		{"hsl(0.5turn 100% 50%)", "aqua"},
+		{"hsla(240deg, 100%, 50%, 0.1)", "rgba(0, 0, 255, 0.1)"},
+	}
+	for _, tc := range tests {
+		var c Color
+		if err := c.UnmarshalText([]byte(tc.input)); err != nil {
+			t.Errorf("Unmarshal %q: unexpected error: %v", tc.input, err)
+			continue
+		}
+		out, err := c.MarshalText()
+		if err != nil {
+			t.Errorf("Marshal %v: unexpected error: %v", c, err)
+		} else if got := string(out); got != tc.want {
+			t.Errorf("Color %q: got %q, want %q", tc.input, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"bogus", "#12345", "rgb(1, 2)", "rgb(a b c)", "hsl(x, 1%, 1%)", "rgb(1 2 3 / q)"} {
+		var c Color
+		if err := c.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("Unmarshal %q: got %v, want error", bad, c)
+		}
+	}
+}
+
 func TestAreas(t *testing.T) {
 	tests := []struct {
 		input  string